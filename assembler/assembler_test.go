@@ -1,6 +1,8 @@
 package assembler
 
 import (
+	"assembly-emulator/emulator"
+	"bytes"
 	"testing"
 )
 
@@ -216,6 +218,7 @@ func TestNumberParsing(t *testing.T) {
 		{"0x2A", 42},
 		{"2Ah", 42},
 		{"0b101010", 42},
+		{"12345678h", 0x5678}, // Truncated to 16 bits
 	}
 
 	for _, tt := range tests {
@@ -229,6 +232,16 @@ func TestNumberParsing(t *testing.T) {
 			}
 		})
 	}
+
+	// ParseNumber32 keeps the whole doubleword
+	for input, expected := range map[string]uint32{"12345678h": 0x12345678, "-1": 0xFFFFFFFF} {
+		if result, err := ParseNumber32(input); err != nil || result != expected {
+			t.Errorf("ParseNumber32(%q) = %X, %v, expected %X", input, result, err, expected)
+		}
+	}
+	if _, err := ParseNumber32("100000000h"); err == nil {
+		t.Errorf("ParseNumber32 accepted a number wider than 32 bits")
+	}
 }
 
 // TestStringInstructions tests that string instructions are recognized and encoded correctly
@@ -242,6 +255,10 @@ func TestStringInstructions(t *testing.T) {
 		{"MOVSW", "MOVSW", 0x71},
 		{"STOSB", "STOSB", 0x72},
 		{"STOSW", "STOSW", 0x73},
+		{"CMPSB", "CMPSB", 0x76},
+		{"CMPSW", "CMPSW", 0x77},
+		{"SCASB", "SCASB", 0x78},
+		{"SCASW", "SCASW", 0x79},
 	}
 
 	for _, tt := range tests {
@@ -270,6 +287,297 @@ func TestStringInstructions(t *testing.T) {
 	}
 }
 
+// TestFlagInstructions tests that flag instructions and parity jumps are encoded
+func TestFlagInstructions(t *testing.T) {
+	tests := []struct {
+		source   string
+		expected emulator.Opcode
+	}{
+		{"PUSHF", emulator.OpPUSHF},
+		{"POPF", emulator.OpPOPF},
+		{"LAHF", emulator.OpLAHF},
+		{"SAHF", emulator.OpSAHF},
+		{"CLC", emulator.OpCLC},
+		{"STC", emulator.OpSTC},
+		{"CMC", emulator.OpCMC},
+		{"CLD", emulator.OpCLD},
+		{"STD", emulator.OpSTD},
+		{"CLI", emulator.OpCLI},
+		{"STI", emulator.OpSTI},
+		{"here: JPE here", emulator.OpJP},
+		{"here: JPO here", emulator.OpJNP},
+	}
+
+	for _, tt := range tests {
+		tokens, err := NewLexer(tt.source).Tokenize()
+		if err != nil {
+			t.Fatalf("Lexer failed: %v", err)
+		}
+		program, err := NewParser(tokens).Parse()
+		if err != nil {
+			t.Fatalf("%s: parser failed: %v", tt.source, err)
+		}
+		if len(program.CodeBytes) == 0 || program.CodeBytes[0] != byte(tt.expected) {
+			t.Errorf("%s: expected opcode 0x%02X, got % X", tt.source, tt.expected, program.CodeBytes)
+		}
+	}
+}
+
+// TestArithmeticInstructions tests the bytecode of the carry, BCD and
+// multi-operand IMUL forms
+func TestArithmeticInstructions(t *testing.T) {
+	reg16 := byte(emulator.OpTypeReg16)
+	reg8 := byte(emulator.OpTypeReg8)
+	imm8 := byte(emulator.OpTypeImm8)
+	imm16 := byte(emulator.OpTypeImm16)
+
+	tests := []struct {
+		source   string
+		expected []byte
+	}{
+		{"ADC AX, BX", []byte{byte(emulator.OpADC), reg16, 0, reg16, 1}},
+		{"SBB AL, 1", []byte{byte(emulator.OpSBB), reg8, 4, imm8, 1}},
+		{"RCL AL, CL", []byte{byte(emulator.OpRCL), reg8, 4, reg8, 8}},
+		{"RCR BX, 1", []byte{byte(emulator.OpRCR), reg16, 1, imm8, 1}},
+		{"CBW", []byte{byte(emulator.OpCBW)}},
+		{"CWD", []byte{byte(emulator.OpCWD)}},
+		{"DAA", []byte{byte(emulator.OpDAA)}},
+		{"AAD 16", []byte{byte(emulator.OpAAD), imm8, 16}},
+		{"IMUL BX", []byte{byte(emulator.OpIMUL), reg16, 1}},
+		{"IMUL AX, BX", []byte{byte(emulator.OpIMUL2), reg16, 0, reg16, 1}},
+		{"IMUL CX, 300h", []byte{byte(emulator.OpIMUL2), reg16, 2, imm16, 0x00, 0x03}},
+		{"IMUL AX, BX, 3", []byte{byte(emulator.OpIMUL3), reg16, 0, reg16, 1, imm8, 3}},
+		// AAM defaults to base 10, and labels after it must account for the base byte
+		{"AAM\nhere: JMP here", []byte{
+			byte(emulator.OpAAM), imm8, 10,
+			byte(emulator.OpJMP), imm16, 0x03, 0x00,
+		}},
+	}
+
+	for _, tt := range tests {
+		program, err := assembleFor(tt.source, BackendBytecode, emulator.Model486)
+		if err != nil {
+			t.Fatalf("%s: parser failed: %v", tt.source, err)
+		}
+		if !bytes.Equal(program.CodeBytes, tt.expected) {
+			t.Errorf("%s: expected % X, got % X", tt.source, tt.expected, program.CodeBytes)
+		}
+	}
+}
+
+// TestCPULevel tests the bytecode of the 80186 instructions, their
+// rejection for the 8086 and the 8086 expansion of immediate shift counts
+func TestCPULevel(t *testing.T) {
+	reg16 := byte(emulator.OpTypeReg16)
+	imm8 := byte(emulator.OpTypeImm8)
+	shl1 := []byte{byte(emulator.OpSHL), reg16, 0, imm8, 1}
+
+	tests := []struct {
+		source   string
+		model    emulator.CPUModel
+		expected []byte // nil: rejected
+	}{
+		{"SHL AX, 3", emulator.Model8086, bytes.Repeat(shl1, 3)},
+		{"SHL AX, 3", emulator.Model186, []byte{byte(emulator.OpSHL), reg16, 0, imm8, 3}},
+		{"SHL AX, 2\nhere: JMP here", emulator.Model8086, append(bytes.Repeat(shl1, 2),
+			byte(emulator.OpJMP), byte(emulator.OpTypeImm16), 10, 0)},
+		{"PUSHA", emulator.Model8086, nil},
+		{"PUSHA", emulator.Model186, []byte{byte(emulator.OpPUSHA)}},
+		{"PUSH 5", emulator.Model8086, nil},
+		{"IMUL AX, BX, 3", emulator.Model8086, nil},
+		{"IMUL AX, BX", emulator.Model286, nil},
+		{"ENTER 8, 0", emulator.Model186, []byte{byte(emulator.OpENTER), imm8, 8, imm8, 0}},
+		{"BOUND DX, [SI]", emulator.Model286, []byte{byte(emulator.OpBOUND), reg16, 3,
+			byte(emulator.OpTypeMemReg), 12, 0, 0}},
+		{"REP OUTSB ES:[SI]", emulator.Model186, []byte{0xF3, emulator.BytecodeSegPrefix, 18, byte(emulator.OpOUTSB)}},
+		{"INSW ES:[SI]", emulator.Model186, nil},
+	}
+
+	for _, tt := range tests {
+		program, err := assembleFor(tt.source, BackendBytecode, tt.model)
+		switch {
+		case tt.expected == nil && err == nil:
+			t.Errorf("%s on the %s: expected an error", tt.source, tt.model)
+		case tt.expected != nil && err != nil:
+			t.Errorf("%s on the %s: parser failed: %v", tt.source, tt.model, err)
+		case tt.expected != nil && !bytes.Equal(program.CodeBytes, tt.expected):
+			t.Errorf("%s on the %s: expected % X, got % X", tt.source, tt.model, tt.expected, program.CodeBytes)
+		}
+	}
+}
+
+// TestBytecode80386 tests the bytecode of 32-bit operands, which are marked
+// by their operand types, the 80386 instructions and their rejection for
+// earlier processors
+func TestBytecode80386(t *testing.T) {
+	reg8 := byte(emulator.OpTypeReg8)
+	reg16 := byte(emulator.OpTypeReg16)
+	reg32 := byte(emulator.OpTypeReg32)
+	imm8 := byte(emulator.OpTypeImm8)
+	imm16 := byte(emulator.OpTypeImm16)
+	imm32 := byte(emulator.OpTypeImm32)
+	dword := byte(emulator.OpTypeDword)
+	mem := byte(emulator.OpTypeMem)
+	memReg := byte(emulator.OpTypeMemReg)
+	jmpHere := func(addr byte) []byte { return []byte{byte(emulator.OpJMP), imm16, addr, 0} }
+
+	tests := []struct {
+		source   string
+		model    emulator.CPUModel
+		expected []byte // nil: rejected
+	}{
+		{"MOV EAX, 1", emulator.Model286, nil},
+		{"SETE AL", emulator.Model286, nil},
+		{"MOV AX, FS:[BX]", emulator.Model286, nil},
+		{"MOV EAX, 1", emulator.Model386, []byte{byte(emulator.OpMOV), reg32, 0, imm32, 1, 0, 0, 0}},
+		{"ADD DWORD [200h], -1", emulator.Model386, []byte{byte(emulator.OpADD), dword, mem, 0x00, 0x02,
+			imm32, 0xFF, 0xFF, 0xFF, 0xFF}},
+		{"SHL EAX, 3", emulator.Model386, []byte{byte(emulator.OpSHL), reg32, 0, imm8, 3}},
+		{"MOVZX ECX, BYTE [SI]", emulator.Model386, []byte{byte(emulator.OpMOVZXB), reg32, 2, memReg, 12, 0, 0}},
+		{"MOVSX EDX, BX", emulator.Model386, []byte{byte(emulator.OpMOVSXW), reg32, 3, reg16, 1}},
+		{"SETB AL", emulator.Model386, []byte{byte(emulator.OpSETcc), reg8, 4, imm8, 2}},
+		{"SHLD EAX, EDX, CL", emulator.Model386, []byte{byte(emulator.OpSHLD), reg32, 0, reg32, 3, reg8, 8}},
+		{"BTS DWORD [BX], 33", emulator.Model386, []byte{byte(emulator.OpBTS), dword, memReg, 1, 0, 0, imm8, 33}},
+		{"MOV AX, GS:[BX]", emulator.Model386, []byte{byte(emulator.OpMOV), reg16, 0,
+			byte(emulator.OpTypeSegOverride), 21, memReg, 1, 0, 0}},
+		{"CDQ", emulator.Model386, []byte{byte(emulator.OpCDQ)}},
+		{"MOV EAX, [EBX]", emulator.Model386, nil},
+		{"MOVZX EAX, [SI]", emulator.Model386, nil},
+		{"JMP EAX", emulator.Model386, nil},
+
+		// The layout pass must size the widened operands
+		{"MOV EAX, 1\nhere: JMP here", emulator.Model386, append([]byte{byte(emulator.OpMOV), reg32, 0,
+			imm32, 1, 0, 0, 0}, jmpHere(8)...)},
+		{"MOV DWORD [200h], 5\nhere: JMP here", emulator.Model386, append([]byte{byte(emulator.OpMOV), dword,
+			mem, 0x00, 0x02, imm32, 5, 0, 0, 0}, jmpHere(10)...)},
+		{"SETE AL\nhere: JMP here", emulator.Model386, append([]byte{byte(emulator.OpSETcc), reg8, 4,
+			imm8, 4}, jmpHere(5)...)},
+	}
+
+	for _, tt := range tests {
+		program, err := assembleFor(tt.source, BackendBytecode, tt.model)
+		switch {
+		case tt.expected == nil && err == nil:
+			t.Errorf("%s on the %s: expected an error", tt.source, tt.model)
+		case tt.expected != nil && err != nil:
+			t.Errorf("%s on the %s: parser failed: %v", tt.source, tt.model, err)
+		case tt.expected != nil && !bytes.Equal(program.CodeBytes, tt.expected):
+			t.Errorf("%s on the %s: expected % X, got % X", tt.source, tt.model, tt.expected, program.CodeBytes)
+		}
+	}
+}
+
+// TestBytecodeFPU tests the bytecode of x87 instructions: the operation byte
+// after OpFPU and the operands the assembler fills in
+func TestBytecodeFPU(t *testing.T) {
+	fpu := func(op emulator.FPUOp, operands ...byte) []byte {
+		return append([]byte{byte(emulator.OpFPU), byte(op)}, operands...)
+	}
+	st := byte(emulator.OpTypeST)
+	qword := byte(emulator.OpTypeQword)
+	tword := byte(emulator.OpTypeTword)
+	dword := byte(emulator.OpTypeDword)
+	mem := byte(emulator.OpTypeMem)
+	memReg := byte(emulator.OpTypeMemReg)
+
+	tests := []struct {
+		source   string
+		model    emulator.CPUModel
+		expected []byte // nil: rejected
+	}{
+		{"FINIT", emulator.Model8086, fpu(emulator.OpFINIT)},
+		{"FNINIT", emulator.Model8086, fpu(emulator.OpFINIT)},
+		{"FLDPI", emulator.Model8086, fpu(emulator.OpFLDPI)},
+		{"FLD ST(3)", emulator.Model8086, fpu(emulator.OpFLD, st, 3)},
+		{"FLD QWORD [200h]", emulator.Model8086, fpu(emulator.OpFLD, qword, mem, 0x00, 0x02)},
+		{"FSTP TBYTE [BX]", emulator.Model8086, fpu(emulator.OpFSTP, tword, memReg, 1, 0, 0)},
+		{"FIST DWORD [200h]", emulator.Model8086, fpu(emulator.OpFIST, dword, mem, 0x00, 0x02)},
+		{"FLDCW [200h]", emulator.Model8086, fpu(emulator.OpFLDCW, mem, 0x00, 0x02)},
+		{"FADD", emulator.Model8086, fpu(emulator.OpFADDP, st, 1, st, 0)},
+		{"FADD ST2", emulator.Model8086, fpu(emulator.OpFADD, st, 0, st, 2)},
+		{"FMUL DWORD [200h]", emulator.Model8086, fpu(emulator.OpFMUL, st, 0, dword, mem, 0x00, 0x02)},
+		{"FDIVRP ST3, ST0", emulator.Model8086, fpu(emulator.OpFDIVRP, st, 3, st, 0)},
+		{"FIADD WORD [200h]", emulator.Model8086, fpu(emulator.OpFIADD, st, 0, mem, 0x00, 0x02)},
+		{"FXCH", emulator.Model8086, fpu(emulator.OpFXCH, st, 1)},
+		{"FSTSW AX", emulator.Model8086, nil},
+		{"FSTSW AX", emulator.Model286, fpu(emulator.OpFSTSW, byte(emulator.OpTypeReg16), 0)},
+		{"FSINCOS", emulator.Model286, nil},
+		{"FSINCOS", emulator.Model386, fpu(emulator.OpFSINCOS)},
+		{"FLD [200h]", emulator.Model8086, nil},
+		{"FLD DWORD [EBX]", emulator.Model386, nil},
+		{"FADD ST1, ST2", emulator.Model8086, nil},
+	}
+
+	for _, tt := range tests {
+		program, err := assembleFor(tt.source, BackendBytecode, tt.model)
+		switch {
+		case tt.expected == nil && err == nil:
+			t.Errorf("%s on the %s: expected an error", tt.source, tt.model)
+		case tt.expected != nil && err != nil:
+			t.Errorf("%s on the %s: parser failed: %v", tt.source, tt.model, err)
+		case tt.expected != nil && !bytes.Equal(program.CodeBytes, tt.expected):
+			t.Errorf("%s on the %s: expected % X, got % X", tt.source, tt.model, tt.expected, program.CodeBytes)
+		}
+	}
+}
+
+// TestRealData tests real numbers in DD, DQ and DT and 64-bit integers in DQ
+func TestRealData(t *testing.T) {
+	tests := []struct {
+		source   string
+		expected []byte // nil: rejected
+	}{
+		{"DD 1.5", []byte{0x00, 0x00, 0xC0, 0x3F}},
+		{"DD -0.1", []byte{0xCD, 0xCC, 0xCC, 0xBD}},
+		{"DQ 2.0", []byte{0, 0, 0, 0, 0, 0, 0, 0x40}},
+		{"DQ 1.0e3", []byte{0, 0, 0, 0, 0, 0x40, 0x8F, 0x40}},
+		{"DQ 0.5, -1", []byte{0, 0, 0, 0, 0, 0, 0xE0, 0x3F, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}},
+		{"DQ 123456789ABCDEFh", []byte{0xEF, 0xCD, 0xAB, 0x89, 0x67, 0x45, 0x23, 0x01}},
+		{"DT 3.25", []byte{0, 0, 0, 0, 0, 0, 0, 0xD0, 0x00, 0x40}},
+		{"DT 1", []byte{0, 0, 0, 0, 0, 0, 0, 0x80, 0xFF, 0x3F}},
+		{"DT 0.1", []byte{0xCD, 0xCC, 0xCC, 0xCC, 0xCC, 0xCC, 0xCC, 0xCC, 0xFB, 0x3F}},
+		{"DW 1.5", nil},
+		{"DB 2.0", nil},
+	}
+
+	for _, tt := range tests {
+		program, err := assembleFor(".data\n"+tt.source, BackendBytecode, emulator.Model8086)
+		switch {
+		case tt.expected == nil && err == nil:
+			t.Errorf("%s: expected an error", tt.source)
+		case tt.expected != nil && err != nil:
+			t.Errorf("%s: parser failed: %v", tt.source, err)
+		case tt.expected != nil && !bytes.Equal(program.DataBytes, tt.expected):
+			t.Errorf("%s: expected % X, got % X", tt.source, tt.expected, program.DataBytes)
+		}
+	}
+}
+
+// TestInterruptInstructions tests the bytecode of INT and IRET
+func TestInterruptInstructions(t *testing.T) {
+	tests := []struct {
+		source   string
+		expected []byte
+	}{
+		{"INT 21h", []byte{byte(emulator.OpINT), byte(emulator.OpTypeImm8), 0x21}},
+		{"IRET", []byte{byte(emulator.OpIRET)}},
+	}
+
+	for _, tt := range tests {
+		tokens, err := NewLexer(tt.source).Tokenize()
+		if err != nil {
+			t.Fatalf("Lexer failed: %v", err)
+		}
+		program, err := NewParser(tokens).Parse()
+		if err != nil {
+			t.Fatalf("%s: parser failed: %v", tt.source, err)
+		}
+		if !bytes.Equal(program.CodeBytes, tt.expected) {
+			t.Errorf("%s: expected % X, got % X", tt.source, tt.expected, program.CodeBytes)
+		}
+	}
+}
+
 // TestREPPrefix tests that REP prefix is handled correctly
 func TestREPPrefix(t *testing.T) {
 	tests := []struct {
@@ -282,6 +590,11 @@ func TestREPPrefix(t *testing.T) {
 		{"REP MOVSW", "REP MOVSW", 0xF3, 0x71},
 		{"REP STOSB", "REP STOSB", 0xF3, 0x72},
 		{"REP STOSW", "REP STOSW", 0xF3, 0x73},
+		{"REP LODSB", "REP LODSB", 0xF3, 0x74},
+		{"REPE CMPSB", "REPE CMPSB", 0xF3, 0x76},
+		{"REPZ CMPSW", "REPZ CMPSW", 0xF3, 0x77},
+		{"REPNE SCASB", "REPNE SCASB", 0xF2, 0x78},
+		{"REPNZ SCASW", "REPNZ SCASW", 0xF2, 0x79},
 	}
 
 	for _, tt := range tests {
@@ -316,6 +629,90 @@ func TestREPPrefix(t *testing.T) {
 	}
 }
 
+// TestMemoryOperands tests the bytecode of based, indexed and segment
+// override addresses
+func TestMemoryOperands(t *testing.T) {
+	source := `.code
+MOV AL, [table+BX]
+MOV [BP+DI-4], AX
+MOV CX, [SI+BX+2]
+MOV AX, CS:[10h]
+MOV ES:[DI-2], DL
+HLT
+.data
+DB 0, 0
+table: DB 1`
+
+	tokens, err := NewLexer(source).Tokenize()
+	if err != nil {
+		t.Fatalf("Lexer failed: %v", err)
+	}
+	program, err := NewParser(tokens).Parse()
+	if err != nil {
+		t.Fatalf("Parser failed: %v", err)
+	}
+
+	mov := byte(emulator.OpMOV)
+	memReg := byte(emulator.OpTypeMemReg)
+	indexed := byte(emulator.OpTypeMemIndexed)
+	override := byte(emulator.OpTypeSegOverride)
+	want := []byte{
+		mov, 0x02, 4, memReg, 1, 0x02, 0x00, // MOV AL, [BX+2]
+		mov, indexed, 3, 0xFC, 0xFF, 0x01, 0, // MOV [BP+DI-4], AX
+		mov, 0x01, 2, indexed, 0, 0x02, 0x00, // MOV CX, [BX+SI+2]
+		mov, 0x01, 0, override, 16, 0x05, 0x10, 0x00, // MOV AX, CS:[10h]
+		mov, override, 18, memReg, 13, 0xFE, 0xFF, 0x02, 10, // MOV ES:[DI-2], DL
+		byte(emulator.OpHLT),
+	}
+	if !bytes.Equal(program.CodeBytes, want) {
+		t.Errorf("Expected % X, got % X", want, program.CodeBytes)
+	}
+
+	for _, bad := range []string{"MOV AX, [BX+BP]", "MOV AX, [BX-SI]", "MOV AX, [CL]", "MOV AX, [BX", "MOV AX, BX:[SI]", "MOV AX, [undefined+BX]"} {
+		tokens, err := NewLexer(bad).Tokenize()
+		if err != nil {
+			t.Fatalf("Lexer failed: %v", err)
+		}
+		if _, err := NewParser(tokens).Parse(); err == nil {
+			t.Errorf("%s: expected an error", bad)
+		}
+	}
+}
+
+// TestStringSourceOverride tests the segment override of a string
+// instruction's source operand and the prefixes it may not take
+func TestStringSourceOverride(t *testing.T) {
+	tokens, err := NewLexer("REP MOVSB CS:[SI]\nLODSB ES:[SI]\nJMP done\ndone: HLT").Tokenize()
+	if err != nil {
+		t.Fatalf("Lexer failed: %v", err)
+	}
+	program, err := NewParser(tokens).Parse()
+	if err != nil {
+		t.Fatalf("Parser failed: %v", err)
+	}
+
+	seg := emulator.BytecodeSegPrefix
+	want := []byte{
+		0xF3, seg, 16, byte(emulator.OpMOVSB), // REP MOVSB CS:[SI]
+		seg, 18, byte(emulator.OpLODSB), // LODSB ES:[SI]
+		byte(emulator.OpJMP), byte(emulator.OpTypeImm16), 0x0B, 0x00, // JMP done
+		byte(emulator.OpHLT),
+	}
+	if !bytes.Equal(program.CodeBytes, want) {
+		t.Errorf("Expected % X, got % X", want, program.CodeBytes)
+	}
+
+	for _, bad := range []string{"REPE MOVSB", "REPNE STOSW", "REP ADD AX, BX", "STOSB ES:[SI]", "LODSB [DI]", "MOVSB ES:[SI+1]"} {
+		tokens, err := NewLexer(bad).Tokenize()
+		if err != nil {
+			t.Fatalf("Lexer failed: %v", err)
+		}
+		if _, err := NewParser(tokens).Parse(); err == nil {
+			t.Errorf("%s: expected an error", bad)
+		}
+	}
+}
+
 // TestPreprocessorEQU tests constant definition using EQU
 func TestPreprocessorEQU(t *testing.T) {
 	source := `MY_CONST EQU 42
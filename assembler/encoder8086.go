@@ -0,0 +1,1074 @@
+package assembler
+
+import (
+	"assembly-emulator/emulator"
+	"fmt"
+)
+
+// Backend selects the machine code format produced by the parser
+type Backend int
+
+const (
+	// BackendBytecode emits the emulator's own bytecode (opcode and operand-type bytes)
+	BackendBytecode Backend = iota
+	// Backend8086 emits genuine Intel 8086 machine code for flat .COM/.BIN images
+	Backend8086
+)
+
+// 8086 register numbers as used in ModR/M reg and rm fields
+var (
+	reg16Codes8086 = map[string]byte{
+		"AX": 0, "CX": 1, "DX": 2, "BX": 3, "SP": 4, "BP": 5, "SI": 6, "DI": 7,
+	}
+	reg8Codes8086 = map[string]byte{
+		"AL": 0, "CL": 1, "DL": 2, "BL": 3, "AH": 4, "CH": 5, "DH": 6, "BH": 7,
+	}
+	reg32Codes8086 = map[string]byte{
+		"EAX": 0, "ECX": 1, "EDX": 2, "EBX": 3, "ESP": 4, "EBP": 5, "ESI": 6, "EDI": 7,
+	}
+	sregCodes8086 = map[string]byte{
+		"ES": 0, "CS": 1, "SS": 2, "DS": 3, "FS": 4, "GS": 5,
+	}
+)
+
+// rm8086 maps the registers of a memory operand to the ModR/M rm field
+var rm8086 = map[string]byte{
+	"BX+SI": 0, "BX+DI": 1, "BP+SI": 2, "BP+DI": 3,
+	"SI": 4, "DI": 5, "BP": 6, "BX": 7,
+}
+
+// scale8086 maps the index scale of a 32-bit address to the SIB scale field
+var scale8086 = map[byte]byte{1: 0, 2: 1, 4: 2, 8: 3}
+
+// segPrefix8086 maps segment registers to their override prefix byte
+var segPrefix8086 = map[string]byte{
+	"ES": 0x26, "CS": 0x2E, "SS": 0x36, "DS": 0x3E, "FS": 0x64, "GS": 0x65,
+}
+
+// alu8086 maps two-operand ALU instructions to their ModR/M reg field (/r of 80-83)
+var alu8086 = map[string]byte{
+	"ADD": 0, "OR": 1, "ADC": 2, "SBB": 3, "AND": 4, "SUB": 5, "XOR": 6, "CMP": 7,
+}
+
+// shift8086 maps shift and rotate instructions to their D0-D3 reg field
+var shift8086 = map[string]byte{
+	"ROL": 0, "ROR": 1, "RCL": 2, "RCR": 3, "SHL": 4, "SAL": 4, "SHR": 5, "SAR": 7,
+}
+
+// group3_8086 maps the single-operand F6/F7 instructions to their reg field
+var group3_8086 = map[string]byte{
+	"NOT": 2, "NEG": 3, "MUL": 4, "IMUL": 5, "DIV": 6, "IDIV": 7,
+}
+
+// jcc8086 maps conditional jumps to their short (70-7F) opcode. The inverse
+// condition is always the opcode with the low bit flipped.
+var jcc8086 = map[string]byte{
+	"JO":  0x70,
+	"JNO": 0x71,
+	"JB":  0x72, "JNAE": 0x72,
+	"JAE": 0x73, "JNB": 0x73,
+	"JE": 0x74, "JZ": 0x74,
+	"JNE": 0x75, "JNZ": 0x75,
+	"JBE": 0x76, "JNA": 0x76,
+	"JA": 0x77, "JNBE": 0x77,
+	"JS":  0x78,
+	"JNS": 0x79,
+	"JP":  0x7A, "JPE": 0x7A,
+	"JNP": 0x7B, "JPO": 0x7B,
+	"JL": 0x7C, "JNGE": 0x7C,
+	"JGE": 0x7D, "JNL": 0x7D,
+	"JLE": 0x7E, "JNG": 0x7E,
+	"JG": 0x7F, "JNLE": 0x7F,
+}
+
+// bt8086 maps the bit test instructions to their group 8 (0F BA) reg field.
+// The low two bits also select the register forms 0F A3, AB, B3 and BB.
+var bt8086 = map[string]byte{
+	"BT": 4, "BTS": 5, "BTR": 6, "BTC": 7,
+}
+
+// loop8086 maps the CX-counted loops to their rel8 opcode
+var loop8086 = map[string]byte{
+	"LOOPNZ": 0xE0, "LOOPNE": 0xE0,
+	"LOOPZ": 0xE1, "LOOPE": 0xE1,
+	"LOOP": 0xE2,
+}
+
+// simple8086 maps operand-less instructions to their single opcode byte
+var simple8086 = map[string]byte{
+	"NOP": 0x90, "HLT": 0xF4, "IRET": 0xCF,
+	"MOVSB": 0xA4, "MOVSW": 0xA5,
+	"STOSB": 0xAA, "STOSW": 0xAB,
+	"LODSB": 0xAC, "LODSW": 0xAD,
+	"CMPSB": 0xA6, "CMPSW": 0xA7,
+	"SCASB": 0xAE, "SCASW": 0xAF,
+	"PUSHF": 0x9C, "POPF": 0x9D,
+	"SAHF": 0x9E, "LAHF": 0x9F,
+	"CMC": 0xF5, "CLC": 0xF8, "STC": 0xF9,
+	"CLI": 0xFA, "STI": 0xFB, "CLD": 0xFC, "STD": 0xFD,
+	"CBW": 0x98, "CWD": 0x99, "CWDE": 0x98, "CDQ": 0x99,
+	"DAA": 0x27, "DAS": 0x2F, "AAA": 0x37, "AAS": 0x3F,
+	"PUSHA": 0x60, "POPA": 0x61, "LEAVE": 0xC9,
+	"INSB": 0x6C, "INSW": 0x6D, "OUTSB": 0x6E, "OUTSW": 0x6F,
+}
+
+// encoder8086 accumulates the machine code of one instruction
+type encoder8086 struct {
+	addr uint16 // Address of the instruction's first byte
+	code []byte
+	long bool              // Branch must use (or chose) its long form
+	cpu  emulator.CPUModel // Target processor
+	op32 bool              // 32-bit operation, behind the operand-size prefix
+}
+
+func (e *encoder8086) emit(b ...byte) {
+	e.code = append(e.code, b...)
+}
+
+func (e *encoder8086) emitWord(w uint16) {
+	e.code = append(e.code, byte(w), byte(w>>8))
+}
+
+func (e *encoder8086) emitDword(d uint32) {
+	e.emitWord(uint16(d))
+	e.emitWord(uint16(d >> 16))
+}
+
+// next returns the address following the bytes emitted so far plus n more
+func (e *encoder8086) next(n int) uint16 {
+	return e.addr + uint16(len(e.code)+n)
+}
+
+// encode8086 encodes one instruction as 8086 machine code
+func (p *Parser) encode8086(instr string, operands []Operand, rep byte, segment string) ([]byte, error) {
+	e := &encoder8086{
+		addr: p.labelAddress(LabelInfo{
+			Segment: p.currentSegment,
+			Offset:  p.getCurrentAddress(),
+		}),
+		long: p.longBranches[p.pos],
+		cpu:  p.cpu,
+		op32: operand32(instr, operands),
+	}
+
+	if rep != 0 {
+		e.emit(rep)
+	}
+	if segment != "" {
+		e.emit(segPrefix8086[segment])
+	}
+	if e.op32 {
+		e.emit(0x66)
+	}
+
+	if err := e.encode(instr, operands); err != nil {
+		return nil, err
+	}
+	if e.long {
+		p.longBranches[p.pos] = true
+	}
+	return e.code, nil
+}
+
+func (e *encoder8086) encode(instr string, ops []Operand) error {
+	if opcode, ok := simple8086[instr]; ok {
+		if len(ops) != 0 {
+			return fmt.Errorf("%s takes no operands", instr)
+		}
+		e.emit(opcode)
+		return nil
+	}
+
+	if op, ok := fpuMnemonics[instr]; ok {
+		return e.encodeFPU(op, ops)
+	}
+	if reg, ok := alu8086[instr]; ok {
+		return e.encodeALU(instr, reg, ops)
+	}
+	if reg, ok := shift8086[instr]; ok {
+		return e.encodeShift(instr, reg, ops)
+	}
+	if reg, ok := group3_8086[instr]; ok {
+		if instr == "IMUL" && len(ops) > 1 {
+			return e.encodeIMUL(ops)
+		}
+		if len(ops) != 1 {
+			return fmt.Errorf("%s expects 1 operand", instr)
+		}
+		is8, err := operandWidth8086(instr, ops)
+		if err != nil {
+			return err
+		}
+		return e.encodeModRM(0xF6|w8086(is8), reg, ops[0])
+	}
+	if opcode, ok := jcc8086[instr]; ok {
+		return e.encodeJcc(instr, opcode, ops)
+	}
+	if opcode, ok := loop8086[instr]; ok {
+		return e.encodeLoop(instr, opcode, ops)
+	}
+	if reg, ok := bt8086[instr]; ok {
+		return e.encodeBT(instr, reg, ops)
+	}
+	if cc := setccCondition(instr); cc >= 0 {
+		return e.encodeSETcc(instr, byte(cc), ops)
+	}
+
+	switch instr {
+	case "MOV":
+		return e.encodeMOV(ops)
+	case "TEST":
+		return e.encodeTEST(ops)
+	case "XCHG":
+		return e.encodeXCHG(ops)
+	case "INC", "DEC":
+		return e.encodeIncDec(instr, ops)
+	case "PUSH", "POP":
+		return e.encodeStack(instr, ops)
+	case "JMP", "CALL":
+		return e.encodeJmpCall(instr, ops)
+	case "RET":
+		if len(ops) == 0 {
+			e.emit(0xC3)
+			return nil
+		}
+		if len(ops) != 1 || ops[0].Type != OperandTypeImmediate {
+			return fmt.Errorf("RET expects an optional immediate operand")
+		}
+		e.emit(0xC2)
+		e.emitWord(ops[0].Immediate)
+		return nil
+	case "AAM", "AAD":
+		// The base is an undocumented immediate byte, 10 unless given
+		base := uint16(10)
+		if len(ops) == 1 && ops[0].Type == OperandTypeImmediate && ops[0].Immediate <= 0xFF {
+			base = ops[0].Immediate
+		} else if len(ops) != 0 {
+			return fmt.Errorf("%s expects an optional 8-bit immediate operand", instr)
+		}
+		opcode := byte(0xD4)
+		if instr == "AAD" {
+			opcode = 0xD5
+		}
+		e.emit(opcode, byte(base))
+		return nil
+	case "INT":
+		if len(ops) != 1 || ops[0].Type != OperandTypeImmediate || ops[0].Immediate > 0xFF {
+			return fmt.Errorf("INT expects an 8-bit immediate operand")
+		}
+		e.emit(0xCD, byte(ops[0].Immediate))
+		return nil
+	case "IN", "OUT":
+		return e.encodeIO(instr, ops)
+	case "ENTER":
+		if len(ops) != 2 || ops[0].Type != OperandTypeImmediate ||
+			ops[1].Type != OperandTypeImmediate || ops[1].Immediate > 0xFF {
+			return fmt.Errorf("ENTER expects a 16-bit frame size and an 8-bit nesting level")
+		}
+		e.emit(0xC8)
+		e.emitWord(ops[0].Immediate)
+		e.emit(byte(ops[1].Immediate))
+		return nil
+	case "MOVZX", "MOVSX":
+		return e.encodeMOVX(instr, ops)
+	case "SHLD", "SHRD":
+		return e.encodeDoubleShift(instr, ops)
+	case "BSF", "BSR":
+		if len(ops) != 2 || !isReg8086(ops[0]) || !isRM8086(ops[1]) {
+			return fmt.Errorf("%s expects a register and a register or memory operand", instr)
+		}
+		if is8, err := operandWidth8086(instr, ops); err != nil || is8 {
+			return fmt.Errorf("%s requires 16-bit or 32-bit operands", instr)
+		}
+		opcode := byte(0xBC)
+		if instr == "BSR" {
+			opcode = 0xBD
+		}
+		return e.encodeModRM0F(opcode, regCode8086(ops[0].Reg), ops[1])
+	case "BOUND":
+		if len(ops) != 2 || !isReg8086(ops[0]) || is8BitRegister(ops[0].Reg) ||
+			(ops[1].Type != OperandTypeMemory && ops[1].Type != OperandTypeMemoryReg) {
+			return fmt.Errorf("BOUND expects a 16-bit register and a memory operand")
+		}
+		return e.encodeModRM(0x62, regCode8086(ops[0].Reg), ops[1])
+	}
+
+	return fmt.Errorf("unknown instruction: %s", instr)
+}
+
+// w8086 returns the w bit of an opcode: 0 for byte operations, 1 for word
+func w8086(is8 bool) byte {
+	if is8 {
+		return 0
+	}
+	return 1
+}
+
+// isReg8086 reports whether op is a general purpose register
+func isReg8086(op Operand) bool {
+	if op.Type != OperandTypeRegister {
+		return false
+	}
+	_, ok16 := reg16Codes8086[op.Reg]
+	_, ok8 := reg8Codes8086[op.Reg]
+	_, ok32 := reg32Codes8086[op.Reg]
+	return ok16 || ok8 || ok32
+}
+
+// isAccumulator reports whether reg is AX or, for 32-bit operations, EAX
+func isAccumulator(reg string) bool {
+	return reg == "AX" || reg == "EAX"
+}
+
+// isSreg8086 reports whether op is a segment register
+func isSreg8086(op Operand) bool {
+	_, ok := sregCodes8086[op.Reg]
+	return op.Type == OperandTypeRegister && ok
+}
+
+// isRM8086 reports whether op can be encoded in a ModR/M rm field
+func isRM8086(op Operand) bool {
+	return isReg8086(op) || op.Type == OperandTypeMemory || op.Type == OperandTypeMemoryReg
+}
+
+// regCode8086 returns the register number of a general purpose register
+func regCode8086(reg string) byte {
+	if code, ok := reg8Codes8086[reg]; ok {
+		return code
+	}
+	if code, ok := reg32Codes8086[reg]; ok {
+		return code
+	}
+	return reg16Codes8086[reg]
+}
+
+// rmCode8086 returns the ModR/M rm field addressing a register-based
+// memory operand, and false if the registers have no 8086 encoding
+func rmCode8086(op Operand) (byte, bool) {
+	key := op.Reg
+	if op.Index != "" {
+		key += "+" + op.Index
+	}
+	rm, ok := rm8086[key]
+	return rm, ok
+}
+
+// operandWidth8086 determines whether an instruction operates on bytes.
+// Registers decide the width; otherwise an explicit BYTE or WORD size is
+// used, and without one the bytecode rule applies: MOV of an immediate that
+// fits in a byte to memory is a byte store, everything else is a word.
+func operandWidth8086(instr string, ops []Operand) (bool, error) {
+	width := 0
+	for _, op := range ops {
+		size := op.Size
+		if isReg8086(op) {
+			size = registerSize(op.Reg)
+		}
+		if size == 0 {
+			continue
+		}
+		if width != 0 && width != size {
+			return false, fmt.Errorf("operand size mismatch in %s", instr)
+		}
+		width = size
+	}
+	if width != 0 {
+		return width == 8, nil
+	}
+
+	if instr == "MOV" && len(ops) == 2 && ops[1].Type == OperandTypeImmediate &&
+		!ops[1].IsLabel && ops[1].Immediate <= 0xFF {
+		return true, nil
+	}
+	return false, nil
+}
+
+// fitsInt8 reports whether a 16-bit value is a sign-extended 8-bit value
+func fitsInt8(v uint16) bool {
+	return int16(v) >= -128 && int16(v) <= 127
+}
+
+// fitsInt8Dword reports whether a 32-bit value is a sign-extended 8-bit value
+func fitsInt8Dword(v uint32) bool {
+	return int32(v) >= -128 && int32(v) <= 127
+}
+
+// immFitsInt8 reports whether an immediate other than a label can take the
+// sign-extended 8-bit form in the operation's width
+func (e *encoder8086) immFitsInt8(op Operand) bool {
+	if op.IsLabel {
+		return false
+	}
+	if e.op32 {
+		return fitsInt8Dword(op.Imm32)
+	}
+	return fitsInt8(op.Immediate)
+}
+
+// encodeModRM emits opcode, a ModR/M byte with the given reg field and the
+// addressing bytes for rm. A segment override is emitted ahead of the opcode
+// when one is given, or where the bytecode dialect's default segment differs
+// from the 8086's.
+func (e *encoder8086) encodeModRM(opcode byte, reg byte, rm Operand) error {
+	return e.encodeModRMOp([]byte{opcode}, reg, rm)
+}
+
+// encodeModRM0F is encodeModRM for the 80386 two-byte opcodes 0F opcode
+func (e *encoder8086) encodeModRM0F(opcode byte, reg byte, rm Operand) error {
+	return e.encodeModRMOp([]byte{0x0F, opcode}, reg, rm)
+}
+
+func (e *encoder8086) encodeModRMOp(opcode []byte, reg byte, rm Operand) error {
+	switch rm.Type {
+	case OperandTypeRegister:
+		if !isReg8086(rm) {
+			return fmt.Errorf("invalid register operand: %s", rm.Reg)
+		}
+		e.emit(opcode...)
+		e.emit(0xC0 | reg<<3 | regCode8086(rm.Reg))
+
+	case OperandTypeMemory:
+		// mod=00 rm=110 is the direct [disp16] form
+		e.emitOverride(rm)
+		e.emit(opcode...)
+		e.emit(reg<<3 | 0x06)
+		e.emitWord(rm.Address)
+
+	case OperandTypeMemoryReg:
+		if isAddr32(rm) {
+			e.encodeAddress32(opcode, reg, rm)
+			return nil
+		}
+		base, ok := rmCode8086(rm)
+		if !ok {
+			return fmt.Errorf("register %s cannot be used as a base register on the 8086", rm.Reg)
+		}
+		e.emitOverride(rm)
+		e.emit(opcode...)
+
+		switch {
+		case rm.IsLabel:
+			// A label's address can change between layout passes, so it
+			// always takes the 16-bit displacement
+			e.emit(0x80 | reg<<3 | base)
+			e.emitWord(rm.Offset)
+		case rm.Offset == 0 && base != 6:
+			// [BP] has no mod=00 form; it always takes a displacement
+			e.emit(reg<<3 | base)
+		case fitsInt8(rm.Offset):
+			e.emit(0x40|reg<<3|base, byte(rm.Offset))
+		default:
+			e.emit(0x80 | reg<<3 | base)
+			e.emitWord(rm.Offset)
+		}
+
+	default:
+		return fmt.Errorf("invalid operand for ModR/M encoding")
+	}
+	return nil
+}
+
+// encodeAddress32 emits the address-size prefix, opcode and the ModR/M, SIB
+// and displacement bytes of a memory operand with 32-bit addressing. The
+// displacement is sign-extended, except for a label's address.
+func (e *encoder8086) encodeAddress32(opcode []byte, reg byte, rm Operand) {
+	e.emit(0x67)
+	e.emitOverride(rm)
+	e.emit(opcode...)
+
+	disp := uint32(int16(rm.Offset))
+	if rm.IsLabel {
+		disp = uint32(rm.Offset)
+	}
+
+	// An index, ESP as the base or the lack of a base need a SIB byte:
+	// index 100 is no index and base 101 under mod=00 is no base
+	base, hasBase := reg32Codes8086[rm.Reg]
+	field := base
+	var sib []byte
+	if rm.Index != "" || !hasBase || base == 4 {
+		index := byte(4)
+		if rm.Index != "" {
+			index = reg32Codes8086[rm.Index]
+		}
+		sibBase := base
+		if !hasBase {
+			sibBase = 5
+		}
+		sib = []byte{scale8086[rm.Scale]<<6 | index<<3 | sibBase}
+		field = 4
+	}
+
+	switch {
+	case !hasBase:
+		e.emit(reg<<3 | field)
+		e.emit(sib...)
+		e.emitDword(disp)
+	case disp == 0 && base != 5 && !rm.IsLabel:
+		// [EBP] has no mod=00 form; it always takes a displacement
+		e.emit(reg<<3 | field)
+		e.emit(sib...)
+	case fitsInt8Dword(disp) && !rm.IsLabel:
+		e.emit(0x40 | reg<<3 | field)
+		e.emit(sib...)
+		e.emit(byte(disp))
+	default:
+		e.emit(0x80 | reg<<3 | field)
+		e.emit(sib...)
+		e.emitDword(disp)
+	}
+}
+
+// emitOverride emits the segment override prefix of a memory operand
+func (e *encoder8086) emitOverride(op Operand) {
+	if op.Segment != "" {
+		e.emit(segPrefix8086[op.Segment])
+	}
+}
+
+// emitImm emits an immediate in the operation's width
+func (e *encoder8086) emitImm(op Operand, is8 bool) error {
+	if is8 {
+		if op.Immediate > 0xFF && !fitsInt8(op.Immediate) {
+			return fmt.Errorf("immediate %d does not fit in a byte", op.Immediate)
+		}
+		e.emit(byte(op.Immediate))
+		return nil
+	}
+	if e.op32 {
+		e.emitDword(op.Imm32)
+		return nil
+	}
+	e.emitWord(op.Immediate)
+	return nil
+}
+
+// encodeALU encodes ADD, OR, AND, SUB, XOR and CMP
+func (e *encoder8086) encodeALU(instr string, reg byte, ops []Operand) error {
+	if len(ops) != 2 {
+		return fmt.Errorf("%s expects 2 operands", instr)
+	}
+	dest, src := ops[0], ops[1]
+	is8, err := operandWidth8086(instr, ops)
+	if err != nil {
+		return err
+	}
+	w := w8086(is8)
+	base := reg << 3 // 00, 08, 20, 28, 30, 38
+
+	switch {
+	case src.Type == OperandTypeImmediate && isRM8086(dest):
+		short := !is8 && e.immFitsInt8(src)
+		if dest.Reg == "AL" || (isAccumulator(dest.Reg) && !short) {
+			// Accumulator short form: op AL, ib / op AX, iw
+			e.emit(base | 0x04 | w)
+			return e.emitImm(src, is8)
+		}
+		if short {
+			// 83 /r ib sign-extends the byte to a word
+			if err := e.encodeModRM(0x83, reg, dest); err != nil {
+				return err
+			}
+			e.emit(byte(src.Immediate))
+			return nil
+		}
+		if err := e.encodeModRM(0x80|w, reg, dest); err != nil {
+			return err
+		}
+		return e.emitImm(src, is8)
+
+	case isReg8086(src) && isRM8086(dest):
+		return e.encodeModRM(base|w, regCode8086(src.Reg), dest)
+
+	case isReg8086(dest) && isRM8086(src):
+		return e.encodeModRM(base|0x02|w, regCode8086(dest.Reg), src)
+	}
+	return fmt.Errorf("invalid operands for %s", instr)
+}
+
+// encodeMOV encodes all MOV forms
+func (e *encoder8086) encodeMOV(ops []Operand) error {
+	if len(ops) != 2 {
+		return fmt.Errorf("MOV expects 2 operands")
+	}
+	dest, src := ops[0], ops[1]
+
+	// Segment register moves: 8C /sr and 8E /sr
+	if isSreg8086(dest) {
+		if !isRM8086(src) || (isReg8086(src) && registerSize(src.Reg) != 16) {
+			return fmt.Errorf("invalid source for MOV %s", dest.Reg)
+		}
+		return e.encodeModRM(0x8E, sregCodes8086[dest.Reg], src)
+	}
+	if isSreg8086(src) {
+		if !isRM8086(dest) || (isReg8086(dest) && registerSize(dest.Reg) != 16) {
+			return fmt.Errorf("invalid destination for MOV %s", src.Reg)
+		}
+		return e.encodeModRM(0x8C, sregCodes8086[src.Reg], dest)
+	}
+
+	is8, err := operandWidth8086("MOV", ops)
+	if err != nil {
+		return err
+	}
+	w := w8086(is8)
+
+	switch {
+	case isReg8086(dest) && src.Type == OperandTypeImmediate:
+		// B0+r ib / B8+r iw
+		e.emit(0xB0 | w<<3 | regCode8086(dest.Reg))
+		return e.emitImm(src, is8)
+
+	case src.Type == OperandTypeImmediate && isRM8086(dest):
+		if err := e.encodeModRM(0xC6|w, 0, dest); err != nil {
+			return err
+		}
+		return e.emitImm(src, is8)
+
+	case (dest.Reg == "AL" || isAccumulator(dest.Reg)) && src.Type == OperandTypeMemory:
+		// A0/A1: accumulator from direct address
+		e.emitOverride(src)
+		e.emit(0xA0 | w)
+		e.emitWord(src.Address)
+		return nil
+
+	case (src.Reg == "AL" || isAccumulator(src.Reg)) && dest.Type == OperandTypeMemory:
+		// A2/A3: accumulator to direct address
+		e.emitOverride(dest)
+		e.emit(0xA2 | w)
+		e.emitWord(dest.Address)
+		return nil
+
+	case isReg8086(src) && isRM8086(dest):
+		return e.encodeModRM(0x88|w, regCode8086(src.Reg), dest)
+
+	case isReg8086(dest) && isRM8086(src):
+		return e.encodeModRM(0x8A|w, regCode8086(dest.Reg), src)
+	}
+	return fmt.Errorf("invalid operands for MOV")
+}
+
+// encodeTEST encodes TEST, which has no sign-extended immediate form
+func (e *encoder8086) encodeTEST(ops []Operand) error {
+	if len(ops) != 2 {
+		return fmt.Errorf("TEST expects 2 operands")
+	}
+	dest, src := ops[0], ops[1]
+	is8, err := operandWidth8086("TEST", ops)
+	if err != nil {
+		return err
+	}
+	w := w8086(is8)
+
+	switch {
+	case src.Type == OperandTypeImmediate && (dest.Reg == "AL" || isAccumulator(dest.Reg)):
+		e.emit(0xA8 | w)
+		return e.emitImm(src, is8)
+	case src.Type == OperandTypeImmediate && isRM8086(dest):
+		if err := e.encodeModRM(0xF6|w, 0, dest); err != nil {
+			return err
+		}
+		return e.emitImm(src, is8)
+	case isReg8086(src) && isRM8086(dest):
+		return e.encodeModRM(0x84|w, regCode8086(src.Reg), dest)
+	case isReg8086(dest) && isRM8086(src):
+		return e.encodeModRM(0x84|w, regCode8086(dest.Reg), src)
+	}
+	return fmt.Errorf("invalid operands for TEST")
+}
+
+// encodeXCHG encodes XCHG, using 90+r when one side is AX
+func (e *encoder8086) encodeXCHG(ops []Operand) error {
+	if len(ops) != 2 {
+		return fmt.Errorf("XCHG expects 2 operands")
+	}
+	dest, src := ops[0], ops[1]
+	is8, err := operandWidth8086("XCHG", ops)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case isAccumulator(dest.Reg) && isReg8086(src) && !is8:
+		e.emit(0x90 | regCode8086(src.Reg))
+		return nil
+	case isAccumulator(src.Reg) && isReg8086(dest) && !is8:
+		e.emit(0x90 | regCode8086(dest.Reg))
+		return nil
+	case isReg8086(src) && isRM8086(dest):
+		return e.encodeModRM(0x86|w8086(is8), regCode8086(src.Reg), dest)
+	case isReg8086(dest) && isRM8086(src):
+		return e.encodeModRM(0x86|w8086(is8), regCode8086(dest.Reg), src)
+	}
+	return fmt.Errorf("invalid operands for XCHG")
+}
+
+// encodeIncDec encodes INC and DEC, using the one-byte 40+r/48+r forms for words
+func (e *encoder8086) encodeIncDec(instr string, ops []Operand) error {
+	if len(ops) != 1 || !isRM8086(ops[0]) {
+		return fmt.Errorf("%s expects a register or memory operand", instr)
+	}
+	is8, err := operandWidth8086(instr, ops)
+	if err != nil {
+		return err
+	}
+	reg := byte(0)
+	if instr == "DEC" {
+		reg = 1
+	}
+	if isReg8086(ops[0]) && !is8 {
+		e.emit(0x40 | reg<<3 | regCode8086(ops[0].Reg))
+		return nil
+	}
+	return e.encodeModRM(0xFE|w8086(is8), reg, ops[0])
+}
+
+// encodeStack encodes PUSH and POP of registers, segment registers and memory
+func (e *encoder8086) encodeStack(instr string, ops []Operand) error {
+	if len(ops) != 1 {
+		return fmt.Errorf("%s expects 1 operand", instr)
+	}
+	op := ops[0]
+	push := instr == "PUSH"
+
+	switch {
+	case op.Reg == "FS" || op.Reg == "GS":
+		// 0F A0/A1 and 0F A8/A9
+		opcode := byte(0xA0) | (sregCodes8086[op.Reg]&1)<<3
+		if !push {
+			opcode |= 0x01
+		}
+		e.emit(0x0F, opcode)
+		return nil
+
+	case isSreg8086(op):
+		if !push && op.Reg == "CS" {
+			return fmt.Errorf("POP CS is not a valid instruction")
+		}
+		opcode := 0x06 | sregCodes8086[op.Reg]<<3
+		if !push {
+			opcode |= 0x01
+		}
+		e.emit(opcode)
+		return nil
+
+	case isReg8086(op):
+		if is8BitRegister(op.Reg) {
+			return fmt.Errorf("%s requires a 16-bit operand", instr)
+		}
+		if push {
+			e.emit(0x50 | regCode8086(op.Reg))
+		} else {
+			e.emit(0x58 | regCode8086(op.Reg))
+		}
+		return nil
+
+	case op.Type == OperandTypeMemory || op.Type == OperandTypeMemoryReg:
+		if push {
+			return e.encodeModRM(0xFF, 6, op)
+		}
+		return e.encodeModRM(0x8F, 0, op)
+
+	case op.Type == OperandTypeImmediate && push:
+		// 6A ib sign-extends the byte to a word
+		if e.immFitsInt8(op) {
+			e.emit(0x6A, byte(op.Immediate))
+			return nil
+		}
+		e.emit(0x68)
+		return e.emitImm(op, false)
+	}
+	return fmt.Errorf("invalid operand for %s", instr)
+}
+
+// encodeIMUL encodes IMUL reg, r/m, imm, IMUL reg, imm, which multiplies
+// the register by the immediate, and the 80386 IMUL reg, r/m
+func (e *encoder8086) encodeIMUL(ops []Operand) error {
+	if len(ops) == 2 && ops[1].Type == OperandTypeImmediate {
+		ops = []Operand{ops[0], ops[0], ops[1]}
+	}
+	if len(ops) == 2 {
+		if !isReg8086(ops[0]) || !isRM8086(ops[1]) {
+			return fmt.Errorf("IMUL expects a register and a register or memory operand")
+		}
+		if is8, err := operandWidth8086("IMUL", ops); err != nil || is8 {
+			return fmt.Errorf("IMUL reg, r/m requires 16-bit or 32-bit operands")
+		}
+		return e.encodeModRM0F(0xAF, regCode8086(ops[0].Reg), ops[1])
+	}
+	if len(ops) != 3 {
+		return fmt.Errorf("IMUL expects 1 to 3 operands")
+	}
+	dest, src, imm := ops[0], ops[1], ops[2]
+	if !isReg8086(dest) || is8BitRegister(dest.Reg) || !isRM8086(src) ||
+		(isReg8086(src) && is8BitRegister(src.Reg)) || imm.Type != OperandTypeImmediate {
+		return fmt.Errorf("IMUL expects a 16-bit register, a 16-bit register or memory operand and an immediate")
+	}
+	if _, err := operandWidth8086("IMUL", ops[:2]); err != nil {
+		return err
+	}
+
+	// 6B /r ib sign-extends the byte to a word
+	if e.immFitsInt8(imm) {
+		if err := e.encodeModRM(0x6B, regCode8086(dest.Reg), src); err != nil {
+			return err
+		}
+		e.emit(byte(imm.Immediate))
+		return nil
+	}
+	if err := e.encodeModRM(0x69, regCode8086(dest.Reg), src); err != nil {
+		return err
+	}
+	return e.emitImm(imm, false)
+}
+
+// encodeShift encodes shifts and rotates by 1, CL or an immediate count.
+// For the 8086, which has no imm8 form, immediate counts are expanded into
+// repeated shifts by one.
+func (e *encoder8086) encodeShift(instr string, reg byte, ops []Operand) error {
+	if len(ops) != 2 || !isRM8086(ops[0]) {
+		return fmt.Errorf("%s expects a register or memory operand and a count", instr)
+	}
+	is8, err := operandWidth8086(instr, ops[:1])
+	if err != nil {
+		return err
+	}
+	w := w8086(is8)
+	count := ops[1]
+
+	if count.Type == OperandTypeRegister {
+		if count.Reg != "CL" {
+			return fmt.Errorf("%s count must be CL or an immediate", instr)
+		}
+		return e.encodeModRM(0xD2|w, reg, ops[0])
+	}
+	if count.Type != OperandTypeImmediate || count.IsLabel {
+		return fmt.Errorf("%s count must be CL or an immediate", instr)
+	}
+	if count.Immediate > 0x1F {
+		return fmt.Errorf("%s count %d out of range", instr, count.Immediate)
+	}
+	if e.cpu >= emulator.Model186 && count.Immediate != 1 {
+		if err := e.encodeModRM(0xC0|w, reg, ops[0]); err != nil {
+			return err
+		}
+		e.emit(byte(count.Immediate))
+		return nil
+	}
+	for i := uint16(0); i < count.Immediate; i++ {
+		if err := e.encodeModRM(0xD0|w, reg, ops[0]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodeMOVX encodes MOVZX (0F B6/B7) and MOVSX (0F BE/BF)
+func (e *encoder8086) encodeMOVX(instr string, ops []Operand) error {
+	src8, err := movxSource8(instr, ops)
+	if err != nil {
+		return err
+	}
+	if !isRM8086(ops[1]) {
+		return fmt.Errorf("invalid source for %s", instr)
+	}
+	opcode := byte(0xB7)
+	if src8 {
+		opcode = 0xB6
+	}
+	if instr == "MOVSX" {
+		opcode |= 0x08
+	}
+	return e.encodeModRM0F(opcode, regCode8086(ops[0].Reg), ops[1])
+}
+
+// encodeDoubleShift encodes SHLD (0F A4/A5) and SHRD (0F AC/AD), which
+// shift bits of a register into the destination, by an immediate or CL
+func (e *encoder8086) encodeDoubleShift(instr string, ops []Operand) error {
+	if len(ops) != 3 || !isRM8086(ops[0]) || !isReg8086(ops[1]) {
+		return fmt.Errorf("%s expects a register or memory operand, a register and a count", instr)
+	}
+	if is8, err := operandWidth8086(instr, ops[:2]); err != nil || is8 {
+		return fmt.Errorf("%s requires 16-bit or 32-bit operands", instr)
+	}
+	opcode := byte(0xA4)
+	if instr == "SHRD" {
+		opcode = 0xAC
+	}
+
+	count := ops[2]
+	switch {
+	case count.Type == OperandTypeRegister && count.Reg == "CL":
+		return e.encodeModRM0F(opcode|1, regCode8086(ops[1].Reg), ops[0])
+	case count.Type == OperandTypeImmediate && !count.IsLabel && count.Immediate <= 0x1F:
+		if err := e.encodeModRM0F(opcode, regCode8086(ops[1].Reg), ops[0]); err != nil {
+			return err
+		}
+		e.emit(byte(count.Immediate))
+		return nil
+	}
+	return fmt.Errorf("%s count must be CL or an immediate up to 31", instr)
+}
+
+// encodeBT encodes BT, BTS, BTR and BTC with a register or an immediate
+// bit index
+func (e *encoder8086) encodeBT(instr string, reg byte, ops []Operand) error {
+	if len(ops) != 2 || !isRM8086(ops[0]) {
+		return fmt.Errorf("%s expects a register or memory operand and a bit index", instr)
+	}
+	if is8, err := operandWidth8086(instr, ops); err != nil || is8 {
+		return fmt.Errorf("%s requires 16-bit or 32-bit operands", instr)
+	}
+
+	index := ops[1]
+	switch {
+	case isReg8086(index):
+		return e.encodeModRM0F(0xA3|(reg&3)<<3, regCode8086(index.Reg), ops[0])
+	case index.Type == OperandTypeImmediate && !index.IsLabel && index.Immediate <= 0xFF:
+		if err := e.encodeModRM0F(0xBA, reg, ops[0]); err != nil {
+			return err
+		}
+		e.emit(byte(index.Immediate))
+		return nil
+	}
+	return fmt.Errorf("%s bit index must be a register or an 8-bit immediate", instr)
+}
+
+// encodeSETcc encodes SETcc (0F 90+cc), which stores 1 or 0 in a byte
+func (e *encoder8086) encodeSETcc(instr string, cc byte, ops []Operand) error {
+	if len(ops) != 1 || !isRM8086(ops[0]) || (isReg8086(ops[0]) && !is8BitRegister(ops[0].Reg)) ||
+		(ops[0].Size != 0 && ops[0].Size != 8) {
+		return fmt.Errorf("%s expects an 8-bit register or memory operand", instr)
+	}
+	return e.encodeModRM0F(0x90|cc, 0, ops[0])
+}
+
+// branchTarget returns the target of a jump operand
+func branchTarget(instr string, ops []Operand) (Operand, error) {
+	if len(ops) != 1 || ops[0].Type != OperandTypeImmediate {
+		return Operand{}, fmt.Errorf("%s expects a label or address", instr)
+	}
+	return ops[0], nil
+}
+
+// short returns the displacement from the end of an n-byte short branch to
+// target, and whether the short form can be used. Unresolved forward labels
+// are assumed short; once a branch needs its long form it keeps it, so the
+// layout passes only ever grow code and always converge.
+func (e *encoder8086) short(target Operand, n int) (byte, bool) {
+	if e.long {
+		return 0, false
+	}
+	if target.Unresolved {
+		return 0, true
+	}
+	disp := target.Immediate - e.next(n)
+	if !fitsInt8(disp) {
+		e.long = true
+		return 0, false
+	}
+	return byte(disp), true
+}
+
+// emitNear emits a near JMP (E9) or CALL (E8) to target
+func (e *encoder8086) emitNear(opcode byte, target uint16) {
+	disp := target - e.next(3)
+	e.emit(opcode)
+	e.emitWord(disp)
+}
+
+// encodeJcc encodes a conditional jump. Targets beyond the short range
+// become the inverse condition jumping over a near JMP.
+func (e *encoder8086) encodeJcc(instr string, opcode byte, ops []Operand) error {
+	target, err := branchTarget(instr, ops)
+	if err != nil {
+		return err
+	}
+	if disp, ok := e.short(target, 2); ok {
+		e.emit(opcode, disp)
+		return nil
+	}
+	e.emit(opcode^1, 3)
+	e.emitNear(0xE9, target.Immediate)
+	return nil
+}
+
+// encodeLoop encodes LOOP, LOOPZ and LOOPNZ. These only exist with a short
+// displacement, so distant targets loop to a near JMP:
+//
+//	LOOP take ; JMP SHORT done ; take: JMP NEAR target ; done:
+func (e *encoder8086) encodeLoop(instr string, opcode byte, ops []Operand) error {
+	target, err := branchTarget(instr, ops)
+	if err != nil {
+		return err
+	}
+	if disp, ok := e.short(target, 2); ok {
+		e.emit(opcode, disp)
+		return nil
+	}
+	e.emit(opcode, 2, 0xEB, 3)
+	e.emitNear(0xE9, target.Immediate)
+	return nil
+}
+
+// encodeJmpCall encodes direct and indirect JMP and CALL
+func (e *encoder8086) encodeJmpCall(instr string, ops []Operand) error {
+	if len(ops) == 1 && isRM8086(ops[0]) {
+		if isReg8086(ops[0]) && is8BitRegister(ops[0].Reg) {
+			return fmt.Errorf("%s requires a 16-bit operand", instr)
+		}
+		// FF /4 (JMP) and FF /2 (CALL) take the target from a register or memory
+		if instr == "JMP" {
+			return e.encodeModRM(0xFF, 4, ops[0])
+		}
+		return e.encodeModRM(0xFF, 2, ops[0])
+	}
+
+	target, err := branchTarget(instr, ops)
+	if err != nil {
+		return err
+	}
+	if instr == "CALL" {
+		e.emitNear(0xE8, target.Immediate)
+		return nil
+	}
+	if disp, ok := e.short(target, 2); ok {
+		e.emit(0xEB, disp)
+		return nil
+	}
+	e.emitNear(0xE9, target.Immediate)
+	return nil
+}
+
+// encodeIO encodes IN and OUT with an immediate port or DX
+func (e *encoder8086) encodeIO(instr string, ops []Operand) error {
+	if len(ops) != 2 {
+		return fmt.Errorf("%s expects 2 operands", instr)
+	}
+	acc, port := ops[0], ops[1]
+	opcode := byte(0xE4)
+	if instr == "OUT" {
+		acc, port = ops[1], ops[0]
+		opcode = 0xE6
+	}
+
+	var w byte
+	switch acc.Reg {
+	case "AL":
+		w = 0
+	case "AX":
+		w = 1
+	default:
+		return fmt.Errorf("%s requires AL or AX", instr)
+	}
+
+	switch {
+	case port.Type == OperandTypeRegister && port.Reg == "DX":
+		e.emit(opcode | 0x08 | w)
+	case port.Type == OperandTypeImmediate && port.Immediate <= 0xFF:
+		e.emit(opcode|w, byte(port.Immediate))
+	default:
+		return fmt.Errorf("%s port must be DX or an 8-bit immediate", instr)
+	}
+	return nil
+}
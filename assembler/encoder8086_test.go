@@ -0,0 +1,477 @@
+package assembler
+
+import (
+	"assembly-emulator/emulator"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// assemble8086 assembles source with the 8086 backend at the given origin
+func assemble8086(t *testing.T, source string, origin uint16) *Program {
+	t.Helper()
+	tokens, err := NewLexer(source).Tokenize()
+	if err != nil {
+		t.Fatalf("Lexer failed: %v", err)
+	}
+	parser := NewParser(tokens)
+	parser.SetBackend(Backend8086, origin)
+	program, err := parser.Parse()
+	if err != nil {
+		t.Fatalf("Parser failed: %v", err)
+	}
+	return program
+}
+
+// assembleFor assembles source for a backend and processor
+func assembleFor(source string, backend Backend, model emulator.CPUModel) (*Program, error) {
+	tokens, err := NewLexer(source).Tokenize()
+	if err != nil {
+		return nil, err
+	}
+	parser := NewParser(tokens)
+	parser.SetBackend(backend, 0)
+	parser.SetCPU(model)
+	return parser.Parse()
+}
+
+// TestEncode8086Instructions compares single instructions with NASM's encodings
+func TestEncode8086Instructions(t *testing.T) {
+	tests := []struct {
+		source string
+		want   []byte
+	}{
+		{"MOV AX, 1234h", []byte{0xB8, 0x34, 0x12}},
+		{"MOV AL, 5", []byte{0xB0, 0x05}},
+		{"MOV BX, CX", []byte{0x89, 0xCB}},
+		{"MOV [1234h], AX", []byte{0xA3, 0x34, 0x12}},
+		{"MOV AL, [10h]", []byte{0xA0, 0x10, 0x00}},
+		{"MOV [BX], DL", []byte{0x88, 0x17}},
+		{"MOV DX, [SI+4]", []byte{0x8B, 0x54, 0x04}},
+		{"MOV [BP], AX", []byte{0x89, 0x46, 0x00}},
+		{"MOV BYTE PTR [BX+200h], 7", []byte{0xC6, 0x87, 0x00, 0x02, 0x07}},
+		{"MOV WORD [BX], 1", []byte{0xC7, 0x07, 0x01, 0x00}},
+		{"MOV [BX], 1", []byte{0xC6, 0x07, 0x01}},
+		{"MOV DS, AX", []byte{0x8E, 0xD8}},
+		{"MOV AX, ES", []byte{0x8C, 0xC0}},
+		{"ADD AX, 1", []byte{0x83, 0xC0, 0x01}},
+		{"ADD AX, 1000h", []byte{0x05, 0x00, 0x10}},
+		{"SUB BX, 300h", []byte{0x81, 0xEB, 0x00, 0x03}},
+		{"SUB BX, 0FFFFh", []byte{0x83, 0xEB, 0xFF}},
+		{"CMP AL, 3", []byte{0x3C, 0x03}},
+		{"AND CL, 0Fh", []byte{0x80, 0xE1, 0x0F}},
+		{"XOR AX, AX", []byte{0x31, 0xC0}},
+		{"CMP CX, [SI]", []byte{0x3B, 0x0C}},
+		{"OR WORD [1000h], 80h", []byte{0x81, 0x0E, 0x00, 0x10, 0x80, 0x00}},
+		{"TEST AL, 1", []byte{0xA8, 0x01}},
+		{"TEST CX, 8000h", []byte{0xF7, 0xC1, 0x00, 0x80}},
+		{"INC CX", []byte{0x41}},
+		{"DEC BL", []byte{0xFE, 0xCB}},
+		{"INC WORD [BX]", []byte{0xFF, 0x07}},
+		{"PUSH ES", []byte{0x06}},
+		{"POP DS", []byte{0x1F}},
+		{"PUSH BX", []byte{0x53}},
+		{"POP WORD [BX]", []byte{0x8F, 0x07}},
+		{"XCHG AX, BX", []byte{0x93}},
+		{"XCHG AL, AH", []byte{0x86, 0xE0}},
+		{"SHL AX, 1", []byte{0xD1, 0xE0}},
+		{"SHR DX, CL", []byte{0xD3, 0xEA}},
+		{"SAR BL, 3", []byte{0xD0, 0xFB, 0xD0, 0xFB, 0xD0, 0xFB}},
+		{"MUL BX", []byte{0xF7, 0xE3}},
+		{"NEG AL", []byte{0xF6, 0xD8}},
+		{"NOT WORD [SI]", []byte{0xF7, 0x14}},
+		{"JMP BX", []byte{0xFF, 0xE3}},
+		{"CALL [BX+2]", []byte{0xFF, 0x57, 0x02}},
+		{"INT 10h", []byte{0xCD, 0x10}},
+		{"INT 3", []byte{0xCD, 0x03}},
+		{"IRET", []byte{0xCF}},
+		{"RET", []byte{0xC3}},
+		{"RET 4", []byte{0xC2, 0x04, 0x00}},
+		{"IN AL, DX", []byte{0xEC}},
+		{"IN AX, 60h", []byte{0xE5, 0x60}},
+		{"OUT 43h, AL", []byte{0xE6, 0x43}},
+		{"OUT DX, AX", []byte{0xEF}},
+		{"REP STOSB", []byte{0xF3, 0xAA}},
+		{"LODSW", []byte{0xAD}},
+		{"NOP", []byte{0x90}},
+		{"HLT", []byte{0xF4}},
+		{"PUSHF", []byte{0x9C}},
+		{"POPF", []byte{0x9D}},
+		{"SAHF", []byte{0x9E}},
+		{"LAHF", []byte{0x9F}},
+		{"CMC", []byte{0xF5}},
+		{"CLC", []byte{0xF8}},
+		{"STI", []byte{0xFB}},
+		{"STD", []byte{0xFD}},
+		{"ADC DX, 0", []byte{0x83, 0xD2, 0x00}},
+		{"SBB AX, 0FFF1h", []byte{0x83, 0xD8, 0xF1}},
+		{"SBB AL, BL", []byte{0x18, 0xD8}},
+		{"ADC AX, 1000h", []byte{0x15, 0x00, 0x10}},
+		{"RCL AX, 1", []byte{0xD1, 0xD0}},
+		{"RCR BYTE [BX], CL", []byte{0xD2, 0x1F}},
+		{"CBW", []byte{0x98}},
+		{"CWD", []byte{0x99}},
+		{"DAA", []byte{0x27}},
+		{"AAS", []byte{0x3F}},
+		{"AAM", []byte{0xD4, 0x0A}},
+		{"AAD 16", []byte{0xD5, 0x10}},
+		{"IMUL BX", []byte{0xF7, 0xEB}},
+		{"IDIV BYTE [SI]", []byte{0xF6, 0x3C}},
+		{"DEC BYTE [DI]", []byte{0xFE, 0x0D}},
+		{"MOV ES:[DI+319], AL", []byte{0x26, 0x88, 0x85, 0x3F, 0x01}},
+		{"MOV AX, [BX+SI]", []byte{0x8B, 0x00}},
+		{"MOV [BP+DI-4], AL", []byte{0x88, 0x43, 0xFC}},
+		{"MOV DX, [BX+DI+1000h]", []byte{0x8B, 0x91, 0x00, 0x10}},
+		{"ADD AX, [SI+BP]", []byte{0x03, 0x02}},
+		{"MOV BX, [BP-2]", []byte{0x8B, 0x5E, 0xFE}},
+		{"INC WORD [BX+SI+2-2]", []byte{0xFF, 0x00}},
+		{"MOV AL, ES:[BX]", []byte{0x26, 0x8A, 0x07}},
+		{"MOV AX, [ES:BX+2]", []byte{0x26, 0x8B, 0x47, 0x02}},
+		{"MOV AX, CS:[10h]", []byte{0x2E, 0xA1, 0x10, 0x00}},
+		{"MOV DS:[DI], AX", []byte{0x3E, 0x89, 0x05}},
+		{"MOV CX, SS:[BX+SI]", []byte{0x36, 0x8B, 0x08}},
+		{"SHL BYTE ES:[BX], 2", []byte{0x26, 0xD0, 0x27, 0x26, 0xD0, 0x27}},
+		{"CMPSW", []byte{0xA7}},
+		{"REPE CMPSB", []byte{0xF3, 0xA6}},
+		{"REPNE SCASW", []byte{0xF2, 0xAF}},
+		{"REP LODSB", []byte{0xF3, 0xAC}},
+		{"MOVSW CS:[SI]", []byte{0x2E, 0xA5}},
+		{"REP MOVSB ES:[SI]", []byte{0xF3, 0x26, 0xA4}},
+	}
+
+	for _, tt := range tests {
+		program := assemble8086(t, tt.source, 0)
+		if !bytes.Equal(program.CodeBytes, tt.want) {
+			t.Errorf("%s: expected % X, got % X", tt.source, tt.want, program.CodeBytes)
+		}
+	}
+}
+
+// TestEncode8086Errors tests operands the 8086 cannot encode
+func TestEncode8086Errors(t *testing.T) {
+	sources := []string{
+		"MOV [AX], BX",
+		"MOV AL, BX",
+		"PUSH AL",
+		"POP CS",
+		"SHL AX, DX",
+		"MOV AL, 1234h",
+		"REP ADD AX, BX",
+		"IMUL AX, BX, 3",
+		"AAM AX",
+		"MOV AX, [BX+BP]",
+		"MOV AX, [SI+DI]",
+		"MOV AX, [BX-SI]",
+		"MOV AX, [BX+SI+DI]",
+		"MOV AX, AX:[BX]",
+		"MOV AX, ES:BX",
+		"MOV AX, [AL]",
+		"REPE STOSB",
+		"SCASB ES:[SI]",
+	}
+
+	for _, source := range sources {
+		tokens, err := NewLexer(source).Tokenize()
+		if err != nil {
+			t.Fatalf("Lexer failed: %v", err)
+		}
+		parser := NewParser(tokens)
+		parser.SetBackend(Backend8086, 0)
+		if _, err := parser.Parse(); err == nil {
+			t.Errorf("%s: expected an encoding error", source)
+		}
+	}
+}
+
+// TestEncode80186 tests the 80186 encodings, and that the 8086 and 80186
+// reject instructions added after them
+func TestEncode80186(t *testing.T) {
+	tests := []struct {
+		source string
+		want   []byte
+	}{
+		{"PUSHA", []byte{0x60}},
+		{"POPA", []byte{0x61}},
+		{"PUSH 0FFFEh", []byte{0x6A, 0xFE}},
+		{"PUSH 1234h", []byte{0x68, 0x34, 0x12}},
+		{"IMUL DX, CX, 3", []byte{0x6B, 0xD1, 0x03}},
+		{"IMUL AX, 300h", []byte{0x69, 0xC0, 0x00, 0x03}},
+		{"IMUL SI, [BX+4], 10", []byte{0x6B, 0x77, 0x04, 0x0A}},
+		{"SHL AX, 4", []byte{0xC1, 0xE0, 0x04}},
+		{"SHR BYTE [BX], 2", []byte{0xC0, 0x2F, 0x02}},
+		{"SHL AX, 1", []byte{0xD1, 0xE0}},
+		{"ENTER 4, 0", []byte{0xC8, 0x04, 0x00, 0x00}},
+		{"LEAVE", []byte{0xC9}},
+		{"BOUND AX, [SI]", []byte{0x62, 0x04}},
+		{"REP INSB", []byte{0xF3, 0x6C}},
+		{"OUTSW", []byte{0x6F}},
+		{"REP OUTSB CS:[SI]", []byte{0xF3, 0x2E, 0x6E}},
+	}
+	for _, tt := range tests {
+		program, err := assembleFor(tt.source, Backend8086, emulator.Model186)
+		if err != nil {
+			t.Errorf("%s: parser failed: %v", tt.source, err)
+		} else if !bytes.Equal(program.CodeBytes, tt.want) {
+			t.Errorf("%s: expected % X, got % X", tt.source, tt.want, program.CodeBytes)
+		}
+	}
+
+	errors := []struct {
+		source string
+		model  emulator.CPUModel
+	}{
+		{"PUSHA", emulator.Model8086},
+		{"PUSH 5", emulator.Model8086},
+		{"ENTER 4, 0", emulator.Model8086},
+		{"INSB", emulator.Model8086},
+		{"IMUL AX, 3", emulator.Model8086},
+		{"IMUL AX, BX", emulator.Model286},
+		{"BOUND AL, [SI]", emulator.Model186},
+		{"BOUND AX, BX", emulator.Model186},
+		{"ENTER 4, 300", emulator.Model186},
+		{"INSB ES:[SI]", emulator.Model186},
+	}
+	for _, tt := range errors {
+		if _, err := assembleFor(tt.source, Backend8086, tt.model); err == nil {
+			t.Errorf("%s on the %s: expected an error", tt.source, tt.model)
+		}
+	}
+}
+
+// TestEncode80386 tests the operand-size and address-size prefixes, the
+// 32-bit addressing forms and the 80386 two-byte opcodes
+func TestEncode80386(t *testing.T) {
+	tests := []struct {
+		source string
+		want   []byte
+	}{
+		{"MOV EAX, 12345678h", []byte{0x66, 0xB8, 0x78, 0x56, 0x34, 0x12}},
+		{"MOV EAX, EBX", []byte{0x66, 0x89, 0xD8}},
+		{"ADD EAX, 1", []byte{0x66, 0x83, 0xC0, 0x01}},
+		{"ADD EAX, 100000h", []byte{0x66, 0x05, 0x00, 0x00, 0x10, 0x00}},
+		{"SUB ECX, -2", []byte{0x66, 0x83, 0xE9, 0xFE}},
+		{"MOV DWORD [200h], 5", []byte{0x66, 0xC7, 0x06, 0x00, 0x02, 0x05, 0x00, 0x00, 0x00}},
+		{"PUSH EAX", []byte{0x66, 0x50}},
+		{"POP EBX", []byte{0x66, 0x5B}},
+		{"INC ESI", []byte{0x66, 0x46}},
+		{"MUL EBX", []byte{0x66, 0xF7, 0xE3}},
+		{"SHL EAX, 4", []byte{0x66, 0xC1, 0xE0, 0x04}},
+		{"XCHG EAX, EDX", []byte{0x66, 0x92}},
+		{"IMUL AX, BX", []byte{0x0F, 0xAF, 0xC3}},
+		{"IMUL EAX, ECX, 1000", []byte{0x66, 0x69, 0xC1, 0xE8, 0x03, 0x00, 0x00}},
+		{"CWDE", []byte{0x66, 0x98}},
+		{"CDQ", []byte{0x66, 0x99}},
+		{"MOVZX EAX, BYTE [SI]", []byte{0x66, 0x0F, 0xB6, 0x04}},
+		{"MOVSX CX, AL", []byte{0x0F, 0xBE, 0xC8}},
+		{"SHLD EAX, EDX, 8", []byte{0x66, 0x0F, 0xA4, 0xD0, 0x08}},
+		{"SHRD AX, DX, CL", []byte{0x0F, 0xAD, 0xD0}},
+		{"BT AX, 3", []byte{0x0F, 0xBA, 0xE0, 0x03}},
+		{"BTS [BX], CX", []byte{0x0F, 0xAB, 0x0F}},
+		{"BSF EAX, ECX", []byte{0x66, 0x0F, 0xBC, 0xC1}},
+		{"SETB AL", []byte{0x0F, 0x92, 0xC0}},
+		{"SETNE BYTE [DI]", []byte{0x0F, 0x95, 0x05}},
+		{"PUSH FS", []byte{0x0F, 0xA0}},
+		{"POP GS", []byte{0x0F, 0xA9}},
+		{"MOV FS, AX", []byte{0x8E, 0xE0}},
+		{"MOV AX, FS:[BX]", []byte{0x64, 0x8B, 0x07}},
+		{"MOV EAX, [EBX+ESI*4+8]", []byte{0x66, 0x67, 0x8B, 0x44, 0xB3, 0x08}},
+		{"MOV AX, [EBP]", []byte{0x67, 0x8B, 0x45, 0x00}},
+		{"MOV AX, [ESP+4]", []byte{0x67, 0x8B, 0x44, 0x24, 0x04}},
+		{"MOV AX, [ECX*2]", []byte{0x67, 0x8B, 0x04, 0x4D, 0x00, 0x00, 0x00, 0x00}},
+		{"MOV AX, [EDI-4]", []byte{0x67, 0x8B, 0x47, 0xFC}},
+	}
+	for _, tt := range tests {
+		program, err := assembleFor(tt.source, Backend8086, emulator.Model386)
+		if err != nil {
+			t.Errorf("%s: parser failed: %v", tt.source, err)
+		} else if !bytes.Equal(program.CodeBytes, tt.want) {
+			t.Errorf("%s: expected % X, got % X", tt.source, tt.want, program.CodeBytes)
+		}
+	}
+
+	errors := []struct {
+		source string
+		model  emulator.CPUModel
+	}{
+		{"MOV EAX, 1", emulator.Model286},
+		{"PUSH FS", emulator.Model286},
+		{"SETE AL", emulator.Model286},
+		{"MOV EAX, BX", emulator.Model386},
+		{"JMP EAX", emulator.Model386},
+		{"SETE AX", emulator.Model386},
+		{"MOVZX EAX, [SI]", emulator.Model386},
+		{"BT AL, 1", emulator.Model386},
+		{"MOV AX, [EBX+SI]", emulator.Model386},
+		{"MOV AX, [ESP*2]", emulator.Model386},
+		{"MOV AX, [EAX*3]", emulator.Model386},
+	}
+	for _, tt := range errors {
+		if _, err := assembleFor(tt.source, Backend8086, tt.model); err == nil {
+			t.Errorf("%s on the %s: expected an error", tt.source, tt.model)
+		}
+	}
+}
+
+// TestEncode8087 tests the x87 register, memory and fixed forms and the
+// WAIT prefix of the instructions that wait for the coprocessor
+func TestEncode8087(t *testing.T) {
+	tests := []struct {
+		source string
+		want   []byte
+	}{
+		{"FINIT", []byte{0x9B, 0xDB, 0xE3}},
+		{"FNINIT", []byte{0xDB, 0xE3}},
+		{"FWAIT", []byte{0x9B}},
+		{"FLD1", []byte{0xD9, 0xE8}},
+		{"FLDPI", []byte{0xD9, 0xEB}},
+		{"FCHS", []byte{0xD9, 0xE0}},
+		{"FABS", []byte{0xD9, 0xE1}},
+		{"FSQRT", []byte{0xD9, 0xFA}},
+		{"FSIN", []byte{0xD9, 0xFE}},
+		{"FLD ST(1)", []byte{0xD9, 0xC1}},
+		{"FLD QWORD [200h]", []byte{0xDD, 0x06, 0x00, 0x02}},
+		{"FLD DWORD [BX]", []byte{0xD9, 0x07}},
+		{"FLD TBYTE [SI+4]", []byte{0xDB, 0x6C, 0x04}},
+		{"FSTP QWORD [200h]", []byte{0xDD, 0x1E, 0x00, 0x02}},
+		{"FSTP ST2", []byte{0xDD, 0xDA}},
+		{"FST ST(3)", []byte{0xDD, 0xD3}},
+		{"FILD WORD [200h]", []byte{0xDF, 0x06, 0x00, 0x02}},
+		{"FILD QWORD [200h]", []byte{0xDF, 0x2E, 0x00, 0x02}},
+		{"FIST DWORD [200h]", []byte{0xDB, 0x16, 0x00, 0x02}},
+		{"FIADD WORD [200h]", []byte{0xDE, 0x06, 0x00, 0x02}},
+		{"FADD ST0, ST1", []byte{0xD8, 0xC1}},
+		{"FADD ST(2), ST", []byte{0xDC, 0xC2}},
+		{"FADD DWORD [BX]", []byte{0xD8, 0x07}},
+		{"FMUL ST0, ST0", []byte{0xD8, 0xC8}},
+		{"FMULP", []byte{0xDE, 0xC9}},
+		{"FSUB", []byte{0xDE, 0xE9}},
+		{"FSUB ST1, ST0", []byte{0xDC, 0xE9}},
+		{"FSUBP ST2, ST0", []byte{0xDE, 0xEA}},
+		{"FDIVR ST1, ST0", []byte{0xDC, 0xF1}},
+		{"FDIVR QWORD [BX]", []byte{0xDC, 0x3F}},
+		{"FCOMP ST1", []byte{0xD8, 0xD9}},
+		{"FCOM", []byte{0xD8, 0xD1}},
+		{"FCOMPP", []byte{0xDE, 0xD9}},
+		{"FUCOMPP", []byte{0xDA, 0xE9}},
+		{"FXCH", []byte{0xD9, 0xC9}},
+		{"FFREE ST7", []byte{0xDD, 0xC7}},
+		{"FSTSW AX", []byte{0x9B, 0xDF, 0xE0}},
+		{"FNSTSW WORD [200h]", []byte{0xDD, 0x3E, 0x00, 0x02}},
+		{"FLDCW [200h]", []byte{0xD9, 0x2E, 0x00, 0x02}},
+		{"FNSTCW [200h]", []byte{0xD9, 0x3E, 0x00, 0x02}},
+	}
+	for _, tt := range tests {
+		program, err := assembleFor(tt.source, Backend8086, emulator.Model486)
+		if err != nil {
+			t.Errorf("%s: parser failed: %v", tt.source, err)
+		} else if !bytes.Equal(program.CodeBytes, tt.want) {
+			t.Errorf("%s: expected % X, got % X", tt.source, tt.want, program.CodeBytes)
+		}
+	}
+
+	errors := []struct {
+		source string
+		model  emulator.CPUModel
+	}{
+		{"FSIN", emulator.Model286},
+		{"FUCOM ST1", emulator.Model286},
+		{"FSTSW AX", emulator.Model8086},
+		{"FLD [200h]", emulator.Model486},
+		{"FST TBYTE [200h]", emulator.Model486},
+		{"FILD BYTE [200h]", emulator.Model486},
+		{"FADD ST1, ST2", emulator.Model486},
+		{"FADDP ST1, ST2", emulator.Model486},
+		{"FLD ST(8)", emulator.Model486},
+		{"FLD AX", emulator.Model486},
+		{"FSTSW BX", emulator.Model486},
+		{"FCHS ST1", emulator.Model486},
+		{"MOV AX, ST1", emulator.Model486},
+		{"MOV AX, QWORD [200h]", emulator.Model486},
+	}
+	for _, tt := range errors {
+		if _, err := assembleFor(tt.source, Backend8086, tt.model); err == nil {
+			t.Errorf("%s on the %s: expected an error", tt.source, tt.model)
+		}
+	}
+}
+
+// TestEncode8086Jumps tests short/near jump selection and branch relaxation
+func TestEncode8086Jumps(t *testing.T) {
+	// Backward and forward short jumps
+	program := assemble8086(t, `top:
+    JMP top
+    JE done
+    LOOP top
+    CALL top
+done:
+    HLT`, 0x100)
+	want := []byte{
+		0xEB, 0xFE, // 0100: JMP 0100
+		0x74, 0x05, // 0102: JE 0109
+		0xE2, 0xFA, // 0104: LOOP 0100
+		0xE8, 0xF7, 0xFF, // 0106: CALL 0100
+		0xF4, // 0109: HLT
+	}
+	if !bytes.Equal(program.CodeBytes, want) {
+		t.Errorf("Expected % X, got % X", want, program.CodeBytes)
+	}
+
+	// Targets beyond 127 bytes become near jumps; Jcc and LOOP are relaxed
+	// into an inverted Jcc or a LOOP trampoline around a near JMP
+	far := strings.Repeat("NOP\n", 200)
+	program = assemble8086(t, "JMP done\nJNE done\nLOOP done\n"+far+"done:\nHLT", 0)
+	want = []byte{
+		0xE9, 0xD4, 0x00, // 0000: JMP 00D7
+		0x74, 0x03, 0xE9, 0xCF, 0x00, // 0003: JE +3 ; JMP 00D7
+		0xE2, 0x02, 0xEB, 0x03, 0xE9, 0xC8, 0x00, // 0008: LOOP +2 ; JMP +3 ; JMP 00D7
+	}
+	if !bytes.Equal(program.CodeBytes[:len(want)], want) {
+		t.Errorf("Expected % X, got % X", want, program.CodeBytes[:len(want)])
+	}
+	if len(program.CodeBytes) != len(want)+200+1 {
+		t.Errorf("Expected %d bytes of code, got %d", len(want)+201, len(program.CodeBytes))
+	}
+}
+
+// TestEncode8086FlatImage tests that data follows code in the flat image and
+// that data labels resolve to their offset from the origin
+func TestEncode8086FlatImage(t *testing.T) {
+	program := assemble8086(t, `.data
+msg: DB "Hi", 0
+.code
+    MOV SI, msg
+    RET`, 0x100)
+
+	want := []byte{
+		0xBE, 0x04, 0x01, // MOV SI, 0104h
+		0xC3,           // RET
+		'H', 'i', 0x00, // msg
+	}
+	if got := program.Flat(); !bytes.Equal(got, want) {
+		t.Errorf("Expected % X, got % X", want, got)
+	}
+	if program.Backend != Backend8086 || program.Origin != 0x100 {
+		t.Errorf("Unexpected backend %d origin %04X", program.Backend, program.Origin)
+	}
+}
+
+// TestEncode8086LabelAddresses tests labels as memory displacements, which
+// always take the 16-bit form since they may move between layout passes
+func TestEncode8086LabelAddresses(t *testing.T) {
+	program := assemble8086(t, `    MOV AL, CS:[table+SI]
+    MOV AX, [table+BX+2]
+    MOV [BP+table-100h], CL
+    HLT
+table: DB 1, 2, 3`, 0x100)
+
+	want := []byte{
+		0x2E, 0x8A, 0x84, 0x0E, 0x01, // 0100: MOV AL, CS:[010Eh+SI]
+		0x8B, 0x87, 0x10, 0x01, // 0105: MOV AX, [0110h+BX]
+		0x88, 0x8E, 0x0E, 0x00, // 0109: MOV [BP+000Eh], CL
+		0xF4,             // 010D: HLT
+		0x01, 0x02, 0x03, // 010E: table
+	}
+	if !bytes.Equal(program.CodeBytes, want) {
+		t.Errorf("Expected % X, got % X", want, program.CodeBytes)
+	}
+}
@@ -0,0 +1,415 @@
+package assembler
+
+import (
+	"assembly-emulator/emulator"
+	"fmt"
+	"strings"
+)
+
+// fpuMnemonics maps the x87 mnemonics to their operation. The FN forms skip
+// the WAIT that the 8086 backend puts ahead of FINIT, FCLEX, FSTSW and FSTCW.
+var fpuMnemonics = map[string]emulator.FPUOp{
+	"FLD": emulator.OpFLD, "FST": emulator.OpFST, "FSTP": emulator.OpFSTP,
+	"FILD": emulator.OpFILD, "FIST": emulator.OpFIST, "FISTP": emulator.OpFISTP,
+	"FXCH": emulator.OpFXCH,
+	"FLDZ": emulator.OpFLDZ, "FLD1": emulator.OpFLD1, "FLDPI": emulator.OpFLDPI,
+	"FLDL2E": emulator.OpFLDL2E, "FLDL2T": emulator.OpFLDL2T,
+	"FLDLG2": emulator.OpFLDLG2, "FLDLN2": emulator.OpFLDLN2,
+
+	"FADD": emulator.OpFADD, "FADDP": emulator.OpFADDP,
+	"FSUB": emulator.OpFSUB, "FSUBP": emulator.OpFSUBP,
+	"FSUBR": emulator.OpFSUBR, "FSUBRP": emulator.OpFSUBRP,
+	"FMUL": emulator.OpFMUL, "FMULP": emulator.OpFMULP,
+	"FDIV": emulator.OpFDIV, "FDIVP": emulator.OpFDIVP,
+	"FDIVR": emulator.OpFDIVR, "FDIVRP": emulator.OpFDIVRP,
+	"FIADD": emulator.OpFIADD, "FISUB": emulator.OpFISUB, "FISUBR": emulator.OpFISUBR,
+	"FIMUL": emulator.OpFIMUL, "FIDIV": emulator.OpFIDIV, "FIDIVR": emulator.OpFIDIVR,
+
+	"FSQRT": emulator.OpFSQRT, "FABS": emulator.OpFABS, "FCHS": emulator.OpFCHS,
+	"FRNDINT": emulator.OpFRNDINT, "FSCALE": emulator.OpFSCALE,
+	"FPREM": emulator.OpFPREM, "FPREM1": emulator.OpFPREM1, "FXTRACT": emulator.OpFXTRACT,
+
+	"FCOM": emulator.OpFCOM, "FCOMP": emulator.OpFCOMP, "FCOMPP": emulator.OpFCOMPP,
+	"FICOM": emulator.OpFICOM, "FICOMP": emulator.OpFICOMP,
+	"FUCOM": emulator.OpFUCOM, "FUCOMP": emulator.OpFUCOMP, "FUCOMPP": emulator.OpFUCOMPP,
+	"FTST": emulator.OpFTST, "FXAM": emulator.OpFXAM,
+
+	"FSIN": emulator.OpFSIN, "FCOS": emulator.OpFCOS, "FSINCOS": emulator.OpFSINCOS,
+	"FPTAN": emulator.OpFPTAN, "FPATAN": emulator.OpFPATAN, "F2XM1": emulator.OpF2XM1,
+	"FYL2X": emulator.OpFYL2X, "FYL2XP1": emulator.OpFYL2XP1,
+
+	"FINIT": emulator.OpFINIT, "FNINIT": emulator.OpFINIT,
+	"FCLEX": emulator.OpFCLEX, "FNCLEX": emulator.OpFCLEX,
+	"FLDCW": emulator.OpFLDCW,
+	"FSTCW": emulator.OpFSTCW, "FNSTCW": emulator.OpFSTCW,
+	"FSTSW": emulator.OpFSTSW, "FNSTSW": emulator.OpFSTSW,
+	"FWAIT": emulator.OpFWAIT, "WAIT": emulator.OpFWAIT,
+	"FNOP": emulator.OpFNOP, "FFREE": emulator.OpFFREE,
+	"FINCSTP": emulator.OpFINCSTP, "FDECSTP": emulator.OpFDECSTP,
+}
+
+// fpuWait lists the mnemonics assembled with a WAIT (9Bh) ahead of them by
+// the 8086 backend, so that the CPU waits for the coprocessor to finish
+var fpuWait = map[string]bool{
+	"FINIT": true, "FCLEX": true, "FSTSW": true, "FSTCW": true,
+}
+
+// fpuArithReg maps the register-stack arithmetic to the reg field of its
+// D8h (ST0, ST(i)) form. The DCh and DEh forms, which store into ST(i),
+// swap the plain and reversed subtraction and division: reg ^ 1.
+var fpuArithReg = map[emulator.FPUOp]byte{
+	emulator.OpFADD: 0, emulator.OpFMUL: 1, emulator.OpFSUB: 4,
+	emulator.OpFSUBR: 5, emulator.OpFDIV: 6, emulator.OpFDIVR: 7,
+	emulator.OpFADDP: 0, emulator.OpFMULP: 1, emulator.OpFSUBP: 4,
+	emulator.OpFSUBRP: 5, emulator.OpFDIVP: 6, emulator.OpFDIVRP: 7,
+}
+
+// fpuPop maps the arithmetic operations to the form that pops the stack
+var fpuPop = map[emulator.FPUOp]emulator.FPUOp{
+	emulator.OpFADD: emulator.OpFADDP, emulator.OpFMUL: emulator.OpFMULP,
+	emulator.OpFSUB: emulator.OpFSUBP, emulator.OpFSUBR: emulator.OpFSUBRP,
+	emulator.OpFDIV: emulator.OpFDIVP, emulator.OpFDIVR: emulator.OpFDIVRP,
+}
+
+// fpuIntArith lists the arithmetic on an integer in memory
+var fpuIntArith = map[emulator.FPUOp]bool{
+	emulator.OpFIADD: true, emulator.OpFISUB: true, emulator.OpFISUBR: true,
+	emulator.OpFIMUL: true, emulator.OpFIDIV: true, emulator.OpFIDIVR: true,
+}
+
+// fpuForm8086 is the opcode and ModR/M reg field of an x87 instruction form
+type fpuForm8086 struct {
+	opcode, reg byte
+}
+
+// fpuMemForms gives the memory forms of each operation by operand size in
+// bits. It also decides which sizes an operation accepts.
+var fpuMemForms = map[emulator.FPUOp]map[int]fpuForm8086{
+	emulator.OpFLD:   {32: {0xD9, 0}, 64: {0xDD, 0}, 80: {0xDB, 5}},
+	emulator.OpFST:   {32: {0xD9, 2}, 64: {0xDD, 2}},
+	emulator.OpFSTP:  {32: {0xD9, 3}, 64: {0xDD, 3}, 80: {0xDB, 7}},
+	emulator.OpFILD:  {16: {0xDF, 0}, 32: {0xDB, 0}, 64: {0xDF, 5}},
+	emulator.OpFIST:  {16: {0xDF, 2}, 32: {0xDB, 2}},
+	emulator.OpFISTP: {16: {0xDF, 3}, 32: {0xDB, 3}, 64: {0xDF, 7}},
+
+	emulator.OpFADD:  {32: {0xD8, 0}, 64: {0xDC, 0}},
+	emulator.OpFMUL:  {32: {0xD8, 1}, 64: {0xDC, 1}},
+	emulator.OpFCOM:  {32: {0xD8, 2}, 64: {0xDC, 2}},
+	emulator.OpFCOMP: {32: {0xD8, 3}, 64: {0xDC, 3}},
+	emulator.OpFSUB:  {32: {0xD8, 4}, 64: {0xDC, 4}},
+	emulator.OpFSUBR: {32: {0xD8, 5}, 64: {0xDC, 5}},
+	emulator.OpFDIV:  {32: {0xD8, 6}, 64: {0xDC, 6}},
+	emulator.OpFDIVR: {32: {0xD8, 7}, 64: {0xDC, 7}},
+
+	emulator.OpFIADD:  {16: {0xDE, 0}, 32: {0xDA, 0}},
+	emulator.OpFIMUL:  {16: {0xDE, 1}, 32: {0xDA, 1}},
+	emulator.OpFICOM:  {16: {0xDE, 2}, 32: {0xDA, 2}},
+	emulator.OpFICOMP: {16: {0xDE, 3}, 32: {0xDA, 3}},
+	emulator.OpFISUB:  {16: {0xDE, 4}, 32: {0xDA, 4}},
+	emulator.OpFISUBR: {16: {0xDE, 5}, 32: {0xDA, 5}},
+	emulator.OpFIDIV:  {16: {0xDE, 6}, 32: {0xDA, 6}},
+	emulator.OpFIDIVR: {16: {0xDE, 7}, 32: {0xDA, 7}},
+
+	emulator.OpFLDCW: {16: {0xD9, 5}},
+	emulator.OpFSTCW: {16: {0xD9, 7}},
+	emulator.OpFSTSW: {16: {0xDD, 7}},
+}
+
+// fpuRegForms gives the forms of the operations with a single ST(i)
+// operand; the ModR/M byte is C0h | reg<<3 | i
+var fpuRegForms = map[emulator.FPUOp]fpuForm8086{
+	emulator.OpFLD:    {0xD9, 0},
+	emulator.OpFXCH:   {0xD9, 1},
+	emulator.OpFCOM:   {0xD8, 2},
+	emulator.OpFCOMP:  {0xD8, 3},
+	emulator.OpFFREE:  {0xDD, 0},
+	emulator.OpFST:    {0xDD, 2},
+	emulator.OpFSTP:   {0xDD, 3},
+	emulator.OpFUCOM:  {0xDD, 4},
+	emulator.OpFUCOMP: {0xDD, 5},
+}
+
+// fpuFixed8086 gives the two bytes of the operations without operands
+var fpuFixed8086 = map[emulator.FPUOp][2]byte{
+	emulator.OpFLDZ: {0xD9, 0xEE}, emulator.OpFLD1: {0xD9, 0xE8}, emulator.OpFLDPI: {0xD9, 0xEB},
+	emulator.OpFLDL2E: {0xD9, 0xEA}, emulator.OpFLDL2T: {0xD9, 0xE9},
+	emulator.OpFLDLG2: {0xD9, 0xEC}, emulator.OpFLDLN2: {0xD9, 0xED},
+	emulator.OpFSQRT: {0xD9, 0xFA}, emulator.OpFABS: {0xD9, 0xE1}, emulator.OpFCHS: {0xD9, 0xE0},
+	emulator.OpFRNDINT: {0xD9, 0xFC}, emulator.OpFSCALE: {0xD9, 0xFD},
+	emulator.OpFPREM: {0xD9, 0xF8}, emulator.OpFPREM1: {0xD9, 0xF5}, emulator.OpFXTRACT: {0xD9, 0xF4},
+	emulator.OpFCOMPP: {0xDE, 0xD9}, emulator.OpFUCOMPP: {0xDA, 0xE9},
+	emulator.OpFTST: {0xD9, 0xE4}, emulator.OpFXAM: {0xD9, 0xE5},
+	emulator.OpFSIN: {0xD9, 0xFE}, emulator.OpFCOS: {0xD9, 0xFF}, emulator.OpFSINCOS: {0xD9, 0xFB},
+	emulator.OpFPTAN: {0xD9, 0xF2}, emulator.OpFPATAN: {0xD9, 0xF3}, emulator.OpF2XM1: {0xD9, 0xF0},
+	emulator.OpFYL2X: {0xD9, 0xF1}, emulator.OpFYL2XP1: {0xD9, 0xF9},
+	emulator.OpFINIT: {0xDB, 0xE3}, emulator.OpFCLEX: {0xDB, 0xE2}, emulator.OpFNOP: {0xD9, 0xD0},
+	emulator.OpFINCSTP: {0xD9, 0xF7}, emulator.OpFDECSTP: {0xD9, 0xF6},
+}
+
+// stRegister returns i of an ST(i) register operand, which the parser
+// names ST0 to ST7
+func stRegister(op Operand) (byte, bool) {
+	if op.Type != OperandTypeRegister || len(op.Reg) != 3 || !strings.HasPrefix(op.Reg, "ST") {
+		return 0, false
+	}
+	i := op.Reg[2] - '0'
+	return i, i <= 7
+}
+
+// st returns the operand ST(i)
+func st(i byte) Operand {
+	return Operand{Type: OperandTypeRegister, Reg: fmt.Sprintf("ST%d", i)}
+}
+
+func isMemoryOperand(op Operand) bool {
+	return op.Type == OperandTypeMemory || op.Type == OperandTypeMemoryReg
+}
+
+// fpuOperands checks the operands of an x87 instruction and brings them into
+// the fixed form of the operation, which may change with them: arithmetic
+// takes a destination register and a source, loads, stores and compares a
+// single operand. FADD without operands is FADDP ST1, ST0; FADD with one
+// operand adds it to ST0. FXCH and the compares default to ST1.
+func fpuOperands(instr string, op emulator.FPUOp, ops []Operand) (emulator.FPUOp, []Operand, error) {
+	for _, o := range ops {
+		if o.Type == OperandTypeRegister {
+			if _, ok := stRegister(o); !ok && !(op == emulator.OpFSTSW && o.Reg == "AX") {
+				return 0, nil, fmt.Errorf("invalid operand %s for %s", o.Reg, instr)
+			}
+		}
+	}
+
+	_, arith := fpuArithReg[op]
+	_, plain := fpuPop[op] // Arithmetic that has a popping form
+	switch {
+	case plain:
+		switch len(ops) {
+		case 0:
+			return fpuPop[op], []Operand{st(1), st(0)}, nil
+		case 1:
+			if _, ok := stRegister(ops[0]); ok {
+				return op, []Operand{st(0), ops[0]}, nil
+			}
+			mem, err := fpuMemory(instr, op, ops[0])
+			return op, []Operand{st(0), mem}, err
+		case 2:
+			a, okA := stRegister(ops[0])
+			b, okB := stRegister(ops[1])
+			if okA && okB && (a == 0 || b == 0) {
+				return op, ops, nil
+			}
+		}
+		return 0, nil, fmt.Errorf("%s expects a memory operand, ST(i), or ST0 and ST(i)", instr)
+
+	case arith:
+		switch len(ops) {
+		case 0:
+			return op, []Operand{st(1), st(0)}, nil
+		case 1:
+			if _, ok := stRegister(ops[0]); ok {
+				return op, []Operand{ops[0], st(0)}, nil
+			}
+		case 2:
+			_, okA := stRegister(ops[0])
+			b, okB := stRegister(ops[1])
+			if okA && okB && b == 0 {
+				return op, ops, nil
+			}
+		}
+		return 0, nil, fmt.Errorf("%s expects ST(i), ST0", instr)
+
+	case fpuIntArith[op]:
+		if len(ops) != 1 {
+			return 0, nil, fmt.Errorf("%s expects 1 operand", instr)
+		}
+		mem, err := fpuMemory(instr, op, ops[0])
+		return op, []Operand{st(0), mem}, err
+
+	case fpuMemForms[op] != nil || fpuRegForms[op] != (fpuForm8086{}):
+		if len(ops) == 0 {
+			switch op {
+			case emulator.OpFXCH, emulator.OpFCOM, emulator.OpFCOMP, emulator.OpFUCOM, emulator.OpFUCOMP:
+				return op, []Operand{st(1)}, nil
+			}
+		}
+		if len(ops) != 1 {
+			return 0, nil, fmt.Errorf("%s expects 1 operand", instr)
+		}
+		if _, ok := stRegister(ops[0]); ok {
+			if fpuRegForms[op] == (fpuForm8086{}) {
+				return 0, nil, fmt.Errorf("%s expects a memory operand", instr)
+			}
+			return op, ops, nil
+		}
+		if op == emulator.OpFSTSW && ops[0].Type == OperandTypeRegister {
+			return op, ops, nil // FSTSW AX
+		}
+		mem, err := fpuMemory(instr, op, ops[0])
+		return op, []Operand{mem}, err
+	}
+
+	if len(ops) != 0 {
+		return 0, nil, fmt.Errorf("%s takes no operands", instr)
+	}
+	return op, ops, nil
+}
+
+// fpuMemory checks the size of a memory operand of an x87 instruction. A
+// size must be given unless the operation takes only one.
+func fpuMemory(instr string, op emulator.FPUOp, mem Operand) (Operand, error) {
+	forms := fpuMemForms[op]
+	if !isMemoryOperand(mem) || forms == nil {
+		return Operand{}, fmt.Errorf("invalid operand for %s", instr)
+	}
+	if mem.Size == 0 && len(forms) == 1 {
+		for size := range forms {
+			mem.Size = size
+		}
+	}
+	if _, ok := forms[mem.Size]; !ok {
+		if mem.Size == 0 {
+			return Operand{}, fmt.Errorf("%s needs an operand size: %s", instr, fpuSizeNames(forms))
+		}
+		return Operand{}, fmt.Errorf("invalid operand size for %s: expected %s", instr, fpuSizeNames(forms))
+	}
+	return mem, nil
+}
+
+// fpuSizeNames lists the size keywords of the memory forms of an operation
+func fpuSizeNames(forms map[int]fpuForm8086) string {
+	var names []string
+	for _, size := range []int{16, 32, 64, 80} {
+		if _, ok := forms[size]; ok {
+			names = append(names, map[int]string{16: "WORD", 32: "DWORD", 64: "QWORD", 80: "TBYTE"}[size])
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+// fpuRequiredCPU returns the first processor whose coprocessor has an x87
+// instruction. The 80387 added FSIN, FCOS, FSINCOS, FPREM1 and the unordered
+// compares, and the 80287 FSTSW AX.
+func fpuRequiredCPU(op emulator.FPUOp, ops []Operand) emulator.CPUModel {
+	for _, o := range ops {
+		if isAddr32(o) {
+			return emulator.Model386
+		}
+	}
+	switch op {
+	case emulator.OpFSIN, emulator.OpFCOS, emulator.OpFSINCOS, emulator.OpFPREM1,
+		emulator.OpFUCOM, emulator.OpFUCOMP, emulator.OpFUCOMPP:
+		return emulator.Model386
+	case emulator.OpFSTSW:
+		if ops[0].Type == OperandTypeRegister {
+			return emulator.Model286
+		}
+	}
+	return emulator.Model8086
+}
+
+// generateFPU assembles an x87 instruction. In the bytecode it is OpFPU
+// followed by the operation and its operands, with ST(i) as OpTypeST and i,
+// and memory operands other than words behind a size marker.
+func (p *Parser) generateFPU(instr string, operands []Operand) error {
+	op, ops, err := fpuOperands(instr, fpuMnemonics[instr], operands)
+	if err != nil {
+		return err
+	}
+	if model := fpuRequiredCPU(op, ops); p.cpu < model {
+		return fmt.Errorf("%s requires a %s or later (assembling for the %s)", instr, model, p.cpu)
+	}
+
+	if p.backend == Backend8086 {
+		if fpuWait[instr] {
+			p.emit(0x9B)
+		}
+		code, err := p.encode8086(op.String(), ops, 0, "")
+		if err != nil {
+			return err
+		}
+		for _, b := range code {
+			p.emit(b)
+		}
+		return nil
+	}
+
+	p.emit(byte(emulator.OpFPU))
+	p.emit(byte(op))
+	for _, o := range ops {
+		if i, ok := stRegister(o); ok {
+			p.emit(byte(emulator.OpTypeST))
+			p.emit(i)
+			continue
+		}
+		if isAddr32(o) {
+			return fmt.Errorf("32-bit addressing is only supported by the 8086 backend")
+		}
+		switch o.Size {
+		case 32:
+			p.emit(byte(emulator.OpTypeDword))
+		case 64:
+			p.emit(byte(emulator.OpTypeQword))
+		case 80:
+			p.emit(byte(emulator.OpTypeTword))
+		}
+		p.emitOperand(o, false)
+	}
+	return nil
+}
+
+// encodeFPU encodes an x87 instruction whose operands fpuOperands has put in
+// the fixed form of its operation
+func (e *encoder8086) encodeFPU(op emulator.FPUOp, ops []Operand) error {
+	if op == emulator.OpFWAIT {
+		e.emit(0x9B)
+		return nil
+	}
+	if code, ok := fpuFixed8086[op]; ok {
+		e.emit(code[0], code[1])
+		return nil
+	}
+
+	if reg, ok := fpuArithReg[op]; ok {
+		if i, ok := stRegister(ops[1]); ok {
+			dest, _ := stRegister(ops[0])
+			_, plain := fpuPop[op]
+			switch {
+			case !plain:
+				e.emit(0xDE, 0xC0|fpuReverse(reg)<<3|dest)
+			case dest == 0:
+				e.emit(0xD8, 0xC0|reg<<3|i)
+			default:
+				e.emit(0xDC, 0xC0|fpuReverse(reg)<<3|dest)
+			}
+			return nil
+		}
+		ops = ops[1:] // ST0, memory
+	}
+	if fpuIntArith[op] {
+		ops = ops[1:]
+	}
+
+	if op == emulator.OpFSTSW && ops[0].Type == OperandTypeRegister {
+		e.emit(0xDF, 0xE0) // FSTSW AX
+		return nil
+	}
+	if i, ok := stRegister(ops[0]); ok {
+		form := fpuRegForms[op]
+		e.emit(form.opcode, 0xC0|form.reg<<3|i)
+		return nil
+	}
+	form, ok := fpuMemForms[op][ops[0].Size]
+	if !ok {
+		return fmt.Errorf("invalid operand for %s", op)
+	}
+	return e.encodeModRM(form.opcode, form.reg, ops[0])
+}
+
+// fpuReverse turns the reg field of a D8h arithmetic form into that of the
+// DCh and DEh forms, which swap the plain and reversed operations
+func fpuReverse(reg byte) byte {
+	if reg >= 4 {
+		return reg ^ 1
+	}
+	return reg
+}
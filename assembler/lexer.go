@@ -264,6 +264,7 @@ func (l *Lexer) readNumber() {
 			for unicode.IsDigit(rune(l.current())) {
 				l.advance()
 			}
+			l.readFraction()
 		}
 	}
 
@@ -276,6 +277,40 @@ func (l *Lexer) readNumber() {
 	})
 }
 
+// readFraction reads the fraction and optional exponent of a real number
+// such as 3.14 or 1.5e-3 after its integer digits
+func (l *Lexer) readFraction() {
+	if l.current() != '.' || !unicode.IsDigit(rune(l.peek())) {
+		return
+	}
+	l.advance()
+	for unicode.IsDigit(rune(l.current())) {
+		l.advance()
+	}
+	if l.current() != 'e' && l.current() != 'E' {
+		return
+	}
+	exponent := l.pos + 1
+	if exponent < len(l.input) && (l.input[exponent] == '+' || l.input[exponent] == '-') {
+		exponent++
+	}
+	if exponent >= len(l.input) || !unicode.IsDigit(rune(l.input[exponent])) {
+		return
+	}
+	for l.pos < exponent {
+		l.advance()
+	}
+	for unicode.IsDigit(rune(l.current())) {
+		l.advance()
+	}
+}
+
+// isReal reports whether a number token is a real number rather than an
+// integer
+func isReal(value string) bool {
+	return strings.ContainsRune(value, '.')
+}
+
 func (l *Lexer) readString() error {
 	quote := l.current()
 	l.advance() // Skip opening quote
@@ -344,6 +379,38 @@ func (l *Lexer) readIdentifier() {
 
 // ParseNumber parses a number token value
 func ParseNumber(value string) (uint16, error) {
+	num, err := ParseNumber32(value)
+	return uint16(num), err
+}
+
+// ParseNumber32 parses a number token value as a doubleword
+func ParseNumber32(value string) (uint32, error) {
+	negative, num, err := parseMagnitude(value)
+	if err != nil || num > 0xFFFFFFFF {
+		return 0, fmt.Errorf("invalid number: %s", strings.TrimPrefix(strings.TrimSpace(value), "-"))
+	}
+
+	if negative {
+		return uint32(-int64(num)), nil
+	}
+	return uint32(num), nil
+}
+
+// ParseNumber64 parses a number token value as a quadword, for DQ
+func ParseNumber64(value string) (uint64, error) {
+	negative, num, err := parseMagnitude(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number: %s", strings.TrimPrefix(strings.TrimSpace(value), "-"))
+	}
+
+	if negative {
+		return -num, nil
+	}
+	return num, nil
+}
+
+// parseMagnitude splits a number token value into its sign and magnitude
+func parseMagnitude(value string) (bool, uint64, error) {
 	value = strings.TrimSpace(value)
 
 	// Negative numbers
@@ -353,32 +420,23 @@ func ParseNumber(value string) (uint16, error) {
 		value = value[1:]
 	}
 
-	var num int64
+	var num uint64
 	var err error
 
 	// Hexadecimal with 0x prefix
 	if strings.HasPrefix(value, "0x") || strings.HasPrefix(value, "0X") {
-		num, err = strconv.ParseInt(value[2:], 16, 32)
+		num, err = strconv.ParseUint(value[2:], 16, 64)
 	} else if strings.HasSuffix(value, "h") || strings.HasSuffix(value, "H") {
 		// Hexadecimal with h suffix
-		num, err = strconv.ParseInt(value[:len(value)-1], 16, 32)
+		num, err = strconv.ParseUint(value[:len(value)-1], 16, 64)
 	} else if strings.HasPrefix(value, "0b") || strings.HasPrefix(value, "0B") {
 		// Binary
-		num, err = strconv.ParseInt(value[2:], 2, 32)
+		num, err = strconv.ParseUint(value[2:], 2, 64)
 	} else {
 		// Decimal
-		num, err = strconv.ParseInt(value, 10, 32)
+		num, err = strconv.ParseUint(value, 10, 64)
 	}
-
-	if err != nil {
-		return 0, fmt.Errorf("invalid number: %s", value)
-	}
-
-	if negative {
-		num = -num
-	}
-
-	return uint16(num), nil
+	return negative, num, err
 }
 
 func isRegister(name string) bool {
@@ -386,8 +444,11 @@ func isRegister(name string) bool {
 		"AX", "BX", "CX", "DX",
 		"AL", "AH", "BL", "BH", "CL", "CH", "DL", "DH",
 		"SI", "DI", "BP", "SP",
+		"EAX", "EBX", "ECX", "EDX", "ESI", "EDI", "EBP", "ESP", // 80386 32-bit registers
 		"IP", "FLAGS",
 		"ES", "CS", "SS", "DS", // Segment registers (for compatibility)
+		"FS", "GS",
+		"ST", "ST0", "ST1", "ST2", "ST3", "ST4", "ST5", "ST6", "ST7", // x87 register stack
 	}
 
 	for _, reg := range registers {
@@ -402,20 +463,34 @@ func isInstruction(name string) bool {
 	instructions := []string{
 		"MOV", "PUSH", "POP", "XCHG",
 		"ADD", "SUB", "MUL", "DIV", "IMUL", "IDIV", "INC", "DEC", "NEG",
+		"ADC", "SBB", "CBW", "CWD", // Carry arithmetic and sign extension
+		"DAA", "DAS", "AAA", "AAS", "AAM", "AAD", // BCD adjustment
 		"AND", "OR", "XOR", "NOT",
-		"SHL", "SHR", "SAL", "SAR", "ROL", "ROR",
+		"SHL", "SHR", "SAL", "SAR", "ROL", "ROR", "RCL", "RCR",
 		"CMP", "TEST",
 		"JMP", "JE", "JZ", "JNE", "JNZ",
 		"JG", "JNLE", "JGE", "JNL", "JL", "JNGE", "JLE", "JNG",
 		"JA", "JNBE", "JAE", "JNB", "JB", "JNAE", "JBE", "JNA",
+		"JO", "JNO", "JS", "JNS", "JP", "JPE", "JNP", "JPO",
 		"CALL", "RET",
 		"LOOP", "LOOPE", "LOOPZ", "LOOPNE", "LOOPNZ",
-		"INT", "NOP", "HLT",
+		"INT", "IRET", "NOP", "HLT",
+		"PUSHF", "POPF", "LAHF", "SAHF", // Flags register
+		"CLC", "STC", "CMC", "CLD", "STD", "CLI", "STI", // Flag control
 		"IN", "OUT", // I/O instructions
 		"MOVSB", "MOVSW", "STOSB", "STOSW", "LODSB", "LODSW", // String instructions
-		"REP", // REP prefix
-		"DB", "DW", "DD", // Data directives
-		"BYTE", "WORD", "DWORD",
+		"CMPSB", "CMPSW", "SCASB", "SCASW",
+		"INSB", "INSW", "OUTSB", "OUTSW",
+		"PUSHA", "POPA", "ENTER", "LEAVE", "BOUND", // 80186 additions
+		"MOVZX", "MOVSX", "SHLD", "SHRD", "CWDE", "CDQ", // 80386 additions
+		"BT", "BTS", "BTR", "BTC", "BSF", "BSR",
+		"SETE", "SETZ", "SETNE", "SETNZ",
+		"SETG", "SETNLE", "SETGE", "SETNL", "SETL", "SETNGE", "SETLE", "SETNG",
+		"SETA", "SETNBE", "SETAE", "SETNB", "SETB", "SETNAE", "SETBE", "SETNA",
+		"SETO", "SETNO", "SETS", "SETNS", "SETP", "SETPE", "SETNP", "SETPO",
+		"REP", "REPE", "REPZ", "REPNE", "REPNZ", // Repeat prefixes
+		"DB", "DW", "DD", "DQ", "DT", // Data directives
+		"BYTE", "WORD", "DWORD", "QWORD", "TBYTE", "TWORD",
 		"EQU", // Constant definition
 	}
 
@@ -424,5 +499,6 @@ func isInstruction(name string) bool {
 			return true
 		}
 	}
-	return false
+	_, fpu := fpuMnemonics[name] // x87 instructions
+	return fpu
 }
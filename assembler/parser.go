@@ -3,6 +3,8 @@ package assembler
 import (
 	"assembly-emulator/emulator"
 	"fmt"
+	"math"
+	"strconv"
 	"strings"
 )
 
@@ -26,6 +28,25 @@ type Program struct {
 	CodeBytes []byte
 	DataBytes []byte
 	StackSize uint16
+	Backend   Backend // Format of CodeBytes
+	Origin    uint16  // Load offset of the first code byte (8086 backend)
+}
+
+// Flat returns the program as a flat binary image: code followed directly by
+// data, as written to .COM and .BIN files by the 8086 backend
+func (prog *Program) Flat() []byte {
+	image := make([]byte, 0, len(prog.CodeBytes)+len(prog.DataBytes))
+	image = append(image, prog.CodeBytes...)
+	return append(image, prog.DataBytes...)
+}
+
+// Bytecode returns the code and data segments of a bytecode program, or ok
+// false for the 8086 backend, whose programs load with Flat
+func (prog *Program) Bytecode() (code, data []byte, ok bool) {
+	if prog.Backend != BackendBytecode {
+		return nil, nil, false
+	}
+	return prog.CodeBytes, prog.DataBytes, true
 }
 
 // Parser parses tokens into instructions
@@ -43,6 +64,16 @@ type Parser struct {
 	currentSegment SegmentType
 	codeAddress    uint16
 	dataAddress    uint16
+
+	// Machine code format and flat-image layout
+	backend  Backend
+	origin   uint16 // Offset of the first code byte (8086 backend)
+	codeSize uint16 // Code size from the previous layout pass (8086 backend)
+	sizing   bool   // True while label layout passes run (undefined labels allowed)
+
+	cpu emulator.CPUModel // Target processor; instructions it lacks are rejected
+
+	longBranches map[int]bool // Branches (by token position) that need their long form
 }
 
 // NewParser creates a new parser
@@ -57,23 +88,38 @@ func NewParser(tokens []Token) *Parser {
 		currentSegment: SegmentCode, // Start in code segment
 		codeAddress:    0,
 		dataAddress:    0,
+		longBranches:   make(map[int]bool),
 	}
 }
 
+// SetBackend selects the machine code format. The 8086 backend lays code out
+// at origin followed directly by data, as in a flat .COM (origin 100h) or
+// .BIN (origin 0) file.
+func (p *Parser) SetBackend(backend Backend, origin uint16) {
+	p.backend = backend
+	p.origin = origin
+}
+
+// SetCPU selects the processor the program is assembled for. Instructions
+// added by later processors are rejected, and for the 8086 a shift or
+// rotate by an immediate count is expanded into repeated shifts by one.
+func (p *Parser) SetCPU(model emulator.CPUModel) {
+	p.cpu = model
+}
+
 // Parse parses the tokens and generates machine code
 func (p *Parser) Parse() (*Program, error) {
 	// First pass: collect labels
-	if err := p.firstPass(); err != nil {
+	if p.backend == Backend8086 {
+		if err := p.layoutPasses(); err != nil {
+			return nil, err
+		}
+	} else if err := p.firstPass(); err != nil {
 		return nil, err
 	}
 
 	// Reset for second pass
-	p.pos = 0
-	p.codeAddress = 0
-	p.dataAddress = 0
-	p.codeBytes = make([]byte, 0)
-	p.dataBytes = make([]byte, 0)
-	p.currentSegment = SegmentCode // Reset to code segment
+	p.resetPass()
 
 	// Second pass: generate code
 	if err := p.secondPass(); err != nil {
@@ -84,9 +130,77 @@ func (p *Parser) Parse() (*Program, error) {
 		CodeBytes: p.codeBytes,
 		DataBytes: p.dataBytes,
 		StackSize: p.stackSize,
+		Backend:   p.backend,
+		Origin:    p.origin,
 	}, nil
 }
 
+// resetPass rewinds the token stream and output for another pass
+func (p *Parser) resetPass() {
+	p.pos = 0
+	p.codeAddress = 0
+	p.dataAddress = 0
+	p.codeBytes = make([]byte, 0)
+	p.dataBytes = make([]byte, 0)
+	p.currentSegment = SegmentCode // Reset to code segment
+}
+
+// maxLayoutPasses bounds the label layout iteration of the 8086 backend
+const maxLayoutPasses = 32
+
+// layoutPasses collects labels for the 8086 backend. Instruction sizes depend
+// on label distances (short or near jumps), so the first pass is repeated
+// with the previous pass's label addresses until the layout is stable.
+// Branches start short and only grow, which guarantees convergence.
+func (p *Parser) layoutPasses() error {
+	p.sizing = true
+	defer func() { p.sizing = false }()
+
+	for pass := 0; pass < maxLayoutPasses; pass++ {
+		previous := make(map[string]LabelInfo, len(p.labels))
+		for name, info := range p.labels {
+			previous[name] = info
+		}
+		previousSize := p.codeSize
+
+		p.resetPass()
+		if err := p.firstPass(); err != nil {
+			return err
+		}
+		p.codeSize = p.codeAddress
+
+		if pass > 0 && p.codeSize == previousSize && labelsEqual(previous, p.labels) {
+			return nil
+		}
+	}
+	return fmt.Errorf("label layout did not converge after %d passes", maxLayoutPasses)
+}
+
+func labelsEqual(a, b map[string]LabelInfo) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, info := range a {
+		if b[name] != info {
+			return false
+		}
+	}
+	return true
+}
+
+// labelAddress returns the value a label reference assembles to. Bytecode
+// labels are offsets within their own segment; 8086 labels are offsets in
+// the flat image, where data follows code.
+func (p *Parser) labelAddress(info LabelInfo) uint16 {
+	if p.backend != Backend8086 {
+		return info.Offset
+	}
+	if info.Segment == SegmentData {
+		return p.origin + p.codeSize + info.Offset
+	}
+	return p.origin + info.Offset
+}
+
 func (p *Parser) firstPass() error {
 	for !p.isAtEnd() {
 		token := p.current()
@@ -232,20 +346,26 @@ func (p *Parser) parseDirective() error {
 }
 
 func (p *Parser) parseInstructionSize() error {
+	// The 8086 backend sizes instructions by encoding them
+	if p.backend == Backend8086 {
+		return p.parseInstruction()
+	}
+
 	instr := strings.ToUpper(p.current().Value)
+
+	// x87 instructions are sized by generating them, with forward labels
+	// allowed as on the 8086 backend
+	if _, ok := fpuMnemonics[instr]; ok {
+		sizing := p.sizing
+		p.sizing = true
+		defer func() { p.sizing = sizing }()
+		return p.parseInstruction()
+	}
 	p.advance()
 
-	// Handle DB/DW/DD directives - each value is 1/2/4 bytes
-	if instr == "DB" || instr == "DW" || instr == "DD" {
-		var bytesPerValue uint16
-		switch instr {
-		case "DB":
-			bytesPerValue = 1
-		case "DW":
-			bytesPerValue = 2
-		case "DD":
-			bytesPerValue = 4
-		}
+	// Handle DB/DW/DD/DQ/DT directives - each value is 1/2/4/8/10 bytes
+	if dataDirectives[instr] != 0 {
+		bytesPerValue := dataDirectives[instr]
 
 		// Count the total number of bytes
 		totalBytes := uint16(0)
@@ -276,40 +396,116 @@ func (p *Parser) parseInstructionSize() error {
 	// Calculate actual instruction size by parsing operands
 	size := 1 // Opcode
 
-	// Check for REP prefix
-	if instr == "REP" {
-		size++ // REP prefix byte (0xF3)
-		// Get the actual instruction after REP
+	// Check for a REP, REPE or REPNE prefix
+	if _, ok := repPrefixes[instr]; ok {
+		size++ // Prefix byte (0xF3 or 0xF2)
+		// Get the actual instruction after the prefix
 		if !p.isAtEnd() && p.current().Type == TokenInstruction {
+			instr = strings.ToUpper(p.current().Value)
+			p.advance()
+		}
+	}
+
+	// A string instruction's source operand becomes a segment override
+	// prefix (prefix byte + register code)
+	if stringInstruction(instr) {
+		for !p.isAtEnd() && p.current().Type != TokenNewline && p.current().Type != TokenComment {
+			if p.current().Type == TokenColon {
+				size += 2
+			}
 			p.advance()
 		}
+		p.incrementAddress(uint16(size))
+		return nil
 	}
 
 	// Parse operands and calculate their sizes
+	dword := p.dwordLine(instr)
+	var last Token // First token of the last operand
+	n := 0         // Operand number
 	for !p.isAtEnd() && p.current().Type != TokenNewline && p.current().Type != TokenComment {
 		if p.current().Type == TokenComma {
+			n++
 			p.advance()
 			continue
 		}
 
-		operandSize := p.getOperandSize()
+		last = p.current()
+		operandSize := p.getOperandSize(dword && !countOperand(instr, n))
 		size += operandSize
 	}
 
+	// SETcc gets its condition code as an 8-bit immediate (type + value)
+	if setccCondition(instr) >= 0 {
+		size += 2
+	}
+
+	// A shift by an immediate count expanded for the 8086 is count shifts
+	// by one of the same size
+	if _, ok := shift8086[instr]; ok && p.cpu < emulator.Model186 && last.Type == TokenNumber {
+		if count, err := ParseNumber(last.Value); err == nil && count <= 0x1F {
+			size *= int(count)
+		}
+	}
+
+	// AAM and AAD without an operand get an implicit 8-bit base (type + value)
+	if (instr == "AAM" || instr == "AAD") && size == 1 {
+		size += 2
+	}
+
 	p.incrementAddress(uint16(size))
 	return nil
 }
 
-func (p *Parser) getOperandSize() int {
+// dwordLine reports whether the operands of the instruction at the current
+// position are 32-bit, matching operand32 for the bytecode: MOVZX, MOVSX
+// and SETcc never mark their operands as doublewords.
+func (p *Parser) dwordLine(instr string) bool {
+	if instr == "MOVZX" || instr == "MOVSX" || setccCondition(instr) >= 0 {
+		return false
+	}
+	for i := p.pos; i < len(p.tokens); i++ {
+		token := p.tokens[i]
+		switch {
+		case token.Type == TokenNewline || token.Type == TokenComment || token.Type == TokenEOF:
+			return false
+		case token.Type == TokenRegister && is32BitRegister(strings.ToUpper(token.Value)),
+			token.Type == TokenInstruction && strings.ToUpper(token.Value) == "DWORD":
+			return true
+		}
+	}
+	return false
+}
+
+// getOperandSize returns the size in bytecode of the operand at the current
+// position. A dword operand is marked as a doubleword if it is in memory,
+// or widened to 32 bits if it is an immediate.
+func (p *Parser) getOperandSize(dword bool) int {
 	token := p.current()
 
 	switch token.Type {
+	case TokenInstruction:
+		// BYTE/WORD/DWORD [PTR] size specifiers add nothing to the bytecode
+		p.advance()
+		if p.current().Type == TokenLabel && strings.ToUpper(p.current().Value) == "PTR" {
+			p.advance()
+		}
+		return 0
+
 	case TokenRegister:
 		p.advance()
+		if p.current().Type == TokenColon {
+			// Segment override before a memory operand
+			p.advance()
+			return 2 + p.getOperandSize(dword) // type (1) + register code (1)
+		}
 		return 2 // type (1) + register code (1)
 
 	case TokenNumber:
 		p.advance()
+		if dword {
+			return 5 // type (1) + doubleword (4)
+		}
 		val, err := ParseNumber(token.Value)
 		if err != nil {
 			return 2 // conservative estimate
@@ -321,44 +517,34 @@ func (p *Parser) getOperandSize() int {
 
 	case TokenLabel:
 		p.advance()
+		if dword {
+			return 5 // type (1) + doubleword (4)
+		}
 		// Labels are treated as immediate addresses (16-bit)
 		return 3 // type (1) + address (2)
 
 	case TokenLeftBracket:
-		// Memory operand [...]
-		p.advance() // skip [
-
-		if p.current().Type == TokenRegister {
-			p.advance() // register
-
-			// Check for offset [REG+offset]
-			if p.current().Type == TokenPlus {
-				p.advance() // +
-				if p.current().Type == TokenNumber {
-					p.advance() // offset value
-				}
-			}
-
-			if p.current().Type == TokenRightBracket {
-				p.advance() // ]
-			}
-			return 4 // type (1) + reg code (1) + offset (2)
-		} else if p.current().Type == TokenNumber {
-			p.advance() // address
-			if p.current().Type == TokenRightBracket {
-				p.advance() // ]
+		// Memory operand [...]: forward labels in the address only need a
+		// placeholder here, the second pass resolves them
+		sizing := p.sizing
+		p.sizing = true
+		op, err := p.parseMemoryOperand("")
+		p.sizing = sizing
+		if err != nil {
+			// Skip the rest of the operand; the second pass reports the error
+			for !p.isAtEnd() && p.current().Type != TokenComma && p.current().Type != TokenNewline {
+				p.advance()
 			}
-			return 3 // type (1) + address (2)
+			return 4
 		}
-
-		// Skip to closing bracket
-		for !p.isAtEnd() && p.current().Type != TokenRightBracket {
-			p.advance()
+		size := 4 // type (1) + reg code (1) + offset (2)
+		if op.Type == OperandTypeMemory {
+			size = 3 // type (1) + address (2)
 		}
-		if p.current().Type == TokenRightBracket {
-			p.advance()
+		if dword {
+			size++ // doubleword marker
 		}
-		return 3 // conservative estimate
+		return size
 
 	default:
 		p.advance()
@@ -372,21 +558,25 @@ func (p *Parser) parseInstruction() error {
 	p.advance()
 
 	// Handle DB (define byte) directive
-	if instr == "DB" || instr == "DW" || instr == "DD" {
+	if dataDirectives[instr] != 0 {
 		return p.parseDataDirective(instr, instrToken.Line)
 	}
 
-	// Check for REP prefix
-	hasREP := false
-	if instr == "REP" {
-		hasREP = true
-		// Get the actual instruction after REP
+	// Check for a REP, REPE or REPNE prefix
+	rep, hasREP := repPrefixes[instr]
+	if hasREP {
+		prefix := instr
+		// Get the actual instruction after the prefix
 		if p.isAtEnd() || p.current().Type != TokenInstruction {
-			return fmt.Errorf("expected instruction after REP prefix at line %d", instrToken.Line)
+			return fmt.Errorf("expected instruction after %s prefix at line %d", prefix, instrToken.Line)
 		}
 		instrToken = p.current()
 		instr = strings.ToUpper(instrToken.Value)
 		p.advance()
+
+		if !stringInstruction(instr) || (prefix != "REP" && !compareInstruction(instr)) {
+			return fmt.Errorf("%s prefix not valid for %s at line %d", prefix, instr, instrToken.Line)
+		}
 	}
 
 	// Parse operands
@@ -406,8 +596,18 @@ func (p *Parser) parseInstruction() error {
 		operands = append(operands, operand)
 	}
 
+	// A string instruction's optional operand overrides its source segment
+	segment := ""
+	if stringInstruction(instr) {
+		var err error
+		if segment, err = stringSource(instr, operands); err != nil {
+			return fmt.Errorf("error at line %d: %v", instrToken.Line, err)
+		}
+		operands = nil
+	}
+
 	// Generate code for instruction
-	if err := p.generateInstruction(instr, operands, hasREP); err != nil {
+	if err := p.generateInstruction(instr, operands, rep, segment); err != nil {
 		return fmt.Errorf("error at line %d: %v", instrToken.Line, err)
 	}
 
@@ -417,23 +617,83 @@ func (p *Parser) parseInstruction() error {
 func (p *Parser) parseOperand() (Operand, error) {
 	token := p.current()
 
+	// Size specifier: BYTE, WORD or DWORD [PTR] before a memory or immediate
+	// operand, or QWORD or TBYTE before an x87 memory operand
+	if token.Type == TokenInstruction {
+		size := 0
+		switch strings.ToUpper(token.Value) {
+		case "BYTE":
+			size = 8
+		case "WORD":
+			size = 16
+		case "DWORD":
+			size = 32
+		case "QWORD":
+			size = 64
+		case "TBYTE", "TWORD":
+			size = 80
+		}
+		if size != 0 {
+			p.advance()
+			if p.current().Type == TokenLabel && strings.ToUpper(p.current().Value) == "PTR" {
+				p.advance()
+			}
+			operand, err := p.parseOperand()
+			if err != nil {
+				return Operand{}, err
+			}
+			operand.Size = size
+			return operand, nil
+		}
+	}
+
 	switch token.Type {
 	case TokenRegister:
 		p.advance()
+		reg := strings.ToUpper(token.Value)
+
+		// Segment override prefix: ES:[BX]
+		if p.current().Type == TokenColon {
+			if !isSegmentRegister(reg) {
+				return Operand{}, fmt.Errorf("%s is not a segment register", reg)
+			}
+			p.advance()
+			if p.current().Type != TokenLeftBracket {
+				return Operand{}, fmt.Errorf("expected memory operand after %s:", reg)
+			}
+			return p.parseMemoryOperand(reg)
+		}
+
+		// x87 registers: ST is ST(0), and ST(i) is named STi
+		if reg == "ST" {
+			reg = "ST0"
+			if p.current().Type == TokenLeftParen {
+				p.advance()
+				i, err := ParseNumber(p.current().Value)
+				if p.current().Type != TokenNumber || err != nil || i > 7 || p.peekType() != TokenRightParen {
+					return Operand{}, fmt.Errorf("expected ST(0) to ST(7)")
+				}
+				reg = fmt.Sprintf("ST%d", i)
+				p.advance() // number
+				p.advance() // )
+			}
+		}
+
 		return Operand{
 			Type: OperandTypeRegister,
-			Reg:  strings.ToUpper(token.Value),
+			Reg:  reg,
 		}, nil
 
 	case TokenNumber:
 		p.advance()
-		val, err := ParseNumber(token.Value)
+		val, err := ParseNumber32(token.Value)
 		if err != nil {
 			return Operand{}, err
 		}
 		return Operand{
 			Type:      OperandTypeImmediate,
-			Immediate: val,
+			Immediate: uint16(val),
+			Imm32:     val,
 		}, nil
 
 	case TokenLabel:
@@ -443,87 +703,228 @@ func (p *Parser) parseOperand() (Operand, error) {
 
 		labelInfo, ok := p.labels[labelName]
 		if !ok {
+			if p.sizing {
+				// Forward reference during 8086 layout: resolved on a later pass
+				return Operand{
+					Type:       OperandTypeImmediate,
+					IsLabel:    true,
+					Unresolved: true,
+				}, nil
+			}
 			return Operand{}, fmt.Errorf("undefined label: %s", labelName)
 		}
 
-		// For now, we'll use the offset within the segment
-		// TODO: Handle cross-segment references (code accessing data labels)
-		// For data labels referenced from code, we'll need to calculate the linear address
-		addr := labelInfo.Offset
-
-		// If this is a data label referenced from code segment, calculate actual address
-		if p.currentSegment == SegmentCode && labelInfo.Segment == SegmentData {
-			// Data will be loaded after code, so calculate the actual linear address
-			// This will be: codeSize + dataOffset
-			// We'll need to fix this up later in a more sophisticated way
-			// For now, just use the offset - we'll handle this properly in the loader
-			addr = labelInfo.Offset
-		}
+		// Bytecode labels use the offset within their segment; data is
+		// addressed through DS, which the loader points at the data segment
+		addr := p.labelAddress(labelInfo)
 
 		return Operand{
 			Type:         OperandTypeImmediate,
 			Immediate:    addr,
+			Imm32:        uint32(addr),
 			IsLabel:      true,          // Mark as label so it always uses 16-bit encoding
 			LabelSegment: labelInfo.Segment, // Store segment info for later use
 		}, nil
 
 	case TokenLeftBracket:
-		// Memory operand [...]
-		p.advance() // skip [
+		return p.parseMemoryOperand("")
 
-		if p.current().Type == TokenRegister {
-			reg := strings.ToUpper(p.current().Value)
-			p.advance()
+	default:
+		return Operand{}, fmt.Errorf("unexpected token in operand: %s", token.Value)
+	}
+}
 
-			offset := uint16(0)
+// parseMemoryOperand parses a bracketed address made of at most a base
+// register, an index register and a displacement that sums numbers and
+// labels, such as [BX+SI+4], [BP+DI-4], [table+BX] or, with 32-bit
+// registers, [EBX+ESI*4+8]. A segment override may precede the operand
+// (ES:[BX], passed in as segment) or open it ([ES:BX]).
+func (p *Parser) parseMemoryOperand(segment string) (Operand, error) {
+	p.advance() // skip [
+
+	if p.current().Type == TokenRegister && p.peekType() == TokenColon {
+		reg := strings.ToUpper(p.current().Value)
+		if !isSegmentRegister(reg) || segment != "" {
+			return Operand{}, fmt.Errorf("invalid segment override %s:", reg)
+		}
+		segment = reg
+		p.advance() // register
+		p.advance() // colon
+	}
 
-			// Check for offset [REG+offset]
-			if p.current().Type == TokenPlus {
-				p.advance()
-				if p.current().Type == TokenNumber {
-					val, err := ParseNumber(p.current().Value)
-					if err != nil {
-						return Operand{}, err
-					}
-					offset = val
-					p.advance()
+	var regs []string
+	var scales []byte
+	var disp uint16
+	var isLabel, unresolved bool
+	negate := false
+
+	for {
+		token := p.current()
+		switch token.Type {
+		case TokenRegister:
+			if negate {
+				return Operand{}, fmt.Errorf("register %s cannot be subtracted", token.Value)
+			}
+			regs = append(regs, strings.ToUpper(token.Value))
+			scales = append(scales, 1)
+			if p.peekType() == TokenMult {
+				p.advance() // register
+				p.advance() // *
+				scale, err := ParseNumber(p.current().Value)
+				if err != nil || p.current().Type != TokenNumber {
+					return Operand{}, fmt.Errorf("expected a scale after %s*", token.Value)
 				}
+				scales[len(scales)-1] = byte(scale)
 			}
 
-			if p.current().Type != TokenRightBracket {
-				return Operand{}, fmt.Errorf("expected ] but got %s", p.current().Value)
-			}
-			p.advance() // skip ]
-
-			return Operand{
-				Type:   OperandTypeMemoryReg,
-				Reg:    reg,
-				Offset: offset,
-			}, nil
-		} else if p.current().Type == TokenNumber {
-			// Direct memory address [1234h]
-			val, err := ParseNumber(p.current().Value)
+		case TokenNumber:
+			val, err := ParseNumber(token.Value)
 			if err != nil {
 				return Operand{}, err
 			}
-			p.advance()
+			if negate {
+				val = -val
+			}
+			disp += val
 
-			if p.current().Type != TokenRightBracket {
-				return Operand{}, fmt.Errorf("expected ]")
+		case TokenLabel:
+			name := strings.ToUpper(token.Value)
+			info, ok := p.labels[name]
+			if !ok {
+				if !p.sizing {
+					return Operand{}, fmt.Errorf("undefined label: %s", name)
+				}
+				unresolved = true
 			}
+			val := p.labelAddress(info)
+			if negate {
+				val = -val
+			}
+			disp += val
+			isLabel = true
+
+		default:
+			return Operand{}, fmt.Errorf("invalid memory operand at %q", token.Value)
+		}
+		p.advance()
+
+		// Terms are joined by + or -, or by a negative number such as [BP-4]
+		switch p.current().Type {
+		case TokenPlus:
+			negate = false
+			p.advance()
+		case TokenMinus:
+			negate = true
 			p.advance()
+		case TokenNumber:
+			if !strings.HasPrefix(p.current().Value, "-") {
+				return Operand{}, fmt.Errorf("expected + or - before %s", p.current().Value)
+			}
+			negate = false
+		case TokenRightBracket:
+			p.advance()
+			return memoryOperand(regs, scales, disp, segment, isLabel, unresolved)
+		default:
+			return Operand{}, fmt.Errorf("expected ] but got %s", p.current().Value)
+		}
+	}
+}
+
+// memoryOperand builds a memory operand from the registers, index scales
+// and displacement of an address. Two registers must form an 8086
+// base/index pair: BX or BP with SI or DI.
+func memoryOperand(regs []string, scales []byte, disp uint16, segment string, isLabel, unresolved bool) (Operand, error) {
+	op := Operand{
+		Type:       OperandTypeMemoryReg,
+		Offset:     disp,
+		Segment:    segment,
+		IsLabel:    isLabel,
+		Unresolved: unresolved,
+	}
 
-			return Operand{
-				Type:    OperandTypeMemory,
-				Address: val,
-			}, nil
+	if len(regs) > 0 && is32BitRegister(regs[0]) {
+		return memoryOperand32(op, regs, scales)
+	}
+	for i, reg := range regs {
+		switch reg {
+		case "AX", "BX", "CX", "DX", "SI", "DI", "BP", "SP":
+		default:
+			return Operand{}, fmt.Errorf("register %s cannot be used in an address", reg)
 		}
+		if scales[i] != 1 {
+			return Operand{}, fmt.Errorf("a scaled index needs a 32-bit register")
+		}
+	}
 
-		return Operand{}, fmt.Errorf("invalid memory operand")
+	switch len(regs) {
+	case 0:
+		op.Type = OperandTypeMemory
+		op.Address = disp
+		op.Offset = 0
+	case 1:
+		op.Reg = regs[0]
+	case 2:
+		base, index := regs[0], regs[1]
+		if base == "SI" || base == "DI" {
+			base, index = index, base
+		}
+		if (base != "BX" && base != "BP") || (index != "SI" && index != "DI") {
+			return Operand{}, fmt.Errorf("invalid base and index registers [%s+%s]", regs[0], regs[1])
+		}
+		op.Reg = base
+		op.Index = index
+	default:
+		return Operand{}, fmt.Errorf("too many registers in memory operand")
+	}
+	return op, nil
+}
 
+// memoryOperand32 builds a memory operand in the 80386 32-bit addressing
+// form: an optional base register plus an optional index register scaled
+// by 1, 2, 4 or 8. Any 32-bit register but ESP can be the index.
+func memoryOperand32(op Operand, regs []string, scales []byte) (Operand, error) {
+	for i, reg := range regs {
+		if !is32BitRegister(reg) {
+			return Operand{}, fmt.Errorf("cannot mix 16-bit and 32-bit registers in an address")
+		}
+		switch scales[i] {
+		case 1, 2, 4, 8:
+		default:
+			return Operand{}, fmt.Errorf("invalid scale %d for %s", scales[i], reg)
+		}
+	}
+
+	switch len(regs) {
+	case 1:
+		if scales[0] == 1 {
+			op.Reg = regs[0]
+		} else {
+			op.Index, op.Scale = regs[0], scales[0]
+		}
+	case 2:
+		base, index, scale := regs[0], regs[1], scales[1]
+		if scales[0] != 1 {
+			if scale != 1 {
+				return Operand{}, fmt.Errorf("only one register of an address can be scaled")
+			}
+			base, index, scale = index, base, scales[0]
+		}
+		if index == "ESP" && scale == 1 {
+			base, index = index, base
+		}
+		op.Reg, op.Index, op.Scale = base, index, scale
 	default:
-		return Operand{}, fmt.Errorf("unexpected token in operand: %s", token.Value)
+		return Operand{}, fmt.Errorf("too many registers in memory operand")
+	}
+	if op.Index == "ESP" {
+		return Operand{}, fmt.Errorf("ESP cannot be an index register")
 	}
+	return op, nil
+}
+
+// isAddr32 reports whether a memory operand uses 32-bit addressing
+func isAddr32(op Operand) bool {
+	return op.Type == OperandTypeMemoryReg && (is32BitRegister(op.Reg) || is32BitRegister(op.Index))
 }
 
 func (p *Parser) skipOperand() {
@@ -575,10 +976,16 @@ type Operand struct {
 	Type         OperandType
 	Reg          string
 	Immediate    uint16
+	Imm32        uint32 // Immediate as a doubleword, for 32-bit operations
 	Address      uint16
 	Offset       uint16
-	IsLabel      bool        // True if this immediate operand came from a label
+	Index        string      // Index register (SI or DI) of a base+index address
+	Scale        byte        // Index scale (1, 2, 4 or 8) of a 32-bit address
+	Segment      string      // Segment override register of a memory operand
+	IsLabel      bool        // True if this immediate or address came from a label
 	LabelSegment SegmentType // Segment the label belongs to (for cross-segment refs)
+	Size         int         // Explicit BYTE (8), WORD (16) or DWORD (32) size, 0 if unspecified
+	Unresolved   bool        // Forward label not yet placed (8086 layout passes)
 }
 
 type OperandType int
@@ -591,8 +998,188 @@ const (
 	OperandTypeMemoryReg
 )
 
-// Generate instruction bytecode (simplified encoding)
-func (p *Parser) generateInstruction(instr string, operands []Operand, hasREP bool) error {
+// repPrefixes maps the repeat prefixes to their prefix byte, which is the
+// same in the bytecode and in 8086 machine code
+var repPrefixes = map[string]byte{
+	"REP": 0xF3, "REPE": 0xF3, "REPZ": 0xF3,
+	"REPNE": 0xF2, "REPNZ": 0xF2,
+}
+
+// stringInstruction reports whether instr is a string instruction
+func stringInstruction(instr string) bool {
+	switch instr {
+	case "MOVSB", "MOVSW", "STOSB", "STOSW", "LODSB", "LODSW",
+		"INSB", "INSW", "OUTSB", "OUTSW":
+		return true
+	}
+	return compareInstruction(instr)
+}
+
+// compareInstruction reports whether instr is a string comparison, which
+// REPE and REPNE repeat while the elements are equal or not equal
+func compareInstruction(instr string) bool {
+	switch instr {
+	case "CMPSB", "CMPSW", "SCASB", "SCASW":
+		return true
+	}
+	return false
+}
+
+// stringSource returns the segment override of a string instruction's
+// optional source operand, written as [SI] with a segment: LODSB ES:[SI]
+func stringSource(instr string, ops []Operand) (string, error) {
+	if len(ops) == 0 {
+		return "", nil
+	}
+	op := ops[0]
+	if len(ops) > 1 || op.Type != OperandTypeMemoryReg || op.Reg != "SI" || op.Index != "" || op.Offset != 0 {
+		return "", fmt.Errorf("%s takes an optional source operand of the form seg:[SI]", instr)
+	}
+	if strings.HasPrefix(instr, "STOS") || strings.HasPrefix(instr, "SCAS") || strings.HasPrefix(instr, "INS") {
+		return "", fmt.Errorf("%s has no DS:SI source to override", instr)
+	}
+	return op.Segment, nil
+}
+
+// requiredCPU returns the first processor with an instruction in the form
+// given by its operands. Shifts by an immediate count are left out: for the
+// 8086 they are expanded into shifts by one.
+func requiredCPU(instr string, ops []Operand) emulator.CPUModel {
+	if instr386[instr] || setccCondition(instr) >= 0 {
+		return emulator.Model386
+	}
+	for _, op := range ops {
+		if is32BitRegister(op.Reg) || isAddr32(op) || op.Size == 32 ||
+			op.Reg == "FS" || op.Reg == "GS" || op.Segment == "FS" || op.Segment == "GS" {
+			return emulator.Model386
+		}
+	}
+
+	switch instr {
+	case "PUSHA", "POPA", "ENTER", "LEAVE", "BOUND", "INSB", "INSW", "OUTSB", "OUTSW":
+		return emulator.Model186
+	case "PUSH":
+		if len(ops) == 1 && ops[0].Type == OperandTypeImmediate {
+			return emulator.Model186
+		}
+	case "IMUL":
+		if len(ops) == 3 || (len(ops) == 2 && ops[1].Type == OperandTypeImmediate) {
+			return emulator.Model186
+		}
+		if len(ops) == 2 {
+			return emulator.Model386
+		}
+	}
+	return emulator.Model8086
+}
+
+// instr386 lists the instructions added by the 80386, apart from SETcc
+var instr386 = map[string]bool{
+	"MOVZX": true, "MOVSX": true, "SHLD": true, "SHRD": true,
+	"BT": true, "BTS": true, "BTR": true, "BTC": true, "BSF": true, "BSR": true,
+	"CWDE": true, "CDQ": true,
+}
+
+// setccCondition returns the condition code (the low nibble of the
+// matching Jcc opcode) of a SETcc instruction, or -1 if instr is not one
+func setccCondition(instr string) int {
+	if !strings.HasPrefix(instr, "SET") {
+		return -1
+	}
+	opcode, ok := jcc8086["J"+instr[3:]]
+	if !ok {
+		return -1
+	}
+	return int(opcode & 0x0F)
+}
+
+// operand32 reports whether an instruction operates on doublewords: it has
+// a 32-bit register or a DWORD operand. MOVZX and MOVSX take the size of
+// their destination, SETcc always stores a byte, CWDE and CDQ are the
+// 32-bit forms of CBW and CWD, and a DWORD operand of an x87 instruction is
+// a real or integer in memory.
+func operand32(instr string, ops []Operand) bool {
+	_, fpu := fpuMnemonics[instr]
+	switch {
+	case instr == "CWDE" || instr == "CDQ":
+		return true
+	case instr == "MOVZX" || instr == "MOVSX":
+		return len(ops) > 0 && is32BitRegister(ops[0].Reg)
+	case setccCondition(instr) >= 0 || fpu:
+		return false
+	}
+	for _, op := range ops {
+		if (op.Type == OperandTypeRegister && is32BitRegister(op.Reg)) || op.Size == 32 {
+			return true
+		}
+	}
+	return false
+}
+
+// has32BitForm reports whether an instruction can operate on doublewords
+func has32BitForm(instr string) bool {
+	if _, ok := alu8086[instr]; ok {
+		return true
+	}
+	if _, ok := shift8086[instr]; ok {
+		return true
+	}
+	if _, ok := group3_8086[instr]; ok {
+		return true
+	}
+	switch instr {
+	case "MOV", "PUSH", "POP", "XCHG", "TEST", "INC", "DEC",
+		"MOVZX", "MOVSX", "SHLD", "SHRD", "BT", "BTS", "BTR", "BTC", "BSF", "BSR", "CWDE", "CDQ":
+		return true
+	}
+	return false
+}
+
+// countOperand reports whether operand i of a 32-bit instruction is a bit
+// count or bit index, which stays a byte
+func countOperand(instr string, i int) bool {
+	if _, ok := shift8086[instr]; ok {
+		return i == 1
+	}
+	switch instr {
+	case "SHLD", "SHRD":
+		return i == 2
+	case "BT", "BTS", "BTR", "BTC":
+		return i == 1
+	}
+	return false
+}
+
+// Generate instruction bytecode (simplified encoding). rep is a repeat
+// prefix byte or 0, and segment overrides the source of a string instruction.
+func (p *Parser) generateInstruction(instr string, operands []Operand, rep byte, segment string) error {
+	if _, ok := fpuMnemonics[instr]; ok {
+		return p.generateFPU(instr, operands)
+	}
+	for _, op := range operands {
+		if _, ok := stRegister(op); ok || op.Size > 32 {
+			return fmt.Errorf("%s does not take x87 operands", instr)
+		}
+	}
+	if model := requiredCPU(instr, operands); p.cpu < model {
+		return fmt.Errorf("%s requires a %s or later (assembling for the %s)", instr, model, p.cpu)
+	}
+	is32 := operand32(instr, operands)
+	if is32 && !has32BitForm(instr) {
+		return fmt.Errorf("%s has no 32-bit form", instr)
+	}
+
+	if p.backend == Backend8086 {
+		code, err := p.encode8086(instr, operands, rep, segment)
+		if err != nil {
+			return err
+		}
+		for _, b := range code {
+			p.emit(b)
+		}
+		return nil
+	}
+
 	// Map instruction to opcode
 	var opcode emulator.Opcode
 	var ok bool
@@ -612,6 +1199,16 @@ func (p *Parser) generateInstruction(instr string, operands []Operand, hasREP bo
 		"INC":  emulator.OpINC,
 		"DEC":  emulator.OpDEC,
 		"NEG":  emulator.OpNEG,
+		"ADC":  emulator.OpADC,
+		"SBB":  emulator.OpSBB,
+		"CBW":  emulator.OpCBW,
+		"CWD":  emulator.OpCWD,
+		"DAA":  emulator.OpDAA,
+		"DAS":  emulator.OpDAS,
+		"AAA":  emulator.OpAAA,
+		"AAS":  emulator.OpAAS,
+		"AAM":  emulator.OpAAM,
+		"AAD":  emulator.OpAAD,
 
 		"AND": emulator.OpAND,
 		"OR":  emulator.OpOR,
@@ -623,6 +1220,8 @@ func (p *Parser) generateInstruction(instr string, operands []Operand, hasREP bo
 		"SAR": emulator.OpSAR,
 		"ROL": emulator.OpROL,
 		"ROR": emulator.OpROR,
+		"RCL": emulator.OpRCL,
+		"RCR": emulator.OpRCR,
 
 		"CMP":  emulator.OpCMP,
 		"TEST": emulator.OpTEST,
@@ -642,17 +1241,44 @@ func (p *Parser) generateInstruction(instr string, operands []Operand, hasREP bo
 		"JNG":    emulator.OpJLE,
 		"JA":     emulator.OpJA,
 		"JAE":    emulator.OpJAE,
+		"JNB":    emulator.OpJAE,
 		"JB":     emulator.OpJB,
+		"JNAE":   emulator.OpJB,
 		"JBE":    emulator.OpJBE,
+		"JNA":    emulator.OpJBE,
+		"JNBE":   emulator.OpJA,
+		"JO":     emulator.OpJO,
+		"JNO":    emulator.OpJNO,
+		"JS":     emulator.OpJS,
+		"JNS":    emulator.OpJNS,
+		"JP":     emulator.OpJP,
+		"JPE":    emulator.OpJP,
+		"JNP":    emulator.OpJNP,
+		"JPO":    emulator.OpJNP,
 		"CALL":   emulator.OpCALL,
 		"RET":    emulator.OpRET,
 		"LOOP":   emulator.OpLOOP,
 		"LOOPZ":  emulator.OpLOOPZ,
+		"LOOPE":  emulator.OpLOOPZ,
 		"LOOPNZ": emulator.OpLOOPNZ,
-
-		"INT": emulator.OpINT,
-		"NOP": emulator.OpNOP,
-		"HLT": emulator.OpHLT,
+		"LOOPNE": emulator.OpLOOPNZ,
+
+		"INT":  emulator.OpINT,
+		"IRET": emulator.OpIRET,
+		"NOP":  emulator.OpNOP,
+		"HLT":  emulator.OpHLT,
+
+		"PUSHF": emulator.OpPUSHF,
+		"POPF":  emulator.OpPOPF,
+		"LAHF":  emulator.OpLAHF,
+		"SAHF":  emulator.OpSAHF,
+		"CLC":   emulator.OpCLC,
+		"STC":   emulator.OpSTC,
+		"CMC":   emulator.OpCMC,
+		"CLD":   emulator.OpCLD,
+		"STD":   emulator.OpSTD,
+		"CLI":   emulator.OpCLI,
+		"STI":   emulator.OpSTI,
 
 		"IN":  emulator.OpIN,
 		"OUT": emulator.OpOUT,
@@ -664,24 +1290,117 @@ func (p *Parser) generateInstruction(instr string, operands []Operand, hasREP bo
 		"STOSW": emulator.OpSTOSW,
 		"LODSB": emulator.OpLODSB,
 		"LODSW": emulator.OpLODSW,
+		"CMPSB": emulator.OpCMPSB,
+		"CMPSW": emulator.OpCMPSW,
+		"SCASB": emulator.OpSCASB,
+		"SCASW": emulator.OpSCASW,
+		"INSB":  emulator.OpINSB,
+		"INSW":  emulator.OpINSW,
+		"OUTSB": emulator.OpOUTSB,
+		"OUTSW": emulator.OpOUTSW,
+
+		// 80186 stack frame and bounds instructions
+		"PUSHA": emulator.OpPUSHA,
+		"POPA":  emulator.OpPOPA,
+		"ENTER": emulator.OpENTER,
+		"LEAVE": emulator.OpLEAVE,
+		"BOUND": emulator.OpBOUND,
+
+		// 80386 bit, double shift and sign extension instructions
+		"SHLD": emulator.OpSHLD,
+		"SHRD": emulator.OpSHRD,
+		"BT":   emulator.OpBT,
+		"BTS":  emulator.OpBTS,
+		"BTR":  emulator.OpBTR,
+		"BTC":  emulator.OpBTC,
+		"BSF":  emulator.OpBSF,
+		"BSR":  emulator.OpBSR,
+		"CWDE": emulator.OpCWDE,
+		"CDQ":  emulator.OpCDQ,
 	}
 
 	opcode, ok = opcodeMap[instr]
-	if !ok {
+	switch {
+	case ok:
+	case instr == "MOVZX" || instr == "MOVSX":
+		// The opcode gives the width of the source
+		src8, err := movxSource8(instr, operands)
+		if err != nil {
+			return err
+		}
+		switch {
+		case instr == "MOVZX" && src8:
+			opcode = emulator.OpMOVZXB
+		case instr == "MOVZX":
+			opcode = emulator.OpMOVZXW
+		case src8:
+			opcode = emulator.OpMOVSXB
+		default:
+			opcode = emulator.OpMOVSXW
+		}
+	case setccCondition(instr) >= 0:
+		// SETcc takes the condition code as a second operand
+		if len(operands) != 1 {
+			return fmt.Errorf("%s expects 1 operand", instr)
+		}
+		opcode = emulator.OpSETcc
+		operands = append(operands, Operand{Type: OperandTypeImmediate, Immediate: uint16(setccCondition(instr))})
+	default:
 		return fmt.Errorf("unknown instruction: %s", instr)
 	}
 
-	// Emit REP prefix if present
-	if hasREP {
-		p.emit(0xF3)
+	for _, op := range operands {
+		if isAddr32(op) {
+			return fmt.Errorf("32-bit addressing is only supported by the 8086 backend")
+		}
 	}
 
-	// Emit opcode
-	p.emit(byte(opcode))
+	// IMUL reg, src multiplies into the register; IMUL reg, src, imm stores src * imm
+	if opcode == emulator.OpIMUL {
+		switch len(operands) {
+		case 2:
+			opcode = emulator.OpIMUL2
+		case 3:
+			opcode = emulator.OpIMUL3
+		}
+	}
 
-	// Emit operands (simplified encoding)
-	for _, op := range operands {
-		p.emitOperand(op)
+	// AAM and AAD work in base 10 unless another base is given
+	if (opcode == emulator.OpAAM || opcode == emulator.OpAAD) && len(operands) == 0 {
+		operands = append(operands, Operand{Type: OperandTypeImmediate, Immediate: 10})
+	}
+
+	// Emit the repeat and segment override prefixes
+	if rep != 0 {
+		p.emit(rep)
+	}
+	if segment != "" {
+		p.emit(emulator.BytecodeSegPrefix)
+		p.emit(encodeRegister(segment))
+	}
+
+	// The 8086 has no shift by an immediate count: repeat the shift by one
+	count := uint16(1)
+	if _, ok := shift8086[instr]; ok && p.cpu < emulator.Model186 && len(operands) == 2 &&
+		operands[1].Type == OperandTypeImmediate && !operands[1].IsLabel {
+		count = operands[1].Immediate
+		if count > 0x1F {
+			return fmt.Errorf("%s count %d out of range", instr, count)
+		}
+		operands = []Operand{operands[0], {Type: OperandTypeImmediate, Immediate: 1}}
+	}
+
+	// MOVZX and MOVSX read a byte or word source whatever their size
+	dword := is32 && instr != "MOVZX" && instr != "MOVSX"
+
+	for i := uint16(0); i < count; i++ {
+		// Emit opcode
+		p.emit(byte(opcode))
+
+		// Emit operands (simplified encoding)
+		for n, op := range operands {
+			p.emitOperand(op, dword && !countOperand(instr, n))
+		}
 	}
 
 	return nil
@@ -711,20 +1430,37 @@ func (p *Parser) emitWord(w uint16) {
 	}
 }
 
-func (p *Parser) emitOperand(op Operand) {
+// emitOperand emits the bytecode of an operand. A dword operand is a memory
+// operand marked as a doubleword or an immediate widened to 32 bits.
+func (p *Parser) emitOperand(op Operand, dword bool) {
+	if dword && (op.Type == OperandTypeMemory || op.Type == OperandTypeMemoryReg) {
+		p.emit(byte(emulator.OpTypeDword))
+	}
+	if op.Segment != "" {
+		p.emit(byte(emulator.OpTypeSegOverride))
+		p.emit(encodeRegister(op.Segment))
+	}
+
 	switch op.Type {
 	case OperandTypeRegister:
-		// Check if register is 8-bit or 16-bit
-		if is8BitRegister(op.Reg) {
+		// Check if register is 8-bit, 16-bit or 32-bit
+		switch registerSize(op.Reg) {
+		case 8:
 			p.emit(byte(emulator.OpTypeReg8))
-		} else {
+		case 32:
+			p.emit(byte(emulator.OpTypeReg32))
+		default:
 			p.emit(byte(emulator.OpTypeReg16))
 		}
 		p.emit(encodeRegister(op.Reg))
 
 	case OperandTypeImmediate:
 		// Labels always use 16-bit encoding to match size calculation
-		if op.IsLabel || op.Immediate > 0xFF {
+		if dword {
+			p.emit(byte(emulator.OpTypeImm32))
+			p.emitWord(uint16(op.Imm32))
+			p.emitWord(uint16(op.Imm32 >> 16))
+		} else if op.IsLabel || op.Immediate > 0xFF {
 			p.emit(byte(emulator.OpTypeImm16))
 			p.emitWord(op.Immediate)
 		} else {
@@ -737,12 +1473,23 @@ func (p *Parser) emitOperand(op Operand) {
 		p.emitWord(op.Address)
 
 	case OperandTypeMemoryReg:
-		p.emit(byte(emulator.OpTypeMemReg))
-		p.emit(encodeRegister(op.Reg))
+		if op.Index != "" {
+			rm, _ := rmCode8086(op) // Pairs are checked by the parser
+			p.emit(byte(emulator.OpTypeMemIndexed))
+			p.emit(rm)
+		} else {
+			p.emit(byte(emulator.OpTypeMemReg))
+			p.emit(encodeRegister(op.Reg))
+		}
 		p.emitWord(op.Offset)
 	}
 }
 
+// dataDirectives maps the data directives to the size of each value
+var dataDirectives = map[string]uint16{
+	"DB": 1, "DW": 2, "DD": 4, "DQ": 8, "DT": 10,
+}
+
 func (p *Parser) parseDataDirective(directive string, line int) error {
 	// Parse comma-separated list of values and emit them as raw bytes
 	for !p.isAtEnd() && p.current().Type != TokenNewline && p.current().Type != TokenComment {
@@ -778,7 +1525,27 @@ func (p *Parser) parseDataDirective(directive string, line int) error {
 			return fmt.Errorf("expected number or string in %s directive at line %d", directive, line)
 		}
 
-		val, err := ParseNumber(p.current().Value)
+		// Real numbers are stored in the IEEE single, double or x87
+		// extended format of DD, DQ and DT
+		if isReal(p.current().Value) || directive == "DT" {
+			if err := p.emitReal(directive, p.current().Value); err != nil {
+				return fmt.Errorf("%v at line %d", err, line)
+			}
+			p.advance()
+			continue
+		}
+		if directive == "DQ" {
+			val, err := ParseNumber64(p.current().Value)
+			if err != nil {
+				return fmt.Errorf("invalid number in %s directive at line %d: %v", directive, line, err)
+			}
+			p.emitDword(uint32(val))
+			p.emitDword(uint32(val >> 32))
+			p.advance()
+			continue
+		}
+
+		val, err := ParseNumber32(p.current().Value)
 		if err != nil {
 			return fmt.Errorf("invalid number in %s directive at line %d: %v", directive, line, err)
 		}
@@ -793,14 +1560,11 @@ func (p *Parser) parseDataDirective(directive string, line int) error {
 
 		case "DW":
 			// Emit word (16-bit, little-endian)
-			p.emitWord(val)
+			p.emitWord(uint16(val))
 
 		case "DD":
 			// Emit dword (32-bit, little-endian)
-			p.emit(byte(val & 0xFF))
-			p.emit(byte((val >> 8) & 0xFF))
-			p.emit(byte((val >> 16) & 0xFF))
-			p.emit(byte((val >> 24) & 0xFF))
+			p.emitDword(val)
 		}
 
 		p.advance()
@@ -809,6 +1573,75 @@ func (p *Parser) parseDataDirective(directive string, line int) error {
 	return nil
 }
 
+// emitDword emits a doubleword, little-endian
+func (p *Parser) emitDword(d uint32) {
+	p.emitWord(uint16(d))
+	p.emitWord(uint16(d >> 16))
+}
+
+// emitReal emits a real number for DD, DQ or DT
+func (p *Parser) emitReal(directive, value string) error {
+	switch directive {
+	case "DD":
+		f, err := strconv.ParseFloat(value, 32)
+		if err != nil {
+			return fmt.Errorf("invalid real number %s in DD directive", value)
+		}
+		p.emitDword(math.Float32bits(float32(f)))
+	case "DQ":
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("invalid real number %s in DQ directive", value)
+		}
+		bits := math.Float64bits(f)
+		p.emitDword(uint32(bits))
+		p.emitDword(uint32(bits >> 32))
+	case "DT":
+		f, err := emulator.ParseFloat80(value)
+		if err != nil {
+			return fmt.Errorf("invalid real number %s in DT directive", value)
+		}
+		for _, b := range f.Bytes() {
+			p.emit(b)
+		}
+	default:
+		return fmt.Errorf("real numbers are only supported in DD, DQ and DT directives")
+	}
+	return nil
+}
+
+// registerSize returns the width in bits of a general purpose register
+func registerSize(reg string) int {
+	switch {
+	case is8BitRegister(reg):
+		return 8
+	case is32BitRegister(reg):
+		return 32
+	default:
+		return 16
+	}
+}
+
+// movxSource8 reports whether the source of MOVZX or MOVSX is a byte
+// rather than a word. A memory source must be sized with BYTE or WORD.
+func movxSource8(instr string, ops []Operand) (bool, error) {
+	if len(ops) != 2 || !isReg8086(ops[0]) || is8BitRegister(ops[0].Reg) ||
+		ops[1].Type == OperandTypeImmediate {
+		return false, fmt.Errorf("%s expects a 16-bit or 32-bit register and a register or memory operand", instr)
+	}
+	size := ops[1].Size
+	if ops[1].Type == OperandTypeRegister {
+		size = registerSize(ops[1].Reg)
+	}
+	switch size {
+	case 8:
+		return true, nil
+	case 16:
+		return false, nil
+	}
+	return false, fmt.Errorf("%s needs a BYTE or WORD source", instr)
+}
+
 func is8BitRegister(reg string) bool {
 	switch reg {
 	case "AL", "AH", "BL", "BH", "CL", "CH", "DL", "DH":
@@ -818,6 +1651,25 @@ func is8BitRegister(reg string) bool {
 	}
 }
 
+// is32BitRegister reports whether reg is one of the 80386 32-bit registers
+func is32BitRegister(reg string) bool {
+	switch reg {
+	case "EAX", "EBX", "ECX", "EDX", "ESI", "EDI", "EBP", "ESP":
+		return true
+	default:
+		return false
+	}
+}
+
+func isSegmentRegister(reg string) bool {
+	switch reg {
+	case "CS", "DS", "ES", "SS", "FS", "GS":
+		return true
+	default:
+		return false
+	}
+}
+
 func encodeRegister(reg string) byte {
 	regMap := map[string]byte{
 		"AX": 0, "BX": 1, "CX": 2, "DX": 3,
@@ -825,7 +1677,10 @@ func encodeRegister(reg string) byte {
 		"CL": 8, "CH": 9, "DL": 10, "DH": 11,
 		"SI": 12, "DI": 13, "BP": 14, "SP": 15,
 		// Segment registers
-		"CS": 16, "DS": 17, "ES": 18, "SS": 19,
+		"CS": 16, "DS": 17, "ES": 18, "SS": 19, "FS": 20, "GS": 21,
+		// 32-bit registers share the codes of the registers they extend
+		"EAX": 0, "EBX": 1, "ECX": 2, "EDX": 3,
+		"ESI": 12, "EDI": 13, "EBP": 14, "ESP": 15,
 	}
 
 	if code, ok := regMap[reg]; ok {
@@ -0,0 +1,247 @@
+package emulator_test
+
+import (
+	"assembly-emulator/assembler"
+	"assembly-emulator/emulator"
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// These tests are meant for the race detector:
+//
+//	go test -race -run Concurrent ./emulator
+
+// concurrentExamples are the examples the concurrency tests render. Each
+// reads port 3DAh every frame.
+var concurrentExamples = []string{"fire", "noise", "plasma", "starfield"}
+
+// concurrentFrames is how many emulated frames each machine runs
+const concurrentFrames = 12
+
+// renderExample runs an example headless on a new machine for
+// concurrentFrames frames of the emulated display and returns its screen
+func renderExample(t *testing.T, program *assembler.Program, engine emulator.Engine) []byte {
+	m := emulator.NewMachine()
+	m.CPU.Engine = engine
+	if err := m.LoadProgram(program); err != nil {
+		t.Errorf("LoadProgram failed: %v", err)
+		return nil
+	}
+	var screen []byte
+	m.CPU.FrameCallback = func(frame uint64) {
+		if frame == concurrentFrames {
+			screen = m.Screenshot().Pix
+			m.Stop()
+		}
+	}
+	if err := m.Run(context.Background()); !errors.Is(err, emulator.ErrStopped) {
+		t.Errorf("Expected the machine to be stopped, got %v", err)
+	}
+	return screen
+}
+
+// TestConcurrentMachines runs the examples on many machines at once, in
+// both formats and on both engines, and checks that each renders exactly
+// what the same machine renders alone
+func TestConcurrentMachines(t *testing.T) {
+	type job struct {
+		name    string
+		program *assembler.Program
+		engine  emulator.Engine
+		want    []byte
+	}
+	var jobs []*job
+	for _, name := range concurrentExamples {
+		source, err := os.ReadFile("../examples/" + name + ".asm")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, format := range exampleBackends {
+			program := assembleExample(t, source, format.backend)
+			for _, engine := range []emulator.Engine{emulator.EngineInterp, emulator.EngineBlock} {
+				jobs = append(jobs, &job{
+					name:    name + "/" + format.name + "/" + engine.String(),
+					program: program,
+					engine:  engine,
+					want:    renderExample(t, program, engine),
+				})
+			}
+		}
+	}
+
+	// Several copies of each machine run side by side
+	const copies = 3
+	screens := make([][]byte, len(jobs)*copies)
+	var wg sync.WaitGroup
+	for i := range screens {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			j := jobs[i%len(jobs)]
+			screens[i] = renderExample(t, j.program, j.engine)
+		}()
+	}
+	wg.Wait()
+
+	for i, screen := range screens {
+		j := jobs[i%len(jobs)]
+		if len(j.want) == 0 {
+			t.Fatalf("%s: no screen rendered", j.name)
+		}
+		if !bytes.Equal(screen, j.want) {
+			t.Errorf("%s: copy %d rendered a different screen", j.name, i/len(jobs))
+		}
+	}
+}
+
+// TestConcurrentDisplay runs a machine while another goroutine acts as its
+// window: raising VBlank, reading VGA memory and the palette, sending keys
+// and a save state through Schedule, and finally stopping it
+func TestConcurrentDisplay(t *testing.T) {
+	source, err := os.ReadFile("../examples/fire.asm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := emulator.NewMachine()
+	if err := m.LoadProgram(assembleExample(t, source, assembler.BackendBytecode)); err != nil {
+		t.Fatalf("LoadProgram failed: %v", err)
+	}
+	display := &lockedDisplay{memory: m.Memory, colors: map[uint8][3]uint8{}}
+	m.SetDisplay(display)
+	// The display runs until the program has drawn a few screens, each
+	// about 35 emulated frames
+	var frames atomic.Uint64
+	m.CPU.FrameCallback = func(frame uint64) { frames.Store(frame) }
+
+	var displayFrames uint64
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(time.Millisecond)
+		defer ticker.Stop()
+		var pixels [emulator.ScreenWidth * emulator.ScreenHeight]byte
+		for tick := 0; frames.Load() < 200; tick++ {
+			<-ticker.C
+			displayFrames++
+			m.CPU.SetVBlank(true)
+			m.Memory.LockVGA()
+			copy(pixels[:], m.Memory.GetVGAMemory())
+			_ = display.colors[pixels[0]]
+			m.Memory.UnlockVGA()
+			if tick%10 == 0 {
+				m.Schedule(func() { m.CPU.SetKeyPress(0x39, ' ') })
+			}
+			if tick == 5 {
+				m.Schedule(func() { m.CPU.SaveState(&bytes.Buffer{}) })
+			}
+		}
+		m.Stop()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	err = m.Run(ctx)
+	wg.Wait()
+	t.Logf("display frames %d", displayFrames)
+	if err != emulator.ErrStopped {
+		t.Fatalf("Expected the display to stop the machine, got %v", err)
+	}
+	if got := m.CPU.FrameCounter.Load(); got != displayFrames {
+		t.Errorf("Expected %d display frames, got %d", displayFrames, got)
+	}
+	if m.CPU.InstructionCount == 0 {
+		t.Error("Expected the program to run")
+	}
+}
+
+// TestConcurrentRender reads the palette and renders on other goroutines
+// while the machine runs, drawing and setting the DAC each frame, in mode 13h and then in
+// text mode
+func TestConcurrentRender(t *testing.T) {
+	source, err := os.ReadFile("../examples/fire.asm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := emulator.NewMachine()
+	if err := m.LoadProgram(assembleExample(t, source, assembler.BackendBytecode)); err != nil {
+		t.Fatalf("LoadProgram failed: %v", err)
+	}
+	// Only closing done orders the goroutines, so the race detector sees
+	// every access the machine makes while the renderer runs
+	done := make(chan struct{})
+	m.CPU.FrameCallback = func(frame uint64) {
+		m.CPU.OutByte(0x3C8, 0)
+		for i := range 256 * 3 {
+			m.CPU.OutByte(0x3C9, uint8(frame)+uint8(i))
+		}
+		switch frame {
+		case 50:
+			ax := m.CPU.AX
+			m.CPU.AX = 0x03
+			if err := m.CPU.Interrupt(0x10); err != nil {
+				t.Errorf("INT 10h failed: %v", err)
+			}
+			m.CPU.AX = ax
+		case 100:
+			close(done)
+			m.Stop()
+		}
+	}
+
+	// Palette has a goroutine of its own, as it reads the DAC far more often
+	// than Screenshot can
+	var renders [2]int
+	var wg sync.WaitGroup
+	for i, render := range []func(){func() { m.CPU.Palette() }, func() { m.Screenshot() }} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+					render()
+					renders[i]++
+				}
+			}
+		}()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	err = m.Run(ctx)
+	wg.Wait()
+	if err != emulator.ErrStopped {
+		t.Fatalf("Expected the machine to be stopped, got %v", err)
+	}
+	if renders[0] == 0 || renders[1] == 0 {
+		t.Errorf("Expected the palette and screen read while the machine ran, got %v", renders)
+	}
+}
+
+// lockedDisplay keeps a palette under the VGA memory lock, as the graphics
+// window does
+type lockedDisplay struct {
+	memory *emulator.Memory
+	colors map[uint8][3]uint8
+}
+
+func (d *lockedDisplay) SetPaletteColor(index, r, g, b uint8) {
+	d.memory.LockVGA()
+	d.colors[index] = [3]uint8{r, g, b}
+	d.memory.UnlockVGA()
+}
+
+func (d *lockedDisplay) ResetPalette() {
+	d.memory.LockVGA()
+	clear(d.colors)
+	d.memory.UnlockVGA()
+}
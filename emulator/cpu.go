@@ -3,6 +3,10 @@ package emulator
 import (
 	"assembly-emulator/font"
 	"fmt"
+	"io"
+	"math/bits"
+	"sync/atomic"
+	"time"
 )
 
 // CPU represents the x86 CPU state
@@ -24,6 +28,12 @@ type CPU struct {
 	DS uint16 // Data Segment
 	ES uint16 // Extra Segment
 	SS uint16 // Stack Segment
+	FS uint16 // 80386 extra segment
+	GS uint16 // 80386 extra segment
+
+	// High words of the 80386 extended registers: EAX is EAXHigh:AX and so on
+	EAXHigh, EBXHigh, ECXHigh, EDXHigh uint16
+	ESIHigh, EDIHigh, EBPHigh, ESPHigh uint16
 
 	// Instruction pointer
 	IP uint16
@@ -31,18 +41,48 @@ type CPU struct {
 	// Flags register
 	Flags Flags
 
+	// x87 floating-point coprocessor
+	FPU FPU
+
 	// Memory
 	Memory *Memory
 
 	// Halted state
 	Halted bool
 
+	// WaitingForInterrupt is set while HLT waits for a hardware interrupt
+	WaitingForInterrupt bool
+
+	// Exceptions selects whether CPU exceptions are dispatched through the
+	// interrupt vector table or stop Run with a diagnostic
+	Exceptions ExceptionPolicy
+
+	// Engine selects how Run executes instructions: the reference
+	// interpreter or compiled blocks
+	Engine Engine
+
+	// extended is set once an 80386 instruction has run, so String shows
+	// the 32-bit registers
+	extended bool
+
+	// Native selects the genuine 8086 machine code decoder instead of the
+	// assembler's bytecode (set when a .COM image is loaded)
+	Native bool
+
 	// Mode 13h callback (called when graphics mode is activated)
 	Mode13hCallback func()
 
+	// Video mode callback (called when INT 10h sets a mode, and when a save
+	// state or a rewind restores one)
+	VideoModeCallback func(mode uint8)
+
 	// Palette callback (called to set palette colors)
 	SetPaletteCallback func(index byte, r, g, b byte)
 
+	// Palette reset callback (called when a save state or a rewind replaces
+	// the machine, before its DAC entries are passed to SetPaletteCallback)
+	ResetPaletteCallback func()
+
 	// VGA DAC state (for palette manipulation)
 	vgaDACWriteIndex uint8 // Port 0x3C8 - DAC write index
 	vgaDACReadIndex  uint8 // Port 0x3C7 - DAC read index
@@ -50,46 +90,162 @@ type CPU struct {
 	vgaDACColorR     uint8 // Temporary storage for R component
 	vgaDACColorG     uint8 // Temporary storage for G component
 
+	// DAC palette entries as 6-bit R, G, B, and which the program has set,
+	// written under the Memory's VGA lock for Render
+	dacPalette [256][3]uint8
+	dacWritten [256]bool
+
 	// Keyboard state (for BIOS INT 16h)
 	keyboardScancode uint8 // Last key scancode
 	keyboardASCII    uint8 // Last key ASCII code
 	keyAvailable     bool  // True if a key is waiting to be read
 
 	// VBlank state (for VGA synchronization via port 0x3DA)
+	FrameSync      bool          // Reading port 0x3DA waits for the next vertical retrace
 	VBlankActive   bool          // Current VBlank state (bit 3 of port 0x3DA)
-	FrameCounter   uint64        // Frame counter for timing
+	FrameCounter   atomic.Uint64 // Frames of the host display (SetVBlank)
 	vblankChan     chan struct{} // Channel to signal VBlank events
 	waitingVBlank  bool          // True if CPU is waiting for VBlank
 
+	// Emulated frame clock: frames of the 70 Hz display timed by Cycles,
+	// which drive the keys of InputScript and FrameCallback. In
+	// Deterministic mode port 0x3DA never waits for the host's display, so
+	// a run depends only on the program and the script.
+	VideoFrame    uint64             // Frames started since cycle 0
+	frameEnd      uint64             // Cycle count at which the current frame ends (0: not known)
+	FrameCallback func(frame uint64) // Called between instructions as each frame starts
+	InputScript   []ScriptedKey      // Key presses by frame, in frame order
+	scriptNext    int                // Next key of InputScript to press
+	Deterministic bool
+
+	// I/O ports claimed by devices, and what accesses to the others do
+	io             ioBus
+	UnclaimedPorts PortPolicy
+	PortLog        io.Writer // Where PortsLog writes (os.Stderr if nil)
+
+	// Programmable interrupt controller (ports 0x20-0x21)
+	PIC *PIC
+
+	// Programmable interval timer (ports 0x40-0x43) and port 0x61
+	PIT        *PIT
+	port61     uint8  // Channel 2 gate (bit 0) and speaker enable (bit 1)
+	timerTicks uint64 // PIT input clocks run, derived from Cycles
+	timerPoll  uint8  // Steps since the timer was last advanced
+
+	// Timing: Model selects the instruction timings and ClockHz the speed
+	// Run is throttled to (0 runs as fast as the host allows). Devices are
+	// clocked from Cycles, so emulated time is the same at any host speed.
+	Model         CPUModel
+	ClockHz       uint64
+	Cycles        uint64    // Emulated clock cycles executed
+	throttleStart time.Time // Host time the throttle started counting
+	throttleBase  uint64    // Cycles at throttleStart
+	throttleNext  uint64    // Cycles at the next throttle check
+
+	// VGA sequencer, CRT controller, graphics controller and attribute
+	// controller: the register each selects, and whether the next write to
+	// port 0x3C0 is a value. The registers themselves are in Memory, for the
+	// display.
+	seqIndex  uint8
+	crtcIndex uint8
+	gcIndex   uint8
+	attrIndex uint8
+	attrData  bool
+
 	// Text cursor state (for BIOS INT 10h text output)
-	cursorX    uint8 // Cursor column (0-39 for 8-pixel chars in 320-width mode)
-	cursorY    uint8 // Cursor row (0-12 for 16-pixel chars in 200-height mode)
+	cursorX    uint8 // Cursor column (0-79 in text mode, 0-39 for 8-pixel chars in mode 13h)
+	cursorY    uint8 // Cursor row (0-24 in text mode, 0-11 for 16-pixel chars in mode 13h)
 	textColor  uint8 // Current text color (palette index)
 	textScale  uint8 // Text scale factor (default 1)
 
 	// Stop channel for external termination signal
 	stopChan chan struct{}
 
+	// Calls waiting to run between instructions (see Schedule)
+	calls chan func()
+
+	// Recorder of the recent past, and whether it is re-executing it, when
+	// rewinding is enabled (see NewRewinder)
+	rewinder  *Rewinder
+	replaying bool
+
 	// Performance metrics
 	InstructionCount uint64 // Total instructions executed
+	Steps            uint64 // Steps taken: instructions, interrupts taken and HLT idles, with a REP string instruction as one
 	StartTime        int64  // Unix nano timestamp when execution started
 }
 
 // Flags represents CPU flags
 type Flags struct {
 	CF bool // Carry Flag
+	PF bool // Parity Flag (even number of set bits in the low byte)
+	AF bool // Auxiliary Carry Flag (carry/borrow out of bit 3)
 	ZF bool // Zero Flag
 	SF bool // Sign Flag
+	TF bool // Trap Flag
+	IF bool // Interrupt Enable Flag
+	DF bool // Direction Flag (string operations decrement when set)
 	OF bool // Overflow Flag
 }
 
+// Bit positions of the flags in the 16-bit FLAGS register
+const (
+	FlagCF uint16 = 1 << 0
+	FlagPF uint16 = 1 << 2
+	FlagAF uint16 = 1 << 4
+	FlagZF uint16 = 1 << 6
+	FlagSF uint16 = 1 << 7
+	FlagTF uint16 = 1 << 8
+	FlagIF uint16 = 1 << 9
+	FlagDF uint16 = 1 << 10
+	FlagOF uint16 = 1 << 11
+
+	// flagsFixed are the bits an 8086 always reads as one (bit 1 and 12-15)
+	flagsFixed uint16 = 0xF002
+)
+
+// Word returns the flags as the 16-bit FLAGS register
+func (f Flags) Word() uint16 {
+	return flagsFixed |
+		flagBit(f.CF, FlagCF) | flagBit(f.PF, FlagPF) | flagBit(f.AF, FlagAF) |
+		flagBit(f.ZF, FlagZF) | flagBit(f.SF, FlagSF) | flagBit(f.TF, FlagTF) |
+		flagBit(f.IF, FlagIF) | flagBit(f.DF, FlagDF) | flagBit(f.OF, FlagOF)
+}
+
+func flagBit(set bool, bit uint16) uint16 {
+	if set {
+		return bit
+	}
+	return 0
+}
+
+// SetWord loads the flags from a 16-bit FLAGS register value
+func (f *Flags) SetWord(w uint16) {
+	f.CF = w&FlagCF != 0
+	f.PF = w&FlagPF != 0
+	f.AF = w&FlagAF != 0
+	f.ZF = w&FlagZF != 0
+	f.SF = w&FlagSF != 0
+	f.TF = w&FlagTF != 0
+	f.IF = w&FlagIF != 0
+	f.DF = w&FlagDF != 0
+	f.OF = w&FlagOF != 0
+}
+
+// SetLowByte loads SF, ZF, AF, PF and CF from the low byte of FLAGS (SAHF)
+func (f *Flags) SetLowByte(b uint8) {
+	w := f.Word()&0xFF00 | uint16(b)
+	f.SetWord(w)
+}
+
 // NewCPU creates a new CPU instance
 func NewCPU() *CPU {
 	mem := NewMemory()
 	// Initialize BIOS ROM with CP437 font data
 	mem.InitializeBIOSROM()
+	mem.decoded = new(decodeCache)
 
-	return &CPU{
+	c := &CPU{
 		Memory:     mem,
 		SP:         0xFFFE, // Stack grows downward from top of memory
 		CS:         0x0000, // Code segment starts at 0
@@ -97,12 +253,21 @@ func NewCPU() *CPU {
 		ES:         0x0000, // Extra segment starts at 0
 		SS:         0x0000, // Stack segment starts at 0
 		stopChan:   make(chan struct{}),
+		calls:      make(chan func(), 4),
 		vblankChan: make(chan struct{}, 1), // Buffered to prevent blocking
 		textScale:  1,                      // Default 1x text scale
 		cursorX:    0,                      // Start at top-left
 		cursorY:    0,
 		textColor:  15, // Default to white
+		PIC:        NewPIC(),
+		PIT:        NewPIT(),
+		FrameSync:  true,
 	}
+	c.FPU.Init()
+	mem.video.reset(0x03) // The BIOS starts in text mode
+	c.mapStandardPorts()
+	c.installInterruptVectors()
+	return c
 }
 
 // Reset resets the CPU to initial state
@@ -119,10 +284,39 @@ func (c *CPU) Reset() {
 	c.DS = 0
 	c.ES = 0
 	c.SS = 0
+	c.FS = 0
+	c.GS = 0
+	c.EAXHigh, c.EBXHigh, c.ECXHigh, c.EDXHigh = 0, 0, 0, 0
+	c.ESIHigh, c.EDIHigh, c.EBPHigh, c.ESPHigh = 0, 0, 0, 0
+	c.extended = false
 	c.IP = 0
 	c.Flags = Flags{}
+	c.FPU = FPU{}
+	c.FPU.Init()
 	c.Halted = false
+	c.Native = false
+	c.FrameSync = true
+	c.WaitingForInterrupt = false
+	c.PIC = NewPIC()
+	c.PIT = NewPIT()
+	c.port61 = 0
+	c.Memory.LockVGA()
+	c.dacPalette = [256][3]uint8{}
+	c.dacWritten = [256]bool{}
+	c.Memory.video.reset(0x03)
+	c.Memory.frame = 0
+	c.Memory.UnlockVGA()
+	c.resetVideoIndexes()
+	c.Cycles = 0
+	c.VideoFrame = 0
+	c.frameEnd = 0
+	c.scriptNext = 0
+	c.timerTicks = 0
+	c.throttleStart = time.Time{}
+	c.throttleNext = 0
 	c.Memory.Clear()
+	c.Memory.InitializeBIOSROM()
+	c.installInterruptVectors()
 }
 
 // GetAL returns the low byte of AX
@@ -205,9 +399,96 @@ func (c *CPU) SetDH(val uint8) {
 	c.DX = (c.DX & 0x00FF) | (uint16(val) << 8)
 }
 
+// reg32 joins the high and low words of an extended register
+func reg32(high, low uint16) uint32 {
+	return uint32(high)<<16 | uint32(low)
+}
+
+// GetEAX returns the 32-bit EAX register
+func (c *CPU) GetEAX() uint32 {
+	return reg32(c.EAXHigh, c.AX)
+}
+
+// SetEAX sets the 32-bit EAX register
+func (c *CPU) SetEAX(val uint32) {
+	c.EAXHigh, c.AX = uint16(val>>16), uint16(val)
+}
+
+// GetEBX returns the 32-bit EBX register
+func (c *CPU) GetEBX() uint32 {
+	return reg32(c.EBXHigh, c.BX)
+}
+
+// SetEBX sets the 32-bit EBX register
+func (c *CPU) SetEBX(val uint32) {
+	c.EBXHigh, c.BX = uint16(val>>16), uint16(val)
+}
+
+// GetECX returns the 32-bit ECX register
+func (c *CPU) GetECX() uint32 {
+	return reg32(c.ECXHigh, c.CX)
+}
+
+// SetECX sets the 32-bit ECX register
+func (c *CPU) SetECX(val uint32) {
+	c.ECXHigh, c.CX = uint16(val>>16), uint16(val)
+}
+
+// GetEDX returns the 32-bit EDX register
+func (c *CPU) GetEDX() uint32 {
+	return reg32(c.EDXHigh, c.DX)
+}
+
+// SetEDX sets the 32-bit EDX register
+func (c *CPU) SetEDX(val uint32) {
+	c.EDXHigh, c.DX = uint16(val>>16), uint16(val)
+}
+
+// GetESI returns the 32-bit ESI register
+func (c *CPU) GetESI() uint32 {
+	return reg32(c.ESIHigh, c.SI)
+}
+
+// SetESI sets the 32-bit ESI register
+func (c *CPU) SetESI(val uint32) {
+	c.ESIHigh, c.SI = uint16(val>>16), uint16(val)
+}
+
+// GetEDI returns the 32-bit EDI register
+func (c *CPU) GetEDI() uint32 {
+	return reg32(c.EDIHigh, c.DI)
+}
+
+// SetEDI sets the 32-bit EDI register
+func (c *CPU) SetEDI(val uint32) {
+	c.EDIHigh, c.DI = uint16(val>>16), uint16(val)
+}
+
+// GetEBP returns the 32-bit EBP register
+func (c *CPU) GetEBP() uint32 {
+	return reg32(c.EBPHigh, c.BP)
+}
+
+// SetEBP sets the 32-bit EBP register
+func (c *CPU) SetEBP(val uint32) {
+	c.EBPHigh, c.BP = uint16(val>>16), uint16(val)
+}
+
+// GetESP returns the 32-bit ESP register
+func (c *CPU) GetESP() uint32 {
+	return reg32(c.ESPHigh, c.SP)
+}
+
+// SetESP sets the 32-bit ESP register
+func (c *CPU) SetESP(val uint32) {
+	c.ESPHigh, c.SP = uint16(val>>16), uint16(val)
+}
+
 // Push pushes a 16-bit value onto the stack using SS:SP
+// Native 8086 programs wrap SP around the segment like real hardware;
+// bytecode programs get an error instead.
 func (c *CPU) Push(val uint16) error {
-	if c.SP < 2 {
+	if c.SP < 2 && !c.Native {
 		return fmt.Errorf("stack overflow")
 	}
 	c.SP -= 2
@@ -218,7 +499,7 @@ func (c *CPU) Push(val uint16) error {
 
 // Pop pops a 16-bit value from the stack using SS:SP
 func (c *CPU) Pop() (uint16, error) {
-	if c.SP > 0xFFFC {
+	if c.SP > 0xFFFC && !c.Native {
 		return 0, fmt.Errorf("stack underflow")
 	}
 	addr := CalculateLinearAddress(c.SS, c.SP)
@@ -242,29 +523,76 @@ func (c *CPU) UpdateSignFlag8(val uint8) {
 	c.Flags.SF = (val&0x80) != 0
 }
 
-// UpdateFlags updates zero and sign flags based on the result
+// UpdateParityFlag sets the parity flag from the low byte of the value
+func (c *CPU) UpdateParityFlag(val uint16) {
+	c.Flags.PF = bits.OnesCount8(uint8(val))%2 == 0
+}
+
+// UpdateFlags updates zero, sign and parity flags based on the result
 func (c *CPU) UpdateFlags(val uint16) {
 	c.UpdateZeroFlag(val)
 	c.UpdateSignFlag(val)
+	c.UpdateParityFlag(val)
 }
 
-// UpdateFlags8 updates zero and sign flags based on 8-bit result
+// UpdateFlags8 updates zero, sign and parity flags based on 8-bit result
 func (c *CPU) UpdateFlags8(val uint8) {
 	c.Flags.ZF = (val == 0)
 	c.UpdateSignFlag8(val)
+	c.UpdateParityFlag(uint16(val))
+}
+
+// updateAuxFlag sets AF from the carry or borrow out of bit 3 of an
+// addition or subtraction of a and b giving result
+func (c *CPU) updateAuxFlag(a, b, result uint16) {
+	c.Flags.AF = (a^b^result)&0x10 != 0
+}
+
+// updateFlagsWidth updates zero, sign and parity flags for an 8-bit or 16-bit result
+func (c *CPU) updateFlagsWidth(val uint16, is8 bool) {
+	if is8 {
+		c.UpdateFlags8(uint8(val))
+	} else {
+		c.UpdateFlags(val)
+	}
 }
 
-// String returns a string representation of CPU state
+// String returns a string representation of CPU state. Once an 80386
+// instruction has run it shows the 32-bit registers and FS and GS, and
+// while the x87 register stack holds values it shows them on a third line.
 func (c *CPU) String() string {
+	s := c.registers()
+	if fpu := c.FPU.String(); fpu != "" {
+		s += "\n" + fpu
+	}
+	return s
+}
+
+// registers formats the CPU registers and flags
+func (c *CPU) registers() string {
+	if c.extended {
+		return fmt.Sprintf("EAX:%08X EBX:%08X ECX:%08X EDX:%08X ESI:%08X EDI:%08X EBP:%08X ESP:%08X IP:%04X\n"+
+			"CS:%04X DS:%04X ES:%04X SS:%04X FS:%04X GS:%04X FLAGS:%04X [%s]",
+			c.GetEAX(), c.GetEBX(), c.GetECX(), c.GetEDX(), c.GetESI(), c.GetEDI(), c.GetEBP(), c.GetESP(), c.IP,
+			c.CS, c.DS, c.ES, c.SS, c.FS, c.GS, c.Flags.Word(), c.flagLetters())
+	}
 	return fmt.Sprintf("AX:%04X BX:%04X CX:%04X DX:%04X SI:%04X DI:%04X BP:%04X SP:%04X IP:%04X\n"+
-		"CS:%04X DS:%04X ES:%04X SS:%04X [%s%s%s%s]",
+		"CS:%04X DS:%04X ES:%04X SS:%04X FLAGS:%04X [%s]",
 		c.AX, c.BX, c.CX, c.DX, c.SI, c.DI, c.BP, c.SP, c.IP,
-		c.CS, c.DS, c.ES, c.SS,
-		flagStr("C", c.Flags.CF),
-		flagStr("Z", c.Flags.ZF),
-		flagStr("S", c.Flags.SF),
-		flagStr("O", c.Flags.OF),
-	)
+		c.CS, c.DS, c.ES, c.SS, c.Flags.Word(), c.flagLetters())
+}
+
+// flagLetters returns the flags as letters, with - for each clear flag
+func (c *CPU) flagLetters() string {
+	return flagStr("O", c.Flags.OF) +
+		flagStr("D", c.Flags.DF) +
+		flagStr("I", c.Flags.IF) +
+		flagStr("T", c.Flags.TF) +
+		flagStr("S", c.Flags.SF) +
+		flagStr("Z", c.Flags.ZF) +
+		flagStr("A", c.Flags.AF) +
+		flagStr("P", c.Flags.PF) +
+		flagStr("C", c.Flags.CF)
 }
 
 func flagStr(name string, set bool) string {
@@ -274,22 +602,34 @@ func flagStr(name string, set bool) string {
 	return "-"
 }
 
+// PerformanceStats summarizes how fast a program ran
+type PerformanceStats struct {
+	Instructions       uint64  // Instructions executed
+	Cycles             uint64  // Emulated clock cycles
+	ElapsedSec         float64 // Host time since StartTime
+	InstructionsPerSec float64
+	CyclesPerSec       float64 // Effective emulated clock rate in Hz
+}
+
 // GetPerformanceStats returns performance metrics
-func (c *CPU) GetPerformanceStats(currentTimeNano int64) (instructionsPerSec float64, totalInstructions uint64, elapsedSec float64) {
-	totalInstructions = c.InstructionCount
+func (c *CPU) GetPerformanceStats(currentTimeNano int64) PerformanceStats {
+	stats := PerformanceStats{Instructions: c.InstructionCount, Cycles: c.Cycles}
 	if c.StartTime == 0 {
-		return 0, totalInstructions, 0
+		return stats
 	}
 	elapsedNano := currentTimeNano - c.StartTime
-	elapsedSec = float64(elapsedNano) / 1e9
-	if elapsedSec > 0 {
-		instructionsPerSec = float64(totalInstructions) / elapsedSec
+	stats.ElapsedSec = float64(elapsedNano) / 1e9
+	if stats.ElapsedSec > 0 {
+		stats.InstructionsPerSec = float64(stats.Instructions) / stats.ElapsedSec
+		stats.CyclesPerSec = float64(stats.Cycles) / stats.ElapsedSec
 	}
-	return instructionsPerSec, totalInstructions, elapsedSec
+	return stats
 }
 
-// OutByte handles OUT instruction - write byte to I/O port
-func (c *CPU) OutByte(port uint16, value uint8) {
+// writeDAC handles an OUT to the VGA DAC: the read index (3C7h), the write
+// index (3C8h) and the data register (3C9h), which takes the red, green and
+// blue components of a palette entry in turn
+func (c *CPU) writeDAC(port uint16, value uint8) {
 	switch port {
 	case 0x3C8: // DAC Write Index
 		c.vgaDACWriteIndex = value
@@ -304,13 +644,14 @@ func (c *CPU) OutByte(port uint16, value uint8) {
 			c.vgaDACState = 2
 		case 2: // Blue component
 			// We have all three components, update the palette
-			// Convert from 6-bit (0-63) to 8-bit (0-255)
-			// Use uint16 to avoid overflow, then convert back to uint8
-			r := uint8((uint16(c.vgaDACColorR&0x3F) * 255) / 63)
-			g := uint8((uint16(c.vgaDACColorG&0x3F) * 255) / 63)
-			b := uint8((uint16(value&0x3F) * 255) / 63)
+			entry := [3]uint8{c.vgaDACColorR & 0x3F, c.vgaDACColorG & 0x3F, value & 0x3F}
+			c.Memory.LockVGA()
+			c.dacPalette[c.vgaDACWriteIndex] = entry
+			c.dacWritten[c.vgaDACWriteIndex] = true
+			c.Memory.UnlockVGA()
 
 			if c.SetPaletteCallback != nil {
+				r, g, b := dacColor(entry)
 				c.SetPaletteCallback(c.vgaDACWriteIndex, r, g, b)
 			}
 
@@ -324,46 +665,66 @@ func (c *CPU) OutByte(port uint16, value uint8) {
 	}
 }
 
-// InByte handles IN instruction - read byte from I/O port
-func (c *CPU) InByte(port uint16) uint8 {
+// dacColor converts a DAC entry's 6-bit (0-63) components to 8-bit (0-255)
+func dacColor(entry [3]uint8) (r, g, b uint8) {
+	// Use uint16 to avoid overflow, then convert back to uint8
+	r = uint8((uint16(entry[0]) * 255) / 63)
+	g = uint8((uint16(entry[1]) * 255) / 63)
+	b = uint8((uint16(entry[2]) * 255) / 63)
+	return r, g, b
+}
+
+// readDAC handles an IN from the VGA DAC ports
+func (c *CPU) readDAC(port uint16) uint8 {
 	switch port {
-	case 0x3C7: // DAC State
-		// Return 0 to indicate DAC is ready
-		return 0
 	case 0x3C8: // DAC Write Index
 		return c.vgaDACWriteIndex
 	case 0x3C9: // DAC Data (read)
 		// For now, return 0 (proper implementation would read from palette)
 		return 0
-	case 0x3DA: // Input Status Register 1 (VGA status)
-		// Bit 3: Vertical retrace (VBlank) - 1 during VBlank, 0 otherwise
-		// Bit 0: Display enable (usually 1)
-
-		// Wait for next VBlank signal from graphics loop
-		// This blocks the CPU until the next frame starts
-		select {
-		case <-c.vblankChan:
-			// VBlank occurred - frame sync
-			c.VBlankActive = true
-		case <-c.stopChan:
-			// CPU stopped
-		}
-
-		var status uint8 = 0x01 // Display enabled
-		if c.VBlankActive {
-			status |= 0x08 // Set bit 3
+	}
+	// DAC State: 0 indicates the DAC is ready
+	return 0
+}
+
+// readInputStatus handles an IN from Input Status Register 1 (3DAh).
+// Bit 3: Vertical retrace (VBlank), bit 0: display blanked, both timed from
+// the cycle counter. With FrameSync a read waits for the next retrace;
+// unthrottled, it also waits for the next frame of the graphics loop so the
+// display keeps up. A machine no display has called SetVBlank on runs free.
+func (c *CPU) readInputStatus(_ uint16) uint8 {
+	if c.FrameSync {
+		c.waitRetrace()
+		if c.ClockHz == 0 && !c.replaying && !c.Deterministic && c.FrameCounter.Load() != 0 {
+			select {
+			case <-c.vblankChan:
+			case <-c.stopChan:
+			}
 		}
-		// Clear VBlank after reading
-		c.VBlankActive = false
-		return status
-	default:
-		return 0
 	}
+	status := c.vgaStatus()
+	c.VBlankActive = status&0x08 != 0
+	c.attrData = false // The attribute controller expects an index next
+	return status
+}
+
+// RaiseIRQ requests a hardware interrupt on an IRQ line of the PIC. It is
+// delivered between instructions once IF is set and the line is unmasked.
+func (c *CPU) RaiseIRQ(irq int) {
+	c.PIC.Raise(irq)
 }
 
 // SetKeyPress sets the keyboard state when a key is pressed
 // scancode is the BIOS scan code, ascii is the ASCII character
 func (c *CPU) SetKeyPress(scancode, ascii uint8) {
+	if c.rewinder != nil {
+		c.rewinder.logKey(scancode, ascii)
+	}
+	c.pressKey(scancode, ascii)
+}
+
+// pressKey makes a key available to INT 16h
+func (c *CPU) pressKey(scancode, ascii uint8) {
 	c.keyboardScancode = scancode
 	c.keyboardASCII = ascii
 	c.keyAvailable = true
@@ -373,7 +734,7 @@ func (c *CPU) SetKeyPress(scancode, ascii uint8) {
 // This is called by the graphics Update() method at the start of each frame
 func (c *CPU) SetVBlank(active bool) {
 	if active {
-		c.FrameCounter++
+		c.FrameCounter.Add(1)
 		// Signal VBlank to waiting CPU (non-blocking)
 		select {
 		case c.vblankChan <- struct{}{}:
@@ -394,6 +755,20 @@ func (c *CPU) Stop() {
 	}
 }
 
+// Schedule runs f on the goroutine running Run, between two instructions,
+// where it can read or replace the machine state, for example to save or
+// load a state from the display's goroutine. It returns false without
+// queueing f if too many calls are already waiting. Calls queued once Run
+// has returned do not run.
+func (c *CPU) Schedule(f func()) bool {
+	select {
+	case c.calls <- f:
+		return true
+	default:
+		return false
+	}
+}
+
 // drawCharToVGA draws a CP437 character directly to VGA memory
 // This is used by the INT 10h teletype function
 func (c *CPU) drawCharToVGA(char byte, x, y int, colorIndex byte, scale int) {
@@ -0,0 +1,103 @@
+package emulator
+
+const (
+	// Cached instructions are kept in pages of 256 linear addresses,
+	// allocated on first use
+	decodePageBits = 8
+	decodePageSize = 1 << decodePageBits
+
+	// maxCachedSize is the longest instruction the cache holds, so that a
+	// write only has to look back this far for instructions it overwrites.
+	// Longer ones, with runs of redundant prefixes, are decoded each time.
+	maxCachedSize = 16
+)
+
+// cachedInstruction is an instruction decoded at a linear address
+type cachedInstruction struct {
+	inst   Instruction
+	cs     uint16   // Code segment it was decoded with; branch targets are IP-relative
+	model  CPUModel // CPU model it was decoded for
+	native bool     // True if decoded as 8086 machine code
+	valid  bool
+}
+
+// decodeCache holds pre-decoded instructions keyed by linear address, so
+// that Step decodes the bytes of an instruction once instead of on every
+// execution. Cached operands keep their addressing form (Base, Index, Disp
+// and Seg), from which the memory addresses are resolved with the current
+// registers before each execution. Memory invalidates the instructions a
+// write overlaps, so self-modifying code is decoded again.
+type decodeCache struct {
+	pages [TotalMemorySize / decodePageSize]*[decodePageSize]cachedInstruction
+	code  [TotalMemorySize / 64]uint64 // Bitmap of the bytes of cached instructions
+}
+
+// lookup returns the instruction cached at addr for the current CS, CPU
+// model and program format, or nil
+func (d *decodeCache) lookup(addr uint32, c *CPU) *Instruction {
+	page := d.pages[addr>>decodePageBits]
+	if page == nil {
+		return nil
+	}
+	e := &page[addr&(decodePageSize-1)]
+	if !e.valid || e.cs != c.CS || e.model != c.Model || e.native != c.Native {
+		return nil
+	}
+	return &e.inst
+}
+
+// store caches an instruction decoded at addr. Instructions whose bytes wrap
+// around the end of the segment or of memory, and those with 32-bit
+// addresses, which are checked against the segment limit as they are
+// decoded, are not cached (see cacheable).
+func (d *decodeCache) store(addr uint32, c *CPU, inst Instruction, ip uint16) {
+	if !cacheable(addr, inst, ip) {
+		return
+	}
+	size := uint32(inst.Size)
+	page := d.pages[addr>>decodePageBits]
+	if page == nil {
+		page = new([decodePageSize]cachedInstruction)
+		d.pages[addr>>decodePageBits] = page
+	}
+	page[addr&(decodePageSize-1)] = cachedInstruction{inst: inst, cs: c.CS, model: c.Model, native: c.Native, valid: true}
+	for a := addr; a < addr+size; a++ {
+		d.code[a/64] |= 1 << (a % 64)
+	}
+}
+
+// cacheable reports whether an instruction decoded at CS:ip, linear address
+// addr, can be cached
+func cacheable(addr uint32, inst Instruction, ip uint16) bool {
+	size := uint32(inst.Size)
+	return size <= maxCachedSize && uint32(ip)+size <= 0x10000 && addr+size <= TotalMemorySize &&
+		!inst.Dest.Addr32 && !inst.Src.Addr32
+}
+
+// covers reports whether addr holds a byte of a cached instruction
+func (d *decodeCache) covers(addr uint32) bool {
+	return d.code[addr/64]&(1<<(addr%64)) != 0
+}
+
+// invalidate drops the cached instructions that include the byte at addr
+func (d *decodeCache) invalidate(addr uint32) {
+	start := uint32(0)
+	if addr >= maxCachedSize {
+		start = addr - (maxCachedSize - 1)
+	}
+	for a := start; a <= addr; a++ {
+		page := d.pages[a>>decodePageBits]
+		if page == nil {
+			continue
+		}
+		if e := &page[a&(decodePageSize-1)]; e.valid && a+uint32(e.inst.Size) > addr {
+			e.valid = false
+		}
+	}
+	d.code[addr/64] &^= 1 << (addr % 64)
+}
+
+// flush drops all cached instructions
+func (d *decodeCache) flush() {
+	*d = decodeCache{}
+}
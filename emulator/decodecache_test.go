@@ -0,0 +1,94 @@
+package emulator
+
+import "testing"
+
+// TestDecodeCacheSelfModifying tests that a write to a cached instruction
+// drops it, by incrementing the immediate of a MOV between executions
+func TestDecodeCacheSelfModifying(t *testing.T) {
+	cpu := runCOM(t, []byte{
+		0xB9, 0x03, 0x00, // 0100: MOV CX, 3
+		0xB8, 0x01, 0x00, // 0103: MOV AX, 1
+		0x01, 0xC3, // 0106: ADD BX, AX
+		0xFE, 0x06, 0x04, 0x01, // 0108: INC BYTE [0104h]
+		0xE2, 0xF5, // 010C: LOOP 0103h
+		0xF4, // 010E: HLT
+	})
+	if cpu.BX != 6 {
+		t.Errorf("Expected BX=1+2+3=6, got %d", cpu.BX)
+	}
+}
+
+// TestDecodeCacheAddresses tests that a cached instruction addresses memory
+// with the registers of each execution, including a segment override
+func TestDecodeCacheAddresses(t *testing.T) {
+	cpu := runCOM(t, []byte{
+		0xBE, 0x20, 0x01, // 0100: MOV SI, 0120h
+		0xB9, 0x03, 0x00, // 0103: MOV CX, 3
+		0x26, 0x02, 0x04, // 0106: ADD AL, ES:[SI]
+		0x46,       // 0109: INC SI
+		0x8C, 0xC2, // 010A: MOV DX, ES
+		0x42,       // 010C: INC DX
+		0x8E, 0xC2, // 010D: MOV ES, DX
+		0xE2, 0xF5, // 010F: LOOP 0106h
+		0xF4, // 0111: HLT
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, // 0120
+		0, 20, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, // 0130
+		0, 0, 44, // 0140
+	})
+	if cpu.GetAL() != 1+20+44 {
+		t.Errorf("Expected AL=%d, got %d", 1+20+44, cpu.GetAL())
+	}
+}
+
+// TestDecodeCacheCodeSegment tests that an instruction reached through
+// another CS:IP for the same linear address is decoded again, as its branch
+// targets are relative to IP
+func TestDecodeCacheCodeSegment(t *testing.T) {
+	cpu := NewCPU()
+	cpu.Native = true
+	cpu.Memory.LoadProgram(0x1000, []byte{
+		0x41,       // INC CX
+		0xEB, 0x00, // JMP $+2
+		0xF4, // HLT
+	})
+	for _, cs := range []uint16{0x0100, 0x00F0} {
+		cpu.CS, cpu.IP, cpu.Halted = cs, 0x1000-cs*16, false
+		for i := 0; i < 3 && !cpu.Halted; i++ {
+			if err := cpu.Step(); err != nil {
+				t.Fatalf("CS=%04X: %v", cs, err)
+			}
+		}
+		if cpu.IP != 0x1004-cs*16 {
+			t.Errorf("CS=%04X: expected HLT at IP=%04X, stopped at %04X", cs, 0x1003-cs*16, cpu.IP-1)
+		}
+	}
+	if cpu.CX != 2 {
+		t.Errorf("Expected CX=2, got %d", cpu.CX)
+	}
+}
+
+// TestStepAllocations tests that Step does not allocate once a loop's
+// instructions are cached
+func TestStepAllocations(t *testing.T) {
+	cpu := NewCPU()
+	if err := cpu.LoadCOM([]byte{
+		0xBE, 0x00, 0x02, // 0100: MOV SI, 0200h
+		0x8A, 0x04, // 0103: MOV AL, [SI]
+		0x00, 0xC4, // 0105: ADD AH, AL
+		0x88, 0x64, 0x01, // 0107: MOV [SI+1], AH
+		0xD0, 0xE0, // 010A: SHL AL, 1
+		0x46,       // 010C: INC SI
+		0xEB, 0xF4, // 010D: JMP 0103h
+	}); err != nil {
+		t.Fatalf("LoadCOM failed: %v", err)
+	}
+	allocs := testing.AllocsPerRun(1000, func() {
+		if err := cpu.Step(); err != nil {
+			t.Fatalf("Step failed: %v", err)
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("Expected no allocations per Step, got %v", allocs)
+	}
+}
@@ -1,6 +1,9 @@
 package emulator
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+)
 
 // Decode decodes the next instruction at the current IP using CS:IP
 func (c *CPU) Decode() (Instruction, error) {
@@ -10,32 +13,59 @@ func (c *CPU) Decode() (Instruction, error) {
 		return Instruction{}, fmt.Errorf("IP out of bounds: CS:IP = %04X:%04X (linear: 0x%05X)", c.CS, c.IP, addr)
 	}
 
-	// Check for REP prefix (0xF3)
-	firstByte := c.Memory.ReadByteLinear(addr)
-	hasREP := false
-	if firstByte == 0xF3 {
-		hasREP = true
+	// Prefixes: REP/REPE (0xF3), REPNE (0xF2) and a segment override
+	// (BytecodeSegPrefix followed by a segment register code)
+	var inst Instruction
+	var segment *uint16
+	for {
+		prefix := c.Memory.ReadByteLinear(addr)
+		if prefix != 0xF3 && prefix != 0xF2 && prefix != BytecodeSegPrefix {
+			break
+		}
 		c.IP++
+		inst.Size++ // Account for the prefix byte
+
+		switch prefix {
+		case 0xF2:
+			inst.REPNE = true
+			inst.HasREP = true
+		case 0xF3:
+			inst.HasREP = true
+		case BytecodeSegPrefix:
+			code := c.Memory.ReadByteLinear(CalculateLinearAddress(c.CS, c.IP))
+			c.IP++
+			inst.Size++
+			seg, err := c.decodeRegister16(code)
+			if err != nil || code < 16 {
+				return inst, fmt.Errorf("invalid segment override register code: %d", code)
+			}
+			segment = seg
+		}
+
 		addr = CalculateLinearAddress(c.CS, c.IP)
 		if addr >= TotalMemorySize {
-			return Instruction{}, fmt.Errorf("IP out of bounds after REP prefix")
+			return Instruction{}, fmt.Errorf("IP out of bounds after prefix")
 		}
 	}
 
 	opcode := Opcode(c.Memory.ReadByteLinear(addr))
 	c.IP++
+	inst.Opcode = opcode
+	inst.Size++
 
-	inst := Instruction{
-		Opcode: opcode,
-		Size:   1,
-		HasREP: hasREP,
-	}
-	if hasREP {
-		inst.Size++ // Account for REP prefix byte
-	}
-
-	// Decode operands based on instruction
+	// Decode operands based on instruction; an x87 instruction has its
+	// operation in the next byte
 	numOperands := getOperandCount(opcode)
+	if opcode == OpFPU {
+		inst.FPU = FPUOp(c.Memory.ReadByteLinear(CalculateLinearAddress(c.CS, c.IP)))
+		c.IP++
+		inst.Size++
+		info, ok := fpuOps[inst.FPU]
+		if !ok {
+			return inst, fmt.Errorf("invalid x87 operation: 0x%02X", byte(inst.FPU))
+		}
+		numOperands = info.operands
+	}
 
 	for i := 0; i < numOperands; i++ {
 		op, size, err := c.decodeOperand()
@@ -45,16 +75,68 @@ func (c *CPU) Decode() (Instruction, error) {
 
 		inst.Size += size
 
-		if i == 0 {
+		switch i {
+		case 0:
 			inst.Dest = op
-		} else {
+		case 1:
 			inst.Src = op
+		default:
+			inst.Src2 = op
 		}
 	}
 
+	resolveMemoryWidth(&inst)
+	if segment != nil {
+		applySegmentPrefix(&inst, segment)
+	}
+	inst.resolve()
+
 	return inst, nil
 }
 
+// BytecodeSegPrefix is the bytecode's segment override prefix. It is
+// followed by a segment register code and applies to the DS:SI source of a
+// string instruction, the table of XLAT and memory operands without their
+// own override.
+const BytecodeSegPrefix byte = 0xF1
+
+// applySegmentPrefix applies a segment override prefix to an instruction
+func applySegmentPrefix(inst *Instruction, seg *uint16) {
+	override := Operand{Seg: seg, SegOverride: true}
+	switch {
+	case isStringOp(inst.Opcode):
+		inst.Src = override
+	case inst.Opcode == OpXLAT:
+		inst.Dest = override
+	}
+	for _, op := range []*Operand{&inst.Dest, &inst.Src, &inst.Src2} {
+		if op.isMemory() && !op.SegOverride {
+			op.Seg = seg
+			op.SegOverride = true
+		}
+	}
+}
+
+// resolveMemoryWidth marks memory operands as byte-sized when the bytecode
+// implies it. The bytecode has no byte size field, so a memory operand is a
+// byte when paired with an 8-bit register, when MOV stores an 8-bit
+// immediate, and for the byte forms of MOVZX, MOVSX and SETcc. Doubleword
+// operands are marked by OpTypeDword instead.
+func resolveMemoryWidth(inst *Instruction) {
+	byteSized := inst.Dest.Type == OpTypeReg8 || inst.Src.Type == OpTypeReg8 ||
+		(inst.Opcode == OpMOV && inst.Src.Type == OpTypeImm8) ||
+		inst.Opcode == OpMOVZXB || inst.Opcode == OpMOVSXB || inst.Opcode == OpSETcc
+	if !byteSized {
+		return
+	}
+	if inst.Dest.isMemory() {
+		inst.Dest.Byte = true
+	}
+	if inst.Src.isMemory() {
+		inst.Src.Byte = true
+	}
+}
+
 func (c *CPU) decodeOperand() (Operand, int, error) {
 	addr := CalculateLinearAddress(c.CS, c.IP)
 	if addr >= TotalMemorySize {
@@ -81,18 +163,31 @@ func (c *CPU) decodeOperand() (Operand, int, error) {
 		}
 		op.Reg16 = reg
 
+	case OpTypeReg32:
+		addr = CalculateLinearAddress(c.CS, c.IP)
+		regCode := c.Memory.ReadByteLinear(addr)
+		c.IP++
+		size++
+
+		low, high, err := c.decodeRegister32(regCode)
+		if err != nil {
+			return op, size, err
+		}
+		op.Reg16 = low
+		op.RegHigh = high
+
 	case OpTypeReg8:
 		addr = CalculateLinearAddress(c.CS, c.IP)
 		regCode := c.Memory.ReadByteLinear(addr)
 		c.IP++
 		size++
 
-		getter, setter, err := c.decodeRegister8(regCode)
+		reg, high, err := c.decodeRegister8(regCode)
 		if err != nil {
 			return op, size, err
 		}
-		op.Reg8Get = getter
-		op.Reg8Set = setter
+		op.Reg8 = reg
+		op.Reg8High = high
 
 	case OpTypeImm8:
 		addr = CalculateLinearAddress(c.CS, c.IP)
@@ -106,13 +201,19 @@ func (c *CPU) decodeOperand() (Operand, int, error) {
 		c.IP += 2
 		size += 2
 
+	case OpTypeImm32:
+		addr = CalculateLinearAddress(c.CS, c.IP)
+		op.Imm32 = reg32(c.Memory.ReadWordLinear(addr+2), c.Memory.ReadWordLinear(addr))
+		c.IP += 4
+		size += 4
+
 	case OpTypeMem:
 		addr = CalculateLinearAddress(c.CS, c.IP)
-		op.MemAddr = c.Memory.ReadWordLinear(addr)
+		op.Disp = c.Memory.ReadWordLinear(addr)
 		c.IP += 2
 		size += 2
 		// Default to DS segment for direct memory access
-		op.MemSegment = c.DS
+		op.Seg = &c.DS
 		op.SegOverride = false
 
 	case OpTypeMemReg:
@@ -126,15 +227,84 @@ func (c *CPU) decodeOperand() (Operand, int, error) {
 		c.IP += 2
 		size += 2
 
-		// Calculate effective offset (not linear address yet)
-		effectiveOffset, seg, err := c.calculateMemRegAddress(regCode, offset)
+		// The effective offset is the register plus the offset
+		base, seg, err := c.memRegAddress(regCode)
 		if err != nil {
 			return op, size, err
 		}
-		op.MemAddr = effectiveOffset
-		op.MemSegment = seg
+		op.Base = base
+		op.Disp = offset
+		op.Seg = seg
 		op.SegOverride = false
 
+	case OpTypeMemIndexed:
+		addr = CalculateLinearAddress(c.CS, c.IP)
+		rm := c.Memory.ReadByteLinear(addr)
+		c.IP++
+		size++
+
+		addr = CalculateLinearAddress(c.CS, c.IP)
+		disp := c.Memory.ReadWordLinear(addr)
+		c.IP += 2
+		size += 2
+
+		// The base/index pairs use 8086 r/m numbering and default segments:
+		// [BX+SI] and [BX+DI] address DS, [BP+SI] and [BP+DI] address SS
+		if rm > 3 {
+			return op, size, fmt.Errorf("invalid base and index code: %d", rm)
+		}
+		op.Base, op.Index, op.Seg = c.address8086(rm)
+		op.Disp = disp
+
+	case OpTypeSegOverride:
+		addr = CalculateLinearAddress(c.CS, c.IP)
+		segCode := c.Memory.ReadByteLinear(addr)
+		c.IP++
+		size++
+
+		seg, err := c.decodeRegister16(segCode)
+		if err != nil || segCode < 16 {
+			return op, size, fmt.Errorf("invalid segment override register code: %d", segCode)
+		}
+
+		// The override applies to the memory operand that follows
+		mem, memSize, err := c.decodeOperand()
+		size += memSize
+		if err != nil {
+			return mem, size, err
+		}
+		if !mem.isMemory() {
+			return mem, size, fmt.Errorf("segment override on a non-memory operand")
+		}
+		mem.Seg = seg
+		mem.SegOverride = true
+		return mem, size, nil
+
+	case OpTypeDword, OpTypeQword, OpTypeTword:
+		// The memory operand that follows is a doubleword, quadword or
+		// ten-byte value
+		mem, memSize, err := c.decodeOperand()
+		size += memSize
+		if err != nil {
+			return mem, size, err
+		}
+		if !mem.isMemory() {
+			return mem, size, fmt.Errorf("operand size marker on a non-memory operand")
+		}
+		mem.Dword = opType == OpTypeDword
+		mem.Qword = opType == OpTypeQword
+		mem.Tword = opType == OpTypeTword
+		return mem, size, nil
+
+	case OpTypeST:
+		addr = CalculateLinearAddress(c.CS, c.IP)
+		op.Imm8 = c.Memory.ReadByteLinear(addr)
+		c.IP++
+		size++
+		if op.Imm8 > 7 {
+			return op, size, fmt.Errorf("invalid x87 register: ST(%d)", op.Imm8)
+		}
+
 	default:
 		return op, size, fmt.Errorf("unknown operand type: 0x%02X", opType)
 	}
@@ -169,78 +339,108 @@ func (c *CPU) decodeRegister16(code byte) (*uint16, error) {
 		return &c.ES, nil
 	case 19:
 		return &c.SS, nil
+	case 20:
+		return &c.FS, nil
+	case 21:
+		return &c.GS, nil
 	default:
 		return nil, fmt.Errorf("invalid 16-bit register code: %d", code)
 	}
 }
 
-func (c *CPU) decodeRegister8(code byte) (func() uint8, func(uint8), error) {
+// decodeRegister32 returns the low and high words of the 32-bit register
+// extending the 16-bit register with the given code
+func (c *CPU) decodeRegister32(code byte) (*uint16, *uint16, error) {
+	switch code {
+	case 0:
+		return &c.AX, &c.EAXHigh, nil
+	case 1:
+		return &c.BX, &c.EBXHigh, nil
+	case 2:
+		return &c.CX, &c.ECXHigh, nil
+	case 3:
+		return &c.DX, &c.EDXHigh, nil
+	case 12:
+		return &c.SI, &c.ESIHigh, nil
+	case 13:
+		return &c.DI, &c.EDIHigh, nil
+	case 14:
+		return &c.BP, &c.EBPHigh, nil
+	case 15:
+		return &c.SP, &c.ESPHigh, nil
+	default:
+		return nil, nil, fmt.Errorf("invalid 32-bit register code: %d", code)
+	}
+}
+
+// decodeRegister8 returns the 16-bit register holding the 8-bit register
+// with the given code, and whether it is the high byte
+func (c *CPU) decodeRegister8(code byte) (*uint16, bool, error) {
 	switch code {
 	case 4: // AL
-		return c.GetAL, c.SetAL, nil
+		return &c.AX, false, nil
 	case 5: // AH
-		return c.GetAH, c.SetAH, nil
+		return &c.AX, true, nil
 	case 6: // BL
-		return c.GetBL, c.SetBL, nil
+		return &c.BX, false, nil
 	case 7: // BH
-		return c.GetBH, c.SetBH, nil
+		return &c.BX, true, nil
 	case 8: // CL
-		return c.GetCL, c.SetCL, nil
+		return &c.CX, false, nil
 	case 9: // CH
-		return c.GetCH, c.SetCH, nil
+		return &c.CX, true, nil
 	case 10: // DL
-		return c.GetDL, c.SetDL, nil
+		return &c.DX, false, nil
 	case 11: // DH
-		return c.GetDH, c.SetDH, nil
+		return &c.DX, true, nil
 	default:
-		return nil, nil, fmt.Errorf("invalid 8-bit register code: %d", code)
+		return nil, false, fmt.Errorf("invalid 8-bit register code: %d", code)
 	}
 }
 
-func (c *CPU) calculateMemRegAddress(regCode byte, offset uint16) (uint16, uint16, error) {
-	var base uint16
-	var segment uint16
-
+// memRegAddress returns the base register and default segment register of
+// a [register+offset] operand
+func (c *CPU) memRegAddress(regCode byte) (base *uint16, segment *uint16, err error) {
 	switch regCode {
 	case 0:
-		base = c.AX
-		segment = c.DS // Default to DS
+		return &c.AX, &c.DS, nil // Default to DS
 	case 1:
-		base = c.BX
-		segment = c.DS
+		return &c.BX, &c.DS, nil
 	case 2:
-		base = c.CX
-		segment = c.DS
+		return &c.CX, &c.DS, nil
 	case 3:
-		base = c.DX
-		segment = c.DS
+		return &c.DX, &c.DS, nil
 	case 12:
-		base = c.SI
-		segment = c.DS
+		return &c.SI, &c.DS, nil
 	case 13:
-		base = c.DI
-		segment = c.ES // DI typically uses ES for string operations
+		return &c.DI, &c.DS, nil // ES is only the string instructions' destination
 	case 14:
-		base = c.BP
-		segment = c.SS // BP typically uses SS (stack frame access)
+		return &c.BP, &c.SS, nil // BP typically uses SS (stack frame access)
 	case 15:
-		base = c.SP
-		segment = c.SS // SP uses SS
+		return &c.SP, &c.SS, nil // SP uses SS
 	default:
-		return 0, 0, fmt.Errorf("invalid register code for memory addressing: %d", regCode)
+		return nil, nil, fmt.Errorf("invalid register code for memory addressing: %d", regCode)
 	}
-
-	return base + offset, segment, nil
 }
 
 func getOperandCount(opcode Opcode) int {
 	switch opcode {
 	case OpMOV, OpXCHG, OpADD, OpSUB:
 		return 2
-	case OpMUL, OpDIV, OpIMUL, OpIDIV:
+	case OpLEA, OpLDS, OpLES, OpJMPF, OpCALLF:
+		return 2
+	case OpADC, OpSBB, OpIMUL2:
+		return 2
+	case OpIMUL3:
+		return 3
+	case OpMUL, OpDIV, OpIMUL, OpIDIV, OpAAM, OpAAD:
 		return 1
+	case OpCBW, OpCWD, OpDAA, OpDAS, OpAAA, OpAAS:
+		return 0
 	case OpAND, OpOR, OpXOR, OpSHL, OpSHR, OpSAL, OpSAR, OpROL, OpROR:
 		return 2
+	case OpRCL, OpRCR:
+		return 2
 	case OpCMP, OpTEST:
 		return 2
 	case OpPUSH, OpPOP, OpINC, OpDEC, OpNEG, OpNOT:
@@ -249,74 +449,235 @@ func getOperandCount(opcode Opcode) int {
 		return 1
 	case OpJA, OpJAE, OpJB, OpJBE:
 		return 1
+	case OpJO, OpJNO, OpJS, OpJNS, OpJCXZ, OpJP, OpJNP:
+		return 1
 	case OpCALL, OpLOOP, OpLOOPZ, OpLOOPNZ:
 		return 1
 	case OpINT:
 		return 1
-	case OpRET, OpNOP, OpHLT:
+	case OpRET, OpRETF, OpIRET, OpINTO, OpNOP, OpHLT, OpXLAT:
+		return 0
+	case OpPUSHF, OpPOPF, OpLAHF, OpSAHF:
+		return 0
+	case OpCLC, OpSTC, OpCMC, OpCLD, OpSTD, OpCLI, OpSTI:
 		return 0
 	case OpOUT, OpIN:
 		return 2
+	case OpENTER, OpBOUND:
+		return 2
+	case OpPUSHA, OpPOPA, OpLEAVE, OpINSB, OpINSW, OpOUTSB, OpOUTSW:
+		return 0
+	case OpMOVZXB, OpMOVZXW, OpMOVSXB, OpMOVSXW, OpBT, OpBTS, OpBTR, OpBTC:
+		return 2
+	case OpBSF, OpBSR, OpSETcc:
+		return 2
+	case OpSHLD, OpSHRD:
+		return 3
+	case OpCWDE, OpCDQ:
+		return 0
 	default:
 		return 0
 	}
 }
 
-// Run executes the program until HLT or error
+// Run executes the program with the selected Engine until HLT or error. It
+// returns ErrStopped once Stop is called.
 func (c *CPU) Run() error {
 	for !c.Halted {
 		// Check if stop signal was received (non-blocking)
 		select {
 		case <-c.stopChan:
-			return fmt.Errorf("CPU stopped by external signal")
+			return ErrStopped
 		default:
 			// Continue execution
 		}
+		// Run a call queued by Schedule
+		if len(c.calls) != 0 {
+			(<-c.calls)()
+		}
 
-		if err := c.Step(); err != nil {
+		var err error
+		if c.Engine == EngineBlock {
+			_, err = c.stepBlock()
+		} else {
+			err = c.Step()
+		}
+		if err != nil {
 			return err
 		}
+		c.throttle()
 	}
 	return nil
 }
 
+// decodeNext decodes the next instruction with the decoder matching the
+// loaded program format, or takes it from the decode cache
+func (c *CPU) decodeNext() (Instruction, error) {
+	addr := CalculateLinearAddress(c.CS, c.IP)
+	cache := c.Memory.decoded
+	if cache != nil {
+		if cached := cache.lookup(addr, c); cached != nil {
+			inst := *cached
+			inst.resolve()
+			c.IP += uint16(inst.Size)
+			return inst, nil
+		}
+	}
+
+	ip := c.IP
+	var inst Instruction
+	var err error
+	if c.Native {
+		inst, err = c.Decode8086()
+	} else {
+		inst, err = c.Decode()
+	}
+	if err == nil && cache != nil {
+		cache.store(addr, c, inst, ip)
+	}
+	return inst, err
+}
+
 // Step executes a single instruction
 func (c *CPU) Step() error {
 	if c.Halted {
-		return fmt.Errorf("CPU is halted")
+		return ErrHalted
+	}
+	if done, err := c.beginStep(); done {
+		return err
 	}
+	return c.stepDecoded()
+}
 
-	inst, err := c.Decode()
+// beginStep does the work Step does before an instruction: hardware
+// interrupts are taken, a HLT waiting for one idles, and a BIOS service stub
+// reached by a far jump or call runs its service. It reports whether that
+// completed the step.
+func (c *CPU) beginStep() (bool, error) {
+	if c.Cycles >= c.frameEnd {
+		c.startFrames()
+	}
+	c.Steps++
+
+	// Hardware interrupts are taken between instructions while IF is set
+	c.updateTimer()
+	if c.Flags.IF {
+		if vector, ok := c.PIC.Acknowledge(); ok {
+			c.WaitingForInterrupt = false
+			c.Cycles += uint64(c.timing(OpINT).reg)
+			if err := c.Interrupt(vector); err != nil {
+				return true, err
+			}
+		}
+	}
+
+	// HLT resumes only after an interrupt has been taken
+	if c.WaitingForInterrupt {
+		c.idle()
+		return true, nil
+	}
+
+	// A far jump or call into a BIOS service stub (chaining to a saved
+	// vector) runs the service
+	if vector, ok := c.serviceStub(); ok {
+		c.InstructionCount++
+		c.Cycles += uint64(c.timing(OpIRET).reg)
+		return true, c.runService(vector)
+	}
+	return false, nil
+}
+
+// stepDecoded decodes and executes the instruction at CS:IP
+func (c *CPU) stepDecoded() error {
+	// An instruction that starts with TF set is followed by the single-step
+	// trap; faults return to its first byte
+	trap := c.Flags.TF
+	faultCS, faultIP := c.CS, c.IP
+
+	inst, err := c.decodeNext()
 	if err != nil {
+		var exception *Exception
+		if errors.As(err, &exception) {
+			return c.raise(exception, faultCS, faultIP)
+		}
 		return fmt.Errorf("decode error at IP=0x%04X: %v", c.IP-1, err)
 	}
+	return c.execInstruction(inst, (*CPU).Execute, c.instructionCycles(inst), trap, faultCS, faultIP)
+}
+
+// execInstruction runs a decoded instruction, whose IP has been advanced
+// past it, with exec. cycles is its cost with jumps taken. It repeats string
+// instructions with a REP prefix, counts the instruction and raises the
+// single-step trap when trap is set.
+func (c *CPU) execInstruction(inst Instruction, exec func(*CPU, Instruction) error, cycles uint64, trap bool, faultCS, faultIP uint16) error {
+	// Machine code may put REP before other instructions, as in the REP RET
+	// of some compilers, and the CPU ignores it there
+	if inst.HasREP && !isStringOp(inst.Opcode) {
+		if !c.Native {
+			return fmt.Errorf("REP prefix not valid for opcode 0x%02X", inst.Opcode)
+		}
+		inst.HasREP = false
+	}
 
 	// Handle REP prefix for string instructions
 	if inst.HasREP {
-		// REP repeats the string instruction CX times
-		switch inst.Opcode {
-		case OpMOVSB, OpMOVSW, OpSTOSB, OpSTOSW:
-			repCount := c.CX
-			for c.CX > 0 {
-				if err := c.Execute(inst); err != nil {
-					return fmt.Errorf("execution error at IP=0x%04X: %v", c.IP-uint16(inst.Size), err)
-				}
-				c.CX--
+		// REP repeats the string instruction CX times; CMPS and SCAS also
+		// stop once ZF is cleared (REPE) or set (REPNE)
+		compare := inst.Opcode == OpCMPSB || inst.Opcode == OpCMPSW ||
+			inst.Opcode == OpSCASB || inst.Opcode == OpSCASW
+		var repCount uint16
+		for c.CX > 0 {
+			if err := exec(c, inst); err != nil {
+				return c.executionError(err, faultCS, faultIP)
+			}
+			c.CX--
+			repCount++
+			if compare && c.Flags.ZF == inst.REPNE {
+				break
 			}
-			// Count REP iterations as separate instructions
-			c.InstructionCount += uint64(repCount)
-			return nil
-		default:
-			return fmt.Errorf("REP prefix not valid for opcode 0x%02X", inst.Opcode)
 		}
+		c.Cycles += c.repCycles(inst.Opcode, repCount)
+
+		// Count REP iterations as separate instructions
+		c.InstructionCount += uint64(repCount)
+		return c.singleStep(trap, inst)
 	}
 
-	if err := c.Execute(inst); err != nil {
-		return fmt.Errorf("execution error at IP=0x%04X: %v", c.IP-uint16(inst.Size), err)
+	// Jumps are costed as taken, unless execution falls through
+	next, cs := c.IP, c.CS
+
+	if err := exec(c, inst); err != nil {
+		return c.executionError(err, faultCS, faultIP)
 	}
 
+	if t := c.timing(inst.Opcode); t.notTaken != 0 && c.IP == next && c.CS == cs {
+		cycles = uint64(t.notTaken)
+	}
+	c.Cycles += cycles
+
 	// Increment instruction counter
 	c.InstructionCount++
 
-	return nil
+	return c.singleStep(trap, inst)
+}
+
+// executionError raises the exception of an instruction at cs:ip that
+// failed with one, and otherwise reports where execution failed: at cs:ip,
+// as a failed BIOS or DOS service has moved CS:IP to its stub
+func (c *CPU) executionError(err error, cs, ip uint16) error {
+	var exception *Exception
+	if errors.As(err, &exception) {
+		return c.raise(exception, cs, ip)
+	}
+	return fmt.Errorf("execution error at %04X:%04X: %w", cs, ip, err)
+}
+
+// singleStep raises the single-step trap after an instruction that started
+// with TF set. INT, and INTO that interrupts, clear TF for the handler and
+// are not trapped, and neither is a HLT that waits for an interrupt.
+func (c *CPU) singleStep(trap bool, inst Instruction) error {
+	if !trap || inst.Opcode == OpINT || inst.Opcode == OpINTO && c.Flags.OF || c.WaitingForInterrupt {
+		return nil
+	}
+	return c.raise(&Exception{Vector: VectorSingleStep}, c.CS, c.IP)
 }
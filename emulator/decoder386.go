@@ -0,0 +1,221 @@
+package emulator
+
+import "fmt"
+
+// Bit test operations selected by bits 3-4 of opcodes 0F A3/AB/B3/BB and by
+// the low two bits of the reg field of group 8 (0F BA)
+var bt386 = [4]Opcode{OpBT, OpBTS, OpBTR, OpBTC}
+
+// MOVZX and MOVSX from a byte or word for opcodes 0F B6, B7, BE and BF
+var movx386 = [4]Opcode{OpMOVZXB, OpMOVZXW, OpMOVSXB, OpMOVSXW}
+
+// decode0F decodes the 80386 two-byte opcodes that follow 0Fh
+func (d *decoder8086) decode0F(inst *Instruction) error {
+	if d.c.Model < Model386 {
+		return unsupported8086(0x0F)
+	}
+	op := d.fetch8()
+
+	switch {
+	case op >= 0x80 && op <= 0x8F: // Jcc rel16
+		inst.Opcode = jcc8086[op&0x0F]
+		inst.Dest = d.rel16()
+		return nil
+	case op >= 0x90 && op <= 0x9F: // SETcc r/m8
+		_, rm := d.modRM(true)
+		inst.Opcode = OpSETcc
+		inst.Dest = rm
+		inst.Src = Operand{Type: OpTypeImm8, Imm8: op & 0x0F}
+		return nil
+	}
+
+	switch op {
+	case 0xA0, 0xA8: // PUSH FS/GS
+		inst.Opcode = OpPUSH
+		inst.Dest = d.sreg(4 + (op>>3)&1)
+	case 0xA1, 0xA9: // POP FS/GS
+		inst.Opcode = OpPOP
+		inst.Dest = d.sreg(4 + (op>>3)&1)
+	case 0xA3, 0xAB, 0xB3, 0xBB: // BT/BTS/BTR/BTC r/m, reg
+		reg, rm := d.modRMW()
+		inst.Opcode = bt386[(op>>3)&3]
+		inst.Dest = rm
+		inst.Src = d.regW(reg)
+	case 0xA4, 0xA5, 0xAC, 0xAD: // SHLD/SHRD r/m, reg, imm8 or CL
+		reg, rm := d.modRMW()
+		inst.Opcode = OpSHLD
+		if op >= 0xAC {
+			inst.Opcode = OpSHRD
+		}
+		inst.Dest = rm
+		inst.Src = d.regW(reg)
+		if op&1 == 0 {
+			inst.Src2 = d.imm8()
+		} else {
+			inst.Src2 = d.reg8(1) // CL
+		}
+	case 0xAF: // IMUL reg, r/m
+		reg, rm := d.modRMW()
+		inst.Opcode = OpIMUL2
+		inst.Dest = d.regW(reg)
+		inst.Src = rm
+	case 0xB6, 0xB7, 0xBE, 0xBF: // MOVZX/MOVSX reg, r/m8 or r/m16
+		reg, rm := d.modRM(op&1 == 0)
+		inst.Opcode = movx386[(op>>2)&2|op&1]
+		inst.Dest = d.regW(reg)
+		inst.Src = rm
+	case 0xBA: // Group 8: BT/BTS/BTR/BTC r/m, imm8
+		reg, rm := d.modRMW()
+		if reg < 4 {
+			return unsupported386(op)
+		}
+		inst.Opcode = bt386[reg&3]
+		inst.Dest = rm
+		inst.Src = d.imm8()
+	case 0xBC, 0xBD: // BSF/BSR reg, r/m
+		reg, rm := d.modRMW()
+		inst.Opcode = OpBSF
+		if op == 0xBD {
+			inst.Opcode = OpBSR
+		}
+		inst.Dest = d.regW(reg)
+		inst.Src = rm
+	default:
+		return unsupported386(op)
+	}
+	return nil
+}
+
+func unsupported386(op byte) error {
+	return invalidOpcode("unsupported 80386 opcode 0x0F 0x%02X", op)
+}
+
+// checkPrefixes rejects an operand-size or address-size prefix on an opcode
+// that has no use for it, and a 32-bit address beyond the 64K limit of a
+// real-mode segment, which only LEA may compute
+func (d *decoder8086) checkPrefixes(op byte, inst *Instruction) error {
+	switch {
+	case d.opsize && !d.wide:
+		return fmt.Errorf("operand-size prefix not supported on opcode 0x%02X", op)
+	case !d.addrsize:
+		return nil
+	case !d.addrUsed:
+		return fmt.Errorf("address-size prefix not supported on opcode 0x%02X", op)
+	case inst.Opcode == OpLEA:
+		return nil
+	}
+	for _, operand := range [...]*Operand{&inst.Dest, &inst.Src} {
+		if operand.Addr32 && operand.MemAddr32 > 0xFFFF {
+			return fmt.Errorf("address %08Xh exceeds the 64K segment limit", operand.MemAddr32)
+		}
+	}
+	return nil
+}
+
+// useOpsize reports whether the operand-size prefix was seen, and records
+// that the opcode has a 32-bit form
+func (d *decoder8086) useOpsize() bool {
+	if d.opsize {
+		d.wide = true
+	}
+	return d.opsize
+}
+
+func (d *decoder8086) fetch32() uint32 {
+	low := d.fetch16()
+	return reg32(d.fetch16(), low)
+}
+
+// reg32 returns the 32-bit register with the given 8086 register number
+func (d *decoder8086) reg32(n byte) Operand {
+	d.wide = true
+	c := d.c
+	low := [8]*uint16{&c.AX, &c.CX, &c.DX, &c.BX, &c.SP, &c.BP, &c.SI, &c.DI}
+	high := [8]*uint16{&c.EAXHigh, &c.ECXHigh, &c.EDXHigh, &c.EBXHigh, &c.ESPHigh, &c.EBPHigh, &c.ESIHigh, &c.EDIHigh}
+	return Operand{Type: OpTypeReg32, Reg16: low[n&7], RegHigh: high[n&7]}
+}
+
+// regW returns a 16-bit register, or its 32-bit extension after the
+// operand-size prefix
+func (d *decoder8086) regW(n byte) Operand {
+	if d.opsize {
+		return d.reg32(n)
+	}
+	return d.reg16(n)
+}
+
+// accumulatorW returns AL, or AX or EAX as selected by the operand-size prefix
+func (d *decoder8086) accumulatorW(is8 bool) Operand {
+	if is8 {
+		return d.reg8(0)
+	}
+	return d.regW(0)
+}
+
+// immW reads a 16-bit immediate, or a 32-bit one after the operand-size prefix
+func (d *decoder8086) immW() Operand {
+	if d.opsize {
+		return d.imm32()
+	}
+	return d.imm16()
+}
+
+func (d *decoder8086) imm32() Operand {
+	d.wide = true
+	return Operand{Type: OpTypeImm32, Imm32: d.fetch32()}
+}
+
+// simm8W reads an 8-bit immediate sign-extended to the operand size
+func (d *decoder8086) simm8W() Operand {
+	if d.useOpsize() {
+		return Operand{Type: OpTypeImm32, Imm32: uint32(int8(d.fetch8()))}
+	}
+	return d.simm8()
+}
+
+// modRMW is modRM for a word operand, which the operand-size prefix widens
+// to a doubleword
+func (d *decoder8086) modRMW() (byte, Operand) {
+	return d.decodeModRM(false, d.opsize)
+}
+
+// address32 reads the rest of a ModR/M memory operand in the 32-bit
+// addressing form selected by the address-size prefix: any 32-bit register
+// as the base, an optional scaled index from a SIB byte and an 8-bit or
+// 32-bit displacement. Forms based on EBP or ESP default to SS.
+func (d *decoder8086) address32(mod, rm byte) (offset uint32, segment uint16) {
+	c := d.c
+	segment = c.DS
+	base := rm
+	if rm == 4 {
+		sib := d.fetch8()
+		scale, index := sib>>6, (sib>>3)&7
+		base = sib & 7
+		if index != 4 {
+			offset = d.value32(index) << scale
+		}
+	}
+
+	if mod == 0 && base == 5 {
+		offset += d.fetch32()
+	} else {
+		offset += d.value32(base)
+		if base == 4 || base == 5 {
+			segment = c.SS
+		}
+	}
+
+	switch mod {
+	case 1:
+		offset += uint32(int8(d.fetch8()))
+	case 2:
+		offset += d.fetch32()
+	}
+	return offset, segment
+}
+
+// value32 returns the contents of the 32-bit register with the given number
+func (d *decoder8086) value32(n byte) uint32 {
+	op := d.reg32(n)
+	return reg32(*op.RegHigh, *op.Reg16)
+}
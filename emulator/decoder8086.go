@@ -0,0 +1,734 @@
+package emulator
+
+// decoder8086 holds the per-instruction state of the 8086 machine code decoder
+type decoder8086 struct {
+	c           *CPU
+	segOverride bool    // True if a segment override prefix was seen
+	segment     *uint16 // Segment register selected by the override prefix
+	opsize      bool    // True if an 80386 operand-size prefix (66h) was seen
+	addrsize    bool    // True if an 80386 address-size prefix (67h) was seen
+	wide        bool    // True if the opcode has a 32-bit form for opsize
+	addrUsed    bool    // True if the opcode has an address for addrsize
+}
+
+// 8086 ALU operations selected by bits 3-5 of opcodes 00h-3Fh and by the
+// reg field of group 1 (80h-83h)
+var alu8086 = [8]Opcode{OpADD, OpOR, OpADC, OpSBB, OpAND, OpSUB, OpXOR, OpCMP}
+
+// Shift and rotate operations selected by the reg field of group 2 (D0h-D3h)
+var shift8086 = [8]Opcode{OpROL, OpROR, OpRCL, OpRCR, OpSHL, OpSHR, OpSHL, OpSAR}
+
+// Conditional jumps 70h-7Fh indexed by the low nibble of the opcode
+var jcc8086 = [16]Opcode{
+	OpJO, OpJNO, OpJB, OpJAE, OpJE, OpJNE, OpJBE, OpJA,
+	OpJS, OpJNS, OpJP, OpJNP, OpJL, OpJGE, OpJLE, OpJG,
+}
+
+// 8-bit register numbers in 8086 encoding order (AL CL DL BL AH CH DH BH)
+// translated to the bytecode register codes used by decodeRegister8
+var reg8Codes8086 = [8]byte{4, 8, 10, 6, 5, 9, 11, 7}
+
+// Decode8086 decodes the next genuine 8086 machine code instruction at CS:IP.
+// The result uses the same Instruction representation as the bytecode
+// decoder so that Execute runs both formats: relative branch targets are
+// resolved to absolute offsets and ModR/M memory operands to segment:offset.
+func (c *CPU) Decode8086() (Instruction, error) {
+	d := decoder8086{c: c}
+	startIP := c.IP
+	var inst Instruction
+
+	op := d.fetch8()
+	for d.prefix(op, &inst) {
+		op = d.fetch8()
+	}
+
+	if err := d.decodeOpcode(op, &inst); err != nil {
+		return inst, err
+	}
+	inst.resolve()
+	if d.opsize || d.addrsize {
+		if err := d.checkPrefixes(op, &inst); err != nil {
+			return inst, err
+		}
+	}
+	inst.Size = int(c.IP - startIP)
+	return inst, nil
+}
+
+// prefix consumes a segment override, LOCK or REP prefix byte, or on the
+// 80386 an FS or GS override or an operand-size or address-size prefix. It
+// returns false if the byte is an opcode.
+func (d *decoder8086) prefix(op byte, inst *Instruction) bool {
+	c := d.c
+	if op >= 0x64 && op <= 0x67 && c.Model < Model386 {
+		return false
+	}
+	switch op {
+	case 0x26:
+		d.setSegment(&c.ES)
+	case 0x2E:
+		d.setSegment(&c.CS)
+	case 0x36:
+		d.setSegment(&c.SS)
+	case 0x3E:
+		d.setSegment(&c.DS)
+	case 0x64:
+		d.setSegment(&c.FS)
+	case 0x65:
+		d.setSegment(&c.GS)
+	case 0x66:
+		d.opsize = true
+	case 0x67:
+		d.addrsize = true
+	case 0xF0: // LOCK has no effect on a single processor
+	case 0xF2, 0xF3:
+		inst.HasREP = true
+		inst.REPNE = op == 0xF2
+	default:
+		return false
+	}
+	return true
+}
+
+func (d *decoder8086) decodeOpcode(op byte, inst *Instruction) error {
+	switch {
+	case op < 0x40 && op&7 < 6:
+		// ALU r/m,reg / reg,r/m / accumulator,imm forms
+		inst.Opcode = alu8086[op>>3]
+		d.decodeALUForm(op&7, inst)
+		return nil
+
+	case op >= 0x40 && op <= 0x47:
+		inst.Opcode = OpINC
+		inst.Dest = d.regW(op & 7)
+		return nil
+
+	case op >= 0x48 && op <= 0x4F:
+		inst.Opcode = OpDEC
+		inst.Dest = d.regW(op & 7)
+		return nil
+
+	case op >= 0x50 && op <= 0x57:
+		inst.Opcode = OpPUSH
+		inst.Dest = d.regW(op & 7)
+		return nil
+
+	case op >= 0x58 && op <= 0x5F:
+		inst.Opcode = OpPOP
+		inst.Dest = d.regW(op & 7)
+		return nil
+
+	case op >= 0x70 && op <= 0x7F:
+		inst.Opcode = jcc8086[op&0x0F]
+		if inst.Opcode == 0 {
+			return unsupported8086(op)
+		}
+		inst.Dest = d.rel8()
+		return nil
+
+	case op >= 0x91 && op <= 0x97:
+		inst.Opcode = OpXCHG
+		inst.Dest = d.regW(0)
+		inst.Src = d.regW(op & 7)
+		return nil
+
+	case op >= 0xB0 && op <= 0xB7:
+		inst.Opcode = OpMOV
+		inst.Dest = d.reg8(op & 7)
+		inst.Src = d.imm8()
+		return nil
+
+	case op >= 0xB8 && op <= 0xBF:
+		inst.Opcode = OpMOV
+		inst.Dest = d.regW(op & 7)
+		inst.Src = d.immW()
+		return nil
+	}
+
+	switch op {
+	case 0x06, 0x0E, 0x16, 0x1E: // PUSH ES/CS/SS/DS
+		inst.Opcode = OpPUSH
+		inst.Dest = d.sreg(op >> 3)
+	case 0x07, 0x17, 0x1F: // POP ES/SS/DS
+		inst.Opcode = OpPOP
+		inst.Dest = d.sreg(op >> 3)
+	case 0x0F: // 80386 two-byte opcodes
+		return d.decode0F(inst)
+	case 0x27:
+		inst.Opcode = OpDAA
+	case 0x2F:
+		inst.Opcode = OpDAS
+	case 0x37:
+		inst.Opcode = OpAAA
+	case 0x3F:
+		inst.Opcode = OpAAS
+
+	case 0x60:
+		inst.Opcode = OpPUSHA
+	case 0x61:
+		inst.Opcode = OpPOPA
+	case 0x62: // BOUND r16, m16&16
+		reg, rm := d.modRM(false)
+		if !rm.isMemory() {
+			return invalidOpcode("BOUND requires a memory operand")
+		}
+		inst.Opcode = OpBOUND
+		inst.Dest = d.reg16(reg)
+		inst.Src = rm
+	case 0x68: // PUSH imm16
+		inst.Opcode = OpPUSH
+		inst.Dest = d.immW()
+	case 0x69, 0x6B: // IMUL r16, r/m16, imm16 / sign-extended imm8
+		reg, rm := d.modRMW()
+		inst.Opcode = OpIMUL3
+		inst.Dest = d.regW(reg)
+		inst.Src = rm
+		if op == 0x69 {
+			inst.Src2 = d.immW()
+		} else {
+			inst.Src2 = d.simm8W()
+		}
+	case 0x6A: // PUSH sign-extended imm8
+		inst.Opcode = OpPUSH
+		inst.Dest = d.simm8W()
+	case 0x6C:
+		inst.Opcode = OpINSB
+	case 0x6D:
+		inst.Opcode = OpINSW
+	case 0x6E:
+		inst.Opcode = OpOUTSB
+		inst.Src = d.override()
+	case 0x6F:
+		inst.Opcode = OpOUTSW
+		inst.Src = d.override()
+
+	case 0x80, 0x81, 0x82, 0x83: // Group 1: ALU r/m, imm
+		reg, rm := d.modRMSized(op&1 == 0)
+		inst.Opcode = alu8086[reg]
+		inst.Dest = rm
+		switch op {
+		case 0x81:
+			inst.Src = d.immW()
+		case 0x83:
+			inst.Src = d.simm8W()
+		default:
+			inst.Src = d.imm8()
+		}
+
+	case 0x84, 0x85: // TEST r/m, reg
+		inst.Opcode = OpTEST
+		d.decodeALUForm(op&1, inst)
+	case 0x86, 0x87: // XCHG r/m, reg
+		inst.Opcode = OpXCHG
+		d.decodeALUForm(op&1, inst)
+	case 0x88, 0x89, 0x8A, 0x8B: // MOV r/m,reg / reg,r/m
+		inst.Opcode = OpMOV
+		d.decodeALUForm(op&3, inst)
+	case 0x8C: // MOV r/m16, sreg
+		reg, rm := d.modRM(false)
+		inst.Opcode = OpMOV
+		inst.Dest = rm
+		inst.Src = d.sreg(reg)
+	case 0x8D: // LEA r16, m
+		reg, rm := d.modRM(false)
+		inst.Opcode = OpLEA
+		inst.Dest = d.regW(reg)
+		inst.Src = rm
+	case 0x8E: // MOV sreg, r/m16
+		reg, rm := d.modRM(false)
+		inst.Opcode = OpMOV
+		inst.Dest = d.sreg(reg)
+		inst.Src = rm
+	case 0x8F: // POP r/m16
+		_, rm := d.modRMW()
+		inst.Opcode = OpPOP
+		inst.Dest = rm
+
+	case 0x90:
+		inst.Opcode = OpNOP
+	case 0x98:
+		inst.Opcode = OpCBW
+		if d.useOpsize() {
+			inst.Opcode = OpCWDE
+		}
+	case 0x99:
+		inst.Opcode = OpCWD
+		if d.useOpsize() {
+			inst.Opcode = OpCDQ
+		}
+	case 0x9A: // CALL far ptr16:16
+		inst.Opcode = OpCALLF
+		inst.Dest = d.imm16()
+		inst.Src = d.imm16()
+	case 0x9B: // WAIT
+		inst.Opcode = OpFPU
+		inst.FPU = OpFWAIT
+	case 0x9C:
+		inst.Opcode = OpPUSHF
+	case 0x9D:
+		inst.Opcode = OpPOPF
+	case 0x9E:
+		inst.Opcode = OpSAHF
+	case 0x9F:
+		inst.Opcode = OpLAHF
+
+	case 0xA0, 0xA1: // MOV AL/AX, [moffs]
+		inst.Opcode = OpMOV
+		inst.Dest = d.accumulatorW(op&1 == 0)
+		inst.Src = d.direct(op&1 == 0)
+	case 0xA2, 0xA3: // MOV [moffs], AL/AX
+		inst.Opcode = OpMOV
+		inst.Dest = d.direct(op&1 == 0)
+		inst.Src = d.accumulatorW(op&1 == 0)
+	case 0xA4:
+		inst.Opcode = OpMOVSB
+		inst.Src = d.override()
+	case 0xA5:
+		inst.Opcode = OpMOVSW
+		inst.Src = d.override()
+	case 0xA6:
+		inst.Opcode = OpCMPSB
+		inst.Src = d.override()
+	case 0xA7:
+		inst.Opcode = OpCMPSW
+		inst.Src = d.override()
+	case 0xA8: // TEST AL, imm8
+		inst.Opcode = OpTEST
+		inst.Dest = d.reg8(0)
+		inst.Src = d.imm8()
+	case 0xA9: // TEST AX, imm16
+		inst.Opcode = OpTEST
+		inst.Dest = d.regW(0)
+		inst.Src = d.immW()
+	case 0xAA:
+		inst.Opcode = OpSTOSB
+	case 0xAB:
+		inst.Opcode = OpSTOSW
+	case 0xAC:
+		inst.Opcode = OpLODSB
+		inst.Src = d.override()
+	case 0xAD:
+		inst.Opcode = OpLODSW
+		inst.Src = d.override()
+	case 0xAE:
+		inst.Opcode = OpSCASB
+	case 0xAF:
+		inst.Opcode = OpSCASW
+
+	case 0xC0, 0xC1: // Group 2 by imm8
+		reg, rm := d.modRMSized(op == 0xC0)
+		inst.Opcode = shift8086[reg]
+		inst.Dest = rm
+		inst.Src = d.imm8()
+	case 0xC2: // RET imm16
+		inst.Opcode = OpRET
+		inst.Dest = d.imm16()
+	case 0xC3:
+		inst.Opcode = OpRET
+	case 0xC4, 0xC5: // LES/LDS r16, m32
+		reg, rm := d.modRM(false)
+		inst.Opcode = OpLES
+		if op == 0xC5 {
+			inst.Opcode = OpLDS
+		}
+		inst.Dest = d.reg16(reg)
+		inst.Src = rm
+	case 0xC6, 0xC7: // MOV r/m, imm
+		_, rm := d.modRMSized(op == 0xC6)
+		inst.Opcode = OpMOV
+		inst.Dest = rm
+		if op == 0xC6 {
+			inst.Src = d.imm8()
+		} else {
+			inst.Src = d.immW()
+		}
+	case 0xC8: // ENTER imm16, imm8
+		inst.Opcode = OpENTER
+		inst.Dest = d.imm16()
+		inst.Src = d.imm8()
+	case 0xC9:
+		inst.Opcode = OpLEAVE
+	case 0xCA: // RETF imm16
+		inst.Opcode = OpRETF
+		inst.Dest = d.imm16()
+	case 0xCB:
+		inst.Opcode = OpRETF
+	case 0xCC: // INT 3
+		inst.Opcode = OpINT
+		inst.Dest = Operand{Type: OpTypeImm8, Imm8: 3}
+	case 0xCD: // INT imm8
+		inst.Opcode = OpINT
+		inst.Dest = d.imm8()
+	case 0xCE: // INTO (not the bytecode's OpCDQ, which is also CEh)
+		inst.Opcode = OpINTO
+	case 0xCF:
+		inst.Opcode = OpIRET
+
+	case 0xD0, 0xD1, 0xD2, 0xD3: // Group 2: shifts and rotates
+		reg, rm := d.modRMSized(op&1 == 0)
+		inst.Opcode = shift8086[reg]
+		inst.Dest = rm
+		if op >= 0xD2 {
+			inst.Src = d.reg8(1) // CL
+		} else {
+			inst.Src = Operand{Type: OpTypeImm8, Imm8: 1}
+		}
+	case 0xD4: // AAM imm8
+		inst.Opcode = OpAAM
+		inst.Dest = d.imm8()
+	case 0xD5: // AAD imm8
+		inst.Opcode = OpAAD
+		inst.Dest = d.imm8()
+	case 0xD7:
+		inst.Opcode = OpXLAT
+		inst.Dest = d.override()
+	case 0xD8, 0xD9, 0xDA, 0xDB, 0xDC, 0xDD, 0xDE, 0xDF: // x87 escapes
+		return d.decodeFPU(op, inst)
+
+	case 0xE0:
+		inst.Opcode = OpLOOPNZ
+		inst.Dest = d.rel8()
+	case 0xE1:
+		inst.Opcode = OpLOOPZ
+		inst.Dest = d.rel8()
+	case 0xE2:
+		inst.Opcode = OpLOOP
+		inst.Dest = d.rel8()
+	case 0xE3:
+		inst.Opcode = OpJCXZ
+		inst.Dest = d.rel8()
+	case 0xE4, 0xE5: // IN AL/AX, imm8
+		inst.Opcode = OpIN
+		inst.Dest = d.accumulator(op == 0xE4)
+		inst.Src = d.imm8()
+	case 0xE6, 0xE7: // OUT imm8, AL/AX
+		inst.Opcode = OpOUT
+		inst.Dest = d.imm8()
+		inst.Src = d.accumulator(op == 0xE6)
+	case 0xE8: // CALL rel16
+		inst.Opcode = OpCALL
+		inst.Dest = d.rel16()
+	case 0xE9: // JMP rel16
+		inst.Opcode = OpJMP
+		inst.Dest = d.rel16()
+	case 0xEA: // JMP far ptr16:16
+		inst.Opcode = OpJMPF
+		inst.Dest = d.imm16()
+		inst.Src = d.imm16()
+	case 0xEB: // JMP rel8
+		inst.Opcode = OpJMP
+		inst.Dest = d.rel8()
+	case 0xEC, 0xED: // IN AL/AX, DX
+		inst.Opcode = OpIN
+		inst.Dest = d.accumulator(op == 0xEC)
+		inst.Src = d.reg16(2)
+	case 0xEE, 0xEF: // OUT DX, AL/AX
+		inst.Opcode = OpOUT
+		inst.Dest = d.reg16(2)
+		inst.Src = d.accumulator(op == 0xEE)
+
+	case 0xF4:
+		inst.Opcode = OpHLT
+	case 0xF5:
+		inst.Opcode = OpCMC
+	case 0xF6, 0xF7: // Group 3
+		reg, rm := d.modRMSized(op == 0xF6)
+		inst.Dest = rm
+		switch reg {
+		case 0, 1:
+			inst.Opcode = OpTEST
+			if op == 0xF6 {
+				inst.Src = d.imm8()
+			} else {
+				inst.Src = d.immW()
+			}
+		case 2:
+			inst.Opcode = OpNOT
+		case 3:
+			inst.Opcode = OpNEG
+		case 4:
+			inst.Opcode = OpMUL
+		case 5:
+			inst.Opcode = OpIMUL
+		case 6:
+			inst.Opcode = OpDIV
+		case 7:
+			inst.Opcode = OpIDIV
+		}
+	case 0xF8:
+		inst.Opcode = OpCLC
+	case 0xF9:
+		inst.Opcode = OpSTC
+	case 0xFA:
+		inst.Opcode = OpCLI
+	case 0xFB:
+		inst.Opcode = OpSTI
+	case 0xFC:
+		inst.Opcode = OpCLD
+	case 0xFD:
+		inst.Opcode = OpSTD
+	case 0xFE: // Group 4: INC/DEC r/m8
+		reg, rm := d.modRM(true)
+		inst.Dest = rm
+		switch reg {
+		case 0:
+			inst.Opcode = OpINC
+		case 1:
+			inst.Opcode = OpDEC
+		default:
+			return unsupported8086(op)
+		}
+	case 0xFF: // Group 5
+		reg, rm := d.modRMW()
+		inst.Dest = rm
+		switch reg {
+		case 0:
+			inst.Opcode = OpINC
+		case 1:
+			inst.Opcode = OpDEC
+		case 2:
+			inst.Opcode = OpCALL
+		case 3:
+			inst.Opcode = OpCALLF
+		case 4:
+			inst.Opcode = OpJMP
+		case 5:
+			inst.Opcode = OpJMPF
+		case 6:
+			inst.Opcode = OpPUSH
+		default:
+			return unsupported8086(op)
+		}
+		if (reg == 3 || reg == 5) && !rm.isMemory() {
+			return invalidOpcode("far CALL/JMP requires a memory operand")
+		}
+
+	default:
+		return unsupported8086(op)
+	}
+
+	return nil
+}
+
+func unsupported8086(op byte) error {
+	return invalidOpcode("unsupported 8086 opcode 0x%02X", op)
+}
+
+// decodeALUForm decodes the common operand forms selected by the low opcode
+// bits: 0 r/m8,r8  1 r/m16,r16  2 r8,r/m8  3 r16,r/m16  4 AL,imm8  5 AX,imm16.
+// The operand-size prefix widens the word forms to doublewords.
+func (d *decoder8086) decodeALUForm(form byte, inst *Instruction) {
+	switch form {
+	case 0, 1, 2, 3:
+		is8 := form&1 == 0
+		reg, rm := d.modRMSized(is8)
+		var regOp Operand
+		if is8 {
+			regOp = d.reg8(reg)
+		} else {
+			regOp = d.regW(reg)
+		}
+		if form < 2 {
+			inst.Dest, inst.Src = rm, regOp
+		} else {
+			inst.Dest, inst.Src = regOp, rm
+		}
+	case 4:
+		inst.Dest = d.reg8(0)
+		inst.Src = d.imm8()
+	case 5:
+		inst.Dest = d.regW(0)
+		inst.Src = d.immW()
+	}
+}
+
+func (d *decoder8086) setSegment(seg *uint16) {
+	d.segOverride = true
+	d.segment = seg
+}
+
+func (d *decoder8086) fetch8() byte {
+	addr := CalculateLinearAddress(d.c.CS, d.c.IP)
+	d.c.IP++
+	return d.c.Memory.ReadByteLinear(addr)
+}
+
+func (d *decoder8086) fetch16() uint16 {
+	low := d.fetch8()
+	return uint16(low) | uint16(d.fetch8())<<8
+}
+
+func (d *decoder8086) imm8() Operand {
+	return Operand{Type: OpTypeImm8, Imm8: d.fetch8()}
+}
+
+func (d *decoder8086) imm16() Operand {
+	return Operand{Type: OpTypeImm16, Imm16: d.fetch16()}
+}
+
+// simm8 reads an 8-bit immediate sign-extended to 16 bits
+func (d *decoder8086) simm8() Operand {
+	return Operand{Type: OpTypeImm16, Imm16: uint16(int8(d.fetch8()))}
+}
+
+// rel8 reads a signed 8-bit displacement and returns the absolute target
+func (d *decoder8086) rel8() Operand {
+	rel := int8(d.fetch8())
+	return Operand{Type: OpTypeImm16, Imm16: d.c.IP + uint16(rel)}
+}
+
+// rel16 reads a 16-bit displacement and returns the absolute target
+func (d *decoder8086) rel16() Operand {
+	rel := d.fetch16()
+	return Operand{Type: OpTypeImm16, Imm16: d.c.IP + rel}
+}
+
+func (d *decoder8086) reg8(n byte) Operand {
+	reg, high, _ := d.c.decodeRegister8(reg8Codes8086[n&7])
+	return Operand{Type: OpTypeReg8, Reg8: reg, Reg8High: high}
+}
+
+func (d *decoder8086) reg16(n byte) Operand {
+	c := d.c
+	regs := [8]*uint16{&c.AX, &c.CX, &c.DX, &c.BX, &c.SP, &c.BP, &c.SI, &c.DI}
+	return Operand{Type: OpTypeReg16, Reg16: regs[n&7]}
+}
+
+// sreg returns the segment register with the given number. Numbers 4 and 5
+// are FS and GS on the 80386; otherwise only the low two bits count.
+func (d *decoder8086) sreg(n byte) Operand {
+	c := d.c
+	regs := [6]*uint16{&c.ES, &c.CS, &c.SS, &c.DS, &c.FS, &c.GS}
+	n &= 7
+	if c.Model < Model386 || n > 5 {
+		n &= 3
+	}
+	return Operand{Type: OpTypeReg16, Reg16: regs[n]}
+}
+
+func (d *decoder8086) accumulator(is8 bool) Operand {
+	if is8 {
+		return d.reg8(0)
+	}
+	return d.reg16(0)
+}
+
+// direct reads a 16-bit offset, or a 32-bit one after the address-size
+// prefix, for the moffs forms of MOV
+func (d *decoder8086) direct(is8 bool) Operand {
+	op := Operand{Type: OpTypeMem, Seg: &d.c.DS, Byte: is8, Dword: d.opsize && !is8}
+	if d.addrsize {
+		d.addrUsed = true
+		op.MemAddr32 = d.fetch32()
+		op.MemAddr = uint16(op.MemAddr32)
+		op.MemSegment = d.c.DS
+		op.Addr32 = true
+	} else {
+		op.Disp = d.fetch16()
+	}
+	d.applyOverride(&op)
+	return op
+}
+
+// override returns an operand carrying the segment override prefix, if any,
+// for instructions with an implicit memory source such as XLAT and MOVS
+func (d *decoder8086) override() Operand {
+	return Operand{Seg: d.segment, SegOverride: d.segOverride}
+}
+
+func (d *decoder8086) applyOverride(op *Operand) {
+	if d.segOverride {
+		op.Seg = d.segment
+		op.SegOverride = true
+		if op.Addr32 {
+			op.MemSegment = *d.segment
+		}
+	}
+}
+
+// modRM reads a ModR/M byte and any displacement. It returns the reg field
+// and the operand selected by mod and r/m, sized by is8.
+func (d *decoder8086) modRM(is8 bool) (byte, Operand) {
+	return d.decodeModRM(is8, false)
+}
+
+// modRMSized is modRM for an instruction with byte and word forms, whose
+// word form the operand-size prefix widens to a doubleword
+func (d *decoder8086) modRMSized(is8 bool) (byte, Operand) {
+	return d.decodeModRM(is8, !is8 && d.opsize)
+}
+
+func (d *decoder8086) decodeModRM(is8, is32 bool) (byte, Operand) {
+	if is32 {
+		d.wide = true
+	}
+	modrm := d.fetch8()
+	mod := modrm >> 6
+	reg := (modrm >> 3) & 7
+	rm := modrm & 7
+	d.addrUsed = true
+
+	if mod == 3 {
+		switch {
+		case is8:
+			return reg, d.reg8(rm)
+		case is32:
+			return reg, d.reg32(rm)
+		}
+		return reg, d.reg16(rm)
+	}
+
+	if d.addrsize {
+		offset, seg := d.address32(mod, rm)
+		op := Operand{Type: OpTypeMemReg, MemAddr: uint16(offset), MemSegment: seg, Byte: is8, Dword: is32,
+			Addr32: true, MemAddr32: offset}
+		d.applyOverride(&op)
+		return reg, op
+	}
+
+	var disp uint16
+	switch {
+	case mod == 0 && rm == 6:
+		// Direct address [disp16]
+		op := Operand{Type: OpTypeMem, Disp: d.fetch16(), Seg: &d.c.DS, Byte: is8, Dword: is32}
+		d.applyOverride(&op)
+		return reg, op
+	case mod == 1:
+		disp = uint16(int8(d.fetch8()))
+	case mod == 2:
+		disp = d.fetch16()
+	}
+
+	opType := OpTypeMemReg
+	if rm < 4 {
+		opType = OpTypeMemIndexed
+	}
+	op := Operand{Type: opType, Disp: disp, Byte: is8, Dword: is32}
+	op.Base, op.Index, op.Seg = d.c.address8086(rm)
+	d.applyOverride(&op)
+	return reg, op
+}
+
+// address8086 returns the base and index registers and the default segment
+// register of one of the eight 8086 base/index combinations selected by the
+// r/m field. BP-based forms default to SS, all others to DS.
+func (c *CPU) address8086(rm byte) (base, index, segment *uint16) {
+	switch rm & 7 {
+	case 0:
+		return &c.BX, &c.SI, &c.DS
+	case 1:
+		return &c.BX, &c.DI, &c.DS
+	case 2:
+		return &c.BP, &c.SI, &c.SS
+	case 3:
+		return &c.BP, &c.DI, &c.SS
+	case 4:
+		return &c.SI, nil, &c.DS
+	case 5:
+		return &c.DI, nil, &c.DS
+	case 6:
+		return &c.BP, nil, &c.SS
+	default:
+		return &c.BX, nil, &c.DS
+	}
+}
@@ -0,0 +1,582 @@
+package emulator
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+)
+
+// runCOM loads a .COM image and runs it until it halts or waits in HLT
+func runCOM(t *testing.T, image []byte) *CPU {
+	t.Helper()
+	cpu := NewCPU()
+	if err := cpu.LoadCOM(image); err != nil {
+		t.Fatalf("LoadCOM failed: %v", err)
+	}
+	runUntilIdle(t, cpu)
+	return cpu
+}
+
+// runUntilIdle steps the CPU until it halts or waits for an interrupt in HLT
+func runUntilIdle(t *testing.T, cpu *CPU) {
+	t.Helper()
+	for !cpu.Halted && !cpu.WaitingForInterrupt {
+		if err := cpu.Step(); err != nil {
+			t.Fatalf("CPU.Step() failed: %v", err)
+		}
+	}
+}
+
+// TestLoadCOMLayout tests the PSP and register setup of the .COM loader
+func TestLoadCOMLayout(t *testing.T) {
+	cpu := NewCPU()
+	if err := cpu.LoadCOM([]byte{0xC3}); err != nil {
+		t.Fatalf("LoadCOM failed: %v", err)
+	}
+
+	if cpu.CS != COMLoadSegment || cpu.DS != COMLoadSegment || cpu.ES != COMLoadSegment || cpu.SS != COMLoadSegment {
+		t.Errorf("Expected CS=DS=ES=SS=%04X, got CS=%04X DS=%04X ES=%04X SS=%04X",
+			COMLoadSegment, cpu.CS, cpu.DS, cpu.ES, cpu.SS)
+	}
+	if cpu.IP != 0x0100 || cpu.SP != 0xFFFE {
+		t.Errorf("Expected IP=0100 SP=FFFE, got IP=%04X SP=%04X", cpu.IP, cpu.SP)
+	}
+
+	psp := CalculateLinearAddress(COMLoadSegment, 0)
+	if cpu.Memory.ReadWordLinear(psp) != 0x20CD {
+		t.Errorf("Expected INT 20h at PSP:0000, got %04X", cpu.Memory.ReadWordLinear(psp))
+	}
+	if cpu.Memory.ReadByteLinear(psp+0x100) != 0xC3 {
+		t.Error("Image was not loaded at PSP:0100")
+	}
+
+	if err := cpu.LoadCOM(make([]byte, COMMaxSize+1)); err == nil {
+		t.Error("Expected error for oversized image")
+	}
+	image := bytes.Repeat([]byte{0x90}, COMMaxSize)
+	if err := cpu.LoadCOM(image); err != nil {
+		t.Fatalf("LoadCOM failed for a %d-byte image: %v", COMMaxSize, err)
+	}
+	if got := cpu.Memory.ReadWordLinear(psp + COMInitialSP - 2); got != 0x9090 {
+		t.Errorf("Expected the stack to leave the image's last bytes, got %04X", got)
+	}
+}
+
+// TestCOMReturnTerminates tests that RET from the entry point exits via INT 20h
+func TestCOMReturnTerminates(t *testing.T) {
+	cpu := runCOM(t, []byte{
+		0xB8, 0x34, 0x12, // MOV AX, 1234h
+		0xC3, // RET
+	})
+
+	if cpu.AX != 0x1234 {
+		t.Errorf("Expected AX=1234, got %04X", cpu.AX)
+	}
+	if cpu.IP != 0x0002 {
+		t.Errorf("Expected to halt after INT 20h at PSP:0000, IP=%04X", cpu.IP)
+	}
+}
+
+// TestDecode8086Arithmetic tests 8086 ALU encodings and byte-sized flags
+func TestDecode8086Arithmetic(t *testing.T) {
+	cpu := runCOM(t, []byte{
+		0xB3, 0x34, // MOV BL, 34h
+		0x80, 0xC3, 0xF0, // ADD BL, F0h
+		0xB8, 0x10, 0x00, // MOV AX, 10h
+		0x83, 0xE8, 0x01, // SUB AX, 1
+		0x83, 0xC0, 0xFF, // ADD AX, -1 (sign-extended imm8)
+		0x01, 0xC1, // ADD CX, AX
+		0xF4, // HLT
+	})
+
+	if cpu.GetBL() != 0x24 {
+		t.Errorf("Expected BL=24h, got %02X", cpu.GetBL())
+	}
+	if cpu.AX != 0x000E || cpu.CX != 0x000E {
+		t.Errorf("Expected AX=CX=000Eh, got AX=%04X CX=%04X", cpu.AX, cpu.CX)
+	}
+}
+
+// TestDecode8086Memory tests ModR/M addressing, displacements and overrides
+func TestDecode8086Memory(t *testing.T) {
+	cpu := runCOM(t, []byte{
+		0xBB, 0x00, 0x02, // MOV BX, 0200h
+		0xBE, 0x04, 0x00, // MOV SI, 4
+		0xC6, 0x40, 0x02, 0xAB, // MOV BYTE [BX+SI+2], ABh
+		0x8A, 0x50, 0x02, // MOV DL, [BX+SI+2]
+		0xC7, 0x06, 0x10, 0x02, 0xCD, 0xAB, // MOV WORD [0210h], ABCDh
+		0xB8, 0x00, 0x20, // MOV AX, 2000h
+		0x8E, 0xC0, // MOV ES, AX
+		0x26, 0x89, 0x1E, 0x00, 0x00, // MOV ES:[0000h], BX
+		0x8D, 0x78, 0xFE, // LEA DI, [BX+SI-2]
+		0xF4, // HLT
+	})
+
+	base := CalculateLinearAddress(COMLoadSegment, 0)
+	if cpu.Memory.ReadByteLinear(base+0x206) != 0xAB || cpu.Memory.ReadByteLinear(base+0x207) != 0 {
+		t.Errorf("Expected single byte ABh at DS:0206")
+	}
+	if cpu.GetDL() != 0xAB {
+		t.Errorf("Expected DL=ABh, got %02X", cpu.GetDL())
+	}
+	if cpu.Memory.ReadWordLinear(base+0x210) != 0xABCD {
+		t.Errorf("Expected ABCDh at DS:0210, got %04X", cpu.Memory.ReadWordLinear(base+0x210))
+	}
+	if cpu.Memory.ReadWordLinear(0x20000) != 0x0200 {
+		t.Errorf("Expected ES override write at 2000:0000, got %04X", cpu.Memory.ReadWordLinear(0x20000))
+	}
+	if cpu.DI != 0x0202 {
+		t.Errorf("Expected DI=0202h from LEA, got %04X", cpu.DI)
+	}
+}
+
+// TestDecode8086Control tests relative jumps, loops, calls and conditional branches
+func TestDecode8086Control(t *testing.T) {
+	cpu := runCOM(t, []byte{
+		0xB9, 0x05, 0x00, // 0100: MOV CX, 5
+		0x31, 0xC0, // 0103: XOR AX, AX
+		0x05, 0x02, 0x00, // 0105: ADD AX, 2
+		0xE2, 0xFB, // 0108: LOOP 0105
+		0xE8, 0x05, 0x00, // 010A: CALL 0112
+		0x3D, 0x0B, 0x00, // 010D: CMP AX, 11
+		0x74, 0x03, // 0110: JE 0115 (skips the next instruction when taken)
+		0x40,             // 0112: INC AX
+		0xC3,             // 0113: RET
+		0xF4,             // 0114: HLT
+		0xBA, 0x01, 0x00, // 0115: MOV DX, 1
+		0xF4, // 0118: HLT
+	})
+
+	if cpu.AX != 11 {
+		t.Errorf("Expected AX=11, got %d", cpu.AX)
+	}
+	if cpu.DX != 1 {
+		t.Error("Expected JE to be taken")
+	}
+	if cpu.CX != 0 {
+		t.Errorf("Expected CX=0 after LOOP, got %d", cpu.CX)
+	}
+}
+
+// TestDecode8086INTO tests that INTO (CEh, which is CDQ in the bytecode)
+// calls INT 4 only when OF is set
+func TestDecode8086INTO(t *testing.T) {
+	image := make([]byte, 0x22)
+	copy(image, []byte{
+		0xB8, 0x04, 0x25, // 0100: MOV AX, 2504h (set vector 4)
+		0xBA, 0x20, 0x01, // 0103: MOV DX, 0120h
+		0xCD, 0x21, // 0106: INT 21h
+		0xCE,       // 0108: INTO (OF clear)
+		0xB0, 0x7F, // 0109: MOV AL, 7Fh
+		0x04, 0x01, // 010B: ADD AL, 1 (sets OF)
+		0xCE, // 010D: INTO
+		0xF4, // 010E: HLT
+	})
+	copy(image[0x20:], []byte{
+		0x43, // 0120: INC BX
+		0xCF, // 0121: IRET
+	})
+	cpu := runCOM(t, image)
+	if cpu.BX != 1 || cpu.IP != 0x010F {
+		t.Errorf("Expected one INT 4 and the HLT reached, got BX=%d at IP=%04X", cpu.BX, cpu.IP)
+	}
+}
+
+// TestDecode8086StringOps tests REP MOVSB with the 8086 encoding
+func TestDecode8086StringOps(t *testing.T) {
+	cpu := runCOM(t, []byte{
+		0xBE, 0x20, 0x01, // MOV SI, 0120h
+		0xBF, 0x00, 0x03, // MOV DI, 0300h
+		0xB9, 0x04, 0x00, // MOV CX, 4
+		0xF3, 0xA4, // REP MOVSB
+		0xF4, // HLT
+	})
+
+	base := CalculateLinearAddress(COMLoadSegment, 0)
+	for i := uint32(0); i < 4; i++ {
+		want := cpu.Memory.ReadByteLinear(base + 0x120 + i)
+		if got := cpu.Memory.ReadByteLinear(base + 0x300 + i); got != want {
+			t.Errorf("Byte %d: expected %02X, got %02X", i, want, got)
+		}
+	}
+	if cpu.SI != 0x124 || cpu.DI != 0x304 || cpu.CX != 0 {
+		t.Errorf("Unexpected SI=%04X DI=%04X CX=%04X", cpu.SI, cpu.DI, cpu.CX)
+	}
+}
+
+// TestDecode8086RepIgnored tests that REP before an instruction that is not
+// a string instruction is ignored, as in REP RET
+func TestDecode8086RepIgnored(t *testing.T) {
+	cpu := runCOM(t, []byte{
+		0xB9, 0x03, 0x00, // 0100: MOV CX, 3
+		0xE8, 0x02, 0x00, // 0103: CALL 0108
+		0xF4,       // 0106: HLT
+		0x90,       // 0107: NOP
+		0xF3, 0x40, // 0108: REP INC AX
+		0xF3, 0xC3, // 010A: REP RET
+	})
+	if cpu.AX != 1 || cpu.CX != 3 || cpu.IP != 0x0107 {
+		t.Errorf("Expected AX=1 and CX=3 after returning to the HLT, got AX=%d CX=%d IP=%04X", cpu.AX, cpu.CX, cpu.IP)
+	}
+}
+
+// TestDecode8086StringCompare tests REPE CMPSB, REPNE SCASB and a segment
+// override on the source of LODSB
+func TestDecode8086StringCompare(t *testing.T) {
+	image := []byte{
+		0xBE, 0x30, 0x01, // 0100: MOV SI, 0130h
+		0xBF, 0x34, 0x01, // 0103: MOV DI, 0134h
+		0xB9, 0x04, 0x00, // 0106: MOV CX, 4
+		0xF3, 0xA6, // 0109: REPE CMPSB
+		0x89, 0xCA, // 010B: MOV DX, CX
+		0xBF, 0x34, 0x01, // 010D: MOV DI, 0134h
+		0xB9, 0x04, 0x00, // 0110: MOV CX, 4
+		0xB0, 'D', // 0113: MOV AL, 'D'
+		0xF2, 0xAE, // 0115: REPNE SCASB
+		0x89, 0xCB, // 0117: MOV BX, CX
+		0xBE, 0x30, 0x01, // 0119: MOV SI, 0130h
+		0x31, 0xC0, // 011C: XOR AX, AX
+		0x8E, 0xD8, // 011E: MOV DS, AX
+		0x2E, 0xAC, // 0120: CS: LODSB
+		0xF4, // 0122: HLT
+	}
+	for len(image) < 0x30 {
+		image = append(image, 0x90)
+	}
+	image = append(image, "ABCDABXD"...) // 0130h and 0134h
+	cpu := runCOM(t, image)
+
+	if cpu.DX != 1 {
+		t.Errorf("Expected REPE CMPSB to stop at the third byte with CX=1, got %d", cpu.DX)
+	}
+	if cpu.BX != 0 || cpu.DI != 0x0138 || !cpu.Flags.ZF {
+		t.Errorf("Expected REPNE SCASB to find 'D' last, got CX=%d DI=%04X ZF=%v", cpu.BX, cpu.DI, cpu.Flags.ZF)
+	}
+	if cpu.GetAL() != 'A' || cpu.SI != 0x0131 {
+		t.Errorf("Expected CS: LODSB to load 'A' from the program, got AL=%02X SI=%04X", cpu.GetAL(), cpu.SI)
+	}
+}
+
+// TestDecode80186 tests the 80186 encodings, and that the 8086 rejects them
+func TestDecode80186(t *testing.T) {
+	image := []byte{
+		0xB8, 0x34, 0x12, // MOV AX, 1234h
+		0xBB, 0x78, 0x56, // MOV BX, 5678h
+		0x60,       // PUSHA
+		0x31, 0xC0, // XOR AX, AX
+		0x31, 0xDB, // XOR BX, BX
+		0x61,       // POPA
+		0x6A, 0xFE, // PUSH -2
+		0x59,             // POP CX
+		0x6B, 0xD1, 0x03, // IMUL DX, CX, 3
+		0xC1, 0xE0, 0x04, // SHL AX, 4
+		0xC8, 0x04, 0x00, 0x00, // ENTER 4, 0
+		0x89, 0xE6, // MOV SI, SP
+		0xC9,       // LEAVE
+		0x89, 0xE7, // MOV DI, SP
+		0xF4, // HLT
+	}
+
+	cpu := NewCPU()
+	cpu.Model = Model186
+	if err := cpu.LoadCOM(image); err != nil {
+		t.Fatalf("LoadCOM failed: %v", err)
+	}
+	runUntilIdle(t, cpu)
+
+	if cpu.AX != 0x2340 || cpu.BX != 0x5678 {
+		t.Errorf("Expected POPA to restore AX and BX, then AX=2340h, got AX=%04X BX=%04X", cpu.AX, cpu.BX)
+	}
+	if cpu.CX != 0xFFFE || cpu.DX != 0xFFFA {
+		t.Errorf("Expected CX=FFFE DX=FFFA, got CX=%04X DX=%04X", cpu.CX, cpu.DX)
+	}
+	if cpu.SI != 0xFFF8 || cpu.DI != 0xFFFE {
+		t.Errorf("Expected SP=FFF8 inside the frame and FFFE after LEAVE, got %04X and %04X", cpu.SI, cpu.DI)
+	}
+
+	cpu = NewCPU()
+	if err := cpu.LoadCOM(image); err != nil {
+		t.Fatalf("LoadCOM failed: %v", err)
+	}
+	if err := cpu.Run(); err == nil || !strings.Contains(err.Error(), "invalid opcode") {
+		t.Errorf("Expected PUSHA to be an invalid opcode on the 8086, got %v", err)
+	}
+}
+
+// TestDecode80186BoundAndStringIO tests BOUND raising INT 5, INSB and
+// REP OUTSB
+func TestDecode80186BoundAndStringIO(t *testing.T) {
+	image := []byte{
+		0xB8, 0x05, 0x00, // 0100: MOV AX, 5
+		0x62, 0x06, 0x40, 0x01, // 0103: BOUND AX, [0140h]
+		0xBA, 0x21, 0x00, // 0107: MOV DX, 21h
+		0xB0, 0xA5, // 010A: MOV AL, A5h
+		0xEE,             // 010C: OUT DX, AL
+		0xBF, 0x44, 0x01, // 010D: MOV DI, 0144h
+		0x6C,             // 0110: INSB
+		0xBA, 0xC9, 0x03, // 0111: MOV DX, 3C9h
+		0xBE, 0x48, 0x01, // 0114: MOV SI, 0148h
+		0xB9, 0x03, 0x00, // 0117: MOV CX, 3
+		0xF3, 0x6E, // 011A: REP OUTSB
+		0xF4, // 011C: HLT
+	}
+	for len(image) < 0x30 {
+		image = append(image, 0x90)
+	}
+	image = append(image, 0x31, 0xC0, 0x43, 0xCF) // 0130: XOR AX, AX; INC BX; IRET
+	for len(image) < 0x40 {
+		image = append(image, 0x90)
+	}
+	image = append(image, 0x00, 0x00, 0x03, 0x00, 0x00, 0x00, 0x00, 0x00) // 0140: bounds 0..3
+	image = append(image, 0x3F, 0x00, 0x3F)                               // 0148: palette entry
+
+	cpu := NewCPU()
+	cpu.Model = Model186
+	var palette [3]uint8
+	cpu.SetPaletteCallback = func(index, r, g, b uint8) {
+		palette = [3]uint8{r, g, b}
+	}
+	if err := cpu.LoadCOM(image); err != nil {
+		t.Fatalf("LoadCOM failed: %v", err)
+	}
+	cpu.SetInterruptVector(5, COMLoadSegment, 0x0130)
+	runUntilIdle(t, cpu)
+
+	if cpu.AX != 0x00A5 || cpu.BX != 1 {
+		t.Errorf("Expected one INT 5 and a retried BOUND, got AX=%04X BX=%04X", cpu.AX, cpu.BX)
+	}
+	if got := cpu.Memory.ReadByteLinear(CalculateLinearAddress(COMLoadSegment, 0x0144)); got != 0xA5 || cpu.DI != 0x0145 {
+		t.Errorf("Expected INSB to store the PIC mask A5h, got %02X DI=%04X", got, cpu.DI)
+	}
+	if palette != [3]uint8{255, 0, 255} || cpu.SI != 0x014B || cpu.CX != 0 {
+		t.Errorf("Expected REP OUTSB to set the palette to magenta, got %v SI=%04X CX=%d", palette, cpu.SI, cpu.CX)
+	}
+}
+
+// TestDecode80386 tests the operand-size and address-size prefixes and the
+// 0Fh two-byte opcodes, and that earlier models reject them
+func TestDecode80386(t *testing.T) {
+	image := []byte{
+		0x66, 0xB8, 0x78, 0x56, 0x34, 0x12, // 0100: MOV EAX, 12345678h
+		0x66, 0xBB, 0x00, 0x00, 0x01, 0x00, // 0106: MOV EBX, 10000h
+		0x66, 0xF7, 0xE3, // 010C: MUL EBX
+		0x66, 0x89, 0xC1, // 010F: MOV ECX, EAX
+		0x66, 0xC1, 0xE9, 0x1C, // 0112: SHR ECX, 28
+		0x66, 0x67, 0x8B, 0x34, 0x8D, 0x2C, 0x01, 0x00, 0x00, // 0116: MOV ESI, [ECX*4+012Ch]
+		0x66, 0x0F, 0xBF, 0xFE, // 011F: MOVSX EDI, SI
+		0x0F, 0xBC, 0xDF, // 0123: BSF BX, DI
+		0x66, 0x0F, 0xBA, 0xE6, 0x1F, // 0126: BT ESI, 31
+		0x0F, 0x92, 0xC2, // 012B: SETB DL
+		0x66, 0x0F, 0xA4, 0xF0, 0x08, // 012E: SHLD EAX, ESI, 8
+		0x66, 0xA3, 0x44, 0x01, // 0133: MOV [0144h], EAX
+		0xF4, // 0137: HLT
+	}
+	for len(image) < 0x40 {
+		image = append(image, 0x90)
+	}
+	image = append(image, 0xBE, 0xBA, 0xFE, 0xCA) // 0140: DD 0CAFEBABEh
+
+	cpu := NewCPU()
+	cpu.Model = Model386
+	if err := cpu.LoadCOM(image); err != nil {
+		t.Fatalf("LoadCOM failed: %v", err)
+	}
+	runUntilIdle(t, cpu)
+
+	if cpu.GetEAX() != 0x780000CA || cpu.GetECX() != 5 || cpu.GetEDX() != 0x00001201 {
+		t.Errorf("Expected EAX=780000CA ECX=00000005 EDX=00001201, got EAX=%08X ECX=%08X EDX=%08X",
+			cpu.GetEAX(), cpu.GetECX(), cpu.GetEDX())
+	}
+	if cpu.GetESI() != 0xCAFEBABE || cpu.GetEDI() != 0xFFFFBABE || cpu.GetEBX() != 0x00010001 {
+		t.Errorf("Expected ESI=CAFEBABE EDI=FFFFBABE EBX=00010001, got ESI=%08X EDI=%08X EBX=%08X",
+			cpu.GetESI(), cpu.GetEDI(), cpu.GetEBX())
+	}
+	low := cpu.Memory.ReadWordLinear(CalculateLinearAddress(COMLoadSegment, 0x0144))
+	high := cpu.Memory.ReadWordLinear(CalculateLinearAddress(COMLoadSegment, 0x0146))
+	if low != 0x00CA || high != 0x7800 {
+		t.Errorf("Expected the doubleword 780000CAh at 0144h, got %04X%04X", high, low)
+	}
+
+	cpu = NewCPU()
+	cpu.Model = Model286
+	if err := cpu.LoadCOM(image); err != nil {
+		t.Fatalf("LoadCOM failed: %v", err)
+	}
+	if err := cpu.Run(); err == nil || !strings.Contains(err.Error(), "0x66") {
+		t.Errorf("Expected the operand-size prefix to be unsupported on the 286, got %v", err)
+	}
+
+	errors := []struct {
+		name  string
+		image []byte
+		want  string
+	}{
+		{"operand size on NOP", []byte{0x66, 0x90}, "operand-size prefix"},
+		{"address size on CBW", []byte{0x67, 0x98}, "address-size prefix"},
+		{"address past the segment limit", []byte{0x67, 0x8B, 0x05, 0x00, 0x00, 0x01, 0x00}, "segment limit"},
+		{"group 8 /0", []byte{0x0F, 0xBA, 0xC0, 0x01}, "0x0F 0xBA"},
+	}
+	for _, tt := range errors {
+		cpu := NewCPU()
+		cpu.Model = Model386
+		if err := cpu.LoadCOM(tt.image); err != nil {
+			t.Fatalf("LoadCOM failed: %v", err)
+		}
+		if err := cpu.Run(); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: expected an error containing %q, got %v", tt.name, tt.want, err)
+		}
+	}
+}
+
+// TestDecode8087 tests the x87 escape opcodes and WAIT by running a COM
+// image that computes sqrt(2) * 10 and stores it as a double and an integer
+func TestDecode8087(t *testing.T) {
+	image := []byte{
+		0x9B, 0xDB, 0xE3, // 0100: FINIT
+		0xD9, 0xE8, // 0103: FLD1
+		0xD9, 0xE8, // 0105: FLD1
+		0xDE, 0xC1, // 0107: FADDP ST1, ST0
+		0xD9, 0xFA, // 0109: FSQRT
+		0xDE, 0x0E, 0x40, 0x01, // 010B: FIMUL WORD [0140h]
+		0xDD, 0x16, 0x48, 0x01, // 010F: FST QWORD [0148h]
+		0xDF, 0x1E, 0x42, 0x01, // 0113: FISTP WORD [0142h]
+		0xD9, 0xEE, // 0117: FLDZ
+		0xD8, 0x1E, 0x44, 0x01, // 0119: FCOMP DWORD [0144h]
+		0x9B, 0xDF, 0xE0, // 011D: FSTSW AX
+		0xF4, // 0120: HLT
+	}
+	for len(image) < 0x40 {
+		image = append(image, 0x90)
+	}
+	image = append(image, 10, 0, 0, 0, 0x00, 0x00, 0x80, 0x3F) // 0140: DW 10, 0; DD 1.0
+
+	cpu := NewCPU()
+	cpu.Model = Model286
+	if err := cpu.LoadCOM(image); err != nil {
+		t.Fatalf("LoadCOM failed: %v", err)
+	}
+	runUntilIdle(t, cpu)
+
+	if got := cpu.Memory.ReadWordLinear(CalculateLinearAddress(COMLoadSegment, 0x0142)); got != 14 {
+		t.Errorf("Expected FISTP to store 14, got %d", got)
+	}
+	var bits uint64
+	for i := uint16(0); i < 4; i++ {
+		bits |= uint64(cpu.Memory.ReadWordLinear(CalculateLinearAddress(COMLoadSegment, 0x0148+2*i))) << (16 * i)
+	}
+	if want := math.Float64bits(10 * math.Sqrt2); bits != want {
+		t.Errorf("Expected the double %016X at 0148h, got %016X", want, bits)
+	}
+	if cpu.GetAH()&0x45 != 0x01 || !cpu.FPU.IsEmpty(0) {
+		t.Errorf("Expected C0 set and an empty stack, got AX=%04X FSW=%04X", cpu.AX, cpu.FPU.Status)
+	}
+
+	errors := []struct {
+		name  string
+		image []byte
+		model CPUModel
+		want  string
+	}{
+		{"FSTSW AX on the 8086", []byte{0xDF, 0xE0}, Model8086, "coprocessor"},
+		{"FSIN on the 286", []byte{0xD9, 0xFE}, Model286, "coprocessor"},
+		{"FLDENV", []byte{0xD9, 0x26, 0x00, 0x02}, Model386, "0xD9 0x26"},
+		{"reserved D9 form", []byte{0xD9, 0xD1}, Model386, "0xD9 0xD1"},
+	}
+	for _, tt := range errors {
+		cpu := NewCPU()
+		cpu.Model = tt.model
+		if err := cpu.LoadCOM(tt.image); err != nil {
+			t.Fatalf("LoadCOM failed: %v", err)
+		}
+		if err := cpu.Run(); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: expected an error containing %q, got %v", tt.name, tt.want, err)
+		}
+	}
+}
+
+// TestDecode8086Unsupported tests that unknown opcodes are reported
+func TestDecode8086Unsupported(t *testing.T) {
+	cpu := NewCPU()
+	if err := cpu.LoadCOM([]byte{0x0F}); err != nil {
+		t.Fatalf("LoadCOM failed: %v", err)
+	}
+	if err := cpu.Run(); err == nil {
+		t.Error("Expected decode error for opcode 0Fh")
+	}
+}
+
+// TestDecode8086Flags tests the flag instructions and parity jumps
+func TestDecode8086Flags(t *testing.T) {
+	cpu := runCOM(t, []byte{
+		0xF9,       // STC
+		0xFD,       // STD
+		0x9C,       // PUSHF
+		0xF5,       // CMC
+		0xFC,       // CLD
+		0x5B,       // POP BX
+		0xB0, 0x03, // MOV AL, 3
+		0x0C, 0x00, // OR AL, 0 (even parity)
+		0x7B, 0x02, // JNP +2 (not taken)
+		0x7A, 0x01, // JP +1 (taken)
+		0xF4, // HLT (skipped)
+		0x9F, // LAHF
+		0xF4, // HLT
+	})
+
+	if cpu.BX&(FlagCF|FlagDF|FlagIF) != FlagCF|FlagDF|FlagIF {
+		t.Errorf("Expected CF, DF and IF in pushed FLAGS, got %04X", cpu.BX)
+	}
+	if cpu.Flags.CF || cpu.Flags.DF {
+		t.Errorf("Expected CF and DF clear, got %+v", cpu.Flags)
+	}
+	if cpu.IP != 0x0111 {
+		t.Errorf("Expected JP to be taken and halt at 0111h, IP=%04X", cpu.IP)
+	}
+	if cpu.GetAH() != 0x06 {
+		t.Errorf("Expected LAHF to give 06h (PF), got %02X", cpu.GetAH())
+	}
+}
+
+// TestDecode8086CarryAndBCD tests the carry, rotate-through-carry, sign
+// extension and BCD adjust encodings
+func TestDecode8086CarryAndBCD(t *testing.T) {
+	cpu := runCOM(t, []byte{
+		0xB8, 0xFF, 0xFF, // MOV AX, FFFFh
+		0xBA, 0x00, 0x00, // MOV DX, 0
+		0x05, 0x01, 0x00, // ADD AX, 1
+		0x83, 0xD2, 0x00, // ADC DX, 0
+		0x89, 0xD6, // MOV SI, DX
+		0xB0, 0x38, // MOV AL, 38h
+		0x04, 0x45, // ADD AL, 45h
+		0x27,       // DAA
+		0x88, 0xC3, // MOV BL, AL
+		0xB0, 0x3F, // MOV AL, 3Fh
+		0xD4, 0x0A, // AAM
+		0x89, 0xC1, // MOV CX, AX
+		0xB0, 0xF0, // MOV AL, F0h
+		0x98,       // CBW
+		0x99,       // CWD
+		0xD1, 0xD8, // RCR AX, 1
+		0xF9,       // STC
+		0xD1, 0xD0, // RCL AX, 1
+		0x1D, 0xF1, 0xFF, // SBB AX, FFF1h
+		0xF4, // HLT
+	})
+
+	if cpu.SI != 1 {
+		t.Errorf("Expected ADC to carry into SI=1, got %04X", cpu.SI)
+	}
+	if cpu.GetBL() != 0x83 {
+		t.Errorf("Expected DAA to give 83h, got %02X", cpu.GetBL())
+	}
+	if cpu.CX != 0x0603 {
+		t.Errorf("Expected AAM to give 0603h, got %04X", cpu.CX)
+	}
+	if cpu.DX != 0xFFFF {
+		t.Errorf("Expected CWD to give DX=FFFFh, got %04X", cpu.DX)
+	}
+	if cpu.AX != 0 || !cpu.Flags.ZF {
+		t.Errorf("Expected RCR/RCL/SBB to give AX=0 with ZF, got AX=%04X ZF=%v", cpu.AX, cpu.Flags.ZF)
+	}
+}
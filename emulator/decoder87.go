@@ -0,0 +1,184 @@
+package emulator
+
+import "fmt"
+
+// Arithmetic operations selected by the reg field of opcodes D8h, DAh, DCh
+// and DEh with a memory operand, and of D8h with a register operand
+var arith87 = [8]FPUOp{OpFADD, OpFMUL, OpFCOM, OpFCOMP, OpFSUB, OpFSUBR, OpFDIV, OpFDIVR}
+
+// Integer arithmetic selected by the reg field of DAh and DEh with a memory
+// operand
+var intArith87 = [8]FPUOp{OpFIADD, OpFIMUL, OpFICOM, OpFICOMP, OpFISUB, OpFISUBR, OpFIDIV, OpFIDIVR}
+
+// Register forms of DCh, which store into ST(i); the reversed operations
+// swap places with the plain ones compared to D8h
+var arithST87 = [8]FPUOp{OpFADD, OpFMUL, OpFCOM, OpFCOMP, OpFSUBR, OpFSUB, OpFDIVR, OpFDIV}
+
+// Register forms of DEh, which store into ST(i) and pop
+var arithPop87 = [8]FPUOp{OpFADDP, OpFMULP, 0, 0, OpFSUBRP, OpFSUBP, OpFDIVRP, OpFDIVP}
+
+// Operations of D9h F0h-FFh in encoding order
+var misc87 = [16]FPUOp{
+	OpF2XM1, OpFYL2X, OpFPTAN, OpFPATAN, OpFXTRACT, OpFPREM1, OpFDECSTP, OpFINCSTP,
+	OpFPREM, OpFYL2XP1, OpFSQRT, OpFSINCOS, OpFRNDINT, OpFSCALE, OpFSIN, OpFCOS,
+}
+
+// Constants loaded by D9h E8h-EEh in encoding order
+var const87 = [7]FPUOp{OpFLD1, OpFLDL2T, OpFLDL2E, OpFLDPI, OpFLDLG2, OpFLDLN2, OpFLDZ}
+
+// mem87 is a memory form of an x87 opcode: the operation and the size of
+// its operand in bytes
+type mem87 struct {
+	op   FPUOp
+	size byte
+}
+
+// Load, store and control operations selected by the reg field of D9h, DBh,
+// DDh and DFh with a memory operand. The environment, save and BCD forms are
+// left out.
+var memForms87 = map[byte][8]mem87{
+	0xD9: {{OpFLD, 4}, {}, {OpFST, 4}, {OpFSTP, 4}, {}, {OpFLDCW, 2}, {}, {OpFSTCW, 2}},
+	0xDB: {{OpFILD, 4}, {}, {OpFIST, 4}, {OpFISTP, 4}, {}, {OpFLD, 10}, {}, {OpFSTP, 10}},
+	0xDD: {{OpFLD, 8}, {}, {OpFST, 8}, {OpFSTP, 8}, {}, {}, {}, {OpFSTSW, 2}},
+	0xDF: {{OpFILD, 2}, {}, {OpFIST, 2}, {OpFISTP, 2}, {}, {OpFILD, 8}, {}, {OpFISTP, 8}},
+}
+
+// decodeFPU decodes the x87 escape opcodes D8h-DFh. A ModR/M byte of C0h
+// or above selects a register form, which the reg and r/m fields together
+// with the opcode pick out; otherwise the reg field selects an operation on
+// the memory operand.
+func (d *decoder8086) decodeFPU(op byte, inst *Instruction) error {
+	inst.Opcode = OpFPU
+	modrm := d.c.Memory.ReadByteLinear(CalculateLinearAddress(d.c.CS, d.c.IP))
+	if modrm < 0xC0 {
+		return d.decodeFPUMemory(op, modrm, inst)
+	}
+	d.fetch8()
+	reg, i := (modrm>>3)&7, modrm&7
+
+	switch op {
+	case 0xD8:
+		inst.FPU = arith87[reg]
+		if fpuOps[inst.FPU].operands == 1 {
+			inst.Dest = st87(i)
+		} else {
+			inst.Dest, inst.Src = st87(0), st87(i)
+		}
+	case 0xD9:
+		switch {
+		case reg == 0:
+			inst.FPU = OpFLD
+			inst.Dest = st87(i)
+		case reg == 1:
+			inst.FPU = OpFXCH
+			inst.Dest = st87(i)
+		case modrm == 0xD0:
+			inst.FPU = OpFNOP
+		case modrm == 0xE0:
+			inst.FPU = OpFCHS
+		case modrm == 0xE1:
+			inst.FPU = OpFABS
+		case modrm == 0xE4:
+			inst.FPU = OpFTST
+		case modrm == 0xE5:
+			inst.FPU = OpFXAM
+		case modrm >= 0xE8 && modrm <= 0xEE:
+			inst.FPU = const87[modrm-0xE8]
+		case modrm >= 0xF0:
+			inst.FPU = misc87[modrm-0xF0]
+		}
+	case 0xDA:
+		if modrm == 0xE9 {
+			inst.FPU = OpFUCOMPP
+		}
+	case 0xDB:
+		switch modrm {
+		case 0xE0, 0xE1, 0xE4: // FENI, FDISI and FSETPM do nothing after the 8087
+			inst.FPU = OpFNOP
+		case 0xE2:
+			inst.FPU = OpFCLEX
+		case 0xE3:
+			inst.FPU = OpFINIT
+		}
+	case 0xDC:
+		inst.FPU = arithST87[reg]
+		if fpuOps[inst.FPU].operands == 1 {
+			inst.Dest = st87(i)
+		} else {
+			inst.Dest, inst.Src = st87(i), st87(0)
+		}
+	case 0xDD:
+		switch reg {
+		case 0:
+			inst.FPU = OpFFREE
+		case 2:
+			inst.FPU = OpFST
+		case 3:
+			inst.FPU = OpFSTP
+		case 4:
+			inst.FPU = OpFUCOM
+		case 5:
+			inst.FPU = OpFUCOMP
+		}
+		inst.Dest = st87(i)
+	case 0xDE:
+		if modrm == 0xD9 {
+			inst.FPU = OpFCOMPP
+			break
+		}
+		inst.FPU = arithPop87[reg]
+		inst.Dest, inst.Src = st87(i), st87(0)
+	case 0xDF:
+		if modrm == 0xE0 {
+			inst.FPU = OpFSTSW
+			inst.Dest = d.reg16(0)
+		}
+	}
+
+	if inst.FPU == 0 {
+		return unsupported87(op, modrm)
+	}
+	return nil
+}
+
+// decodeFPUMemory decodes the memory forms of an x87 escape opcode
+func (d *decoder8086) decodeFPUMemory(op, modrm byte, inst *Instruction) error {
+	reg, mem := d.modRM(false)
+
+	var form mem87
+	switch op {
+	case 0xD8:
+		form = mem87{arith87[reg], 4}
+	case 0xDA:
+		form = mem87{intArith87[reg], 4}
+	case 0xDC:
+		form = mem87{arith87[reg], 8}
+	case 0xDE:
+		form = mem87{intArith87[reg], 2}
+	default:
+		form = memForms87[op][reg]
+	}
+	if form.op == 0 {
+		return unsupported87(op, modrm)
+	}
+
+	mem.Dword = form.size == 4
+	mem.Qword = form.size == 8
+	mem.Tword = form.size == 10
+	inst.FPU = form.op
+	if fpuOps[form.op].operands == 2 {
+		inst.Dest, inst.Src = st87(0), mem
+	} else {
+		inst.Dest = mem
+	}
+	return nil
+}
+
+// st87 returns the x87 register operand ST(i)
+func st87(i byte) Operand {
+	return Operand{Type: OpTypeST, Imm8: i & 7}
+}
+
+func unsupported87(op, modrm byte) error {
+	return fmt.Errorf("unsupported x87 opcode 0x%02X 0x%02X", op, modrm)
+}
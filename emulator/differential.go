@@ -0,0 +1,130 @@
+package emulator
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// differentialMemoryInterval is how many steps pass between comparisons
+// of the engines' memory, which is much slower to compare than registers
+const differentialMemoryInterval = 4096
+
+// Differential runs a program on the reference interpreter and the block
+// engine side by side. After each block it steps the interpreter as many
+// times and compares the two machines, so a bug in the block engine is
+// caught at the block that first goes wrong.
+type Differential struct {
+	Interp *CPU   // Runs with EngineInterp
+	Block  *CPU   // Runs with EngineBlock
+	Steps  uint64 // Steps each CPU has taken
+
+	memoryChecked uint64 // Steps at the last memory comparison
+}
+
+// Divergence reports the first difference between the two engines
+type Divergence struct {
+	Steps         uint64 // Steps taken by each engine when they were compared
+	What          string // What differs
+	Interp, Block string // The interpreter's and the block engine's value
+}
+
+func (d *Divergence) Error() string {
+	return fmt.Sprintf("engines diverge after %d steps: %s\ninterp: %s\nblock:  %s", d.Steps, d.What, d.Interp, d.Block)
+}
+
+// NewDifferential compares two CPUs loaded with the same program, selecting
+// the interpreter for one and the block engine for the other
+func NewDifferential(interp, block *CPU) *Differential {
+	interp.Engine = EngineInterp
+	block.Engine = EngineBlock
+	return &Differential{Interp: interp, Block: block}
+}
+
+// Step runs one block on the block engine and as many steps on the
+// interpreter, and returns a *Divergence if the machines differ. An error
+// both engines stop with is returned as is.
+func (d *Differential) Step() error {
+	steps, blockErr := d.Block.stepBlock()
+	var interpErr error
+	for i := 0; i < steps && interpErr == nil; i++ {
+		interpErr = d.Interp.Step()
+	}
+	d.Steps += uint64(steps)
+
+	if blockErr != nil || interpErr != nil {
+		if blockErr == nil || interpErr == nil || blockErr.Error() != interpErr.Error() {
+			return &Divergence{Steps: d.Steps, What: "error", Interp: fmt.Sprint(interpErr), Block: fmt.Sprint(blockErr)}
+		}
+		if divergence := d.compare(true); divergence != nil {
+			return divergence
+		}
+		return blockErr
+	}
+	if divergence := d.compare(d.Steps-d.memoryChecked >= differentialMemoryInterval); divergence != nil {
+		return divergence
+	}
+	return nil
+}
+
+// Run steps both engines until the program halts, either stops with an
+// error or differs, or maxSteps steps have run
+func (d *Differential) Run(maxSteps uint64) error {
+	for !d.Block.Halted && d.Steps < maxSteps {
+		if err := d.Step(); err != nil {
+			return err
+		}
+	}
+	if divergence := d.compare(true); divergence != nil {
+		return divergence
+	}
+	return nil
+}
+
+// compare compares the registers, flags and counters of the two CPUs, and
+// their memory when memory is set
+func (d *Differential) compare(memory bool) *Divergence {
+	a, b := d.Interp, d.Block
+	diverge := func(what string, interp, block any) *Divergence {
+		return &Divergence{Steps: d.Steps, What: what, Interp: fmt.Sprint(interp), Block: fmt.Sprint(block)}
+	}
+
+	if as, bs := a.String(), b.String(); as != bs {
+		return diverge("registers", as, bs)
+	}
+	switch {
+	case a.Halted != b.Halted:
+		return diverge("halted", a.Halted, b.Halted)
+	case a.WaitingForInterrupt != b.WaitingForInterrupt:
+		return diverge("waiting for interrupt", a.WaitingForInterrupt, b.WaitingForInterrupt)
+	case a.InstructionCount != b.InstructionCount:
+		return diverge("instruction count", a.InstructionCount, b.InstructionCount)
+	case a.Cycles != b.Cycles:
+		return diverge("cycles", a.Cycles, b.Cycles)
+	}
+	if !memory {
+		return nil
+	}
+
+	d.memoryChecked = d.Steps
+	if addr, ok := firstDifference(a.Memory.RAM, b.Memory.RAM); ok {
+		return diverge(fmt.Sprintf("memory at 0x%05X", addr), a.Memory.RAM[addr], b.Memory.RAM[addr])
+	}
+	if offset, ok := firstDifference(a.Memory.VGA, b.Memory.VGA); ok {
+		return diverge(fmt.Sprintf("VGA memory at offset 0x%05X", offset), a.Memory.VGA[offset], b.Memory.VGA[offset])
+	}
+	return nil
+}
+
+// firstDifference returns the index of the first byte that differs between
+// two equal-length slices
+func firstDifference(a, b []byte) (int, bool) {
+	if bytes.Equal(a, b) {
+		return 0, false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return i, true
+		}
+	}
+	return 0, false
+}
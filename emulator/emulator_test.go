@@ -1,6 +1,7 @@
 package emulator
 
 import (
+	"strings"
 	"testing"
 )
 
@@ -199,6 +200,66 @@ func TestSegmentedAddressing(t *testing.T) {
 	}
 }
 
+// TestEffectiveAddresses tests base+index addressing, default segments and
+// segment overrides in the bytecode
+func TestEffectiveAddresses(t *testing.T) {
+	cpu := NewCPU()
+	cpu.DS, cpu.ES, cpu.SS = 0x2000, 0x3000, 0x4000
+	cpu.BX, cpu.SI, cpu.BP, cpu.DI = 0x0100, 0x0010, 0x0200, 0x0020
+	cpu.Memory.WriteWordLinear(CalculateLinearAddress(0x2000, 0x0114), 0x1111)
+	cpu.Memory.WriteWordLinear(CalculateLinearAddress(0x4000, 0x021E), 0x2222)
+	cpu.Memory.WriteWordLinear(CalculateLinearAddress(0x3000, 0x0114), 0x3333)
+
+	indexed := func(rm byte, disp uint16) []byte {
+		return []byte{byte(OpTypeMemIndexed), rm, byte(disp), byte(disp >> 8)}
+	}
+	override := func(seg byte, mem []byte) []byte {
+		return append([]byte{byte(OpTypeSegOverride), seg}, mem...)
+	}
+	opCX := []byte{byte(OpTypeReg16), 2}
+	opDX := []byte{byte(OpTypeReg16), 3}
+	opBH := []byte{byte(OpTypeReg8), 7}
+	direct := []byte{byte(OpTypeMem), 0x00, 0x05}
+	atDI := []byte{byte(OpTypeMemReg), 13, 0x00, 0x00}
+	atDI2 := []byte{byte(OpTypeMemReg), 13, 0x02, 0x00}
+	program := [][]byte{
+		code(OpMOV, opAX, indexed(0, 4)),               // MOV AX, [BX+SI+4] (DS)
+		code(OpMOV, opDX, indexed(3, 0xFFFE)),          // MOV DX, [BP+DI-2] (SS)
+		code(OpMOV, opCX, override(18, indexed(0, 4))), // MOV CX, ES:[BX+SI+4]
+		code(OpMOV, override(19, direct), opAX),        // MOV SS:[0500h], AX
+		code(OpMOV, override(17, atDI), opBH),          // MOV DS:[DI], BH
+		code(OpMOV, atDI2, opBH),                       // MOV [DI+2], BH (DS)
+	}
+	var image []byte
+	for _, inst := range program {
+		image = append(image, inst...)
+	}
+	copy(cpu.Memory.RAM, append(image, byte(OpHLT)))
+	if err := cpu.Run(); err != nil {
+		t.Fatalf("CPU.Run() failed: %v", err)
+	}
+
+	if cpu.AX != 0x1111 || cpu.DX != 0x2222 || cpu.CX != 0x3333 {
+		t.Errorf("Expected AX=1111 DX=2222 CX=3333, got AX=%04X DX=%04X CX=%04X", cpu.AX, cpu.DX, cpu.CX)
+	}
+	if got := cpu.Memory.ReadWordLinear(CalculateLinearAddress(0x4000, 0x0500)); got != 0x1111 {
+		t.Errorf("Expected SS:0500 = 1111h, got %04Xh", got)
+	}
+	if got := cpu.Memory.ReadByteLinear(CalculateLinearAddress(0x2000, 0x0020)); got != 0x01 {
+		t.Errorf("Expected DS:[DI] = BH (01h), got %02Xh", got)
+	}
+	if got := cpu.Memory.ReadByteLinear(CalculateLinearAddress(0x2000, 0x0022)); got != 0x01 {
+		t.Errorf("Expected [DI+2] to address DS, got %02Xh there", got)
+	}
+
+	// An override must be followed by a memory operand
+	cpu = NewCPU()
+	copy(cpu.Memory.RAM, code(OpMOV, opAX, override(18, opBX)))
+	if _, err := cpu.Decode(); err == nil {
+		t.Error("Expected an error for an override on a register operand")
+	}
+}
+
 // TestSUB tests SUB instruction
 func TestSUB(t *testing.T) {
 	cpu := NewCPU()
@@ -1091,3 +1152,559 @@ func TestStackMultiplePush(t *testing.T) {
 		t.Errorf("Expected BX=1, got BX=%d", cpu.BX)
 	}
 }
+
+// runProgram loads bytecode at address 0 and runs it until HLT
+func runProgram(t *testing.T, program []byte) *CPU {
+	t.Helper()
+	cpu := NewCPU()
+	copy(cpu.Memory.RAM, program)
+	runUntilIdle(t, cpu)
+	return cpu
+}
+
+// TestFlagsWord tests conversion between Flags and the 16-bit FLAGS register
+func TestFlagsWord(t *testing.T) {
+	f := Flags{CF: true, ZF: true, IF: true, OF: true}
+	if w := f.Word(); w != 0xFA43 {
+		t.Errorf("Expected FLAGS=FA43, got %04X", w)
+	}
+
+	var g Flags
+	g.SetWord(0x0FD5) // Every defined flag
+	want := Flags{CF: true, PF: true, AF: true, ZF: true, SF: true, TF: true, IF: true, DF: true, OF: true}
+	if g != want {
+		t.Errorf("Expected %+v, got %+v", want, g)
+	}
+
+	g.SetLowByte(0x00)
+	if g.CF || g.PF || g.AF || g.ZF || g.SF || !g.TF || !g.IF || !g.DF || !g.OF {
+		t.Errorf("SetLowByte should only change SF, ZF, AF, PF and CF, got %+v", g)
+	}
+}
+
+// TestParityAndAuxFlags tests PF and AF after arithmetic and logic instructions
+func TestParityAndAuxFlags(t *testing.T) {
+	tests := []struct {
+		name    string
+		op      Opcode
+		al, imm byte
+		want    byte
+		pf, af  bool
+	}{
+		{"ADD carry out of bit 3", OpADD, 0x0F, 0x01, 0x10, false, true},
+		{"ADD even parity", OpADD, 0x03, 0x00, 0x03, true, false},
+		{"SUB borrow into bit 3", OpSUB, 0x10, 0x01, 0x0F, true, true},
+		{"CMP leaves AL unchanged", OpCMP, 0x10, 0x01, 0x10, true, true},
+		{"ADD odd parity", OpADD, 0x08, 0x03, 0x0B, false, false},
+		{"AND clears AF", OpAND, 0xFF, 0xC0, 0xC0, true, false},
+		{"XOR zero has even parity", OpXOR, 0x5A, 0x5A, 0x00, true, false},
+	}
+
+	for _, tt := range tests {
+		cpu := runProgram(t, []byte{
+			byte(OpMOV), byte(OpTypeReg8), 4, byte(OpTypeImm8), tt.al, // MOV AL, al
+			byte(tt.op), byte(OpTypeReg8), 4, byte(OpTypeImm8), tt.imm, // op AL, imm
+			byte(OpHLT),
+		})
+		if cpu.GetAL() != tt.want {
+			t.Errorf("%s: expected AL=%02X, got %02X", tt.name, tt.want, cpu.GetAL())
+		}
+		if cpu.Flags.PF != tt.pf || cpu.Flags.AF != tt.af {
+			t.Errorf("%s: expected PF=%v AF=%v, got PF=%v AF=%v",
+				tt.name, tt.pf, tt.af, cpu.Flags.PF, cpu.Flags.AF)
+		}
+	}
+}
+
+// TestFlagInstructions tests STC/CLC/CMC, STD/CLD, STI/CLI, PUSHF/POPF and LAHF/SAHF
+func TestFlagInstructions(t *testing.T) {
+	cpu := runProgram(t, []byte{
+		byte(OpSTC),
+		byte(OpSTD),
+		byte(OpSTI),
+		byte(OpPUSHF),
+		byte(OpCMC),
+		byte(OpCLD),
+		byte(OpCLI),
+		byte(OpPOP), byte(OpTypeReg16), 1, // POP BX (saved FLAGS)
+		byte(OpMOV), byte(OpTypeReg8), 5, byte(OpTypeImm8), 0xD5, // MOV AH, D5h
+		byte(OpSAHF),
+		byte(OpMOV), byte(OpTypeReg8), 5, byte(OpTypeImm8), 0x00, // MOV AH, 0
+		byte(OpLAHF),
+		byte(OpHLT),
+	})
+
+	if cpu.BX != 0xF603 {
+		t.Errorf("Expected pushed FLAGS=F603 (CF, IF, DF), got %04X", cpu.BX)
+	}
+	if cpu.GetAH() != 0xD7 {
+		t.Errorf("Expected LAHF to give D7h (SF ZF AF PF CF + bit 1), got %02X", cpu.GetAH())
+	}
+	if !cpu.Flags.CF || !cpu.Flags.ZF || !cpu.Flags.SF || cpu.Flags.DF || cpu.Flags.IF {
+		t.Errorf("Unexpected flags after SAHF: %+v", cpu.Flags)
+	}
+
+	cpu = runProgram(t, []byte{
+		byte(OpMOV), byte(OpTypeReg16), 1, byte(OpTypeImm16), 0xFF, 0xFF, // MOV BX, FFFFh
+		byte(OpPUSH), byte(OpTypeReg16), 1, // PUSH BX
+		byte(OpPOPF),
+		byte(OpHLT),
+	})
+	if w := cpu.Flags.Word(); w != 0xFFD7 {
+		t.Errorf("Expected POPF of FFFFh to give FLAGS=FFD7, got %04X", w)
+	}
+}
+
+// TestStringDirectionFlag tests that string instructions decrement when DF is set
+func TestStringDirectionFlag(t *testing.T) {
+	program := []byte{
+		byte(OpSTD),
+		byte(OpMOV), byte(OpTypeReg16), 12, byte(OpTypeImm16), 0x02, 0x01, // MOV SI, 0102h
+		byte(OpMOV), byte(OpTypeReg16), 13, byte(OpTypeImm16), 0x02, 0x02, // MOV DI, 0202h
+		byte(OpMOV), byte(OpTypeReg16), 2, byte(OpTypeImm8), 3, // MOV CX, 3
+		0xF3, byte(OpMOVSB), // REP MOVSB
+		byte(OpLODSB),
+		byte(OpHLT),
+	}
+	cpu := NewCPU()
+	copy(cpu.Memory.RAM, program)
+	copy(cpu.Memory.RAM[0xFF:], []byte{0x11, 0xAA, 0xBB, 0xCC})
+	if err := cpu.Run(); err != nil {
+		t.Fatalf("CPU.Run() failed: %v", err)
+	}
+
+	if got := cpu.Memory.RAM[0x200:0x203]; got[0] != 0xAA || got[1] != 0xBB || got[2] != 0xCC {
+		t.Errorf("Expected AA BB CC at 0200h, got % X", got)
+	}
+	if cpu.SI != 0x00FE || cpu.DI != 0x01FF {
+		t.Errorf("Expected SI=00FE DI=01FF, got SI=%04X DI=%04X", cpu.SI, cpu.DI)
+	}
+	if cpu.GetAL() != 0x11 {
+		t.Errorf("Expected LODSB to read 11h from 00FFh, got %02X", cpu.GetAL())
+	}
+}
+
+// TestRepeatedStringCompare tests REPNE SCASW, REPE CMPSB and a segment
+// override prefix in the bytecode
+func TestRepeatedStringCompare(t *testing.T) {
+	cpu := NewCPU()
+	cpu.ES = 0x1000
+	program := []byte{
+		byte(OpSTD),
+		byte(OpMOV), byte(OpTypeReg16), 13, byte(OpTypeImm16), 0x06, 0x02, // MOV DI, 0206h
+		byte(OpMOV), byte(OpTypeReg16), 2, byte(OpTypeImm8), 4, // MOV CX, 4
+		byte(OpMOV), byte(OpTypeReg16), 0, byte(OpTypeImm16), 0x34, 0x12, // MOV AX, 1234h
+		0xF2, byte(OpSCASW), // REPNE SCASW
+		byte(OpMOV), byte(OpTypeReg16), 1, byte(OpTypeReg16), 2, // MOV BX, CX
+		byte(OpCLD),
+		byte(OpMOV), byte(OpTypeReg16), 12, byte(OpTypeImm16), 0x00, 0x03, // MOV SI, 0300h
+		byte(OpMOV), byte(OpTypeReg16), 13, byte(OpTypeImm16), 0x00, 0x03, // MOV DI, 0300h
+		byte(OpMOV), byte(OpTypeReg16), 2, byte(OpTypeImm8), 5, // MOV CX, 5
+		0xF3, byte(OpCMPSB), // REPE CMPSB
+		byte(OpMOV), byte(OpTypeReg16), 3, byte(OpTypeReg16), 2, // MOV DX, CX
+		BytecodeSegPrefix, 18, byte(OpLODSB), // LODSB ES:[SI]
+		byte(OpHLT),
+	}
+	copy(cpu.Memory.RAM, program)
+	copy(cpu.Memory.RAM[0x10200:], []byte{0x34, 0x12, 0x55, 0x55, 0x66, 0x66, 0x77, 0x77})
+	copy(cpu.Memory.RAM[0x300:], "ABCDE")
+	copy(cpu.Memory.RAM[0x10300:], "ABXDEF")
+	if err := cpu.Run(); err != nil {
+		t.Fatalf("CPU.Run() failed: %v", err)
+	}
+
+	// REPNE SCASW finds 1234h as the fourth word scanning backwards
+	if cpu.BX != 0 {
+		t.Errorf("Expected REPNE SCASW to use all 4 iterations, CX=%d left", cpu.BX)
+	}
+	// REPE CMPSB stops at the first difference, the third byte
+	if cpu.DX != 2 || cpu.Flags.ZF {
+		t.Errorf("Expected REPE CMPSB to stop with CX=2 and ZF clear, got CX=%d ZF=%v", cpu.DX, cpu.Flags.ZF)
+	}
+	if cpu.DI != 0x0303 {
+		t.Errorf("Expected DI=0303h after REPE CMPSB, got %04X", cpu.DI)
+	}
+	// LODSB reads ES:0303 through the override
+	if cpu.GetAL() != 'D' || cpu.SI != 0x0304 {
+		t.Errorf("Expected LODSB ES:[SI] to load 'D' and advance SI, got AL=%02X SI=%04X", cpu.GetAL(), cpu.SI)
+	}
+}
+
+// Bytecode operands for the arithmetic tables
+var (
+	opAX = []byte{byte(OpTypeReg16), 0}
+	opBX = []byte{byte(OpTypeReg16), 1}
+	opAL = []byte{byte(OpTypeReg8), 4}
+	opBL = []byte{byte(OpTypeReg8), 6}
+	opCL = []byte{byte(OpTypeReg8), 8}
+)
+
+func imm8(v byte) []byte    { return []byte{byte(OpTypeImm8), v} }
+func imm16(v uint16) []byte { return []byte{byte(OpTypeImm16), byte(v), byte(v >> 8)} }
+
+// code assembles one bytecode instruction from its opcode and operands
+func code(op Opcode, operands ...[]byte) []byte {
+	inst := []byte{byte(op)}
+	for _, operand := range operands {
+		inst = append(inst, operand...)
+	}
+	return inst
+}
+
+// arithInput is the register and flag state an arithmetic table row starts from
+type arithInput struct {
+	ax, bx, cx, dx uint16
+	cf, af         bool
+}
+
+// runArith runs a single bytecode instruction from the given state until HLT
+func runArith(t *testing.T, in arithInput, inst []byte) (*CPU, error) {
+	t.Helper()
+	cpu := NewCPU()
+	cpu.Model = Model486 // Every instruction form is available
+	cpu.AX, cpu.BX, cpu.CX, cpu.DX = in.ax, in.bx, in.cx, in.dx
+	cpu.Flags.CF, cpu.Flags.AF = in.cf, in.af
+	copy(cpu.Memory.RAM, append(inst, byte(OpHLT)))
+	return cpu, cpu.Run()
+}
+
+// TestADCSBB tests add with carry and subtract with borrow
+func TestADCSBB(t *testing.T) {
+	tests := []struct {
+		name   string
+		inst   []byte
+		in     arithInput
+		want   uint16
+		cf, of bool
+		zf, af bool
+	}{
+		{"ADC carry in wraps to zero", code(OpADC, opAX, opBX), arithInput{ax: 0xFFFF, cf: true}, 0x0000, true, false, true, true},
+		{"ADC carry in overflows", code(OpADC, opAX, opBX), arithInput{ax: 0x7FFF, cf: true}, 0x8000, false, true, false, true},
+		{"ADC without carry", code(OpADC, opAX, imm16(0x1234)), arithInput{ax: 0x1111}, 0x2345, false, false, false, false},
+		{"ADC byte", code(OpADC, opAL, opBL), arithInput{ax: 0x0080, bx: 0x0080, cf: true}, 0x0001, true, true, false, false},
+		{"ADC byte imm", code(OpADC, opAL, imm8(0x0F)), arithInput{ax: 0x1200, cf: true}, 0x1210, false, false, false, true},
+		{"SBB borrow in wraps", code(OpSBB, opAX, opBX), arithInput{cf: true}, 0xFFFF, true, false, false, true},
+		{"SBB borrow in overflows", code(OpSBB, opAX, opBX), arithInput{ax: 0x8000, cf: true}, 0x7FFF, false, true, false, true},
+		{"SBB borrow from src+1", code(OpSBB, opAX, opBX), arithInput{ax: 0x1000, bx: 0xFFFF, cf: true}, 0x1000, true, false, false, true},
+		{"SBB byte to zero", code(OpSBB, opAL, opBL), arithInput{ax: 0x0005, bx: 0x0004, cf: true}, 0x0000, false, false, true, false},
+		{"SBB byte borrow", code(OpSBB, opAL, opBL), arithInput{ax: 0x0005, bx: 0x0005, cf: true}, 0x00FF, true, false, false, true},
+		{"SBB imm without borrow", code(OpSBB, opAX, imm8(0x10)), arithInput{ax: 0x0030}, 0x0020, false, false, false, false},
+	}
+
+	for _, tt := range tests {
+		cpu, err := runArith(t, tt.in, tt.inst)
+		if err != nil {
+			t.Fatalf("%s: CPU.Run() failed: %v", tt.name, err)
+		}
+		if cpu.AX != tt.want {
+			t.Errorf("%s: expected AX=%04X, got %04X", tt.name, tt.want, cpu.AX)
+		}
+		if cpu.Flags.CF != tt.cf || cpu.Flags.OF != tt.of || cpu.Flags.ZF != tt.zf || cpu.Flags.AF != tt.af {
+			t.Errorf("%s: expected CF=%v OF=%v ZF=%v AF=%v, got CF=%v OF=%v ZF=%v AF=%v", tt.name,
+				tt.cf, tt.of, tt.zf, tt.af, cpu.Flags.CF, cpu.Flags.OF, cpu.Flags.ZF, cpu.Flags.AF)
+		}
+	}
+}
+
+// TestRotates tests ROL, ROR, RCL and RCR by 1, by an immediate and by CL
+func TestRotates(t *testing.T) {
+	tests := []struct {
+		name   string
+		inst   []byte
+		in     arithInput
+		want   uint16
+		cf, of bool
+	}{
+		{"ROL word by 1", code(OpROL, opAX, imm8(1)), arithInput{ax: 0x8001}, 0x0003, true, true},
+		{"ROL byte by 4", code(OpROL, opAL, imm8(4)), arithInput{ax: 0x0012}, 0x0021, true, true},
+		{"ROL byte by CL=9", code(OpROL, opAL, opCL), arithInput{ax: 0x0081, cx: 9}, 0x0003, true, true},
+		{"ROL by CL=0 keeps flags", code(OpROL, opAX, opCL), arithInput{ax: 0x1234, cf: true}, 0x1234, true, false},
+		{"ROR word by 1", code(OpROR, opAX, imm8(1)), arithInput{ax: 0x0001}, 0x8000, true, true},
+		{"ROR byte by CL=4", code(OpROR, opAL, opCL), arithInput{ax: 0x0012, cx: 4}, 0x0021, false, false},
+		{"ROR word by 16", code(OpROR, opAX, imm8(16)), arithInput{ax: 0x8001}, 0x8001, true, true},
+		{"RCL word by 1", code(OpRCL, opAX, imm8(1)), arithInput{ax: 0x8000, cf: true}, 0x0001, true, true},
+		{"RCL byte by 1", code(OpRCL, opAL, imm8(1)), arithInput{ax: 0x0040}, 0x0080, false, true},
+		{"RCL byte by CL=9", code(OpRCL, opAL, opCL), arithInput{ax: 0x0055, cx: 9}, 0x0055, false, false},
+		{"RCL word by 17", code(OpRCL, opAX, imm8(17)), arithInput{ax: 0x1234, cf: true}, 0x1234, true, true},
+		{"RCL word by 2", code(OpRCL, opAX, imm8(2)), arithInput{ax: 0x4000, cf: true}, 0x0002, true, true},
+		{"RCR word by 1", code(OpRCR, opAX, imm8(1)), arithInput{ax: 0x0001, cf: true}, 0x8000, true, true},
+		{"RCR byte by CL=2", code(OpRCR, opAL, opCL), arithInput{ax: 0x0001, cx: 2, cf: true}, 0x00C0, false, false},
+		{"RCR word by 3", code(OpRCR, opAX, imm8(3)), arithInput{ax: 0x0006}, 0x8000, true, true},
+	}
+
+	for _, tt := range tests {
+		cpu, err := runArith(t, tt.in, tt.inst)
+		if err != nil {
+			t.Fatalf("%s: CPU.Run() failed: %v", tt.name, err)
+		}
+		if cpu.AX != tt.want {
+			t.Errorf("%s: expected AX=%04X, got %04X", tt.name, tt.want, cpu.AX)
+		}
+		if cpu.Flags.CF != tt.cf || cpu.Flags.OF != tt.of {
+			t.Errorf("%s: expected CF=%v OF=%v, got CF=%v OF=%v", tt.name, tt.cf, tt.of, cpu.Flags.CF, cpu.Flags.OF)
+		}
+	}
+}
+
+// TestSignedMultiplyDivide tests the one-, two- and three-operand IMUL forms and IDIV
+func TestSignedMultiplyDivide(t *testing.T) {
+	tests := []struct {
+		name     string
+		inst     []byte
+		in       arithInput
+		ax, dx   uint16
+		overflow bool // Expected CF and OF for IMUL
+	}{
+		{"IMUL byte negative", code(OpIMUL, opBL), arithInput{ax: 0x00FF, bx: 0x0002}, 0xFFFE, 0, false},
+		{"IMUL byte overflow", code(OpIMUL, opBL), arithInput{ax: 0x0040, bx: 0x0004}, 0x0100, 0, true},
+		{"IMUL word -1 * -1", code(OpIMUL, opBX), arithInput{ax: 0xFFFF, bx: 0xFFFF, dx: 0x5555}, 0x0001, 0x0000, false},
+		{"IMUL word into DX", code(OpIMUL, opBX), arithInput{ax: 0x4000, bx: 0x0004}, 0x0000, 0x0001, true},
+		{"IMUL word negative into DX", code(OpIMUL, opBX), arithInput{ax: 0x8000, bx: 0x0002}, 0x0000, 0xFFFF, true},
+		{"IMUL reg, reg", code(OpIMUL2, opAX, opBX), arithInput{ax: 0xFFFD, bx: 0x0007, dx: 0x1234}, 0xFFEB, 0x1234, false},
+		{"IMUL reg, imm truncates", code(OpIMUL2, opAX, imm16(0x0300)), arithInput{ax: 0x0100}, 0x0000, 0x0000, true},
+		{"IMUL reg, reg, imm", code(OpIMUL3, opAX, opBX, imm8(10)), arithInput{bx: 0xFFFB}, 0xFFCE, 0x0000, false},
+		{"IDIV byte negative", code(OpIDIV, opBL), arithInput{ax: 0xFFF9, bx: 0x0002}, 0xFFFD, 0, false},
+		{"IDIV word negative dividend", code(OpIDIV, opBX), arithInput{ax: 0xFF9C, bx: 0x0007, dx: 0xFFFF}, 0xFFF2, 0xFFFE, false},
+		{"IDIV word negative divisor", code(OpIDIV, opBX), arithInput{ax: 0x0064, bx: 0xFFF6}, 0xFFF6, 0x0000, false},
+	}
+
+	for _, tt := range tests {
+		cpu, err := runArith(t, tt.in, tt.inst)
+		if err != nil {
+			t.Fatalf("%s: CPU.Run() failed: %v", tt.name, err)
+		}
+		if cpu.AX != tt.ax || cpu.DX != tt.dx {
+			t.Errorf("%s: expected AX=%04X DX=%04X, got AX=%04X DX=%04X", tt.name, tt.ax, tt.dx, cpu.AX, cpu.DX)
+		}
+		if tt.inst[0] != byte(OpIDIV) && (cpu.Flags.CF != tt.overflow || cpu.Flags.OF != tt.overflow) {
+			t.Errorf("%s: expected CF=OF=%v, got CF=%v OF=%v", tt.name, tt.overflow, cpu.Flags.CF, cpu.Flags.OF)
+		}
+	}
+
+	errors := []struct {
+		name string
+		inst []byte
+		in   arithInput
+	}{
+		{"IDIV byte by zero", code(OpIDIV, opBL), arithInput{ax: 0x0010}},
+		{"IDIV byte quotient too large", code(OpIDIV, opBL), arithInput{ax: 0x8000, bx: 0x00FF}},
+		{"IDIV word quotient too large", code(OpIDIV, opBX), arithInput{ax: 0x0000, bx: 0x0001, dx: 0x0001}},
+		{"AAM base zero", code(OpAAM, imm8(0)), arithInput{ax: 0x0010}},
+		{"IMUL into byte register", code(OpIMUL2, opAL, opBL), arithInput{}},
+	}
+
+	for _, tt := range errors {
+		if _, err := runArith(t, tt.in, tt.inst); err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		}
+	}
+}
+
+// TestSignExtendAndBCD tests CBW, CWD and the decimal and ASCII adjustments
+func TestSignExtendAndBCD(t *testing.T) {
+	tests := []struct {
+		name   string
+		inst   []byte
+		in     arithInput
+		ax, dx uint16
+		cf, af bool
+	}{
+		{"CBW negative", code(OpCBW), arithInput{ax: 0x1280}, 0xFF80, 0, false, false},
+		{"CBW positive", code(OpCBW), arithInput{ax: 0xFF7F}, 0x007F, 0, false, false},
+		{"CWD negative", code(OpCWD), arithInput{ax: 0x8000}, 0x8000, 0xFFFF, false, false},
+		{"CWD positive", code(OpCWD), arithInput{ax: 0x7FFF, dx: 0x1234}, 0x7FFF, 0x0000, false, false},
+		{"DAA low digit", code(OpDAA), arithInput{ax: 0x007D}, 0x0083, 0, false, true},                 // 38 + 45
+		{"DAA both digits", code(OpDAA), arithInput{ax: 0x009A}, 0x0000, 0, true, true},                // 99 + 01
+		{"DAA auxiliary carry", code(OpDAA), arithInput{ax: 0x0012, af: true}, 0x0018, 0, false, true}, // 09 + 09
+		{"DAA carry", code(OpDAA), arithInput{ax: 0x0030, cf: true}, 0x0090, 0, true, false},           // 90 + 40
+		{"DAS low digit", code(OpDAS), arithInput{ax: 0x003E, af: true}, 0x0038, 0, false, true},       // 83 - 45
+		{"DAS borrow", code(OpDAS), arithInput{ax: 0x00FF, cf: true, af: true}, 0x0099, 0, true, true}, // 00 - 01
+		{"AAA auxiliary carry", code(OpAAA), arithInput{ax: 0x0011, af: true}, 0x0107, 0, true, true},  // 8 + 9
+		{"AAA low digit", code(OpAAA), arithInput{ax: 0x000B}, 0x0101, 0, true, true},
+		{"AAA no adjust", code(OpAAA), arithInput{ax: 0x0235}, 0x0205, 0, false, false},
+		{"AAS borrow", code(OpAAS), arithInput{ax: 0x01FE, af: true}, 0x0008, 0, true, true}, // 13 - 5
+		{"AAS no adjust", code(OpAAS), arithInput{ax: 0x0104}, 0x0104, 0, false, false},
+		{"AAM base 10", code(OpAAM, imm8(10)), arithInput{ax: 0x003F}, 0x0603, 0, false, false},
+		{"AAM base 16", code(OpAAM, imm8(16)), arithInput{ax: 0x003F}, 0x030F, 0, false, false},
+		{"AAD base 10", code(OpAAD, imm8(10)), arithInput{ax: 0x0603}, 0x003F, 0, false, false},
+		{"AAD base 16", code(OpAAD, imm8(16)), arithInput{ax: 0x030F}, 0x003F, 0, false, false},
+	}
+
+	for _, tt := range tests {
+		cpu, err := runArith(t, tt.in, tt.inst)
+		if err != nil {
+			t.Fatalf("%s: CPU.Run() failed: %v", tt.name, err)
+		}
+		if cpu.AX != tt.ax || cpu.DX != tt.dx {
+			t.Errorf("%s: expected AX=%04X DX=%04X, got AX=%04X DX=%04X", tt.name, tt.ax, tt.dx, cpu.AX, cpu.DX)
+		}
+		if cpu.Flags.CF != tt.cf || cpu.Flags.AF != tt.af {
+			t.Errorf("%s: expected CF=%v AF=%v, got CF=%v AF=%v", tt.name, tt.cf, tt.af, cpu.Flags.CF, cpu.Flags.AF)
+		}
+	}
+}
+
+// Bytecode operands for the 80386 tables
+var (
+	opEAX      = []byte{byte(OpTypeReg32), 0}
+	opEBX      = []byte{byte(OpTypeReg32), 1}
+	opEDX      = []byte{byte(OpTypeReg32), 3}
+	opDword200 = []byte{byte(OpTypeDword), byte(OpTypeMem), 0x00, 0x02} // DWORD [0200h]
+	opDword1FC = []byte{byte(OpTypeDword), byte(OpTypeMem), 0xFC, 0x01} // DWORD [01FCh]
+)
+
+func imm32(v uint32) []byte {
+	return []byte{byte(OpTypeImm32), byte(v), byte(v >> 8), byte(v >> 16), byte(v >> 24)}
+}
+
+// join concatenates bytecode instructions
+func join(insts ...[]byte) []byte {
+	var all []byte
+	for _, inst := range insts {
+		all = append(all, inst...)
+	}
+	return all
+}
+
+// Test32BitInstructions tests the doubleword forms of the 8086 instructions
+// and the instructions added by the 80386
+func Test32BitInstructions(t *testing.T) {
+	tests := []struct {
+		name          string
+		inst          []byte
+		eax, ebx, edx uint32
+		cf            bool
+		wantEAX       uint32
+		wantEDX       uint32
+		wantCF        bool
+	}{
+		{"ADD carries out of bit 31", code(OpADD, opEAX, opEBX), 0xFFFFFFFF, 1, 0, false, 0, 0, true},
+		{"ADC imm32", code(OpADC, opEAX, imm32(0x10000)), 0xFFFF, 0, 0, true, 0x20000, 0, false},
+		{"SUB borrows", code(OpSUB, opEAX, opEBX), 1, 2, 0, false, 0xFFFFFFFF, 0, true},
+		{"NEG", code(OpNEG, opEAX), 1, 0, 0, false, 0xFFFFFFFF, 0, true},
+		{"MUL into EDX", code(OpMUL, opEBX), 0x80000000, 4, 0, false, 0, 2, true},
+		{"IMUL negative", code(OpIMUL, opEBX), 0xFFFFFFFF, 3, 0, false, 0xFFFFFFFD, 0xFFFFFFFF, false},
+		{"IMUL reg, imm truncates", code(OpIMUL2, opEAX, imm32(0x10000)), 0x10000, 0, 0, false, 0, 0, true},
+		{"DIV EDX:EAX", code(OpDIV, opEBX), 0, 0x10, 1, false, 0x10000000, 0, false},
+		{"IDIV negative dividend", code(OpIDIV, opEBX), 0xFFFFFF9C, 7, 0xFFFFFFFF, false, 0xFFFFFFF2, 0xFFFFFFFE, false},
+		{"SHL into CF", code(OpSHL, opEAX, imm8(4)), 0x18000000, 0, 0, false, 0x80000000, 0, true},
+		{"SAR by 31", code(OpSAR, opEAX, imm8(31)), 0x80000000, 0, 0, false, 0xFFFFFFFF, 0, false},
+		{"RCL through CF", code(OpRCL, opEAX, imm8(1)), 0x80000000, 0, 0, true, 0x00000001, 0, true},
+		{"PUSH and POP", join(code(OpPUSH, opEAX), code(OpPOP, opEDX)), 0x12345678, 0, 0, false, 0x12345678, 0x12345678, false},
+		{"MOV through memory", join(code(OpMOV, opDword200, opEAX), code(OpMOV, opEDX, opDword200)), 0xCAFEBABE, 0, 0, false, 0xCAFEBABE, 0xCAFEBABE, false},
+		{"MOVZX byte", code(OpMOVZXB, opEAX, opBL), 0xFFFFFFFF, 0x1FF, 0, false, 0xFF, 0, false},
+		{"MOVSX word", code(OpMOVSXW, opEAX, opBX), 0, 0x8000, 0, false, 0xFFFF8000, 0, false},
+		{"SHLD", code(OpSHLD, opEAX, opEBX, imm8(8)), 0x12345678, 0xABCDEF01, 0, false, 0x345678AB, 0, false},
+		{"SHRD", code(OpSHRD, opEAX, opEBX, imm8(4)), 0x12345678, 0x0000000F, 0, false, 0xF1234567, 0, true},
+		{"BSR", code(OpBSR, opEAX, opEBX), 0, 0x00012345, 0, false, 16, 0, false},
+		{"BSF of zero keeps dest", code(OpBSF, opEAX, opEBX), 0x55, 0, 0, false, 0x55, 0, false},
+		{"BTS bit 31", code(OpBTS, opEAX, imm8(31)), 0, 0, 0, false, 0x80000000, 0, false},
+		{"BTC word", code(OpBTC, opAX, imm8(3)), 0x8, 0, 0, false, 0, 0, true},
+		{"BTR bit 36 of DWORD [01FCh]", join(code(OpMOV, opDword200, opEAX), code(OpBTR, opDword1FC, opEBX), code(OpMOV, opEAX, opDword200)), 0x30, 36, 0, false, 0x20, 0, true},
+		{"CWDE", code(OpCWDE), 0x00008000, 0, 0, false, 0xFFFF8000, 0, false},
+		{"CDQ", code(OpCDQ), 0x80000000, 0, 0, false, 0x80000000, 0xFFFFFFFF, false},
+		{"SETB", code(OpSETcc, opAL, imm8(2)), 0, 0, 0, true, 1, 0, true},
+	}
+
+	for _, tt := range tests {
+		cpu := NewCPU()
+		cpu.Model = Model386
+		cpu.SP = 0x1000
+		cpu.SetEAX(tt.eax)
+		cpu.SetEBX(tt.ebx)
+		cpu.SetEDX(tt.edx)
+		cpu.Flags.CF = tt.cf
+		copy(cpu.Memory.RAM, append(tt.inst, byte(OpHLT)))
+		if err := cpu.Run(); err != nil {
+			t.Fatalf("%s: CPU.Run() failed: %v", tt.name, err)
+		}
+		if cpu.GetEAX() != tt.wantEAX || cpu.GetEDX() != tt.wantEDX {
+			t.Errorf("%s: expected EAX=%08X EDX=%08X, got EAX=%08X EDX=%08X", tt.name, tt.wantEAX, tt.wantEDX, cpu.GetEAX(), cpu.GetEDX())
+		}
+		if cpu.Flags.CF != tt.wantCF {
+			t.Errorf("%s: expected CF=%v, got %v", tt.name, tt.wantCF, cpu.Flags.CF)
+		}
+		if !strings.Contains(cpu.String(), "EAX:") {
+			t.Errorf("%s: expected the extended registers in %q", tt.name, cpu.String())
+		}
+	}
+
+	// The program overwrites the vector table, so the divide error stops Run
+	cpu := NewCPU()
+	cpu.Model = Model386
+	cpu.Exceptions = ExceptionsStop
+	cpu.SetEDX(1)
+	cpu.SetEBX(1)
+	copy(cpu.Memory.RAM, append(code(OpDIV, opEBX), byte(OpHLT)))
+	if err := cpu.Run(); err == nil || !strings.Contains(err.Error(), "division overflow") {
+		t.Errorf("Expected a division overflow, got %v", err)
+	}
+	if strings.Contains(NewCPU().String(), "EAX:") {
+		t.Error("Expected 16-bit registers until an 80386 instruction runs")
+	}
+}
+
+// TestCPULevel tests that instructions added by later processors raise an
+// invalid opcode error on earlier models
+func TestCPULevel(t *testing.T) {
+	tests := []struct {
+		name  string
+		inst  []byte
+		model CPUModel // First model with the instruction
+	}{
+		{"SHL by 1", code(OpSHL, opAX, imm8(1)), Model8086},
+		{"SHL by 4", code(OpSHL, opAX, imm8(4)), Model186},
+		{"PUSH imm", code(OpPUSH, imm16(0x1234)), Model186},
+		{"PUSHA", code(OpPUSHA), Model186},
+		{"IMUL reg, imm", code(OpIMUL2, opAX, imm8(3)), Model186},
+		{"IMUL reg, reg, imm", code(OpIMUL3, opAX, opBX, imm8(3)), Model186},
+		{"IMUL reg, reg", code(OpIMUL2, opAX, opBX), Model386},
+		{"MOV EAX, EBX", code(OpMOV, opEAX, opEBX), Model386},
+		{"SETB AL", code(OpSETcc, opAL, imm8(2)), Model386},
+	}
+
+	for _, tt := range tests {
+		for model := Model8086; model < modelCount; model++ {
+			cpu := NewCPU()
+			cpu.Model = model
+			copy(cpu.Memory.RAM, append(tt.inst, byte(OpHLT)))
+			err := cpu.Run()
+			switch {
+			case model < tt.model && (err == nil || !strings.Contains(err.Error(), "invalid opcode")):
+				t.Errorf("%s on %s: expected an invalid opcode error, got %v", tt.name, model, err)
+			case model >= tt.model && err != nil:
+				t.Errorf("%s on %s: CPU.Run() failed: %v", tt.name, model, err)
+			}
+		}
+	}
+}
+
+// TestEnterLeave tests a nested ENTER, which copies the enclosing frame
+// pointers, and LEAVE
+func TestEnterLeave(t *testing.T) {
+	cpu := NewCPU()
+	cpu.Model = Model186
+	cpu.SP, cpu.BP = 0x0F00, 0x1000
+	cpu.Memory.WriteWordLinear(CalculateLinearAddress(cpu.SS, 0x0FFE), 0xABCD) // Outer frame pointer
+	copy(cpu.Memory.RAM, append(code(OpENTER, imm8(8), imm8(2)), code(OpLEAVE)...))
+
+	if err := cpu.Step(); err != nil {
+		t.Fatalf("ENTER failed: %v", err)
+	}
+	if cpu.BP != 0x0EFE || cpu.SP != 0x0EF2 {
+		t.Errorf("Expected BP=0EFE SP=0EF2 after ENTER, got BP=%04X SP=%04X", cpu.BP, cpu.SP)
+	}
+	stack := func(offset uint16) uint16 {
+		return cpu.Memory.ReadWordLinear(CalculateLinearAddress(cpu.SS, offset))
+	}
+	if stack(0x0EFE) != 0x1000 || stack(0x0EFC) != 0xABCD || stack(0x0EFA) != 0x0EFE {
+		t.Errorf("Expected frame 1000h ABCDh 0EFEh, got %04X %04X %04X", stack(0x0EFE), stack(0x0EFC), stack(0x0EFA))
+	}
+
+	if err := cpu.Step(); err != nil {
+		t.Fatalf("LEAVE failed: %v", err)
+	}
+	if cpu.BP != 0x1000 || cpu.SP != 0x0F00 {
+		t.Errorf("Expected BP=1000 SP=0F00 after LEAVE, got BP=%04X SP=%04X", cpu.BP, cpu.SP)
+	}
+}
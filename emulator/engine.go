@@ -0,0 +1,294 @@
+package emulator
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Engine selects how Run executes instructions
+type Engine uint8
+
+const (
+	// EngineInterp is the reference interpreter: Step takes each
+	// instruction from the decode cache and runs it through Execute
+	EngineInterp Engine = iota
+
+	// EngineBlock compiles straight-line runs of instructions into blocks,
+	// each instruction bound to its handler once, and runs a whole block
+	// per dispatch. It gives the same results as the interpreter, which
+	// still runs anything a block cannot hold.
+	EngineBlock
+)
+
+func (e Engine) String() string {
+	switch e {
+	case EngineInterp:
+		return "interp"
+	case EngineBlock:
+		return "block"
+	}
+	return fmt.Sprintf("Engine(%d)", uint8(e))
+}
+
+// ParseEngine parses an execution engine name: "interp" or "block"
+func ParseEngine(name string) (Engine, error) {
+	switch strings.ToLower(name) {
+	case "interp", "interpreter":
+		return EngineInterp, nil
+	case "block":
+		return EngineBlock, nil
+	}
+	return 0, fmt.Errorf("unknown engine %q (expected interp or block)", name)
+}
+
+// maxBlockOps is the most instructions a block holds
+const maxBlockOps = 64
+
+// blockOp is an instruction of a compiled block
+type blockOp struct {
+	inst          Instruction
+	exec          func(*CPU, Instruction) error // Handler bound when the block was compiled
+	ip            uint16                        // Offset of the instruction in the block's CS
+	cycles        uint64                        // Cost with jumps taken
+	dynamicCycles bool                          // True if the cost depends on CL and is worked out each time
+}
+
+// block is a run of instructions that execute one after the other, ending
+// at the first jump, call, return or interrupt
+type block struct {
+	ops        []blockOp
+	start, end uint32 // Linear addresses of its first byte and the byte after its last
+	cs         uint16 // Code segment it was compiled with
+	model      CPUModel
+	native     bool
+	valid      bool // Cleared when a write overlaps its bytes
+}
+
+// blockCache holds compiled blocks by the linear address they start at.
+// Each block is also listed under every decode page its bytes fall in, so a
+// write finds the blocks it overwrites.
+type blockCache struct {
+	starts [TotalMemorySize / decodePageSize]*[decodePageSize]*block
+	pages  [TotalMemorySize / decodePageSize][]*block
+}
+
+// lookup returns the valid block starting at addr for the current CS, CPU
+// model and program format, or nil
+func (bc *blockCache) lookup(addr uint32, c *CPU) *block {
+	page := bc.starts[addr>>decodePageBits]
+	if page == nil {
+		return nil
+	}
+	b := page[addr&(decodePageSize-1)]
+	if b == nil || !b.valid || b.cs != c.CS || b.model != c.Model || b.native != c.Native {
+		return nil
+	}
+	return b
+}
+
+// store adds a compiled block, replacing any block that started at the
+// same address
+func (bc *blockCache) store(b *block) {
+	page := bc.starts[b.start>>decodePageBits]
+	if page == nil {
+		page = new([decodePageSize]*block)
+		bc.starts[b.start>>decodePageBits] = page
+	}
+	if old := page[b.start&(decodePageSize-1)]; old != nil {
+		bc.remove(old)
+	}
+	page[b.start&(decodePageSize-1)] = b
+	for p := b.start >> decodePageBits; p <= (b.end-1)>>decodePageBits; p++ {
+		bc.pages[p] = append(bc.pages[p], b)
+	}
+}
+
+// remove marks a block invalid and drops it from the cache
+func (bc *blockCache) remove(b *block) {
+	b.valid = false
+	if page := bc.starts[b.start>>decodePageBits]; page != nil && page[b.start&(decodePageSize-1)] == b {
+		page[b.start&(decodePageSize-1)] = nil
+	}
+	for p := b.start >> decodePageBits; p <= (b.end-1)>>decodePageBits; p++ {
+		list := bc.pages[p]
+		for i, other := range list {
+			if other == b {
+				list[i] = list[len(list)-1]
+				bc.pages[p] = list[:len(list)-1]
+				break
+			}
+		}
+	}
+}
+
+// invalidate drops the blocks that include the byte at addr
+func (bc *blockCache) invalidate(addr uint32) {
+	list := bc.pages[addr>>decodePageBits]
+	for i := 0; i < len(list); {
+		if b := list[i]; addr >= b.start && addr < b.end {
+			bc.remove(b) // Moves the last block of the list to i
+			list = bc.pages[addr>>decodePageBits]
+			continue
+		}
+		i++
+	}
+}
+
+// flush drops all compiled blocks
+func (bc *blockCache) flush() {
+	for _, list := range bc.pages {
+		for _, b := range list {
+			b.valid = false
+		}
+	}
+	*bc = blockCache{}
+}
+
+// endsBlock reports whether an opcode transfers control, so a block ends
+// with it and the bytes after it are not decoded
+func endsBlock(op Opcode) bool {
+	switch op {
+	case OpJMP, OpJE, OpJNE, OpJG, OpJGE, OpJL, OpJLE, OpJA, OpJAE, OpJB, OpJBE,
+		OpJO, OpJNO, OpJS, OpJNS, OpJP, OpJNP, OpJCXZ,
+		OpCALL, OpRET, OpLOOP, OpLOOPZ, OpLOOPNZ, OpJMPF, OpCALLF, OpRETF,
+		OpINT, OpINTO, OpIRET, OpHLT, OpBOUND:
+		return true
+	}
+	return false
+}
+
+// blockHandlers are the handlers blocks bind their instructions to, which
+// skip Execute's dispatch. Opcodes without one run through Execute.
+var blockHandlers [256]func(*CPU, Instruction) error
+
+func init() {
+	for op, exec := range map[Opcode]func(*CPU, Instruction) error{
+		OpMOV: (*CPU).execMOV, OpPUSH: (*CPU).execPUSH, OpPOP: (*CPU).execPOP,
+		OpXCHG: (*CPU).execXCHG, OpLEA: (*CPU).execLEA, OpXLAT: (*CPU).execXLAT,
+
+		OpADD: (*CPU).execADD, OpSUB: (*CPU).execSUB, OpADC: (*CPU).execADC, OpSBB: (*CPU).execSBB,
+		OpMUL: (*CPU).execMUL, OpDIV: (*CPU).execDIV, OpIMUL: (*CPU).execIMUL, OpIDIV: (*CPU).execIDIV,
+		OpINC: (*CPU).execINC, OpDEC: (*CPU).execDEC, OpNEG: (*CPU).execNEG,
+
+		OpAND: (*CPU).execAND, OpOR: (*CPU).execOR, OpXOR: (*CPU).execXOR, OpNOT: (*CPU).execNOT,
+		OpSHL: (*CPU).execSHL, OpSAL: (*CPU).execSHL, OpSHR: (*CPU).execSHR, OpSAR: (*CPU).execSAR,
+		OpROL: (*CPU).execROL, OpROR: (*CPU).execROR, OpRCL: (*CPU).execRCL, OpRCR: (*CPU).execRCR,
+		OpCMP: (*CPU).execCMP, OpTEST: (*CPU).execTEST,
+
+		OpJMP: (*CPU).execJMP, OpJE: (*CPU).execJE, OpJNE: (*CPU).execJNE,
+		OpJG: (*CPU).execJG, OpJGE: (*CPU).execJGE, OpJL: (*CPU).execJL, OpJLE: (*CPU).execJLE,
+		OpJA: (*CPU).execJA, OpJAE: (*CPU).execJAE, OpJB: (*CPU).execJB, OpJBE: (*CPU).execJBE,
+		OpJO: (*CPU).execJO, OpJNO: (*CPU).execJNO, OpJS: (*CPU).execJS, OpJNS: (*CPU).execJNS,
+		OpJP: (*CPU).execJP, OpJNP: (*CPU).execJNP, OpJCXZ: (*CPU).execJCXZ,
+		OpCALL: (*CPU).execCALL, OpRET: (*CPU).execRET,
+		OpLOOP: (*CPU).execLOOP, OpLOOPZ: (*CPU).execLOOPZ, OpLOOPNZ: (*CPU).execLOOPNZ,
+
+		OpIN: (*CPU).execIN, OpOUT: (*CPU).execOUT,
+		OpMOVSB: (*CPU).execMOVSB, OpMOVSW: (*CPU).execMOVSW,
+		OpSTOSB: (*CPU).execSTOSB, OpSTOSW: (*CPU).execSTOSW,
+		OpLODSB: (*CPU).execLODSB, OpLODSW: (*CPU).execLODSW,
+		OpNOP: func(*CPU, Instruction) error { return nil },
+	} {
+		blockHandlers[op] = exec
+	}
+}
+
+// compileBlock decodes the block starting at CS:IP, or returns nil when the
+// instruction there cannot be cached and must be stepped by the interpreter
+func (c *CPU) compileBlock(addr uint32) *block {
+	ip := c.IP
+	defer func() { c.IP = ip }()
+
+	b := &block{start: addr, cs: c.CS, model: c.Model, native: c.Native, valid: true}
+	for len(b.ops) < maxBlockOps {
+		opIP := c.IP
+		opAddr := CalculateLinearAddress(c.CS, opIP)
+		inst, err := c.decodeNext()
+		if err != nil || !cacheable(opAddr, inst, opIP) {
+			break
+		}
+		b.ops = append(b.ops, c.compileOp(inst, opIP))
+		b.end = opAddr + uint32(inst.Size)
+		if endsBlock(inst.Opcode) || c.IP < opIP {
+			break
+		}
+	}
+	if len(b.ops) == 0 {
+		return nil
+	}
+	return b
+}
+
+// compileOp binds an instruction to its handler and works out its cost.
+// Instructions that need a later CPU model, or the 80386's doubleword
+// operations, keep Execute, which raises the invalid opcode exception or
+// dispatches to them.
+func (c *CPU) compileOp(inst Instruction, ip uint16) blockOp {
+	op := blockOp{inst: inst, exec: (*CPU).Execute, ip: ip}
+	if model := requiredModel(inst); model <= c.Model && model < Model386 && blockHandlers[inst.Opcode] != nil {
+		op.exec = blockHandlers[inst.Opcode]
+	}
+
+	// Shifts and rotates by CL pay for the count in CL at the time
+	t := c.timing(inst.Opcode)
+	if (t.countBase != 0 || t.perBit != 0) && inst.Src.Type == OpTypeReg8 {
+		op.dynamicCycles = true
+	} else {
+		op.cycles = c.instructionCycles(inst)
+	}
+	return op
+}
+
+// stepBlock runs the compiled block at CS:IP, compiling it first if need
+// be, and returns the number of steps taken. Around each instruction it does
+// what Step does, so hardware interrupts, traps and cycle counts match the
+// interpreter's. It leaves the block once control transfers out of it or
+// one of its instructions is overwritten. Without a block, it steps once.
+func (c *CPU) stepBlock() (int, error) {
+	if c.Halted {
+		return 0, ErrHalted
+	}
+	// Blocks are invalidated through the decode cache's map of code bytes
+	if c.Memory.decoded == nil {
+		return 1, c.Step()
+	}
+	if c.Memory.blocks == nil {
+		c.Memory.blocks = new(blockCache)
+	}
+	cache := c.Memory.blocks
+	addr := CalculateLinearAddress(c.CS, c.IP)
+	b := cache.lookup(addr, c)
+	if b == nil {
+		if b = c.compileBlock(addr); b == nil {
+			return 1, c.Step()
+		}
+		cache.store(b)
+	}
+
+	for i := range b.ops {
+		op := &b.ops[i]
+		if done, err := c.beginStep(); done {
+			return i + 1, err
+		}
+		if c.CS != b.cs || c.IP != op.ip {
+			// An interrupt was taken, and its handler runs instead
+			return i + 1, c.stepDecoded()
+		}
+
+		trap := c.Flags.TF
+		inst := op.inst
+		inst.resolve()
+		c.IP += uint16(inst.Size)
+		cycles := op.cycles
+		if op.dynamicCycles {
+			cycles = c.instructionCycles(inst)
+		}
+		if err := c.execInstruction(inst, op.exec, cycles, trap, b.cs, op.ip); err != nil {
+			return i + 1, err
+		}
+		if !b.valid || c.Halted || c.CS != b.cs || c.IP != op.ip+uint16(inst.Size) {
+			return i + 1, nil
+		}
+	}
+	return len(b.ops), nil
+}
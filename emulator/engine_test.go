@@ -0,0 +1,168 @@
+package emulator
+
+import (
+	"errors"
+	"testing"
+)
+
+// runDifferential runs a .COM image on both engines side by side for up to
+// maxSteps steps and fails at the first difference
+func runDifferential(t *testing.T, image []byte, maxSteps uint64) *Differential {
+	t.Helper()
+	interp, block := NewCPU(), NewCPU()
+	for _, cpu := range []*CPU{interp, block} {
+		if err := cpu.LoadCOM(image); err != nil {
+			t.Fatalf("LoadCOM failed: %v", err)
+		}
+	}
+	d := NewDifferential(interp, block)
+	if err := d.Run(maxSteps); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// TestBlockEngineSelfModifying tests that a write into the running block
+// stops it before the overwritten instruction runs
+func TestBlockEngineSelfModifying(t *testing.T) {
+	d := runDifferential(t, []byte{
+		0xB9, 0x03, 0x00, // 0100: MOV CX, 3
+		0xFE, 0x06, 0x0C, 0x01, // 0103: INC BYTE [010Ch]
+		0x90,       // 0107: NOP
+		0x90,       // 0108: NOP
+		0x01, 0xC3, // 0109: ADD BX, AX
+		0xB8, 0x01, 0x00, // 010B: MOV AX, 1 (immediate incremented above)
+		0xE2, 0xF3, // 010E: LOOP 0103h
+		0xF4, // 0110: HLT
+	}, 1000)
+	if d.Block.BX != 2+3 || d.Block.AX != 4 {
+		t.Errorf("Expected BX=5 and AX=4, got BX=%d AX=%d", d.Block.BX, d.Block.AX)
+	}
+}
+
+// TestBlockEngineTimerInterrupt tests that IRQ0 interrupts a block between
+// the same two instructions as the interpreter, with an INT 1Ch hook counting
+// ticks while a loop runs
+func TestBlockEngineTimerInterrupt(t *testing.T) {
+	d := runDifferential(t, []byte{
+		0xB8, 0x1C, 0x25, // 0100: MOV AX, 251Ch
+		0xBA, 0x20, 0x01, // 0103: MOV DX, 0120h
+		0xCD, 0x21, // 0106: INT 21h
+		0xB0, 0x36, // 0108: MOV AL, 36h
+		0xE6, 0x43, // 010A: OUT 43h, AL
+		0xB0, 0x00, // 010C: MOV AL, 0
+		0xE6, 0x40, // 010E: OUT 40h, AL
+		0xB0, 0x01, // 0110: MOV AL, 1 (period 256)
+		0xE6, 0x40, // 0112: OUT 40h, AL
+		0xFB,       // 0114: STI
+		0x41,       // 0115: INC CX
+		0x42,       // 0116: INC DX
+		0x43,       // 0117: INC BX
+		0x47,       // 0118: INC DI
+		0xEB, 0xFA, // 0119: JMP 0115h
+		0, 0, 0, 0, 0, // 011B
+		0x46, // 0120: INC SI
+		0xCF, // 0121: IRET
+	}, 200000)
+	if d.Block.SI == 0 {
+		t.Error("Expected the INT 1Ch hook to run")
+	}
+}
+
+// TestBlockEngineSingleStep tests that the single-step trap follows each
+// instruction of a block
+func TestBlockEngineSingleStep(t *testing.T) {
+	d := runDifferential(t, []byte{
+		0xB8, 0x01, 0x25, // 0100: MOV AX, 2501h
+		0xBA, 0x20, 0x01, // 0103: MOV DX, 0120h
+		0xCD, 0x21, // 0106: INT 21h
+		0x9C,             // 0108: PUSHF
+		0x58,             // 0109: POP AX
+		0x0D, 0x00, 0x01, // 010A: OR AX, 0100h
+		0x50,                               // 010D: PUSH AX
+		0x9D,                               // 010E: POPF
+		0x40,                               // 010F: INC AX
+		0x40,                               // 0110: INC AX
+		0x40,                               // 0111: INC AX
+		0xFA,                               // 0112: CLI
+		0xF4,                               // 0113: HLT
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, // 0114
+		0x43, // 0120: INC BX
+		0xCF, // 0121: IRET
+	}, 1000)
+	if d.Block.BX == 0 {
+		t.Error("Expected the single-step handler to run")
+	}
+}
+
+// TestBlockEngineFault tests that both engines stop with the same
+// diagnostic at an unhandled divide error
+func TestBlockEngineFault(t *testing.T) {
+	interp, block := NewCPU(), NewCPU()
+	for _, cpu := range []*CPU{interp, block} {
+		if err := cpu.LoadCOM([]byte{
+			0xB8, 0x07, 0x00, // 0100: MOV AX, 7
+			0x31, 0xDB, // 0103: XOR BX, BX
+			0xF7, 0xF3, // 0105: DIV BX
+			0xF4, // 0107: HLT
+		}); err != nil {
+			t.Fatalf("LoadCOM failed: %v", err)
+		}
+	}
+	err := NewDifferential(interp, block).Run(100)
+	var exception *Exception
+	if !errors.As(err, &exception) || exception.Vector != VectorDivideError {
+		t.Fatalf("Expected a divide error from both engines, got %v", err)
+	}
+}
+
+// TestParseEngine tests parsing execution engine names
+func TestParseEngine(t *testing.T) {
+	for name, want := range map[string]Engine{"interp": EngineInterp, "Block": EngineBlock} {
+		if got, err := ParseEngine(name); err != nil || got != want {
+			t.Errorf("ParseEngine(%q) = %v, %v; want %v", name, got, err, want)
+		}
+	}
+	if _, err := ParseEngine("jit"); err == nil {
+		t.Error("Expected an error for an unknown engine")
+	}
+}
+
+// BenchmarkEngines runs a pixel loop on each engine and reports the
+// emulated instructions per second
+func BenchmarkEngines(b *testing.B) {
+	image := []byte{
+		0xB8, 0x00, 0xA0, // 0100: MOV AX, A000h
+		0x8E, 0xC0, // 0103: MOV ES, AX
+		0x31, 0xFF, // 0105: XOR DI, DI
+		0x88, 0xD8, // 0107: MOV AL, BL
+		0x00, 0xE0, // 0109: ADD AL, AH
+		0x26, 0x88, 0x05, // 010B: MOV ES:[DI], AL
+		0x47,       // 010E: INC DI
+		0xFE, 0xC4, // 010F: INC AH
+		0xD0, 0xE8, // 0111: SHR AL, 1
+		0x01, 0xFB, // 0113: ADD BX, DI
+		0xEB, 0xF0, // 0115: JMP 0107h
+	}
+	for _, engine := range []Engine{EngineInterp, EngineBlock} {
+		b.Run(engine.String(), func(b *testing.B) {
+			cpu := NewCPU()
+			if err := cpu.LoadCOM(image); err != nil {
+				b.Fatalf("LoadCOM failed: %v", err)
+			}
+			b.ResetTimer()
+			for cpu.InstructionCount < uint64(b.N) {
+				var err error
+				if engine == EngineBlock {
+					_, err = cpu.stepBlock()
+				} else {
+					err = cpu.Step()
+				}
+				if err != nil {
+					b.Fatalf("Step failed: %v", err)
+				}
+			}
+			b.ReportMetric(float64(cpu.InstructionCount)/b.Elapsed().Seconds(), "IPS")
+		})
+	}
+}
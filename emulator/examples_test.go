@@ -0,0 +1,179 @@
+package emulator_test
+
+import (
+	"assembly-emulator/assembler"
+	"assembly-emulator/emulator"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The example tests and benchmarks live in an external test package because
+// the assembler imports the emulator
+
+// exampleBackends are the two formats the bundled examples run in
+var exampleBackends = []struct {
+	name    string
+	backend assembler.Backend
+}{
+	{"bytecode", assembler.BackendBytecode},
+	{"8086", assembler.Backend8086},
+}
+
+// assembleExample assembles an example program for a backend
+func assembleExample(b testing.TB, source []byte, backend assembler.Backend) *assembler.Program {
+	b.Helper()
+	tokens, err := assembler.NewLexer(string(source)).Tokenize()
+	if err != nil {
+		b.Fatalf("Lexer error: %v", err)
+	}
+	tokens, err = assembler.NewPreprocessor().Process(tokens)
+	if err != nil {
+		b.Fatalf("Preprocessor error: %v", err)
+	}
+	parser := assembler.NewParser(tokens)
+	origin := uint16(0)
+	if backend == assembler.Backend8086 {
+		origin = emulator.COMEntryOffset
+	}
+	parser.SetBackend(backend, origin)
+	program, err := parser.Parse()
+	if err != nil {
+		b.Fatalf("Parser error: %v", err)
+	}
+	return program
+}
+
+// loadExample resets the CPU and loads an assembled example. Port 3DAh
+// reports the retrace without waiting for the display.
+func loadExample(b testing.TB, cpu *emulator.CPU, program *assembler.Program, backend assembler.Backend) {
+	b.Helper()
+	cpu.Reset()
+	if backend == assembler.Backend8086 {
+		if err := cpu.LoadCOM(program.Flat()); err != nil {
+			b.Fatalf("LoadCOM failed: %v", err)
+		}
+		return
+	}
+	cpu.LoadBytecode(program.CodeBytes, program.DataBytes)
+	cpu.FrameSync = false
+}
+
+// BenchmarkExamples runs each bundled example in both formats, one Step per
+// iteration, restarting it at the HLT that ends it. It reports the emulated
+// instructions per second, which leaves out the restarts and counts each
+// repetition of a REP string instruction.
+func BenchmarkExamples(b *testing.B) {
+	files, err := filepath.Glob("../examples/*.asm")
+	if err != nil || len(files) == 0 {
+		b.Fatalf("No examples found: %v", err)
+	}
+	for _, file := range files {
+		source, err := os.ReadFile(file)
+		if err != nil {
+			b.Fatal(err)
+		}
+		name := strings.TrimSuffix(filepath.Base(file), ".asm")
+		for _, format := range exampleBackends {
+			b.Run(name+"/"+format.name, func(b *testing.B) {
+				program := assembleExample(b, source, format.backend)
+				cpu := emulator.NewCPU()
+				loadExample(b, cpu, program, format.backend)
+				start := cpu.InstructionCount
+
+				var running time.Duration
+				b.ReportAllocs()
+				b.ResetTimer()
+				started := time.Now()
+				for i := 0; i < b.N; i++ {
+					if cpu.Halted || cpu.WaitingForInterrupt {
+						running += time.Since(started)
+						loadExample(b, cpu, program, format.backend)
+						started = time.Now()
+					}
+					if err := cpu.Step(); err != nil {
+						b.Fatalf("Step failed: %v", err)
+					}
+				}
+				running += time.Since(started)
+				b.ReportMetric(float64(cpu.InstructionCount-start)/running.Seconds(), "IPS")
+			})
+		}
+	}
+}
+
+// TestExamplesDifferential runs each bundled example in both formats on the
+// interpreter and the block engine side by side, failing at the first
+// difference or error
+func TestExamplesDifferential(t *testing.T) {
+	const maxSteps = 200000
+	files, err := filepath.Glob("../examples/*.asm")
+	if err != nil || len(files) == 0 {
+		t.Fatalf("No examples found: %v", err)
+	}
+	for _, file := range files {
+		source, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := strings.TrimSuffix(filepath.Base(file), ".asm")
+		for _, format := range exampleBackends {
+			t.Run(name+"/"+format.name, func(t *testing.T) {
+				program := assembleExample(t, source, format.backend)
+				interp, block := emulator.NewCPU(), emulator.NewCPU()
+				loadExample(t, interp, program, format.backend)
+				loadExample(t, block, program, format.backend)
+				// Each example runs without error to the HLT that ends it, as
+				// in the benchmarks, or to the step limit. A .COM runs with
+				// interrupts enabled, so there the HLT waits for one instead
+				// of halting.
+				d := emulator.NewDifferential(interp, block)
+				for !block.Halted && !block.WaitingForInterrupt && d.Steps < maxSteps {
+					if err := d.Step(); err != nil {
+						t.Fatal(err)
+					}
+				}
+				// Compare memory where they stopped
+				if err := d.Run(d.Steps); err != nil {
+					t.Fatal(err)
+				}
+			})
+		}
+	}
+}
+
+// TestDefaultSegments tests that in both formats [DI] addresses DS, as on
+// the 8086, and reaches ES only through an override. Bytecode programs
+// assembled before the bytecode followed the 8086 here wrote [DI] to ES.
+func TestDefaultSegments(t *testing.T) {
+	source := []byte(`
+.code
+    MOV AX, 0x13
+    INT 0x10
+    MOV AX, 0xA000
+    MOV ES, AX
+    MOV DI, 0x10
+    MOV AL, 7
+    MOV [DI], AL
+    MOV ES:[DI+1], AL
+    HLT
+`)
+	for _, format := range exampleBackends {
+		program := assembleExample(t, source, format.backend)
+		cpu := emulator.NewCPU()
+		loadExample(t, cpu, program, format.backend)
+		for !cpu.Halted && !cpu.WaitingForInterrupt {
+			if err := cpu.Step(); err != nil {
+				t.Fatalf("%s: %v", format.name, err)
+			}
+		}
+		if got := cpu.Memory.ReadByteLinear(emulator.CalculateLinearAddress(cpu.DS, 0x10)); got != 7 {
+			t.Errorf("%s: expected [DI] to write DS:0010, got %d", format.name, got)
+		}
+		if vga := cpu.Memory.VGA; vga[0x10] != 0 || vga[0x11] != 7 {
+			t.Errorf("%s: expected only ES:[DI+1] in VGA memory, got % X", format.name, vga[0x10:0x12])
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package emulator
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Exception vectors of the real-mode CPU exceptions
+const (
+	VectorDivideError   = 0x00 // DIV, IDIV or AAM by zero, or a quotient that does not fit
+	VectorSingleStep    = 0x01 // Trap after each instruction while TF is set
+	VectorBreakpoint    = 0x03 // INT 3
+	VectorInvalidOpcode = 0x06 // Undefined opcode, or one the CPU model lacks
+)
+
+var exceptionNames = map[uint8]string{
+	VectorDivideError:   "divide error",
+	VectorSingleStep:    "single-step trap",
+	VectorBreakpoint:    "breakpoint",
+	VectorInvalidOpcode: "invalid opcode",
+}
+
+// Exception is a CPU exception. Faults (divide error and invalid opcode)
+// are raised by an instruction that cannot complete and carry the cause in
+// Err; traps (single step and breakpoint) are raised after an instruction.
+type Exception struct {
+	Vector uint8
+	CS, IP uint16 // Address of the faulting instruction, or where a trap returns to
+	Err    error  // Cause of a fault
+}
+
+func (e *Exception) Error() string {
+	s := fmt.Sprintf("%s (INT %02Xh) at %04X:%04X", exceptionNames[e.Vector], e.Vector, e.CS, e.IP)
+	if e.Err != nil {
+		s += ": " + e.Err.Error()
+	}
+	return s
+}
+
+func (e *Exception) Unwrap() error {
+	return e.Err
+}
+
+func (e *Exception) fault() bool {
+	return e.Vector == VectorDivideError || e.Vector == VectorInvalidOpcode
+}
+
+// divideError returns a divide error fault
+func divideError(cause string) error {
+	return &Exception{Vector: VectorDivideError, Err: errors.New(cause)}
+}
+
+// invalidOpcode returns an invalid opcode fault
+func invalidOpcode(format string, args ...any) error {
+	return &Exception{Vector: VectorInvalidOpcode, Err: fmt.Errorf(format, args...)}
+}
+
+// ExceptionPolicy selects what the CPU does when it raises an exception
+type ExceptionPolicy uint8
+
+const (
+	// ExceptionsInterrupt dispatches exceptions through the interrupt
+	// vector table like the real CPU. A fault whose vector still points at
+	// its BIOS stub stops Run with a diagnostic instead, as DOS ends a
+	// program on a divide error; traps without a handler return at once.
+	ExceptionsInterrupt ExceptionPolicy = iota
+
+	// ExceptionsStop stops Run with a diagnostic on every exception,
+	// including INT 3 and the single-step trap. A fault leaves CS:IP at
+	// the faulting instruction and a trap after the instruction, so Run
+	// can continue from a breakpoint or step on by one instruction.
+	ExceptionsStop
+)
+
+func (p ExceptionPolicy) String() string {
+	switch p {
+	case ExceptionsInterrupt:
+		return "interrupt"
+	case ExceptionsStop:
+		return "stop"
+	}
+	return fmt.Sprintf("ExceptionPolicy(%d)", uint8(p))
+}
+
+// ParseExceptionPolicy parses an exception policy name: "interrupt" or "stop"
+func ParseExceptionPolicy(name string) (ExceptionPolicy, error) {
+	switch strings.ToLower(name) {
+	case "interrupt":
+		return ExceptionsInterrupt, nil
+	case "stop":
+		return ExceptionsStop, nil
+	}
+	return 0, fmt.Errorf("unknown exception policy %q (expected interrupt or stop)", name)
+}
+
+// raise handles an exception raised by the instruction at cs:ip. Faults
+// return to the faulting instruction once the handler returns, except a
+// divide error on the 8086 and 80186, which returns after it.
+func (c *CPU) raise(e *Exception, cs, ip uint16) error {
+	if e.fault() {
+		e.CS, e.IP = cs, ip
+		if e.Vector != VectorDivideError || c.Model >= Model286 || c.Exceptions == ExceptionsStop {
+			c.CS, c.IP = cs, ip
+		}
+	} else {
+		e.CS, e.IP = c.CS, c.IP
+	}
+
+	if c.Exceptions == ExceptionsStop || (e.fault() && !c.hooked(e.Vector)) {
+		return e
+	}
+	c.Cycles += uint64(c.timing(OpINT).reg)
+	return c.Interrupt(e.Vector)
+}
+
+// hooked reports whether a program has pointed an interrupt vector away
+// from its BIOS stub
+func (c *CPU) hooked(vector uint8) bool {
+	segment, offset := c.GetInterruptVector(vector)
+	return segment != BIOSSegment || offset != biosStubOffset+uint16(vector)
+}
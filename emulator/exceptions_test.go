@@ -0,0 +1,200 @@
+package emulator
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// exceptionImage builds a .COM image that points an exception vector at a
+// handler at 0130h, then runs main from 0108h
+func exceptionImage(vector byte, main, handler []byte) []byte {
+	image := make([]byte, 0x30, 0x40)
+	copy(image, []byte{
+		0xBA, 0x30, 0x01, // 0100: MOV DX, 0130h
+		0xB8, vector, 0x25, // 0103: MOV AX, 25xxh (set vector)
+		0xCD, 0x21, // 0106: INT 21h
+	})
+	copy(image[8:], main)
+	return append(image, handler...)
+}
+
+// loadCOM loads a .COM image on a CPU of the given model
+func loadCOM(t *testing.T, model CPUModel, image []byte) *CPU {
+	t.Helper()
+	cpu := NewCPU()
+	cpu.Model = model
+	if err := cpu.LoadCOM(image); err != nil {
+		t.Fatalf("LoadCOM failed: %v", err)
+	}
+	return cpu
+}
+
+// divideByZero divides 100 by BL=0 and halts
+var divideByZero = []byte{
+	0xB8, 0x64, 0x00, // 0108: MOV AX, 100
+	0xB3, 0x00, // 010B: MOV BL, 0
+	0xF6, 0xF3, // 010D: DIV BL
+	0xF4, // 010F: HLT
+}
+
+// TestDivideError tests INT 0, which returns after the DIV on the 8086 and
+// 80186 and retries it on later models
+func TestDivideError(t *testing.T) {
+	handler := []byte{
+		0xB3, 0x05, // 0130: MOV BL, 5
+		0x41, // 0132: INC CX
+		0xCF, // 0133: IRET
+	}
+	image := exceptionImage(VectorDivideError, divideByZero, handler)
+
+	cpu := loadCOM(t, Model8086, image)
+	runUntilIdle(t, cpu)
+	if cpu.CX != 1 || cpu.AX != 100 || cpu.IP != 0x0110 {
+		t.Errorf("8086: expected the handler to run once and return past the DIV, got CX=%d AX=%d IP=%04X", cpu.CX, cpu.AX, cpu.IP)
+	}
+
+	cpu = loadCOM(t, Model286, image)
+	runUntilIdle(t, cpu)
+	if cpu.CX != 1 || cpu.AX != 20 {
+		t.Errorf("286: expected the DIV to be retried by 5, got CX=%d AX=%d", cpu.CX, cpu.AX)
+	}
+
+	// Without a handler the program stops at the DIV
+	cpu = loadCOM(t, Model286, append(make([]byte, 8), divideByZero...))
+	err := cpu.Run()
+	var exception *Exception
+	if !errors.As(err, &exception) || exception.Vector != VectorDivideError {
+		t.Fatalf("Expected a divide error, got %v", err)
+	}
+	if want := "divide error (INT 00h) at 1000:010D: division by zero"; err.Error() != want {
+		t.Errorf("Expected %q, got %q", want, err.Error())
+	}
+	if cpu.IP != 0x010D {
+		t.Errorf("Expected CS:IP at the DIV, got IP=%04X", cpu.IP)
+	}
+
+	// The stop policy stops even with a handler installed
+	cpu = loadCOM(t, Model8086, image)
+	cpu.Exceptions = ExceptionsStop
+	if err := cpu.Run(); err == nil || !strings.Contains(err.Error(), "divide error") || cpu.CX != 0 {
+		t.Errorf("Expected the stop policy to stop at the divide error, got %v with CX=%d", err, cpu.CX)
+	}
+}
+
+// TestInvalidOpcode tests INT 6 for an opcode the CPU model lacks, with a
+// handler that skips the opcode byte
+func TestInvalidOpcode(t *testing.T) {
+	main := []byte{
+		0x0F, // 0108: 80386 two-byte opcode escape
+		0x46, // 0109: INC SI
+		0xF4, // 010A: HLT
+	}
+	handler := []byte{
+		0x55,       // 0130: PUSH BP
+		0x89, 0xE5, // 0131: MOV BP, SP
+		0xFF, 0x46, 0x02, // 0133: INC WORD [BP+2]
+		0x5D, // 0136: POP BP
+		0x41, // 0137: INC CX
+		0xCF, // 0138: IRET
+	}
+	cpu := loadCOM(t, Model186, exceptionImage(VectorInvalidOpcode, main, handler))
+	runUntilIdle(t, cpu)
+	if cpu.CX != 1 || cpu.SI != 1 {
+		t.Errorf("Expected the handler to skip the opcode, got CX=%d SI=%d", cpu.CX, cpu.SI)
+	}
+
+	cpu = loadCOM(t, Model186, []byte{0x90, 0x60, 0x0F, 0xF4})
+	if err := cpu.Run(); err == nil || !strings.HasPrefix(err.Error(), "invalid opcode (INT 06h) at 1000:0102") {
+		t.Errorf("Expected an unhandled invalid opcode at 0102h, got %v", err)
+	}
+}
+
+// TestSingleStep tests the INT 1 trap after each instruction that starts
+// with TF set, including the POPF that clears it
+func TestSingleStep(t *testing.T) {
+	main := []byte{
+		0x9C,             // 0108: PUSHF
+		0x58,             // 0109: POP AX
+		0x80, 0xCC, 0x01, // 010A: OR AH, 1 (TF)
+		0x50,             // 010D: PUSH AX
+		0x9D,             // 010E: POPF
+		0x90,             // 010F: NOP
+		0x90,             // 0110: NOP
+		0x9C,             // 0111: PUSHF
+		0x58,             // 0112: POP AX
+		0x80, 0xE4, 0xFE, // 0113: AND AH, FEh
+		0x50, // 0116: PUSH AX
+		0x9D, // 0117: POPF
+		0xF4, // 0118: HLT
+	}
+	handler := []byte{
+		0x41, // 0130: INC CX
+		0xCF, // 0131: IRET
+	}
+	image := exceptionImage(VectorSingleStep, main, handler)
+
+	cpu := loadCOM(t, Model8086, image)
+	runUntilIdle(t, cpu)
+	if cpu.CX != 7 || cpu.Flags.TF {
+		t.Errorf("Expected 7 traps and TF clear, got CX=%d TF=%v", cpu.CX, cpu.Flags.TF)
+	}
+
+	// The stop policy returns after each traced instruction
+	cpu = loadCOM(t, Model8086, image)
+	cpu.Exceptions = ExceptionsStop
+	for _, ip := range []uint16{0x0110, 0x0111, 0x0112} {
+		err := cpu.Run()
+		if err == nil || !strings.Contains(err.Error(), "single-step trap") || cpu.IP != ip {
+			t.Errorf("Expected a single-step stop at %04X, got %v at %04X", ip, err, cpu.IP)
+		}
+	}
+}
+
+// TestBreakpoint tests INT 3 through a handler and as a stop under the stop
+// policy, from which Run continues
+func TestBreakpoint(t *testing.T) {
+	main := []byte{
+		0xCC, // 0108: INT 3
+		0x46, // 0109: INC SI
+		0xF4, // 010A: HLT
+	}
+	handler := []byte{
+		0x41, // 0130: INC CX
+		0xCF, // 0131: IRET
+	}
+	cpu := loadCOM(t, Model8086, exceptionImage(VectorBreakpoint, main, handler))
+	runUntilIdle(t, cpu)
+	if cpu.CX != 1 || cpu.SI != 1 {
+		t.Errorf("Expected the handler to run once, got CX=%d SI=%d", cpu.CX, cpu.SI)
+	}
+
+	// Without a handler INT 3 returns at once
+	cpu = runCOM(t, main)
+	if cpu.SI != 1 {
+		t.Errorf("Expected INT 3 without a handler to continue, got SI=%d", cpu.SI)
+	}
+
+	cpu = loadCOM(t, Model8086, main)
+	cpu.Exceptions = ExceptionsStop
+	err := cpu.Run()
+	if err == nil || err.Error() != "breakpoint (INT 03h) at 1000:0101" {
+		t.Fatalf("Expected a breakpoint at 0101h, got %v", err)
+	}
+	runUntilIdle(t, cpu)
+	if cpu.SI != 1 {
+		t.Errorf("Expected Run to continue after the breakpoint, got SI=%d", cpu.SI)
+	}
+}
+
+// TestParseExceptionPolicy tests the names of the exception policies
+func TestParseExceptionPolicy(t *testing.T) {
+	for _, policy := range []ExceptionPolicy{ExceptionsInterrupt, ExceptionsStop} {
+		if got, err := ParseExceptionPolicy(strings.ToUpper(policy.String())); err != nil || got != policy {
+			t.Errorf("ParseExceptionPolicy(%s): got %v, %v", policy, got, err)
+		}
+	}
+	if _, err := ParseExceptionPolicy("ignore"); err == nil {
+		t.Error("Expected an error for an unknown policy")
+	}
+}
@@ -0,0 +1,500 @@
+package emulator
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"strings"
+)
+
+// FPU emulates the x87 floating-point coprocessor: the 8087 of the 8086 and
+// 80186, the 80287, the 80387 and the FPU built into the 486. Its eight
+// 80-bit registers form a stack whose top is the TOP field of the status
+// word; ST(i) is physical register (TOP+i) mod 8.
+//
+// Exceptions always get the masked response (a NaN, infinity or denormal
+// result), as with the control word FINIT loads. An exception that is
+// unmasked also sets ES and B in the status word, but does not interrupt
+// the CPU.
+type FPU struct {
+	regs    [8]Float80 // Physical registers
+	Control uint16     // Control word: exception masks, precision and rounding control
+	Status  uint16     // Status word: exception flags, condition codes and TOP
+	Tag     uint16     // Tag word: two bits per physical register
+}
+
+// Status word bits
+const (
+	fpuIE uint16 = 1 << 0  // Invalid operation
+	fpuDE uint16 = 1 << 1  // Denormal operand
+	fpuZE uint16 = 1 << 2  // Division by zero
+	fpuOE uint16 = 1 << 3  // Overflow
+	fpuUE uint16 = 1 << 4  // Underflow
+	fpuPE uint16 = 1 << 5  // Precision (inexact result)
+	fpuSF uint16 = 1 << 6  // Stack fault: IE caused by stack overflow or underflow
+	fpuES uint16 = 1 << 7  // Error summary: an unmasked exception is pending
+	fpuC0 uint16 = 1 << 8  // Condition code 0
+	fpuC1 uint16 = 1 << 9  // Condition code 1
+	fpuC2 uint16 = 1 << 10 // Condition code 2
+	fpuC3 uint16 = 1 << 14 // Condition code 3
+	fpuB  uint16 = 1 << 15 // Busy
+
+	fpuExceptions = fpuIE | fpuDE | fpuZE | fpuOE | fpuUE | fpuPE
+	fpuConditions = fpuC0 | fpuC1 | fpuC2 | fpuC3
+	fpuTopShift   = 11
+)
+
+// Tag word values of a register
+const (
+	tagValid   = 0
+	tagZero    = 1
+	tagSpecial = 2 // NaN, infinity or denormal
+	tagEmpty   = 3
+)
+
+// fpuControlInit is the control word after FINIT: all exceptions masked,
+// 64-bit precision, round to nearest
+const fpuControlInit uint16 = 0x037F
+
+// Init puts the FPU in the state FINIT leaves: the default control word,
+// a clear status word with TOP = 0 and all registers empty
+func (f *FPU) Init() {
+	f.Control = fpuControlInit
+	f.Status = 0
+	f.Tag = 0xFFFF
+}
+
+// ST returns register ST(i). An empty register reads as zero.
+func (f *FPU) ST(i int) Float80 {
+	return f.regs[f.physical(i)]
+}
+
+// IsEmpty reports whether register ST(i) is empty
+func (f *FPU) IsEmpty(i int) bool {
+	return f.tag(f.physical(i)) == tagEmpty
+}
+
+// String lists the registers in use from ST(0) up, or returns "" when the
+// register stack is empty
+func (f *FPU) String() string {
+	var regs []string
+	for i := 0; i < 8; i++ {
+		if !f.IsEmpty(i) {
+			regs = append(regs, fmt.Sprintf("ST%d:%g", i, f.ST(i).Float64()))
+		}
+	}
+	if len(regs) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%s FSW:%04X FCW:%04X", strings.Join(regs, " "), f.Status, f.Control)
+}
+
+func (f *FPU) top() int {
+	return int(f.Status>>fpuTopShift) & 7
+}
+
+func (f *FPU) setTop(top int) {
+	f.Status = f.Status&^(7<<fpuTopShift) | uint16(top&7)<<fpuTopShift
+}
+
+func (f *FPU) physical(i int) int {
+	return (f.top() + i) & 7
+}
+
+func (f *FPU) tag(reg int) int {
+	return int(f.Tag>>(2*reg)) & 3
+}
+
+func (f *FPU) setTag(reg, tag int) {
+	f.Tag = f.Tag&^(3<<(2*reg)) | uint16(tag)<<(2*reg)
+}
+
+// raise records exceptions, and condition code C1 when it is included.
+// An unmasked exception also sets the error summary and busy bits.
+func (f *FPU) raise(flags uint16) {
+	f.Status |= flags
+	if flags&fpuExceptions&^f.Control != 0 {
+		f.Status |= fpuES | fpuB
+	}
+}
+
+// setConditions sets C3, C2, C1 and C0 to the given bits
+func (f *FPU) setConditions(flags uint16) {
+	f.Status = f.Status&^fpuConditions | flags&fpuConditions
+}
+
+// get returns ST(i). Reading an empty register is a stack underflow, which
+// returns the indefinite NaN and false.
+func (f *FPU) get(i int) (Float80, bool) {
+	if f.IsEmpty(i) {
+		f.Status &^= fpuC1
+		f.raise(fpuIE | fpuSF)
+		return float80Indefinite, false
+	}
+	return f.ST(i), true
+}
+
+// set stores a value in ST(i) and tags the register by its contents
+func (f *FPU) set(i int, v Float80) {
+	reg := f.physical(i)
+	f.regs[reg] = v
+	f.setTag(reg, v.tag())
+}
+
+// push pushes a value onto the register stack. Pushing onto a full stack is
+// a stack overflow, which pushes the indefinite NaN instead.
+func (f *FPU) push(v Float80) {
+	if !f.IsEmpty(7) {
+		f.raise(fpuIE | fpuSF | fpuC1)
+		v = float80Indefinite
+	}
+	f.setTop(f.top() - 1)
+	f.set(0, v)
+}
+
+// pop marks ST(0) empty and increments TOP
+func (f *FPU) pop() {
+	f.setTag(f.physical(0), tagEmpty)
+	f.setTop(f.top() + 1)
+}
+
+// precision returns the significand width selected by the precision
+// control field: 24, 53 or 64 bits
+func (f *FPU) precision() uint {
+	switch (f.Control >> 8) & 3 {
+	case 0:
+		return 24
+	case 2:
+		return 53
+	}
+	return 64
+}
+
+// rounding returns the rounding mode selected by the rounding control field
+func (f *FPU) rounding() big.RoundingMode {
+	return [4]big.RoundingMode{big.ToNearestEven, big.ToNegativeInf, big.ToPositiveInf, big.ToZero}[(f.Control>>10)&3]
+}
+
+// round rounds an exact result to the precision and rounding mode of the
+// control word and records the exceptions it raises
+func (f *FPU) round(x *big.Float) Float80 {
+	v, flags := roundFloat80(x, f.precision(), f.rounding())
+	f.raise(flags)
+	return v
+}
+
+// Float80 is an 80-bit extended precision value in the x87 register format:
+// a sign bit, a 15-bit biased exponent and a 64-bit significand whose
+// integer bit is explicit
+type Float80 struct {
+	Mant uint64 // Significand, integer bit in bit 63
+	SE   uint16 // Sign in bit 15, biased exponent in bits 0-14
+}
+
+const (
+	float80Bias   = 16383
+	float80MaxExp = 0x7FFF
+	float80Sign   = 0x8000
+
+	// float80MinScale is the power of two of the lowest significand bit of
+	// a denormal (and of a normal number with the smallest exponent)
+	float80MinScale = 1 - float80Bias - 63
+)
+
+// float80Indefinite is the quiet NaN that masked invalid operations return
+var float80Indefinite = Float80{Mant: 0xC000000000000000, SE: 0xFFFF}
+
+// Float80FromBytes decodes a value stored little-endian in ten bytes
+func Float80FromBytes(b [10]byte) Float80 {
+	var v Float80
+	for i := 7; i >= 0; i-- {
+		v.Mant = v.Mant<<8 | uint64(b[i])
+	}
+	v.SE = uint16(b[8]) | uint16(b[9])<<8
+	return v
+}
+
+// Bytes returns the value as stored little-endian in memory
+func (v Float80) Bytes() [10]byte {
+	var b [10]byte
+	for i := 0; i < 8; i++ {
+		b[i] = byte(v.Mant >> (8 * i))
+	}
+	b[8], b[9] = byte(v.SE), byte(v.SE>>8)
+	return b
+}
+
+// Float80FromFloat64 converts a float64, which is always exact
+func Float80FromFloat64(x float64) Float80 {
+	if math.IsNaN(x) {
+		bits := math.Float64bits(x)
+		return Float80{Mant: 1<<63 | bits<<11, SE: uint16(bits>>48)&float80Sign | float80MaxExp}
+	}
+	v, _ := roundFloat80(new(big.Float).SetFloat64(x), 64, big.ToNearestEven)
+	return v
+}
+
+// ParseFloat80 parses a decimal floating-point number such as "3.14",
+// "-2.5e-3" or "1e10", rounded to nearest in 80-bit extended precision
+func ParseFloat80(s string) (Float80, error) {
+	x, _, err := big.ParseFloat(s, 10, 64, big.ToNearestEven)
+	if err != nil {
+		return Float80{}, fmt.Errorf("invalid floating-point number: %s", s)
+	}
+	v, flags := roundFloat80(x, 64, big.ToNearestEven)
+	if flags&fpuOE != 0 {
+		return Float80{}, fmt.Errorf("floating-point number out of range: %s", s)
+	}
+	return v, nil
+}
+
+// Float64 returns the value rounded to the nearest float64
+func (v Float80) Float64() float64 {
+	switch {
+	case v.isNaN():
+		return math.NaN()
+	case v.isInf():
+		return math.Inf(v.signValue())
+	}
+	x, _ := v.big().Float64()
+	return x
+}
+
+// Float32 rounds the value to a float32 in the given rounding mode, and
+// reports whether the result is inexact
+func (v Float80) Float32(mode big.RoundingMode) (float32, bool) {
+	switch {
+	case v.isNaN():
+		bits := uint32(v.SE&float80Sign)<<16 | 0x7F800000 | uint32(v.Mant>>40)&0x7FFFFF | 0x400000
+		return math.Float32frombits(bits), false
+	case v.isInf():
+		return float32(math.Inf(v.signValue())), false
+	}
+	x := new(big.Float).SetMode(mode).SetPrec(24).Set(v.big())
+	r, acc := x.Float32()
+	return r, acc != big.Exact || x.Acc() != big.Exact
+}
+
+// float64Rounded rounds the value to a float64 in the given rounding mode,
+// and reports whether the result is inexact
+func (v Float80) float64Rounded(mode big.RoundingMode) (float64, bool) {
+	if v.isNaN() || v.isInf() {
+		return v.Float64(), false
+	}
+	x := new(big.Float).SetMode(mode).SetPrec(53).Set(v.big())
+	r, acc := x.Float64()
+	return r, acc != big.Exact || x.Acc() != big.Exact
+}
+
+func (v Float80) exponent() int {
+	return int(v.SE & float80MaxExp)
+}
+
+func (v Float80) negative() bool {
+	return v.SE&float80Sign != 0
+}
+
+func (v Float80) signValue() int {
+	if v.negative() {
+		return -1
+	}
+	return 1
+}
+
+func (v Float80) isNaN() bool {
+	return v.exponent() == float80MaxExp && v.Mant<<1 != 0
+}
+
+// isSNaN reports whether the value is a signaling NaN, whose most
+// significant fraction bit is clear
+func (v Float80) isSNaN() bool {
+	return v.isNaN() && v.Mant&(1<<62) == 0
+}
+
+func (v Float80) isInf() bool {
+	return v.exponent() == float80MaxExp && v.Mant<<1 == 0
+}
+
+func (v Float80) isZero() bool {
+	return v.Mant == 0 && v.exponent() != float80MaxExp
+}
+
+func (v Float80) isDenormal() bool {
+	return v.exponent() == 0 && v.Mant != 0
+}
+
+func (v Float80) tag() int {
+	switch {
+	case v.isZero():
+		return tagZero
+	case v.exponent() == float80MaxExp || v.isDenormal():
+		return tagSpecial
+	}
+	return tagValid
+}
+
+func (v Float80) neg() Float80 {
+	v.SE ^= float80Sign
+	return v
+}
+
+func (v Float80) abs() Float80 {
+	v.SE &^= float80Sign
+	return v
+}
+
+// quiet returns a NaN with its quiet bit set
+func (v Float80) quiet() Float80 {
+	v.Mant |= 1 << 62
+	return v
+}
+
+// infinity returns an infinity with the given sign
+func infinity(negative bool) Float80 {
+	return signed(Float80{Mant: 1 << 63, SE: float80MaxExp}, negative)
+}
+
+// zero returns a zero with the given sign
+func zero(negative bool) Float80 {
+	return signed(Float80{}, negative)
+}
+
+func signed(v Float80, negative bool) Float80 {
+	if negative {
+		v.SE |= float80Sign
+	}
+	return v
+}
+
+// scale returns the power of two of the lowest significand bit, so the
+// value is Mant * 2^scale
+func (v Float80) scale() int {
+	e := v.exponent()
+	if e == 0 {
+		e = 1 // Denormals share the scale of the smallest exponent
+	}
+	return e - float80Bias - 63
+}
+
+// big returns the exact value of a finite number or an infinity
+func (v Float80) big() *big.Float {
+	if v.isInf() {
+		return new(big.Float).SetInf(v.negative())
+	}
+	x := new(big.Float).SetUint64(v.Mant)
+	x.SetMantExp(x, v.scale())
+	if v.negative() {
+		x.Neg(x)
+	}
+	return x
+}
+
+// roundFloat80 rounds x to a significand of prec bits in the given mode and
+// encodes it. It returns the exceptions raised, with C1 when the magnitude
+// was rounded up. Results too large for the exponent become infinities or
+// the largest finite number, depending on the mode; results too small are
+// denormalized.
+func roundFloat80(x *big.Float, prec uint, mode big.RoundingMode) (Float80, uint16) {
+	negative := x.Signbit()
+	switch {
+	case x.IsInf():
+		return infinity(negative), 0
+	case x.Sign() == 0:
+		return zero(negative), 0
+	}
+
+	r := new(big.Float).SetMode(mode).SetPrec(prec).Set(x)
+	exp := r.MantExp(nil) // |r| is in [2^(exp-1), 2^exp)
+	biased := exp - 1 + float80Bias
+
+	if biased >= float80MaxExp {
+		// Overflow: round to nearest and away from zero give an infinity,
+		// the other directions the largest finite number
+		flags := fpuOE | fpuPE
+		up := mode == big.ToNearestEven || mode == big.AwayFromZero ||
+			(mode == big.ToPositiveInf && !negative) || (mode == big.ToNegativeInf && negative)
+		if up {
+			return infinity(negative), flags | fpuC1
+		}
+		return signed(Float80{Mant: ^uint64(0) << (64 - prec), SE: float80MaxExp - 1}, negative), flags
+	}
+
+	var flags uint16
+	if biased < 1 {
+		// Tiny: only the bits down to the denormal scale remain
+		bits := x.MantExp(nil) - float80MinScale
+		if bits <= 0 {
+			flags = fpuUE | fpuPE
+			if (mode == big.ToPositiveInf && !negative) || (mode == big.ToNegativeInf && negative) {
+				return signed(Float80{Mant: 1}, negative), flags | fpuC1
+			}
+			return zero(negative), flags
+		}
+		if uint(bits) < prec {
+			prec = uint(bits)
+		}
+		r.SetPrec(prec).Set(x)
+		if r.Acc() != big.Exact {
+			flags |= fpuUE
+		}
+	}
+	if r.Acc() != big.Exact {
+		flags |= fpuPE
+		if (r.Acc() == big.Above) != negative {
+			flags |= fpuC1
+		}
+	}
+
+	// Both normal and denormal significands are an integer multiple of the
+	// scale of their exponent
+	exp = r.MantExp(nil)
+	biased = exp - 1 + float80Bias
+	shift := 64 - exp // 2^(exp-1) becomes bit 63
+	if biased < 1 {
+		biased = 0
+		shift = -float80MinScale
+	}
+	m := new(big.Float).SetMantExp(r, shift)
+	m.Abs(m)
+	mant, _ := m.Uint64()
+	v := Float80{Mant: mant, SE: uint16(biased)}
+	if biased == 0 && mant>>63 != 0 {
+		v.SE = 1 // Rounded up to the smallest normal number
+	}
+	return signed(v, negative), flags
+}
+
+// float80FromInt converts an integer, which is always exact
+func float80FromInt(n int64) Float80 {
+	v, _ := roundFloat80(new(big.Float).SetInt64(n), 64, big.ToNearestEven)
+	return v
+}
+
+// roundToInt rounds a finite value to an integer in the given mode and
+// reports whether it had a fractional part
+func roundToInt(x *big.Float, mode big.RoundingMode) (*big.Int, bool) {
+	n, acc := x.Int(nil) // Truncated toward zero
+	if acc == big.Exact {
+		return n, false
+	}
+	frac := new(big.Float).Sub(x, new(big.Float).SetInt(n))
+	away := false
+	switch mode {
+	case big.ToNegativeInf:
+		away = x.Sign() < 0
+	case big.ToPositiveInf:
+		away = x.Sign() > 0
+	case big.ToNearestEven:
+		frac.Abs(frac)
+		switch frac.Cmp(big.NewFloat(0.5)) {
+		case 1:
+			away = true
+		case 0:
+			away = n.Bit(0) == 1
+		}
+	}
+	if away {
+		n.Add(n, big.NewInt(int64(x.Sign())))
+	}
+	return n, true
+}
@@ -0,0 +1,237 @@
+package emulator
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+// fpu assembles one bytecode x87 instruction from its operation and operands
+func fpu(op FPUOp, operands ...[]byte) []byte {
+	return code(OpFPU, append([][]byte{{byte(op)}}, operands...)...)
+}
+
+// st returns the bytecode operand ST(i)
+func st(i byte) []byte { return []byte{byte(OpTypeST), i} }
+
+// Bytecode memory operands of the x87 tests
+var (
+	opWord200  = []byte{byte(OpTypeMem), 0x00, 0x02}                    // WORD [0200h]
+	opQword200 = []byte{byte(OpTypeQword), byte(OpTypeMem), 0x00, 0x02} // QWORD [0200h]
+	opTword200 = []byte{byte(OpTypeTword), byte(OpTypeMem), 0x00, 0x02} // TBYTE [0200h]
+)
+
+// runFPU runs bytecode until HLT with the given words stored from 0200h
+func runFPU(t *testing.T, model CPUModel, program []byte, words ...uint16) *CPU {
+	t.Helper()
+	cpu := NewCPU()
+	cpu.Model = model
+	copy(cpu.Memory.RAM, append(program, byte(OpHLT)))
+	for i, w := range words {
+		cpu.Memory.WriteWordLinear(0x200+uint32(2*i), w)
+	}
+	if err := cpu.Run(); err != nil {
+		t.Fatalf("CPU.Run() failed: %v", err)
+	}
+	return cpu
+}
+
+// TestFloat80 tests conversions between the 80-bit extended format, its
+// memory image and float64
+func TestFloat80(t *testing.T) {
+	tests := []struct {
+		text string
+		want Float80
+	}{
+		{"1", Float80{Mant: 0x8000000000000000, SE: 0x3FFF}},
+		{"-2.5", Float80{Mant: 0xA000000000000000, SE: 0xC000}},
+		{"0.1", Float80{Mant: 0xCCCCCCCCCCCCCCCD, SE: 0x3FFB}},
+		{"3.14159265358979323846", fpuConstants[OpFLDPI]},
+		{"0", Float80{}},
+	}
+	for _, tt := range tests {
+		got, err := ParseFloat80(tt.text)
+		if err != nil || got != tt.want {
+			t.Errorf("ParseFloat80(%s): expected %04X:%016X, got %04X:%016X (%v)", tt.text, tt.want.SE, tt.want.Mant, got.SE, got.Mant, err)
+		}
+		if back := Float80FromBytes(got.Bytes()); back != got {
+			t.Errorf("%s: memory image round trip gave %04X:%016X", tt.text, back.SE, back.Mant)
+		}
+	}
+
+	if b := Float80FromFloat64(1.5).Bytes(); b != [10]byte{0, 0, 0, 0, 0, 0, 0, 0xC0, 0xFF, 0x3F} {
+		t.Errorf("Expected the memory image of 1.5, got % X", b)
+	}
+	for _, x := range []float64{0.1, -1e300, 5e-324, math.Inf(-1)} {
+		if got := Float80FromFloat64(x).Float64(); got != x {
+			t.Errorf("Expected %g to convert exactly, got %g", x, got)
+		}
+	}
+	if !math.IsNaN(float80Indefinite.Float64()) {
+		t.Error("Expected the indefinite to convert to NaN")
+	}
+}
+
+// TestFPUInstructions tests x87 arithmetic, rounding and the exception flags
+func TestFPUInstructions(t *testing.T) {
+	tests := []struct {
+		name   string
+		inst   []byte
+		words  []uint16 // Memory from 0200h
+		want   float64  // ST0
+		status uint16   // Status bits that must be set
+	}{
+		{"FADDP", join(fpu(OpFLD1), fpu(OpFLD1), fpu(OpFADDP, st(1), st(0))), nil, 2, 0},
+		{"FSUBR", join(fpu(OpFLD1), fpu(OpFLDZ), fpu(OpFSUBR, st(0), st(1))), nil, 1, 0},
+		{"FDIV by zero", join(fpu(OpFLD1), fpu(OpFLDZ), fpu(OpFDIVP, st(1), st(0))), nil, math.Inf(1), fpuZE},
+		{"FILD word", fpu(OpFILD, opWord200), []uint16{0xFFFB}, -5, 0},
+		{"FILD qword", fpu(OpFILD, opQword200), []uint16{0, 0, 0, 0x8000}, math.MinInt64, 0},
+		{"FLD double", fpu(OpFLD, opQword200), []uint16{0, 0, 0, 0x4004}, 2.5, 0},
+		{"FLD single", fpu(OpFLD, opDword200), []uint16{0, 0xC020}, -2.5, 0},
+		{"FLD extended", fpu(OpFLD, opTword200), []uint16{0, 0, 0, 0xC000, 0x3FFF}, 1.5, 0},
+		{"FIMUL", join(fpu(OpFLDPI), fpu(OpFIMUL, st(0), opWord200)), []uint16{2}, 2 * math.Pi, 0},
+		{"FRNDINT to even", join(fpu(OpFLD, opQword200), fpu(OpFRNDINT)), []uint16{0, 0, 0, 0x4004}, 2, fpuPE},
+		{"FRNDINT rounding up", join(fpu(OpFLDCW, opWord200), fpu(OpFLD1), fpu(OpFCHS), fpu(OpFLD, opDword200),
+			fpu(OpFRNDINT)), []uint16{0x0B7F, 0x3E00}, 1, fpuPE},
+		{"FSQRT of -1", join(fpu(OpFLD1), fpu(OpFCHS), fpu(OpFSQRT)), nil, math.NaN(), fpuIE},
+		{"Stack underflow", fpu(OpFADDP, st(1), st(0)), nil, math.NaN(), fpuIE | fpuSF},
+		{"FPREM", join(fpu(OpFLD1), fpu(OpFLDPI), fpu(OpFPREM)), nil, math.Pi - 3, 0},
+		{"FSCALE", join(fpu(OpFLD1), fpu(OpFLD1), fpu(OpFADDP, st(1), st(0)), fpu(OpFLD1), fpu(OpFSCALE)), nil, 4, 0},
+		{"FXTRACT", join(fpu(OpFILD, opWord200), fpu(OpFXTRACT), fpu(OpFSTP, st(0))), []uint16{40}, 5, 0},
+		{"FXCH", join(fpu(OpFLD1), fpu(OpFLDZ), fpu(OpFXCH, st(1))), nil, 1, 0},
+		{"FCOS", join(fpu(OpFLDZ), fpu(OpFCOS)), nil, 1, 0},
+		{"F2XM1", join(fpu(OpFLD1), fpu(OpFCHS), fpu(OpF2XM1)), nil, -0.5, 0},
+		{"FYL2X", join(fpu(OpFLD1), fpu(OpFILD, opWord200), fpu(OpFYL2X)), []uint16{8}, 3, 0},
+		{"FPATAN", join(fpu(OpFLD1), fpu(OpFLD1), fpu(OpFPATAN)), nil, math.Pi / 4, fpuPE},
+	}
+
+	for _, tt := range tests {
+		cpu := runFPU(t, Model486, tt.inst, tt.words...)
+		got := cpu.FPU.ST(0).Float64()
+		if got != tt.want && !(math.IsNaN(got) && math.IsNaN(tt.want)) && math.Abs(got-tt.want) > 1e-15 {
+			t.Errorf("%s: expected ST0=%g, got %g", tt.name, tt.want, got)
+		}
+		if cpu.FPU.Status&tt.status != tt.status {
+			t.Errorf("%s: expected status bits %04X, got FSW=%04X", tt.name, tt.status, cpu.FPU.Status)
+		}
+	}
+}
+
+// TestFPUExactResults tests results that the 64-bit significand and the
+// rounding to the memory formats fix exactly
+func TestFPUExactResults(t *testing.T) {
+	// sqrt(2) to 64 bits, then 1/3 rounded to a double
+	program := join(
+		fpu(OpFLD1), fpu(OpFLD1), fpu(OpFADDP, st(1), st(0)), fpu(OpFSQRT),
+		fpu(OpFLD1), fpu(OpFILD, opWord200), fpu(OpFDIVP, st(1), st(0)),
+		fpu(OpFST, opQword200),
+	)
+	cpu := runFPU(t, Model8086, program, 3)
+	if got := cpu.FPU.ST(1); got != (Float80{Mant: 0xB504F333F9DE6484, SE: 0x3FFF}) {
+		t.Errorf("Expected sqrt(2) = 3FFF:B504F333F9DE6484, got %04X:%016X", got.SE, got.Mant)
+	}
+	var bits uint64
+	for i := uint32(0); i < 4; i++ {
+		bits |= uint64(cpu.Memory.ReadWordLinear(0x200+2*i)) << (16 * i)
+	}
+	if bits != math.Float64bits(1.0/3) {
+		t.Errorf("Expected 1/3 stored as %016X, got %016X", math.Float64bits(1.0/3), bits)
+	}
+
+	// FIST rounds by the control word and stores the integer indefinite
+	// when the value does not fit
+	program = join(fpu(OpFLD, opDword200), fpu(OpFIST, opWord200), fpu(OpFILD, opQword200), fpu(OpFISTP, opWord200))
+	cpu = runFPU(t, Model8086, program, 0, 0x3FE0)
+	if w := cpu.Memory.ReadWordLinear(0x200); w != 0x8000 {
+		t.Errorf("Expected the integer indefinite, got %04X", w)
+	}
+	if cpu.FPU.Status&fpuIE == 0 || cpu.FPU.ST(0).Float64() != 1.75 {
+		t.Errorf("Expected IE and ST0=1.75, got FSW=%04X ST0=%g", cpu.FPU.Status, cpu.FPU.ST(0).Float64())
+	}
+}
+
+// TestFPUCompare tests the condition codes set by the compares and FXAM and
+// their transfer to AX with FSTSW
+func TestFPUCompare(t *testing.T) {
+	tests := []struct {
+		name string
+		inst []byte
+		want uint16 // C3, C2 and C0 in AH
+	}{
+		{"FCOM less", join(fpu(OpFLD1), fpu(OpFLDZ), fpu(OpFCOM, st(1))), 0x01},
+		{"FCOM greater", join(fpu(OpFLDZ), fpu(OpFLD1), fpu(OpFCOM, st(1))), 0x00},
+		{"FCOMPP equal", join(fpu(OpFLD1), fpu(OpFLD1), fpu(OpFCOMPP)), 0x40},
+		{"FTST negative", join(fpu(OpFLD1), fpu(OpFCHS), fpu(OpFTST)), 0x01},
+		{"FUCOM unordered", join(fpu(OpFLD1), fpu(OpFCHS), fpu(OpFSQRT), fpu(OpFUCOM, st(0))), 0x45},
+		{"FXAM empty", fpu(OpFXAM), 0x41},
+		{"FXAM zero", join(fpu(OpFLDZ), fpu(OpFXAM)), 0x40},
+		{"FXAM normal", join(fpu(OpFLD1), fpu(OpFXAM)), 0x04},
+	}
+	for _, tt := range tests {
+		cpu := runFPU(t, Model386, join(tt.inst, fpu(OpFSTSW, opAX)))
+		if got := cpu.GetAH() & 0x45; uint16(got) != tt.want {
+			t.Errorf("%s: expected C3 C2 C0 = %02X, got %02X", tt.name, tt.want, got)
+		}
+	}
+}
+
+// TestFPUControl tests FINIT, the control word, the stack pointer and the
+// register display
+func TestFPUControl(t *testing.T) {
+	cpu := NewCPU()
+	if cpu.FPU.Control != 0x037F || cpu.FPU.Tag != 0xFFFF || cpu.FPU.String() != "" {
+		t.Errorf("Expected an initialized, empty FPU, got FCW=%04X FTW=%04X %q", cpu.FPU.Control, cpu.FPU.Tag, cpu.FPU.String())
+	}
+
+	program := join(fpu(OpFLD1), fpu(OpFSTCW, opWord200), fpu(OpFDECSTP), fpu(OpFFREE, st(1)), fpu(OpFINCSTP))
+	cpu = runFPU(t, Model8086, program)
+	if w := cpu.Memory.ReadWordLinear(0x200); w != 0x037F {
+		t.Errorf("Expected FSTCW to store 037Fh, got %04X", w)
+	}
+	if !cpu.FPU.IsEmpty(0) {
+		t.Error("Expected FFREE to empty the register FLD1 loaded")
+	}
+	if strings.Contains(cpu.String(), "FCW") {
+		t.Errorf("Expected no FPU line while the stack is empty, got %q", cpu.String())
+	}
+
+	cpu = runFPU(t, Model8086, fpu(OpFLD1))
+	if !strings.HasSuffix(cpu.String(), "\nST0:1 FSW:3800 FCW:037F") {
+		t.Errorf("Expected the FPU in the register display, got %q", cpu.String())
+	}
+
+	cpu = runFPU(t, Model8086, join(fpu(OpFLD1), fpu(OpFINIT)))
+	if !cpu.FPU.IsEmpty(0) || cpu.FPU.Status != 0 {
+		t.Errorf("Expected FINIT to empty the stack, got FSW=%04X", cpu.FPU.Status)
+	}
+}
+
+// TestFPUCPULevel tests that the x87 instructions follow the coprocessor of
+// each CPU model
+func TestFPUCPULevel(t *testing.T) {
+	tests := []struct {
+		name  string
+		inst  []byte
+		model CPUModel
+	}{
+		{"FSQRT", join(fpu(OpFLD1), fpu(OpFSQRT)), Model8086},
+		{"FSTSW mem", fpu(OpFSTSW, opWord200), Model8086},
+		{"FSTSW AX", fpu(OpFSTSW, opAX), Model286},
+		{"FSIN", join(fpu(OpFLDZ), fpu(OpFSIN)), Model386},
+		{"FUCOMPP", join(fpu(OpFLDZ), fpu(OpFLDZ), fpu(OpFUCOMPP)), Model386},
+	}
+	for _, tt := range tests {
+		for model := Model8086; model < modelCount; model++ {
+			cpu := NewCPU()
+			cpu.Model = model
+			copy(cpu.Memory.RAM, append(tt.inst, byte(OpHLT)))
+			err := cpu.Run()
+			switch {
+			case model < tt.model && (err == nil || !strings.Contains(err.Error(), "coprocessor")):
+				t.Errorf("%s on %s: expected a coprocessor error, got %v", tt.name, model, err)
+			case model >= tt.model && err != nil:
+				t.Errorf("%s on %s: CPU.Run() failed: %v", tt.name, model, err)
+			}
+		}
+	}
+}
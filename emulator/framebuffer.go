@@ -0,0 +1,127 @@
+package emulator
+
+import (
+	"image"
+	"image/color"
+)
+
+const (
+	// Mode 13h resolution
+	ScreenWidth  = 320
+	ScreenHeight = 200
+
+	// Largest screen of the unchained 256-colour modes, such as 360x480
+	// Mode X
+	MaxScreenWidth  = 360
+	MaxScreenHeight = 480
+)
+
+// DefaultPalette returns the standard VGA default palette, which the display
+// shows for DAC entries the program has not set
+func DefaultPalette() [256]color.RGBA {
+	var palette [256]color.RGBA
+
+	// Standard VGA 16-color palette (EGA compatible)
+	// These are the default colors 0-15
+	palette[0] = color.RGBA{0, 0, 0, 255}        // Black
+	palette[1] = color.RGBA{0, 0, 170, 255}      // Blue
+	palette[2] = color.RGBA{0, 170, 0, 255}      // Green
+	palette[3] = color.RGBA{0, 170, 170, 255}    // Cyan
+	palette[4] = color.RGBA{170, 0, 0, 255}      // Red
+	palette[5] = color.RGBA{170, 0, 170, 255}    // Magenta
+	palette[6] = color.RGBA{170, 85, 0, 255}     // Brown
+	palette[7] = color.RGBA{170, 170, 170, 255}  // Light Gray
+	palette[8] = color.RGBA{85, 85, 85, 255}     // Dark Gray
+	palette[9] = color.RGBA{85, 85, 255, 255}    // Light Blue
+	palette[10] = color.RGBA{85, 255, 85, 255}   // Light Green
+	palette[11] = color.RGBA{85, 255, 255, 255}  // Light Cyan
+	palette[12] = color.RGBA{255, 85, 85, 255}   // Light Red
+	palette[13] = color.RGBA{255, 85, 255, 255}  // Light Magenta
+	palette[14] = color.RGBA{255, 255, 85, 255}  // Yellow
+	palette[15] = color.RGBA{255, 255, 255, 255} // White
+
+	// Colors 16-231: 216-color cube (6x6x6) - standard VGA default
+	idx := 16
+	for r := 0; r < 6; r++ {
+		for g := 0; g < 6; g++ {
+			for b := 0; b < 6; b++ {
+				palette[idx] = color.RGBA{uint8(r * 51), uint8(g * 51), uint8(b * 51), 255}
+				idx++
+			}
+		}
+	}
+
+	// Colors 232-255: Grayscale ramp
+	for i := 0; i < 24; i++ {
+		gray := uint8(8 + i*10)
+		palette[232+i] = color.RGBA{gray, gray, gray, 255}
+	}
+	return palette
+}
+
+// Palette returns the colours of the DAC: the entries the program has set,
+// and the default palette for the others
+func (c *CPU) Palette() [256]color.RGBA {
+	c.Memory.LockVGA()
+	defer c.Memory.UnlockVGA()
+	return c.palette()
+}
+
+// palette returns the colours of the DAC; the caller holds the VGA lock
+func (c *CPU) palette() [256]color.RGBA {
+	palette := DefaultPalette()
+	for i, written := range c.dacWritten {
+		if written {
+			r, g, b := dacColor(c.dacPalette[i])
+			palette[i] = color.RGBA{r, g, b, 255}
+		}
+	}
+	return palette
+}
+
+// Render draws the screen into the top left of dst: the 256-colour screen
+// ScanOut reads, the ScreenWidth by ScreenHeight pixels of mode 13h or the
+// size GraphicsSize gives for Mode X, or in text mode the TextWidth by
+// TextHeight pixels DrawText draws, blinking with the emulated frame. It
+// needs no display, so any number of machines can render on their own
+// goroutines, and it holds the VGA lock, so it may run on another goroutine
+// while the machine runs.
+func (m *Machine) Render(dst *image.RGBA) {
+	m.Memory.LockVGA()
+	defer m.Memory.UnlockVGA()
+	m.render(dst)
+}
+
+// render draws the screen into dst; the caller holds the VGA lock
+func (m *Machine) render(dst *image.RGBA) {
+	palette := m.CPU.palette()
+	video := &m.Memory.video
+	if video.TextMode() {
+		DrawText(dst, m.Memory.GetTextMemory(), video, &palette, m.Memory.frame)
+		return
+	}
+	width, height := video.GraphicsSize()
+	indices := make([]byte, width*height)
+	ScanOut(indices, m.Memory.VGA, video)
+	for y := 0; y < height; y++ {
+		row := dst.Pix[dst.PixOffset(dst.Rect.Min.X, dst.Rect.Min.Y+y):]
+		for x, index := range indices[y*width : (y+1)*width] {
+			c := palette[index]
+			row[x*4], row[x*4+1], row[x*4+2], row[x*4+3] = c.R, c.G, c.B, c.A
+		}
+	}
+}
+
+// Screenshot returns the screen as a new image the size of the mode's (see
+// Render)
+func (m *Machine) Screenshot() *image.RGBA {
+	m.Memory.LockVGA()
+	defer m.Memory.UnlockVGA()
+	width, height := m.Memory.video.GraphicsSize()
+	if m.Memory.video.TextMode() {
+		width, height = TextWidth, TextHeight
+	}
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	m.render(img)
+	return img
+}
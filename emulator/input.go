@@ -0,0 +1,70 @@
+package emulator
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ScriptedKey is a key press an input script delivers at the start of an
+// emulated frame
+type ScriptedKey struct {
+	Frame    uint64
+	Scancode uint8 // BIOS scan code
+	ASCII    uint8
+}
+
+// scriptKeys are the named keys of input scripts with their scan code and
+// ASCII code
+var scriptKeys = map[string][2]uint8{
+	"esc": {0x01, 0x1B}, "escape": {0x01, 0x1B},
+	"enter": {0x1C, 0x0D}, "space": {0x39, 0x20},
+	"backspace": {0x0E, 0x08}, "tab": {0x0F, 0x09},
+}
+
+func init() {
+	for i, row := range []string{"1234567890", "qwertyuiop", "asdfghjkl", "zxcvbnm"} {
+		first := []uint8{0x02, 0x10, 0x1E, 0x2C}[i]
+		for j, ch := range row {
+			scriptKeys[string(ch)] = [2]uint8{first + uint8(j), uint8(ch)}
+		}
+	}
+}
+
+// ParseInputScript reads an input script: one key press per line, as the
+// frame number of the emulated 70 Hz display followed by the key, such as
+// "140 space" or "300 esc". Frames count from 1, the first frame after the
+// program starts. Keys are letters, digits, or esc, enter, space, backspace
+// and tab. Blank lines and lines starting with # are ignored. The keys are
+// returned in frame order.
+func ParseInputScript(r io.Reader) ([]ScriptedKey, error) {
+	var keys []ScriptedKey
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("input script line %d: expected a frame and a key, got %q", line, text)
+		}
+		frame, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("input script line %d: invalid frame %q", line, fields[0])
+		}
+		codes, ok := scriptKeys[strings.ToLower(fields[1])]
+		if !ok {
+			return nil, fmt.Errorf("input script line %d: unknown key %q", line, fields[1])
+		}
+		keys = append(keys, ScriptedKey{Frame: frame, Scancode: codes[0], ASCII: codes[1]})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(keys, func(i, j int) bool { return keys[i].Frame < keys[j].Frame })
+	return keys, nil
+}
@@ -0,0 +1,118 @@
+package emulator
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// TestParseInputScript tests parsing key presses by frame
+func TestParseInputScript(t *testing.T) {
+	keys, err := ParseInputScript(strings.NewReader("# Start the demo\n300 esc\n\n140 Space\n140 a\n"))
+	if err != nil {
+		t.Fatalf("ParseInputScript failed: %v", err)
+	}
+	want := []ScriptedKey{{140, 0x39, ' '}, {140, 0x1E, 'a'}, {300, 0x01, 0x1B}}
+	if len(keys) != len(want) {
+		t.Fatalf("Expected %d keys, got %v", len(want), keys)
+	}
+	for i := range want {
+		if keys[i] != want[i] {
+			t.Errorf("Key %d: expected %v, got %v", i, want[i], keys[i])
+		}
+	}
+
+	for _, script := range []string{"140", "x space", "140 f13"} {
+		if _, err := ParseInputScript(strings.NewReader(script)); err == nil {
+			t.Errorf("Expected an error for %q", script)
+		}
+	}
+}
+
+// TestInputScriptKeys tests that scripted keys arrive at the start of their
+// frame and FrameCallback sees every frame in order
+func TestInputScriptKeys(t *testing.T) {
+	cpu := NewCPU()
+	if err := cpu.LoadCOM([]byte{
+		0xB4, 0x01, // 0100: MOV AH, 1
+		0xCD, 0x16, // 0102: INT 16h
+		0x74, 0x06, // 0104: JZ 010Ch
+		0xB4, 0x00, // 0106: MOV AH, 0
+		0xCD, 0x16, // 0108: INT 16h
+		0x01, 0xC3, // 010A: ADD BX, AX
+		0x41,       // 010C: INC CX
+		0xEB, 0xF1, // 010D: JMP 0100h
+	}); err != nil {
+		t.Fatalf("LoadCOM failed: %v", err)
+	}
+	cpu.InputScript = []ScriptedKey{{Frame: 3, Scancode: 0x1E, ASCII: 'a'}}
+	var frames []uint64
+	bxAtFrame := map[uint64]uint16{}
+	cpu.FrameCallback = func(frame uint64) {
+		frames = append(frames, frame)
+		bxAtFrame[frame] = cpu.BX
+	}
+	for cpu.VideoFrame < 5 {
+		if err := cpu.Step(); err != nil {
+			t.Fatalf("Step failed: %v", err)
+		}
+	}
+
+	for i, frame := range frames {
+		if frame != uint64(i+1) {
+			t.Fatalf("Expected frames 1-5 in order, got %v", frames)
+		}
+	}
+	if bxAtFrame[3] != 0 || bxAtFrame[4] != 0x1E61 {
+		t.Errorf("Expected the key to be read during frame 3, got BX=%04X at frame 3 and %04X at frame 4",
+			bxAtFrame[3], bxAtFrame[4])
+	}
+}
+
+// TestDeterministicRun tests that two runs of a program polling the VGA
+// status port give identical framebuffers and counts in Deterministic
+// mode, where the port does not wait for a display
+func TestDeterministicRun(t *testing.T) {
+	run := func() *CPU {
+		cpu := NewCPU()
+		if err := cpu.LoadCOM([]byte{
+			0xB8, 0x13, 0x00, // 0100: MOV AX, 0013h
+			0xCD, 0x10, // 0103: INT 10h
+			0xB8, 0x00, 0xA0, // 0105: MOV AX, A000h
+			0x8E, 0xC0, // 0108: MOV ES, AX
+			0xBA, 0xDA, 0x03, // 010A: MOV DX, 03DAh
+			0xEC,             // 010D: IN AL, DX
+			0x26, 0x88, 0x1D, // 010E: MOV ES:[DI], BL
+			0x47,       // 0111: INC DI
+			0x00, 0xC3, // 0112: ADD BL, AL
+			0xEB, 0xF7, // 0114: JMP 010Dh
+		}); err != nil {
+			t.Fatalf("LoadCOM failed: %v", err)
+		}
+		cpu.Deterministic = true
+		cpu.FrameCallback = func(frame uint64) {
+			if frame == 20 {
+				cpu.Stop()
+			}
+		}
+		err := cpu.Run()
+		var exception *Exception
+		if err == nil || errors.As(err, &exception) {
+			t.Fatalf("Expected Run to be stopped, got %v", err)
+		}
+		return cpu
+	}
+
+	first, second := run(), run()
+	if first.InstructionCount != second.InstructionCount || first.Cycles != second.Cycles {
+		t.Errorf("Runs differ: %d instructions in %d cycles, then %d in %d",
+			first.InstructionCount, first.Cycles, second.InstructionCount, second.Cycles)
+	}
+	if !bytes.Equal(first.Memory.VGA, second.Memory.VGA) {
+		t.Error("Framebuffers differ")
+	}
+	if first.VideoFrame != 20 {
+		t.Errorf("Expected to stop at frame 20, got %d", first.VideoFrame)
+	}
+}
@@ -14,6 +14,10 @@ const (
 	OpPUSH Opcode = 0x02
 	OpPOP  Opcode = 0x03
 	OpXCHG Opcode = 0x04
+	OpLEA  Opcode = 0x05
+	OpLDS  Opcode = 0x06
+	OpLES  Opcode = 0x07
+	OpXLAT Opcode = 0x08
 
 	// Arithmetic
 	OpADD  Opcode = 0x10
@@ -37,6 +41,8 @@ const (
 	OpSAR Opcode = 0x27
 	OpROL Opcode = 0x28
 	OpROR Opcode = 0x29
+	OpRCL Opcode = 0x2A // Rotate left through carry
+	OpRCR Opcode = 0x2B // Rotate right through carry
 
 	// Comparison
 	OpCMP  Opcode = 0x30
@@ -61,9 +67,10 @@ const (
 	OpLOOPNZ Opcode = 0x4F
 
 	// Special
-	OpINT Opcode = 0x50
-	OpNOP Opcode = 0x51
-	OpHLT Opcode = 0x52
+	OpINT  Opcode = 0x50
+	OpNOP  Opcode = 0x51
+	OpHLT  Opcode = 0x52
+	OpINTO Opcode = 0x53 // INT 4 if OF is set
 
 	// I/O
 	OpIN  Opcode = 0x60
@@ -76,46 +83,239 @@ const (
 	OpSTOSW Opcode = 0x73
 	OpLODSB Opcode = 0x74
 	OpLODSW Opcode = 0x75
+	OpCMPSB Opcode = 0x76
+	OpCMPSW Opcode = 0x77
+	OpSCASB Opcode = 0x78
+	OpSCASW Opcode = 0x79
+
+	// Extended control flow (used by the 8086 machine code decoder)
+	OpJO    Opcode = 0x80 // Jump if overflow
+	OpJNO   Opcode = 0x81 // Jump if not overflow
+	OpJS    Opcode = 0x82 // Jump if sign
+	OpJNS   Opcode = 0x83 // Jump if not sign
+	OpJCXZ  Opcode = 0x84 // Jump if CX is zero
+	OpJMPF  Opcode = 0x85 // Far jump (segment:offset)
+	OpCALLF Opcode = 0x86 // Far call (segment:offset)
+	OpRETF  Opcode = 0x87 // Far return
+	OpJP    Opcode = 0x88 // JP/JPE (jump if parity even)
+	OpJNP   Opcode = 0x89 // JNP/JPO (jump if parity odd)
+	OpIRET  Opcode = 0x8A // Return from interrupt
+
+	// Flag operations
+	OpPUSHF Opcode = 0x90
+	OpPOPF  Opcode = 0x91
+	OpLAHF  Opcode = 0x92
+	OpSAHF  Opcode = 0x93
+	OpCLC   Opcode = 0x94
+	OpSTC   Opcode = 0x95
+	OpCMC   Opcode = 0x96
+	OpCLD   Opcode = 0x97
+	OpSTD   Opcode = 0x98
+	OpCLI   Opcode = 0x99
+	OpSTI   Opcode = 0x9A
+
+	// Extended arithmetic
+	OpADC   Opcode = 0xA0 // Add with carry
+	OpSBB   Opcode = 0xA1 // Subtract with borrow
+	OpCBW   Opcode = 0xA2 // Sign-extend AL into AX
+	OpCWD   Opcode = 0xA3 // Sign-extend AX into DX:AX
+	OpDAA   Opcode = 0xA4 // Decimal adjust AL after addition
+	OpDAS   Opcode = 0xA5 // Decimal adjust AL after subtraction
+	OpAAA   Opcode = 0xA6 // ASCII adjust AL after addition
+	OpAAS   Opcode = 0xA7 // ASCII adjust AL after subtraction
+	OpAAM   Opcode = 0xA8 // ASCII adjust AX after multiply (base in the operand)
+	OpAAD   Opcode = 0xA9 // ASCII adjust AX before division (base in the operand)
+	OpIMUL2 Opcode = 0xAA // IMUL reg, r/m|imm (reg = reg * src)
+	OpIMUL3 Opcode = 0xAB // IMUL reg, r/m, imm (reg = src * imm)
+
+	// 80186 extensions
+	OpPUSHA Opcode = 0xB0 // Push AX, CX, DX, BX, original SP, BP, SI, DI
+	OpPOPA  Opcode = 0xB1 // Pop DI, SI, BP, (SP discarded), BX, DX, CX, AX
+	OpENTER Opcode = 0xB2 // Create a stack frame (size, nesting level)
+	OpLEAVE Opcode = 0xB3 // Release the stack frame: SP = BP, POP BP
+	OpBOUND Opcode = 0xB4 // INT 5 unless the lower <= reg <= upper bound in memory
+	OpINSB  Opcode = 0xB5 // Input byte from port DX to ES:DI
+	OpINSW  Opcode = 0xB6 // Input word from port DX to ES:DI
+	OpOUTSB Opcode = 0xB7 // Output byte from DS:SI to port DX
+	OpOUTSW Opcode = 0xB8 // Output word from DS:SI to port DX
+
+	// 80386 extensions
+	OpMOVZXB Opcode = 0xC0 // Zero-extend a byte into a 16- or 32-bit register
+	OpMOVZXW Opcode = 0xC1 // Zero-extend a word into a 32-bit register
+	OpMOVSXB Opcode = 0xC2 // Sign-extend a byte into a 16- or 32-bit register
+	OpMOVSXW Opcode = 0xC3 // Sign-extend a word into a 32-bit register
+	OpSHLD   Opcode = 0xC4 // Shift left, filling from a register (dest, src, count)
+	OpSHRD   Opcode = 0xC5 // Shift right, filling from a register (dest, src, count)
+	OpBT     Opcode = 0xC6 // Copy a bit to CF
+	OpBTS    Opcode = 0xC7 // Copy a bit to CF and set it
+	OpBTR    Opcode = 0xC8 // Copy a bit to CF and clear it
+	OpBTC    Opcode = 0xC9 // Copy a bit to CF and complement it
+	OpBSF    Opcode = 0xCA // Index of the lowest set bit
+	OpBSR    Opcode = 0xCB // Index of the highest set bit
+	OpSETcc  Opcode = 0xCC // Set a byte to a condition (condition code in Src)
+	OpCWDE   Opcode = 0xCD // Sign-extend AX into EAX
+	OpCDQ    Opcode = 0xCE // Sign-extend EAX into EDX:EAX
+
+	// x87 coprocessor
+	OpFPU Opcode = 0xD8 // x87 instruction; the operation is in FPU
 )
 
 // Operand types
 type OperandType byte
 
 const (
-	OpTypeNone     OperandType = 0
-	OpTypeReg16    OperandType = 1 // 16-bit register
-	OpTypeReg8     OperandType = 2 // 8-bit register
-	OpTypeImm16    OperandType = 3 // 16-bit immediate
-	OpTypeImm8     OperandType = 4 // 8-bit immediate
-	OpTypeMem      OperandType = 5 // Memory address
-	OpTypeMemReg   OperandType = 6 // Memory [register]
+	OpTypeNone        OperandType = 0
+	OpTypeReg16       OperandType = 1 // 16-bit register
+	OpTypeReg8        OperandType = 2 // 8-bit register
+	OpTypeImm16       OperandType = 3 // 16-bit immediate
+	OpTypeImm8        OperandType = 4 // 8-bit immediate
+	OpTypeMem         OperandType = 5 // Memory address
+	OpTypeMemReg      OperandType = 6 // Memory [register]
+	OpTypeMemIndexed  OperandType = 7 // Memory [base+index], 8086 r/m 0-3
+	OpTypeSegOverride OperandType = 8 // Segment override before a memory operand
+	OpTypeReg32       OperandType = 9  // 32-bit register (80386)
+	OpTypeImm32       OperandType = 10 // 32-bit immediate (80386)
+	OpTypeDword       OperandType = 11 // Doubleword size before a memory operand
+	OpTypeST          OperandType = 12 // x87 register ST(i), with i in Imm8
+	OpTypeQword       OperandType = 13 // Quadword size before a memory operand (x87)
+	OpTypeTword       OperandType = 14 // Ten-byte size before a memory operand (x87)
 )
 
 // Instruction represents a decoded instruction
 type Instruction struct {
 	Opcode     Opcode
+	FPU        FPUOp // x87 operation of OpFPU
 	Dest       Operand
 	Src        Operand
+	Src2       Operand // Third operand (immediate of three-operand IMUL)
 	Size       int  // Instruction size in bytes
-	HasREP     bool // True if REP prefix (0xF3) is present
+	HasREP     bool // True if a REP/REPE (0xF3) or REPNE (0xF2) prefix is present
+	REPNE      bool // True for REPNE: CMPS and SCAS repeat while ZF is clear
 }
 
 // Operand represents an instruction operand
 type Operand struct {
 	Type        OperandType
-	Reg16       *uint16 // Pointer to 16-bit register
+	Reg16       *uint16 // Pointer to 16-bit register, or the low word of a 32-bit one
+	RegHigh     *uint16 // Pointer to the high word of a 32-bit register
 	RegSeg      *uint16 // Pointer to segment register (CS, DS, ES, SS)
-	Reg8Get     func() uint8
-	Reg8Set     func(uint8)
+	Reg8        *uint16 // Pointer to the 16-bit register holding an 8-bit one
+	Reg8High    bool    // True if the 8-bit register is the high byte (AH, BH, CH, DH)
 	Imm16       uint16
 	Imm8        uint8
-	MemAddr     uint16 // Offset within segment
-	MemSegment  uint16 // Segment for memory access (will be set to DS/ES/SS/CS)
-	SegOverride bool   // True if segment was explicitly overridden
+	Imm32       uint32
+	MemAddr     uint16  // Offset within segment
+	MemSegment  uint16  // Segment for memory access (will be set to DS/ES/SS/CS)
+	Base        *uint16 // Base register of a 16-bit memory address, or nil
+	Index       *uint16 // Index register of a 16-bit memory address, or nil
+	Disp        uint16  // Displacement added to Base and Index
+	Seg         *uint16 // Segment register that MemSegment is read from
+	SegOverride bool    // True if segment was explicitly overridden
+	Byte        bool    // True if a memory operand accesses a single byte
+	Dword       bool    // True if a memory operand accesses a doubleword
+	Qword       bool    // True if an x87 memory operand accesses a quadword
+	Tword       bool    // True if an x87 memory operand accesses ten bytes
+	Addr32      bool    // True if the address came from 32-bit registers (MemAddr32)
+	MemAddr32   uint32  // Full 32-bit effective address, which LEA can load
 }
 
-// Execute executes a single instruction
+// reg8 returns the value of an 8-bit register operand
+func (op Operand) reg8() uint8 {
+	if op.Reg8High {
+		return uint8(*op.Reg8 >> 8)
+	}
+	return uint8(*op.Reg8)
+}
+
+// setReg8 stores a value in an 8-bit register operand
+func (op Operand) setReg8(val uint8) {
+	if op.Reg8High {
+		*op.Reg8 = *op.Reg8&0x00FF | uint16(val)<<8
+	} else {
+		*op.Reg8 = *op.Reg8&0xFF00 | uint16(val)
+	}
+}
+
+// resolve computes the offset and segment of a 16-bit memory operand from
+// its registers, and the segment of an operand with a segment override. The
+// decoders resolve each operand once decoded, and the decode cache again
+// before each execution.
+func (op *Operand) resolve() {
+	if op.Seg == nil || op.Addr32 {
+		return
+	}
+	op.MemSegment = *op.Seg
+	if !op.isMemory() {
+		return
+	}
+	offset := op.Disp
+	if op.Base != nil {
+		offset += *op.Base
+	}
+	if op.Index != nil {
+		offset += *op.Index
+	}
+	op.MemAddr = offset
+}
+
+// resolve resolves the operands of an instruction
+func (inst *Instruction) resolve() {
+	inst.Dest.resolve()
+	inst.Src.resolve()
+	inst.Src2.resolve()
+}
+
+// is8Bit reports whether the operand refers to an 8-bit register or byte of memory
+func (op Operand) is8Bit() bool {
+	return op.Type == OpTypeReg8 || op.Byte
+}
+
+// is32Bit reports whether the operand refers to a 32-bit register or doubleword of memory
+func (op Operand) is32Bit() bool {
+	return op.Type == OpTypeReg32 || op.Dword
+}
+
+// isMemory reports whether the operand refers to memory
+func (op Operand) isMemory() bool {
+	return op.Type == OpTypeMem || op.Type == OpTypeMemReg || op.Type == OpTypeMemIndexed
+}
+
+// isImmediate reports whether the operand is an immediate value
+func (op Operand) isImmediate() bool {
+	return op.Type == OpTypeImm8 || op.Type == OpTypeImm16 || op.Type == OpTypeImm32
+}
+
+// widthMasks returns the value mask and sign bit for an 8-bit or 16-bit operation
+func widthMasks(is8 bool) (mask uint16, sign uint16) {
+	if is8 {
+		return 0xFF, 0x80
+	}
+	return 0xFFFF, 0x8000
+}
+
+// Execute executes a single instruction. Instructions added after the CPU's
+// model raise the invalid opcode exception.
 func (c *CPU) Execute(inst Instruction) error {
+	if model := requiredModel(inst); c.Model < model {
+		if inst.Opcode == OpFPU {
+			return invalidOpcode("%s is not supported by the coprocessor of the %s (requires a %s or later)", inst.FPU, c.Model, model)
+		}
+		return invalidOpcode("opcode 0x%02X is not supported on the %s (requires a %s or later)", inst.Opcode, c.Model, model)
+	} else if model >= Model386 && inst.Opcode != OpFPU {
+		c.extended = true
+	}
+
+	// Operations on doublewords have their own implementations; the x87
+	// reads its doubleword memory operands itself
+	if inst.Dest.is32Bit() || inst.Dest.Type == OpTypeImm32 {
+		switch inst.Opcode {
+		case OpMOVZXB, OpMOVZXW, OpMOVSXB, OpMOVSXW, OpSHLD, OpSHRD,
+			OpBT, OpBTS, OpBTR, OpBTC, OpBSF, OpBSR, OpFPU:
+		default:
+			return c.execute32(inst)
+		}
+	}
+
 	switch inst.Opcode {
 	case OpMOV:
 		return c.execMOV(inst)
@@ -125,21 +325,62 @@ func (c *CPU) Execute(inst Instruction) error {
 		return c.execPOP(inst)
 	case OpXCHG:
 		return c.execXCHG(inst)
+	case OpLEA:
+		return c.execLEA(inst)
+	case OpLDS:
+		return c.execLDS(inst)
+	case OpLES:
+		return c.execLES(inst)
+	case OpXLAT:
+		return c.execXLAT(inst)
 
 	case OpADD:
 		return c.execADD(inst)
 	case OpSUB:
 		return c.execSUB(inst)
+	case OpADC:
+		return c.execADC(inst)
+	case OpSBB:
+		return c.execSBB(inst)
 	case OpMUL:
 		return c.execMUL(inst)
 	case OpDIV:
 		return c.execDIV(inst)
+	case OpIMUL:
+		return c.execIMUL(inst)
+	case OpIMUL2:
+		return c.execIMULReg(inst, c.getOperandValue(inst.Dest), c.getOperandValue(inst.Src))
+	case OpIMUL3:
+		return c.execIMULReg(inst, c.getOperandValue(inst.Src), c.getOperandValue(inst.Src2))
+	case OpIDIV:
+		return c.execIDIV(inst)
 	case OpINC:
 		return c.execINC(inst)
 	case OpDEC:
 		return c.execDEC(inst)
 	case OpNEG:
 		return c.execNEG(inst)
+	case OpCBW:
+		c.AX = uint16(int16(int8(c.GetAL())))
+		return nil
+	case OpCWD:
+		c.DX = 0
+		if c.AX&0x8000 != 0 {
+			c.DX = 0xFFFF
+		}
+		return nil
+	case OpDAA:
+		return c.execDAA(inst)
+	case OpDAS:
+		return c.execDAS(inst)
+	case OpAAA:
+		return c.execAAA(inst)
+	case OpAAS:
+		return c.execAAS(inst)
+	case OpAAM:
+		return c.execAAM(inst)
+	case OpAAD:
+		return c.execAAD(inst)
 
 	case OpAND:
 		return c.execAND(inst)
@@ -155,6 +396,14 @@ func (c *CPU) Execute(inst Instruction) error {
 		return c.execSHR(inst)
 	case OpSAR:
 		return c.execSAR(inst)
+	case OpROL:
+		return c.execROL(inst)
+	case OpROR:
+		return c.execROR(inst)
+	case OpRCL:
+		return c.execRCL(inst)
+	case OpRCR:
+		return c.execRCR(inst)
 
 	case OpCMP:
 		return c.execCMP(inst)
@@ -193,13 +442,78 @@ func (c *CPU) Execute(inst Instruction) error {
 		return c.execLOOPZ(inst)
 	case OpLOOPNZ:
 		return c.execLOOPNZ(inst)
+	case OpJO:
+		return c.execJO(inst)
+	case OpJNO:
+		return c.execJNO(inst)
+	case OpJS:
+		return c.execJS(inst)
+	case OpJNS:
+		return c.execJNS(inst)
+	case OpJCXZ:
+		return c.execJCXZ(inst)
+	case OpJMPF:
+		return c.execJMPF(inst)
+	case OpCALLF:
+		return c.execCALLF(inst)
+	case OpRETF:
+		return c.execRETF(inst)
+	case OpJP:
+		return c.execJP(inst)
+	case OpJNP:
+		return c.execJNP(inst)
+	case OpIRET:
+		return c.execIRET(inst)
+
+	case OpPUSHF:
+		return c.Push(c.Flags.Word())
+	case OpPOPF:
+		return c.execPOPF(inst)
+	case OpLAHF:
+		c.SetAH(uint8(c.Flags.Word()))
+		return nil
+	case OpSAHF:
+		c.Flags.SetLowByte(c.GetAH())
+		return nil
+	case OpCLC:
+		c.Flags.CF = false
+		return nil
+	case OpSTC:
+		c.Flags.CF = true
+		return nil
+	case OpCMC:
+		c.Flags.CF = !c.Flags.CF
+		return nil
+	case OpCLD:
+		c.Flags.DF = false
+		return nil
+	case OpSTD:
+		c.Flags.DF = true
+		return nil
+	case OpCLI:
+		c.Flags.IF = false
+		return nil
+	case OpSTI:
+		c.Flags.IF = true
+		return nil
 
 	case OpINT:
 		return c.execINT(inst)
+	case OpINTO:
+		if c.Flags.OF {
+			return c.Interrupt(4)
+		}
+		return nil
 	case OpNOP:
 		return nil
 	case OpHLT:
-		c.Halted = true
+		// With interrupts enabled HLT waits for the next one; otherwise
+		// nothing can resume the CPU and the program ends
+		if c.Flags.IF {
+			c.WaitingForInterrupt = true
+		} else {
+			c.Halted = true
+		}
 		return nil
 
 	case OpOUT:
@@ -219,33 +533,63 @@ func (c *CPU) Execute(inst Instruction) error {
 		return c.execLODSW(inst)
 	case OpSTOSW:
 		return c.execSTOSW(inst)
+	case OpCMPSB:
+		return c.execCMPS(inst, 1)
+	case OpCMPSW:
+		return c.execCMPS(inst, 2)
+	case OpSCASB:
+		return c.execSCAS(inst, 1)
+	case OpSCASW:
+		return c.execSCAS(inst, 2)
+
+	case OpPUSHA:
+		return c.execPUSHA(inst)
+	case OpPOPA:
+		return c.execPOPA(inst)
+	case OpENTER:
+		return c.execENTER(inst)
+	case OpLEAVE:
+		return c.execLEAVE(inst)
+	case OpBOUND:
+		return c.execBOUND(inst)
+	case OpINSB:
+		return c.execINS(inst, 1)
+	case OpINSW:
+		return c.execINS(inst, 2)
+	case OpOUTSB:
+		return c.execOUTS(inst, 1)
+	case OpOUTSW:
+		return c.execOUTS(inst, 2)
+
+	case OpMOVZXB, OpMOVZXW, OpMOVSXB, OpMOVSXW:
+		return c.execMOVX(inst)
+	case OpSHLD, OpSHRD:
+		return c.execSHLD(inst)
+	case OpBT, OpBTS, OpBTR, OpBTC:
+		return c.execBT(inst)
+	case OpBSF, OpBSR:
+		return c.execBSF(inst)
+	case OpSETcc:
+		return c.execSETcc(inst)
+	case OpCWDE:
+		c.SetEAX(uint32(int32(int16(c.AX))))
+		return nil
+	case OpCDQ:
+		c.SetEDX(uint32(int32(c.GetEAX()) >> 31))
+		return nil
+
+	case OpFPU:
+		return c.execFPU(inst)
 
 	default:
-		return fmt.Errorf("unknown opcode: 0x%02X", inst.Opcode)
+		return invalidOpcode("unknown opcode: 0x%02X", inst.Opcode)
 	}
 }
 
 // MOV instruction
 func (c *CPU) execMOV(inst Instruction) error {
-	// Special handling for 8-bit memory reads (e.g., MOV AL, [SI])
-	if (inst.Src.Type == OpTypeMem || inst.Src.Type == OpTypeMemReg) &&
-		(inst.Dest.Type == OpTypeReg8) {
-		addr := CalculateLinearAddress(inst.Src.MemSegment, inst.Src.MemAddr)
-		val := c.Memory.ReadByteLinear(addr)
-		c.setOperandValue(inst.Dest, uint16(val))
-		return nil
-	}
-
-	// Special handling for 8-bit memory writes (e.g., MOV [DI], AL)
-	if (inst.Src.Type == OpTypeReg8 || inst.Src.Type == OpTypeImm8) &&
-		(inst.Dest.Type == OpTypeMem || inst.Dest.Type == OpTypeMemReg) {
-		addr := CalculateLinearAddress(inst.Dest.MemSegment, inst.Dest.MemAddr)
-		val := c.getOperandValue(inst.Src)
-		c.Memory.WriteByteLinear(addr, uint8(val&0xFF))
-		return nil
-	}
-
-	// Default: use word operations
+	// Operand widths are resolved by the decoder, so byte moves such as
+	// MOV AL, [SI] or MOV [DI], AL only touch a single byte of memory
 	val := c.getOperandValue(inst.Src)
 	c.setOperandValue(inst.Dest, val)
 	return nil
@@ -276,39 +620,137 @@ func (c *CPU) execXCHG(inst Instruction) error {
 	return nil
 }
 
+// LEA instruction - load the effective address (offset) of a memory operand
+func (c *CPU) execLEA(inst Instruction) error {
+	if !inst.Src.isMemory() {
+		return fmt.Errorf("LEA: source must be a memory operand")
+	}
+	c.setOperandValue(inst.Dest, inst.Src.MemAddr)
+	return nil
+}
+
+// loadFarPointer reads a 32-bit pointer for LDS/LES, storing the offset in
+// the destination register and returning the segment
+func (c *CPU) loadFarPointer(inst Instruction) (uint16, error) {
+	if !inst.Src.isMemory() {
+		return 0, fmt.Errorf("source must be a memory operand")
+	}
+	addr := CalculateLinearAddress(inst.Src.MemSegment, inst.Src.MemAddr)
+	c.setOperandValue(inst.Dest, c.Memory.ReadWordLinear(addr))
+	return c.Memory.ReadWordLinear(addr + 2), nil
+}
+
+// LDS instruction - load pointer into register and DS
+func (c *CPU) execLDS(inst Instruction) error {
+	seg, err := c.loadFarPointer(inst)
+	if err != nil {
+		return fmt.Errorf("LDS: %v", err)
+	}
+	c.DS = seg
+	return nil
+}
+
+// LES instruction - load pointer into register and ES
+func (c *CPU) execLES(inst Instruction) error {
+	seg, err := c.loadFarPointer(inst)
+	if err != nil {
+		return fmt.Errorf("LES: %v", err)
+	}
+	c.ES = seg
+	return nil
+}
+
+// XLAT instruction - AL = [DS:BX + AL]
+// The decoder may supply a segment override in Dest.MemSegment.
+func (c *CPU) execXLAT(inst Instruction) error {
+	seg := c.DS
+	if inst.Dest.SegOverride {
+		seg = inst.Dest.MemSegment
+	}
+	addr := CalculateLinearAddress(seg, c.BX+uint16(c.GetAL()))
+	c.SetAL(c.Memory.ReadByteLinear(addr))
+	return nil
+}
+
 // ADD instruction
 func (c *CPU) execADD(inst Instruction) error {
-	dest := c.getOperandValue(inst.Dest)
-	src := c.getOperandValue(inst.Src)
-	result := dest + src
-
-	// Set flags
-	c.Flags.CF = result < dest // Carry occurred
-	c.Flags.OF = ((dest^result)&(src^result)&0x8000) != 0 // Overflow
-	c.UpdateFlags(result)
+	result := c.add(inst, 0)
+	c.setOperandValue(inst.Dest, result)
+	return nil
+}
 
+// ADC instruction (add with carry)
+func (c *CPU) execADC(inst Instruction) error {
+	result := c.add(inst, c.carry())
 	c.setOperandValue(inst.Dest, result)
 	return nil
 }
 
-// SUB instruction
-func (c *CPU) execSUB(inst Instruction) error {
-	dest := c.getOperandValue(inst.Dest)
-	src := c.getOperandValue(inst.Src)
-	result := dest - src
+// add computes dest + src + carry for ADD and ADC and updates the flags
+func (c *CPU) add(inst Instruction, carry uint16) uint16 {
+	is8 := inst.Dest.is8Bit()
+	mask, sign := widthMasks(is8)
+	dest := c.getOperandValue(inst.Dest) & mask
+	src := c.getOperandValue(inst.Src) & mask
+	result := (dest + src + carry) & mask
 
 	// Set flags
-	c.Flags.CF = src > dest // Borrow occurred
-	c.Flags.OF = ((dest^src)&(dest^result)&0x8000) != 0 // Overflow
-	c.UpdateFlags(result)
+	c.Flags.CF = uint32(dest)+uint32(src)+uint32(carry) > uint32(mask) // Carry occurred
+	c.Flags.OF = ((dest^result)&(src^result)&sign) != 0                 // Overflow
+	c.updateAuxFlag(dest, src, result)
+	c.updateFlagsWidth(result, is8)
+	return result
+}
 
+// SUB instruction
+func (c *CPU) execSUB(inst Instruction) error {
+	result := c.subtract(inst, 0)
 	c.setOperandValue(inst.Dest, result)
 	return nil
 }
 
+// SBB instruction (subtract with borrow)
+func (c *CPU) execSBB(inst Instruction) error {
+	result := c.subtract(inst, c.carry())
+	c.setOperandValue(inst.Dest, result)
+	return nil
+}
+
+// subtract computes dest - src - borrow for SUB, SBB and CMP and updates the flags
+func (c *CPU) subtract(inst Instruction, borrow uint16) uint16 {
+	is8 := inst.Dest.is8Bit()
+	mask, sign := widthMasks(is8)
+	dest := c.getOperandValue(inst.Dest) & mask
+	src := c.getOperandValue(inst.Src) & mask
+	result := (dest - src - borrow) & mask
+
+	c.Flags.CF = uint32(src)+uint32(borrow) > uint32(dest) // Borrow occurred
+	c.Flags.OF = ((dest^src)&(dest^result)&sign) != 0     // Overflow
+	c.updateAuxFlag(dest, src, result)
+	c.updateFlagsWidth(result, is8)
+	return result
+}
+
+// carry returns CF as 0 or 1 for ADC, SBB and the rotates through carry
+func (c *CPU) carry() uint16 {
+	if c.Flags.CF {
+		return 1
+	}
+	return 0
+}
+
 // MUL instruction (unsigned)
 func (c *CPU) execMUL(inst Instruction) error {
 	src := c.getOperandValue(inst.Dest)
+
+	if inst.Dest.is8Bit() {
+		// AX = AL * r/m8
+		c.AX = uint16(c.GetAL()) * (src & 0xFF)
+		c.Flags.CF = c.GetAH() != 0
+		c.Flags.OF = c.Flags.CF
+		return nil
+	}
+
 	result := uint32(c.AX) * uint32(src)
 
 	c.AX = uint16(result & 0xFFFF)
@@ -324,8 +766,24 @@ func (c *CPU) execMUL(inst Instruction) error {
 // DIV instruction (unsigned)
 func (c *CPU) execDIV(inst Instruction) error {
 	divisor := uint32(c.getOperandValue(inst.Dest))
+
+	if inst.Dest.is8Bit() {
+		// AL = AX / r/m8, AH = AX % r/m8
+		divisor &= 0xFF
+		if divisor == 0 {
+			return divideError("division by zero")
+		}
+		quotient := uint32(c.AX) / divisor
+		if quotient > 0xFF {
+			return divideError("division overflow")
+		}
+		c.SetAH(uint8(uint32(c.AX) % divisor))
+		c.SetAL(uint8(quotient))
+		return nil
+	}
+
 	if divisor == 0 {
-		return fmt.Errorf("division by zero")
+		return divideError("division by zero")
 	}
 
 	dividend := (uint32(c.DX) << 16) | uint32(c.AX)
@@ -333,7 +791,7 @@ func (c *CPU) execDIV(inst Instruction) error {
 	remainder := dividend % divisor
 
 	if quotient > 0xFFFF {
-		return fmt.Errorf("division overflow")
+		return divideError("division overflow")
 	}
 
 	c.AX = uint16(quotient)
@@ -342,21 +800,92 @@ func (c *CPU) execDIV(inst Instruction) error {
 	return nil
 }
 
-// INC instruction
-func (c *CPU) execINC(inst Instruction) error {
-	val := c.getOperandValue(inst.Dest)
-	result := val + 1
+// IMUL instruction (signed) - AX = AL * r/m8 or DX:AX = AX * r/m16
+func (c *CPU) execIMUL(inst Instruction) error {
+	src := c.getOperandValue(inst.Dest)
 
-	// Handle 8-bit vs 16-bit operations correctly
-	if inst.Dest.Type == OpTypeReg8 {
-		// For 8-bit operations, mask to 8 bits before updating flags
-		result = result & 0xFF
-		c.Flags.OF = (val == 0x7F) // Overflow from max positive (8-bit)
-	} else {
-		c.Flags.OF = (val == 0x7FFF) // Overflow from max positive (16-bit)
+	if inst.Dest.is8Bit() {
+		result := int16(int8(c.GetAL())) * int16(int8(src))
+		c.AX = uint16(result)
+		// CF and OF set if AH is not the sign extension of AL
+		c.Flags.CF = result != int16(int8(result))
+		c.Flags.OF = c.Flags.CF
+		return nil
+	}
+
+	result := int32(int16(c.AX)) * int32(int16(src))
+	c.AX = uint16(result)
+	c.DX = uint16(result >> 16)
+
+	// CF and OF set if DX is not the sign extension of AX
+	c.Flags.CF = result != int32(int16(result))
+	c.Flags.OF = c.Flags.CF
+	return nil
+}
+
+// execIMULReg implements the two- and three-operand IMUL forms, which keep
+// the low word of the signed product a * b in a 16-bit register
+func (c *CPU) execIMULReg(inst Instruction, a, b uint16) error {
+	if inst.Dest.Type != OpTypeReg16 {
+		return fmt.Errorf("IMUL: destination must be a 16-bit register")
+	}
+	result := int32(int16(a)) * int32(int16(b))
+
+	// CF and OF set if the product was truncated
+	c.Flags.CF = result != int32(int16(result))
+	c.Flags.OF = c.Flags.CF
+
+	c.setOperandValue(inst.Dest, uint16(result))
+	return nil
+}
+
+// IDIV instruction (signed, quotient truncated toward zero)
+func (c *CPU) execIDIV(inst Instruction) error {
+	src := c.getOperandValue(inst.Dest)
+
+	if inst.Dest.is8Bit() {
+		// AL = AX / r/m8, AH = AX % r/m8
+		divisor := int32(int8(src))
+		if divisor == 0 {
+			return divideError("division by zero")
+		}
+		dividend := int32(int16(c.AX))
+		quotient := dividend / divisor
+		if quotient != int32(int8(quotient)) {
+			return divideError("division overflow")
+		}
+		c.SetAH(uint8(dividend % divisor))
+		c.SetAL(uint8(quotient))
+		return nil
+	}
+
+	divisor := int64(int16(src))
+	if divisor == 0 {
+		return divideError("division by zero")
 	}
 
-	c.UpdateFlags(result)
+	dividend := int64(int32(uint32(c.DX)<<16 | uint32(c.AX)))
+	quotient := dividend / divisor
+	if quotient != int64(int16(quotient)) {
+		return divideError("division overflow")
+	}
+
+	c.AX = uint16(quotient)
+	c.DX = uint16(dividend % divisor)
+	return nil
+}
+
+// INC instruction
+func (c *CPU) execINC(inst Instruction) error {
+	is8 := inst.Dest.is8Bit()
+	mask, sign := widthMasks(is8)
+	val := c.getOperandValue(inst.Dest) & mask
+	result := (val + 1) & mask
+
+	// Overflow from max positive value of the operand width
+	c.Flags.OF = val == sign-1
+	c.updateAuxFlag(val, 1, result)
+	c.updateFlagsWidth(result, is8)
 	// Note: INC does not affect CF
 
 	c.setOperandValue(inst.Dest, result)
@@ -365,19 +894,15 @@ func (c *CPU) execINC(inst Instruction) error {
 
 // DEC instruction
 func (c *CPU) execDEC(inst Instruction) error {
-	val := c.getOperandValue(inst.Dest)
-	result := val - 1
-
-	// Handle 8-bit vs 16-bit operations correctly
-	if inst.Dest.Type == OpTypeReg8 {
-		// For 8-bit operations, mask to 8 bits before updating flags
-		result = result & 0xFF
-		c.Flags.OF = (val == 0x80) // Overflow from min negative (8-bit)
-	} else {
-		c.Flags.OF = (val == 0x8000) // Overflow from min negative (16-bit)
-	}
-
-	c.UpdateFlags(result)
+	is8 := inst.Dest.is8Bit()
+	mask, sign := widthMasks(is8)
+	val := c.getOperandValue(inst.Dest) & mask
+	result := (val - 1) & mask
+
+	// Overflow from min negative value of the operand width
+	c.Flags.OF = val == sign
+	c.updateAuxFlag(val, 1, result)
+	c.updateFlagsWidth(result, is8)
 	// Note: DEC does not affect CF
 
 	c.setOperandValue(inst.Dest, result)
@@ -386,26 +911,125 @@ func (c *CPU) execDEC(inst Instruction) error {
 
 // NEG instruction
 func (c *CPU) execNEG(inst Instruction) error {
-	val := c.getOperandValue(inst.Dest)
-	result := uint16(-int16(val))
+	is8 := inst.Dest.is8Bit()
+	mask, sign := widthMasks(is8)
+	val := c.getOperandValue(inst.Dest) & mask
+	result := (-val) & mask
 
 	c.Flags.CF = (val != 0)
-	c.Flags.OF = (val == 0x8000)
-	c.UpdateFlags(result)
+	c.Flags.OF = (val == sign)
+	c.updateAuxFlag(0, val, result)
+	c.updateFlagsWidth(result, is8)
 
 	c.setOperandValue(inst.Dest, result)
 	return nil
 }
 
+// DAA instruction - adjust AL after adding two packed BCD values.
+// OF is undefined after the decimal adjustments and is left unchanged.
+func (c *CPU) execDAA(inst Instruction) error {
+	al := c.GetAL()
+	oldAL, oldCF := al, c.Flags.CF
+
+	c.Flags.CF = false
+	if al&0x0F > 9 || c.Flags.AF {
+		c.Flags.CF = oldCF || al > 0xF9
+		al += 0x06
+		c.Flags.AF = true
+	} else {
+		c.Flags.AF = false
+	}
+	if oldAL > 0x99 || oldCF {
+		al += 0x60
+		c.Flags.CF = true
+	}
+
+	c.SetAL(al)
+	c.updateFlagsWidth(uint16(al), true)
+	return nil
+}
+
+// DAS instruction - adjust AL after subtracting two packed BCD values
+func (c *CPU) execDAS(inst Instruction) error {
+	al := c.GetAL()
+	oldAL, oldCF := al, c.Flags.CF
+
+	c.Flags.CF = false
+	if al&0x0F > 9 || c.Flags.AF {
+		c.Flags.CF = oldCF || al < 0x06
+		al -= 0x06
+		c.Flags.AF = true
+	} else {
+		c.Flags.AF = false
+	}
+	if oldAL > 0x99 || oldCF {
+		al -= 0x60
+		c.Flags.CF = true
+	}
+
+	c.SetAL(al)
+	c.updateFlagsWidth(uint16(al), true)
+	return nil
+}
+
+// AAA instruction - adjust AX after adding two unpacked BCD digits.
+// As on the 8086, the carry out of AL is not propagated into AH.
+func (c *CPU) execAAA(inst Instruction) error {
+	al := c.GetAL()
+	adjust := al&0x0F > 9 || c.Flags.AF
+	if adjust {
+		al += 0x06
+		c.SetAH(c.GetAH() + 1)
+	}
+	c.Flags.AF = adjust
+	c.Flags.CF = adjust
+	c.SetAL(al & 0x0F)
+	return nil
+}
+
+// AAS instruction - adjust AX after subtracting two unpacked BCD digits
+func (c *CPU) execAAS(inst Instruction) error {
+	al := c.GetAL()
+	adjust := al&0x0F > 9 || c.Flags.AF
+	if adjust {
+		al -= 0x06
+		c.SetAH(c.GetAH() - 1)
+	}
+	c.Flags.AF = adjust
+	c.Flags.CF = adjust
+	c.SetAL(al & 0x0F)
+	return nil
+}
+
+// AAM instruction - split AL into AH = AL / base, AL = AL % base
+func (c *CPU) execAAM(inst Instruction) error {
+	base := uint8(c.getOperandValue(inst.Dest))
+	if base == 0 {
+		return divideError("division by zero")
+	}
+	al := c.GetAL()
+	c.SetAH(al / base)
+	c.SetAL(al % base)
+	c.updateFlagsWidth(uint16(c.GetAL()), true)
+	return nil
+}
+
+// AAD instruction - combine AH and AL into AL = AH * base + AL, AH = 0
+func (c *CPU) execAAD(inst Instruction) error {
+	base := uint8(c.getOperandValue(inst.Dest))
+	al := c.GetAH()*base + c.GetAL()
+	c.AX = uint16(al)
+	c.updateFlagsWidth(uint16(al), true)
+	return nil
+}
+
 // AND instruction
 func (c *CPU) execAND(inst Instruction) error {
 	dest := c.getOperandValue(inst.Dest)
 	src := c.getOperandValue(inst.Src)
 	result := dest & src
 
-	c.Flags.CF = false
-	c.Flags.OF = false
-	c.UpdateFlags(result)
+	c.setLogicFlags(result, inst.Dest.is8Bit())
 
 	c.setOperandValue(inst.Dest, result)
 	return nil
@@ -417,9 +1041,7 @@ func (c *CPU) execOR(inst Instruction) error {
 	src := c.getOperandValue(inst.Src)
 	result := dest | src
 
-	c.Flags.CF = false
-	c.Flags.OF = false
-	c.UpdateFlags(result)
+	c.setLogicFlags(result, inst.Dest.is8Bit())
 
 	c.setOperandValue(inst.Dest, result)
 	return nil
@@ -431,14 +1053,21 @@ func (c *CPU) execXOR(inst Instruction) error {
 	src := c.getOperandValue(inst.Src)
 	result := dest ^ src
 
-	c.Flags.CF = false
-	c.Flags.OF = false
-	c.UpdateFlags(result)
+	c.setLogicFlags(result, inst.Dest.is8Bit())
 
 	c.setOperandValue(inst.Dest, result)
 	return nil
 }
 
+// setLogicFlags clears CF/OF/AF and updates ZF/SF/PF for AND, OR, XOR and TEST
+func (c *CPU) setLogicFlags(result uint16, is8 bool) {
+	c.Flags.CF = false
+	c.Flags.OF = false
+	c.Flags.AF = false
+	mask, _ := widthMasks(is8)
+	c.updateFlagsWidth(result&mask, is8)
+}
+
 // NOT instruction
 func (c *CPU) execNOT(inst Instruction) error {
 	val := c.getOperandValue(inst.Dest)
@@ -447,16 +1076,35 @@ func (c *CPU) execNOT(inst Instruction) error {
 	return nil
 }
 
+// shiftOperands returns the value, count and width of a shift instruction.
+// The count is taken from the source operand (immediate or CL).
+func (c *CPU) shiftOperands(inst Instruction) (val uint16, count uint16, bits uint16, is8 bool) {
+	is8 = inst.Dest.is8Bit()
+	mask, _ := widthMasks(is8)
+	bits = 16
+	if is8 {
+		bits = 8
+	}
+	val = c.getOperandValue(inst.Dest) & mask
+	count = c.getOperandValue(inst.Src) & 0xFF
+	if c.Model >= Model186 {
+		count &= 0x1F // The 80186 and later use five bits of the count
+	}
+	return val, count, bits, is8
+}
+
 // SHL instruction (shift left)
 func (c *CPU) execSHL(inst Instruction) error {
-	val := c.getOperandValue(inst.Dest)
-	count := min(c.getOperandValue(inst.Src), 16)
+	val, count, bits, is8 := c.shiftOperands(inst)
+	mask, sign := widthMasks(is8)
 
 	if count > 0 {
 		// Last bit shifted out goes to CF
-		c.Flags.CF = ((val >> (16 - count)) & 1) != 0
-		result := val << count
-		c.UpdateFlags(result)
+		wide := uint32(val) << min(count, bits+1)
+		c.Flags.CF = (wide>>bits)&1 != 0
+		result := uint16(wide) & mask
+		c.Flags.OF = ((result & sign) != 0) != c.Flags.CF
+		c.updateFlagsWidth(result, is8)
 		c.setOperandValue(inst.Dest, result)
 	}
 
@@ -465,14 +1113,16 @@ func (c *CPU) execSHL(inst Instruction) error {
 
 // SHR instruction (shift right logical)
 func (c *CPU) execSHR(inst Instruction) error {
-	val := c.getOperandValue(inst.Dest)
-	count := min(c.getOperandValue(inst.Src), 16)
+	val, count, bits, is8 := c.shiftOperands(inst)
+	_, sign := widthMasks(is8)
 
 	if count > 0 {
 		// Last bit shifted out goes to CF
-		c.Flags.CF = ((val >> (count - 1)) & 1) != 0
-		result := val >> count
-		c.UpdateFlags(result)
+		count = min(count, bits+1)
+		c.Flags.CF = ((uint32(val) >> (count - 1)) & 1) != 0
+		c.Flags.OF = (val & sign) != 0
+		result := uint16(uint32(val) >> count)
+		c.updateFlagsWidth(result, is8)
 		c.setOperandValue(inst.Dest, result)
 	}
 
@@ -481,30 +1131,103 @@ func (c *CPU) execSHR(inst Instruction) error {
 
 // SAR instruction (shift right arithmetic - preserves sign)
 func (c *CPU) execSAR(inst Instruction) error {
-	val := c.getOperandValue(inst.Dest)
-	count := min(c.getOperandValue(inst.Src), 16)
+	val, count, bits, is8 := c.shiftOperands(inst)
+	mask, _ := widthMasks(is8)
 
 	if count > 0 {
-		signed := int16(val)
-		c.Flags.CF = ((val >> (count - 1)) & 1) != 0
-		result := uint16(signed >> count)
-		c.UpdateFlags(result)
+		count = min(count, bits)
+		signed := int32(int16(val))
+		if is8 {
+			signed = int32(int8(val))
+		}
+		c.Flags.CF = ((signed >> (count - 1)) & 1) != 0
+		c.Flags.OF = false
+		result := uint16(signed>>count) & mask
+		c.updateFlagsWidth(result, is8)
 		c.setOperandValue(inst.Dest, result)
 	}
 
 	return nil
 }
 
-// CMP instruction (compare - SUB without storing result)
-func (c *CPU) execCMP(inst Instruction) error {
-	dest := c.getOperandValue(inst.Dest)
-	src := c.getOperandValue(inst.Src)
-	result := dest - src
+// ROL instruction (rotate left)
+func (c *CPU) execROL(inst Instruction) error {
+	val, count, bits, is8 := c.shiftOperands(inst)
+	mask, sign := widthMasks(is8)
+
+	if count > 0 {
+		n := count % bits
+		result := (val<<n | val>>(bits-n)) & mask
+		// The bit rotated into bit 0 goes to CF
+		c.Flags.CF = result&1 != 0
+		c.Flags.OF = ((result & sign) != 0) != c.Flags.CF
+		c.setOperandValue(inst.Dest, result)
+	}
+
+	return nil
+}
+
+// ROR instruction (rotate right)
+func (c *CPU) execROR(inst Instruction) error {
+	val, count, bits, is8 := c.shiftOperands(inst)
+	mask, sign := widthMasks(is8)
+
+	if count > 0 {
+		n := count % bits
+		result := (val>>n | val<<(bits-n)) & mask
+		// The bit rotated into the sign bit goes to CF
+		c.Flags.CF = result&sign != 0
+		c.Flags.OF = (result^result<<1)&sign != 0
+		c.setOperandValue(inst.Dest, result)
+	}
+
+	return nil
+}
+
+// RCL instruction (rotate left through carry)
+func (c *CPU) execRCL(inst Instruction) error {
+	val, count, bits, is8 := c.shiftOperands(inst)
+	mask, sign := widthMasks(is8)
+
+	if count > 0 {
+		// CF acts as an extra bit, so the rotation repeats every bits+1 steps
+		cf := c.carry()
+		for i := uint16(0); i < count%(bits+1); i++ {
+			out := (val & sign) >> (bits - 1)
+			val = (val<<1 | cf) & mask
+			cf = out
+		}
+		c.Flags.CF = cf != 0
+		c.Flags.OF = ((val & sign) != 0) != c.Flags.CF
+		c.setOperandValue(inst.Dest, val)
+	}
+
+	return nil
+}
 
-	c.Flags.CF = src > dest
-	c.Flags.OF = ((dest^src)&(dest^result)&0x8000) != 0
-	c.UpdateFlags(result)
+// RCR instruction (rotate right through carry)
+func (c *CPU) execRCR(inst Instruction) error {
+	val, count, bits, is8 := c.shiftOperands(inst)
+	mask, sign := widthMasks(is8)
 
+	if count > 0 {
+		cf := c.carry()
+		for i := uint16(0); i < count%(bits+1); i++ {
+			out := val & 1
+			val = (val>>1 | cf<<(bits-1)) & mask
+			cf = out
+		}
+		c.Flags.CF = cf != 0
+		c.Flags.OF = (val^val<<1)&sign != 0
+		c.setOperandValue(inst.Dest, val)
+	}
+
+	return nil
+}
+
+// CMP instruction (compare - SUB without storing result)
+func (c *CPU) execCMP(inst Instruction) error {
+	c.subtract(inst, 0)
 	return nil
 }
 
@@ -514,9 +1237,7 @@ func (c *CPU) execTEST(inst Instruction) error {
 	src := c.getOperandValue(inst.Src)
 	result := dest & src
 
-	c.Flags.CF = false
-	c.Flags.OF = false
-	c.UpdateFlags(result)
+	c.setLogicFlags(result, inst.Dest.is8Bit())
 
 	return nil
 }
@@ -607,6 +1328,62 @@ func (c *CPU) execJBE(inst Instruction) error {
 	return nil
 }
 
+// JO instruction (jump if overflow)
+func (c *CPU) execJO(inst Instruction) error {
+	if c.Flags.OF {
+		c.IP = c.getOperandValue(inst.Dest)
+	}
+	return nil
+}
+
+// JNO instruction (jump if not overflow)
+func (c *CPU) execJNO(inst Instruction) error {
+	if !c.Flags.OF {
+		c.IP = c.getOperandValue(inst.Dest)
+	}
+	return nil
+}
+
+// JS instruction (jump if sign)
+func (c *CPU) execJS(inst Instruction) error {
+	if c.Flags.SF {
+		c.IP = c.getOperandValue(inst.Dest)
+	}
+	return nil
+}
+
+// JNS instruction (jump if not sign)
+func (c *CPU) execJNS(inst Instruction) error {
+	if !c.Flags.SF {
+		c.IP = c.getOperandValue(inst.Dest)
+	}
+	return nil
+}
+
+// JP/JPE instruction (jump if parity even)
+func (c *CPU) execJP(inst Instruction) error {
+	if c.Flags.PF {
+		c.IP = c.getOperandValue(inst.Dest)
+	}
+	return nil
+}
+
+// JNP/JPO instruction (jump if parity odd)
+func (c *CPU) execJNP(inst Instruction) error {
+	if !c.Flags.PF {
+		c.IP = c.getOperandValue(inst.Dest)
+	}
+	return nil
+}
+
+// JCXZ instruction (jump if CX is zero)
+func (c *CPU) execJCXZ(inst Instruction) error {
+	if c.CX == 0 {
+		c.IP = c.getOperandValue(inst.Dest)
+	}
+	return nil
+}
+
 // CALL instruction
 func (c *CPU) execCALL(inst Instruction) error {
 	// Push return address (next instruction)
@@ -618,12 +1395,74 @@ func (c *CPU) execCALL(inst Instruction) error {
 }
 
 // RET instruction
-func (c *CPU) execRET(_ Instruction) error {
+// An optional immediate operand (RET imm16) releases that many bytes of
+// stack arguments after popping the return address.
+func (c *CPU) execRET(inst Instruction) error {
 	addr, err := c.Pop()
 	if err != nil {
 		return err
 	}
 	c.IP = addr
+	if inst.Dest.Type != OpTypeNone {
+		c.SP += c.getOperandValue(inst.Dest)
+	}
+	return nil
+}
+
+// farPointer returns the segment:offset target of a far JMP or CALL.
+// Direct forms carry the offset in Dest and the segment in Src; indirect
+// forms read a 32-bit pointer (offset then segment) from memory.
+func (c *CPU) farPointer(inst Instruction) (segment, offset uint16) {
+	if inst.Dest.isMemory() {
+		addr := CalculateLinearAddress(inst.Dest.MemSegment, inst.Dest.MemAddr)
+		return c.Memory.ReadWordLinear(addr + 2), c.Memory.ReadWordLinear(addr)
+	}
+	return c.getOperandValue(inst.Src), c.getOperandValue(inst.Dest)
+}
+
+// JMP FAR instruction
+func (c *CPU) execJMPF(inst Instruction) error {
+	c.CS, c.IP = c.farPointer(inst)
+	return nil
+}
+
+// CALL FAR instruction
+func (c *CPU) execCALLF(inst Instruction) error {
+	segment, offset := c.farPointer(inst)
+	if err := c.Push(c.CS); err != nil {
+		return err
+	}
+	if err := c.Push(c.IP); err != nil {
+		return err
+	}
+	c.CS, c.IP = segment, offset
+	return nil
+}
+
+// RETF instruction (far return, optional immediate stack release)
+func (c *CPU) execRETF(inst Instruction) error {
+	ip, err := c.Pop()
+	if err != nil {
+		return err
+	}
+	cs, err := c.Pop()
+	if err != nil {
+		return err
+	}
+	c.IP, c.CS = ip, cs
+	if inst.Dest.Type != OpTypeNone {
+		c.SP += c.getOperandValue(inst.Dest)
+	}
+	return nil
+}
+
+// POPF instruction - pop the FLAGS register
+func (c *CPU) execPOPF(_ Instruction) error {
+	val, err := c.Pop()
+	if err != nil {
+		return err
+	}
+	c.Flags.SetWord(val)
 	return nil
 }
 
@@ -654,21 +1493,14 @@ func (c *CPU) execLOOPNZ(inst Instruction) error {
 	return nil
 }
 
-// INT instruction (interrupt)
+// INT instruction (interrupt). Under the stop exception policy INT 3 stops
+// Run as a breakpoint.
 func (c *CPU) execINT(inst Instruction) error {
-	intNum := uint8(c.getOperandValue(inst.Dest))
-
-	switch intNum {
-	case 0x10: // Video services
-		return c.handleInt10()
-	case 0x16: // Keyboard services
-		return c.handleInt16()
-	case 0x21: // DOS services
-		return c.handleInt21()
-	default:
-		// Ignore unknown interrupts for now
-		return nil
+	vector := uint8(c.getOperandValue(inst.Dest))
+	if vector == VectorBreakpoint && c.Exceptions == ExceptionsStop {
+		return &Exception{Vector: VectorBreakpoint}
 	}
+	return c.Interrupt(vector)
 }
 
 // INT 10h - Video services
@@ -677,13 +1509,55 @@ func (c *CPU) handleInt10() error {
 
 	switch ah {
 	case 0x00: // Set video mode
-		al := c.GetAL()
-		if al == 0x13 {
-			// Mode 13h - 320x200 256-color graphics
-			// Notify that graphics mode has been activated
-			if c.Mode13hCallback != nil {
-				c.Mode13hCallback()
+		c.setVideoMode(c.GetAL())
+		return nil
+
+	case 0x01: // Set cursor shape
+		// CH = first scan line (bit 5 hides the cursor), CL = last scan line
+		c.setCursorShape(c.GetCH(), c.GetCL())
+		return nil
+
+	case 0x02: // Set cursor position
+		// DH = row, DL = column, BH = page number (ignored)
+		c.setCursor(c.GetDL(), c.GetDH())
+		return nil
+
+	case 0x03: // Get cursor position and shape
+		c.SetDH(c.cursorY)
+		c.SetDL(c.cursorX)
+		c.SetCH(c.Memory.video.CRTC[crtcCursorStart])
+		c.SetCL(c.Memory.video.CRTC[crtcCursorEnd])
+		return nil
+
+	case 0x06, 0x07: // Scroll window up or down
+		// AL = lines (0 blanks the window), BH = attribute of new lines,
+		// CH, CL = top left row and column, DH, DL = bottom right
+		if c.textMode() {
+			c.scrollText(int(c.GetAL()), c.GetBH(), int(c.GetCH()), int(c.GetCL()), int(c.GetDH()), int(c.GetDL()), ah == 0x06)
+		}
+		return nil
+
+	case 0x08: // Read character and attribute at cursor
+		c.AX = 0
+		if c.textMode() {
+			c.AX = c.Memory.ReadWordLinear(textCell(int(c.cursorX), int(c.cursorY)))
+		}
+		return nil
+
+	case 0x09, 0x0A: // Write character (and attribute) at cursor
+		// AL = character, BL = attribute (AH=09h in text mode) or colour
+		// (graphics modes), CX = count. The cursor does not move.
+		if c.textMode() {
+			attr := -1
+			if ah == 0x09 {
+				attr = int(c.GetBL())
 			}
+			c.writeText(c.GetAL(), attr, int(c.CX))
+			return nil
+		}
+		scale := int(c.textScale)
+		for i := 0; i < int(c.CX) && int(c.cursorX)+i < 320/(8*scale); i++ {
+			c.drawCharToVGA(c.GetAL(), (int(c.cursorX)+i)*8*scale, int(c.cursorY)*16*scale, c.GetBL(), scale)
 		}
 		return nil
 
@@ -691,70 +1565,60 @@ func (c *CPU) handleInt10() error {
 		// AL = character to write
 		// BL = foreground color (in graphics modes)
 		// BH = page number (ignored - we always use page 0)
-		char := c.GetAL()
-		color := c.GetBL()
-
-		// Update text color
-		c.textColor = color
+		if !c.textMode() {
+			c.textColor = c.GetBL()
+		}
+		c.teletype(c.GetAL())
+		return nil
 
-		// Handle special characters
-		switch char {
-		case 0x0D: // Carriage return
-			c.cursorX = 0
-		case 0x0A: // Line feed
-			c.cursorY++
-			// Check if we need to scroll (cursor beyond bottom of screen)
-			maxRows := uint8(200 / 16) // 12 rows for 16-pixel tall chars
-			if c.cursorY >= maxRows {
-				c.cursorY = maxRows - 1
-				// TODO: Implement scrolling if needed
-			}
-		case 0x08: // Backspace
-			if c.cursorX > 0 {
-				c.cursorX--
-			}
-		case 0x07: // Bell
-			// Ignore bell character (no audio support yet)
-		default:
-			// Draw character at cursor position
-			pixelX := int(c.cursorX) * 8 * int(c.textScale)
-			pixelY := int(c.cursorY) * 16 * int(c.textScale)
-
-			// Draw character directly to VGA memory
-			c.drawCharToVGA(char, pixelX, pixelY, c.textColor, int(c.textScale))
-
-			// Advance cursor
-			c.cursorX++
-			maxCols := uint8(320 / (8 * int(c.textScale))) // 40 cols for 8-pixel wide chars at 1x scale
-			if c.cursorX >= maxCols {
-				c.cursorX = 0
-				c.cursorY++
-				maxRows := uint8(200 / (16 * int(c.textScale))) // 12 rows for 16-pixel tall chars at 1x scale
-				if c.cursorY >= maxRows {
-					c.cursorY = maxRows - 1
-					// TODO: Implement scrolling if needed
-				}
-			}
+	case 0x0F: // Get video mode
+		// AL = mode, AH = columns, BH = page
+		c.SetAL(c.Memory.video.Mode)
+		c.SetAH(40)
+		if c.textMode() {
+			c.SetAH(TextColumns)
 		}
+		c.SetBH(0)
 		return nil
 
 	case 0x10: // Set palette register
 		al := c.GetAL()
 		switch al {
 		case 0x00:
-			// Set single palette register
-			// BL = color register to set
-			// BH = color value
-			if c.SetPaletteCallback != nil {
-				index := c.GetBL()
-				colorValue := c.GetBH()
-				// Convert 6-bit VGA color value to 8-bit RGB
-				// VGA uses 6 bits per channel (0-63), we scale to 0-255
-				r := byte((colorValue & 0x3F) * 4)
-				g := r // For now, use same value for simple greyscale
-				b := r
-				c.SetPaletteCallback(index, r, g, b)
+			// Set attribute controller palette register
+			// BL = register (0-15), BH = DAC entry of the colour
+			if bl := c.GetBL(); bl < 16 {
+				c.setAttr(bl, c.GetBH())
+			}
+		case 0x01:
+			// Set overscan (border) colour to BH
+			c.setAttr(attrOverscan, c.GetBH())
+		case 0x02:
+			// Set all palette registers and the overscan colour from the
+			// 17 bytes at ES:DX
+			for i := uint8(0); i <= 16; i++ {
+				index := i
+				if i == 16 {
+					index = attrOverscan
+				}
+				c.setAttr(index, c.Memory.ReadByteLinear(CalculateLinearAddress(c.ES, c.DX+uint16(i))))
+			}
+		case 0x03:
+			// Toggle blinking: BL = 1 blinks characters with attribute bit
+			// 7 set, BL = 0 gives them bright backgrounds
+			mode := c.Memory.video.Attr[attrModeControl] &^ attrBlink
+			if c.GetBL() != 0 {
+				mode |= attrBlink
 			}
+			c.setAttr(attrModeControl, mode)
+		case 0x07:
+			// Read attribute controller palette register BL into BH
+			if bl := c.GetBL(); bl < 16 {
+				c.SetBH(c.Memory.video.Attr[bl])
+			}
+		case 0x08:
+			// Read overscan colour into BH
+			c.SetBH(c.Memory.video.Attr[attrOverscan])
 		case 0x10:
 			// Set individual DAC register
 			// BX = register number
@@ -788,6 +1652,9 @@ func (c *CPU) handleInt10() error {
 			c.BP = fontOff
 			c.CX = 16  // 16 bytes per character (8x16 font)
 			c.SetDL(11) // 12 rows - 1 (200/16 = 12.5, use 12)
+			if c.textMode() {
+				c.SetDL(TextRows - 1)
+			}
 		}
 		return nil
 
@@ -832,37 +1699,118 @@ func (c *CPU) handleInt16() error {
 	}
 }
 
+// teletype writes a character at the cursor and advances it, as INT 10h
+// AH=0Eh does: into text memory in text mode, or drawn in the text colour
+// in graphics modes
+func (c *CPU) teletype(char uint8) {
+	if c.textMode() {
+		c.teletypeText(char)
+		return
+	}
+
+	// Handle special characters
+	switch char {
+	case 0x0D: // Carriage return
+		c.cursorX = 0
+	case 0x0A: // Line feed
+		c.cursorY++
+		// Check if we need to scroll (cursor beyond bottom of screen)
+		maxRows := uint8(200 / 16) // 12 rows for 16-pixel tall chars
+		if c.cursorY >= maxRows {
+			c.cursorY = maxRows - 1
+			// TODO: Implement scrolling if needed
+		}
+	case 0x08: // Backspace
+		if c.cursorX > 0 {
+			c.cursorX--
+		}
+	case 0x07: // Bell
+		// Ignore bell character (no audio support yet)
+	default:
+		// Draw character at cursor position
+		pixelX := int(c.cursorX) * 8 * int(c.textScale)
+		pixelY := int(c.cursorY) * 16 * int(c.textScale)
+
+		// Draw character directly to VGA memory
+		c.drawCharToVGA(char, pixelX, pixelY, c.textColor, int(c.textScale))
+
+		// Advance cursor
+		c.cursorX++
+		maxCols := uint8(320 / (8 * int(c.textScale))) // 40 cols for 8-pixel wide chars at 1x scale
+		if c.cursorX >= maxCols {
+			c.cursorX = 0
+			c.cursorY++
+			maxRows := uint8(200 / (16 * int(c.textScale))) // 12 rows for 16-pixel tall chars at 1x scale
+			if c.cursorY >= maxRows {
+				c.cursorY = maxRows - 1
+				// TODO: Implement scrolling if needed
+			}
+		}
+	}
+}
+
 // INT 21h - DOS services
 func (c *CPU) handleInt21() error {
 	ah := c.GetAH()
 
 	switch ah {
-	case 0x4C: // Exit program
+	case 0x00, 0x4C: // Terminate program (AH=4Ch with the exit code in AL)
 		c.Halted = true
 		return nil
-	default:
+	case 0x02: // Write character DL to standard output
+		c.teletype(c.GetDL())
+		c.SetAL(c.GetDL())
+		return nil
+	case 0x09: // Write the string at DS:DX, ending at "$", to standard output
+		for offset := 0; offset < 0x10000; offset++ {
+			char := c.Memory.ReadByteLinear(CalculateLinearAddress(c.DS, c.DX+uint16(offset)))
+			if char == '$' {
+				break
+			}
+			c.teletype(char)
+		}
+		c.SetAL('$')
+		return nil
+	case 0x25: // Set interrupt vector AL to DS:DX
+		c.SetInterruptVector(c.GetAL(), c.DS, c.DX)
 		return nil
+	case 0x19: // Get current drive: C:
+		c.SetAL(2)
+		return nil
+	case 0x30: // Get DOS version: MS-DOS 5.00
+		c.AX, c.BX, c.CX = 0x0005, 0xFF00, 0
+		return nil
+	case 0x35: // Get interrupt vector AL into ES:BX
+		c.ES, c.BX = c.GetInterruptVector(c.GetAL())
+		return nil
+	default:
+		return fmt.Errorf("function %02Xh is not implemented", ah)
 	}
 }
 
 // Helper: Get operand value
 func (c *CPU) getOperandValue(op Operand) uint16 {
 	switch op.Type {
-	case OpTypeReg16:
+	case OpTypeReg16, OpTypeReg32:
 		if op.Reg16 != nil {
 			return *op.Reg16
 		}
 	case OpTypeReg8:
-		if op.Reg8Get != nil {
-			return uint16(op.Reg8Get())
+		if op.Reg8 != nil {
+			return uint16(op.reg8())
 		}
 	case OpTypeImm16:
 		return op.Imm16
 	case OpTypeImm8:
 		return uint16(op.Imm8)
-	case OpTypeMem, OpTypeMemReg:
+	case OpTypeImm32:
+		return uint16(op.Imm32)
+	case OpTypeMem, OpTypeMemReg, OpTypeMemIndexed:
 		// Use segmented addressing
 		addr := CalculateLinearAddress(op.MemSegment, op.MemAddr)
+		if op.Byte {
+			return uint16(c.Memory.ReadByteLinear(addr))
+		}
 		return c.Memory.ReadWordLinear(addr)
 	}
 	return 0
@@ -871,17 +1819,21 @@ func (c *CPU) getOperandValue(op Operand) uint16 {
 // Helper: Set operand value
 func (c *CPU) setOperandValue(op Operand, val uint16) {
 	switch op.Type {
-	case OpTypeReg16:
+	case OpTypeReg16, OpTypeReg32:
 		if op.Reg16 != nil {
 			*op.Reg16 = val
 		}
 	case OpTypeReg8:
-		if op.Reg8Set != nil {
-			op.Reg8Set(uint8(val & 0xFF))
+		if op.Reg8 != nil {
+			op.setReg8(uint8(val & 0xFF))
 		}
-	case OpTypeMem, OpTypeMemReg:
+	case OpTypeMem, OpTypeMemReg, OpTypeMemIndexed:
 		// Use segmented addressing
 		addr := CalculateLinearAddress(op.MemSegment, op.MemAddr)
+		if op.Byte {
+			c.Memory.WriteByteLinear(addr, uint8(val))
+			return
+		}
 		c.Memory.WriteWordLinear(addr, val)
 	}
 }
@@ -902,12 +1854,17 @@ func (c *CPU) execOUT(inst Instruction) error {
 		return fmt.Errorf("OUT: invalid port operand")
 	}
 
+	// OUT DX, AX writes the low byte to port and the high byte to port+1
+	if inst.Src.Type == OpTypeReg16 && inst.Src.Reg16 == &c.AX {
+		return c.outWord(port, c.AX)
+	}
+
 	// Get value (typically from AL register)
 	value := uint8(0)
 	switch inst.Src.Type {
 	case OpTypeReg8:
-		if inst.Src.Reg8Get != nil {
-			value = inst.Src.Reg8Get()
+		if inst.Src.Reg8 != nil {
+			value = inst.Src.reg8()
 		}
 	case OpTypeImm8:
 		value = inst.Src.Imm8
@@ -915,8 +1872,7 @@ func (c *CPU) execOUT(inst Instruction) error {
 		return fmt.Errorf("OUT: invalid value operand")
 	}
 
-	c.OutByte(port, value)
-	return nil
+	return c.out(port, value)
 }
 
 // IN instruction - read from I/O port
@@ -935,13 +1891,26 @@ func (c *CPU) execIN(inst Instruction) error {
 		return fmt.Errorf("IN: invalid port operand")
 	}
 
+	// IN AX, DX reads the low byte from port and the high byte from port+1
+	if inst.Dest.Type == OpTypeReg16 && inst.Dest.Reg16 == &c.AX {
+		value, err := c.inWord(port)
+		if err != nil {
+			return err
+		}
+		c.AX = value
+		return nil
+	}
+
 	// Read value from port
-	value := c.InByte(port)
+	value, err := c.in(port)
+	if err != nil {
+		return err
+	}
 
 	// Store in destination (typically AL register)
 	if inst.Dest.Type == OpTypeReg8 {
-		if inst.Dest.Reg8Set != nil {
-			inst.Dest.Reg8Set(value)
+		if inst.Dest.Reg8 != nil {
+			inst.Dest.setReg8(value)
 		}
 	} else {
 		return fmt.Errorf("IN: invalid destination operand")
@@ -950,36 +1919,70 @@ func (c *CPU) execIN(inst Instruction) error {
 	return nil
 }
 
+// stringDelta returns the SI/DI adjustment for a string element of the given
+// size: forward when DF is clear, backward when it is set
+func (c *CPU) stringDelta(size uint16) uint16 {
+	if c.Flags.DF {
+		return -size
+	}
+	return size
+}
+
+// sourceSegment returns the segment of a string instruction's DS:SI source,
+// which a segment override prefix replaces through Src
+func (c *CPU) sourceSegment(inst Instruction) uint16 {
+	if inst.Src.SegOverride {
+		return inst.Src.MemSegment
+	}
+	return c.DS
+}
+
+// stringOperand returns the memory operand of a string element at seg:offset
+func stringOperand(seg, offset, size uint16) Operand {
+	return Operand{Type: OpTypeMemReg, MemSegment: seg, MemAddr: offset, Byte: size == 1}
+}
+
+// isStringOp reports whether an opcode is a string instruction that takes a
+// REP prefix
+func isStringOp(op Opcode) bool {
+	switch op {
+	case OpMOVSB, OpMOVSW, OpSTOSB, OpSTOSW, OpLODSB, OpLODSW,
+		OpCMPSB, OpCMPSW, OpSCASB, OpSCASW, OpINSB, OpINSW, OpOUTSB, OpOUTSW:
+		return true
+	}
+	return false
+}
+
 // MOVSB - Move byte from DS:SI to ES:DI
-func (c *CPU) execMOVSB(_ Instruction) error {
+func (c *CPU) execMOVSB(inst Instruction) error {
 	// Read byte from DS:SI
-	srcAddr := CalculateLinearAddress(c.DS, c.SI)
+	srcAddr := CalculateLinearAddress(c.sourceSegment(inst), c.SI)
 	value := c.Memory.ReadByteLinear(srcAddr)
 
 	// Write byte to ES:DI
 	destAddr := CalculateLinearAddress(c.ES, c.DI)
 	c.Memory.WriteByteLinear(destAddr, value)
 
-	// Update SI and DI (assume DF=0, increment)
-	c.SI++
-	c.DI++
+	// Update SI and DI in the direction given by DF
+	c.SI += c.stringDelta(1)
+	c.DI += c.stringDelta(1)
 
 	return nil
 }
 
 // MOVSW - Move word from DS:SI to ES:DI
-func (c *CPU) execMOVSW(_ Instruction) error {
+func (c *CPU) execMOVSW(inst Instruction) error {
 	// Read word from DS:SI
-	srcAddr := CalculateLinearAddress(c.DS, c.SI)
+	srcAddr := CalculateLinearAddress(c.sourceSegment(inst), c.SI)
 	value := c.Memory.ReadWordLinear(srcAddr)
 
 	// Write word to ES:DI
 	destAddr := CalculateLinearAddress(c.ES, c.DI)
 	c.Memory.WriteWordLinear(destAddr, value)
 
-	// Update SI and DI by 2 (assume DF=0, increment)
-	c.SI += 2
-	c.DI += 2
+	// Update SI and DI by 2 in the direction given by DF
+	c.SI += c.stringDelta(2)
+	c.DI += c.stringDelta(2)
 
 	return nil
 }
@@ -993,8 +1996,8 @@ func (c *CPU) execSTOSB(_ Instruction) error {
 	destAddr := CalculateLinearAddress(c.ES, c.DI)
 	c.Memory.WriteByteLinear(destAddr, value)
 
-	// Update DI (assume DF=0, increment)
-	c.DI++
+	// Update DI in the direction given by DF
+	c.DI += c.stringDelta(1)
 
 	return nil
 }
@@ -1008,38 +2011,67 @@ func (c *CPU) execSTOSW(_ Instruction) error {
 	destAddr := CalculateLinearAddress(c.ES, c.DI)
 	c.Memory.WriteWordLinear(destAddr, value)
 
-	// Update DI by 2 (assume DF=0, increment)
-	c.DI += 2
+	// Update DI by 2 in the direction given by DF
+	c.DI += c.stringDelta(2)
 
 	return nil
 }
 
 // LODSB - Load byte from DS:SI into AL
-func (c *CPU) execLODSB(_ Instruction) error {
+func (c *CPU) execLODSB(inst Instruction) error {
 	// Read byte from DS:SI
-	srcAddr := CalculateLinearAddress(c.DS, c.SI)
+	srcAddr := CalculateLinearAddress(c.sourceSegment(inst), c.SI)
 	value := c.Memory.ReadByteLinear(srcAddr)
 
 	// Store in AL
 	c.SetAL(value)
 
-	// Update SI (assume DF=0, increment)
-	c.SI++
+	// Update SI in the direction given by DF
+	c.SI += c.stringDelta(1)
 
 	return nil
 }
 
 // LODSW - Load word from DS:SI into AX
-func (c *CPU) execLODSW(_ Instruction) error {
+func (c *CPU) execLODSW(inst Instruction) error {
 	// Read word from DS:SI
-	srcAddr := CalculateLinearAddress(c.DS, c.SI)
+	srcAddr := CalculateLinearAddress(c.sourceSegment(inst), c.SI)
 	value := c.Memory.ReadWordLinear(srcAddr)
 
 	// Store in AX
 	c.AX = value
 
-	// Update SI by 2 (assume DF=0, increment)
-	c.SI += 2
+	// Update SI by 2 in the direction given by DF
+	c.SI += c.stringDelta(2)
+
+	return nil
+}
+
+// CMPSB/CMPSW - Compare DS:SI with ES:DI, setting the flags of [SI] - [DI]
+func (c *CPU) execCMPS(inst Instruction, size uint16) error {
+	c.subtract(Instruction{
+		Dest: stringOperand(c.sourceSegment(inst), c.SI, size),
+		Src:  stringOperand(c.ES, c.DI, size),
+	}, 0)
+
+	// Update SI and DI in the direction given by DF
+	c.SI += c.stringDelta(size)
+	c.DI += c.stringDelta(size)
+
+	return nil
+}
+
+// SCASB/SCASW - Compare AL or AX with ES:DI, setting the flags of
+// accumulator - [DI]
+func (c *CPU) execSCAS(_ Instruction, size uint16) error {
+	acc := Operand{Type: OpTypeReg16, Reg16: &c.AX}
+	if size == 1 {
+		acc = Operand{Type: OpTypeReg8, Reg8: &c.AX}
+	}
+	c.subtract(Instruction{Dest: acc, Src: stringOperand(c.ES, c.DI, size)}, 0)
+
+	// Update DI in the direction given by DF
+	c.DI += c.stringDelta(size)
 
 	return nil
 }
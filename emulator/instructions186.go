@@ -0,0 +1,167 @@
+package emulator
+
+import "fmt"
+
+// requiredModel returns the first CPU model that implements an instruction.
+// The 80186 added PUSHA, POPA, ENTER, LEAVE, BOUND, INS, OUTS, PUSH of an
+// immediate, IMUL by an immediate and shifts by an immediate count other
+// than one. The 80386 added the 32-bit registers and operands, MOVZX,
+// MOVSX, SHLD, SHRD, the bit instructions, SETcc and IMUL reg, r/m. x87
+// instructions depend on the coprocessor that goes with each CPU.
+func requiredModel(inst Instruction) CPUModel {
+	if inst.Opcode == OpFPU {
+		return fpuModel(inst)
+	}
+	for _, op := range [...]*Operand{&inst.Dest, &inst.Src, &inst.Src2} {
+		if op.is32Bit() || op.Type == OpTypeImm32 || op.Addr32 {
+			return Model386
+		}
+	}
+
+	switch inst.Opcode {
+	case OpMOVZXB, OpMOVZXW, OpMOVSXB, OpMOVSXW, OpSHLD, OpSHRD,
+		OpBT, OpBTS, OpBTR, OpBTC, OpBSF, OpBSR, OpSETcc, OpCWDE, OpCDQ:
+		return Model386
+	case OpPUSHA, OpPOPA, OpENTER, OpLEAVE, OpBOUND,
+		OpINSB, OpINSW, OpOUTSB, OpOUTSW, OpIMUL3:
+		return Model186
+	case OpPUSH:
+		if inst.Dest.isImmediate() {
+			return Model186
+		}
+	case OpIMUL2:
+		if inst.Src.isImmediate() {
+			return Model186
+		}
+		return Model386
+	case OpSHL, OpSHR, OpSAL, OpSAR, OpROL, OpROR, OpRCL, OpRCR:
+		if inst.Src.Type == OpTypeImm16 || (inst.Src.Type == OpTypeImm8 && inst.Src.Imm8 != 1) {
+			return Model186
+		}
+	}
+	return Model8086
+}
+
+// PUSHA - Push AX, CX, DX, BX, the SP before the instruction, BP, SI and DI
+func (c *CPU) execPUSHA(_ Instruction) error {
+	sp := c.SP
+	for _, val := range []uint16{c.AX, c.CX, c.DX, c.BX, sp, c.BP, c.SI, c.DI} {
+		if err := c.Push(val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// POPA - Pop DI, SI, BP, BX, DX, CX and AX in the reverse order of PUSHA.
+// The saved SP is skipped.
+func (c *CPU) execPOPA(_ Instruction) error {
+	var sp uint16
+	for _, reg := range []*uint16{&c.DI, &c.SI, &c.BP, &sp, &c.BX, &c.DX, &c.CX, &c.AX} {
+		val, err := c.Pop()
+		if err != nil {
+			return err
+		}
+		*reg = val
+	}
+	return nil
+}
+
+// ENTER size, level - Push BP, copy level-1 frame pointers of the enclosing
+// procedures, push the new frame pointer when level > 0, then point BP at
+// the frame and reserve size bytes of locals below it
+func (c *CPU) execENTER(inst Instruction) error {
+	size := c.getOperandValue(inst.Dest)
+	level := c.getOperandValue(inst.Src) & 0x1F
+
+	if err := c.Push(c.BP); err != nil {
+		return err
+	}
+	frame := c.SP
+	if level > 0 {
+		for i := uint16(1); i < level; i++ {
+			c.BP -= 2
+			if err := c.Push(c.Memory.ReadWordLinear(CalculateLinearAddress(c.SS, c.BP))); err != nil {
+				return err
+			}
+		}
+		if err := c.Push(frame); err != nil {
+			return err
+		}
+	}
+	c.BP = frame
+	c.SP -= size
+	return nil
+}
+
+// LEAVE - Release the frame of ENTER: SP = BP, then POP BP
+func (c *CPU) execLEAVE(_ Instruction) error {
+	c.SP = c.BP
+	bp, err := c.Pop()
+	if err != nil {
+		return err
+	}
+	c.BP = bp
+	return nil
+}
+
+// BOUND reg, mem - Raise INT 5 unless the signed register value lies within
+// the lower and upper bounds stored as two words at mem. The interrupt
+// returns to the BOUND instruction itself.
+func (c *CPU) execBOUND(inst Instruction) error {
+	if !inst.Src.isMemory() {
+		return fmt.Errorf("BOUND: bounds must be in memory")
+	}
+	bound := inst.Src
+	bound.Byte = false
+	lower := int16(c.getOperandValue(bound))
+	bound.MemAddr += 2
+	upper := int16(c.getOperandValue(bound))
+
+	if val := int16(c.getOperandValue(inst.Dest)); val < lower || val > upper {
+		c.IP -= uint16(inst.Size)
+		return c.Interrupt(5)
+	}
+	return nil
+}
+
+// INSB/INSW - Input a byte or word from port DX to ES:DI
+func (c *CPU) execINS(_ Instruction, size uint16) error {
+	var value uint16
+	var err error
+	if size == 2 {
+		value, err = c.inWord(c.DX)
+	} else {
+		var b uint8
+		b, err = c.in(c.DX)
+		value = uint16(b)
+	}
+	if err != nil {
+		return err
+	}
+	c.setOperandValue(stringOperand(c.ES, c.DI, size), value)
+
+	// Update DI in the direction given by DF
+	c.DI += c.stringDelta(size)
+
+	return nil
+}
+
+// OUTSB/OUTSW - Output a byte or word from DS:SI to port DX
+func (c *CPU) execOUTS(inst Instruction, size uint16) error {
+	value := c.getOperandValue(stringOperand(c.sourceSegment(inst), c.SI, size))
+	var err error
+	if size == 2 {
+		err = c.outWord(c.DX, value)
+	} else {
+		err = c.out(c.DX, uint8(value))
+	}
+	if err != nil {
+		return err
+	}
+
+	// Update SI in the direction given by DF
+	c.SI += c.stringDelta(size)
+
+	return nil
+}
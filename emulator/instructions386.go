@@ -0,0 +1,456 @@
+package emulator
+
+import (
+	"fmt"
+	"math/bits"
+)
+
+// getOperandValue32 returns an operand zero-extended to 32 bits. A 32-bit
+// register is its high word joined to its low word, and a doubleword in
+// memory is stored low word first.
+func (c *CPU) getOperandValue32(op Operand) uint32 {
+	switch {
+	case op.Type == OpTypeReg32:
+		return reg32(*op.RegHigh, *op.Reg16)
+	case op.Type == OpTypeImm32:
+		return op.Imm32
+	case op.isMemory() && op.Dword:
+		low := c.Memory.ReadWordLinear(CalculateLinearAddress(op.MemSegment, op.MemAddr))
+		high := c.Memory.ReadWordLinear(CalculateLinearAddress(op.MemSegment, op.MemAddr+2))
+		return reg32(high, low)
+	}
+	return uint32(c.getOperandValue(op))
+}
+
+// setOperandValue32 stores a doubleword, truncated to the width of a byte
+// or word operand
+func (c *CPU) setOperandValue32(op Operand, val uint32) {
+	switch {
+	case op.Type == OpTypeReg32:
+		*op.RegHigh, *op.Reg16 = uint16(val>>16), uint16(val)
+	case op.isMemory() && op.Dword:
+		c.Memory.WriteWordLinear(CalculateLinearAddress(op.MemSegment, op.MemAddr), uint16(val))
+		c.Memory.WriteWordLinear(CalculateLinearAddress(op.MemSegment, op.MemAddr+2), uint16(val>>16))
+	default:
+		c.setOperandValue(op, uint16(val))
+	}
+}
+
+// push32 pushes a doubleword, high word first, so it sits low word first
+// on the stack
+func (c *CPU) push32(val uint32) error {
+	if err := c.Push(uint16(val >> 16)); err != nil {
+		return err
+	}
+	return c.Push(uint16(val))
+}
+
+// pop32 pops a doubleword pushed by push32
+func (c *CPU) pop32() (uint32, error) {
+	low, err := c.Pop()
+	if err != nil {
+		return 0, err
+	}
+	high, err := c.Pop()
+	if err != nil {
+		return 0, err
+	}
+	return reg32(high, low), nil
+}
+
+// updateFlags32 updates zero, sign and parity flags based on a 32-bit result
+func (c *CPU) updateFlags32(val uint32) {
+	c.Flags.ZF = val == 0
+	c.Flags.SF = val&0x80000000 != 0
+	c.UpdateParityFlag(uint16(val))
+}
+
+// execute32 executes an instruction whose destination is a 32-bit register,
+// a doubleword in memory or a 32-bit immediate
+func (c *CPU) execute32(inst Instruction) error {
+	switch inst.Opcode {
+	case OpMOV:
+		c.setOperandValue32(inst.Dest, c.getOperandValue32(inst.Src))
+	case OpPUSH:
+		return c.push32(c.getOperandValue32(inst.Dest))
+	case OpPOP:
+		val, err := c.pop32()
+		if err != nil {
+			return err
+		}
+		c.setOperandValue32(inst.Dest, val)
+	case OpXCHG:
+		dest, src := c.getOperandValue32(inst.Dest), c.getOperandValue32(inst.Src)
+		c.setOperandValue32(inst.Dest, src)
+		c.setOperandValue32(inst.Src, dest)
+	case OpLEA:
+		if !inst.Src.isMemory() {
+			return fmt.Errorf("LEA: source must be a memory operand")
+		}
+		ea := uint32(inst.Src.MemAddr)
+		if inst.Src.Addr32 {
+			ea = inst.Src.MemAddr32
+		}
+		c.setOperandValue32(inst.Dest, ea)
+	case OpADD:
+		c.setOperandValue32(inst.Dest, c.add32(inst, 0))
+	case OpADC:
+		c.setOperandValue32(inst.Dest, c.add32(inst, uint32(c.carry())))
+	case OpSUB:
+		c.setOperandValue32(inst.Dest, c.subtract32(inst, 0))
+	case OpSBB:
+		c.setOperandValue32(inst.Dest, c.subtract32(inst, uint32(c.carry())))
+	case OpCMP:
+		c.subtract32(inst, 0)
+	case OpAND, OpOR, OpXOR, OpTEST:
+		c.logic32(inst)
+	case OpNOT:
+		c.setOperandValue32(inst.Dest, ^c.getOperandValue32(inst.Dest))
+	case OpNEG:
+		val := c.getOperandValue32(inst.Dest)
+		result := -val
+		c.Flags.CF = val != 0
+		c.Flags.OF = val == 0x80000000
+		c.updateAuxFlag(0, uint16(val), uint16(result))
+		c.updateFlags32(result)
+		c.setOperandValue32(inst.Dest, result)
+	case OpINC, OpDEC:
+		// INC and DEC do not affect CF
+		val := c.getOperandValue32(inst.Dest)
+		result := val + 1
+		c.Flags.OF = val == 0x7FFFFFFF
+		if inst.Opcode == OpDEC {
+			result = val - 1
+			c.Flags.OF = val == 0x80000000
+		}
+		c.updateAuxFlag(uint16(val), 1, uint16(result))
+		c.updateFlags32(result)
+		c.setOperandValue32(inst.Dest, result)
+	case OpMUL, OpIMUL:
+		c.multiply32(inst)
+	case OpDIV, OpIDIV:
+		return c.divide32(inst)
+	case OpIMUL2:
+		return c.imulReg32(inst, c.getOperandValue32(inst.Dest), c.getOperandValue32(inst.Src))
+	case OpIMUL3:
+		return c.imulReg32(inst, c.getOperandValue32(inst.Src), c.getOperandValue32(inst.Src2))
+	case OpSHL, OpSAL, OpSHR, OpSAR, OpROL, OpROR, OpRCL, OpRCR:
+		c.shift32(inst)
+	default:
+		return fmt.Errorf("opcode 0x%02X has no 32-bit form", inst.Opcode)
+	}
+	return nil
+}
+
+// add32 computes dest + src + carry for a 32-bit ADD or ADC and updates the flags
+func (c *CPU) add32(inst Instruction, carry uint32) uint32 {
+	dest := c.getOperandValue32(inst.Dest)
+	src := c.getOperandValue32(inst.Src)
+	result, carryOut := bits.Add32(dest, src, carry)
+
+	c.Flags.CF = carryOut != 0
+	c.Flags.OF = (dest^result)&(src^result)&0x80000000 != 0
+	c.updateAuxFlag(uint16(dest), uint16(src), uint16(result))
+	c.updateFlags32(result)
+	return result
+}
+
+// subtract32 computes dest - src - borrow for a 32-bit SUB, SBB or CMP and
+// updates the flags
+func (c *CPU) subtract32(inst Instruction, borrow uint32) uint32 {
+	dest := c.getOperandValue32(inst.Dest)
+	src := c.getOperandValue32(inst.Src)
+	result, borrowOut := bits.Sub32(dest, src, borrow)
+
+	c.Flags.CF = borrowOut != 0
+	c.Flags.OF = (dest^src)&(dest^result)&0x80000000 != 0
+	c.updateAuxFlag(uint16(dest), uint16(src), uint16(result))
+	c.updateFlags32(result)
+	return result
+}
+
+// logic32 implements a 32-bit AND, OR, XOR or TEST
+func (c *CPU) logic32(inst Instruction) {
+	dest := c.getOperandValue32(inst.Dest)
+	src := c.getOperandValue32(inst.Src)
+
+	var result uint32
+	switch inst.Opcode {
+	case OpAND, OpTEST:
+		result = dest & src
+	case OpOR:
+		result = dest | src
+	case OpXOR:
+		result = dest ^ src
+	}
+
+	c.Flags.CF = false
+	c.Flags.OF = false
+	c.Flags.AF = false
+	c.updateFlags32(result)
+	if inst.Opcode != OpTEST {
+		c.setOperandValue32(inst.Dest, result)
+	}
+}
+
+// multiply32 implements MUL and IMUL r/m32: EDX:EAX = EAX * r/m32
+func (c *CPU) multiply32(inst Instruction) {
+	src := c.getOperandValue32(inst.Dest)
+
+	if inst.Opcode == OpMUL {
+		high, low := bits.Mul32(c.GetEAX(), src)
+		c.SetEAX(low)
+		c.SetEDX(high)
+		c.Flags.CF = high != 0
+	} else {
+		result := int64(int32(c.GetEAX())) * int64(int32(src))
+		c.SetEAX(uint32(result))
+		c.SetEDX(uint32(result >> 32))
+		// CF set if EDX is not the sign extension of EAX
+		c.Flags.CF = result != int64(int32(result))
+	}
+	c.Flags.OF = c.Flags.CF
+}
+
+// divide32 implements DIV and IDIV r/m32: EAX = EDX:EAX / r/m32 and EDX is
+// the remainder
+func (c *CPU) divide32(inst Instruction) error {
+	divisor := c.getOperandValue32(inst.Dest)
+	if divisor == 0 {
+		return divideError("division by zero")
+	}
+
+	if inst.Opcode == OpDIV {
+		if c.GetEDX() >= divisor {
+			return divideError("division overflow")
+		}
+		quotient, remainder := bits.Div32(c.GetEDX(), c.GetEAX(), divisor)
+		c.SetEAX(quotient)
+		c.SetEDX(remainder)
+		return nil
+	}
+
+	dividend := int64(uint64(c.GetEDX())<<32 | uint64(c.GetEAX()))
+	quotient := dividend / int64(int32(divisor))
+	if quotient != int64(int32(quotient)) {
+		return divideError("division overflow")
+	}
+	c.SetEAX(uint32(quotient))
+	c.SetEDX(uint32(dividend % int64(int32(divisor))))
+	return nil
+}
+
+// imulReg32 implements the two- and three-operand IMUL forms on a 32-bit
+// register
+func (c *CPU) imulReg32(inst Instruction, a, b uint32) error {
+	if inst.Dest.Type != OpTypeReg32 {
+		return fmt.Errorf("IMUL: destination must be a register")
+	}
+	result := int64(int32(a)) * int64(int32(b))
+
+	// CF and OF set if the product was truncated
+	c.Flags.CF = result != int64(int32(result))
+	c.Flags.OF = c.Flags.CF
+
+	c.setOperandValue32(inst.Dest, uint32(result))
+	return nil
+}
+
+// shift32 implements the shifts and rotates of a doubleword. Five bits of
+// the count are used. Rotates leave ZF, SF and PF alone.
+func (c *CPU) shift32(inst Instruction) {
+	val := c.getOperandValue32(inst.Dest)
+	count := uint(c.getOperandValue(inst.Src) & 0x1F)
+	if count == 0 {
+		return
+	}
+
+	var result uint32
+	switch inst.Opcode {
+	case OpSHL, OpSAL:
+		result = val << count
+		c.Flags.CF = (val>>(32-count))&1 != 0
+		c.Flags.OF = (result&0x80000000 != 0) != c.Flags.CF
+		c.updateFlags32(result)
+	case OpSHR:
+		result = val >> count
+		c.Flags.CF = (val>>(count-1))&1 != 0
+		c.Flags.OF = val&0x80000000 != 0
+		c.updateFlags32(result)
+	case OpSAR:
+		result = uint32(int32(val) >> count)
+		c.Flags.CF = (val>>(count-1))&1 != 0
+		c.Flags.OF = false
+		c.updateFlags32(result)
+	case OpROL:
+		result = bits.RotateLeft32(val, int(count))
+		c.Flags.CF = result&1 != 0
+		c.Flags.OF = (result&0x80000000 != 0) != c.Flags.CF
+	case OpROR:
+		result = bits.RotateLeft32(val, -int(count))
+		c.Flags.CF = result&0x80000000 != 0
+		c.Flags.OF = (result^result<<1)&0x80000000 != 0
+	case OpRCL, OpRCR:
+		// CF is bit 32 of a 33-bit rotate
+		const mask33 = 1<<33 - 1
+		wide := uint64(c.carry())<<32 | uint64(val)
+		if inst.Opcode == OpRCL {
+			wide = (wide<<count | wide>>(33-count)) & mask33
+		} else {
+			wide = (wide>>count | wide<<(33-count)) & mask33
+		}
+		result = uint32(wide)
+		c.Flags.CF = wide>>32 != 0
+		if inst.Opcode == OpRCL {
+			c.Flags.OF = (result&0x80000000 != 0) != c.Flags.CF
+		} else {
+			c.Flags.OF = (result^result<<1)&0x80000000 != 0
+		}
+	}
+	c.setOperandValue32(inst.Dest, result)
+}
+
+// MOVZX/MOVSX reg, r/m - Load a byte or word into a wider register,
+// zero- or sign-extended
+func (c *CPU) execMOVX(inst Instruction) error {
+	if inst.Dest.Type != OpTypeReg16 && inst.Dest.Type != OpTypeReg32 {
+		return fmt.Errorf("MOVZX/MOVSX: destination must be a 16-bit or 32-bit register")
+	}
+	val := uint32(c.getOperandValue(inst.Src))
+	switch inst.Opcode {
+	case OpMOVZXB:
+		val &= 0xFF
+	case OpMOVSXB:
+		val = uint32(int32(int8(val)))
+	case OpMOVSXW:
+		val = uint32(int32(int16(val)))
+	}
+	c.setOperandValue32(inst.Dest, val)
+	return nil
+}
+
+// SHLD/SHRD r/m, reg, count - Shift r/m by count, filling the vacated bits
+// from reg. Five bits of the count are used.
+func (c *CPU) execSHLD(inst Instruction) error {
+	width := uint(16)
+	if inst.Dest.is32Bit() {
+		width = 32
+	}
+	count := uint(c.getOperandValue(inst.Src2) & 0x1F)
+	if count == 0 {
+		return nil
+	}
+
+	dest := uint64(c.getOperandValue32(inst.Dest))
+	src := uint64(c.getOperandValue32(inst.Src))
+	mask := uint64(1)<<width - 1
+	sign := uint64(1) << (width - 1)
+
+	var result uint64
+	if inst.Opcode == OpSHLD {
+		result = (dest<<count | src>>(width-count)) & mask
+		c.Flags.CF = (dest>>(width-count))&1 != 0
+	} else {
+		result = (dest>>count | src<<(width-count)) & mask
+		c.Flags.CF = (dest>>(count-1))&1 != 0
+	}
+	c.Flags.OF = (result^dest)&sign != 0
+
+	if width == 32 {
+		c.updateFlags32(uint32(result))
+	} else {
+		c.UpdateFlags(uint16(result))
+	}
+	c.setOperandValue32(inst.Dest, uint32(result))
+	return nil
+}
+
+// BT/BTS/BTR/BTC r/m, offset - Copy a bit of r/m to CF, then leave it, set
+// it, clear it or complement it. A register offset into memory is signed
+// and may select a bit anywhere in the bit string starting at r/m.
+func (c *CPU) execBT(inst Instruction) error {
+	base := inst.Dest
+	width := uint32(16)
+	if base.is32Bit() {
+		width = 32
+	}
+	offset := c.getOperandValue32(inst.Src)
+	if base.isMemory() && !inst.Src.isImmediate() {
+		if width == 32 {
+			base.MemAddr += uint16((int32(offset) >> 5) * 4)
+		} else {
+			base.MemAddr += uint16((int16(offset) >> 4) * 2)
+		}
+	}
+
+	bit := offset % width
+	val := c.getOperandValue32(base)
+	c.Flags.CF = (val>>bit)&1 != 0
+
+	switch inst.Opcode {
+	case OpBTS:
+		val |= 1 << bit
+	case OpBTR:
+		val &^= 1 << bit
+	case OpBTC:
+		val ^= 1 << bit
+	default:
+		return nil
+	}
+	c.setOperandValue32(base, val)
+	return nil
+}
+
+// BSF/BSR reg, r/m - Store the index of the lowest or highest set bit of
+// r/m in reg. ZF is set and reg is left unchanged when r/m is zero.
+func (c *CPU) execBSF(inst Instruction) error {
+	val := c.getOperandValue32(inst.Src)
+	c.Flags.ZF = val == 0
+	if val == 0 {
+		return nil
+	}
+
+	index := bits.TrailingZeros32(val)
+	if inst.Opcode == OpBSR {
+		index = bits.Len32(val) - 1
+	}
+	c.setOperandValue32(inst.Dest, uint32(index))
+	return nil
+}
+
+// SETcc r/m8, cc - Store 1 in r/m8 if condition cc holds, otherwise 0
+func (c *CPU) execSETcc(inst Instruction) error {
+	var val uint16
+	if c.condition(uint8(c.getOperandValue(inst.Src))) {
+		val = 1
+	}
+	c.setOperandValue(inst.Dest, val)
+	return nil
+}
+
+// condition evaluates one of the sixteen conditions of Jcc and SETcc,
+// numbered in machine code order: O, NO, B, AE, E, NE, BE, A, S, NS, P, NP,
+// L, GE, LE, G. Each odd condition is the negation of the one before it.
+func (c *CPU) condition(cc uint8) bool {
+	f := c.Flags
+	var result bool
+	switch (cc & 0x0F) >> 1 {
+	case 0:
+		result = f.OF
+	case 1:
+		result = f.CF
+	case 2:
+		result = f.ZF
+	case 3:
+		result = f.CF || f.ZF
+	case 4:
+		result = f.SF
+	case 5:
+		result = f.PF
+	case 6:
+		result = f.SF != f.OF
+	case 7:
+		result = f.ZF || f.SF != f.OF
+	}
+	return result != (cc&1 != 0)
+}
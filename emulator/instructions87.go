@@ -0,0 +1,927 @@
+package emulator
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+)
+
+// FPUOp selects the x87 operation of an OpFPU instruction. In the bytecode
+// it is the byte that follows the opcode.
+type FPUOp byte
+
+// x87 operations. Arithmetic takes a destination and a source operand, one
+// of which is ST(0); the other instructions take at most one operand, in
+// Dest. Memory operands are words unless marked as doublewords, quadwords
+// or ten-byte values; the operation decides between integers and reals.
+const (
+	// Load and store
+	OpFLD    FPUOp = 0x01 // Push a real or ST(i)
+	OpFST    FPUOp = 0x02 // Store ST(0) as a real or into ST(i)
+	OpFSTP   FPUOp = 0x03 // Store ST(0) and pop
+	OpFILD   FPUOp = 0x04 // Push an integer
+	OpFIST   FPUOp = 0x05 // Store ST(0) as an integer
+	OpFISTP  FPUOp = 0x06 // Store ST(0) as an integer and pop
+	OpFXCH   FPUOp = 0x07 // Exchange ST(0) and ST(i)
+	OpFLDZ   FPUOp = 0x08 // Push +0.0
+	OpFLD1   FPUOp = 0x09 // Push +1.0
+	OpFLDPI  FPUOp = 0x0A // Push pi
+	OpFLDL2E FPUOp = 0x0B // Push log2(e)
+	OpFLDL2T FPUOp = 0x0C // Push log2(10)
+	OpFLDLG2 FPUOp = 0x0D // Push log10(2)
+	OpFLDLN2 FPUOp = 0x0E // Push ln(2)
+
+	// Arithmetic on reals and registers (dest, src)
+	OpFADD   FPUOp = 0x10
+	OpFADDP  FPUOp = 0x11 // ... and pop
+	OpFSUB   FPUOp = 0x12 // dest = dest - src
+	OpFSUBP  FPUOp = 0x13
+	OpFSUBR  FPUOp = 0x14 // dest = src - dest
+	OpFSUBRP FPUOp = 0x15
+	OpFMUL   FPUOp = 0x16
+	OpFMULP  FPUOp = 0x17
+	OpFDIV   FPUOp = 0x18 // dest = dest / src
+	OpFDIVP  FPUOp = 0x19
+	OpFDIVR  FPUOp = 0x1A // dest = src / dest
+	OpFDIVRP FPUOp = 0x1B
+
+	// Arithmetic on integers in memory (ST(0), mem)
+	OpFIADD  FPUOp = 0x20
+	OpFISUB  FPUOp = 0x21
+	OpFISUBR FPUOp = 0x22
+	OpFIMUL  FPUOp = 0x23
+	OpFIDIV  FPUOp = 0x24
+	OpFIDIVR FPUOp = 0x25
+
+	// Other arithmetic on ST(0), and ST(1) where noted
+	OpFSQRT   FPUOp = 0x30
+	OpFABS    FPUOp = 0x31
+	OpFCHS    FPUOp = 0x32
+	OpFRNDINT FPUOp = 0x33 // Round to an integer as the rounding control says
+	OpFSCALE  FPUOp = 0x34 // ST(0) * 2^trunc(ST(1))
+	OpFPREM   FPUOp = 0x35 // Partial remainder of ST(0) / ST(1), quotient truncated
+	OpFPREM1  FPUOp = 0x36 // IEEE remainder of ST(0) / ST(1), quotient rounded
+	OpFXTRACT FPUOp = 0x37 // Split ST(0) into exponent and significand
+
+	// Comparison: C3, C2 and C0 are set like ZF, PF and CF by SAHF
+	OpFCOM    FPUOp = 0x40 // Compare ST(0) with a real or ST(i)
+	OpFCOMP   FPUOp = 0x41 // ... and pop
+	OpFCOMPP  FPUOp = 0x42 // Compare ST(0) with ST(1) and pop both
+	OpFICOM   FPUOp = 0x43 // Compare ST(0) with an integer
+	OpFICOMP  FPUOp = 0x44
+	OpFUCOM   FPUOp = 0x45 // Unordered compare: quiet NaNs are not invalid
+	OpFUCOMP  FPUOp = 0x46
+	OpFUCOMPP FPUOp = 0x47
+	OpFTST    FPUOp = 0x48 // Compare ST(0) with 0.0
+	OpFXAM    FPUOp = 0x49 // Classify ST(0)
+
+	// Transcendental
+	OpFSIN    FPUOp = 0x50
+	OpFCOS    FPUOp = 0x51
+	OpFSINCOS FPUOp = 0x52 // ST(0) = sin, then push cos
+	OpFPTAN   FPUOp = 0x53 // ST(0) = tan, then push 1.0
+	OpFPATAN  FPUOp = 0x54 // ST(1) = atan(ST(1) / ST(0)), then pop
+	OpF2XM1   FPUOp = 0x55 // 2^ST(0) - 1
+	OpFYL2X   FPUOp = 0x56 // ST(1) = ST(1) * log2(ST(0)), then pop
+	OpFYL2XP1 FPUOp = 0x57 // ST(1) = ST(1) * log2(ST(0) + 1), then pop
+
+	// Control
+	OpFINIT   FPUOp = 0x60
+	OpFCLEX   FPUOp = 0x61 // Clear the exception flags
+	OpFLDCW   FPUOp = 0x62 // Load the control word from memory
+	OpFSTCW   FPUOp = 0x63 // Store the control word to memory
+	OpFSTSW   FPUOp = 0x64 // Store the status word to memory or AX
+	OpFWAIT   FPUOp = 0x65 // Wait for the FPU (WAIT)
+	OpFNOP    FPUOp = 0x66
+	OpFFREE   FPUOp = 0x67 // Tag ST(i) empty
+	OpFINCSTP FPUOp = 0x68 // Increment TOP
+	OpFDECSTP FPUOp = 0x69 // Decrement TOP
+)
+
+// fpuOpInfo describes an x87 operation
+type fpuOpInfo struct {
+	name     string
+	operands int      // Operands in the bytecode
+	integer  bool     // A memory operand is an integer rather than a real
+	model    CPUModel // First CPU whose coprocessor has the instruction
+}
+
+// fpuOps describes each x87 operation. The 80387 added FSIN, FCOS,
+// FSINCOS, FPREM1 and the unordered compares; FSTSW AX needs an 80287.
+var fpuOps = map[FPUOp]fpuOpInfo{
+	OpFLD:    {"FLD", 1, false, Model8086},
+	OpFST:    {"FST", 1, false, Model8086},
+	OpFSTP:   {"FSTP", 1, false, Model8086},
+	OpFILD:   {"FILD", 1, true, Model8086},
+	OpFIST:   {"FIST", 1, true, Model8086},
+	OpFISTP:  {"FISTP", 1, true, Model8086},
+	OpFXCH:   {"FXCH", 1, false, Model8086},
+	OpFLDZ:   {"FLDZ", 0, false, Model8086},
+	OpFLD1:   {"FLD1", 0, false, Model8086},
+	OpFLDPI:  {"FLDPI", 0, false, Model8086},
+	OpFLDL2E: {"FLDL2E", 0, false, Model8086},
+	OpFLDL2T: {"FLDL2T", 0, false, Model8086},
+	OpFLDLG2: {"FLDLG2", 0, false, Model8086},
+	OpFLDLN2: {"FLDLN2", 0, false, Model8086},
+
+	OpFADD:   {"FADD", 2, false, Model8086},
+	OpFADDP:  {"FADDP", 2, false, Model8086},
+	OpFSUB:   {"FSUB", 2, false, Model8086},
+	OpFSUBP:  {"FSUBP", 2, false, Model8086},
+	OpFSUBR:  {"FSUBR", 2, false, Model8086},
+	OpFSUBRP: {"FSUBRP", 2, false, Model8086},
+	OpFMUL:   {"FMUL", 2, false, Model8086},
+	OpFMULP:  {"FMULP", 2, false, Model8086},
+	OpFDIV:   {"FDIV", 2, false, Model8086},
+	OpFDIVP:  {"FDIVP", 2, false, Model8086},
+	OpFDIVR:  {"FDIVR", 2, false, Model8086},
+	OpFDIVRP: {"FDIVRP", 2, false, Model8086},
+	OpFIADD:  {"FIADD", 2, true, Model8086},
+	OpFISUB:  {"FISUB", 2, true, Model8086},
+	OpFISUBR: {"FISUBR", 2, true, Model8086},
+	OpFIMUL:  {"FIMUL", 2, true, Model8086},
+	OpFIDIV:  {"FIDIV", 2, true, Model8086},
+	OpFIDIVR: {"FIDIVR", 2, true, Model8086},
+
+	OpFSQRT:   {"FSQRT", 0, false, Model8086},
+	OpFABS:    {"FABS", 0, false, Model8086},
+	OpFCHS:    {"FCHS", 0, false, Model8086},
+	OpFRNDINT: {"FRNDINT", 0, false, Model8086},
+	OpFSCALE:  {"FSCALE", 0, false, Model8086},
+	OpFPREM:   {"FPREM", 0, false, Model8086},
+	OpFPREM1:  {"FPREM1", 0, false, Model386},
+	OpFXTRACT: {"FXTRACT", 0, false, Model8086},
+
+	OpFCOM:    {"FCOM", 1, false, Model8086},
+	OpFCOMP:   {"FCOMP", 1, false, Model8086},
+	OpFCOMPP:  {"FCOMPP", 0, false, Model8086},
+	OpFICOM:   {"FICOM", 1, true, Model8086},
+	OpFICOMP:  {"FICOMP", 1, true, Model8086},
+	OpFUCOM:   {"FUCOM", 1, false, Model386},
+	OpFUCOMP:  {"FUCOMP", 1, false, Model386},
+	OpFUCOMPP: {"FUCOMPP", 0, false, Model386},
+	OpFTST:    {"FTST", 0, false, Model8086},
+	OpFXAM:    {"FXAM", 0, false, Model8086},
+
+	OpFSIN:    {"FSIN", 0, false, Model386},
+	OpFCOS:    {"FCOS", 0, false, Model386},
+	OpFSINCOS: {"FSINCOS", 0, false, Model386},
+	OpFPTAN:   {"FPTAN", 0, false, Model8086},
+	OpFPATAN:  {"FPATAN", 0, false, Model8086},
+	OpF2XM1:   {"F2XM1", 0, false, Model8086},
+	OpFYL2X:   {"FYL2X", 0, false, Model8086},
+	OpFYL2XP1: {"FYL2XP1", 0, false, Model8086},
+
+	OpFINIT:   {"FINIT", 0, false, Model8086},
+	OpFCLEX:   {"FCLEX", 0, false, Model8086},
+	OpFLDCW:   {"FLDCW", 1, false, Model8086},
+	OpFSTCW:   {"FSTCW", 1, false, Model8086},
+	OpFSTSW:   {"FSTSW", 1, false, Model8086},
+	OpFWAIT:   {"FWAIT", 0, false, Model8086},
+	OpFNOP:    {"FNOP", 0, false, Model8086},
+	OpFFREE:   {"FFREE", 1, false, Model8086},
+	OpFINCSTP: {"FINCSTP", 0, false, Model8086},
+	OpFDECSTP: {"FDECSTP", 0, false, Model8086},
+}
+
+// String returns the mnemonic of the operation
+func (op FPUOp) String() string {
+	if info, ok := fpuOps[op]; ok {
+		return info.name
+	}
+	return fmt.Sprintf("FPUOp(0x%02X)", byte(op))
+}
+
+// fpuModel returns the first CPU model whose coprocessor implements an x87
+// instruction
+func fpuModel(inst Instruction) CPUModel {
+	if inst.Dest.Addr32 || inst.Src.Addr32 {
+		return Model386
+	}
+	if inst.FPU == OpFSTSW && inst.Dest.Type == OpTypeReg16 {
+		return Model286
+	}
+	return fpuOps[inst.FPU].model
+}
+
+// Constants loaded by FLDZ ... FLDLN2, rounded to nearest
+var fpuConstants = map[FPUOp]Float80{
+	OpFLDZ:   {},
+	OpFLD1:   {Mant: 0x8000000000000000, SE: 0x3FFF},
+	OpFLDPI:  {Mant: 0xC90FDAA22168C235, SE: 0x4000},
+	OpFLDL2E: {Mant: 0xB8AA3B295C17F0BC, SE: 0x3FFF},
+	OpFLDL2T: {Mant: 0xD49A784BCD1B8AFE, SE: 0x4000},
+	OpFLDLG2: {Mant: 0x9A209A84FBCFF799, SE: 0x3FFD},
+	OpFLDLN2: {Mant: 0xB17217F7D1CF79AC, SE: 0x3FFE},
+}
+
+// execFPU executes an x87 instruction
+func (c *CPU) execFPU(inst Instruction) error {
+	f := &c.FPU
+	info, ok := fpuOps[inst.FPU]
+	if !ok {
+		return fmt.Errorf("invalid x87 operation 0x%02X", byte(inst.FPU))
+	}
+
+	// C1 reports stack overflow or rounding up for the instruction that ran
+	// last; the control instructions leave the condition codes alone
+	if inst.FPU < OpFINIT {
+		f.Status &^= fpuC1
+	}
+
+	switch inst.FPU {
+	case OpFLD, OpFILD:
+		v, err := c.fpuLoad(inst.Dest, info.integer)
+		if err != nil {
+			return err
+		}
+		f.push(v)
+	case OpFST, OpFSTP, OpFIST, OpFISTP:
+		v, _ := f.get(0)
+		if err := c.fpuStore(inst.Dest, v, info.integer); err != nil {
+			return err
+		}
+		if inst.FPU == OpFSTP || inst.FPU == OpFISTP {
+			f.pop()
+		}
+	case OpFXCH:
+		i, err := stIndex(inst.Dest)
+		if err != nil {
+			return err
+		}
+		a, _ := f.get(0)
+		b, _ := f.get(i)
+		f.set(0, b)
+		f.set(i, a)
+	case OpFLDZ, OpFLD1, OpFLDPI, OpFLDL2E, OpFLDL2T, OpFLDLG2, OpFLDLN2:
+		f.push(fpuConstants[inst.FPU])
+
+	case OpFADD, OpFADDP, OpFSUB, OpFSUBP, OpFSUBR, OpFSUBRP,
+		OpFMUL, OpFMULP, OpFDIV, OpFDIVP, OpFDIVR, OpFDIVRP,
+		OpFIADD, OpFISUB, OpFISUBR, OpFIMUL, OpFIDIV, OpFIDIVR:
+		return c.fpuArith(inst, info)
+
+	case OpFSQRT:
+		if v, ok := f.get(0); ok {
+			f.set(0, f.sqrt(v))
+		}
+	case OpFABS:
+		if v, ok := f.get(0); ok {
+			f.set(0, v.abs())
+		}
+	case OpFCHS:
+		if v, ok := f.get(0); ok {
+			f.set(0, v.neg())
+		}
+	case OpFRNDINT:
+		if v, ok := f.get(0); ok {
+			f.set(0, f.roundInt(v))
+		}
+	case OpFSCALE:
+		a, okA := f.get(0)
+		b, okB := f.get(1)
+		if okA && okB {
+			f.set(0, f.scale(a, b))
+		}
+	case OpFPREM, OpFPREM1:
+		a, okA := f.get(0)
+		b, okB := f.get(1)
+		if okA && okB {
+			f.set(0, f.remainder(a, b, inst.FPU == OpFPREM1))
+		} else {
+			f.set(0, float80Indefinite)
+		}
+	case OpFXTRACT:
+		v, ok := f.get(0)
+		if !ok {
+			f.push(float80Indefinite)
+			break
+		}
+		exponent, significand := f.extract(v)
+		f.set(0, exponent)
+		f.push(significand)
+
+	case OpFCOM, OpFCOMP, OpFICOM, OpFICOMP, OpFUCOM, OpFUCOMP:
+		src, err := c.fpuLoad(inst.Dest, info.integer)
+		if err != nil {
+			return err
+		}
+		a, _ := f.get(0)
+		f.compare(a, src, inst.FPU == OpFUCOM || inst.FPU == OpFUCOMP)
+		if inst.FPU == OpFCOMP || inst.FPU == OpFICOMP || inst.FPU == OpFUCOMP {
+			f.pop()
+		}
+	case OpFCOMPP, OpFUCOMPP:
+		a, _ := f.get(0)
+		b, _ := f.get(1)
+		f.compare(a, b, inst.FPU == OpFUCOMPP)
+		f.pop()
+		f.pop()
+	case OpFTST:
+		a, _ := f.get(0)
+		f.compare(a, Float80{}, false)
+	case OpFXAM:
+		f.examine()
+
+	case OpFSIN, OpFCOS, OpFPTAN, OpFSINCOS:
+		f.trig(inst.FPU)
+	case OpFPATAN, OpFYL2X, OpFYL2XP1:
+		f.logarithm(inst.FPU)
+	case OpF2XM1:
+		if v, ok := f.get(0); ok {
+			f.set(0, f.unary(v, func(x float64) float64 { return math.Expm1(x * math.Ln2) }))
+		}
+
+	case OpFINIT:
+		f.Init()
+	case OpFCLEX:
+		f.Status &^= fpuExceptions | fpuSF | fpuES | fpuB
+	case OpFLDCW:
+		f.Control = c.getOperandValue(inst.Dest)&0x1F3F | 0x0040
+	case OpFSTCW:
+		c.setOperandValue(inst.Dest, f.Control)
+	case OpFSTSW:
+		c.setOperandValue(inst.Dest, f.Status)
+	case OpFWAIT, OpFNOP:
+	case OpFFREE:
+		i, err := stIndex(inst.Dest)
+		if err != nil {
+			return err
+		}
+		f.setTag(f.physical(i), tagEmpty)
+	case OpFINCSTP:
+		f.setTop(f.top() + 1)
+	case OpFDECSTP:
+		f.setTop(f.top() - 1)
+	}
+	return nil
+}
+
+// stIndex returns i of an ST(i) operand
+func stIndex(op Operand) (int, error) {
+	if op.Type != OpTypeST {
+		return 0, fmt.Errorf("expected an x87 register operand")
+	}
+	return int(op.Imm8 & 7), nil
+}
+
+// fpuArith executes the two-operand arithmetic instructions
+func (c *CPU) fpuArith(inst Instruction, info fpuOpInfo) error {
+	f := &c.FPU
+	dest, err := stIndex(inst.Dest)
+	if err != nil {
+		return err
+	}
+	a, _ := f.get(dest)
+	b, err := c.fpuLoad(inst.Src, info.integer)
+	if err != nil {
+		return err
+	}
+
+	var op byte
+	switch inst.FPU {
+	case OpFADD, OpFADDP, OpFIADD:
+		op = '+'
+	case OpFSUB, OpFSUBP, OpFISUB:
+		op = '-'
+	case OpFSUBR, OpFSUBRP, OpFISUBR:
+		a, b, op = b, a, '-'
+	case OpFMUL, OpFMULP, OpFIMUL:
+		op = '*'
+	case OpFDIV, OpFDIVP, OpFIDIV:
+		op = '/'
+	case OpFDIVR, OpFDIVRP, OpFIDIVR:
+		a, b, op = b, a, '/'
+	}
+	f.set(dest, f.arith(op, a, b))
+
+	switch inst.FPU {
+	case OpFADDP, OpFSUBP, OpFSUBRP, OpFMULP, OpFDIVP, OpFDIVRP:
+		f.pop()
+	}
+	return nil
+}
+
+// fpuLoad reads an x87 source operand: ST(i), or an integer or real in
+// memory of the size the operand is marked with
+func (c *CPU) fpuLoad(op Operand, integer bool) (Float80, error) {
+	if op.Type == OpTypeST {
+		v, _ := c.FPU.get(int(op.Imm8 & 7))
+		return v, nil
+	}
+	if !op.isMemory() {
+		return Float80{}, fmt.Errorf("expected an x87 register or memory operand")
+	}
+	if integer {
+		switch {
+		case op.Qword:
+			return float80FromInt(int64(c.fpuRead(op, 4))), nil
+		case op.Dword:
+			return float80FromInt(int64(int32(c.fpuRead(op, 2)))), nil
+		case !op.Tword:
+			return float80FromInt(int64(int16(c.fpuRead(op, 1)))), nil
+		}
+		return Float80{}, fmt.Errorf("invalid memory operand size for an integer")
+	}
+	switch {
+	case op.Dword:
+		return Float80FromFloat64(float64(math.Float32frombits(uint32(c.fpuRead(op, 2))))), nil
+	case op.Qword:
+		return Float80FromFloat64(math.Float64frombits(c.fpuRead(op, 4))), nil
+	case op.Tword:
+		v := Float80{Mant: c.fpuRead(op, 4)}
+		op.MemAddr += 8
+		v.SE = uint16(c.fpuRead(op, 1))
+		return v, nil
+	}
+	return Float80{}, fmt.Errorf("invalid memory operand size for a real")
+}
+
+// fpuStore writes ST(0) to an x87 destination operand: ST(i), or an
+// integer or real in memory of the size the operand is marked with.
+// Integers and reals are rounded as the rounding control says; a value
+// out of an integer's range stores the integer indefinite, the most
+// negative integer.
+func (c *CPU) fpuStore(op Operand, v Float80, integer bool) error {
+	f := &c.FPU
+	if op.Type == OpTypeST {
+		f.set(int(op.Imm8&7), v)
+		return nil
+	}
+	if !op.isMemory() {
+		return fmt.Errorf("expected an x87 register or memory operand")
+	}
+
+	if integer {
+		words := 1
+		switch {
+		case op.Qword:
+			words = 4
+		case op.Dword:
+			words = 2
+		case op.Tword:
+			return fmt.Errorf("invalid memory operand size for an integer")
+		}
+		c.fpuWrite(op, uint64(f.toInt(v, 16*words)), words)
+		return nil
+	}
+
+	var flags uint16
+	switch {
+	case op.Dword:
+		r, inexact := v.Float32(f.rounding())
+		flags = storeFlags(v, math.IsInf(float64(r), 0), inexact)
+		c.fpuWrite(op, uint64(math.Float32bits(r)), 2)
+	case op.Qword:
+		r, inexact := v.float64Rounded(f.rounding())
+		flags = storeFlags(v, math.IsInf(r, 0), inexact)
+		c.fpuWrite(op, math.Float64bits(r), 4)
+	case op.Tword:
+		c.fpuWrite(op, v.Mant, 4)
+		op.MemAddr += 8
+		c.fpuWrite(op, uint64(v.SE), 1)
+	default:
+		return fmt.Errorf("invalid memory operand size for a real")
+	}
+	if v.isSNaN() {
+		flags |= fpuIE
+	}
+	f.raise(flags)
+	return nil
+}
+
+// storeFlags returns the exceptions of storing a value as a shorter real
+func storeFlags(v Float80, inf, inexact bool) uint16 {
+	var flags uint16
+	if inf && !v.isInf() {
+		flags |= fpuOE
+	}
+	if inexact {
+		flags |= fpuPE
+	}
+	return flags
+}
+
+// fpuRead reads words consecutive words of memory, wrapping within the
+// segment, as an integer stored little-endian
+func (c *CPU) fpuRead(op Operand, words int) uint64 {
+	var v uint64
+	for i := words - 1; i >= 0; i-- {
+		v = v<<16 | uint64(c.Memory.ReadWordLinear(CalculateLinearAddress(op.MemSegment, op.MemAddr+uint16(2*i))))
+	}
+	return v
+}
+
+// fpuWrite writes the low words of v to memory little-endian
+func (c *CPU) fpuWrite(op Operand, v uint64, words int) {
+	for i := 0; i < words; i++ {
+		c.Memory.WriteWordLinear(CalculateLinearAddress(op.MemSegment, op.MemAddr+uint16(2*i)), uint16(v>>(16*i)))
+	}
+}
+
+// toInt rounds a value to a signed integer of the given width as the
+// rounding control says. NaNs, infinities and values out of range are
+// invalid and give the integer indefinite.
+func (f *FPU) toInt(v Float80, width int) int64 {
+	indefinite := int64(-1) << (width - 1)
+	if v.isNaN() || v.isInf() {
+		f.raise(fpuIE)
+		return indefinite
+	}
+	n, inexact := roundToInt(v.big(), f.rounding())
+	if n.BitLen() > width-1 && !(n.IsInt64() && n.Int64() == indefinite) {
+		f.raise(fpuIE)
+		return indefinite
+	}
+	if inexact {
+		f.raise(fpuPE)
+	}
+	return n.Int64()
+}
+
+// nan returns the result of an operation on NaNs: the NaN with the larger
+// significand, made quiet. A signaling NaN is an invalid operation.
+func (f *FPU) nan(a, b Float80) Float80 {
+	if a.isSNaN() || b.isSNaN() {
+		f.raise(fpuIE)
+	}
+	switch {
+	case !b.isNaN():
+		return a.quiet()
+	case !a.isNaN() || b.Mant > a.Mant:
+		return b.quiet()
+	}
+	return a.quiet()
+}
+
+// invalid raises the invalid operation exception and returns the
+// indefinite NaN
+func (f *FPU) invalid() Float80 {
+	f.raise(fpuIE)
+	return float80Indefinite
+}
+
+// arith computes a+b, a-b, a*b or a/b rounded to the precision and
+// rounding mode of the control word
+func (f *FPU) arith(op byte, a, b Float80) Float80 {
+	if a.isNaN() || b.isNaN() {
+		return f.nan(a, b)
+	}
+	if a.isDenormal() || b.isDenormal() {
+		f.raise(fpuDE)
+	}
+
+	neg := a.negative() != b.negative()
+	switch op {
+	case '+':
+		if a.isInf() && b.isInf() && neg {
+			return f.invalid()
+		}
+	case '-':
+		if a.isInf() && b.isInf() && !neg {
+			return f.invalid()
+		}
+	case '*':
+		if (a.isInf() && b.isZero()) || (a.isZero() && b.isInf()) {
+			return f.invalid()
+		}
+	case '/':
+		switch {
+		case (a.isInf() && b.isInf()) || (a.isZero() && b.isZero()):
+			return f.invalid()
+		case b.isZero():
+			f.raise(fpuZE)
+			return infinity(neg)
+		}
+	}
+
+	z := new(big.Float).SetPrec(f.precision()).SetMode(f.rounding())
+	x, y := a.big(), b.big()
+	switch op {
+	case '+':
+		z.Add(x, y)
+	case '-':
+		z.Sub(x, y)
+	case '*':
+		z.Mul(x, y)
+	case '/':
+		z.Quo(x, y)
+	}
+	return f.roundResult(z)
+}
+
+// roundResult encodes a result already rounded to the control word's
+// precision, raising the precision exception if the rounding was inexact
+func (f *FPU) roundResult(z *big.Float) Float80 {
+	acc := z.Acc()
+	v := f.round(z)
+	if acc != big.Exact {
+		f.raise(fpuPE)
+		if (acc == big.Above) != z.Signbit() {
+			f.raise(fpuC1)
+		}
+	}
+	return v
+}
+
+// sqrt computes the square root, rounded as the control word says
+func (f *FPU) sqrt(v Float80) Float80 {
+	switch {
+	case v.isNaN():
+		return f.nan(v, v)
+	case v.isZero():
+		return v
+	case v.negative():
+		return f.invalid()
+	case v.isInf():
+		return v
+	}
+	if v.isDenormal() {
+		f.raise(fpuDE)
+	}
+	x := v.big()
+	z := new(big.Float).SetPrec(f.precision()).SetMode(f.rounding()).Sqrt(x)
+	result := f.round(z)
+	square := new(big.Float).SetPrec(256).Mul(z, z)
+	if square.Cmp(x) != 0 {
+		f.raise(fpuPE)
+	}
+	return result
+}
+
+// roundInt rounds to an integer as the rounding control says
+func (f *FPU) roundInt(v Float80) Float80 {
+	switch {
+	case v.isNaN():
+		return f.nan(v, v)
+	case v.isInf() || v.isZero():
+		return v
+	}
+	n, inexact := roundToInt(v.big(), f.rounding())
+	if inexact {
+		f.raise(fpuPE)
+	}
+	if n.Sign() == 0 {
+		return zero(v.negative())
+	}
+	return f.round(new(big.Float).SetInt(n))
+}
+
+// scale computes a * 2^trunc(b)
+func (f *FPU) scale(a, b Float80) Float80 {
+	switch {
+	case a.isNaN() || b.isNaN():
+		return f.nan(a, b)
+	case b.isInf() && !b.negative():
+		if a.isZero() {
+			return f.invalid()
+		}
+		return infinity(a.negative())
+	case b.isInf():
+		if a.isInf() {
+			return f.invalid()
+		}
+		return zero(a.negative())
+	case a.isInf() || a.isZero():
+		return a
+	}
+
+	n, _ := b.big().Int64()
+	const limit = 1 << 16 // Beyond this every result overflows or underflows
+	n = max(-limit, min(limit, n))
+	x := a.big()
+	return f.round(x.SetMantExp(x, int(n)))
+}
+
+// remainder computes the partial remainder of FPREM (quotient truncated
+// toward zero) or FPREM1 (quotient rounded to nearest). C0, C3 and C1
+// receive the three low bits of the quotient. When the exponents differ by
+// 64 or more only a partial reduction is done, and C2 is set so that the
+// program repeats the instruction.
+func (f *FPU) remainder(a, b Float80, nearest bool) Float80 {
+	f.Status &^= fpuC2
+	switch {
+	case a.isNaN() || b.isNaN():
+		return f.nan(a, b)
+	case a.isInf() || b.isZero():
+		return f.invalid()
+	case b.isInf() || a.isZero():
+		f.setConditions(0)
+		return a
+	}
+
+	ma, mb := new(big.Int).SetUint64(a.Mant), new(big.Int).SetUint64(b.Mant)
+	scaleA, scaleB := a.scale(), b.scale()
+	diff := (scaleA + ma.BitLen()) - (scaleB + mb.BitLen())
+
+	partial := diff >= 64
+	if partial {
+		// Reduce the exponent difference by 32 to 63 bits
+		scaleB += diff - (32 + (diff-64)%32)
+	}
+
+	// a = ma * 2^scaleA and b = mb * 2^scaleB: align both on the smaller scale
+	scale := min(scaleA, scaleB)
+	ma.Lsh(ma, uint(scaleA-scale))
+	mb.Lsh(mb, uint(scaleB-scale))
+	q, r := new(big.Int).QuoRem(ma, mb, new(big.Int))
+	if nearest && !partial {
+		twice := new(big.Int).Lsh(r, 1)
+		if c := twice.Cmp(mb); c > 0 || (c == 0 && q.Bit(0) == 1) {
+			r.Sub(r, mb)
+			q.Add(q, big.NewInt(1))
+		}
+	}
+
+	if partial {
+		f.Status |= fpuC2
+	} else {
+		var codes uint16
+		if q.Bit(2) == 1 {
+			codes |= fpuC0
+		}
+		if q.Bit(1) == 1 {
+			codes |= fpuC3
+		}
+		if q.Bit(0) == 1 {
+			codes |= fpuC1
+		}
+		f.setConditions(codes)
+	}
+
+	if r.Sign() == 0 {
+		return zero(a.negative())
+	}
+	x := new(big.Float).SetInt(r)
+	x.SetMantExp(x, scale)
+	if a.negative() {
+		x.Neg(x)
+	}
+	return f.round(x)
+}
+
+// extract splits a value into its unbiased exponent and its significand,
+// which keeps the sign and has an exponent of zero
+func (f *FPU) extract(v Float80) (exponent, significand Float80) {
+	switch {
+	case v.isNaN():
+		q := f.nan(v, v)
+		return q, q
+	case v.isInf():
+		return infinity(false), v
+	case v.isZero():
+		f.raise(fpuZE)
+		return infinity(true), v
+	}
+	x := v.big()
+	exp := x.MantExp(x) - 1 // x is now in [0.5, 1)
+	x.SetMantExp(x, 1)
+	return float80FromInt(int64(exp)), f.round(x)
+}
+
+// compare compares a with b and sets C3, C2 and C0: 000 if a > b, 001 if
+// a < b, 100 if equal and 111 if unordered. Unordered compares of a
+// signaling NaN, and ordered compares of any NaN, are invalid operations.
+func (f *FPU) compare(a, b Float80, unordered bool) {
+	if a.isNaN() || b.isNaN() {
+		if !unordered || a.isSNaN() || b.isSNaN() {
+			f.raise(fpuIE)
+		}
+		f.setConditions(fpuC3 | fpuC2 | fpuC0)
+		return
+	}
+	if a.isDenormal() || b.isDenormal() {
+		f.raise(fpuDE)
+	}
+	switch a.big().Cmp(b.big()) {
+	case 1:
+		f.setConditions(0)
+	case -1:
+		f.setConditions(fpuC0)
+	default:
+		f.setConditions(fpuC3)
+	}
+}
+
+// examine classifies ST(0) into C3, C2 and C0, with its sign in C1
+func (f *FPU) examine() {
+	v := f.ST(0)
+	var codes uint16
+	switch {
+	case f.IsEmpty(0):
+		codes = fpuC3 | fpuC0
+	case v.isNaN():
+		codes = fpuC0
+	case v.isInf():
+		codes = fpuC2 | fpuC0
+	case v.isZero():
+		codes = fpuC3
+	case v.isDenormal():
+		codes = fpuC3 | fpuC2
+	case v.Mant>>63 == 0:
+		codes = 0 // Unnormal: unsupported
+	default:
+		codes = fpuC2
+	}
+	if v.negative() {
+		codes |= fpuC1
+	}
+	f.setConditions(codes)
+}
+
+// unary computes a transcendental function of a finite value in double
+// precision
+func (f *FPU) unary(v Float80, fn func(float64) float64) Float80 {
+	switch {
+	case v.isNaN():
+		return f.nan(v, v)
+	case v.isInf():
+		return f.invalid()
+	}
+	result := fn(v.Float64())
+	if math.IsNaN(result) {
+		return f.invalid()
+	}
+	if !v.isZero() {
+		f.raise(fpuPE)
+	}
+	return f.round(new(big.Float).SetFloat64(result))
+}
+
+// trig executes FSIN, FCOS, FSINCOS and FPTAN. An operand of magnitude
+// 2^63 or more is out of range: it is left unchanged and C2 is set.
+func (f *FPU) trig(op FPUOp) {
+	v, ok := f.get(0)
+	f.Status &^= fpuC2
+	if ok && v.exponent() >= float80Bias+63 && v.exponent() != float80MaxExp {
+		f.Status |= fpuC2
+		return
+	}
+	if (op == OpFSINCOS || op == OpFPTAN) && !f.IsEmpty(7) {
+		f.raise(fpuIE | fpuSF | fpuC1)
+		f.set(0, float80Indefinite)
+		f.push(float80Indefinite)
+		return
+	}
+
+	switch op {
+	case OpFSIN:
+		f.set(0, f.unary(v, math.Sin))
+	case OpFCOS:
+		f.set(0, f.unary(v, math.Cos))
+	case OpFSINCOS:
+		sin, cos := f.unary(v, math.Sin), f.unary(v, math.Cos)
+		f.set(0, sin)
+		f.push(cos)
+	case OpFPTAN:
+		tan := f.unary(v, math.Tan)
+		f.set(0, tan)
+		if tan.isNaN() {
+			f.push(tan)
+		} else {
+			f.push(fpuConstants[OpFLD1])
+		}
+	}
+}
+
+// logarithm executes FPATAN, FYL2X and FYL2XP1, which combine ST(0) and
+// ST(1) into ST(1) and pop
+func (f *FPU) logarithm(op FPUOp) {
+	x, okX := f.get(0)
+	y, okY := f.get(1)
+	var result Float80
+	switch {
+	case !okX || !okY:
+		result = float80Indefinite
+	case x.isNaN() || y.isNaN():
+		result = f.nan(x, y)
+	case op == OpFPATAN:
+		f.raise(fpuPE)
+		result = f.round(new(big.Float).SetFloat64(math.Atan2(y.Float64(), x.Float64())))
+	case x.negative() && !x.isZero() && (op == OpFYL2X || x.Float64() < -1):
+		result = f.invalid()
+	case op == OpFYL2X && x.isZero():
+		if y.isZero() {
+			result = f.invalid()
+		} else {
+			f.raise(fpuZE)
+			result = infinity(!y.negative())
+		}
+	default:
+		var log float64
+		if op == OpFYL2X {
+			log = math.Log2(x.Float64())
+		} else {
+			log = math.Log1p(x.Float64()) / math.Ln2
+		}
+		product := y.Float64() * log
+		if math.IsNaN(product) {
+			result = f.invalid()
+		} else {
+			f.raise(fpuPE)
+			result = f.round(new(big.Float).SetFloat64(product))
+		}
+	}
+	f.set(1, result)
+	f.pop()
+}
@@ -0,0 +1,164 @@
+package emulator
+
+import "fmt"
+
+const (
+	// IVTBase is the linear address of the interrupt vector table: 256 far
+	// pointers stored as offset, segment
+	IVTBase = 0x00000
+
+	// BIOSSegment holds the BIOS ROM, including the interrupt service stubs
+	BIOSSegment = 0xF000
+
+	// biosStubOffset is the offset of the first service stub in BIOSSegment.
+	// Vector n initially points at BIOSSegment:biosStubOffset+n.
+	biosStubOffset = 0xE000
+
+	// biosIRETStub is the stub index of a plain IRET that ends a service
+	// after it has called a user hook, such as INT 08h calling INT 1Ch
+	biosIRETStub = 0x100
+
+	// BIOS data area timer tick counter: a dword of ticks since midnight and
+	// a byte set when the count passes midnight
+	biosTickCount    = 0x046C
+	biosMidnightFlag = 0x0470
+	ticksPerDay      = 0x1800B0
+)
+
+// installInterruptVectors points every vector of the IVT at its service stub
+// in the BIOS ROM. Each stub is a single IRET byte, so vectors without a
+// service return straight away like a real BIOS's dummy handler.
+func (c *CPU) installInterruptVectors() {
+	for vector := 0; vector < 256; vector++ {
+		// ROM is read-only to programs, so the stub is written directly
+		c.Memory.RAM[CalculateLinearAddress(BIOSSegment, biosStubOffset)+uint32(vector)] = 0xCF
+		c.SetInterruptVector(uint8(vector), BIOSSegment, biosStubOffset+uint16(vector))
+	}
+	c.Memory.RAM[CalculateLinearAddress(BIOSSegment, biosStubOffset+biosIRETStub)] = 0xCF
+}
+
+// GetInterruptVector returns the handler address of an interrupt vector
+func (c *CPU) GetInterruptVector(vector uint8) (segment, offset uint16) {
+	addr := uint32(IVTBase) + uint32(vector)*4
+	return c.Memory.ReadWordLinear(addr + 2), c.Memory.ReadWordLinear(addr)
+}
+
+// SetInterruptVector sets the handler address of an interrupt vector
+func (c *CPU) SetInterruptVector(vector uint8, segment, offset uint16) {
+	addr := uint32(IVTBase) + uint32(vector)*4
+	c.Memory.WriteWordLinear(addr, offset)
+	c.Memory.WriteWordLinear(addr+2, segment)
+}
+
+// Interrupt performs the 8086 interrupt sequence: FLAGS, CS and IP are
+// pushed, IF and TF are cleared and execution continues at the handler from
+// the vector table. A vector that still points at its BIOS stub runs the
+// service immediately.
+func (c *CPU) Interrupt(vector uint8) error {
+	if err := c.Push(c.Flags.Word()); err != nil {
+		return err
+	}
+	if err := c.Push(c.CS); err != nil {
+		return err
+	}
+	if err := c.Push(c.IP); err != nil {
+		return err
+	}
+	c.Flags.IF = false
+	c.Flags.TF = false
+	c.CS, c.IP = c.GetInterruptVector(vector)
+
+	if stub, ok := c.serviceStub(); ok {
+		return c.runService(stub)
+	}
+	return nil
+}
+
+// IRET instruction - return from an interrupt handler
+func (c *CPU) execIRET(inst Instruction) error {
+	ip, err := c.Pop()
+	if err != nil {
+		return err
+	}
+	cs, err := c.Pop()
+	if err != nil {
+		return err
+	}
+	flags, err := c.Pop()
+	if err != nil {
+		return err
+	}
+	c.IP, c.CS = ip, cs
+	c.Flags.SetWord(flags)
+	return nil
+}
+
+// serviceStub reports whether CS:IP is one of the BIOS service stubs and
+// returns its index, which is the vector for the stubs of the vector table.
+// Programs reach a stub through INT or by chaining to a vector they saved.
+func (c *CPU) serviceStub() (uint16, bool) {
+	if c.CS != BIOSSegment || c.IP < biosStubOffset || c.IP > biosStubOffset+biosIRETStub {
+		return 0, false
+	}
+	return c.IP - biosStubOffset, true
+}
+
+// runService runs the BIOS or DOS service of a stub and returns to the
+// caller. Like the real BIOS (which returns with RETF 2), the status flags
+// set by the service are kept, while IF, TF and DF are restored from the
+// FLAGS pushed by the interrupt. The timer service instead ends by calling
+// the INT 1Ch hook, and returns when the hook's IRET reaches the IRET stub.
+func (c *CPU) runService(vector uint16) error {
+	var err error
+	switch vector {
+	case 0x08: // Timer tick (IRQ0)
+		c.timerTick()
+		c.PIC.Write(0x20, 0x20) // EOI first, so a hook that never returns keeps the timer running
+		return c.callHook(0x1C)
+	case 0x09, 0x0A, 0x0B, 0x0C, 0x0D, 0x0E, 0x0F: // Other IRQs
+		// Like the BIOS's dummy IRQ handler, end an unhooked request
+		c.PIC.Write(0x20, 0x20)
+	case 0x10: // Video services
+		err = c.handleInt10()
+	case 0x16: // Keyboard services
+		err = c.handleInt16()
+	case 0x20: // DOS program terminate
+		c.Halted = true
+	case 0x21: // DOS services
+		err = c.handleInt21()
+	case biosIRETStub: // End of a service that called a hook
+		return c.execIRET(Instruction{})
+	}
+	if err != nil {
+		return fmt.Errorf("INT %02Xh: %v", vector, err)
+	}
+
+	status := c.Flags
+	if err := c.execIRET(Instruction{}); err != nil {
+		return err
+	}
+	c.Flags.CF, c.Flags.PF, c.Flags.AF = status.CF, status.PF, status.AF
+	c.Flags.ZF, c.Flags.SF, c.Flags.OF = status.ZF, status.SF, status.OF
+	return nil
+}
+
+// callHook calls a user hook interrupt from inside a BIOS service. The hook
+// returns to the BIOS IRET stub, which then returns from the service.
+func (c *CPU) callHook(vector uint8) error {
+	c.CS, c.IP = BIOSSegment, biosStubOffset+biosIRETStub
+	return c.Interrupt(vector)
+}
+
+// timerTick counts an IRQ0 tick in the BIOS data area, wrapping the count
+// and setting the midnight flag once a day has passed
+func (c *CPU) timerTick() {
+	ticks := uint32(c.Memory.ReadWordLinear(biosTickCount)) |
+		uint32(c.Memory.ReadWordLinear(biosTickCount+2))<<16
+	ticks++
+	if ticks >= ticksPerDay {
+		ticks = 0
+		c.Memory.WriteByteLinear(biosMidnightFlag, 1)
+	}
+	c.Memory.WriteWordLinear(biosTickCount, uint16(ticks))
+	c.Memory.WriteWordLinear(biosTickCount+2, uint16(ticks>>16))
+}
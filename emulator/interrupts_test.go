@@ -0,0 +1,195 @@
+package emulator
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestInterruptVectorTable tests the initial IVT and vector access
+func TestInterruptVectorTable(t *testing.T) {
+	cpu := NewCPU()
+
+	seg, off := cpu.GetInterruptVector(0x10)
+	if seg != BIOSSegment || off != biosStubOffset+0x10 {
+		t.Errorf("Expected INT 10h at F000:E010, got %04X:%04X", seg, off)
+	}
+	if cpu.Memory.ReadByteLinear(CalculateLinearAddress(seg, off)) != 0xCF {
+		t.Error("Expected an IRET byte at the INT 10h stub")
+	}
+
+	cpu.SetInterruptVector(0x1C, 0x1234, 0x5678)
+	if cpu.Memory.ReadWordLinear(0x1C*4) != 0x5678 || cpu.Memory.ReadWordLinear(0x1C*4+2) != 0x1234 {
+		t.Error("Expected vector 1Ch stored as offset, segment at 0000:0070")
+	}
+
+	cpu.Reset()
+	if seg, off := cpu.GetInterruptVector(0x1C); seg != BIOSSegment || off != biosStubOffset+0x1C {
+		t.Errorf("Expected Reset to reinstall vector 1Ch, got %04X:%04X", seg, off)
+	}
+}
+
+// TestBytecodeInterrupts tests INT and IRET in bytecode programs, including
+// vectors without a service and the flags returned by a BIOS service
+func TestBytecodeInterrupts(t *testing.T) {
+	program := append(code(OpINT, imm8(0x60)), byte(OpHLT)) // 0000: INT 60h ; HLT
+	handler := append(code(OpMOV, opBX, imm8(7)), byte(OpIRET))
+
+	// A program-installed handler runs and returns past the INT
+	cpu := NewCPU()
+	cpu.LoadBytecode(append(program, handler...), nil)
+	cpu.SetInterruptVector(0x60, BytecodeLoadSegment, uint16(len(program)))
+	cpu.Flags.IF = true
+	runUntilIdle(t, cpu)
+	if cpu.BX != 7 || cpu.IP != uint16(len(program)) {
+		t.Errorf("Expected handler to set BX=7 and halt at %04X, got BX=%d IP=%04X", len(program), cpu.BX, cpu.IP)
+	}
+	if !cpu.Flags.IF || cpu.SP != 0xFFFE {
+		t.Errorf("Expected IRET to restore IF and the stack, got IF=%v SP=%04X", cpu.Flags.IF, cpu.SP)
+	}
+
+	// An unhooked vector returns straight away
+	cpu = NewCPU()
+	cpu.LoadBytecode(program, nil)
+	if err := cpu.Run(); err != nil {
+		t.Fatalf("CPU.Run() failed: %v", err)
+	}
+	if cpu.BX != 0 || cpu.IP != uint16(len(program)) {
+		t.Errorf("Expected INT 60h to return without effect, got BX=%d IP=%04X", cpu.BX, cpu.IP)
+	}
+
+	// INT 16h AH=01h reports "no key" in ZF, which must survive the return
+	cpu = NewCPU()
+	cpu.LoadBytecode(append(code(OpINT, imm8(0x16)), byte(OpHLT)), nil)
+	cpu.AX = 0x0100
+	if err := cpu.Run(); err != nil {
+		t.Fatalf("CPU.Run() failed: %v", err)
+	}
+	if !cpu.Flags.ZF {
+		t.Error("Expected ZF set by INT 16h AH=01h after the return")
+	}
+}
+
+// TestDOSSetGetVector tests INT 21h AH=25h/35h with a handler in a .COM program
+func TestDOSSetGetVector(t *testing.T) {
+	cpu := runCOM(t, []byte{
+		0xBA, 0x11, 0x01, // 0100: MOV DX, 0111h
+		0xB8, 0x60, 0x25, // 0103: MOV AX, 2560h (set vector 60h to DS:DX)
+		0xCD, 0x21, // 0106: INT 21h
+		0xF9,       // 0108: STC
+		0xCD, 0x60, // 0109: INT 60h
+		0xB8, 0x60, 0x35, // 010B: MOV AX, 3560h (get vector 60h)
+		0xCD, 0x21, // 010E: INT 21h
+		0xF4, // 0110: HLT
+		0x41, // 0111: INC CX (handler)
+		0x9C, // 0112: PUSHF
+		0x5E, // 0113: POP SI
+		0xCF, // 0114: IRET
+	})
+
+	if cpu.CX != 1 {
+		t.Errorf("Expected the handler to run once, CX=%d", cpu.CX)
+	}
+	if cpu.ES != COMLoadSegment || cpu.BX != 0x0111 {
+		t.Errorf("Expected vector 60h at %04X:0111, got %04X:%04X", COMLoadSegment, cpu.ES, cpu.BX)
+	}
+	if cpu.SI&FlagIF != 0 || cpu.SI&FlagCF == 0 {
+		t.Errorf("Expected IF clear and CF set inside the handler, FLAGS=%04X", cpu.SI)
+	}
+	if !cpu.Flags.IF || !cpu.Flags.CF {
+		t.Errorf("Expected IRET to restore IF and CF, got %+v", cpu.Flags)
+	}
+}
+
+// TestDOSOutput tests INT 21h AH=09h and AH=02h writing through the BIOS
+// teletype, and that unknown functions stop the program naming AH and the
+// INT
+func TestDOSOutput(t *testing.T) {
+	cpu := runCOM(t, []byte{
+		0xB4, 0x09, // 0100: MOV AH, 09h
+		0xBA, 0x10, 0x01, // 0102: MOV DX, 0110h
+		0xCD, 0x21, // 0105: INT 21h
+		0xB4, 0x02, // 0107: MOV AH, 02h
+		0xB2, 0x21, // 0109: MOV DL, '!'
+		0xCD, 0x21, // 010B: INT 21h
+		0xF4,       // 010D: HLT
+		0x00, 0x00, // 010E
+		'H', 'i', '$', // 0110: "Hi$"
+	})
+	text := cpu.Memory.GetTextMemory()
+	if text[0] != 'H' || text[2] != 'i' || text[4] != '!' || cpu.cursorX != 3 {
+		t.Errorf("Expected \"Hi!\" with the cursor after it, got %q at column %d", []byte{text[0], text[2], text[4]}, cpu.cursorX)
+	}
+	if cpu.GetAL() != '!' {
+		t.Errorf("Expected AL = '!', got %02X", cpu.GetAL())
+	}
+
+	cpu = NewCPU()
+	if err := cpu.LoadCOM([]byte{
+		0xB4, 0x3D, // 0100: MOV AH, 3Dh (open file)
+		0xCD, 0x21, // 0102: INT 21h
+	}); err != nil {
+		t.Fatalf("LoadCOM failed: %v", err)
+	}
+	var err error
+	for i := 0; i < 2 && err == nil; i++ {
+		err = cpu.Step()
+	}
+	if err == nil || !strings.Contains(err.Error(), "3Dh") || !strings.Contains(err.Error(), "1000:0102") {
+		t.Errorf("Expected an error naming function 3Dh at 1000:0102, got %v", err)
+	}
+}
+
+// TestDOSQueries tests the DOS version and current drive, and that AH=00h
+// ends the program like INT 20h and AH=4Ch
+func TestDOSQueries(t *testing.T) {
+	cpu := runCOM(t, []byte{
+		0xB4, 0x30, // 0100: MOV AH, 30h
+		0xCD, 0x21, // 0102: INT 21h
+		0x89, 0xC6, // 0104: MOV SI, AX
+		0xB4, 0x19, // 0106: MOV AH, 19h
+		0xCD, 0x21, // 0108: INT 21h
+		0x88, 0xC2, // 010A: MOV DL, AL
+		0xB4, 0x00, // 010C: MOV AH, 00h
+		0xCD, 0x21, // 010E: INT 21h
+		0x47, // 0110: INC DI
+	})
+	if cpu.SI != 0x0005 || cpu.BX != 0xFF00 || cpu.GetDL() != 2 {
+		t.Errorf("Expected DOS 5.00 on drive C:, got AX=%04X BX=%04X drive %d", cpu.SI, cpu.BX, cpu.GetDL())
+	}
+	if !cpu.Halted || cpu.DI != 0 {
+		t.Errorf("Expected AH=00h to end the program, got halted %v and DI=%04X", cpu.Halted, cpu.DI)
+	}
+}
+
+// TestInterruptChaining tests a program hooking INT 10h and chaining to the
+// saved BIOS vector with a far jump
+func TestInterruptChaining(t *testing.T) {
+	image := make([]byte, 0x50)
+	copy(image, []byte{
+		0xB8, 0x10, 0x35, // 0100: MOV AX, 3510h (get vector 10h)
+		0xCD, 0x21, // 0103: INT 21h
+		0x89, 0x1E, 0x40, 0x01, // 0105: MOV [0140h], BX
+		0x8C, 0x06, 0x42, 0x01, // 0109: MOV [0142h], ES
+		0xBA, 0x30, 0x01, // 010D: MOV DX, 0130h
+		0xB8, 0x10, 0x25, // 0110: MOV AX, 2510h (set vector 10h)
+		0xCD, 0x21, // 0113: INT 21h
+		0xB8, 0x30, 0x11, // 0115: MOV AX, 1130h (get font information)
+		0xCD, 0x10, // 0118: INT 10h
+		0xF4, // 011A: HLT
+	})
+	copy(image[0x30:], []byte{
+		0x47,                   // 0130: INC DI
+		0xFF, 0x2E, 0x40, 0x01, // 0131: JMP FAR [0140h]
+	})
+	cpu := runCOM(t, image)
+
+	if cpu.DI != 1 {
+		t.Errorf("Expected the hook to run once, DI=%d", cpu.DI)
+	}
+	if cpu.CX != 16 || cpu.ES != 0xF000 || cpu.BP != 0xA000 {
+		t.Errorf("Expected the BIOS service to run, got CX=%d ES:BP=%04X:%04X", cpu.CX, cpu.ES, cpu.BP)
+	}
+	if cpu.CS != COMLoadSegment || cpu.IP != 0x011B {
+		t.Errorf("Expected the BIOS to return to the caller, halted at %04X:%04X", cpu.CS, cpu.IP)
+	}
+}
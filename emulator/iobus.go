@@ -0,0 +1,287 @@
+package emulator
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// PortRange is a device that claims the I/O ports First to Last. Its
+// handlers are passed the port accessed. A range without an In handler
+// reads 0 and one without an Out handler ignores writes. Word accesses that
+// start within the range use InWord and OutWord when the range has them and
+// claims both bytes; otherwise they are split into two byte accesses of the
+// port and the port after it, which may belong to different devices.
+type PortRange struct {
+	Name        string
+	First, Last uint16
+	In          func(port uint16) uint8
+	Out         func(port uint16, value uint8)
+	InWord      func(port uint16) uint16
+	OutWord     func(port uint16, value uint16)
+}
+
+// PortPolicy selects what the CPU does on an access to a port that no
+// device has claimed
+type PortPolicy uint8
+
+const (
+	// PortsIgnore reads unclaimed ports as 0 and ignores writes to them
+	PortsIgnore PortPolicy = iota
+
+	// PortsLog ignores the access like PortsIgnore and writes a line about
+	// it to CPU.PortLog, headed by the CS:IP after the instruction
+	PortsLog
+
+	// PortsTrap stops Run with a *PortError at the IN, OUT, INS or OUTS
+	// instruction. Accesses through InByte and OutByte are only ignored.
+	PortsTrap
+)
+
+func (p PortPolicy) String() string {
+	switch p {
+	case PortsIgnore:
+		return "ignore"
+	case PortsLog:
+		return "log"
+	case PortsTrap:
+		return "trap"
+	}
+	return fmt.Sprintf("PortPolicy(%d)", uint8(p))
+}
+
+// ParsePortPolicy parses an unclaimed port policy name: "ignore", "log" or "trap"
+func ParsePortPolicy(name string) (PortPolicy, error) {
+	switch strings.ToLower(name) {
+	case "ignore":
+		return PortsIgnore, nil
+	case "log":
+		return PortsLog, nil
+	case "trap":
+		return PortsTrap, nil
+	}
+	return 0, fmt.Errorf("unknown unclaimed port policy %q (expected ignore, log or trap)", name)
+}
+
+// PortError reports an access to an unclaimed port under PortsTrap
+type PortError struct {
+	Port  uint16
+	Out   bool  // True for a write
+	Value uint8 // Value written
+}
+
+func (e *PortError) Error() string {
+	if e.Out {
+		return fmt.Sprintf("write of %02Xh to unclaimed I/O port %04Xh", e.Value, e.Port)
+	}
+	return fmt.Sprintf("read from unclaimed I/O port %04Xh", e.Port)
+}
+
+// ioBus routes port accesses to the devices that claim them. Ports are
+// looked up through pages of 256 ports, allocated for pages that have a
+// device.
+type ioBus struct {
+	ranges []*PortRange
+	pages  [256]*[256]*PortRange
+}
+
+// lookup returns the range claiming a port, or nil
+func (b *ioBus) lookup(port uint16) *PortRange {
+	page := b.pages[port>>8]
+	if page == nil {
+		return nil
+	}
+	return page[port&0xFF]
+}
+
+// MapPorts lets a device claim a range of I/O ports. The range must not
+// overlap a claimed range or share its name.
+func (c *CPU) MapPorts(r PortRange) error {
+	if r.First > r.Last {
+		return fmt.Errorf("port range %q: invalid range %04Xh-%04Xh", r.Name, r.First, r.Last)
+	}
+	for _, other := range c.io.ranges {
+		if other.Name == r.Name {
+			return fmt.Errorf("port range %q is already mapped", r.Name)
+		}
+		if r.First <= other.Last && other.First <= r.Last {
+			return fmt.Errorf("port range %q (%04Xh-%04Xh) overlaps %q (%04Xh-%04Xh)",
+				r.Name, r.First, r.Last, other.Name, other.First, other.Last)
+		}
+	}
+	ports := &r
+	c.io.ranges = append(c.io.ranges, ports)
+	for port := uint32(r.First); port <= uint32(r.Last); port++ {
+		page := c.io.pages[port>>8]
+		if page == nil {
+			page = new([256]*PortRange)
+			c.io.pages[port>>8] = page
+		}
+		page[port&0xFF] = ports
+	}
+	return nil
+}
+
+// UnmapPorts releases the ports of the range with the given name. It
+// reports whether the range was mapped.
+func (c *CPU) UnmapPorts(name string) bool {
+	for i, r := range c.io.ranges {
+		if r.Name != name {
+			continue
+		}
+		c.io.ranges = append(c.io.ranges[:i], c.io.ranges[i+1:]...)
+		for port := uint32(r.First); port <= uint32(r.Last); port++ {
+			c.io.pages[port>>8][port&0xFF] = nil
+		}
+		return true
+	}
+	return false
+}
+
+// PortRanges returns the mapped port ranges in the order they were mapped
+func (c *CPU) PortRanges() []PortRange {
+	ranges := make([]PortRange, len(c.io.ranges))
+	for i, r := range c.io.ranges {
+		ranges[i] = *r
+	}
+	return ranges
+}
+
+// OutByte writes a byte to an I/O port
+func (c *CPU) OutByte(port uint16, value uint8) {
+	c.out(port, value)
+}
+
+// InByte reads a byte from an I/O port
+func (c *CPU) InByte(port uint16) uint8 {
+	value, _ := c.in(port)
+	return value
+}
+
+// OutWord writes a word to an I/O port
+func (c *CPU) OutWord(port uint16, value uint16) {
+	c.outWord(port, value)
+}
+
+// InWord reads a word from an I/O port
+func (c *CPU) InWord(port uint16) uint16 {
+	value, _ := c.inWord(port)
+	return value
+}
+
+// out writes a byte to the device claiming a port, or handles the write to
+// an unclaimed port by the UnclaimedPorts policy
+func (c *CPU) out(port uint16, value uint8) error {
+	if r := c.io.lookup(port); r != nil {
+		if r.Out != nil {
+			r.Out(port, value)
+		}
+		return nil
+	}
+	return c.unclaimed(&PortError{Port: port, Out: true, Value: value})
+}
+
+// in reads a byte from the device claiming a port, or handles the read of
+// an unclaimed port by the UnclaimedPorts policy
+func (c *CPU) in(port uint16) (uint8, error) {
+	if r := c.io.lookup(port); r != nil {
+		if r.In != nil {
+			return r.In(port), nil
+		}
+		return 0, nil
+	}
+	return 0, c.unclaimed(&PortError{Port: port})
+}
+
+// outWord writes a word to a port and the port after it
+func (c *CPU) outWord(port uint16, value uint16) error {
+	if r := c.io.lookup(port); r != nil && r.OutWord != nil && port != r.Last {
+		r.OutWord(port, value)
+		return nil
+	}
+	if err := c.out(port, uint8(value)); err != nil {
+		return err
+	}
+	return c.out(port+1, uint8(value>>8))
+}
+
+// inWord reads a word from a port and the port after it
+func (c *CPU) inWord(port uint16) (uint16, error) {
+	if r := c.io.lookup(port); r != nil && r.InWord != nil && port != r.Last {
+		return r.InWord(port), nil
+	}
+	low, err := c.in(port)
+	if err != nil {
+		return 0, err
+	}
+	high, err := c.in(port + 1)
+	return uint16(low) | uint16(high)<<8, err
+}
+
+// unclaimed handles an access to an unclaimed port
+func (c *CPU) unclaimed(access *PortError) error {
+	switch c.UnclaimedPorts {
+	case PortsLog:
+		w := c.PortLog
+		if w == nil {
+			w = os.Stderr
+		}
+		fmt.Fprintf(w, "%04X:%04X: %v\n", c.CS, c.IP, access)
+	case PortsTrap:
+		return access
+	}
+	return nil
+}
+
+// mapStandardPorts claims the ports of the emulated PC's devices: the PIC,
+// the PIT, system control port B, and the VGA attribute controller,
+// miscellaneous output, sequencer, DAC, graphics controller, CRT controller
+// and status register
+func (c *CPU) mapStandardPorts() {
+	c.MapPorts(PortRange{
+		Name: "pic", First: 0x20, Last: 0x21,
+		In:  func(port uint16) uint8 { return c.PIC.Read(port) },
+		Out: func(port uint16, value uint8) { c.PIC.Write(port, value) },
+	})
+	c.MapPorts(PortRange{
+		Name: "pit", First: 0x40, Last: 0x43,
+		In: func(port uint16) uint8 {
+			c.syncTimer()
+			return c.PIT.Read(port)
+		},
+		Out: func(port uint16, value uint8) {
+			c.syncTimer()
+			c.PIT.Write(port, value)
+		},
+	})
+	c.MapPorts(PortRange{Name: "port-b", First: 0x61, Last: 0x61, In: c.readPortB, Out: c.writePortB})
+	c.MapPorts(PortRange{Name: "vga-attr", First: 0x3C0, Last: 0x3C1, In: c.readAttr, Out: c.writeAttr})
+	c.MapPorts(PortRange{Name: "vga-misc", First: 0x3C2, Last: 0x3C2, Out: c.writeMisc})
+	c.MapPorts(PortRange{Name: "vga-seq", First: 0x3C4, Last: 0x3C5, In: c.readSeq, Out: c.writeSeq})
+	c.MapPorts(PortRange{Name: "vga-dac", First: 0x3C7, Last: 0x3C9, In: c.readDAC, Out: c.writeDAC})
+	c.MapPorts(PortRange{Name: "vga-misc-read", First: 0x3CC, Last: 0x3CC, In: c.readMisc})
+	c.MapPorts(PortRange{Name: "vga-gc", First: 0x3CE, Last: 0x3CF, In: c.readGC, Out: c.writeGC})
+	c.MapPorts(PortRange{Name: "vga-crtc", First: 0x3D4, Last: 0x3D5, In: c.readCRTC, Out: c.writeCRTC})
+	c.MapPorts(PortRange{Name: "vga-status", First: 0x3DA, Last: 0x3DA, In: c.readInputStatus})
+}
+
+// writePortB handles an OUT to system control port B (61h): bit 0 gates
+// PIT channel 2 and bit 1 enables the speaker
+func (c *CPU) writePortB(_ uint16, value uint8) {
+	c.syncTimer()
+	c.port61 = value & 0x03
+	c.PIT.SetGate(2, value&0x01 != 0)
+}
+
+// readPortB handles an IN from port 61h. Bit 4 toggles on every read like
+// the DRAM refresh signal, which programs poll for short delays; bit 5 is
+// PIT channel 2's output.
+func (c *CPU) readPortB(_ uint16) uint8 {
+	c.syncTimer()
+	c.port61 ^= 0x10
+	status := c.port61
+	if c.PIT.Output(2) {
+		status |= 0x20
+	}
+	return status
+}
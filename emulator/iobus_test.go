@@ -0,0 +1,107 @@
+package emulator
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// TestIOBusDevice tests a device with byte and word handlers claiming ports
+// 300h-301h, reached by IN, OUT, INSW and OUTSW
+func TestIOBusDevice(t *testing.T) {
+	cpu := NewCPU()
+	var latch uint16
+	var bytesOut []uint8
+	if err := cpu.MapPorts(PortRange{
+		Name: "latch", First: 0x300, Last: 0x301,
+		In:      func(port uint16) uint8 { return uint8(latch >> (8 * (port - 0x300))) },
+		Out:     func(port uint16, value uint8) { bytesOut = append(bytesOut, value) },
+		InWord:  func(port uint16) uint16 { return latch },
+		OutWord: func(port uint16, value uint16) { latch = value },
+	}); err != nil {
+		t.Fatalf("MapPorts failed: %v", err)
+	}
+	if err := cpu.LoadCOM([]byte{
+		0xBA, 0x00, 0x03, // 0100: MOV DX, 0300h
+		0xB8, 0x34, 0x12, // 0103: MOV AX, 1234h
+		0xEF,       // 0106: OUT DX, AX
+		0xEC,       // 0107: IN AL, DX
+		0x88, 0xC3, // 0108: MOV BL, AL
+		0x42,       // 010A: INC DX
+		0xEC,       // 010B: IN AL, DX
+		0x88, 0xC7, // 010C: MOV BH, AL
+		0xEE, // 010E: OUT DX, AL
+		0xFA, // 010F: CLI
+		0xF4, // 0110: HLT
+	}); err != nil {
+		t.Fatalf("LoadCOM failed: %v", err)
+	}
+	runUntilIdle(t, cpu)
+	if latch != 0x1234 || cpu.BX != 0x1234 {
+		t.Errorf("Expected the word write to latch 1234h and BX=1234h, got %04X and %04X", latch, cpu.BX)
+	}
+	if len(bytesOut) != 1 || bytesOut[0] != 0x12 {
+		t.Errorf("Expected one byte write of 12h, got %v", bytesOut)
+	}
+
+	// A word access on the last claimed port is split
+	cpu.OutWord(0x301, 0xBEEF)
+	if len(bytesOut) != 2 || bytesOut[1] != 0xEF {
+		t.Errorf("Expected a split byte write of EFh, got %v", bytesOut)
+	}
+
+	if err := cpu.MapPorts(PortRange{Name: "overlap", First: 0x2FF, Last: 0x300}); err == nil {
+		t.Error("Expected an error mapping an overlapping port range")
+	}
+	if !cpu.UnmapPorts("latch") || cpu.InWord(0x300) != 0 {
+		t.Error("Expected unmapped ports to read 0")
+	}
+}
+
+// TestIOBusUnclaimed tests logging and trapping accesses to unclaimed ports
+func TestIOBusUnclaimed(t *testing.T) {
+	program := []byte{
+		0xB0, 0x5A, // 0100: MOV AL, 5Ah
+		0xE6, 0x80, // 0102: OUT 80h, AL
+		0xF4, // 0104: HLT
+	}
+
+	cpu := NewCPU()
+	var log bytes.Buffer
+	cpu.UnclaimedPorts = PortsLog
+	cpu.PortLog = &log
+	if err := cpu.LoadCOM(program); err != nil {
+		t.Fatalf("LoadCOM failed: %v", err)
+	}
+	runUntilIdle(t, cpu)
+	if !strings.Contains(log.String(), "write of 5Ah to unclaimed I/O port 0080h") {
+		t.Errorf("Expected the write to be logged, got %q", log.String())
+	}
+
+	cpu = NewCPU()
+	cpu.UnclaimedPorts = PortsTrap
+	if err := cpu.LoadCOM(program); err != nil {
+		t.Fatalf("LoadCOM failed: %v", err)
+	}
+	var err error
+	for i := 0; i < 3 && err == nil; i++ {
+		err = cpu.Step()
+	}
+	var portErr *PortError
+	if !errors.As(err, &portErr) || portErr.Port != 0x80 || !portErr.Out {
+		t.Errorf("Expected a trapped write to port 80h, got %v", err)
+	}
+}
+
+// TestParsePortPolicy tests parsing unclaimed port policy names
+func TestParsePortPolicy(t *testing.T) {
+	for name, want := range map[string]PortPolicy{"ignore": PortsIgnore, "log": PortsLog, "Trap": PortsTrap} {
+		if got, err := ParsePortPolicy(name); err != nil || got != want {
+			t.Errorf("ParsePortPolicy(%q) = %v, %v; want %v", name, got, err, want)
+		}
+	}
+	if _, err := ParsePortPolicy("panic"); err == nil {
+		t.Error("Expected an error for an unknown policy")
+	}
+}
@@ -0,0 +1,84 @@
+package emulator
+
+import "fmt"
+
+const (
+	// DOS .COM program layout
+	COMLoadSegment = 0x1000 // Segment of the Program Segment Prefix (PSP)
+	COMEntryOffset = 0x0100 // Image is loaded right after the 256-byte PSP
+	COMInitialSP   = 0xFFFE // Holds the zero word a final RET returns to
+
+	// COMMaxSize is the largest image, which must end below the initial stack
+	COMMaxSize = COMInitialSP - COMEntryOffset
+
+	// pspMemoryTop is the first segment beyond the program's memory (PSP offset 02h)
+	pspMemoryTop = 0xA000
+
+	// BytecodeLoadSegment is where bytecode programs are loaded: the first
+	// free paragraph after the interrupt vector table and BIOS data area
+	BytecodeLoadSegment = 0x0050
+)
+
+// LoadBytecode loads an assembled bytecode program with separate code, data
+// and stack segments. Code is loaded at BytecodeLoadSegment:0000, data on the
+// next paragraph boundary with DS=ES pointing at it, and the stack segment
+// follows the data with SP=FFFEh. Reads of port 3DAh wait for the next
+// vertical retrace, the bytecode dialect's frame sync.
+func (c *CPU) LoadBytecode(code, data []byte) {
+	codeBase := CalculateLinearAddress(BytecodeLoadSegment, 0)
+	c.Memory.LoadProgram(codeBase, code)
+
+	// Data starts on the paragraph after the code
+	dataBase := codeBase + (uint32(len(code))+15)/16*16
+	c.Memory.LoadProgram(dataBase, data)
+
+	// Stack segment starts on the paragraph after the data
+	stackBase := dataBase + (uint32(len(data))+15)/16*16
+
+	c.CS = BytecodeLoadSegment
+	c.DS = uint16(dataBase / 16)
+	c.ES = uint16(dataBase / 16)
+	c.SS = uint16(stackBase / 16)
+	c.IP = 0
+	c.SP = 0xFFFE
+	c.Native = false
+	c.FrameSync = true
+}
+
+// LoadCOM loads a DOS .COM image the way DOS does. A Program Segment Prefix
+// is built at COMLoadSegment:0000 with INT 20h at offset 0, the image is
+// copied to offset 0100h, CS=DS=ES=SS point at the PSP, IP=0100h and
+// SP=FFFEh with a zero word on the stack, so a final RET terminates the
+// program through the INT 20h. Interrupts are enabled as DOS leaves them,
+// and the CPU is switched to the 8086 decoder. Port 3DAh reports the
+// retrace status without waiting, as programs poll it.
+func (c *CPU) LoadCOM(image []byte) error {
+	if len(image) > COMMaxSize {
+		return fmt.Errorf(".COM image too large: %d bytes (max %d)", len(image), COMMaxSize)
+	}
+
+	psp := make([]byte, COMEntryOffset)
+	psp[0x00] = 0xCD // INT 20h
+	psp[0x01] = 0x20
+	psp[0x02] = byte(pspMemoryTop & 0xFF)
+	psp[0x03] = byte(pspMemoryTop >> 8)
+	psp[0x80] = 0    // Command tail length
+	psp[0x81] = 0x0D // Command tail terminator
+
+	base := CalculateLinearAddress(COMLoadSegment, 0)
+	c.Memory.LoadProgram(base, psp)
+	c.Memory.LoadProgram(base+COMEntryOffset, image)
+
+	c.CS = COMLoadSegment
+	c.DS = COMLoadSegment
+	c.ES = COMLoadSegment
+	c.SS = COMLoadSegment
+	c.IP = COMEntryOffset
+	c.SP = COMInitialSP
+	c.Memory.WriteWordLinear(CalculateLinearAddress(c.SS, c.SP), 0)
+	c.Flags.IF = true
+
+	c.Native = true
+	c.FrameSync = false
+	return nil
+}
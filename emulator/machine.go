@@ -0,0 +1,127 @@
+package emulator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrStopped is returned by Run once Stop is called, and by Machine.Run
+	// when its context is done
+	ErrStopped = errors.New("CPU stopped by external signal")
+
+	// ErrHalted is returned by Machine.Run when the program ends, and by
+	// Step once the CPU has halted
+	ErrHalted = errors.New("CPU is halted")
+)
+
+// Program is an assembled program a Machine can load. *assembler.Program
+// implements it; the emulator cannot import the assembler, which depends on
+// it for the CPU models.
+type Program interface {
+	// Bytecode returns the code and data of a program in the emulator's
+	// bytecode, or ok false for 8086 machine code
+	Bytecode() (code, data []byte, ok bool)
+
+	// Flat returns 8086 machine code as one image
+	Flat() []byte
+}
+
+// Display shows the colours of a machine's VGA DAC
+type Display interface {
+	SetPaletteColor(index, r, g, b uint8)
+	ResetPalette()
+}
+
+// Machine is an emulated PC for embedding: a CPU with its memory and
+// devices, loaded with a program and run under a context. Options such as
+// Model, ClockHz, Engine, Exceptions and UnclaimedPorts are set on CPU, and
+// devices are added to the memory and I/O buses with Memory.MapRegion and
+// CPU.MapPorts. Machines share no state, so each can run on its own
+// goroutine.
+type Machine struct {
+	CPU    *CPU
+	Memory *Memory // RAM, VGA memory and the BIOS ROM behind the memory bus
+	PIC    *PIC
+	PIT    *PIT
+
+	display Display
+}
+
+// NewMachine creates a machine with the default 8086 CPU, running as fast as
+// the host allows
+func NewMachine() *Machine {
+	cpu := NewCPU()
+	m := &Machine{CPU: cpu, Memory: cpu.Memory, PIC: cpu.PIC, PIT: cpu.PIT}
+	cpu.SetPaletteCallback = func(index byte, r, g, b byte) {
+		if m.display != nil {
+			m.display.SetPaletteColor(index, r, g, b)
+		}
+	}
+	cpu.ResetPaletteCallback = func() {
+		if m.display != nil {
+			m.display.ResetPalette()
+		}
+	}
+	return m
+}
+
+// LoadProgram loads an assembled program: bytecode with its own code, data
+// and stack segments, or 8086 machine code, assembled at COMEntryOffset, as
+// a .COM program
+func (m *Machine) LoadProgram(p Program) error {
+	if code, data, ok := p.Bytecode(); ok {
+		m.CPU.LoadBytecode(code, data)
+		return nil
+	}
+	return m.CPU.LoadCOM(p.Flat())
+}
+
+// LoadCOM loads a DOS .COM binary image
+func (m *Machine) LoadCOM(image []byte) error {
+	return m.CPU.LoadCOM(image)
+}
+
+// SetDisplay connects a display to the DAC: it is reset, given the entries
+// the program has set so far, and then each entry as the program writes it.
+// Call it before Run or between instructions, such as from Mode13hCallback.
+func (m *Machine) SetDisplay(d Display) {
+	m.display = d
+	if d != nil {
+		m.CPU.replayPalette()
+	}
+}
+
+// Run executes the program until it ends, fails or is stopped. It returns
+// ErrHalted when the program ends, ErrStopped after Stop, an error wrapping
+// both ErrStopped and the context's cause when ctx is done, and otherwise
+// the error execution stopped with, such as an *Exception. A stopped
+// machine stays stopped.
+func (m *Machine) Run(ctx context.Context) error {
+	if ctx.Err() != nil {
+		m.Stop()
+	}
+	cancel := context.AfterFunc(ctx, m.Stop)
+	defer cancel()
+
+	err := m.CPU.Run()
+	switch {
+	case err == nil:
+		return ErrHalted
+	case errors.Is(err, ErrStopped) && ctx.Err() != nil:
+		return fmt.Errorf("%w: %w", ErrStopped, context.Cause(ctx))
+	}
+	return err
+}
+
+// Stop makes Run return ErrStopped. It may be called from any goroutine.
+func (m *Machine) Stop() {
+	m.CPU.Stop()
+}
+
+// Schedule runs f between two instructions on the goroutine running Run
+// (see CPU.Schedule)
+func (m *Machine) Schedule(f func()) bool {
+	return m.CPU.Schedule(f)
+}
@@ -0,0 +1,152 @@
+package emulator_test
+
+import (
+	"assembly-emulator/assembler"
+	"assembly-emulator/emulator"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// Both assembler backends produce programs a Machine loads
+var _ emulator.Program = (*assembler.Program)(nil)
+
+// paletteSource sets DAC entry 7 to pure blue and exits to DOS
+const paletteSource = `
+MOV DX, 0x03C8
+MOV AL, 7
+OUT DX, AL
+INC DX
+MOV AL, 0
+OUT DX, AL
+OUT DX, AL
+MOV AL, 63
+OUT DX, AL
+MOV BX, 0x1234
+INT 0x20
+`
+
+// spinCOM is a .COM program that loops forever
+var spinCOM = []byte{
+	0xEB, 0xFE, // 0100: JMP 0100h
+}
+
+// testDisplay records the palette a Machine passes to its display
+type testDisplay struct {
+	colors map[uint8][3]uint8
+	resets int
+}
+
+func (d *testDisplay) SetPaletteColor(index, r, g, b uint8) {
+	d.colors[index] = [3]uint8{r, g, b}
+}
+
+func (d *testDisplay) ResetPalette() {
+	d.resets++
+	d.colors = map[uint8][3]uint8{}
+}
+
+// TestMachineRunsPrograms tests loading an assembled program in either
+// format and running it to the end
+func TestMachineRunsPrograms(t *testing.T) {
+	for _, format := range exampleBackends {
+		t.Run(format.name, func(t *testing.T) {
+			m := emulator.NewMachine()
+			if err := m.LoadProgram(assembleExample(t, []byte(paletteSource), format.backend)); err != nil {
+				t.Fatalf("LoadProgram failed: %v", err)
+			}
+			if err := m.Run(context.Background()); !errors.Is(err, emulator.ErrHalted) {
+				t.Fatalf("Expected ErrHalted, got %v", err)
+			}
+			if m.CPU.BX != 0x1234 {
+				t.Errorf("Expected BX=1234, got %s", m.CPU.String())
+			}
+			if err := m.CPU.Step(); !errors.Is(err, emulator.ErrHalted) {
+				t.Errorf("Expected Step to return ErrHalted, got %v", err)
+			}
+		})
+	}
+}
+
+// TestMachineDisplay tests that a display attached after the program has
+// set colours is given them, and then each new one
+func TestMachineDisplay(t *testing.T) {
+	m := emulator.NewMachine()
+	if err := m.LoadProgram(assembleExample(t, []byte(paletteSource), assembler.BackendBytecode)); err != nil {
+		t.Fatalf("LoadProgram failed: %v", err)
+	}
+	display := &testDisplay{}
+	for i := 0; i < 6; i++ { // Up to the first OUT to 3C9h
+		if err := m.CPU.Step(); err != nil {
+			t.Fatalf("Step failed: %v", err)
+		}
+	}
+	m.SetDisplay(display)
+	if display.resets != 1 || len(display.colors) != 0 {
+		t.Fatalf("Expected a reset palette, got %d resets and %v", display.resets, display.colors)
+	}
+
+	if err := m.Run(context.Background()); !errors.Is(err, emulator.ErrHalted) {
+		t.Fatalf("Expected ErrHalted, got %v", err)
+	}
+	if got := display.colors[7]; got != [3]uint8{0, 0, 255} {
+		t.Errorf("Expected entry 7 to be blue, got %v", got)
+	}
+
+	// A display attached later is given the entries already set
+	late := &testDisplay{}
+	m.SetDisplay(late)
+	if got := late.colors[7]; got != [3]uint8{0, 0, 255} {
+		t.Errorf("Expected the late display to get entry 7 as blue, got %v", got)
+	}
+}
+
+// TestMachineContext tests that a machine stops when its context is done,
+// and that the error tells why
+func TestMachineContext(t *testing.T) {
+	m := emulator.NewMachine()
+	if err := m.LoadCOM(spinCOM); err != nil {
+		t.Fatalf("LoadCOM failed: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err := m.Run(ctx)
+	if !errors.Is(err, emulator.ErrStopped) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected ErrStopped by the deadline, got %v", err)
+	}
+	if m.CPU.InstructionCount == 0 {
+		t.Error("Expected the program to run until the deadline")
+	}
+
+	// A stopped machine stays stopped
+	if err := m.Run(context.Background()); err != emulator.ErrStopped {
+		t.Errorf("Expected ErrStopped running again, got %v", err)
+	}
+}
+
+// TestMachineStop tests stopping a machine from another goroutine, and
+// running one whose context is already cancelled
+func TestMachineStop(t *testing.T) {
+	m := emulator.NewMachine()
+	if err := m.LoadCOM(spinCOM); err != nil {
+		t.Fatalf("LoadCOM failed: %v", err)
+	}
+	time.AfterFunc(10*time.Millisecond, m.Stop)
+	if err := m.Run(context.Background()); err != emulator.ErrStopped {
+		t.Errorf("Expected ErrStopped, got %v", err)
+	}
+
+	m = emulator.NewMachine()
+	if err := m.LoadCOM(spinCOM); err != nil {
+		t.Fatalf("LoadCOM failed: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := m.Run(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the cancellation, got %v", err)
+	}
+	if m.CPU.InstructionCount != 0 {
+		t.Errorf("Expected no instructions to run, got %d", m.CPU.InstructionCount)
+	}
+}
@@ -9,7 +9,7 @@ const (
 	// Memory size constants for x86 real mode (1MB addressable)
 	TotalMemorySize = 0x100000 // 1MB total addressable memory
 	VGAMemoryStart  = 0xA0000  // VGA memory starts at 0xA0000 (linear address)
-	VGAMemorySize   = 64000    // 320x200 pixels
+	VGAMemorySize   = 4 * VGAPlaneSize // 256 KB: four planes, interleaved (see Memory.GetVGAMemory)
 
 	// BIOS ROM constants
 	ROMStart      = 0xF0000  // BIOS ROM starts at 0xF0000 (960KB)
@@ -20,17 +20,28 @@ const (
 
 // Memory represents the system memory including VGA video memory
 type Memory struct {
-	RAM     []byte     // 1MB RAM (VGA is mapped within this space at 0xA0000)
-	VGA     []byte     // VGA video memory (separate for easy rendering access)
-	vgaMux  sync.Mutex // Mutex to protect VGA memory from race conditions
-}
-
-// NewMemory creates a new memory instance
+	RAM     []byte       // 1MB RAM (VGA is mapped within this space at 0xA0000)
+	VGA     []byte       // VGA video memory (separate for easy rendering access)
+	vgaMux  sync.Mutex   // Mutex to protect VGA memory from race conditions
+	video   VideoState   // VGA registers the display draws with, under vgaMux
+	frame   uint64       // The CPU's VideoFrame, which text blinks with, under vgaMux
+	latch   [4]uint8     // VGA latches: the byte of each plane last read in Mode X
+	bus     memoryBus    // Devices mapped over RAM, such as the VGA window and the ROM
+	decoded *decodeCache // Instructions decoded by the CPU, invalidated by writes
+	blocks  *blockCache  // Blocks compiled by the block engine, invalidated with decoded
+}
+
+// NewMemory creates a new memory instance. A bare Memory is in mode 13h,
+// the screen a display draws from VGA memory; NewCPU sets text mode, as
+// the BIOS does at boot.
 func NewMemory() *Memory {
-	return &Memory{
+	m := &Memory{
 		RAM: make([]byte, TotalMemorySize),
 		VGA: make([]byte, VGAMemorySize),
 	}
+	m.video.reset(0x13)
+	m.mapStandardRegions()
+	return m
 }
 
 // CalculateLinearAddress converts segment:offset to 20-bit linear address
@@ -41,12 +52,20 @@ func CalculateLinearAddress(segment, offset uint16) uint32 {
 
 // Clear clears all memory
 func (m *Memory) Clear() {
+	m.vgaMux.Lock() // Text memory is in RAM
 	for i := range m.RAM {
 		m.RAM[i] = 0
 	}
 	for i := range m.VGA {
 		m.VGA[i] = 0
 	}
+	m.vgaMux.Unlock()
+	if m.decoded != nil {
+		m.decoded.flush()
+	}
+	if m.blocks != nil {
+		m.blocks.flush()
+	}
 }
 
 // ReadByteLinear reads a byte from linear (physical) address
@@ -54,10 +73,11 @@ func (m *Memory) ReadByteLinear(addr uint32) uint8 {
 	// Ensure address is within 1MB
 	addr = addr & 0xFFFFF
 
-	// VGA memory mapping at 0xA0000-0xAFA00 (64000 bytes)
-	if addr >= VGAMemoryStart && addr < VGAMemoryStart+uint32(VGAMemorySize) {
-		offset := addr - VGAMemoryStart
-		return m.VGA[offset]
+	// Pages with a mapped device go through the bus
+	if m.bus.mapped[addr>>busPageBits] {
+		if r := m.bus.region(addr); r != nil && r.Read != nil {
+			return r.Read(addr - r.Start)
+		}
 	}
 
 	return m.RAM[addr]
@@ -68,24 +88,37 @@ func (m *Memory) WriteByteLinear(addr uint32, val uint8) {
 	// Ensure address is within 1MB
 	addr = addr & 0xFFFFF
 
-	// ROM area is read-only - ignore writes to 0xF0000-0xFFFFF
-	if addr >= ROMStart && addr < ROMStart+ROMSize {
-		// Silently ignore writes to ROM
-		return
+	// Pages with a mapped device go through the bus; read-only regions
+	// such as the ROM silently ignore writes
+	var device *MemoryRegion
+	if m.bus.mapped[addr>>busPageBits] {
+		if device = m.bus.region(addr); device != nil && device.Write == nil {
+			return
+		}
 	}
 
-	// VGA memory mapping at 0xA0000-0xAFA00 (64000 bytes)
-	if addr >= VGAMemoryStart && addr < VGAMemoryStart+uint32(VGAMemorySize) {
-		offset := addr - VGAMemoryStart
-		m.VGA[offset] = val
-		// Also update RAM for consistency
-		m.RAM[addr] = val
-		return
+	// Writes to the bytes of decoded instructions drop them
+	if m.decoded != nil && m.decoded.covers(addr) {
+		m.invalidateCode(addr)
 	}
 
+	if device != nil {
+		device.Write(addr-device.Start, val)
+		return
+	}
 	m.RAM[addr] = val
 }
 
+// invalidateCode drops the decoded instructions and compiled blocks that
+// include the byte at addr. Every byte of a block is in the decode cache's
+// map of code bytes.
+func (m *Memory) invalidateCode(addr uint32) {
+	m.decoded.invalidate(addr)
+	if m.blocks != nil {
+		m.blocks.invalidate(addr)
+	}
+}
+
 // ReadWord reads a 16-bit word from memory (little-endian, legacy)
 func (m *Memory) ReadWord(addr uint16) uint16 {
 	return m.ReadWordLinear(uint32(addr))
@@ -115,6 +148,9 @@ func (m *Memory) LoadProgram(addr uint32, program []byte) {
 		if addr+uint32(i) >= TotalMemorySize {
 			break
 		}
+		if m.decoded != nil && m.decoded.covers(addr+uint32(i)) {
+			m.invalidateCode(addr + uint32(i))
+		}
 		m.RAM[addr+uint32(i)] = b
 	}
 }
@@ -129,12 +165,47 @@ func (m *Memory) UnlockVGA() {
 	m.vgaMux.Unlock()
 }
 
-// GetVGAMemory returns a reference to the VGA memory for rendering
+// GetVGAMemory returns a reference to the VGA memory for rendering: the four
+// planes interleaved, byte p of each group of four being plane p, so that
+// in mode 13h it holds the pixels in order (see ScanOut)
 // IMPORTANT: Caller must call LockVGA() before and UnlockVGA() after using this
 func (m *Memory) GetVGAMemory() []byte {
 	return m.VGA
 }
 
+// GetTextMemory returns a reference to the text memory at 0xB8000 for rendering
+// IMPORTANT: Caller must call LockVGA() before and UnlockVGA() after using this
+func (m *Memory) GetTextMemory() []byte {
+	return m.RAM[TextMemoryStart : TextMemoryStart+TextMemorySize]
+}
+
+// VideoState returns the VGA registers the display draws with
+// IMPORTANT: Caller must call LockVGA() before and UnlockVGA() after using this
+func (m *Memory) VideoState() VideoState {
+	return m.video
+}
+
+// clearVideo fills text memory with blanks, grey on black, or clears the
+// four planes of VGA memory, as setting a mode does. The caller holds the
+// VGA lock.
+func (m *Memory) clearVideo(text bool) {
+	start, size := uint32(VGAMemoryStart), uint32(VGAWindowSize)
+	if text {
+		start, size = TextMemoryStart, TextMemorySize
+	} else {
+		clear(m.VGA)
+	}
+	for addr := start; addr < start+size; addr++ {
+		m.RAM[addr] = 0
+		if text {
+			m.RAM[addr] = " \x07"[addr&1]
+		}
+		if m.decoded != nil && m.decoded.covers(addr) {
+			m.invalidateCode(addr)
+		}
+	}
+}
+
 // GetVGAPixel gets a pixel color at x, y coordinates (Mode 13h: 320x200)
 func (m *Memory) GetVGAPixel(x, y int) uint8 {
 	if x < 0 || x >= 320 || y < 0 || y >= 200 {
@@ -0,0 +1,140 @@
+package emulator
+
+import "fmt"
+
+// busPageBits sets the granularity of the bus's page table: a read or write
+// in a 4 KB page without a mapped region goes straight to RAM
+const busPageBits = 12
+
+// MemoryRegion is a device mapped onto the memory bus at the linear
+// addresses Start to End-1. Its handlers are passed the offset of the access
+// from Start. A region without a Read handler reads RAM, and one without a
+// Write handler ignores writes, like ROM.
+type MemoryRegion struct {
+	Name       string
+	Start, End uint32
+	Read       func(offset uint32) uint8
+	Write      func(offset uint32, val uint8)
+}
+
+// contains reports whether a linear address is in the region
+func (r *MemoryRegion) contains(addr uint32) bool {
+	return addr >= r.Start && addr < r.End
+}
+
+// memoryBus routes the accesses of mapped regions to their devices. Each
+// page of the address space has a list of the regions that overlap it and a
+// flag that lets accesses to pages without any go straight to RAM.
+type memoryBus struct {
+	regions []*MemoryRegion
+	mapped  [TotalMemorySize >> busPageBits]bool // Pages with at least one region
+	pages   [TotalMemorySize >> busPageBits][]*MemoryRegion
+}
+
+// region returns the mapped region holding addr, or nil
+func (b *memoryBus) region(addr uint32) *MemoryRegion {
+	for _, r := range b.pages[addr>>busPageBits] {
+		if r.contains(addr) {
+			return r
+		}
+	}
+	return nil
+}
+
+// MapRegion maps a device onto the memory bus. The region must lie within
+// the 1 MB address space and not overlap a mapped region or share its name.
+func (m *Memory) MapRegion(r MemoryRegion) error {
+	if r.Start >= r.End || r.End > TotalMemorySize {
+		return fmt.Errorf("memory region %q: invalid range 0x%05X-0x%05X", r.Name, r.Start, r.End)
+	}
+	for _, other := range m.bus.regions {
+		if other.Name == r.Name {
+			return fmt.Errorf("memory region %q is already mapped", r.Name)
+		}
+		if r.Start < other.End && other.Start < r.End {
+			return fmt.Errorf("memory region %q (0x%05X-0x%05X) overlaps %q (0x%05X-0x%05X)",
+				r.Name, r.Start, r.End-1, other.Name, other.Start, other.End-1)
+		}
+	}
+	region := &r
+	m.bus.regions = append(m.bus.regions, region)
+	for page := r.Start >> busPageBits; page <= (r.End-1)>>busPageBits; page++ {
+		m.bus.pages[page] = append(m.bus.pages[page], region)
+		m.bus.mapped[page] = true
+	}
+	return nil
+}
+
+// UnmapRegion removes the region with the given name from the bus, returning
+// its addresses to RAM. It reports whether the region was mapped.
+func (m *Memory) UnmapRegion(name string) bool {
+	for i, r := range m.bus.regions {
+		if r.Name != name {
+			continue
+		}
+		m.bus.regions = append(m.bus.regions[:i], m.bus.regions[i+1:]...)
+		for page := r.Start >> busPageBits; page <= (r.End-1)>>busPageBits; page++ {
+			list := m.bus.pages[page]
+			for j, other := range list {
+				if other == r {
+					m.bus.pages[page] = append(list[:j], list[j+1:]...)
+					m.bus.mapped[page] = len(m.bus.pages[page]) != 0
+					break
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// Region returns the mapped region with the given name. A device can be
+// wrapped, for example to watch its writes, by unmapping it and mapping a
+// region whose handlers call the original's.
+func (m *Memory) Region(name string) (MemoryRegion, bool) {
+	for _, r := range m.bus.regions {
+		if r.Name == name {
+			return *r, true
+		}
+	}
+	return MemoryRegion{}, false
+}
+
+// Regions returns the mapped regions in the order they were mapped
+func (m *Memory) Regions() []MemoryRegion {
+	regions := make([]MemoryRegion, len(m.bus.regions))
+	for i, r := range m.bus.regions {
+		regions[i] = *r
+	}
+	return regions
+}
+
+// mapStandardRegions maps the devices of the PC's upper memory: the VGA
+// window at 0xA0000, whose writes are mirrored into RAM, the text memory at
+// 0xB8000, kept in RAM, and the read-only BIOS ROM at 0xF0000
+func (m *Memory) mapStandardRegions() {
+	m.MapRegion(MemoryRegion{
+		Name:  "vga",
+		Start: VGAMemoryStart,
+		End:   VGAMemoryStart + VGAWindowSize,
+		Read:  m.readVGA,
+		Write: func(offset uint32, val uint8) {
+			// Planes, map mask and latches as the sequencer and graphics
+			// controller select them
+			m.writeVGA(offset, val)
+			// Also update RAM for consistency
+			m.RAM[VGAMemoryStart+offset] = val
+		},
+	})
+	m.MapRegion(MemoryRegion{
+		Name:  "text",
+		Start: TextMemoryStart,
+		End:   TextMemoryStart + TextMemorySize,
+		Write: func(offset uint32, val uint8) {
+			m.vgaMux.Lock()
+			m.RAM[TextMemoryStart+offset] = val
+			m.vgaMux.Unlock()
+		},
+	})
+	m.MapRegion(MemoryRegion{Name: "rom", Start: ROMStart, End: ROMStart + ROMSize})
+}
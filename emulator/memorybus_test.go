@@ -0,0 +1,69 @@
+package emulator
+
+import "testing"
+
+// TestMemoryBusStandardRegions tests the VGA window and the read-only ROM
+func TestMemoryBusStandardRegions(t *testing.T) {
+	m := NewMemory()
+	m.WriteByteLinear(VGAMemoryStart+10, 0x2A)
+	if m.VGA[10] != 0x2A || m.ReadByteLinear(VGAMemoryStart+10) != 0x2A {
+		t.Errorf("Expected a VGA write to reach VGA memory, got %02X", m.VGA[10])
+	}
+	m.RAM[ROMStart+5] = 0x11
+	m.WriteByteLinear(ROMStart+5, 0x22)
+	if got := m.ReadByteLinear(ROMStart + 5); got != 0x11 {
+		t.Errorf("Expected ROM to ignore writes, read %02X", got)
+	}
+}
+
+// TestMemoryBusDevice tests mapping, wrapping and unmapping devices: an
+// option ROM that computes its bytes and a watch on the VGA window
+func TestMemoryBusDevice(t *testing.T) {
+	m := NewMemory()
+	if err := m.MapRegion(MemoryRegion{
+		Name:  "option-rom",
+		Start: 0xC8000,
+		End:   0xC8100,
+		Read:  func(offset uint32) uint8 { return uint8(offset) ^ 0x55 },
+	}); err != nil {
+		t.Fatalf("MapRegion failed: %v", err)
+	}
+	if got := m.ReadWordLinear(0xC8010); got != 0x4445 {
+		t.Errorf("Expected the option ROM to read 4445h, got %04X", got)
+	}
+	m.WriteByteLinear(0xC8010, 0)
+	if got := m.ReadByteLinear(0xC8010); got != 0x45 {
+		t.Errorf("Expected the option ROM to ignore writes, read %02X", got)
+	}
+
+	if err := m.MapRegion(MemoryRegion{Name: "overlap", Start: 0xC80FF, End: 0xC8200}); err == nil {
+		t.Error("Expected an error mapping an overlapping region")
+	}
+
+	// Watch writes to the VGA window by wrapping its device
+	vga, ok := m.Region("vga")
+	if !ok || !m.UnmapRegion("vga") {
+		t.Fatal("Expected the VGA region to be mapped")
+	}
+	var watched []uint32
+	watch := vga
+	watch.Write = func(offset uint32, val uint8) {
+		watched = append(watched, offset)
+		vga.Write(offset, val)
+	}
+	if err := m.MapRegion(watch); err != nil {
+		t.Fatalf("MapRegion failed: %v", err)
+	}
+	m.WriteWordLinear(VGAMemoryStart+320, 0x0F0F)
+	if len(watched) != 2 || watched[0] != 320 || m.VGA[321] != 0x0F {
+		t.Errorf("Expected two watched writes at 320, got %v", watched)
+	}
+
+	if !m.UnmapRegion("option-rom") {
+		t.Fatal("Expected the option ROM to be mapped")
+	}
+	m.WriteByteLinear(0xC8010, 0x99)
+	if got := m.ReadByteLinear(0xC8010); got != 0x99 {
+		t.Errorf("Expected RAM after unmapping, read %02X", got)
+	}
+}
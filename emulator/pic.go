@@ -0,0 +1,131 @@
+package emulator
+
+// PIC emulates the master 8259A programmable interrupt controller on ports
+// 20h-21h. Devices raise IRQ lines 0-7; the CPU acknowledges the highest
+// priority unmasked request (IRQ0 first) when IF is set, and the handler
+// ends it with an EOI command so requests of equal or lower priority can
+// follow. There is no slave controller, so IRQ 8-15 do not exist.
+type PIC struct {
+	irr        uint8 // Interrupt request register: raised, not yet acknowledged
+	isr        uint8 // In-service register: acknowledged, waiting for EOI
+	imr        uint8 // Interrupt mask register (port 21h)
+	vectorBase uint8 // Vector of IRQ0, set by ICW2
+
+	initStep uint8 // Next initialization word expected on port 21h (0 = none)
+	needICW4 bool
+	single   bool // No cascaded slave, so ICW3 is skipped
+	autoEOI  bool
+	readISR  bool // OCW3 selected the ISR for reads of port 20h
+}
+
+// Initialization sequence steps
+const (
+	picReady = iota
+	picICW2
+	picICW3
+	picICW4
+)
+
+// NewPIC creates an interrupt controller set up the way the BIOS leaves it:
+// IRQ0-7 on vectors 08h-0Fh, with the timer (IRQ0), keyboard (IRQ1) and
+// floppy (IRQ6) unmasked
+func NewPIC() *PIC {
+	return &PIC{vectorBase: 0x08, imr: 0xBC}
+}
+
+// Raise requests an interrupt on an IRQ line
+func (p *PIC) Raise(irq int) {
+	p.irr |= 1 << irq
+}
+
+// Write handles an OUT to port 20h or 21h
+func (p *PIC) Write(port uint16, value uint8) {
+	if port&1 == 0 {
+		switch {
+		case value&0x10 != 0: // ICW1 starts initialization
+			p.irr, p.isr, p.imr = 0, 0, 0
+			p.needICW4 = value&0x01 != 0
+			p.single = value&0x02 != 0
+			p.autoEOI = false
+			p.readISR = false
+			p.initStep = picICW2
+		case value&0x08 != 0: // OCW3: select the register read from port 20h
+			if value&0x02 != 0 {
+				p.readISR = value&0x01 != 0
+			}
+		default: // OCW2: end of interrupt
+			switch value >> 5 {
+			case 1: // Non-specific EOI ends the highest priority in-service IRQ
+				p.isr &= p.isr - 1
+			case 3: // Specific EOI
+				p.isr &^= 1 << (value & 7)
+			}
+		}
+		return
+	}
+
+	switch p.initStep {
+	case picICW2:
+		p.vectorBase = value & 0xF8
+		p.initStep = picICW3
+		if p.single {
+			p.nextICW4()
+		}
+	case picICW3: // Cascade wiring, which has no effect without a slave
+		p.nextICW4()
+	case picICW4:
+		p.autoEOI = value&0x02 != 0
+		p.initStep = picReady
+	default: // OCW1: interrupt mask
+		p.imr = value
+	}
+}
+
+func (p *PIC) nextICW4() {
+	if p.needICW4 {
+		p.initStep = picICW4
+	} else {
+		p.initStep = picReady
+	}
+}
+
+// Read handles an IN from port 20h (IRR or ISR, chosen by OCW3) or 21h (IMR)
+func (p *PIC) Read(port uint16) uint8 {
+	if port&1 != 0 {
+		return p.imr
+	}
+	if p.readISR {
+		return p.isr
+	}
+	return p.irr
+}
+
+// pending returns the highest priority unmasked request that is higher
+// priority than every IRQ in service
+func (p *PIC) pending() (int, bool) {
+	requests := p.irr &^ p.imr
+	for irq := 0; irq < 8; irq++ {
+		bit := uint8(1) << irq
+		if p.isr&bit != 0 {
+			return 0, false
+		}
+		if requests&bit != 0 {
+			return irq, true
+		}
+	}
+	return 0, false
+}
+
+// Acknowledge performs the interrupt acknowledge cycle: the highest priority
+// pending request moves from IRR to ISR and its vector is returned
+func (p *PIC) Acknowledge() (vector uint8, ok bool) {
+	irq, ok := p.pending()
+	if !ok {
+		return 0, false
+	}
+	p.irr &^= 1 << irq
+	if !p.autoEOI {
+		p.isr |= 1 << irq
+	}
+	return p.vectorBase + uint8(irq), true
+}
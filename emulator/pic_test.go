@@ -0,0 +1,147 @@
+package emulator
+
+import (
+	"testing"
+)
+
+// TestPICPriorityAndEOI tests request priority, nesting and EOI commands
+func TestPICPriorityAndEOI(t *testing.T) {
+	p := NewPIC()
+	p.Write(0x21, 0x00) // Unmask every IRQ
+
+	p.Raise(3)
+	p.Raise(1)
+	if vector, ok := p.Acknowledge(); !ok || vector != 0x09 {
+		t.Fatalf("Expected IRQ1 first (vector 09h), got %02Xh ok=%v", vector, ok)
+	}
+	if _, ok := p.Acknowledge(); ok {
+		t.Error("Expected IRQ3 blocked while IRQ1 is in service")
+	}
+
+	// A higher priority request nests
+	p.Raise(0)
+	if vector, ok := p.Acknowledge(); !ok || vector != 0x08 {
+		t.Fatalf("Expected IRQ0 to nest (vector 08h), got %02Xh ok=%v", vector, ok)
+	}
+
+	p.Write(0x20, 0x0B) // OCW3: read ISR
+	if isr := p.Read(0x20); isr != 0x03 {
+		t.Errorf("Expected ISR=03h, got %02Xh", isr)
+	}
+	p.Write(0x20, 0x0A) // OCW3: read IRR
+	if irr := p.Read(0x20); irr != 0x08 {
+		t.Errorf("Expected IRR=08h, got %02Xh", irr)
+	}
+
+	// A non-specific EOI ends IRQ0, leaving IRQ1 in service
+	p.Write(0x20, 0x20)
+	if _, ok := p.Acknowledge(); ok {
+		t.Error("Expected IRQ3 still blocked by IRQ1")
+	}
+
+	// A specific EOI ends IRQ1
+	p.Write(0x20, 0x61)
+	if vector, ok := p.Acknowledge(); !ok || vector != 0x0B {
+		t.Errorf("Expected IRQ3 after the EOI (vector 0Bh), got %02Xh ok=%v", vector, ok)
+	}
+}
+
+// TestPICMaskAndInit tests the interrupt mask and the initialization sequence
+func TestPICMaskAndInit(t *testing.T) {
+	p := NewPIC()
+	if imr := p.Read(0x21); imr != 0xBC {
+		t.Errorf("Expected the BIOS mask BCh, got %02Xh", imr)
+	}
+
+	// A masked request waits until it is unmasked
+	p.Raise(5)
+	if _, ok := p.Acknowledge(); ok {
+		t.Error("Expected masked IRQ5 not to be acknowledged")
+	}
+	p.Write(0x21, 0xDC)
+	if vector, ok := p.Acknowledge(); !ok || vector != 0x0D {
+		t.Errorf("Expected IRQ5 once unmasked (vector 0Dh), got %02Xh ok=%v", vector, ok)
+	}
+
+	// ICW1-ICW4 remap the vectors and clear the mask
+	p.Write(0x20, 0x11) // ICW1: cascade, ICW4 needed
+	p.Write(0x21, 0x20) // ICW2: IRQ0 at vector 20h
+	p.Write(0x21, 0x04) // ICW3: slave on IRQ2
+	p.Write(0x21, 0x01) // ICW4: 8086 mode
+	if imr := p.Read(0x21); imr != 0x00 {
+		t.Errorf("Expected initialization to clear the mask, got %02Xh", imr)
+	}
+	p.Raise(1)
+	if vector, ok := p.Acknowledge(); !ok || vector != 0x21 {
+		t.Errorf("Expected IRQ1 at vector 21h, got %02Xh ok=%v", vector, ok)
+	}
+
+	// Single mode skips ICW3; automatic EOI leaves nothing in service
+	p.Write(0x20, 0x13) // ICW1: single, ICW4 needed
+	p.Write(0x21, 0x50) // ICW2
+	p.Write(0x21, 0x03) // ICW4: 8086 mode, automatic EOI
+	p.Write(0x21, 0xFE) // OCW1: only IRQ0 unmasked
+	p.Raise(0)
+	if vector, ok := p.Acknowledge(); !ok || vector != 0x50 {
+		t.Errorf("Expected IRQ0 at vector 50h, got %02Xh ok=%v", vector, ok)
+	}
+	p.Raise(0)
+	if _, ok := p.Acknowledge(); !ok {
+		t.Error("Expected automatic EOI to allow the next IRQ0")
+	}
+}
+
+// TestHardwareInterrupts tests IRQ delivery between instructions and HLT
+// waiting for an interrupt
+func TestHardwareInterrupts(t *testing.T) {
+	cpu := NewCPU()
+	if err := cpu.LoadCOM([]byte{
+		0xBA, 0x0F, 0x01, // 0100: MOV DX, 010Fh
+		0xB8, 0x08, 0x25, // 0103: MOV AX, 2508h (set vector 08h)
+		0xCD, 0x21, // 0106: INT 21h
+		0xFB,       // 0108: STI
+		0xF4,       // 0109: HLT
+		0xF4,       // 010A: HLT
+		0xFA,       // 010B: CLI
+		0xF4,       // 010C: HLT
+		0x90, 0x90, // 010D: NOP ; NOP
+		0x41,       // 010F: INC CX (IRQ0 handler)
+		0xB0, 0x20, // 0110: MOV AL, 20h
+		0xE6, 0x20, // 0112: OUT 20h, AL (EOI)
+		0xCF, // 0114: IRET
+	}); err != nil {
+		t.Fatalf("LoadCOM failed: %v", err)
+	}
+
+	runUntilIdle(t, cpu)
+	if !cpu.WaitingForInterrupt || cpu.Halted || cpu.IP != 0x010A {
+		t.Fatalf("Expected HLT to wait at 010A, got IP=%04X halted=%v", cpu.IP, cpu.Halted)
+	}
+
+	// A masked IRQ does not wake the CPU
+	cpu.RaiseIRQ(5)
+	if err := cpu.Step(); err != nil {
+		t.Fatalf("CPU.Step() failed: %v", err)
+	}
+	if !cpu.WaitingForInterrupt {
+		t.Error("Expected masked IRQ5 to leave the CPU waiting")
+	}
+
+	for want := uint16(1); want <= 2; want++ {
+		cpu.RaiseIRQ(0)
+		if err := cpu.Step(); err != nil {
+			t.Fatalf("CPU.Step() failed: %v", err)
+		}
+		runUntilIdle(t, cpu)
+		if cpu.CX != want {
+			t.Errorf("Expected the IRQ0 handler to have run %d times, CX=%d", want, cpu.CX)
+		}
+	}
+
+	if !cpu.Halted || cpu.IP != 0x010D {
+		t.Errorf("Expected HLT with IF clear to end the program at 010D, got IP=%04X halted=%v", cpu.IP, cpu.Halted)
+	}
+	if cpu.SP != 0xFFFE || cpu.PIC.isr != 0 {
+		t.Errorf("Expected the stack restored and no IRQ in service, got SP=%04X ISR=%02Xh", cpu.SP, cpu.PIC.isr)
+	}
+}
@@ -0,0 +1,365 @@
+package emulator
+
+import "time"
+
+// PITFrequency is the input clock of the 8253/8254 timer in Hz
+const PITFrequency = 1193182
+
+// PIT emulates the 8253/8254 programmable interval timer on ports 40h-43h.
+// Channel 0 drives IRQ0, channel 1 is the (unused) DRAM refresh timer and
+// channel 2 drives the PC speaker, gated by bit 0 of port 61h.
+//
+// Modes 0 (interrupt on terminal count), 2 (rate generator) and 3 (square
+// wave) are emulated; modes 1, 4 and 5 count down once like mode 0. Counts
+// are binary, BCD counting is not supported.
+type PIT struct {
+	channels [3]pitChannel
+}
+
+// pitChannel is one counter of the PIT
+type pitChannel struct {
+	mode    uint8  // Counter mode 0-5
+	access  uint8  // 1 = LSB only, 2 = MSB only, 3 = LSB then MSB
+	reload  uint32 // Count written by the program (0 counts as 65536)
+	next    uint32 // Count written while counting in mode 2 or 3
+	pending bool   // next is loaded at the end of the current period
+	phase   uint32 // Input clocks since the count was loaded
+	armed   bool   // A count has been written and the counter is running
+	gate    bool
+	out     bool
+
+	writeMSB      bool  // Next write is the MSB of an LSB/MSB count
+	lsb           uint8 // LSB waiting for its MSB
+	readMSB       bool  // Next read returns the MSB of an LSB/MSB count
+	latched       bool  // latch holds a count captured by a latch command
+	latch         uint16
+	statusLatched bool // status holds a byte captured by a read-back command
+	status        uint8
+}
+
+// NewPIT creates a timer set up the way the BIOS leaves it: channel 0 in
+// mode 3 with the maximum count, giving IRQ0 at about 18.2 Hz
+func NewPIT() *PIT {
+	p := &PIT{}
+	p.channels[0].gate = true
+	p.channels[1].gate = true
+	p.Write(0x43, 0x36) // Channel 0, LSB then MSB, mode 3
+	p.Write(0x40, 0x00)
+	p.Write(0x40, 0x00)
+	return p
+}
+
+// Write handles an OUT to ports 40h-43h
+func (p *PIT) Write(port uint16, value uint8) {
+	if port == 0x43 {
+		p.writeControl(value)
+		return
+	}
+	p.channels[port&3].writeCount(value)
+}
+
+// Read handles an IN from ports 40h-42h
+func (p *PIT) Read(port uint16) uint8 {
+	if port == 0x43 {
+		return 0xFF // The control register is write-only
+	}
+	return p.channels[port&3].read()
+}
+
+// SetGate sets the gate input of a channel. Only channel 2's gate is
+// wired to anything (port 61h bit 0).
+func (p *PIT) SetGate(channel int, gate bool) {
+	p.channels[channel].setGate(gate)
+}
+
+// Output returns the output level of a channel
+func (p *PIT) Output(channel int) bool {
+	return p.channels[channel].out
+}
+
+// Advance runs the timer for the given number of input clocks and returns
+// the number of rising edges on channel 0's output (IRQ0 requests)
+func (p *PIT) Advance(clocks uint64) int {
+	edges := p.channels[0].advance(clocks)
+	p.channels[1].advance(clocks)
+	p.channels[2].advance(clocks)
+	return edges
+}
+
+// writeControl handles a control word written to port 43h
+func (p *PIT) writeControl(value uint8) {
+	sel := value >> 6
+	if sel == 3 {
+		p.readBack(value)
+		return
+	}
+
+	ch := &p.channels[sel]
+	access := (value >> 4) & 3
+	if access == 0 {
+		ch.latchCount()
+		return
+	}
+
+	ch.mode = (value >> 1) & 7
+	if ch.mode >= 6 {
+		ch.mode -= 4 // Modes 6 and 7 are aliases of 2 and 3
+	}
+	ch.access = access
+	ch.armed = false
+	ch.pending = false
+	ch.writeMSB = false
+	ch.readMSB = false
+	ch.latched = false
+	ch.out = ch.mode != 0
+}
+
+// readBack handles the 8254 read-back command: bits 1-3 select the channels,
+// a clear bit 5 latches their counts and a clear bit 4 their status
+func (p *PIT) readBack(value uint8) {
+	for i := range p.channels {
+		if value&(2<<i) == 0 {
+			continue
+		}
+		ch := &p.channels[i]
+		if value&0x20 == 0 {
+			ch.latchCount()
+		}
+		if value&0x10 == 0 && !ch.statusLatched {
+			ch.status = ch.access<<4 | ch.mode<<1
+			if ch.out {
+				ch.status |= 0x80
+			}
+			if !ch.armed {
+				ch.status |= 0x40 // Null count: no count loaded yet
+			}
+			ch.statusLatched = true
+		}
+	}
+}
+
+// period returns the programmed count, where 0 means 65536
+func (ch *pitChannel) period() uint32 {
+	if ch.reload == 0 {
+		return 0x10000
+	}
+	return ch.reload
+}
+
+// count returns the current value of the counter
+func (ch *pitChannel) count() uint16 {
+	if !ch.armed {
+		return uint16(ch.reload)
+	}
+	n := ch.period()
+	if ch.mode == 3 {
+		// Mode 3 counts down by two through each half of the period
+		half := (n + 1) / 2
+		if ch.phase < half {
+			return uint16(n - 2*ch.phase)
+		}
+		return uint16(n - 2*(ch.phase-half))
+	}
+	return uint16(n - ch.phase)
+}
+
+func (ch *pitChannel) latchCount() {
+	if !ch.latched {
+		ch.latch = ch.count()
+		ch.latched = true
+	}
+}
+
+func (ch *pitChannel) writeCount(value uint8) {
+	switch ch.access {
+	case 1:
+		ch.load(uint32(value))
+	case 2:
+		ch.load(uint32(value) << 8)
+	case 3:
+		if !ch.writeMSB {
+			ch.lsb = value
+			ch.writeMSB = true
+			return
+		}
+		ch.writeMSB = false
+		ch.load(uint32(value)<<8 | uint32(ch.lsb))
+	}
+}
+
+// load starts counting from a new count. In modes 2 and 3 a running
+// counter finishes its current period first.
+func (ch *pitChannel) load(count uint32) {
+	periodic := ch.mode == 2 || ch.mode == 3
+	if ch.armed && periodic {
+		ch.next = count
+		ch.pending = true
+		return
+	}
+	ch.reload = count
+	ch.phase = 0
+	ch.armed = true
+	ch.out = periodic
+}
+
+func (ch *pitChannel) read() uint8 {
+	if ch.statusLatched {
+		ch.statusLatched = false
+		return ch.status
+	}
+
+	value := ch.count()
+	if ch.latched {
+		value = ch.latch
+	}
+	switch ch.access {
+	case 1:
+		ch.latched = false
+		return uint8(value)
+	case 2:
+		ch.latched = false
+		return uint8(value >> 8)
+	default:
+		if !ch.readMSB {
+			ch.readMSB = true
+			return uint8(value)
+		}
+		ch.readMSB = false
+		ch.latched = false
+		return uint8(value >> 8)
+	}
+}
+
+func (ch *pitChannel) setGate(gate bool) {
+	if gate == ch.gate {
+		return
+	}
+	ch.gate = gate
+	if ch.mode == 2 || ch.mode == 3 {
+		// A low gate forces the output high; a rising gate restarts the period
+		ch.out = true
+		if gate {
+			ch.phase = 0
+		}
+	}
+}
+
+// advance counts down the given number of input clocks and returns the
+// number of rising edges on the output
+func (ch *pitChannel) advance(clocks uint64) int {
+	if !ch.armed || !ch.gate {
+		return 0
+	}
+
+	n := uint64(ch.period())
+	edges := 0
+
+	if ch.mode != 2 && ch.mode != 3 {
+		// One-shot: the output rises once when the count reaches zero, then
+		// the counter keeps wrapping through 65536 with the output high
+		total := uint64(ch.phase) + clocks
+		if !ch.out && total >= n {
+			ch.out = true
+			edges = 1
+		}
+		if total >= n {
+			total = n + (total-n)%0x10000
+		}
+		ch.phase = uint32(total)
+		return edges
+	}
+
+	// A count written during the period is loaded when the period ends
+	if ch.pending && uint64(ch.phase)+clocks >= n {
+		clocks -= n - uint64(ch.phase)
+		edges++
+		ch.reload = ch.next
+		ch.pending = false
+		ch.phase = 0
+		n = uint64(ch.period())
+	}
+
+	total := uint64(ch.phase) + clocks
+	edges += int(total / n)
+	ch.phase = uint32(total % n)
+
+	if ch.mode == 2 {
+		// Rate generator: low for the single clock before the reload
+		ch.out = uint64(ch.phase) != n-1
+	} else {
+		// Square wave: high for the first (longer) half of the period
+		ch.out = uint64(ch.phase) < (n+1)/2
+	}
+	return edges
+}
+
+// untilEdge returns the number of input clocks until the next rising edge
+// of the output, if one is coming
+func (ch *pitChannel) untilEdge() (uint64, bool) {
+	if !ch.armed || !ch.gate || (ch.mode != 2 && ch.mode != 3 && ch.out) {
+		return 0, false
+	}
+	return uint64(ch.period() - ch.phase), true
+}
+
+// timerPollInterval is how many steps run between timer updates, keeping
+// the conversion from cycles off the per-instruction path
+const timerPollInterval = 64
+
+// updateTimer brings the PIT up to date with the cycle counter every
+// timerPollInterval steps
+func (c *CPU) updateTimer() {
+	c.timerPoll++
+	if c.timerPoll < timerPollInterval {
+		return
+	}
+	c.timerPoll = 0
+	c.syncTimer()
+}
+
+// syncTimer advances the PIT to the current cycle count, so IRQ0 fires at
+// the programmed rate in emulated time
+func (c *CPU) syncTimer() {
+	ticks := c.cyclesToDevice(c.Cycles, PITFrequency)
+	if ticks > c.timerTicks {
+		c.advanceTimer(ticks - c.timerTicks)
+		c.timerTicks = ticks
+	}
+}
+
+// advanceTimer runs the PIT for the given number of input clocks and raises
+// IRQ0 on a rising edge of channel 0. Edges that arrive before the request
+// is acknowledged are merged into one, as on the PIC's request line.
+func (c *CPU) advanceTimer(clocks uint64) {
+	if c.PIT.Advance(clocks) > 0 {
+		c.RaiseIRQ(0)
+	}
+}
+
+// idleInterval is how long a CPU waiting in HLT sleeps when no timer
+// interrupt is due, leaving devices on the host to raise one
+const idleInterval = time.Millisecond
+
+// idle runs while HLT waits for an interrupt. When the timer will raise
+// IRQ0, the cycle counter skips ahead to that edge; otherwise the host
+// thread sleeps briefly.
+func (c *CPU) idle() {
+	clocks, ok := c.PIT.channels[0].untilEdge()
+	if !ok || c.PIC.imr&0x01 != 0 {
+		select {
+		case <-c.stopChan:
+		case <-time.After(idleInterval):
+		}
+		return
+	}
+	c.skipToCycle(c.deviceToCycles(c.timerTicks+clocks, PITFrequency))
+	c.syncTimer()
+}
+
+// skipToCycle moves the cycle counter forward to a later cycle while the
+// CPU idles
+func (c *CPU) skipToCycle(cycle uint64) {
+	if cycle > c.Cycles {
+		c.Cycles = cycle
+	}
+}
@@ -0,0 +1,206 @@
+package emulator
+
+import (
+	"testing"
+)
+
+// readCount reads a channel's LSB/MSB count through its port
+func readCount(p *PIT, port uint16) uint16 {
+	lsb := p.Read(port)
+	return uint16(p.Read(port))<<8 | uint16(lsb)
+}
+
+// programPIT writes a control word and an LSB/MSB count
+func programPIT(p *PIT, control uint8, count uint16) {
+	port := 0x40 + uint16(control>>6)
+	p.Write(0x43, control)
+	p.Write(port, uint8(count))
+	p.Write(port, uint8(count>>8))
+}
+
+// TestPITModes tests IRQ0 edges and the output of modes 0, 2 and 3
+func TestPITModes(t *testing.T) {
+	p := NewPIT()
+
+	// The BIOS setup fires every 65536 clocks
+	if edges := p.Advance(65535); edges != 0 {
+		t.Errorf("BIOS mode 3: expected no edge before 65536 clocks, got %d", edges)
+	}
+	if edges := p.Advance(1); edges != 1 {
+		t.Errorf("BIOS mode 3: expected an edge at 65536 clocks, got %d", edges)
+	}
+
+	// Mode 0 fires once when the count runs out
+	programPIT(p, 0x30, 100)
+	if p.Output(0) {
+		t.Error("Mode 0: expected the output low while counting")
+	}
+	if edges := p.Advance(99); edges != 0 || readCount(p, 0x40) != 1 {
+		t.Errorf("Mode 0: expected count 1 and no edge after 99 clocks, got %d edges", edges)
+	}
+	if edges := p.Advance(1); edges != 1 || !p.Output(0) {
+		t.Errorf("Mode 0: expected one edge at terminal count, got %d", edges)
+	}
+	if edges := p.Advance(200000); edges != 0 {
+		t.Errorf("Mode 0: expected no edge after terminal count, got %d", edges)
+	}
+
+	// Mode 2 fires every period with a one-clock low pulse
+	programPIT(p, 0x34, 100)
+	if edges := p.Advance(250); edges != 2 || readCount(p, 0x40) != 50 {
+		t.Errorf("Mode 2: expected 2 edges and count 50, got %d edges", edges)
+	}
+	p.Advance(49)
+	if p.Output(0) {
+		t.Error("Mode 2: expected the output low at count 1")
+	}
+
+	// Mode 3 is a square wave, high for the first half of the period
+	programPIT(p, 0x36, 100)
+	if edges := p.Advance(1000); edges != 10 || !p.Output(0) {
+		t.Errorf("Mode 3: expected 10 edges with the output high, got %d", edges)
+	}
+	p.Advance(50)
+	if p.Output(0) {
+		t.Error("Mode 3: expected the output low in the second half")
+	}
+
+	// A new count takes effect at the end of the running period
+	programPIT(p, 0x34, 100)
+	p.Advance(10)
+	p.Write(0x40, 10)
+	p.Write(0x40, 0)
+	if edges := p.Advance(90); edges != 1 {
+		t.Errorf("Reload: expected the old period to finish, got %d edges", edges)
+	}
+	if edges := p.Advance(30); edges != 3 {
+		t.Errorf("Reload: expected the new period of 10, got %d edges", edges)
+	}
+}
+
+// TestPITLatchAndReadBack tests the counter latch and read-back commands
+func TestPITLatchAndReadBack(t *testing.T) {
+	p := NewPIT()
+
+	// Counter latch command: the count read is frozen at the latch
+	programPIT(p, 0x74, 1000) // Channel 1, mode 2
+	p.Advance(10)
+	p.Write(0x43, 0x40)
+	p.Advance(100)
+	if count := readCount(p, 0x41); count != 990 {
+		t.Errorf("Expected the latched count 990, got %d", count)
+	}
+	if count := readCount(p, 0x41); count != 890 {
+		t.Errorf("Expected the live count 890 after the latch is read, got %d", count)
+	}
+
+	// LSB-only access
+	p.Write(0x43, 0x90) // Channel 2, LSB only, mode 0
+	if status := p.Read(0x42); status != 0 {
+		t.Errorf("Expected count 0 before loading, got %d", status)
+	}
+	p.Write(0x42, 0x20)
+	if count := p.Read(0x42); count != 0x20 {
+		t.Errorf("Expected LSB-only count 20h, got %02Xh", count)
+	}
+
+	// Read-back of channel 0's status then count
+	programPIT(p, 0x34, 500)
+	p.Advance(5)
+	p.Write(0x43, 0xC2) // Latch count and status of channel 0
+	if status := p.Read(0x40); status != 0xB4 {
+		t.Errorf("Expected status B4h (out high, LSB/MSB, mode 2), got %02Xh", status)
+	}
+	if count := readCount(p, 0x40); count != 495 {
+		t.Errorf("Expected read-back count 495, got %d", count)
+	}
+
+	// A channel that has not been loaded reports a null count
+	p.Write(0x43, 0x36)
+	p.Write(0x43, 0xE2) // Latch status only
+	if status := p.Read(0x40); status&0x40 == 0 {
+		t.Errorf("Expected the null count bit, got %02Xh", status)
+	}
+}
+
+// TestPITSpeakerGate tests channel 2 gated through port 61h
+func TestPITSpeakerGate(t *testing.T) {
+	cpu := NewCPU()
+	cpu.OutByte(0x43, 0xB0) // Channel 2, LSB/MSB, mode 0
+	cpu.OutByte(0x42, 100)
+	cpu.OutByte(0x42, 0)
+
+	cpu.advanceTimer(1000)
+	if cpu.InByte(0x61)&0x20 != 0 {
+		t.Error("Expected channel 2 stopped while its gate is low")
+	}
+
+	cpu.OutByte(0x61, 0x03) // Gate and speaker on
+	cpu.advanceTimer(99)
+	if cpu.InByte(0x61)&0x20 != 0 {
+		t.Error("Expected channel 2's output low before terminal count")
+	}
+	cpu.advanceTimer(1)
+	status := cpu.InByte(0x61)
+	if status&0x20 == 0 || status&0x03 != 0x03 {
+		t.Errorf("Expected channel 2's output and the written bits in port 61h, got %02Xh", status)
+	}
+	if cpu.InByte(0x61)&0x10 == status&0x10 {
+		t.Error("Expected the refresh bit to toggle between reads")
+	}
+}
+
+// TestTimerInterrupt tests IRQ0 running the BIOS tick counter and the
+// INT 1Ch user hook
+func TestTimerInterrupt(t *testing.T) {
+	image := []byte{
+		0xBA, 0x0B, 0x01, // 0100: MOV DX, 010Bh
+		0xB8, 0x1C, 0x25, // 0103: MOV AX, 251Ch (set vector 1Ch)
+		0xCD, 0x21, // 0106: INT 21h
+		0x90, // 0108: NOP
+		0x90, // 0109: NOP
+		0xF4, // 010A: HLT
+		0x41, // 010B: INC CX (hook)
+		0xCF, // 010C: IRET
+	}
+
+	for _, enabled := range []bool{true, false} {
+		cpu := NewCPU()
+		if err := cpu.LoadCOM(image); err != nil {
+			t.Fatalf("LoadCOM failed: %v", err)
+		}
+		cpu.Flags.IF = enabled
+		for i := 0; i < 3; i++ {
+			if err := cpu.Step(); err != nil {
+				t.Fatalf("CPU.Step() failed: %v", err)
+			}
+		}
+		cpu.advanceTimer(0x10000)
+		runUntilIdle(t, cpu)
+
+		var want uint16
+		if enabled {
+			want = 1
+		}
+		if cpu.CX != want || cpu.Memory.ReadWordLinear(biosTickCount) != want {
+			t.Errorf("IF=%v: expected %d ticks and hook calls, got ticks=%d CX=%d",
+				enabled, want, cpu.Memory.ReadWordLinear(biosTickCount), cpu.CX)
+		}
+		if cpu.CS != COMLoadSegment || cpu.IP != 0x010B || cpu.SP != 0xFFFE {
+			t.Errorf("IF=%v: expected to halt at the program's HLT with the stack restored, got %04X:%04X SP=%04X",
+				enabled, cpu.CS, cpu.IP, cpu.SP)
+		}
+	}
+
+	// The tick count wraps at midnight
+	cpu := NewCPU()
+	cpu.Memory.WriteWordLinear(biosTickCount, uint16((ticksPerDay-1)&0xFFFF))
+	cpu.Memory.WriteWordLinear(biosTickCount+2, uint16((ticksPerDay-1)>>16))
+	cpu.timerTick()
+	if cpu.Memory.ReadWordLinear(biosTickCount) != 0 || cpu.Memory.ReadWordLinear(biosTickCount+2) != 0 {
+		t.Error("Expected the tick count to wrap to 0 at midnight")
+	}
+	if cpu.Memory.ReadByteLinear(biosMidnightFlag) != 1 {
+		t.Error("Expected the midnight flag set")
+	}
+}
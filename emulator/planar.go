@@ -0,0 +1,170 @@
+package emulator
+
+const (
+	// VGA memory: four 64 KB planes, seen by the CPU through the 64 KB
+	// window at A000:0000
+	VGAPlaneSize  = 0x10000
+	VGAWindowSize = 0x10000
+)
+
+// Sequencer registers (ports 3C4h and 3C5h)
+const (
+	seqMapMask    = 0x02 // Bits 0-3: the planes a write reaches
+	seqMemoryMode = 0x04 // Bit 3: chain-4, where the low address bits select the plane
+	seqRegisters  = 0x05
+
+	seqChain4 = 0x08
+)
+
+// Graphics controller registers (ports 3CEh and 3CFh)
+const (
+	gcReadMap   = 0x04 // Bits 0-1: the plane a read returns
+	gcMode      = 0x05 // Bits 0-1: write mode; bit 6: 256-colour shift
+	gcRegisters = 0x09
+
+	gc256Color = 0x40
+)
+
+// writeVGA handles a CPU write to the A000h window. In a 256-colour mode,
+// with chain-4 the low two bits of the address select the plane and the
+// rest the byte in it, and without (Mode X) the byte goes to the same
+// address of each plane the map mask enables, or in write mode 1 the
+// latches are written instead. Other modes write the window linearly. VGA
+// memory keeps the planes interleaved, byte p of each group of four being
+// plane p, so in mode 13h it reads as the screen's pixels in order.
+//
+// Write mode 0 stores the CPU's byte as it is: the set/reset, rotate,
+// logical function and bit mask registers are not emulated.
+func (m *Memory) writeVGA(offset uint32, val uint8) {
+	video := &m.video
+	m.vgaMux.Lock()
+	switch {
+	case video.GC[gcMode]&gc256Color == 0:
+		m.VGA[offset] = val
+	case video.Seq[seqMemoryMode]&seqChain4 != 0:
+		if video.Seq[seqMapMask]&(1<<(offset&3)) != 0 {
+			m.VGA[offset] = val
+		}
+	default:
+		mask := video.Seq[seqMapMask]
+		for plane := uint32(0); plane < 4; plane++ {
+			if mask&(1<<plane) == 0 {
+				continue
+			}
+			if video.GC[gcMode]&0x03 == 1 {
+				m.VGA[offset*4+plane] = m.latch[plane]
+			} else {
+				m.VGA[offset*4+plane] = val
+			}
+		}
+	}
+	m.vgaMux.Unlock()
+}
+
+// readVGA handles a CPU read of the A000h window. Without chain-4 in a
+// 256-colour mode it loads the latches with the address's byte of each
+// plane and returns the plane the read map select chooses.
+func (m *Memory) readVGA(offset uint32) uint8 {
+	video := &m.video
+	if video.GC[gcMode]&gc256Color == 0 || video.Seq[seqMemoryMode]&seqChain4 != 0 {
+		return m.VGA[offset]
+	}
+	copy(m.latch[:], m.VGA[offset*4:offset*4+4])
+	return m.latch[video.GC[gcReadMap]&3]
+}
+
+// GraphicsSize returns the size of the 256-colour screen the CRT
+// controller shows: 320x200 in mode 13h, and in unchained modes such as
+// the 320x240 of Mode X up to MaxScreenWidth by MaxScreenHeight pixels
+func (v *VideoState) GraphicsSize() (width, height int) {
+	width = (int(v.CRTC[crtcHorizontalEnd]) + 1) * 4
+	lines := int(v.CRTC[crtcVerticalEnd]) |
+		int(v.CRTC[crtcOverflow]&0x02)<<7 | int(v.CRTC[crtcOverflow]&0x40)<<3
+	rowLines := int(v.CRTC[crtcMaxScanLine]&0x1F) + 1
+	if v.CRTC[crtcMaxScanLine]&0x80 != 0 {
+		rowLines *= 2
+	}
+	height = (lines + 1) / rowLines
+	return min(width, MaxScreenWidth), max(min(height, MaxScreenHeight), 1)
+}
+
+// ScanOut reads the 256-colour screen out of VGA memory into dst as width
+// by height palette indices (see GraphicsSize), as the CRT controller does:
+// each row starts the offset register's words after the last, from the
+// start address on, and pixel x of a row is in plane x mod 4. Page
+// flipping moves the start address.
+func ScanOut(dst []byte, vga []byte, v *VideoState) {
+	width, height := v.GraphicsSize()
+	start := int(v.StartAddress())
+	line := int(v.CRTC[crtcOffset]) * 2
+	for y := 0; y < height; y++ {
+		row := dst[y*width : (y+1)*width]
+		addr := start + y*line
+		for x := range row {
+			row[x] = vga[((addr+x>>2)&(VGAPlaneSize-1))*4+(x&3)]
+		}
+	}
+}
+
+// writeSeq handles an OUT to the sequencer's index (3C4h) or data (3C5h)
+// register
+func (c *CPU) writeSeq(port uint16, value uint8) {
+	if port == 0x3C4 {
+		c.seqIndex = value & 0x07
+		return
+	}
+	if c.seqIndex < seqRegisters {
+		c.Memory.LockVGA()
+		c.Memory.video.Seq[c.seqIndex] = value
+		c.Memory.UnlockVGA()
+	}
+}
+
+// readSeq handles an IN from the sequencer ports
+func (c *CPU) readSeq(port uint16) uint8 {
+	if port == 0x3C4 {
+		return c.seqIndex
+	}
+	if c.seqIndex < seqRegisters {
+		return c.Memory.video.Seq[c.seqIndex]
+	}
+	return 0
+}
+
+// writeGC handles an OUT to the graphics controller's index (3CEh) or data
+// (3CFh) register
+func (c *CPU) writeGC(port uint16, value uint8) {
+	if port == 0x3CE {
+		c.gcIndex = value & 0x0F
+		return
+	}
+	if c.gcIndex < gcRegisters {
+		c.Memory.LockVGA()
+		c.Memory.video.GC[c.gcIndex] = value
+		c.Memory.UnlockVGA()
+	}
+}
+
+// readGC handles an IN from the graphics controller ports
+func (c *CPU) readGC(port uint16) uint8 {
+	if port == 0x3CE {
+		return c.gcIndex
+	}
+	if c.gcIndex < gcRegisters {
+		return c.Memory.video.GC[c.gcIndex]
+	}
+	return 0
+}
+
+// writeMisc handles an OUT to the miscellaneous output register (3C2h),
+// which Mode X sets for 480-line timing
+func (c *CPU) writeMisc(_ uint16, value uint8) {
+	c.Memory.LockVGA()
+	c.Memory.video.Misc = value
+	c.Memory.UnlockVGA()
+}
+
+// readMisc handles an IN from the miscellaneous output register (3CCh)
+func (c *CPU) readMisc(_ uint16) uint8 {
+	return c.Memory.video.Misc
+}
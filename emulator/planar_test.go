@@ -0,0 +1,161 @@
+package emulator
+
+import (
+	"bytes"
+	"image"
+	"testing"
+)
+
+// modeX sets mode 13h and unchains it to the 320x240 of Mode X, as
+// examples/modex.asm does
+func modeX(cpu *CPU) {
+	cpu.setVideoMode(0x13)
+	cpu.OutWord(0x3C4, 0x0604) // Chain-4 off
+	cpu.OutByte(0x3C2, 0xE3)
+	cpu.OutWord(0x3D4, 0x0E11) // Unprotect registers 0-7
+	for _, w := range []uint16{0x0D06, 0x3E07, 0x4109, 0xEA10, 0xAC11, 0xDF12, 0x0014, 0xE715, 0x0616, 0xE317} {
+		cpu.OutWord(0x3D4, w)
+	}
+}
+
+// TestModeXWrites tests that without chain-4 a write reaches the planes the
+// map mask enables, a read returns the plane the read map selects, and
+// write mode 1 copies the latches a read loaded
+func TestModeXWrites(t *testing.T) {
+	cpu := NewCPU()
+	modeX(cpu)
+	m := cpu.Memory
+
+	cpu.OutWord(0x3C4, 0x0502) // Planes 0 and 2
+	m.WriteByteLinear(VGAMemoryStart+1, 0xAB)
+	cpu.OutWord(0x3C4, 0x0202) // Plane 1
+	m.WriteByteLinear(VGAMemoryStart+1, 0xCD)
+	if got := m.VGA[4:8]; !bytes.Equal(got, []byte{0xAB, 0xCD, 0xAB, 0x00}) {
+		t.Errorf("Expected planes AB CD AB 00 at byte 1, got % X", got)
+	}
+
+	for plane, want := range []uint8{0xAB, 0xCD, 0xAB, 0x00} {
+		cpu.OutWord(0x3CE, uint16(plane)<<8|gcReadMap)
+		if got := m.ReadByteLinear(VGAMemoryStart + 1); got != want {
+			t.Errorf("Read map %d: expected %02X, got %02X", plane, want, got)
+		}
+	}
+
+	cpu.OutWord(0x3C4, 0x0F02)
+	cpu.OutWord(0x3CE, 0x4105) // Write mode 1
+	m.WriteByteLinear(VGAMemoryStart+3, 0xFF)
+	if got := m.VGA[12:16]; !bytes.Equal(got, []byte{0xAB, 0xCD, 0xAB, 0x00}) {
+		t.Errorf("Expected the latches copied to byte 3, got % X", got)
+	}
+}
+
+// TestChain4Layout tests that in mode 13h the window is the screen's
+// pixels in order, and that the map mask still applies to them
+func TestChain4Layout(t *testing.T) {
+	cpu := NewCPU()
+	cpu.setVideoMode(0x13)
+	m := cpu.Memory
+	m.WriteByteLinear(VGAMemoryStart+321, 9)
+	if got := m.GetVGAPixel(1, 1); got != 9 {
+		t.Errorf("Expected pixel (1, 1) = 9, got %d", got)
+	}
+
+	cpu.OutWord(0x3C4, 0x0E02) // All planes but 0
+	m.WriteByteLinear(VGAMemoryStart+320, 7)
+	m.WriteByteLinear(VGAMemoryStart+322, 7)
+	if got := m.VGA[320:323]; !bytes.Equal(got, []byte{0, 9, 7}) {
+		t.Errorf("Expected plane 0's write masked, got % X", got)
+	}
+}
+
+// TestScanOut tests the screen size the CRT controller sets up and that
+// the start address flips pages
+func TestScanOut(t *testing.T) {
+	machine := NewMachine()
+	cpu := machine.CPU
+	cpu.setVideoMode(0x13)
+	state := cpu.Memory.VideoState()
+	if w, h := state.GraphicsSize(); w != ScreenWidth || h != ScreenHeight {
+		t.Errorf("Expected %dx%d in mode 13h, got %dx%d", ScreenWidth, ScreenHeight, w, h)
+	}
+
+	modeX(cpu)
+	m := cpu.Memory
+	cpu.OutWord(0x3C4, 0x0402)                     // Plane 2
+	m.WriteByteLinear(VGAMemoryStart+80*239, 5)    // Pixel (2, 239) of page 0
+	m.WriteByteLinear(VGAMemoryStart+0x4B00+80, 6) // Pixel (2, 1) of page 1
+	state = m.VideoState()
+	w, h := state.GraphicsSize()
+	if w != 320 || h != 240 {
+		t.Fatalf("Expected 320x240 in Mode X, got %dx%d", w, h)
+	}
+	screen := make([]byte, w*h)
+	ScanOut(screen, m.VGA, &state)
+	if screen[239*w+2] != 5 {
+		t.Errorf("Expected colour 5 at (2, 239) of page 0, got %d", screen[239*w+2])
+	}
+
+	cpu.OutWord(0x3D4, 0x4B0C)
+	cpu.OutWord(0x3D4, 0x000D)
+	state = m.VideoState()
+	ScanOut(screen, m.VGA, &state)
+	if screen[w+2] != 6 {
+		t.Errorf("Expected colour 6 at (2, 1) of page 1, got %d", screen[w+2])
+	}
+	if bounds := machine.Screenshot().Bounds(); bounds != image.Rect(0, 0, 320, 240) {
+		t.Errorf("Expected a 320x240 screenshot, got %v", bounds)
+	}
+}
+
+// TestCRTCProtect tests that bit 7 of register 11h write-protects
+// registers 0-7 but for the line compare bit of the overflow register
+func TestCRTCProtect(t *testing.T) {
+	cpu := NewCPU()
+	cpu.setVideoMode(0x13)
+	cpu.OutWord(0x3D4, 0x5A01)
+	cpu.OutWord(0x3D4, 0xFF07)
+	state := cpu.Memory.VideoState()
+	if state.CRTC[crtcHorizontalEnd] != graphicsCRTC[crtcHorizontalEnd] || state.CRTC[crtcOverflow] != graphicsCRTC[crtcOverflow]|0x10 {
+		t.Errorf("Expected the protected registers kept, got %02X and %02X", state.CRTC[crtcHorizontalEnd], state.CRTC[crtcOverflow])
+	}
+
+	cpu.OutWord(0x3D4, 0x0E11)
+	cpu.OutWord(0x3D4, 0x5A01)
+	if state := cpu.Memory.VideoState(); state.CRTC[crtcHorizontalEnd] != 0x5A {
+		t.Errorf("Expected register 1 written once unprotected, got %02X", state.CRTC[crtcHorizontalEnd])
+	}
+}
+
+// TestLoadStatePlanes tests that a save state restores all four planes and
+// the sequencer and graphics controller, and that a version 3 state loads
+// with mode 13h's registers
+func TestLoadStatePlanes(t *testing.T) {
+	cpu := NewCPU()
+	modeX(cpu)
+	cpu.OutWord(0x3C4, 0x0802)
+	cpu.Memory.WriteByteLinear(VGAMemoryStart+0xFFFF, 0x77)
+	cpu.Memory.ReadByteLinear(VGAMemoryStart + 0xFFFF)
+
+	restored := NewCPU()
+	if err := restored.LoadState(bytes.NewReader(saveState(t, cpu))); err != nil {
+		t.Fatalf("LoadState failed: %v", err)
+	}
+	if restored.Memory.video != cpu.Memory.video || restored.Memory.latch != cpu.Memory.latch {
+		t.Errorf("Expected the saved registers and latches, got %+v", restored.Memory.video)
+	}
+	if got := restored.Memory.VGA[VGAMemorySize-1]; got != 0x77 {
+		t.Errorf("Expected plane 3's last byte restored, got %02X", got)
+	}
+
+	cpu.setVideoMode(0x13)
+	cpu.Memory.WriteByteLinear(VGAMemoryStart+10, 3)
+	restored = NewCPU()
+	modeX(restored)
+	if err := restored.LoadState(bytes.NewReader(oldState(cpu, 3))); err != nil {
+		t.Fatalf("LoadState failed: %v", err)
+	}
+	state := restored.Memory.VideoState()
+	if state.Seq != graphicsSeq || state.GC != graphicsGC || restored.Memory.VGA[10] != 3 {
+		t.Errorf("Expected mode 13h's registers and pixels, got %+v", state)
+	}
+}
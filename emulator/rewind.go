@@ -0,0 +1,175 @@
+package emulator
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Rewinder records the recent past of a CPU so it can be run backwards. It
+// snapshots the machine every few emulated frames and logs the key presses
+// in between. Going back restores the last snapshot before the target step
+// and re-executes up to it, which rebuilds the same machine because
+// execution depends only on the state and the input.
+//
+// Key presses are replayed at the step they arrived, so they must be
+// delivered between instructions: call SetKeyPress from the goroutine
+// running the CPU, through Schedule while Run is running. Seek, StepBack and
+// RewindFrames must be called the same way.
+type Rewinder struct {
+	cpu               *CPU
+	maxSnapshots      int
+	framesPerSnapshot int
+
+	snapshots     []rewindSnapshot // Oldest first
+	frames        []uint64         // Step at which each recorded frame started, oldest first
+	keys          []keyPress       // Key presses since the oldest snapshot, oldest first
+	sinceSnapshot int              // Frames started since the last snapshot
+}
+
+// rewindSnapshot is the machine state before a step
+type rewindSnapshot struct {
+	steps uint64
+	state []byte
+}
+
+// keyPress is a key delivered before a step
+type keyPress struct {
+	steps           uint64
+	scancode, ascii uint8
+}
+
+// NewRewinder starts recording a CPU's execution, keeping up to maxSnapshots
+// snapshots taken every framesPerSnapshot frames of the 70 Hz VGA refresh.
+// The oldest reachable step is therefore about
+// maxSnapshots*framesPerSnapshot frames back.
+func NewRewinder(cpu *CPU, maxSnapshots, framesPerSnapshot int) *Rewinder {
+	r := &Rewinder{
+		cpu:               cpu,
+		maxSnapshots:      max(maxSnapshots, 1),
+		framesPerSnapshot: max(framesPerSnapshot, 1),
+	}
+	cpu.rewinder = r
+	r.Reset()
+	return r
+}
+
+// Reset forgets the recorded past and starts again from the current state.
+// LoadState calls it.
+func (r *Rewinder) Reset() {
+	r.snapshots = r.snapshots[:0]
+	r.frames = r.frames[:0]
+	r.keys = r.keys[:0]
+	r.snapshot()
+}
+
+// Frames returns the number of frame starts recorded. RewindFrames can go
+// back up to one less than that.
+func (r *Rewinder) Frames() int {
+	return len(r.frames)
+}
+
+// StepBack goes back to the state before the last step, as a debugger's
+// "back" command does
+func (r *Rewinder) StepBack() error {
+	if r.cpu.Steps == 0 {
+		return fmt.Errorf("already at the first step")
+	}
+	return r.Seek(r.cpu.Steps - 1)
+}
+
+// RewindFrames goes back to the start of the frame n frames before the
+// current one
+func (r *Rewinder) RewindFrames(n int) error {
+	if n < 0 || n >= len(r.frames) {
+		return fmt.Errorf("cannot rewind %d frames: %d recorded", n, len(r.frames))
+	}
+	return r.Seek(r.frames[len(r.frames)-1-n])
+}
+
+// Seek goes back to the state after the given number of steps. Key presses
+// at or after that step are forgotten, as they are now in the future.
+func (r *Rewinder) Seek(step uint64) error {
+	c := r.cpu
+	if step > c.Steps {
+		return fmt.Errorf("cannot seek forward from step %d to %d", c.Steps, step)
+	}
+	i := len(r.snapshots) - 1
+	for i >= 0 && r.snapshots[i].steps > step {
+		i--
+	}
+	if i < 0 {
+		return fmt.Errorf("step %d is before the oldest snapshot (step %d)", step, r.snapshots[0].steps)
+	}
+
+	// Forget what happened after the snapshot; re-executing records the
+	// frames and snapshots up to the target again
+	snap := r.snapshots[i]
+	r.snapshots = r.snapshots[:i+1]
+	for len(r.frames) > 0 && r.frames[len(r.frames)-1] > snap.steps {
+		r.frames = r.frames[:len(r.frames)-1]
+	}
+	for len(r.keys) > 0 && r.keys[len(r.keys)-1].steps >= step {
+		r.keys = r.keys[:len(r.keys)-1]
+	}
+
+	if err := c.codeState(&stateCodec{in: snap.state, version: SaveStateVersion}); err != nil {
+		return err
+	}
+	c.Steps = snap.steps
+	c.restored()
+	r.sinceSnapshot = 0
+
+	c.replaying = true
+	defer func() { c.replaying = false }()
+	k := 0
+	for k < len(r.keys) && r.keys[k].steps < snap.steps {
+		k++
+	}
+	for c.Steps < step {
+		for ; k < len(r.keys) && r.keys[k].steps == c.Steps; k++ {
+			c.pressKey(r.keys[k].scancode, r.keys[k].ascii)
+		}
+		if err := c.Step(); err != nil {
+			return fmt.Errorf("replaying step %d: %w", c.Steps, err)
+		}
+	}
+	return nil
+}
+
+// frameStarted records the start of a frame before a step and takes a
+// snapshot every framesPerSnapshot frames
+func (r *Rewinder) frameStarted() {
+	r.frames = append(r.frames, r.cpu.Steps)
+	r.sinceSnapshot++
+	if r.sinceSnapshot >= r.framesPerSnapshot {
+		r.snapshot()
+	}
+}
+
+// snapshot saves the current state, reusing the oldest snapshot's buffer
+// once the ring is full, and drops the frames and keys before the oldest
+// snapshot left
+func (r *Rewinder) snapshot() {
+	var buf []byte
+	if len(r.snapshots) == r.maxSnapshots {
+		buf = r.snapshots[0].state[:0]
+		r.snapshots = r.snapshots[1:]
+	}
+	s := &stateCodec{out: bytes.NewBuffer(buf), version: SaveStateVersion}
+	r.cpu.codeState(s)
+	r.snapshots = append(r.snapshots, rewindSnapshot{steps: r.cpu.Steps, state: s.out.Bytes()})
+	r.sinceSnapshot = 0
+
+	oldest := r.snapshots[0].steps
+	for len(r.frames) > 0 && r.frames[0] < oldest {
+		r.frames = r.frames[1:]
+	}
+	for len(r.keys) > 0 && r.keys[0].steps < oldest {
+		r.keys = r.keys[1:]
+	}
+}
+
+// logKey records a key press delivered before the next step
+func (r *Rewinder) logKey(scancode, ascii uint8) {
+	r.keys = append(r.keys, keyPress{steps: r.cpu.Steps, scancode: scancode, ascii: ascii})
+}
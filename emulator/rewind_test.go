@@ -0,0 +1,134 @@
+package emulator
+
+import (
+	"bytes"
+	"testing"
+)
+
+// newTimerCPU loads timerProgram into a new CPU
+func newTimerCPU(t *testing.T) *CPU {
+	t.Helper()
+	cpu := NewCPU()
+	if err := cpu.LoadCOM(timerProgram); err != nil {
+		t.Fatalf("LoadCOM failed: %v", err)
+	}
+	return cpu
+}
+
+// stepTo steps a CPU until it has taken the given number of steps
+func stepTo(t *testing.T, cpu *CPU, steps uint64) {
+	t.Helper()
+	for cpu.Steps < steps {
+		if err := cpu.Step(); err != nil {
+			t.Fatalf("Step failed: %v", err)
+		}
+	}
+}
+
+// expectSameMachine fails unless two CPUs have the same registers, cycle
+// count and memory
+func expectSameMachine(t *testing.T, got, want *CPU) {
+	t.Helper()
+	if got.String() != want.String() || got.Cycles != want.Cycles || got.Steps != want.Steps {
+		t.Fatalf("Machines differ:\ngot:  %s (%d cycles, %d steps)\nwant: %s (%d cycles, %d steps)",
+			got.String(), got.Cycles, got.Steps, want.String(), want.Cycles, want.Steps)
+	}
+	if !bytes.Equal(got.Memory.RAM, want.Memory.RAM) {
+		t.Fatal("Memory differs")
+	}
+}
+
+// TestRewindStepBack tests that stepping back gives the machine as it was
+// one step earlier, with the timer and interrupts mid-flight
+func TestRewindStepBack(t *testing.T) {
+	cpu := newTimerCPU(t)
+	r := NewRewinder(cpu, 4, 2)
+	stepTo(t, cpu, 200000)
+
+	if err := r.StepBack(); err != nil {
+		t.Fatalf("StepBack failed: %v", err)
+	}
+	reference := newTimerCPU(t)
+	stepTo(t, reference, 199999)
+	expectSameMachine(t, cpu, reference)
+	if reference.SI == 0 {
+		t.Error("Expected the INT 1Ch hook to have run")
+	}
+}
+
+// TestRewindFrames tests rewinding to the start of an earlier frame and
+// running on from there
+func TestRewindFrames(t *testing.T) {
+	cpu := newTimerCPU(t)
+	r := NewRewinder(cpu, 4, 2) // Wraps around after about 8 frames
+	stepTo(t, cpu, 400000)
+
+	if r.snapshots[0].steps == 0 {
+		t.Fatal("Expected the oldest snapshots to have been dropped")
+	}
+	if len(r.frames) < 4 {
+		t.Fatalf("Expected at least 4 recorded frames, got %d", len(r.frames))
+	}
+	target := r.frames[len(r.frames)-4]
+	if err := r.RewindFrames(3); err != nil {
+		t.Fatalf("RewindFrames failed: %v", err)
+	}
+	if cpu.Steps != target {
+		t.Fatalf("Expected to rewind to step %d, got %d", target, cpu.Steps)
+	}
+	reference := newTimerCPU(t)
+	stepTo(t, reference, target)
+	expectSameMachine(t, cpu, reference)
+
+	// The recording carries on from the rewound state
+	stepTo(t, cpu, target+100000)
+	stepTo(t, reference, target+100000)
+	expectSameMachine(t, cpu, reference)
+
+	if err := r.RewindFrames(len(r.frames)); err == nil {
+		t.Error("Expected an error rewinding past the recorded frames")
+	}
+}
+
+// TestRewindReplaysKeys tests that key presses are re-delivered at the same
+// step when execution is replayed from a snapshot
+func TestRewindReplaysKeys(t *testing.T) {
+	cpu := NewCPU()
+	if err := cpu.LoadCOM([]byte{
+		0xB4, 0x01, // 0100: MOV AH, 1
+		0xCD, 0x16, // 0102: INT 16h
+		0x74, 0x06, // 0104: JZ 010Ch
+		0xB4, 0x00, // 0106: MOV AH, 0
+		0xCD, 0x16, // 0108: INT 16h
+		0x01, 0xC3, // 010A: ADD BX, AX
+		0x41,       // 010C: INC CX
+		0xEB, 0xF1, // 010D: JMP 0100h
+	}); err != nil {
+		t.Fatalf("LoadCOM failed: %v", err)
+	}
+	r := NewRewinder(cpu, 4, 1000) // Only the snapshot at step 0
+	stepTo(t, cpu, 5000)
+	cpu.SetKeyPress(0x1E, 'a')
+	stepTo(t, cpu, 10000)
+	if cpu.BX != 0x1E61 {
+		t.Fatalf("Expected the program to read the key into BX, got BX=%04X", cpu.BX)
+	}
+	want := cpu.String()
+
+	if err := r.StepBack(); err != nil {
+		t.Fatalf("StepBack failed: %v", err)
+	}
+	stepTo(t, cpu, 10000)
+	if got := cpu.String(); got != want {
+		t.Errorf("Replay differs:\ngot:  %s\nwant: %s", got, want)
+	}
+
+	// Seeking to before the key press forgets it
+	if err := r.Seek(4000); err != nil {
+		t.Fatalf("Seek failed: %v", err)
+	}
+	stepTo(t, cpu, 10000)
+	if cpu.BX != 0 {
+		t.Errorf("Expected the key to be forgotten, got BX=%04X", cpu.BX)
+	}
+}
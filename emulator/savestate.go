@@ -0,0 +1,384 @@
+package emulator
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+// SaveStateVersion is the version of the save state format SaveState writes.
+// LoadState reads it and the versions before it. Version 2 added the
+// emulated frame count, version 3 the CRT and attribute controllers, and
+// version 4 the four planes of VGA memory, the sequencer and the graphics
+// controller.
+const SaveStateVersion = 4
+
+// saveStateMagic starts every save state file
+const saveStateMagic = "AEMUSAVE"
+
+// SaveState writes a snapshot of the whole machine: the registers and flags,
+// the FPU, RAM and VGA memory, the DAC palette, the keyboard, the PIC and
+// PIT, the video mode and VGA registers and the counters. A file starts with the magic
+// "AEMUSAVE" and a little-endian uint16 version, followed by the
+// gzip-compressed state.
+//
+// Settings chosen by the host, such as ClockHz, Engine and the exception
+// and port policies, are not part of the state. Call it between
+// instructions, from the goroutine running the CPU (see Schedule).
+func (c *CPU) SaveState(w io.Writer) error {
+	s := &stateCodec{out: new(bytes.Buffer), version: SaveStateVersion}
+	c.codeState(s)
+
+	header := make([]byte, len(saveStateMagic)+2)
+	copy(header, saveStateMagic)
+	binary.LittleEndian.PutUint16(header[len(saveStateMagic):], SaveStateVersion)
+	if _, err := w.Write(header); err != nil {
+		return fmt.Errorf("writing save state: %w", err)
+	}
+	gz := gzip.NewWriter(w)
+	if _, err := gz.Write(s.out.Bytes()); err != nil {
+		return fmt.Errorf("writing save state: %w", err)
+	}
+	if err := gz.Close(); err != nil {
+		return fmt.Errorf("writing save state: %w", err)
+	}
+	return nil
+}
+
+// LoadState restores a snapshot written by SaveState, after which the CPU
+// runs exactly as the saved machine did. A damaged or truncated file leaves
+// the CPU as it was.
+//
+// Mode13hCallback is called if the snapshot is in mode 13h, then
+// VideoModeCallback with its mode, and then ResetPaletteCallback, after which the restored DAC entries are passed to
+// SetPaletteCallback. A Rewinder recording the CPU starts again from the
+// loaded state.
+func (c *CPU) LoadState(r io.Reader) error {
+	header := make([]byte, len(saveStateMagic)+2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return fmt.Errorf("reading save state: %w", err)
+	}
+	if string(header[:len(saveStateMagic)]) != saveStateMagic {
+		return fmt.Errorf("not a save state file")
+	}
+	version := binary.LittleEndian.Uint16(header[len(saveStateMagic):])
+	if version == 0 || version > SaveStateVersion {
+		return fmt.Errorf("unsupported save state version %d (expected up to %d)", version, SaveStateVersion)
+	}
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("reading save state: %w", err)
+	}
+	body, err := io.ReadAll(gz)
+	if err != nil {
+		return fmt.Errorf("reading save state: %w", err)
+	}
+
+	// Decode into a scratch machine first, so a bad file changes nothing
+	scratch := &CPU{
+		Memory: &Memory{RAM: make([]byte, TotalMemorySize), VGA: make([]byte, VGAMemorySize)},
+		PIC:    &PIC{},
+		PIT:    &PIT{},
+	}
+	if err := scratch.codeState(&stateCodec{in: body, version: version}); err != nil {
+		return err
+	}
+	c.codeState(&stateCodec{in: body, version: version})
+	c.restored()
+	if c.rewinder != nil {
+		c.rewinder.Reset()
+	}
+	return nil
+}
+
+// restored brings the rest of the emulator up to date after the machine
+// state was replaced. Cached code came from the old memory, and the throttle
+// restarts from the restored cycle count.
+func (c *CPU) restored() {
+	if c.Memory.decoded != nil {
+		c.Memory.decoded.flush()
+	}
+	if c.Memory.blocks != nil {
+		c.Memory.blocks.flush()
+	}
+	c.throttleStart = time.Time{}
+	c.throttleNext = 0
+
+	// The frame clock picks up from the restored frame, and the input
+	// script from its first key after it
+	c.frameEnd = 0
+	c.scriptNext = 0
+	for c.scriptNext < len(c.InputScript) && c.InputScript[c.scriptNext].Frame <= c.VideoFrame {
+		c.scriptNext++
+	}
+
+	mode := c.Memory.video.Mode
+	if mode == 0x13 && c.Mode13hCallback != nil {
+		c.Mode13hCallback()
+	}
+	if c.VideoModeCallback != nil {
+		c.VideoModeCallback(mode)
+	}
+	c.replayPalette()
+}
+
+// replayPalette passes ResetPaletteCallback and then the DAC entries the
+// program has set to SetPaletteCallback, so a display shows the machine's
+// colours
+func (c *CPU) replayPalette() {
+	if c.ResetPaletteCallback != nil {
+		c.ResetPaletteCallback()
+	}
+	if c.SetPaletteCallback != nil {
+		for i, written := range c.dacWritten {
+			if written {
+				r, g, b := dacColor(c.dacPalette[i])
+				c.SetPaletteCallback(byte(i), r, g, b)
+			}
+		}
+	}
+}
+
+// codeState saves the machine state to s or loads it from s. Each field is
+// listed once, in file order, so saving and loading cannot drift apart.
+func (c *CPU) codeState(s *stateCodec) error {
+	for _, reg := range []*uint16{
+		&c.AX, &c.BX, &c.CX, &c.DX, &c.SI, &c.DI, &c.BP, &c.SP,
+		&c.CS, &c.DS, &c.ES, &c.SS, &c.FS, &c.GS,
+		&c.EAXHigh, &c.EBXHigh, &c.ECXHigh, &c.EDXHigh,
+		&c.ESIHigh, &c.EDIHigh, &c.EBPHigh, &c.ESPHigh,
+		&c.IP,
+	} {
+		s.u16(reg)
+	}
+	flags := c.Flags.Word()
+	s.u16(&flags)
+	c.Flags.SetWord(flags)
+	s.flag(&c.extended)
+	s.flag(&c.Halted)
+	s.flag(&c.WaitingForInterrupt)
+	s.flag(&c.Native)
+	s.u8((*uint8)(&c.Model))
+	if c.Model >= modelCount {
+		s.fail(fmt.Errorf("save state has unknown CPU model %d", c.Model))
+	}
+
+	for i := range c.FPU.regs {
+		s.u64(&c.FPU.regs[i].Mant)
+		s.u16(&c.FPU.regs[i].SE)
+	}
+	s.u16(&c.FPU.Control)
+	s.u16(&c.FPU.Status)
+	s.u16(&c.FPU.Tag)
+
+	s.u64(&c.Cycles)
+	s.u64(&c.InstructionCount)
+	if s.version >= 2 {
+		s.u64(&c.VideoFrame)
+	} else if c.Model < modelCount {
+		c.VideoFrame = c.Cycles / c.frameCycles()
+	}
+	s.u64(&c.timerTicks)
+	s.u8(&c.timerPoll)
+	s.u8(&c.port61)
+	c.PIC.codeState(s)
+	c.PIT.codeState(s)
+
+	s.u8(&c.vgaDACWriteIndex)
+	s.u8(&c.vgaDACReadIndex)
+	s.u8(&c.vgaDACState)
+	s.u8(&c.vgaDACColorR)
+	s.u8(&c.vgaDACColorG)
+
+	// A display may be reading the DAC, the video state, text memory in RAM
+	// and VGA memory
+	c.Memory.LockVGA()
+	defer c.Memory.UnlockVGA()
+	c.Memory.frame = c.VideoFrame
+	for i := range c.dacPalette {
+		s.bytes(c.dacPalette[i][:])
+		s.flag(&c.dacWritten[i])
+	}
+	s.flag(&c.VBlankActive)
+
+	s.u8(&c.keyboardScancode)
+	s.u8(&c.keyboardASCII)
+	s.flag(&c.keyAvailable)
+
+	video := &c.Memory.video
+	s.u8(&video.Mode)
+	s.u8(&c.cursorX)
+	s.u8(&c.cursorY)
+	s.u8(&c.textColor)
+	s.u8(&c.textScale)
+
+	s.bytes(c.Memory.RAM)
+	if s.version >= 4 {
+		s.bytes(c.Memory.VGA)
+	} else {
+		// Older states have the 64000 bytes of mode 13h
+		s.bytes(c.Memory.VGA[:ScreenWidth*ScreenHeight])
+		clear(c.Memory.VGA[ScreenWidth*ScreenHeight:])
+	}
+	if s.version >= 3 {
+		s.bytes(video.CRTC[:])
+		s.bytes(video.Attr[:])
+		s.u8(&c.crtcIndex)
+		s.u8(&c.attrIndex)
+		s.flag(&c.attrData)
+	} else {
+		// Older states have the registers the BIOS programmed for the mode,
+		// with the cursor where it left it
+		video.reset(video.Mode)
+		cursor := uint16(c.cursorY)*TextColumns + uint16(c.cursorX)
+		if video.TextMode() {
+			video.CRTC[crtcCursorHigh], video.CRTC[crtcCursorLow] = uint8(cursor>>8), uint8(cursor)
+		}
+		c.resetVideoIndexes()
+	}
+	if s.version >= 4 {
+		s.u8(&video.Misc)
+		s.bytes(video.Seq[:])
+		s.bytes(video.GC[:])
+		s.u8(&c.seqIndex)
+		s.u8(&c.gcIndex)
+		s.bytes(c.Memory.latch[:])
+	} else {
+		var defaults VideoState
+		defaults.reset(video.Mode)
+		video.Misc, video.Seq, video.GC = defaults.Misc, defaults.Seq, defaults.GC
+		c.seqIndex, c.gcIndex = 0, 0
+		c.Memory.latch = [4]uint8{}
+	}
+	return s.finish()
+}
+
+// codeState saves or loads the interrupt controller's registers
+func (p *PIC) codeState(s *stateCodec) {
+	s.u8(&p.irr)
+	s.u8(&p.isr)
+	s.u8(&p.imr)
+	s.u8(&p.vectorBase)
+	s.u8(&p.initStep)
+	s.flag(&p.needICW4)
+	s.flag(&p.single)
+	s.flag(&p.autoEOI)
+	s.flag(&p.readISR)
+}
+
+// codeState saves or loads the timer's three counters
+func (p *PIT) codeState(s *stateCodec) {
+	for i := range p.channels {
+		ch := &p.channels[i]
+		s.u8(&ch.mode)
+		s.u8(&ch.access)
+		s.u32(&ch.reload)
+		s.u32(&ch.next)
+		s.flag(&ch.pending)
+		s.u32(&ch.phase)
+		s.flag(&ch.armed)
+		s.flag(&ch.gate)
+		s.flag(&ch.out)
+		s.flag(&ch.writeMSB)
+		s.u8(&ch.lsb)
+		s.flag(&ch.readMSB)
+		s.flag(&ch.latched)
+		s.u16(&ch.latch)
+		s.flag(&ch.statusLatched)
+		s.u8(&ch.status)
+	}
+}
+
+// stateCodec writes state fields to out when saving, or reads them from in
+// when loading. After a read runs past the end of the input, later reads
+// leave their fields alone and finish reports the error.
+type stateCodec struct {
+	out     *bytes.Buffer // Set when saving
+	in      []byte        // Input not yet read when loading
+	version uint16        // Format version of the state
+	err     error
+}
+
+// fail records an error in the state being loaded
+func (s *stateCodec) fail(err error) {
+	if s.err == nil {
+		s.err = err
+	}
+}
+
+// take returns the next n bytes of the input, or nil if it is too short
+func (s *stateCodec) take(n int) []byte {
+	if s.err != nil {
+		return nil
+	}
+	if len(s.in) < n {
+		s.fail(fmt.Errorf("save state is truncated"))
+		return nil
+	}
+	b := s.in[:n]
+	s.in = s.in[n:]
+	return b
+}
+
+func (s *stateCodec) u8(v *uint8) {
+	if s.out != nil {
+		s.out.WriteByte(*v)
+	} else if b := s.take(1); b != nil {
+		*v = b[0]
+	}
+}
+
+func (s *stateCodec) u16(v *uint16) {
+	if s.out != nil {
+		s.out.Write(binary.LittleEndian.AppendUint16(nil, *v))
+	} else if b := s.take(2); b != nil {
+		*v = binary.LittleEndian.Uint16(b)
+	}
+}
+
+func (s *stateCodec) u32(v *uint32) {
+	if s.out != nil {
+		s.out.Write(binary.LittleEndian.AppendUint32(nil, *v))
+	} else if b := s.take(4); b != nil {
+		*v = binary.LittleEndian.Uint32(b)
+	}
+}
+
+func (s *stateCodec) u64(v *uint64) {
+	if s.out != nil {
+		s.out.Write(binary.LittleEndian.AppendUint64(nil, *v))
+	} else if b := s.take(8); b != nil {
+		*v = binary.LittleEndian.Uint64(b)
+	}
+}
+
+func (s *stateCodec) flag(v *bool) {
+	b := uint8(0)
+	if *v {
+		b = 1
+	}
+	s.u8(&b)
+	if s.err == nil {
+		*v = b != 0
+	}
+}
+
+// bytes saves or loads a fixed-size block such as RAM
+func (s *stateCodec) bytes(v []byte) {
+	if s.out != nil {
+		s.out.Write(v)
+	} else if b := s.take(len(v)); b != nil {
+		copy(v, b)
+	}
+}
+
+// finish returns the first error, or an error if a load left input unread
+func (s *stateCodec) finish() error {
+	if s.out == nil && len(s.in) != 0 {
+		s.fail(fmt.Errorf("save state has %d bytes of unexpected data", len(s.in)))
+	}
+	return s.err
+}
@@ -0,0 +1,189 @@
+package emulator
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"testing"
+)
+
+// timerProgram hooks INT 1Ch, speeds up the timer and counts ticks in SI
+// while a loop runs, so its state includes the PIC and PIT mid-count
+var timerProgram = []byte{
+	0xB8, 0x1C, 0x25, // 0100: MOV AX, 251Ch
+	0xBA, 0x20, 0x01, // 0103: MOV DX, 0120h
+	0xCD, 0x21, // 0106: INT 21h
+	0xB0, 0x36, // 0108: MOV AL, 36h
+	0xE6, 0x43, // 010A: OUT 43h, AL
+	0xB0, 0x00, // 010C: MOV AL, 0
+	0xE6, 0x40, // 010E: OUT 40h, AL
+	0xB0, 0x01, // 0110: MOV AL, 1 (period 256)
+	0xE6, 0x40, // 0112: OUT 40h, AL
+	0xFB,       // 0114: STI
+	0x41,       // 0115: INC CX
+	0x42,       // 0116: INC DX
+	0x43,       // 0117: INC BX
+	0x47,       // 0118: INC DI
+	0xEB, 0xFA, // 0119: JMP 0115h
+	0, 0, 0, 0, 0, // 011B
+	0x46, // 0120: INC SI
+	0xCF, // 0121: IRET
+}
+
+// saveState saves a CPU's state, failing the test on error
+func saveState(t *testing.T, cpu *CPU) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := cpu.SaveState(&buf); err != nil {
+		t.Fatalf("SaveState failed: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// stepN steps a CPU n times, failing the test on error
+func stepN(t *testing.T, cpu *CPU, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		if err := cpu.Step(); err != nil {
+			t.Fatalf("Step failed: %v", err)
+		}
+	}
+}
+
+// TestSaveStateRestoresExecution tests that a machine restored from a
+// snapshot runs exactly as the original does from the same point
+func TestSaveStateRestoresExecution(t *testing.T) {
+	original := NewCPU()
+	if err := original.LoadCOM(timerProgram); err != nil {
+		t.Fatalf("LoadCOM failed: %v", err)
+	}
+	stepN(t, original, 5000)
+	state := saveState(t, original)
+
+	restored := NewCPU()
+	if err := restored.LoadState(bytes.NewReader(state)); err != nil {
+		t.Fatalf("LoadState failed: %v", err)
+	}
+	if restored.String() != original.String() {
+		t.Fatalf("Restored registers differ:\nsaved:    %s\nrestored: %s", original.String(), restored.String())
+	}
+
+	stepN(t, original, 50000)
+	stepN(t, restored, 50000)
+	if restored.String() != original.String() || restored.Cycles != original.Cycles {
+		t.Errorf("Execution diverged after restoring:\noriginal: %s (%d cycles)\nrestored: %s (%d cycles)",
+			original.String(), original.Cycles, restored.String(), restored.Cycles)
+	}
+	if original.SI == 0 {
+		t.Error("Expected the INT 1Ch hook to run")
+	}
+	if !bytes.Equal(restored.Memory.RAM, original.Memory.RAM) {
+		t.Error("Memory diverged after restoring")
+	}
+}
+
+// TestSaveStatePaletteAndMode tests that loading a state replays the DAC
+// entries the program set and reports mode 13h
+func TestSaveStatePaletteAndMode(t *testing.T) {
+	cpu := runCOM(t, []byte{
+		0xB8, 0x13, 0x00, // 0100: MOV AX, 0013h
+		0xCD, 0x10, // 0103: INT 10h
+		0xBA, 0xC8, 0x03, // 0105: MOV DX, 03C8h
+		0xB0, 0x05, // 0108: MOV AL, 5
+		0xEE,       // 010A: OUT DX, AL
+		0x42,       // 010B: INC DX
+		0xB0, 0x3F, // 010C: MOV AL, 63
+		0xEE,       // 010E: OUT DX, AL
+		0xB0, 0x00, // 010F: MOV AL, 0
+		0xEE, // 0111: OUT DX, AL
+		0xEE, // 0112: OUT DX, AL
+		0xF4, // 0113: HLT
+	})
+	state := saveState(t, cpu)
+
+	restored := NewCPU()
+	var palette [][4]byte
+	mode13h := false
+	restored.SetPaletteCallback = func(index byte, r, g, b byte) {
+		palette = append(palette, [4]byte{index, r, g, b})
+	}
+	restored.Mode13hCallback = func() { mode13h = true }
+	if err := restored.LoadState(bytes.NewReader(state)); err != nil {
+		t.Fatalf("LoadState failed: %v", err)
+	}
+	if len(palette) != 1 || palette[0] != [4]byte{5, 255, 0, 0} {
+		t.Errorf("Expected entry 5 to be restored as bright red, got %v", palette)
+	}
+	if !mode13h {
+		t.Error("Expected Mode13hCallback after loading a mode 13h state")
+	}
+	if restored.Halted != cpu.Halted || restored.WaitingForInterrupt != cpu.WaitingForInterrupt || restored.IP != 0x0114 {
+		t.Errorf("Expected the restored CPU to wait after HLT, got %s", restored.String())
+	}
+}
+
+// TestLoadStateRejectsBadFiles tests that a foreign, newer or truncated
+// file is rejected without changing the CPU
+func TestLoadStateRejectsBadFiles(t *testing.T) {
+	cpu := NewCPU()
+	cpu.AX = 0x1234
+	state := saveState(t, cpu)
+
+	newer := append([]byte(nil), state...)
+	binary.LittleEndian.PutUint16(newer[len(saveStateMagic):], SaveStateVersion+1)
+
+	// Bodies that are too short or too long, in intact gzip streams
+	full := &stateCodec{out: new(bytes.Buffer), version: SaveStateVersion}
+	cpu.codeState(full)
+	header := state[:len(saveStateMagic)+2]
+	withBody := func(body []byte) []byte {
+		var buf bytes.Buffer
+		buf.Write(header)
+		gz := gzip.NewWriter(&buf)
+		gz.Write(body)
+		gz.Close()
+		return buf.Bytes()
+	}
+
+	for name, file := range map[string][]byte{
+		"foreign":  []byte("MZ\x90\x00 not a state"),
+		"newer":    newer,
+		"cut":      state[:len(state)/2],
+		"short":    withBody(full.out.Bytes()[:100]),
+		"trailing": withBody(append(full.out.Bytes(), 0)),
+	} {
+		target := NewCPU()
+		target.AX = 0xBEEF
+		if err := target.LoadState(bytes.NewReader(file)); err == nil {
+			t.Errorf("%s: expected LoadState to fail", name)
+		}
+		if target.AX != 0xBEEF {
+			t.Errorf("%s: a failed load changed AX to %04X", name, target.AX)
+		}
+	}
+}
+
+// TestLoadStateVersion1 tests that a state from before the frame count was
+// saved loads with the frame worked out from the cycle count
+func TestLoadStateVersion1(t *testing.T) {
+	cpu := newTimerCPU(t)
+	stepTo(t, cpu, 100000)
+	body := &stateCodec{out: new(bytes.Buffer), version: 1}
+	cpu.codeState(body)
+
+	var file bytes.Buffer
+	file.WriteString(saveStateMagic)
+	binary.Write(&file, binary.LittleEndian, uint16(1))
+	gz := gzip.NewWriter(&file)
+	gz.Write(body.out.Bytes())
+	gz.Close()
+
+	restored := NewCPU()
+	if err := restored.LoadState(&file); err != nil {
+		t.Fatalf("LoadState failed: %v", err)
+	}
+	if restored.VideoFrame != cpu.VideoFrame || restored.String() != cpu.String() {
+		t.Errorf("Expected frame %d and %s, got frame %d and %s",
+			cpu.VideoFrame, cpu.String(), restored.VideoFrame, restored.String())
+	}
+}
@@ -0,0 +1,572 @@
+package emulator
+
+import (
+	"fmt"
+	"math/bits"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CPUModel selects the processor whose instruction timings are emulated
+type CPUModel uint8
+
+const (
+	Model8086 CPUModel = iota // Intel 8086/8088
+	Model186                  // Intel 80186/80188
+	Model286                  // Intel 80286
+	Model386                  // Intel 80386
+	Model486                  // Intel 80486
+	modelCount
+)
+
+// defaultClockHz is the clock each model runs at when no speed is set: the
+// original IBM PC, the Tandy 2000, the IBM PC/AT Model 339, the Compaq
+// Deskpro 386/25 and a typical 486DX
+var defaultClockHz = [modelCount]uint64{4772727, 8000000, 8000000, 25000000, 33000000}
+
+var modelNames = [modelCount]string{"8086", "186", "286", "386", "486"}
+
+// String returns the model's name as accepted by ParseCPUModel
+func (m CPUModel) String() string {
+	if m < modelCount {
+		return modelNames[m]
+	}
+	return fmt.Sprintf("CPUModel(%d)", uint8(m))
+}
+
+// ParseCPUModel parses a CPU model name such as "8086", "186", "386" or "80486"
+func ParseCPUModel(name string) (CPUModel, error) {
+	switch strings.TrimPrefix(strings.TrimPrefix(strings.ToLower(name), "i"), "80") {
+	case "86", "88":
+		return Model8086, nil
+	case "186", "188":
+		return Model186, nil
+	case "286":
+		return Model286, nil
+	case "386":
+		return Model386, nil
+	case "486":
+		return Model486, nil
+	}
+	return 0, fmt.Errorf("unknown CPU model %q (expected 8086, 186, 286, 386 or 486)", name)
+}
+
+// instTiming is the cost of an instruction in clock cycles
+type instTiming struct {
+	reg       uint16 // Register and immediate operands; a taken jump
+	mem       uint16 // Memory destination, or memory operand of a one-operand instruction
+	load      uint16 // Memory source with a register destination (0: same as mem)
+	byteReg   uint16 // 8-bit register operand of MUL and DIV (0: same as reg)
+	byteMem   uint16 // 8-bit memory operand of MUL and DIV (0: same as mem)
+	notTaken  uint16 // Conditional jump or LOOP that falls through
+	countBase uint16 // Shift or rotate by a count other than 1
+	perBit    uint16 // Shift or rotate: cycles per bit of the count
+	rep       uint16 // Per iteration under REP
+}
+
+// cycleTable lists the timings of each opcode for the 8086, 186, 286, 386 and 486,
+// taken from the Intel programmer's reference manuals. Where a manual gives
+// a range the typical value is used. 8086 memory timings exclude the
+// effective address calculation, which is added by eaCycles.
+var cycleTable = map[Opcode][modelCount]instTiming{
+	//          8086                       186                         286                        386                        486
+	OpMOV:  {{reg: 2, mem: 9, load: 8}, {reg: 2, mem: 12, load: 9}, {reg: 2, mem: 3, load: 5}, {reg: 2, mem: 2, load: 4}, {reg: 1, mem: 1, load: 1}},
+	OpPUSH: {{reg: 11, mem: 16}, {reg: 10, mem: 16}, {reg: 3, mem: 5}, {reg: 2, mem: 5}, {reg: 1, mem: 4}},
+	OpPOP:  {{reg: 8, mem: 17}, {reg: 10, mem: 20}, {reg: 5, mem: 5}, {reg: 4, mem: 5}, {reg: 4, mem: 6}},
+	OpXCHG: {{reg: 4, mem: 17}, {reg: 4, mem: 17}, {reg: 3, mem: 5}, {reg: 3, mem: 5}, {reg: 3, mem: 5}},
+	OpLEA:  {{reg: 2, mem: 2}, {reg: 6, mem: 6}, {reg: 3, mem: 3}, {reg: 2, mem: 2}, {reg: 1, mem: 1}},
+	OpLDS:  {{mem: 16}, {mem: 18}, {mem: 7}, {mem: 7}, {mem: 6}},
+	OpLES:  {{mem: 16}, {mem: 18}, {mem: 7}, {mem: 7}, {mem: 6}},
+	OpXLAT: {{reg: 11}, {reg: 11}, {reg: 5}, {reg: 5}, {reg: 4}},
+
+	OpADD:  {{reg: 3, mem: 16, load: 9}, {reg: 3, mem: 10, load: 10}, {reg: 2, mem: 7, load: 7}, {reg: 2, mem: 7, load: 6}, {reg: 1, mem: 3, load: 2}},
+	OpADC:  {{reg: 3, mem: 16, load: 9}, {reg: 3, mem: 10, load: 10}, {reg: 2, mem: 7, load: 7}, {reg: 2, mem: 7, load: 6}, {reg: 1, mem: 3, load: 2}},
+	OpSUB:  {{reg: 3, mem: 16, load: 9}, {reg: 3, mem: 10, load: 10}, {reg: 2, mem: 7, load: 7}, {reg: 2, mem: 7, load: 6}, {reg: 1, mem: 3, load: 2}},
+	OpSBB:  {{reg: 3, mem: 16, load: 9}, {reg: 3, mem: 10, load: 10}, {reg: 2, mem: 7, load: 7}, {reg: 2, mem: 7, load: 6}, {reg: 1, mem: 3, load: 2}},
+	OpAND:  {{reg: 3, mem: 16, load: 9}, {reg: 3, mem: 10, load: 10}, {reg: 2, mem: 7, load: 7}, {reg: 2, mem: 7, load: 6}, {reg: 1, mem: 3, load: 2}},
+	OpOR:   {{reg: 3, mem: 16, load: 9}, {reg: 3, mem: 10, load: 10}, {reg: 2, mem: 7, load: 7}, {reg: 2, mem: 7, load: 6}, {reg: 1, mem: 3, load: 2}},
+	OpXOR:  {{reg: 3, mem: 16, load: 9}, {reg: 3, mem: 10, load: 10}, {reg: 2, mem: 7, load: 7}, {reg: 2, mem: 7, load: 6}, {reg: 1, mem: 3, load: 2}},
+	OpCMP:  {{reg: 3, mem: 9}, {reg: 3, mem: 10}, {reg: 2, mem: 7, load: 6}, {reg: 2, mem: 5, load: 6}, {reg: 1, mem: 2}},
+	OpTEST: {{reg: 3, mem: 9}, {reg: 3, mem: 10}, {reg: 2, mem: 6}, {reg: 2, mem: 5}, {reg: 1, mem: 2}},
+	OpINC:  {{reg: 3, mem: 15}, {reg: 3, mem: 15}, {reg: 2, mem: 7}, {reg: 2, mem: 6}, {reg: 1, mem: 3}},
+	OpDEC:  {{reg: 3, mem: 15}, {reg: 3, mem: 15}, {reg: 2, mem: 7}, {reg: 2, mem: 6}, {reg: 1, mem: 3}},
+	OpNEG:  {{reg: 3, mem: 16}, {reg: 3, mem: 10}, {reg: 2, mem: 7}, {reg: 2, mem: 6}, {reg: 1, mem: 3}},
+	OpNOT:  {{reg: 3, mem: 16}, {reg: 3, mem: 10}, {reg: 2, mem: 7}, {reg: 2, mem: 6}, {reg: 1, mem: 3}},
+
+	OpMUL:   {{reg: 118, mem: 124, byteReg: 70, byteMem: 76}, {reg: 36, mem: 42, byteReg: 26, byteMem: 32}, {reg: 21, mem: 24, byteReg: 13, byteMem: 16}, {reg: 22, mem: 25, byteReg: 14, byteMem: 17}, {reg: 26, mem: 26, byteReg: 13, byteMem: 13}},
+	OpIMUL:  {{reg: 128, mem: 134, byteReg: 80, byteMem: 86}, {reg: 35, mem: 41, byteReg: 26, byteMem: 32}, {reg: 21, mem: 24, byteReg: 13, byteMem: 16}, {reg: 22, mem: 25, byteReg: 14, byteMem: 17}, {reg: 26, mem: 26, byteReg: 18, byteMem: 18}},
+	OpIMUL2: {{reg: 128, mem: 134}, {reg: 22, mem: 29}, {reg: 21, mem: 24}, {reg: 22, mem: 25}, {reg: 26, mem: 26}},
+	OpIMUL3: {{reg: 128, mem: 134}, {reg: 22, mem: 29}, {reg: 21, mem: 24}, {reg: 22, mem: 25}, {reg: 26, mem: 26}},
+	OpDIV:   {{reg: 144, mem: 150, byteReg: 80, byteMem: 86}, {reg: 38, mem: 44, byteReg: 29, byteMem: 35}, {reg: 22, mem: 25, byteReg: 14, byteMem: 17}, {reg: 22, mem: 25, byteReg: 14, byteMem: 17}, {reg: 24, mem: 24, byteReg: 16, byteMem: 16}},
+	OpIDIV:  {{reg: 165, mem: 171, byteReg: 101, byteMem: 107}, {reg: 57, mem: 63, byteReg: 48, byteMem: 54}, {reg: 25, mem: 28, byteReg: 17, byteMem: 20}, {reg: 27, mem: 30, byteReg: 19, byteMem: 22}, {reg: 27, mem: 28, byteReg: 19, byteMem: 20}},
+
+	OpSHL: {{reg: 2, mem: 15, countBase: 6, perBit: 4}, {reg: 2, mem: 15, countBase: 3, perBit: 1}, {reg: 2, mem: 7, countBase: 3, perBit: 1}, {reg: 3, mem: 7}, {reg: 3, mem: 4}},
+	OpSHR: {{reg: 2, mem: 15, countBase: 6, perBit: 4}, {reg: 2, mem: 15, countBase: 3, perBit: 1}, {reg: 2, mem: 7, countBase: 3, perBit: 1}, {reg: 3, mem: 7}, {reg: 3, mem: 4}},
+	OpSAL: {{reg: 2, mem: 15, countBase: 6, perBit: 4}, {reg: 2, mem: 15, countBase: 3, perBit: 1}, {reg: 2, mem: 7, countBase: 3, perBit: 1}, {reg: 3, mem: 7}, {reg: 3, mem: 4}},
+	OpSAR: {{reg: 2, mem: 15, countBase: 6, perBit: 4}, {reg: 2, mem: 15, countBase: 3, perBit: 1}, {reg: 2, mem: 7, countBase: 3, perBit: 1}, {reg: 3, mem: 7}, {reg: 3, mem: 4}},
+	OpROL: {{reg: 2, mem: 15, countBase: 6, perBit: 4}, {reg: 2, mem: 15, countBase: 3, perBit: 1}, {reg: 2, mem: 7, countBase: 3, perBit: 1}, {reg: 3, mem: 7}, {reg: 3, mem: 4}},
+	OpROR: {{reg: 2, mem: 15, countBase: 6, perBit: 4}, {reg: 2, mem: 15, countBase: 3, perBit: 1}, {reg: 2, mem: 7, countBase: 3, perBit: 1}, {reg: 3, mem: 7}, {reg: 3, mem: 4}},
+	OpRCL: {{reg: 2, mem: 15, countBase: 6, perBit: 4}, {reg: 2, mem: 15, countBase: 3, perBit: 1}, {reg: 2, mem: 7, countBase: 3, perBit: 1}, {reg: 9, mem: 10}, {reg: 3, mem: 4, countBase: 6}},
+	OpRCR: {{reg: 2, mem: 15, countBase: 6, perBit: 4}, {reg: 2, mem: 15, countBase: 3, perBit: 1}, {reg: 2, mem: 7, countBase: 3, perBit: 1}, {reg: 9, mem: 10}, {reg: 3, mem: 4, countBase: 6}},
+
+	OpJMP:    {{reg: 15, mem: 18}, {reg: 14, mem: 17}, {reg: 7, mem: 11}, {reg: 7, mem: 10}, {reg: 3, mem: 5}},
+	OpJMPF:   {{reg: 15, mem: 24}, {reg: 14, mem: 26}, {reg: 11, mem: 15}, {reg: 12, mem: 17}, {reg: 17, mem: 13}},
+	OpCALL:   {{reg: 19, mem: 21}, {reg: 15, mem: 19}, {reg: 7, mem: 11}, {reg: 7, mem: 10}, {reg: 3, mem: 5}},
+	OpCALLF:  {{reg: 28, mem: 37}, {reg: 23, mem: 38}, {reg: 13, mem: 16}, {reg: 17, mem: 22}, {reg: 18, mem: 17}},
+	OpRET:    {{reg: 16}, {reg: 16}, {reg: 11}, {reg: 10}, {reg: 5}},
+	OpRETF:   {{reg: 26}, {reg: 22}, {reg: 15}, {reg: 18}, {reg: 13}},
+	OpJE:     {{reg: 16, notTaken: 4}, {reg: 13, notTaken: 4}, {reg: 7, notTaken: 3}, {reg: 7, notTaken: 3}, {reg: 3, notTaken: 1}},
+	OpJNE:    {{reg: 16, notTaken: 4}, {reg: 13, notTaken: 4}, {reg: 7, notTaken: 3}, {reg: 7, notTaken: 3}, {reg: 3, notTaken: 1}},
+	OpJG:     {{reg: 16, notTaken: 4}, {reg: 13, notTaken: 4}, {reg: 7, notTaken: 3}, {reg: 7, notTaken: 3}, {reg: 3, notTaken: 1}},
+	OpJGE:    {{reg: 16, notTaken: 4}, {reg: 13, notTaken: 4}, {reg: 7, notTaken: 3}, {reg: 7, notTaken: 3}, {reg: 3, notTaken: 1}},
+	OpJL:     {{reg: 16, notTaken: 4}, {reg: 13, notTaken: 4}, {reg: 7, notTaken: 3}, {reg: 7, notTaken: 3}, {reg: 3, notTaken: 1}},
+	OpJLE:    {{reg: 16, notTaken: 4}, {reg: 13, notTaken: 4}, {reg: 7, notTaken: 3}, {reg: 7, notTaken: 3}, {reg: 3, notTaken: 1}},
+	OpJA:     {{reg: 16, notTaken: 4}, {reg: 13, notTaken: 4}, {reg: 7, notTaken: 3}, {reg: 7, notTaken: 3}, {reg: 3, notTaken: 1}},
+	OpJAE:    {{reg: 16, notTaken: 4}, {reg: 13, notTaken: 4}, {reg: 7, notTaken: 3}, {reg: 7, notTaken: 3}, {reg: 3, notTaken: 1}},
+	OpJB:     {{reg: 16, notTaken: 4}, {reg: 13, notTaken: 4}, {reg: 7, notTaken: 3}, {reg: 7, notTaken: 3}, {reg: 3, notTaken: 1}},
+	OpJBE:    {{reg: 16, notTaken: 4}, {reg: 13, notTaken: 4}, {reg: 7, notTaken: 3}, {reg: 7, notTaken: 3}, {reg: 3, notTaken: 1}},
+	OpJO:     {{reg: 16, notTaken: 4}, {reg: 13, notTaken: 4}, {reg: 7, notTaken: 3}, {reg: 7, notTaken: 3}, {reg: 3, notTaken: 1}},
+	OpJNO:    {{reg: 16, notTaken: 4}, {reg: 13, notTaken: 4}, {reg: 7, notTaken: 3}, {reg: 7, notTaken: 3}, {reg: 3, notTaken: 1}},
+	OpJS:     {{reg: 16, notTaken: 4}, {reg: 13, notTaken: 4}, {reg: 7, notTaken: 3}, {reg: 7, notTaken: 3}, {reg: 3, notTaken: 1}},
+	OpJNS:    {{reg: 16, notTaken: 4}, {reg: 13, notTaken: 4}, {reg: 7, notTaken: 3}, {reg: 7, notTaken: 3}, {reg: 3, notTaken: 1}},
+	OpJP:     {{reg: 16, notTaken: 4}, {reg: 13, notTaken: 4}, {reg: 7, notTaken: 3}, {reg: 7, notTaken: 3}, {reg: 3, notTaken: 1}},
+	OpJNP:    {{reg: 16, notTaken: 4}, {reg: 13, notTaken: 4}, {reg: 7, notTaken: 3}, {reg: 7, notTaken: 3}, {reg: 3, notTaken: 1}},
+	OpJCXZ:   {{reg: 18, notTaken: 6}, {reg: 15, notTaken: 5}, {reg: 8, notTaken: 4}, {reg: 9, notTaken: 5}, {reg: 8, notTaken: 5}},
+	OpLOOP:   {{reg: 17, notTaken: 5}, {reg: 15, notTaken: 5}, {reg: 8, notTaken: 4}, {reg: 11, notTaken: 5}, {reg: 7, notTaken: 6}},
+	OpLOOPZ:  {{reg: 18, notTaken: 6}, {reg: 16, notTaken: 6}, {reg: 8, notTaken: 4}, {reg: 11, notTaken: 5}, {reg: 9, notTaken: 6}},
+	OpLOOPNZ: {{reg: 19, notTaken: 5}, {reg: 16, notTaken: 5}, {reg: 8, notTaken: 4}, {reg: 11, notTaken: 5}, {reg: 9, notTaken: 6}},
+	OpINT:    {{reg: 51}, {reg: 47}, {reg: 23}, {reg: 37}, {reg: 30}},
+	OpINTO:   {{reg: 53, notTaken: 4}, {reg: 48, notTaken: 4}, {reg: 24, notTaken: 3}, {reg: 35, notTaken: 3}, {reg: 28, notTaken: 3}},
+	OpIRET:   {{reg: 24}, {reg: 28}, {reg: 17}, {reg: 22}, {reg: 15}},
+
+	OpNOP: {{reg: 3}, {reg: 3}, {reg: 3}, {reg: 3}, {reg: 1}},
+	OpHLT: {{reg: 2}, {reg: 2}, {reg: 2}, {reg: 5}, {reg: 4}},
+	OpIN:  {{reg: 10}, {reg: 10}, {reg: 5}, {reg: 12}, {reg: 14}},
+	OpOUT: {{reg: 10}, {reg: 9}, {reg: 3}, {reg: 10}, {reg: 16}},
+
+	OpMOVSB: {{reg: 18, rep: 17}, {reg: 9, rep: 8}, {reg: 5, rep: 4}, {reg: 7, rep: 4}, {reg: 7, rep: 3}},
+	OpMOVSW: {{reg: 18, rep: 17}, {reg: 9, rep: 8}, {reg: 5, rep: 4}, {reg: 7, rep: 4}, {reg: 7, rep: 3}},
+	OpSTOSB: {{reg: 11, rep: 10}, {reg: 10, rep: 9}, {reg: 3, rep: 3}, {reg: 4, rep: 5}, {reg: 5, rep: 4}},
+	OpSTOSW: {{reg: 11, rep: 10}, {reg: 10, rep: 9}, {reg: 3, rep: 3}, {reg: 4, rep: 5}, {reg: 5, rep: 4}},
+	OpLODSB: {{reg: 12, rep: 13}, {reg: 10, rep: 11}, {reg: 5, rep: 4}, {reg: 5, rep: 5}, {reg: 5, rep: 4}},
+	OpLODSW: {{reg: 12, rep: 13}, {reg: 10, rep: 11}, {reg: 5, rep: 4}, {reg: 5, rep: 5}, {reg: 5, rep: 4}},
+	OpCMPSB: {{reg: 22, rep: 22}, {reg: 22, rep: 22}, {reg: 8, rep: 9}, {reg: 10, rep: 9}, {reg: 8, rep: 7}},
+	OpCMPSW: {{reg: 22, rep: 22}, {reg: 22, rep: 22}, {reg: 8, rep: 9}, {reg: 10, rep: 9}, {reg: 8, rep: 7}},
+	OpSCASB: {{reg: 15, rep: 15}, {reg: 15, rep: 15}, {reg: 7, rep: 8}, {reg: 7, rep: 8}, {reg: 6, rep: 5}},
+	OpSCASW: {{reg: 15, rep: 15}, {reg: 15, rep: 15}, {reg: 7, rep: 8}, {reg: 7, rep: 8}, {reg: 6, rep: 5}},
+
+	// Instructions added by the 80186, which the 8086 lacks
+	OpPUSHA: {{}, {reg: 36}, {reg: 17}, {reg: 18}, {reg: 11}},
+	OpPOPA:  {{}, {reg: 51}, {reg: 19}, {reg: 24}, {reg: 9}},
+	OpENTER: {{}, {reg: 15}, {reg: 11}, {reg: 10}, {reg: 14}},
+	OpLEAVE: {{}, {reg: 8}, {reg: 5}, {reg: 4}, {reg: 5}},
+	OpBOUND: {{}, {mem: 33}, {mem: 13}, {mem: 10}, {mem: 7}},
+	OpINSB:  {{}, {reg: 14, rep: 8}, {reg: 5, rep: 4}, {reg: 15, rep: 6}, {reg: 17, rep: 8}},
+	OpINSW:  {{}, {reg: 14, rep: 8}, {reg: 5, rep: 4}, {reg: 15, rep: 6}, {reg: 17, rep: 8}},
+	OpOUTSB: {{}, {reg: 14, rep: 8}, {reg: 5, rep: 4}, {reg: 14, rep: 5}, {reg: 17, rep: 5}},
+	OpOUTSW: {{}, {reg: 14, rep: 8}, {reg: 5, rep: 4}, {reg: 14, rep: 5}, {reg: 17, rep: 5}},
+
+	// Instructions added by the 80386
+	OpMOVZXB: {{}, {}, {}, {reg: 3, mem: 6}, {reg: 3, mem: 3}},
+	OpMOVZXW: {{}, {}, {}, {reg: 3, mem: 6}, {reg: 3, mem: 3}},
+	OpMOVSXB: {{}, {}, {}, {reg: 3, mem: 6}, {reg: 3, mem: 3}},
+	OpMOVSXW: {{}, {}, {}, {reg: 3, mem: 6}, {reg: 3, mem: 3}},
+	OpSHLD:   {{}, {}, {}, {reg: 3, mem: 7}, {reg: 2, mem: 3}},
+	OpSHRD:   {{}, {}, {}, {reg: 3, mem: 7}, {reg: 2, mem: 3}},
+	OpBT:     {{}, {}, {}, {reg: 3, mem: 6}, {reg: 3, mem: 3}},
+	OpBTS:    {{}, {}, {}, {reg: 6, mem: 8}, {reg: 6, mem: 8}},
+	OpBTR:    {{}, {}, {}, {reg: 6, mem: 8}, {reg: 6, mem: 8}},
+	OpBTC:    {{}, {}, {}, {reg: 6, mem: 8}, {reg: 6, mem: 8}},
+	OpBSF:    {{}, {}, {}, {reg: 20, mem: 23}, {reg: 20, mem: 20}},
+	OpBSR:    {{}, {}, {}, {reg: 20, mem: 23}, {reg: 20, mem: 20}},
+	OpSETcc:  {{}, {}, {}, {reg: 4, mem: 5}, {reg: 4, mem: 3}},
+	OpCWDE:   {{}, {}, {}, {reg: 3}, {reg: 3}},
+	OpCDQ:    {{}, {}, {}, {reg: 2}, {reg: 3}},
+
+	OpPUSHF: {{reg: 10}, {reg: 9}, {reg: 3}, {reg: 4}, {reg: 4}},
+	OpPOPF:  {{reg: 8}, {reg: 8}, {reg: 5}, {reg: 5}, {reg: 9}},
+	OpLAHF:  {{reg: 4}, {reg: 2}, {reg: 2}, {reg: 2}, {reg: 3}},
+	OpSAHF:  {{reg: 4}, {reg: 3}, {reg: 2}, {reg: 3}, {reg: 2}},
+	OpCLC:   {{reg: 2}, {reg: 2}, {reg: 2}, {reg: 2}, {reg: 2}},
+	OpSTC:   {{reg: 2}, {reg: 2}, {reg: 2}, {reg: 2}, {reg: 2}},
+	OpCMC:   {{reg: 2}, {reg: 2}, {reg: 2}, {reg: 2}, {reg: 2}},
+	OpCLD:   {{reg: 2}, {reg: 2}, {reg: 2}, {reg: 2}, {reg: 2}},
+	OpSTD:   {{reg: 2}, {reg: 2}, {reg: 2}, {reg: 2}, {reg: 2}},
+	OpCLI:   {{reg: 2}, {reg: 2}, {reg: 3}, {reg: 3}, {reg: 5}},
+	OpSTI:   {{reg: 2}, {reg: 2}, {reg: 2}, {reg: 3}, {reg: 5}},
+
+	OpCBW: {{reg: 2}, {reg: 2}, {reg: 2}, {reg: 3}, {reg: 3}},
+	OpCWD: {{reg: 5}, {reg: 4}, {reg: 2}, {reg: 2}, {reg: 3}},
+	OpDAA: {{reg: 4}, {reg: 4}, {reg: 3}, {reg: 4}, {reg: 2}},
+	OpDAS: {{reg: 4}, {reg: 4}, {reg: 3}, {reg: 4}, {reg: 2}},
+	OpAAA: {{reg: 4}, {reg: 8}, {reg: 3}, {reg: 4}, {reg: 3}},
+	OpAAS: {{reg: 4}, {reg: 7}, {reg: 3}, {reg: 4}, {reg: 3}},
+	OpAAM: {{reg: 83}, {reg: 19}, {reg: 16}, {reg: 17}, {reg: 15}},
+	OpAAD: {{reg: 60}, {reg: 15}, {reg: 14}, {reg: 19}, {reg: 14}},
+}
+
+// fpuCycleTable lists the timings of the x87 operations for the 8087 (which
+// goes with the 8086 and 186), 80287, 80387 and the 486's FPU. The CPU is
+// costed as though it waited for each result.
+var fpuCycleTable = map[FPUOp][modelCount]instTiming{
+	// 8086 and 186 with an 8087, 286 with an 80287, 386 with an 80387, 486
+	OpFLD:    {{reg: 20, mem: 46}, {reg: 20, mem: 46}, {reg: 20, mem: 46}, {reg: 14, mem: 20}, {reg: 4, mem: 3}},
+	OpFST:    {{reg: 18, mem: 90}, {reg: 18, mem: 90}, {reg: 18, mem: 90}, {reg: 11, mem: 44}, {reg: 3, mem: 7}},
+	OpFSTP:   {{reg: 20, mem: 95}, {reg: 20, mem: 95}, {reg: 20, mem: 95}, {reg: 12, mem: 44}, {reg: 3, mem: 7}},
+	OpFILD:   {{mem: 56}, {mem: 56}, {mem: 56}, {mem: 53}, {mem: 14}},
+	OpFIST:   {{mem: 86}, {mem: 86}, {mem: 86}, {mem: 82}, {mem: 33}},
+	OpFISTP:  {{mem: 90}, {mem: 90}, {mem: 90}, {mem: 82}, {mem: 33}},
+	OpFXCH:   {{reg: 12}, {reg: 12}, {reg: 12}, {reg: 18}, {reg: 4}},
+	OpFLDZ:   {{reg: 14}, {reg: 14}, {reg: 14}, {reg: 20}, {reg: 4}},
+	OpFLD1:   {{reg: 18}, {reg: 18}, {reg: 18}, {reg: 24}, {reg: 4}},
+	OpFLDPI:  {{reg: 19}, {reg: 19}, {reg: 19}, {reg: 40}, {reg: 8}},
+	OpFLDL2E: {{reg: 18}, {reg: 18}, {reg: 18}, {reg: 40}, {reg: 8}},
+	OpFLDL2T: {{reg: 19}, {reg: 19}, {reg: 19}, {reg: 40}, {reg: 8}},
+	OpFLDLG2: {{reg: 21}, {reg: 21}, {reg: 21}, {reg: 41}, {reg: 8}},
+	OpFLDLN2: {{reg: 20}, {reg: 20}, {reg: 20}, {reg: 41}, {reg: 8}},
+
+	OpFADD:   {{reg: 85, mem: 105}, {reg: 85, mem: 105}, {reg: 85, mem: 105}, {reg: 23, mem: 27}, {reg: 10, mem: 10}},
+	OpFADDP:  {{reg: 90}, {reg: 90}, {reg: 90}, {reg: 23}, {reg: 10}},
+	OpFSUB:   {{reg: 85, mem: 105}, {reg: 85, mem: 105}, {reg: 85, mem: 105}, {reg: 26, mem: 27}, {reg: 10, mem: 10}},
+	OpFSUBP:  {{reg: 90}, {reg: 90}, {reg: 90}, {reg: 26}, {reg: 10}},
+	OpFSUBR:  {{reg: 87, mem: 105}, {reg: 87, mem: 105}, {reg: 87, mem: 105}, {reg: 26, mem: 27}, {reg: 10, mem: 10}},
+	OpFSUBRP: {{reg: 90}, {reg: 90}, {reg: 90}, {reg: 26}, {reg: 10}},
+	OpFMUL:   {{reg: 130, mem: 130}, {reg: 130, mem: 130}, {reg: 130, mem: 130}, {reg: 46, mem: 32}, {reg: 16, mem: 14}},
+	OpFMULP:  {{reg: 134}, {reg: 134}, {reg: 134}, {reg: 46}, {reg: 16}},
+	OpFDIV:   {{reg: 198, mem: 220}, {reg: 198, mem: 220}, {reg: 198, mem: 220}, {reg: 88, mem: 89}, {reg: 73, mem: 73}},
+	OpFDIVP:  {{reg: 202}, {reg: 202}, {reg: 202}, {reg: 91}, {reg: 73}},
+	OpFDIVR:  {{reg: 199, mem: 221}, {reg: 199, mem: 221}, {reg: 199, mem: 221}, {reg: 88, mem: 89}, {reg: 73, mem: 73}},
+	OpFDIVRP: {{reg: 203}, {reg: 203}, {reg: 203}, {reg: 91}, {reg: 73}},
+	OpFIADD:  {{mem: 120}, {mem: 120}, {mem: 120}, {mem: 57}, {mem: 22}},
+	OpFISUB:  {{mem: 120}, {mem: 120}, {mem: 120}, {mem: 57}, {mem: 22}},
+	OpFISUBR: {{mem: 120}, {mem: 120}, {mem: 120}, {mem: 57}, {mem: 22}},
+	OpFIMUL:  {{mem: 130}, {mem: 130}, {mem: 130}, {mem: 61}, {mem: 23}},
+	OpFIDIV:  {{mem: 230}, {mem: 230}, {mem: 230}, {mem: 120}, {mem: 73}},
+	OpFIDIVR: {{mem: 230}, {mem: 230}, {mem: 230}, {mem: 120}, {mem: 73}},
+
+	OpFSQRT:   {{reg: 183}, {reg: 183}, {reg: 183}, {reg: 122}, {reg: 85}},
+	OpFABS:    {{reg: 14}, {reg: 14}, {reg: 14}, {reg: 22}, {reg: 3}},
+	OpFCHS:    {{reg: 15}, {reg: 15}, {reg: 15}, {reg: 24}, {reg: 6}},
+	OpFRNDINT: {{reg: 45}, {reg: 45}, {reg: 45}, {reg: 66}, {reg: 29}},
+	OpFSCALE:  {{reg: 35}, {reg: 35}, {reg: 35}, {reg: 67}, {reg: 31}},
+	OpFPREM:   {{reg: 125}, {reg: 125}, {reg: 125}, {reg: 74}, {reg: 84}},
+	OpFPREM1:  {{}, {}, {}, {reg: 95}, {reg: 94}},
+	OpFXTRACT: {{reg: 50}, {reg: 50}, {reg: 50}, {reg: 70}, {reg: 19}},
+
+	OpFCOM:    {{reg: 45, mem: 70}, {reg: 45, mem: 70}, {reg: 45, mem: 70}, {reg: 24, mem: 26}, {reg: 4, mem: 4}},
+	OpFCOMP:   {{reg: 47, mem: 72}, {reg: 47, mem: 72}, {reg: 47, mem: 72}, {reg: 26, mem: 26}, {reg: 4, mem: 4}},
+	OpFCOMPP:  {{reg: 50}, {reg: 50}, {reg: 50}, {reg: 26}, {reg: 5}},
+	OpFICOM:   {{mem: 80}, {mem: 80}, {mem: 80}, {mem: 71}, {mem: 16}},
+	OpFICOMP:  {{mem: 82}, {mem: 82}, {mem: 82}, {mem: 71}, {mem: 16}},
+	OpFUCOM:   {{}, {}, {}, {reg: 24}, {reg: 4}},
+	OpFUCOMP:  {{}, {}, {}, {reg: 26}, {reg: 4}},
+	OpFUCOMPP: {{}, {}, {}, {reg: 26}, {reg: 5}},
+	OpFTST:    {{reg: 42}, {reg: 42}, {reg: 42}, {reg: 28}, {reg: 4}},
+	OpFXAM:    {{reg: 17}, {reg: 17}, {reg: 17}, {reg: 30}, {reg: 8}},
+
+	OpFSIN:    {{}, {}, {}, {reg: 300}, {reg: 257}},
+	OpFCOS:    {{}, {}, {}, {reg: 300}, {reg: 257}},
+	OpFSINCOS: {{}, {}, {}, {reg: 350}, {reg: 292}},
+	OpFPTAN:   {{reg: 450}, {reg: 450}, {reg: 450}, {reg: 300}, {reg: 244}},
+	OpFPATAN:  {{reg: 650}, {reg: 650}, {reg: 650}, {reg: 400}, {reg: 289}},
+	OpF2XM1:   {{reg: 500}, {reg: 500}, {reg: 500}, {reg: 300}, {reg: 242}},
+	OpFYL2X:   {{reg: 950}, {reg: 950}, {reg: 950}, {reg: 200}, {reg: 311}},
+	OpFYL2XP1: {{reg: 850}, {reg: 850}, {reg: 850}, {reg: 260}, {reg: 313}},
+
+	OpFINIT:   {{reg: 5}, {reg: 5}, {reg: 5}, {reg: 33}, {reg: 17}},
+	OpFCLEX:   {{reg: 5}, {reg: 5}, {reg: 5}, {reg: 11}, {reg: 7}},
+	OpFLDCW:   {{mem: 10}, {mem: 10}, {mem: 10}, {mem: 19}, {mem: 4}},
+	OpFSTCW:   {{mem: 15}, {mem: 15}, {mem: 15}, {mem: 15}, {mem: 3}},
+	OpFSTSW:   {{mem: 15}, {mem: 15}, {reg: 12, mem: 15}, {reg: 13, mem: 15}, {reg: 3, mem: 3}},
+	OpFWAIT:   {{reg: 4}, {reg: 4}, {reg: 3}, {reg: 6}, {reg: 1}},
+	OpFNOP:    {{reg: 13}, {reg: 13}, {reg: 13}, {reg: 12}, {reg: 3}},
+	OpFFREE:   {{reg: 11}, {reg: 11}, {reg: 11}, {reg: 18}, {reg: 3}},
+	OpFINCSTP: {{reg: 9}, {reg: 9}, {reg: 9}, {reg: 21}, {reg: 3}},
+	OpFDECSTP: {{reg: 9}, {reg: 9}, {reg: 9}, {reg: 22}, {reg: 3}},
+}
+
+// defaultTiming is used for opcodes missing from cycleTable: the cost of a
+// simple ALU instruction
+var defaultTiming = [modelCount]instTiming{
+	{reg: 3, mem: 16, load: 9}, {reg: 3, mem: 10}, {reg: 2, mem: 7}, {reg: 2, mem: 7, load: 6}, {reg: 1, mem: 3},
+}
+
+// repSetup is the fixed cost of a REP prefix before the first iteration
+var repSetup = [modelCount]uint64{9, 6, 5, 5, 7}
+
+// timings holds cycleTable indexed by model and opcode, and fpuTimings
+// fpuCycleTable indexed by model and x87 operation
+var (
+	timings    [modelCount][256]instTiming
+	fpuTimings [modelCount][256]instTiming
+)
+
+func init() {
+	for m := range timings {
+		for op := range timings[m] {
+			timings[m][op] = defaultTiming[m]
+		}
+	}
+	for op, t := range cycleTable {
+		for m := range t {
+			timings[m][op] = t[m]
+		}
+	}
+	for op, t := range fpuCycleTable {
+		for m := range t {
+			fpuTimings[m][op] = t[m]
+		}
+	}
+}
+
+// timing returns the timing entry of an opcode for the CPU's model
+func (c *CPU) timing(op Opcode) *instTiming {
+	return &timings[c.Model][op]
+}
+
+// instructionCycles returns the cost of an instruction that is about to
+// execute, counting a jump as taken
+func (c *CPU) instructionCycles(inst Instruction) uint64 {
+	t := c.timing(inst.Opcode)
+	if inst.Opcode == OpFPU {
+		t = &fpuTimings[c.Model][inst.FPU]
+	}
+
+	op := inst.Dest
+	if op.Type == OpTypeNone {
+		op = inst.Src
+	}
+	byteOp := op.is8Bit() && t.byteReg != 0
+
+	var cycles uint16
+	switch {
+	case inst.Dest.isMemory() || (inst.Dest.Type == OpTypeNone && inst.Src.isMemory()):
+		cycles = t.mem
+		if byteOp {
+			cycles = t.byteMem
+		}
+	case inst.Src.isMemory():
+		cycles = t.load
+		if cycles == 0 {
+			cycles = t.mem
+		}
+	default:
+		cycles = t.reg
+		if byteOp {
+			cycles = t.byteReg
+		}
+	}
+	total := uint64(cycles)
+
+	// Shifts and rotates by CL or an immediate count pay per bit
+	if t.countBase != 0 || t.perBit != 0 {
+		count := uint64(1)
+		switch inst.Src.Type {
+		case OpTypeImm8:
+			count = uint64(inst.Src.Imm8)
+		case OpTypeReg8:
+			count = uint64(inst.Src.reg8())
+		}
+		if count != 1 {
+			total += uint64(t.countBase) + uint64(t.perBit)*count
+		}
+	}
+
+	if c.Model == Model8086 {
+		if inst.Dest.isMemory() {
+			total += eaCycles(inst.Dest)
+		} else if inst.Src.isMemory() {
+			total += eaCycles(inst.Src)
+		}
+	}
+	return total
+}
+
+// eaCycles returns the 8086's effective address calculation time, plus
+// two cycles for a segment override
+func eaCycles(op Operand) uint64 {
+	cycles := uint64(5) // [BX], [SI], [DI] or [BP]
+	switch op.Type {
+	case OpTypeMem:
+		cycles = 6 // Direct address
+	case OpTypeMemIndexed:
+		cycles = 8 // Base plus index
+	}
+	if op.SegOverride {
+		cycles += 2
+	}
+	return cycles
+}
+
+// repCycles returns the cost of a REP-prefixed string instruction that
+// runs count iterations
+func (c *CPU) repCycles(op Opcode, count uint16) uint64 {
+	return repSetup[c.Model] + uint64(c.timing(op).rep)*uint64(count)
+}
+
+// ClockRate returns the emulated clock in Hz: ClockHz, or the model's
+// standard clock when execution is not throttled
+func (c *CPU) ClockRate() uint64 {
+	if c.ClockHz != 0 {
+		return c.ClockHz
+	}
+	return defaultClockHz[c.Model]
+}
+
+// cyclesToDevice converts a cycle count into ticks of a device clock
+func (c *CPU) cyclesToDevice(cycles, hz uint64) uint64 {
+	hi, lo := bits.Mul64(cycles, hz)
+	ticks, _ := bits.Div64(hi, lo, c.ClockRate())
+	return ticks
+}
+
+// deviceToCycles converts ticks of a device clock into the first cycle
+// count at which they have elapsed
+func (c *CPU) deviceToCycles(ticks, hz uint64) uint64 {
+	hi, lo := bits.Mul64(ticks, c.ClockRate())
+	lo, carry := bits.Add64(lo, hz-1, 0)
+	cycles, _ := bits.Div64(hi+carry, lo, hz)
+	return cycles
+}
+
+const (
+	// throttleQuantum is how much emulated time runs between throttle checks
+	throttleQuantum = time.Millisecond
+
+	// maxThrottleLag is how far the host may fall behind the emulated clock
+	// before the throttle gives up on the lost time
+	maxThrottleLag = 100 * time.Millisecond
+)
+
+// throttle sleeps while the emulated clock runs ahead of the host clock, so
+// the program runs at ClockHz. A host that falls behind by more than
+// maxThrottleLag does not make the program run fast to catch up.
+func (c *CPU) throttle() {
+	if c.ClockHz == 0 || c.Cycles < c.throttleNext {
+		return
+	}
+	c.throttleNext = c.Cycles + c.ClockHz/uint64(time.Second/throttleQuantum)
+
+	now := time.Now()
+	if c.throttleStart.IsZero() {
+		c.throttleStart, c.throttleBase = now, c.Cycles
+		return
+	}
+	emulated := time.Duration(float64(c.Cycles-c.throttleBase) / float64(c.ClockHz) * float64(time.Second))
+	ahead := emulated - now.Sub(c.throttleStart)
+	switch {
+	case ahead > 0:
+		select {
+		case <-c.stopChan:
+		case <-time.After(ahead):
+		}
+	case ahead < -maxThrottleLag:
+		c.throttleStart, c.throttleBase = now, c.Cycles
+	}
+}
+
+// ParseClockSpeed parses a clock speed such as "4.77", "4.77MHz", "33 MHz",
+// "8000kHz" or "4772727Hz". A bare number is in MHz. "max" or "0" means
+// unthrottled and returns 0.
+func ParseClockSpeed(s string) (uint64, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "max" || s == "0" {
+		return 0, nil
+	}
+	scale := 1e6
+	for _, unit := range []struct {
+		suffix string
+		scale  float64
+	}{{"mhz", 1e6}, {"khz", 1e3}, {"hz", 1}} {
+		if strings.HasSuffix(s, unit.suffix) {
+			s, scale = strings.TrimSpace(strings.TrimSuffix(s, unit.suffix)), unit.scale
+			break
+		}
+	}
+	value, err := strconv.ParseFloat(s, 64)
+	if err != nil || value <= 0 {
+		return 0, fmt.Errorf("invalid clock speed %q", s)
+	}
+	hz := uint64(value*scale + 0.5)
+	if hz == 0 {
+		return 0, fmt.Errorf("clock speed %q is below 1 Hz", s)
+	}
+	return hz, nil
+}
+
+// VGA timing of the 70 Hz display used by mode 13h: a frame has 449
+// scanlines, 400 of them displayed, with the vertical retrace pulse on lines
+// 412-413. Each line is blanked for the last fifth of its time.
+const (
+	vgaRefreshHz    = 70
+	vgaFrameLines   = 449
+	vgaDisplayLines = 400
+	vgaRetraceStart = 412
+	vgaRetraceLines = 2
+)
+
+// frameCycles returns the cycles in a frame of the 70 Hz display: at least
+// one, so that a clock slower than the refresh rate starts a frame every
+// cycle
+func (c *CPU) frameCycles() uint64 {
+	return max(c.ClockRate()/vgaRefreshHz, 1)
+}
+
+// startFrames starts the frames of the emulated display that the cycle
+// counter has reached since the last one started. Each delivers the keys
+// InputScript presses in it, is recorded by the Rewinder and is passed to
+// FrameCallback; a HLT that skipped over several frames starts them all at
+// once.
+func (c *CPU) startFrames() {
+	frameCycles := c.frameCycles()
+	frame := c.Cycles / frameCycles
+	c.frameEnd = (frame + 1) * frameCycles
+	for c.VideoFrame < frame {
+		c.VideoFrame++
+		c.Memory.LockVGA()
+		c.Memory.frame = c.VideoFrame
+		c.Memory.UnlockVGA()
+		for ; c.scriptNext < len(c.InputScript) && c.InputScript[c.scriptNext].Frame <= c.VideoFrame; c.scriptNext++ {
+			key := c.InputScript[c.scriptNext]
+			c.pressKey(key.Scancode, key.ASCII)
+		}
+		if c.rewinder != nil {
+			c.rewinder.frameStarted()
+		}
+		if c.FrameCallback != nil {
+			c.FrameCallback(c.VideoFrame)
+		}
+	}
+}
+
+// vgaStatus returns Input Status Register 1 (port 3DAh) at the current
+// cycle: bit 3 is set during vertical retrace and bit 0 while the display
+// is blanked
+func (c *CPU) vgaStatus() uint8 {
+	frameCycles := c.frameCycles()
+	pos := (c.Cycles % frameCycles) * vgaFrameLines
+	line, inLine := pos/frameCycles, pos%frameCycles
+
+	var status uint8
+	if line >= vgaDisplayLines || inLine >= frameCycles*4/5 {
+		status |= 0x01
+	}
+	if line >= vgaRetraceStart && line < vgaRetraceStart+vgaRetraceLines {
+		status |= 0x08
+	}
+	return status
+}
+
+// waitRetrace moves the cycle counter forward to the start of the next
+// vertical retrace
+func (c *CPU) waitRetrace() {
+	frameCycles := c.frameCycles()
+	start := (vgaRetraceStart*frameCycles + vgaFrameLines - 1) / vgaFrameLines
+	target := c.Cycles/frameCycles*frameCycles + start
+	if c.Cycles >= target {
+		target += frameCycles
+	}
+	c.skipToCycle(target)
+	c.syncTimer()
+}
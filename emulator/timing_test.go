@@ -0,0 +1,228 @@
+package emulator
+
+import (
+	"testing"
+	"time"
+)
+
+// TestInstructionCycles tests the cycle counts charged for each model
+func TestInstructionCycles(t *testing.T) {
+	tests := []struct {
+		name  string
+		image []byte
+		want  [modelCount]uint64 // 8086, 186, 286, 386, 486
+	}{
+		{
+			"register, memory and multiply",
+			[]byte{
+				0xB8, 0x01, 0x00, // MOV AX, 1
+				0x01, 0xD8, // ADD AX, BX
+				0xF7, 0xE3, // MUL BX
+				0xA1, 0x00, 0x02, // MOV AX, [0200h] (8086: 8 + 6 for the address)
+				0xF4, // HLT
+			},
+			[modelCount]uint64{139, 52, 32, 35, 33},
+		},
+		{
+			"taken and not taken jumps",
+			[]byte{
+				0x31, 0xC0, // 0100: XOR AX, AX
+				0x74, 0x01, // 0102: JZ 0105 (taken)
+				0x90,       // 0104: NOP
+				0x75, 0x01, // 0105: JNZ 0108 (not taken)
+				0x90, // 0107: NOP
+				0xF4, // 0108: HLT
+			},
+			[modelCount]uint64{28, 25, 17, 20, 10},
+		},
+		{
+			"REP STOSB",
+			[]byte{
+				0xB9, 0x0A, 0x00, // MOV CX, 10
+				0xF3, 0xAA, // REP STOSB
+				0xF4, // HLT
+			},
+			[modelCount]uint64{113, 100, 39, 62, 52},
+		},
+		{
+			"shift by CL",
+			[]byte{
+				0xB1, 0x03, // MOV CL, 3
+				0xD3, 0xE0, // SHL AX, CL
+				0xF4, // HLT
+			},
+			[modelCount]uint64{24, 12, 12, 10, 8},
+		},
+	}
+
+	for _, tt := range tests {
+		for model := Model8086; model < modelCount; model++ {
+			cpu := NewCPU()
+			cpu.Model = model
+			if err := cpu.LoadCOM(tt.image); err != nil {
+				t.Fatalf("LoadCOM failed: %v", err)
+			}
+			runUntilIdle(t, cpu)
+			if cpu.Cycles != tt.want[model] {
+				t.Errorf("%s on %s: expected %d cycles, got %d", tt.name, model, tt.want[model], cpu.Cycles)
+			}
+		}
+	}
+}
+
+// TestParseCPUSettings tests parsing of CPU model names and clock speeds
+func TestParseCPUSettings(t *testing.T) {
+	models := map[string]CPUModel{"8086": Model8086, "8088": Model8086, "186": Model186, "80188": Model186, "286": Model286, "80286": Model286, "386": Model386, "80386": Model386, "i486": Model486}
+	for name, want := range models {
+		if got, err := ParseCPUModel(name); err != nil || got != want {
+			t.Errorf("ParseCPUModel(%q): expected %s, got %s (%v)", name, want, got, err)
+		}
+	}
+	if _, err := ParseCPUModel("68000"); err == nil {
+		t.Error("Expected an error for an unknown model")
+	}
+
+	speeds := map[string]uint64{"4.77": 4770000, "4.77MHz": 4770000, "33 MHz": 33000000, "8000kHz": 8000000, "4772727Hz": 4772727, "max": 0}
+	for s, want := range speeds {
+		if got, err := ParseClockSpeed(s); err != nil || got != want {
+			t.Errorf("ParseClockSpeed(%q): expected %d, got %d (%v)", s, want, got, err)
+		}
+	}
+	for _, s := range []string{"fast", "-4MHz", "0.1Hz"} {
+		if _, err := ParseClockSpeed(s); err == nil {
+			t.Errorf("ParseClockSpeed(%q): expected an error", s)
+		}
+	}
+}
+
+// TestTimerFromCycles tests that the PIT runs from the cycle counter and that
+// HLT skips ahead to the next timer interrupt
+func TestTimerFromCycles(t *testing.T) {
+	cpu := NewCPU()
+	if err := cpu.LoadCOM([]byte{
+		0xF4,       // 0100: HLT
+		0xEB, 0xFD, // 0101: JMP 0100
+	}); err != nil {
+		t.Fatalf("LoadCOM failed: %v", err)
+	}
+
+	// The BIOS timer period is 65536 PIT clocks: 262144 cycles at 4.77 MHz
+	period := cpu.deviceToCycles(0x10000, PITFrequency)
+	if period != 262144 {
+		t.Errorf("Expected a timer period of 262144 cycles, got %d", period)
+	}
+
+	for ticks := uint16(1); ticks <= 3; ticks++ {
+		runUntilIdle(t, cpu)
+		if err := cpu.Step(); err != nil { // Idle until the next timer edge
+			t.Fatalf("CPU.Step() failed: %v", err)
+		}
+		if err := cpu.Step(); err != nil { // INT 08h and its return
+			t.Fatalf("CPU.Step() failed: %v", err)
+		}
+		if got := cpu.Memory.ReadWordLinear(biosTickCount); got != ticks {
+			t.Errorf("Expected %d timer ticks, got %d", ticks, got)
+		}
+		if cpu.Cycles < uint64(ticks)*period {
+			t.Errorf("Expected at least %d cycles after %d ticks, got %d", uint64(ticks)*period, ticks, cpu.Cycles)
+		}
+	}
+	if cpu.Cycles > 3*period+1000 {
+		t.Errorf("Expected the CPU to idle in HLT until the third tick, got %d cycles", cpu.Cycles)
+	}
+}
+
+// TestVGARetraceTiming tests port 3DAh timed from the cycle counter
+func TestVGARetraceTiming(t *testing.T) {
+	cpu := NewCPU()
+	cpu.ClockHz = 7000000 // 100000 cycles per 70 Hz frame
+	cpu.FrameSync = false
+
+	statuses := []struct {
+		cycles uint64
+		want   uint8
+	}{
+		{0, 0x00},     // Top of the display
+		{180, 0x01},   // Horizontal blanking at the end of line 0
+		{90000, 0x01}, // Vertical blanking below line 400
+		{91800, 0x09}, // Vertical retrace on line 412
+		{92400, 0x01}, // Retrace over, still blanked
+	}
+	for _, st := range statuses {
+		cpu.Cycles = st.cycles
+		if got := cpu.InByte(0x3DA); got != st.want {
+			t.Errorf("Cycle %d: expected status %02Xh, got %02Xh", st.cycles, st.want, got)
+		}
+	}
+
+	// With FrameSync each read waits for the start of the next retrace
+	cpu.FrameSync = true
+	cpu.Cycles = 1000
+	if got := cpu.InByte(0x3DA); got != 0x09 || cpu.Cycles != 91760 {
+		t.Errorf("Expected the retrace at cycle 91760, got status %02Xh at %d", got, cpu.Cycles)
+	}
+	if cpu.InByte(0x3DA); cpu.Cycles != 191760 {
+		t.Errorf("Expected the next read to wait a frame, got cycle %d", cpu.Cycles)
+	}
+
+	// A clock slower than the refresh rate has a frame every cycle
+	cpu.ClockHz = 50
+	cpu.Cycles = 1000
+	if got := cpu.InByte(0x3DA); got != 0x01 || cpu.Cycles != 1001 {
+		t.Errorf("Expected the read to wait for cycle 1001, got status %02Xh at %d", got, cpu.Cycles)
+	}
+	cpu.FrameSync = false
+	if got := cpu.InByte(0x3DA); got != 0x01 {
+		t.Errorf("Expected a blanked display at 50 Hz, got status %02Xh", got)
+	}
+}
+
+// TestSlowClock tests that a clock slower than the display's refresh rate
+// starts a frame on every cycle
+func TestSlowClock(t *testing.T) {
+	cpu := NewCPU()
+	cpu.ClockHz = 50
+	if err := cpu.LoadCOM([]byte{
+		0x90, // NOP
+		0x90, // NOP
+		0xF4, // HLT
+	}); err != nil {
+		t.Fatalf("LoadCOM failed: %v", err)
+	}
+	stepN(t, cpu, 1)
+	start := cpu.Cycles
+	stepN(t, cpu, 1) // Starts the frames up to the cycle it begins at
+	if cpu.VideoFrame != start {
+		t.Errorf("Expected frame %d, got %d", start, cpu.VideoFrame)
+	}
+}
+
+// TestThrottle tests that ClockHz slows Run down to the emulated clock
+func TestThrottle(t *testing.T) {
+	cpu := NewCPU()
+	cpu.ClockHz = 1000000
+	if err := cpu.LoadCOM([]byte{
+		0xB9, 0xE8, 0x03, // MOV CX, 1000
+		0xE2, 0xFE, // LOOP $ (17 cycles per iteration)
+		0xFA, // CLI
+		0xF4, // HLT
+	}); err != nil {
+		t.Fatalf("LoadCOM failed: %v", err)
+	}
+
+	start := time.Now()
+	cpu.StartTime = start.UnixNano()
+	if err := cpu.Run(); err != nil {
+		t.Fatalf("CPU.Run() failed: %v", err)
+	}
+	elapsed := time.Since(start)
+
+	// About 17000 cycles at 1 MHz take 17 ms
+	if elapsed < 10*time.Millisecond {
+		t.Errorf("Expected the throttle to take at least 10ms, took %v", elapsed)
+	}
+	stats := cpu.GetPerformanceStats(time.Now().UnixNano())
+	if stats.Cycles != cpu.Cycles || stats.Cycles < 16000 || stats.CyclesPerSec <= 0 {
+		t.Errorf("Unexpected performance stats %+v", stats)
+	}
+}
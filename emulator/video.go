@@ -0,0 +1,409 @@
+package emulator
+
+import (
+	"assembly-emulator/font"
+	"image"
+	"image/color"
+)
+
+const (
+	// Colour text memory at B800:0000: character/attribute pairs, eight
+	// pages of 80x25
+	TextMemoryStart = 0xB8000
+	TextMemorySize  = 0x8000
+
+	// Text mode layout, and its resolution with the 8x16 CP437 font
+	TextColumns = 80
+	TextRows    = 25
+	TextWidth   = TextColumns * 8
+	TextHeight  = TextRows * 16
+)
+
+// CRT controller registers (ports 3D4h and 3D5h)
+const (
+	crtcHorizontalEnd = 0x01 // Character clocks shown per line, less one
+	crtcOverflow      = 0x07 // Bits 1 and 6 are bits 8 and 9 of the vertical display end
+	crtcMaxScanLine   = 0x09 // Bits 0-4: scan lines per row, less one; bit 7 doubles them
+	crtcCursorStart   = 0x0A // Bits 0-4: first scan line of the cursor; bit 5 hides it
+	crtcCursorEnd     = 0x0B // Bits 0-4: last scan line of the cursor
+	crtcStartHigh     = 0x0C // Start address: the word of text memory, or byte of the planes, shown top left
+	crtcStartLow      = 0x0D
+	crtcCursorHigh    = 0x0E // Cursor location: the word of text memory it is over
+	crtcCursorLow     = 0x0F
+	crtcProtect       = 0x11 // Bit 7 protects registers 0-7 from writes
+	crtcVerticalEnd   = 0x12 // Scan lines shown, less one (bits 0-7)
+	crtcOffset        = 0x13 // Words of video memory from one row to the next
+	crtcRegisters     = 0x19
+)
+
+// Attribute controller registers (port 3C0h)
+const (
+	attrModeControl = 0x10 // Bit 3 blinks characters instead of brightening their background
+	attrOverscan    = 0x11
+	attrColorSelect = 0x14 // Bits 2-3 are bits 6-7 of the DAC entry of every colour
+	attrRegisters   = 0x15
+
+	attrBlink = 0x08 // Blink enable in the mode control register
+)
+
+// The sequencer, CRT controller and graphics controller registers the BIOS
+// programs for text mode 03h and for mode 13h
+var (
+	textSeq     = [seqRegisters]uint8{0x03, 0x00, 0x03, 0x00, 0x02}
+	graphicsSeq = [seqRegisters]uint8{0x03, 0x01, 0x0F, 0x00, 0x0E}
+	textGC      = [gcRegisters]uint8{0x00, 0x00, 0x00, 0x00, 0x00, 0x10, 0x0E, 0x00, 0xFF}
+	graphicsGC  = [gcRegisters]uint8{0x00, 0x00, 0x00, 0x00, 0x00, 0x40, 0x05, 0x0F, 0xFF}
+	textCRTC    = [crtcRegisters]uint8{
+		0x5F, 0x4F, 0x50, 0x82, 0x55, 0x81, 0xBF, 0x1F, 0x00, 0x4F, 0x0D, 0x0E, 0x00,
+		0x00, 0x00, 0x00, 0x9C, 0x8E, 0x8F, 0x28, 0x1F, 0x96, 0xB9, 0xA3, 0xFF,
+	}
+	graphicsCRTC = [crtcRegisters]uint8{
+		0x5F, 0x4F, 0x50, 0x82, 0x54, 0x80, 0xBF, 0x1F, 0x00, 0x41, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x9C, 0x8E, 0x8F, 0x28, 0x40, 0x96, 0xB9, 0xA3, 0xFF,
+	}
+)
+
+// VideoState is what a display needs besides video memory to draw the
+// screen. The CPU changes it with the VGA lock held; a display reads it
+// through Memory.VideoState, also under the lock.
+type VideoState struct {
+	Mode uint8                // Video mode set through INT 10h
+	Misc uint8                // Miscellaneous output register (written at 3C2h, read at 3CCh)
+	Seq  [seqRegisters]uint8  // Sequencer registers, such as the map mask and memory mode
+	CRTC [crtcRegisters]uint8 // CRT controller registers
+	GC   [gcRegisters]uint8   // Graphics controller registers, such as the read map select
+	Attr [attrRegisters]uint8 // Attribute controller registers: the 16-colour palette, mode control and more
+}
+
+// TextMode reports whether the mode is 80x25 colour text (02h or 03h)
+func (v *VideoState) TextMode() bool {
+	return isTextMode(v.Mode)
+}
+
+func isTextMode(mode uint8) bool {
+	return mode == 0x02 || mode == 0x03
+}
+
+// StartAddress returns the word of text memory, or the byte of each plane in
+// the 256-colour modes, shown at the top left
+func (v *VideoState) StartAddress() uint16 {
+	return uint16(v.CRTC[crtcStartHigh])<<8 | uint16(v.CRTC[crtcStartLow])
+}
+
+// Cursor returns the word of text memory the cursor is over and the scan
+// lines it covers. A cursor with bit 5 of the start register set, or
+// starting below its end, is not shown.
+func (v *VideoState) Cursor() (offset uint16, start, end uint8, visible bool) {
+	offset = uint16(v.CRTC[crtcCursorHigh])<<8 | uint16(v.CRTC[crtcCursorLow])
+	start = v.CRTC[crtcCursorStart] & 0x1F
+	end = v.CRTC[crtcCursorEnd] & 0x1F
+	visible = v.CRTC[crtcCursorStart]&0x20 == 0 && start <= end
+	return offset, start, end, visible
+}
+
+// Blink reports whether bit 7 of an attribute blinks the character rather
+// than selecting a bright background
+func (v *VideoState) Blink() bool {
+	return v.Attr[attrModeControl]&attrBlink != 0
+}
+
+// ColorIndex returns the DAC entry that shows one of the 16 text colours
+func (v *VideoState) ColorIndex(color uint8) uint8 {
+	return v.Attr[color&0x0F]&0x3F | (v.Attr[attrColorSelect]&0x0C)<<4
+}
+
+// reset programs the registers for a mode as the BIOS does. The
+// attribute palette maps the 16 text colours to the first 16 DAC entries,
+// which hold the EGA colours. The caller holds the VGA lock.
+func (v *VideoState) reset(mode uint8) {
+	v.Mode = mode
+	v.Attr = [attrRegisters]uint8{}
+	for i := uint8(0); i < 16; i++ {
+		v.Attr[i] = i
+	}
+	v.Attr[0x12] = 0x0F // Colour plane enable
+	if isTextMode(mode) {
+		v.Misc = 0x67
+		v.Seq = textSeq
+		v.CRTC = textCRTC
+		v.GC = textGC
+		v.Attr[attrModeControl] = 0x0C // Line graphics and blinking
+		v.Attr[0x13] = 0x08            // Horizontal panning for 9-dot characters
+	} else {
+		v.Misc = 0x63
+		v.Seq = graphicsSeq
+		v.CRTC = graphicsCRTC
+		v.GC = graphicsGC
+		v.Attr[attrModeControl] = 0x41 // Graphics with 8-bit colour
+	}
+}
+
+// DrawText draws the 80x25 text screen into the top left TextWidth by
+// TextHeight pixels of dst, in the colours palette gives the DAC entries
+// ScanOutText chooses
+func DrawText(dst *image.RGBA, text []byte, v *VideoState, palette *[256]color.RGBA, frame uint64) {
+	indices := make([]byte, TextWidth*TextHeight)
+	ScanOutText(indices, text, v, frame)
+	for y := 0; y < TextHeight; y++ {
+		row := dst.Pix[dst.PixOffset(dst.Rect.Min.X, dst.Rect.Min.Y+y):]
+		for x, index := range indices[y*TextWidth : (y+1)*TextWidth] {
+			c := palette[index]
+			row[x*4], row[x*4+1], row[x*4+2], row[x*4+3] = c.R, c.G, c.B, c.A
+		}
+	}
+}
+
+// ScanOutText reads the 80x25 text screen into dst as TextWidth by
+// TextHeight DAC entries. Each character/attribute pair from the start
+// address on is drawn in the CP437 font, in the foreground colour of the
+// attribute's low nibble over the background of its high nibble, through
+// the attribute palette. As on a VGA, the frame count blinks the cursor
+// every 8 frames and, with blinking enabled, characters whose attribute has
+// bit 7 set every 16.
+func ScanOutText(dst []byte, text []byte, v *VideoState, frame uint64) {
+	start := int(v.StartAddress())
+	cursor, cursorStart, cursorEnd, cursorVisible := v.Cursor()
+	cursorOn := cursorVisible && frame/8%2 == 0
+	blinkOn := frame/16%2 == 0
+	words := len(text) / 2
+
+	for row := 0; row < TextRows; row++ {
+		for col := 0; col < TextColumns; col++ {
+			word := (start + row*TextColumns + col) % words
+			char, attr := text[word*2], text[word*2+1]
+
+			fg, bg := attr&0x0F, attr>>4
+			if v.Blink() {
+				bg &= 0x07
+				if attr&0x80 != 0 && !blinkOn {
+					fg = bg
+				}
+			}
+			fgIndex, bgIndex := v.ColorIndex(fg), v.ColorIndex(bg)
+
+			glyph := &font.CP437Font[char]
+			for line := 0; line < 16; line++ {
+				bits := glyph[line]
+				if cursorOn && word == int(cursor)%words && line >= int(cursorStart) && line <= int(cursorEnd) {
+					bits = 0xFF
+				}
+				pix := dst[(row*16+line)*TextWidth+col*8:]
+				for x := 0; x < 8; x++ {
+					pix[x] = bgIndex
+					if bits&(0x80>>x) != 0 {
+						pix[x] = fgIndex
+					}
+				}
+			}
+		}
+	}
+}
+
+// writeCRTC handles an OUT to the CRT controller's index (3D4h) or data
+// (3D5h) register. While bit 7 of register 11h is set, registers 0-7 are
+// protected, except for the line compare bit of the overflow register.
+func (c *CPU) writeCRTC(port uint16, value uint8) {
+	if port == 0x3D4 {
+		c.crtcIndex = value & 0x1F
+		return
+	}
+	if int(c.crtcIndex) >= crtcRegisters {
+		return
+	}
+	video := &c.Memory.video
+	if c.crtcIndex <= crtcOverflow && video.CRTC[crtcProtect]&0x80 != 0 {
+		if c.crtcIndex != crtcOverflow {
+			return
+		}
+		value = video.CRTC[crtcOverflow]&^0x10 | value&0x10
+	}
+	c.Memory.LockVGA()
+	video.CRTC[c.crtcIndex] = value
+	c.Memory.UnlockVGA()
+}
+
+// readCRTC handles an IN from the CRT controller ports
+func (c *CPU) readCRTC(port uint16) uint8 {
+	if port == 0x3D4 {
+		return c.crtcIndex
+	}
+	if int(c.crtcIndex) < crtcRegisters {
+		return c.Memory.video.CRTC[c.crtcIndex]
+	}
+	return 0
+}
+
+// writeAttr handles an OUT to the attribute controller (3C0h), which takes
+// a register index and then its value in turn. Reading port 3DAh makes the
+// next write an index again.
+func (c *CPU) writeAttr(port uint16, value uint8) {
+	if port != 0x3C0 {
+		return
+	}
+	if !c.attrData {
+		c.attrIndex = value & 0x3F
+	} else if index := c.attrIndex & 0x1F; index < attrRegisters {
+		c.Memory.LockVGA()
+		c.Memory.video.Attr[index] = value
+		c.Memory.UnlockVGA()
+	}
+	c.attrData = !c.attrData
+}
+
+// readAttr handles an IN from the attribute controller's index (3C0h) or
+// data (3C1h) register
+func (c *CPU) readAttr(port uint16) uint8 {
+	if port == 0x3C0 {
+		return c.attrIndex
+	}
+	if index := c.attrIndex & 0x1F; index < attrRegisters {
+		return c.Memory.video.Attr[index]
+	}
+	return 0
+}
+
+// setVideoMode sets a mode through INT 10h AH=00h: the registers are
+// programmed for it, the cursor goes home and, unless bit 7 of mode is
+// set, video memory is cleared
+func (c *CPU) setVideoMode(mode uint8) {
+	keep := mode&0x80 != 0
+	mode &= 0x7F
+
+	c.Memory.LockVGA()
+	c.Memory.video.reset(mode)
+	if !keep {
+		c.Memory.clearVideo(isTextMode(mode))
+	}
+	c.Memory.UnlockVGA()
+	c.resetVideoIndexes()
+	c.setCursor(0, 0)
+
+	if mode == 0x13 && c.Mode13hCallback != nil {
+		c.Mode13hCallback()
+	}
+	if c.VideoModeCallback != nil {
+		c.VideoModeCallback(mode)
+	}
+}
+
+// resetVideoIndexes selects register 0 of each VGA controller and makes
+// the next write to port 3C0h an index
+func (c *CPU) resetVideoIndexes() {
+	c.seqIndex, c.crtcIndex, c.gcIndex, c.attrIndex, c.attrData = 0, 0, 0, 0, false
+}
+
+// textMode reports whether the CPU is in 80x25 text mode
+func (c *CPU) textMode() bool {
+	return c.Memory.video.TextMode()
+}
+
+// setCursor moves the BIOS cursor and, in text mode, the hardware cursor
+func (c *CPU) setCursor(x, y uint8) {
+	c.cursorX, c.cursorY = x, y
+	if !c.textMode() {
+		return
+	}
+	offset := uint16(y)*TextColumns + uint16(x)
+	c.Memory.LockVGA()
+	c.Memory.video.CRTC[crtcCursorHigh] = uint8(offset >> 8)
+	c.Memory.video.CRTC[crtcCursorLow] = uint8(offset)
+	c.Memory.UnlockVGA()
+}
+
+// setCursorShape sets the scan lines the text cursor covers (INT 10h AH=01h)
+func (c *CPU) setCursorShape(start, end uint8) {
+	c.Memory.LockVGA()
+	c.Memory.video.CRTC[crtcCursorStart] = start & 0x3F
+	c.Memory.video.CRTC[crtcCursorEnd] = end & 0x1F
+	c.Memory.UnlockVGA()
+}
+
+// setAttr sets an attribute controller register through INT 10h AH=10h
+func (c *CPU) setAttr(index, value uint8) {
+	if index >= attrRegisters {
+		return
+	}
+	c.Memory.LockVGA()
+	c.Memory.video.Attr[index] = value
+	c.Memory.UnlockVGA()
+}
+
+// textCell returns the linear address of a character on page 0
+func textCell(x, y int) uint32 {
+	return TextMemoryStart + uint32(y*TextColumns+x)*2
+}
+
+// writeText writes a character, and its attribute unless attr is negative,
+// count times from the cursor on without moving it (INT 10h AH=09h and
+// AH=0Ah)
+func (c *CPU) writeText(char uint8, attr int, count int) {
+	pos := int(c.cursorY)*TextColumns + int(c.cursorX)
+	for i := 0; i < count && pos < TextColumns*TextRows; i, pos = i+1, pos+1 {
+		addr := textCell(pos%TextColumns, pos/TextColumns)
+		c.Memory.WriteByteLinear(addr, char)
+		if attr >= 0 {
+			c.Memory.WriteByteLinear(addr+1, uint8(attr))
+		}
+	}
+}
+
+// teletypeText writes a character at the cursor and advances it, as INT
+// 10h AH=0Eh does in text mode: carriage return, line feed, backspace and
+// bell move the cursor or are ignored, and the screen scrolls up from the
+// bottom line
+func (c *CPU) teletypeText(char uint8) {
+	x, y := int(c.cursorX), int(c.cursorY)
+	switch char {
+	case 0x0D: // Carriage return
+		x = 0
+	case 0x0A: // Line feed
+		y++
+	case 0x08: // Backspace
+		if x > 0 {
+			x--
+		}
+	case 0x07: // Bell
+	default:
+		c.Memory.WriteByteLinear(textCell(x, y), char)
+		x++
+		if x >= TextColumns {
+			x = 0
+			y++
+		}
+	}
+	if y >= TextRows {
+		// New lines take the attribute of the character at the cursor
+		attr := c.Memory.ReadByteLinear(textCell(x, TextRows-1) + 1)
+		c.scrollText(1, attr, 0, 0, TextRows-1, TextColumns-1, true)
+		y = TextRows - 1
+	}
+	c.setCursor(uint8(x), uint8(y))
+}
+
+// scrollText scrolls a window of the screen up or down by lines, filling
+// the lines it uncovers with blanks of attr; 0 lines, or more than the
+// window holds, blanks the whole window (INT 10h AH=06h and AH=07h)
+func (c *CPU) scrollText(lines int, attr uint8, top, left, bottom, right int, up bool) {
+	right = min(right, TextColumns-1)
+	bottom = min(bottom, TextRows-1)
+	if top > bottom || left > right {
+		return
+	}
+	height := bottom - top + 1
+	if lines == 0 || lines > height {
+		lines = height
+	}
+	for i := 0; i < height; i++ {
+		y, from := top+i, top+i+lines
+		if !up {
+			y, from = bottom-i, bottom-i-lines
+		}
+		for x := left; x <= right; x++ {
+			cell := uint16(attr)<<8 | ' '
+			if i < height-lines {
+				cell = c.Memory.ReadWordLinear(textCell(x, from))
+			}
+			c.Memory.WriteWordLinear(textCell(x, y), cell)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package emulator
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"image"
+	"testing"
+)
+
+// teletypeProgram sets text mode and writes "Hi" and a new line through
+// the BIOS teletype
+var teletypeProgram = []byte{
+	0xB8, 0x03, 0x00, // 0100: MOV AX, 0003h
+	0xCD, 0x10, // 0103: INT 10h
+	0xB8, 0x48, 0x0E, // 0105: MOV AX, 0E48h ('H')
+	0xCD, 0x10, // 0108: INT 10h
+	0xB0, 0x69, // 010A: MOV AL, 'i'
+	0xCD, 0x10, // 010C: INT 10h
+	0xB0, 0x0D, // 010E: MOV AL, 0Dh
+	0xCD, 0x10, // 0110: INT 10h
+	0xB0, 0x0A, // 0112: MOV AL, 0Ah
+	0xCD, 0x10, // 0114: INT 10h
+	0xF4, // 0116: HLT
+}
+
+// TestTextModeTeletype tests that setting text mode clears text memory to
+// grey spaces, and that the teletype writes characters there and moves the
+// hardware cursor
+func TestTextModeTeletype(t *testing.T) {
+	m := NewMachine()
+	m.Memory.WriteByteLinear(TextMemoryStart+200, 'X')
+	if err := m.LoadCOM(teletypeProgram); err != nil {
+		t.Fatalf("LoadCOM failed: %v", err)
+	}
+	runUntilIdle(t, m.CPU)
+
+	text := m.Memory.GetTextMemory()
+	if !bytes.Equal(text[:4], []byte{'H', 0x07, 'i', 0x07}) {
+		t.Errorf("Expected \"Hi\" in grey, got % X", text[:4])
+	}
+	if text[200] != ' ' || text[201] != 0x07 {
+		t.Errorf("Expected the screen to be cleared, got %02X %02X", text[200], text[201])
+	}
+	state := m.Memory.VideoState()
+	if offset, start, end, visible := state.Cursor(); offset != TextColumns || start != 0x0D || end != 0x0E || !visible {
+		t.Errorf("Expected the cursor at word 80 on lines 13-14, got %d, %d-%d, visible %v", offset, start, end, visible)
+	}
+	if bounds := m.Screenshot().Bounds(); bounds != image.Rect(0, 0, TextWidth, TextHeight) {
+		t.Errorf("Expected a %dx%d screenshot in text mode, got %v", TextWidth, TextHeight, bounds)
+	}
+}
+
+// TestTextModeScroll tests that a line feed on the bottom line scrolls the
+// screen up
+func TestTextModeScroll(t *testing.T) {
+	cpu := runCOM(t, []byte{
+		0xB8, 0x03, 0x00, // 0100: MOV AX, 0003h
+		0xCD, 0x10, // 0103: INT 10h
+		0xB4, 0x02, // 0105: MOV AH, 02h
+		0xBA, 0x00, 0x18, // 0107: MOV DX, 1800h (row 24, column 0)
+		0xCD, 0x10, // 010A: INT 10h
+		0xB8, 0x41, 0x0E, // 010C: MOV AX, 0E41h ('A')
+		0xCD, 0x10, // 010F: INT 10h
+		0xB8, 0x0A, 0x0E, // 0111: MOV AX, 0E0Ah
+		0xCD, 0x10, // 0114: INT 10h
+		0xF4, // 0116: HLT
+	})
+	if got := cpu.Memory.ReadByteLinear(textCell(0, TextRows-2)); got != 'A' {
+		t.Errorf("Expected 'A' to scroll up a line, got %02X", got)
+	}
+	if got := cpu.Memory.ReadWordLinear(textCell(0, TextRows-1)); got != 0x0720 {
+		t.Errorf("Expected a blank bottom line, got %04X", got)
+	}
+	state := cpu.Memory.VideoState()
+	if offset, _, _, _ := state.Cursor(); offset != (TextRows-1)*TextColumns+1 || cpu.cursorX != 1 || cpu.cursorY != TextRows-1 {
+		t.Errorf("Expected the cursor at row 24, column 1, got word %d (%d, %d)", offset, cpu.cursorY, cpu.cursorX)
+	}
+}
+
+// TestVideoRegisterPorts tests the CRT controller's index and data ports,
+// the attribute controller's flip-flop and the BIOS palette functions
+func TestVideoRegisterPorts(t *testing.T) {
+	cpu := runCOM(t, []byte{
+		0xBA, 0xD4, 0x03, // 0100: MOV DX, 03D4h
+		0xB8, 0x0E, 0x12, // 0103: MOV AX, 120Eh
+		0xEF,             // 0106: OUT DX, AX (cursor high = 12h)
+		0xB8, 0x0F, 0x34, // 0107: MOV AX, 340Fh
+		0xEF,       // 010A: OUT DX, AX (cursor low = 34h)
+		0xB0, 0x0E, // 010B: MOV AL, 0Eh
+		0xEE,       // 010D: OUT DX, AL
+		0x42,       // 010E: INC DX
+		0xEC,       // 010F: IN AL, DX
+		0x88, 0xC1, // 0110: MOV CL, AL
+		0xBA, 0xDA, 0x03, // 0112: MOV DX, 03DAh
+		0xEC,             // 0115: IN AL, DX (attribute index next)
+		0xBA, 0xC0, 0x03, // 0116: MOV DX, 03C0h
+		0xB0, 0x10, // 0119: MOV AL, 10h (mode control)
+		0xEE,       // 011B: OUT DX, AL
+		0xB0, 0x04, // 011C: MOV AL, 04h (blinking off)
+		0xEE,       // 011E: OUT DX, AL
+		0xB0, 0x01, // 011F: MOV AL, 01h (palette register 1)
+		0xEE,       // 0121: OUT DX, AL
+		0xB0, 0x3F, // 0122: MOV AL, 3Fh
+		0xEE, // 0124: OUT DX, AL
+		0xF4, // 0125: HLT
+	})
+	state := cpu.Memory.VideoState()
+	if offset, _, _, _ := state.Cursor(); offset != 0x1234 || cpu.GetCL() != 0x12 {
+		t.Errorf("Expected the cursor at 1234h and 12h read back, got %04X and %02X", offset, cpu.GetCL())
+	}
+	if state.Blink() || state.ColorIndex(1) != 0x3F {
+		t.Errorf("Expected blinking off and colour 1 at DAC entry 3Fh, got %v and %02X", state.Blink(), state.ColorIndex(1))
+	}
+
+	cpu = runCOM(t, []byte{
+		0xB8, 0x03, 0x10, // 0100: MOV AX, 1003h
+		0xB3, 0x00, // 0103: MOV BL, 0 (blinking off)
+		0xCD, 0x10, // 0105: INT 10h
+		0xB8, 0x00, 0x10, // 0107: MOV AX, 1000h
+		0xBB, 0x02, 0x2A, // 010A: MOV BX, 2A02h (register 2 = 2Ah)
+		0xCD, 0x10, // 010D: INT 10h
+		0xB8, 0x07, 0x10, // 010F: MOV AX, 1007h
+		0xBB, 0x02, 0x00, // 0112: MOV BX, 0002h
+		0xCD, 0x10, // 0115: INT 10h
+		0xF4, // 0117: HLT
+	})
+	state = cpu.Memory.VideoState()
+	if state.Blink() || cpu.GetBH() != 0x2A || state.ColorIndex(2) != 0x2A {
+		t.Errorf("Expected blinking off and register 2 at 2Ah, got %v, BH=%02X", state.Blink(), cpu.GetBH())
+	}
+}
+
+// TestDrawText tests the colours, blinking, cursor and start address of the
+// text screen
+func TestDrawText(t *testing.T) {
+	var state VideoState
+	state.reset(0x03)
+	state.CRTC[crtcCursorLow] = 3
+	state.CRTC[crtcCursorStart], state.CRTC[crtcCursorEnd] = 14, 15
+	text := make([]byte, TextMemorySize)
+	copy(text, []byte{
+		' ', 0x1E, // Yellow on blue
+		0xDB, 0x8C, // Blinking light red on black
+		' ', 0xC0, // Black on red, or on light red without blinking
+		' ', 0x07, // Under the cursor
+	})
+	palette := DefaultPalette()
+	img := image.NewRGBA(image.Rect(0, 0, TextWidth, TextHeight))
+
+	tests := []struct {
+		name  string
+		frame uint64
+		setup func()
+		x, y  int
+		want  uint8
+	}{
+		{"background", 0, nil, 0, 0, 1},
+		{"blink on", 0, nil, 8, 0, 12},
+		{"blink off", 16, nil, 8, 0, 0},
+		{"blink background", 0, nil, 16, 0, 4},
+		{"cursor on", 0, nil, 24, 15, 7},
+		{"cursor off", 8, nil, 24, 15, 0},
+		{"above cursor", 0, nil, 24, 13, 0},
+		{"bright background", 16, func() { state.Attr[attrModeControl] &^= attrBlink }, 16, 0, 12},
+		{"no blinking", 16, nil, 8, 0, 12},
+		{"start address", 0, func() { state.CRTC[crtcStartLow] = 1 }, 0, 0, 12},
+	}
+	for _, tt := range tests {
+		if tt.setup != nil {
+			tt.setup()
+		}
+		DrawText(img, text, &state, &palette, tt.frame)
+		if got := img.RGBAAt(tt.x, tt.y); got != palette[tt.want] {
+			t.Errorf("%s: expected colour %d at (%d, %d), got %v", tt.name, tt.want, tt.x, tt.y, got)
+		}
+	}
+}
+
+// TestLoadStateVideo tests that a save state restores the VGA registers
+// and reports the text mode, and that a version 2 state, saved before the
+// registers were, loads with the BIOS's text registers and its cursor
+func TestLoadStateVideo(t *testing.T) {
+	cpu := runCOM(t, teletypeProgram)
+	cpu.setCursorShape(0x00, 0x0F)
+
+	restored := NewCPU()
+	restored.setVideoMode(0x13)
+	var mode uint8
+	restored.VideoModeCallback = func(m uint8) { mode = m }
+	if err := restored.LoadState(bytes.NewReader(saveState(t, cpu))); err != nil {
+		t.Fatalf("LoadState failed: %v", err)
+	}
+	if restored.Memory.video != cpu.Memory.video || mode != 0x03 {
+		t.Errorf("Expected mode 03h with the saved registers, got mode %02X and %+v", mode, restored.Memory.video)
+	}
+
+	restored = NewCPU()
+	restored.setVideoMode(0x13)
+	if err := restored.LoadState(bytes.NewReader(oldState(cpu, 2))); err != nil {
+		t.Fatalf("LoadState failed: %v", err)
+	}
+	state := restored.Memory.VideoState()
+	if offset, start, end, _ := state.Cursor(); !state.TextMode() || offset != TextColumns || start != 0x0D || end != 0x0E {
+		t.Errorf("Expected text mode with the BIOS cursor at word 80, got mode %02X, word %d, lines %d-%d",
+			state.Mode, offset, start, end)
+	}
+}
+
+// oldState saves a CPU's state in an earlier version of the format
+func oldState(cpu *CPU, version uint16) []byte {
+	body := &stateCodec{out: new(bytes.Buffer), version: version}
+	cpu.codeState(body)
+	var file bytes.Buffer
+	file.WriteString(saveStateMagic)
+	binary.Write(&file, binary.LittleEndian, version)
+	gz := gzip.NewWriter(&file)
+	gz.Write(body.out.Bytes())
+	gz.Close()
+	return file.Bytes()
+}
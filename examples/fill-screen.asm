@@ -14,7 +14,7 @@
     MOV AX, 0x0F0F      ; Color 15 (white) in both bytes
 
 fill_loop:
-    MOV [DI], AX        ; Write word to ES:DI
+    MOV ES:[DI], AX     ; Write word to ES:DI
     INC DI
     INC DI              ; Move to next word
     LOOP fill_loop
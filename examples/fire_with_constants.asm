@@ -149,7 +149,7 @@ main_loop:
         add al, FIRE_MIN_COLOR
 
         write_198:
-        mov [di], al
+        mov es:[di], al
         inc di
         loop fill_line_198
 
@@ -182,7 +182,7 @@ main_loop:
         add al, FIRE_MIN_COLOR
 
         write_199:
-        mov [di], al
+        mov es:[di], al
         inc di
         loop fill_line_199
 
@@ -211,19 +211,19 @@ main_loop:
             xor ax, ax
 
             ; Pixel [x-1, y+1] = di + 319
-            mov al, [di + 319]
+            mov al, es:[di + 319]
 
             ; Pixel [x, y+1] = di + 320
             xor dx, dx
-            mov dl, [di + 320]
+            mov dl, es:[di + 320]
             add ax, dx
 
             ; Pixel [x+1, y+1] = di + 321
-            mov dl, [di + 321]
+            mov dl, es:[di + 321]
             add ax, dx
 
             ; Pixel [x, y+2] = di + 640
-            mov dl, [di + 640]
+            mov dl, es:[di + 640]
             add ax, dx
 
             ; Divide by 4
@@ -235,7 +235,7 @@ main_loop:
             dec ax
 
             write_pixel:
-            mov [di], al
+            mov es:[di], al
             inc di
             loop propagate_pixels
 
@@ -0,0 +1,149 @@
+; Mode X Demo - unchained 320x240 with page flipping
+; Switches mode 13h to the planar Mode X, draws each frame on the page that
+; is not shown (four pixels per byte with all planes enabled, one pixel per
+; byte through a single plane) and flips pages with the CRTC start address
+
+.code
+start:
+    mov ax, 0x13
+    int 0x10
+
+    ; Unchain the planes: chain-4 and odd/even off
+    mov dx, 0x3C4
+    mov ax, 0x0604
+    out dx, ax
+
+    ; 480-line timing: 25 MHz clock, negative sync polarities
+    mov dx, 0x3C2
+    mov al, 0xE3
+    out dx, al
+
+    ; Unprotect CRTC registers 0-7
+    mov dx, 0x3D4
+    mov al, 0x11
+    out dx, al
+    inc dx
+    in al, dx
+    and al, 0x7F
+    out dx, al
+    dec dx
+
+    ; CRTC timing for 240 double-scanned lines, in byte mode
+    mov ax, 0x0D06        ; Vertical total
+    out dx, ax
+    mov ax, 0x3E07        ; Overflow: bit 8 of the vertical counts
+    out dx, ax
+    mov ax, 0x4109        ; Two scan lines per row
+    out dx, ax
+    mov ax, 0xEA10        ; Vertical sync start
+    out dx, ax
+    mov ax, 0xAC11        ; Vertical sync end, protecting registers 0-7
+    out dx, ax
+    mov ax, 0xDF12        ; 480 lines shown
+    out dx, ax
+    mov ax, 0x0014        ; Doubleword mode off
+    out dx, ax
+    mov ax, 0xE715        ; Vertical blank start
+    out dx, ax
+    mov ax, 0x0616        ; Vertical blank end
+    out dx, ax
+    mov ax, 0xE317        ; Byte mode on
+    out dx, ax
+
+    ; Clear all 256 KB: every plane at once
+    mov dx, 0x3C4
+    mov ax, 0x0F02        ; Map mask: all planes
+    out dx, ax
+    mov ax, 0xA000
+    mov es, ax
+    xor di, di
+    xor ax, ax
+    mov cx, 0x8000
+    rep stosw
+
+    xor si, si            ; Frame counter
+    mov bp, 0x4B00        ; Draw on page 1 (80*240 bytes in) while page 0 shows
+
+draw_frame:
+    mov dx, 0x3C4
+    mov ax, 0x0F02        ; All planes: each byte is four pixels
+    out dx, ax
+
+    ; Background: each row in one colour of the cube
+    mov di, bp
+    xor bx, bx            ; Row
+bg_row:
+    mov ax, bx
+    shr ax, 1
+    shr ax, 1
+    add al, 32
+    mov ah, al
+    mov cx, 40            ; 80 bytes: 320 pixels
+    rep stosw
+    inc bx
+    cmp bx, 240
+    jne bg_row
+
+    ; A white box 64 pixels wide moving across rows 80-159
+    mov di, bp
+    add di, 6400          ; Row 80
+    mov ax, si
+    and ax, 63
+    add di, ax
+    mov bx, 80
+    mov ax, 0x0F0F
+box_row:
+    mov cx, 8             ; 16 bytes: 64 pixels
+    rep stosw
+    add di, 64            ; On to the next row
+    dec bx
+    jnz box_row
+
+    ; A red line one pixel wide, through the plane of its column
+    mov cx, si
+    and cx, 3
+    mov ah, 1
+    shl ah, cl
+    mov al, 0x02          ; Map mask: plane x mod 4
+    mov dx, 0x3C4
+    out dx, ax
+    mov di, si
+    and di, 255
+    shr di, 1
+    shr di, 1             ; Byte x / 4 of each row
+    add di, bp
+    mov al, 196           ; Red in the colour cube
+    mov cx, 240
+line_row:
+    stosb
+    add di, 79
+    loop line_row
+
+    ; Show the page just drawn: the start address takes effect at the
+    ; next vertical retrace
+    mov dx, 0x3D4
+    mov bx, bp
+    mov al, 0x0C
+    mov ah, bh
+    out dx, ax
+    mov al, 0x0D
+    mov ah, bl
+    out dx, ax
+
+    ; Wait for VBlank - reading 0x3DA blocks until the next retrace
+    mov dx, 0x3DA
+    in al, dx
+
+    ; Draw the next frame on the other page
+    xor bp, 0x4B00
+    inc si
+
+    mov ah, 0x01          ; Until a key is pressed
+    int 0x16
+    jz draw_frame
+
+    xor ax, ax
+    int 0x16
+    mov ax, 0x03          ; Back to text mode
+    int 0x10
+    hlt
@@ -123,7 +123,7 @@ x_loop:
     ; Combine waves using addition (classic plasma effect)
     add al, dh
 
-    ; mov [di], al
+    ; mov es:[di], al
     ; inc di
     stosb
 
@@ -245,7 +245,7 @@ apply_row_offset:
     push di
     mov di, ax
     mov al, 15              ; White pixel
-    mov [di], al            ; Writes to ES:DI (back buffer at 0x7000)
+    mov es:[di], al         ; Writes to ES:DI (back buffer at 0x7000)
     pop di
 
 skip_pixel_pop:
@@ -0,0 +1,130 @@
+; Text Mode Demo - 80x25 colour text at B800h
+; Draws a framed window with attributes straight into text memory, writes
+; through the BIOS, blinks a line and moves the hardware cursor
+
+.data
+title:
+    db " Text mode 03h ", 0
+line1:
+    db "Every character is a CP437 code and an attribute byte:", 0
+line2:
+    db "foreground in bits 0-3, background in 4-6, blink in 7.", 0
+blink:
+    db "This line blinks", 0
+prompt:
+    db "Press a key...", 0
+
+.code
+start:
+    ; Set 80x25 text mode (clears the screen)
+    mov ax, 0x03
+    int 0x10
+
+    mov ax, 0xB800
+    mov es, ax
+
+    ; Fill the screen with light grey on blue
+    xor di, di
+    mov ax, 0x17B0        ; Light shade, grey on blue
+    mov cx, 2000          ; 80x25 characters
+    rep stosw
+
+    ; Window frame, rows 6-16 and columns 10-69, white on cyan
+    mov di, 980           ; (6*80+10)*2
+    mov ax, 0x3FC9        ; Top left corner
+    stosw
+    mov al, 0xCD          ; Horizontal line
+    mov cx, 58
+    rep stosw
+    mov al, 0xBB          ; Top right corner
+    stosw
+
+    mov bx, 9             ; Nine rows of sides
+    mov di, 1140          ; (7*80+10)*2
+sides:
+    mov al, 0xBA          ; Vertical line
+    stosw
+    mov al, 0x20          ; Space
+    mov cx, 58
+    rep stosw
+    mov al, 0xBA
+    stosw
+    add di, 40            ; On to the next row
+    dec bx
+    jnz sides
+
+    mov al, 0xC8          ; Bottom left corner
+    stosw
+    mov al, 0xCD
+    mov cx, 58
+    rep stosw
+    mov al, 0xBC          ; Bottom right corner
+    stosw
+
+    ; Title in yellow on red
+    mov si, title
+    mov di, 1024          ; (6*80+32)*2
+    mov ah, 0x4E
+    call puts
+
+    ; Text in black on cyan
+    mov si, line1
+    mov di, 1306          ; (8*80+13)*2
+    mov ah, 0x30
+    call puts
+    mov si, line2
+    mov di, 1466          ; (9*80+13)*2
+    call puts
+
+    ; A blinking line: bit 7 of the attribute
+    mov si, blink
+    mov di, 1984          ; (12*80+32)*2
+    mov ah, 0xCF          ; Blinking white on red
+    call puts
+
+    ; Sixteen colour swatches through INT 10h AH=09h
+    mov dx, 0x0E18        ; Row 14, column 24
+    xor bl, bl
+swatch:
+    mov ah, 0x02          ; Set cursor position
+    int 0x10
+    mov ax, 0x09DB        ; Full block
+    mov cx, 2
+    int 0x10
+    add dl, 2
+    inc bl
+    cmp bl, 16
+    jne swatch
+
+    ; Prompt through the BIOS teletype, leaving the cursor after it
+    mov dx, 0x1417        ; Row 20, column 23 (outside the window)
+    mov ah, 0x02
+    int 0x10
+    mov si, prompt
+print:
+    lodsb
+    test al, al
+    jz wait_key
+    mov ah, 0x0E
+    int 0x10
+    jmp print
+
+wait_key:
+    ; A block cursor
+    mov ah, 0x01
+    mov cx, 0x000F
+    int 0x10
+
+    xor ax, ax
+    int 0x16
+    hlt
+
+; puts copies the string at DS:SI to ES:DI with attribute AH
+puts:
+    lodsb
+    test al, al
+    jz puts_done
+    stosw
+    jmp puts
+puts_done:
+    ret
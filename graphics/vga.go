@@ -15,25 +15,41 @@ import (
 )
 
 const (
-	ScreenWidth  = 320
-	ScreenHeight = 200
+	ScreenWidth  = emulator.ScreenWidth
+	ScreenHeight = emulator.ScreenHeight
 	Scale        = 3 // Scale factor for display
 )
 
-// VGADisplay represents the VGA Mode 13h display
+// VGADisplay represents the VGA display, in Mode 13h, the unchained Mode X
+// or 80x25 text mode. The palette is set from the CPU's goroutine and read
+// by the display's, under the VGA memory lock.
 type VGADisplay struct {
 	memory       *emulator.Memory
+	width        int // Size of the 256-colour screen the CRT controller shows
+	height       int
+	indices      []byte // Palette indices scanned out of the planes
 	pixels       []byte
 	palette      [256]color.RGBA
 	screenBuffer *ebiten.Image // Offscreen buffer for pixel-perfect rendering
+
+	// Text mode screen, drawn with the CP437 font
+	textMode   bool
+	text       *image.RGBA
+	textBuffer *ebiten.Image
+	frames     uint64 // Frames updated, which time the cursor and blinking
 }
 
 // NewVGADisplay creates a new VGA display
 func NewVGADisplay(memory *emulator.Memory) *VGADisplay {
 	vga := &VGADisplay{
 		memory:       memory,
+		width:        ScreenWidth,
+		height:       ScreenHeight,
+		indices:      make([]byte, ScreenWidth*ScreenHeight),
 		pixels:       make([]byte, ScreenWidth*ScreenHeight*4), // RGBA
 		screenBuffer: ebiten.NewImage(ScreenWidth, ScreenHeight),
+		text:         image.NewRGBA(image.Rect(0, 0, emulator.TextWidth, emulator.TextHeight)),
+		textBuffer:   ebiten.NewImage(emulator.TextWidth, emulator.TextHeight),
 	}
 
 	// Initialize with standard VGA default palette
@@ -45,57 +61,34 @@ func NewVGADisplay(memory *emulator.Memory) *VGADisplay {
 // initializeDefaultPalette sets up the standard VGA default palette
 // This matches the default VGA Mode 13h palette that programs expect
 func (v *VGADisplay) initializeDefaultPalette() {
-	// Standard VGA 16-color palette (EGA compatible)
-	// These are the default colors 0-15
-	v.palette[0] = color.RGBA{0, 0, 0, 255}       // Black
-	v.palette[1] = color.RGBA{0, 0, 170, 255}     // Blue
-	v.palette[2] = color.RGBA{0, 170, 0, 255}     // Green
-	v.palette[3] = color.RGBA{0, 170, 170, 255}   // Cyan
-	v.palette[4] = color.RGBA{170, 0, 0, 255}     // Red
-	v.palette[5] = color.RGBA{170, 0, 170, 255}   // Magenta
-	v.palette[6] = color.RGBA{170, 85, 0, 255}    // Brown
-	v.palette[7] = color.RGBA{170, 170, 170, 255} // Light Gray
-	v.palette[8] = color.RGBA{85, 85, 85, 255}    // Dark Gray
-	v.palette[9] = color.RGBA{85, 85, 255, 255}   // Light Blue
-	v.palette[10] = color.RGBA{85, 255, 85, 255}  // Light Green
-	v.palette[11] = color.RGBA{85, 255, 255, 255} // Light Cyan
-	v.palette[12] = color.RGBA{255, 85, 85, 255}  // Light Red
-	v.palette[13] = color.RGBA{255, 85, 255, 255} // Light Magenta
-	v.palette[14] = color.RGBA{255, 255, 85, 255} // Yellow
-	v.palette[15] = color.RGBA{255, 255, 255, 255} // White
-
-	// Colors 16-231: 216-color cube (6x6x6) - standard VGA default
-	idx := 16
-	for r := 0; r < 6; r++ {
-		for g := 0; g < 6; g++ {
-			for b := 0; b < 6; b++ {
-				v.palette[idx] = color.RGBA{
-					uint8(r * 51),
-					uint8(g * 51),
-					uint8(b * 51),
-					255,
-				}
-				idx++
-			}
-		}
-	}
-
-	// Colors 232-255: Grayscale ramp
-	for i := 0; i < 24; i++ {
-		gray := uint8(8 + i*10)
-		v.palette[232+i] = color.RGBA{gray, gray, gray, 255}
-	}
+	v.palette = emulator.DefaultPalette()
 }
 
-// Update updates the display from VGA memory
+// Update updates the display from the planes of VGA memory as the CRT
+// controller scans them out, or from text memory in text mode
 func (v *VGADisplay) Update() error {
 	// Lock VGA memory to prevent tearing while reading
 	v.memory.LockVGA()
-	vgaMem := v.memory.GetVGAMemory()
+	defer v.memory.UnlockVGA()
+	v.frames++
 
-	// Convert VGA memory to RGBA pixels
-	for i := 0; i < ScreenWidth*ScreenHeight; i++ {
-		colorIndex := vgaMem[i]
+	state := v.memory.VideoState()
+	v.textMode = state.TextMode()
+	if v.textMode {
+		emulator.DrawText(v.text, v.memory.GetTextMemory(), &state, &v.palette, v.frames)
+		return nil
+	}
+
+	// Mode X programs can change the resolution
+	if width, height := state.GraphicsSize(); width != v.width || height != v.height {
+		v.width, v.height = width, height
+		v.indices = make([]byte, width*height)
+		v.pixels = make([]byte, width*height*4)
+	}
+	emulator.ScanOut(v.indices, v.memory.GetVGAMemory(), &state)
+
+	// Convert palette indices to RGBA pixels
+	for i, colorIndex := range v.indices {
 		c := v.palette[colorIndex]
 
 		pixelOffset := i * 4
@@ -104,14 +97,22 @@ func (v *VGADisplay) Update() error {
 		v.pixels[pixelOffset+2] = c.B
 		v.pixels[pixelOffset+3] = c.A
 	}
-	v.memory.UnlockVGA()
 
 	return nil
 }
 
 // Draw draws the VGA display
 func (v *VGADisplay) Draw(screen *ebiten.Image) {
+	if v.textMode {
+		v.textBuffer.WritePixels(v.text.Pix)
+		screen.DrawImage(v.textBuffer, &ebiten.DrawImageOptions{Filter: ebiten.FilterNearest})
+		return
+	}
+
 	// Write pixels to offscreen buffer
+	if v.screenBuffer.Bounds() != image.Rect(0, 0, v.width, v.height) {
+		v.screenBuffer = ebiten.NewImage(v.width, v.height)
+	}
 	v.screenBuffer.WritePixels(v.pixels)
 
 	// Draw buffer to screen with nearest-neighbor filtering for pixel-perfect scaling
@@ -120,9 +121,19 @@ func (v *VGADisplay) Draw(screen *ebiten.Image) {
 	screen.DrawImage(v.screenBuffer, opts)
 }
 
+// ResetPalette restores the default palette, dropping the colors set
+// through the DAC, for example before a save state sets its own
+func (v *VGADisplay) ResetPalette() {
+	v.memory.LockVGA()
+	v.initializeDefaultPalette()
+	v.memory.UnlockVGA()
+}
+
 // SetPaletteColor sets a single palette entry
 func (v *VGADisplay) SetPaletteColor(index byte, r, g, b byte) {
+	v.memory.LockVGA()
 	v.palette[index] = color.RGBA{r, g, b, 255}
+	v.memory.UnlockVGA()
 }
 
 // DrawChar draws a single CP437 character at pixel coordinates (x, y)
@@ -182,9 +193,12 @@ func (v *VGADisplay) GetCharHeight(scale int) int {
 	return 16 * scale
 }
 
-// Layout returns the screen dimensions
+// Layout returns the screen dimensions of the current mode
 func (v *VGADisplay) Layout(outsideWidth, outsideHeight int) (int, int) {
-	return ScreenWidth, ScreenHeight
+	if v.textMode {
+		return emulator.TextWidth, emulator.TextHeight
+	}
+	return v.width, v.height
 }
 
 // Game wraps VGADisplay to implement ebiten.Game interface
@@ -193,6 +207,15 @@ type Game struct {
 	cpu              interface{ SetVBlank(bool) } // CPU reference for VBlank synchronization
 	keyPressCallback func(scancode, ascii uint8)  // Callback to notify CPU of key press
 	frameCount       int                          // Internal frame counter for VBlank toggle
+	hotkeys          Hotkeys
+}
+
+// Hotkeys are the emulator's own actions bound to function keys, which are
+// not passed to the program. Nil actions are unbound.
+type Hotkeys struct {
+	SaveState func() // F5
+	Rewind    func() // F6
+	LoadState func() // F9
 }
 
 // NewGame creates a new game instance
@@ -224,6 +247,16 @@ func (g *Game) Update() error {
 		return ebiten.Termination
 	}
 
+	if inpututil.IsKeyJustPressed(ebiten.KeyF5) && g.hotkeys.SaveState != nil {
+		g.hotkeys.SaveState()
+	}
+	if inpututil.IsKeyJustPressed(ebiten.KeyF6) && g.hotkeys.Rewind != nil {
+		g.hotkeys.Rewind()
+	}
+	if inpututil.IsKeyJustPressed(ebiten.KeyF9) && g.hotkeys.LoadState != nil {
+		g.hotkeys.LoadState()
+	}
+
 	// Check for other keys and notify CPU
 	if g.keyPressCallback != nil {
 		// Map common keys to BIOS scancodes
@@ -271,7 +304,7 @@ func (g *Game) Layout(outsideWidth, outsideHeight int) (int, int) {
 // RunGraphics starts the graphics window (should be called in a goroutine after mode 13h is detected)
 func RunGraphics(memory *emulator.Memory) error {
 	ebiten.SetWindowSize(ScreenWidth*Scale, ScreenHeight*Scale)
-	ebiten.SetWindowTitle("Assembly Emulator - VGA Mode 13h")
+	ebiten.SetWindowTitle("Assembly Emulator - VGA")
 	ebiten.SetWindowResizingMode(ebiten.WindowResizingModeEnabled)
 	ebiten.SetScreenClearedEveryFrame(false) // Optimization: we redraw everything each frame
 
@@ -280,69 +313,40 @@ func RunGraphics(memory *emulator.Memory) error {
 }
 
 // RunGraphicsWithDisplay starts the graphics window with a specific VGA display
-func RunGraphicsWithDisplay(display *VGADisplay, cpu interface{ SetVBlank(bool) }, keyCallback func(scancode, ascii uint8)) error {
+func RunGraphicsWithDisplay(display *VGADisplay, cpu interface{ SetVBlank(bool) }, keyCallback func(scancode, ascii uint8), hotkeys Hotkeys) error {
 	ebiten.SetWindowSize(ScreenWidth*Scale, ScreenHeight*Scale)
-	ebiten.SetWindowTitle("Assembly Emulator - VGA Mode 13h")
+	ebiten.SetWindowTitle("Assembly Emulator - VGA")
 	ebiten.SetWindowResizingMode(ebiten.WindowResizingModeEnabled)
 
 	game := &Game{
 		display:          display,
 		cpu:              cpu,
 		keyPressCallback: keyCallback,
+		hotkeys:          hotkeys,
 	}
 	return ebiten.RunGame(game)
 }
 
-// RecordGIF records frames to an animated GIF file (headless mode)
+// RecordGIF records frames to an animated GIF file (headless mode), raising
+// VBlank about 60 times a second of host time
 func RecordGIF(display *VGADisplay, cpu interface{ SetVBlank(bool) }, outputPath string, maxFrames int) error {
-	frames := make([]*image.Paletted, 0, maxFrames)
-	delays := make([]int, 0, maxFrames)
+	recorder := NewGIFRecorder(display, maxFrames)
 
 	// Start time
 	startTime := time.Now()
 	frameCount := 0
-	capturedFrames := 0
 
 	// Capture loop - run headless
-	for capturedFrames < maxFrames {
+	for !recorder.Done() {
 		// Signal VBlank at the start of each frame (60 FPS)
 		if cpu != nil {
 			cpu.SetVBlank(true)
 		}
 
-		// Update display from VGA memory
-		if err := display.Update(); err != nil {
-			return err
-		}
-
 		// Capture every other frame to get 30fps output
 		if frameCount%2 == 0 {
-			// Create paletted image with VGA palette
-			palette := make(color.Palette, 256)
-			for i := 0; i < 256; i++ {
-				palette[i] = display.palette[i]
-			}
-
-			// Create paletted image
-			img := image.NewPaletted(image.Rect(0, 0, ScreenWidth, ScreenHeight), palette)
-
-			// Copy VGA memory to image
-			display.memory.LockVGA()
-			vgaMem := display.memory.GetVGAMemory()
-			for y := 0; y < ScreenHeight; y++ {
-				for x := 0; x < ScreenWidth; x++ {
-					offset := y*ScreenWidth + x
-					img.SetColorIndex(x, y, vgaMem[offset])
-				}
-			}
-			display.memory.UnlockVGA()
-
-			frames = append(frames, img)
-			delays = append(delays, 3) // 3/100 second = 30fps (approximately)
-
-			capturedFrames++
-			if capturedFrames%30 == 0 {
-				fmt.Printf("Captured %d/%d frames...\n", capturedFrames, maxFrames)
+			if err := recorder.Capture(3); err != nil { // 3/100 second = 30fps (approximately)
+				return err
 			}
 		}
 
@@ -353,8 +357,74 @@ func RecordGIF(display *VGADisplay, cpu interface{ SetVBlank(bool) }, outputPath
 	}
 
 	elapsed := time.Since(startTime)
-	fmt.Printf("Captured %d frames in %.2f seconds\n", capturedFrames, elapsed.Seconds())
+	fmt.Printf("Captured %d frames in %.2f seconds\n", len(recorder.frames), elapsed.Seconds())
+	return recorder.Save(outputPath)
+}
+
+// GIFRecorder collects frames of a display for an animated GIF. In
+// deterministic runs it captures from the emulated frame clock, so the same
+// program and input give the same file.
+type GIFRecorder struct {
+	display   *VGADisplay
+	maxFrames int
+	frames    []*image.Paletted
+	delays    []int
+}
+
+// NewGIFRecorder creates a recorder that captures up to maxFrames frames
+func NewGIFRecorder(display *VGADisplay, maxFrames int) *GIFRecorder {
+	return &GIFRecorder{
+		display:   display,
+		maxFrames: maxFrames,
+		frames:    make([]*image.Paletted, 0, maxFrames),
+		delays:    make([]int, 0, maxFrames),
+	}
+}
 
+// Done reports whether all frames have been captured
+func (r *GIFRecorder) Done() bool {
+	return len(r.frames) >= r.maxFrames
+}
+
+// Capture adds the current screen and palette as a frame shown for delay
+// hundredths of a second
+func (r *GIFRecorder) Capture(delay int) error {
+	display := r.display
+
+	// Update display from VGA memory
+	if err := display.Update(); err != nil {
+		return err
+	}
+
+	// Copy the screen's palette indices and the palette to a paletted
+	// image; text mode draws its DAC entries straight into it
+	display.memory.LockVGA()
+	palette := make(color.Palette, 256)
+	for i := 0; i < 256; i++ {
+		palette[i] = display.palette[i]
+	}
+	var img *image.Paletted
+	if display.textMode {
+		img = image.NewPaletted(image.Rect(0, 0, emulator.TextWidth, emulator.TextHeight), palette)
+		state := display.memory.VideoState()
+		emulator.ScanOutText(img.Pix, display.memory.GetTextMemory(), &state, display.frames)
+	} else {
+		img = image.NewPaletted(image.Rect(0, 0, display.width, display.height), palette)
+		copy(img.Pix, display.indices)
+	}
+	display.memory.UnlockVGA()
+
+	r.frames = append(r.frames, img)
+	r.delays = append(r.delays, delay)
+
+	if len(r.frames)%30 == 0 {
+		fmt.Printf("Captured %d/%d frames...\n", len(r.frames), r.maxFrames)
+	}
+	return nil
+}
+
+// Save encodes the captured frames to a GIF file
+func (r *GIFRecorder) Save(outputPath string) error {
 	// Encode to GIF
 	fmt.Printf("Encoding GIF to %s...\n", outputPath)
 	file, err := os.Create(outputPath)
@@ -363,9 +433,17 @@ func RecordGIF(display *VGADisplay, cpu interface{ SetVBlank(bool) }, outputPath
 	}
 	defer file.Close()
 
+	// The screen is as large as the largest frame, in case the program
+	// changed the resolution or switched between text and graphics
+	var config image.Config
+	for _, frame := range r.frames {
+		config.Width = max(config.Width, frame.Rect.Dx())
+		config.Height = max(config.Height, frame.Rect.Dy())
+	}
 	err = gif.EncodeAll(file, &gif.GIF{
-		Image: frames,
-		Delay: delays,
+		Image:  r.frames,
+		Delay:  r.delays,
+		Config: config,
 		// Loop forever
 		LoopCount: 0,
 	})
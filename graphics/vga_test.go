@@ -2,6 +2,7 @@ package graphics
 
 import (
 	"assembly-emulator/emulator"
+	"image"
 	"image/color"
 	"testing"
 )
@@ -81,6 +82,20 @@ func TestSetPaletteColor(t *testing.T) {
 	}
 }
 
+// TestResetPalette tests that ResetPalette drops colors set through the DAC
+func TestResetPalette(t *testing.T) {
+	memory := emulator.NewMemory()
+	vga := NewVGADisplay(memory)
+
+	vga.SetPaletteColor(4, 1, 2, 3)
+	vga.ResetPalette()
+
+	expected := color.RGBA{170, 0, 0, 255}
+	if got := vga.palette[4]; got != expected {
+		t.Errorf("After ResetPalette: expected %v, got %v", expected, got)
+	}
+}
+
 // TestVGAMemoryUpdate tests updating pixels from VGA memory
 func TestVGAMemoryUpdate(t *testing.T) {
 	memory := emulator.NewMemory()
@@ -164,6 +179,81 @@ func TestLayout(t *testing.T) {
 	}
 }
 
+// TestTextModeUpdate tests that a display in text mode draws text memory
+// with the CP437 font at the text resolution
+func TestTextModeUpdate(t *testing.T) {
+	cpu := emulator.NewCPU() // Starts in text mode
+	vga := NewVGADisplay(cpu.Memory)
+	cpu.Memory.WriteWordLinear(emulator.TextMemoryStart, 0x1EDB) // Yellow block on blue
+	cpu.Memory.WriteWordLinear(emulator.TextMemoryStart+2, 0x1E20)
+
+	if err := vga.Update(); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	if w, h := vga.Layout(1000, 1000); w != emulator.TextWidth || h != emulator.TextHeight {
+		t.Errorf("Layout(): expected (%d, %d) in text mode, got (%d, %d)", emulator.TextWidth, emulator.TextHeight, w, h)
+	}
+	if got := vga.text.RGBAAt(0, 0); got != vga.palette[14] {
+		t.Errorf("Expected the block in yellow, got %v", got)
+	}
+	if got := vga.text.RGBAAt(8, 0); got != vga.palette[1] {
+		t.Errorf("Expected the space in blue, got %v", got)
+	}
+}
+
+// TestModeXUpdate tests that a display scans an unchained mode out of the
+// planes at the resolution and start address the CRT controller sets
+func TestModeXUpdate(t *testing.T) {
+	cpu := emulator.NewCPU()
+	cpu.AX = 0x0013
+	if err := cpu.Interrupt(0x10); err != nil {
+		t.Fatalf("INT 10h failed: %v", err)
+	}
+	vga := NewVGADisplay(cpu.Memory)
+	cpu.OutWord(0x3C4, 0x0604) // Chain-4 off
+	cpu.OutWord(0x3D4, 0x0E11) // Unprotect CRTC registers 0-7
+	cpu.OutWord(0x3D4, 0x3E07) // 480 lines, doubled
+	cpu.OutWord(0x3D4, 0xDF12)
+	cpu.OutWord(0x3D4, 0x0014)
+	cpu.OutWord(0x3D4, 0xE317)
+	cpu.OutWord(0x3D4, 0x010D) // Start at byte 1
+	cpu.OutWord(0x3C4, 0x0202) // Plane 1
+	cpu.Memory.WriteByteLinear(0xA0001, 4)
+
+	if err := vga.Update(); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	if w, h := vga.Layout(1000, 1000); w != 320 || h != 240 {
+		t.Errorf("Layout(): expected (320, 240) in Mode X, got (%d, %d)", w, h)
+	}
+	if len(vga.pixels) != 320*240*4 {
+		t.Fatalf("Expected a 320x240 pixel buffer, got %d bytes", len(vga.pixels))
+	}
+	if got := vga.pixels[4:8]; got[0] != 170 || got[1] != 0 || got[2] != 0 {
+		t.Errorf("Second pixel (red): expected RGBA(170,0,0,255), got %v", got)
+	}
+}
+
+// TestGIFCaptureTextMode tests that a recording captures the text screen
+// at the text resolution
+func TestGIFCaptureTextMode(t *testing.T) {
+	cpu := emulator.NewCPU() // Starts in text mode
+	vga := NewVGADisplay(cpu.Memory)
+	cpu.Memory.WriteWordLinear(emulator.TextMemoryStart, 0x1EDB) // Yellow block on blue
+	recorder := NewGIFRecorder(vga, 1)
+
+	if err := recorder.Capture(3); err != nil {
+		t.Fatalf("Capture failed: %v", err)
+	}
+	frame := recorder.frames[0]
+	if bounds := frame.Bounds(); bounds != image.Rect(0, 0, emulator.TextWidth, emulator.TextHeight) {
+		t.Fatalf("Expected a %dx%d frame, got %v", emulator.TextWidth, emulator.TextHeight, bounds)
+	}
+	if got := frame.At(0, 0); got != vga.palette[14] {
+		t.Errorf("Expected the block in yellow, got %v", got)
+	}
+}
+
 // TestColorCubeRange tests the 216-color cube in the palette
 func TestColorCubeRange(t *testing.T) {
 	memory := emulator.NewMemory()
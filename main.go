@@ -4,111 +4,289 @@ import (
 	"assembly-emulator/assembler"
 	"assembly-emulator/emulator"
 	"assembly-emulator/graphics"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 )
 
+// Rewinding takes a snapshot every half second of the 70 Hz display, and
+// F6 goes back one second
+const (
+	rewindSnapshotFrames = 35
+	rewindHotkeyFrames   = 70
+)
+
 func main() {
 	// Define command-line flags
 	gifOutput := flag.String("gif", "", "Output GIF file (enables headless recording mode)")
 	gifFrames := flag.Int("gif-frames", 90, "Number of frames to capture for GIF (default: 90 = 3 seconds at 30fps)")
+	backendName := flag.String("backend", "bytecode", "Assembler backend: bytecode (emulator bytecode) or 8086 (real machine code)")
+	outputFile := flag.String("o", "", "Write the assembled 8086 program to a flat .com or .bin file instead of running it")
+	cpuName := flag.String("cpu", "8086", "CPU model for the instruction set and timings: 8086, 186, 286, 386 or 486")
+	cpuSpeed := flag.String("cpu-speed", "max", "Emulated clock speed, e.g. 4.77MHz or 33MHz (max: as fast as the host allows)")
+	exceptions := flag.String("exceptions", "interrupt", "CPU exceptions: interrupt (dispatch through the vector table) or stop (stop with a diagnostic)")
+	unclaimedPorts := flag.String("unclaimed-ports", "ignore", "Accesses to I/O ports no device claims: ignore, log (to stderr) or trap (stop with a diagnostic)")
+	engineName := flag.String("engine", "interp", "Execution engine: interp (reference interpreter), block (compiled basic blocks) or diff (run both side by side and stop at the first difference)")
+	diffSteps := flag.Uint64("diff-steps", 10_000_000, "Number of steps --engine diff runs before reporting that the engines agree")
+	rewindSeconds := flag.Int("rewind", 30, "Seconds of emulated time F6 can rewind through, recorded as snapshots (0 disables rewinding)")
+	loadState := flag.String("load-state", "", "Restore a save state (saved with F5 in the graphics window) after loading the program")
+	deterministic := flag.Bool("deterministic", false, "Run independently of the wall clock: frames follow the cycle count, window keys are ignored and --gif records emulated frames")
+	inputScript := flag.String("input", "", "Input script of key presses by emulated frame, one \"frame key\" per line (e.g. \"140 space\")")
 	flag.Parse()
 
 	// Check for assembly file argument
 	if flag.NArg() < 1 {
-		fmt.Fprintf(os.Stderr, "Usage: %s [options] <assembly-file.asm>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] <assembly-file.asm | program.com>\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "Example: %s examples/noise.asm\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "\nOptions:\n")
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
 
-	asmFile := flag.Arg(0)
+	programFile := flag.Arg(0)
 
-	// Read assembly file
-	source, err := os.ReadFile(asmFile)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error reading file %s: %v\n", asmFile, err)
-		os.Exit(1)
+	// F5 and F9 save and load the state given to --load-state, or one
+	// named after the program
+	statePath := *loadState
+	if statePath == "" {
+		statePath = strings.TrimSuffix(programFile, filepath.Ext(programFile)) + ".state"
 	}
 
-	fmt.Printf("Assembling %s...\n", asmFile)
+	var backend assembler.Backend
+	switch *backendName {
+	case "bytecode":
+		backend = assembler.BackendBytecode
+	case "8086":
+		backend = assembler.Backend8086
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown backend %q (expected bytecode or 8086)\n", *backendName)
+		os.Exit(1)
+	}
+	if *outputFile != "" && backend != assembler.Backend8086 {
+		fmt.Fprintf(os.Stderr, "-o requires --backend 8086\n")
+		os.Exit(1)
+	}
 
-	// Assemble the code
-	lexer := assembler.NewLexer(string(source))
-	tokens, err := lexer.Tokenize()
+	model, err := emulator.ParseCPUModel(*cpuName)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Lexer error: %v\n", err)
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	clockHz, err := emulator.ParseClockSpeed(*cpuSpeed)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	policy, err := emulator.ParseExceptionPolicy(*exceptions)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
 		os.Exit(1)
 	}
 
-	// Preprocess constants
-	preprocessor := assembler.NewPreprocessor()
-	tokens, err = preprocessor.Process(tokens)
+	portPolicy, err := emulator.ParsePortPolicy(*unclaimedPorts)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Preprocessor error: %v\n", err)
+		fmt.Fprintf(os.Stderr, "%v\n", err)
 		os.Exit(1)
 	}
+	differential := strings.EqualFold(*engineName, "diff")
+	engine := emulator.EngineInterp
+	if !differential {
+		engine, err = emulator.ParseEngine(*engineName)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+	}
 
-	parser := assembler.NewParser(tokens)
-	program, err := parser.Parse()
+	// Read program file
+	source, err := os.ReadFile(programFile)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Parser error: %v\n", err)
+		fmt.Fprintf(os.Stderr, "Error reading file %s: %v\n", programFile, err)
 		os.Exit(1)
 	}
 
-	fmt.Printf("Assembly successful! Generated %d bytes of code, %d bytes of data.\n",
-		len(program.CodeBytes), len(program.DataBytes))
+	// Assemble-only mode: write a flat binary. .COM files load at offset
+	// 100h, raw .BIN images at offset 0.
+	if *outputFile != "" {
+		origin := uint16(emulator.COMEntryOffset)
+		if strings.EqualFold(filepath.Ext(*outputFile), ".bin") {
+			origin = 0
+		}
+		fmt.Printf("Assembling %s...\n", programFile)
+		program := assemble(source, backend, model, origin)
+		image := program.Flat()
+		if err := os.WriteFile(*outputFile, image, 0644); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing %s: %v\n", *outputFile, err)
+			os.Exit(1)
+		}
+		fmt.Printf("Wrote %d bytes to %s.\n", len(image), *outputFile)
+		return
+	}
 
-	// Create CPU
-	cpu := emulator.NewCPU()
+	// Pick the loader by file extension: .COM files are genuine 8086 binaries,
+	// everything else is assembly source
+	var load func(m *emulator.Machine) error
+	isCOM := strings.EqualFold(filepath.Ext(programFile), ".com")
+	if isCOM {
+		fmt.Printf("Loading DOS executable %s...\n", programFile)
+		load = func(m *emulator.Machine) error { return m.LoadCOM(source) }
+	} else {
+		// Real machine code runs as a .COM program, bytecode with its own
+		// segments
+		origin := uint16(0)
+		if backend == assembler.Backend8086 {
+			origin = emulator.COMEntryOffset
+		}
+		fmt.Printf("Assembling %s...\n", programFile)
+		program := assemble(source, backend, model, origin)
+		load = func(m *emulator.Machine) error { return m.LoadProgram(program) }
+	}
 
-	// Load code segment at address 0
-	codeBase := uint32(0)
-	cpu.Memory.LoadProgram(codeBase, program.CodeBytes)
+	var script []emulator.ScriptedKey
+	if *inputScript != "" {
+		file, err := os.Open(*inputScript)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading input script: %v\n", err)
+			os.Exit(1)
+		}
+		script, err = emulator.ParseInputScript(file)
+		file.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
 
-	// Load data segment after code (aligned to 16-byte paragraph boundary)
-	codeSize := uint32(len(program.CodeBytes))
-	dataBase := ((codeSize + 15) / 16) * 16 // Round up to next paragraph boundary
-	cpu.Memory.LoadProgram(dataBase, program.DataBytes)
+	// Create the machine
+	newMachine := func() *emulator.Machine {
+		m := emulator.NewMachine()
+		cpu := m.CPU
+		cpu.Model = model
+		cpu.ClockHz = clockHz
+		cpu.Exceptions = policy
+		cpu.UnclaimedPorts = portPolicy
+		cpu.Engine = engine
+		cpu.Deterministic = *deterministic
+		cpu.InputScript = script
+		if err := load(m); err != nil {
+			fmt.Fprintf(os.Stderr, "Loader error: %v\n", err)
+			os.Exit(1)
+		}
+		return m
+	}
+	machine := newMachine()
+	cpu := machine.CPU
+	if isCOM {
+		fmt.Printf("Loaded %d bytes at %04X:%04X.\n", len(source), cpu.CS, cpu.IP)
+	}
 
-	// Set segment registers
-	cpu.CS = 0x0000 // Code starts at 0
-	if len(program.DataBytes) > 0 {
-		// Calculate data segment value: dataBase / 16 (convert linear address to segment)
-		cpu.DS = uint16(dataBase / 16)
-		cpu.ES = uint16(dataBase / 16)
+	if differential {
+		block := newMachine().CPU
+		if *loadState != "" {
+			restoreState(cpu, *loadState)
+			restoreState(block, *loadState)
+		}
+		runDifferential(cpu, block, *diffSteps)
+		return
 	}
 
-	// Stack segment: place after data
-	dataSize := uint32(len(program.DataBytes))
-	stackBase := dataBase + dataSize
-	stackBase = ((stackBase + 15) / 16) * 16 // Align to paragraph boundary
-	cpu.SS = uint16(stackBase / 16)
-	// SP is already initialized to 0xFFFE in NewCPU()
+	// Record snapshots every half second of emulated frames for F6
+	var rewinder *emulator.Rewinder
 
 	// Setup graphics initialization callback
 	var graphicsStarted bool
 	var graphicsMutex sync.Mutex
 	graphicsDone := make(chan struct{})
 	var vgaDisplay *graphics.VGADisplay
+	var recorder *graphics.GIFRecorder
 
-	cpu.Mode13hCallback = func() {
+	// The window, or a GIF recording, opens once the program sets mode 13h
+	// or text mode
+	cpu.VideoModeCallback = func(mode uint8) {
+		if mode != 0x13 && mode != 0x02 && mode != 0x03 {
+			return
+		}
 		graphicsMutex.Lock()
 		defer graphicsMutex.Unlock()
 		if !graphicsStarted {
 			graphicsStarted = true
-			fmt.Println("Mode 13h detected - initializing graphics...")
+			fmt.Printf("Mode %02Xh detected - initializing graphics...\n", mode)
 
-			// Create VGA display immediately (before releasing mutex)
+			// Create VGA display immediately (before releasing mutex) and
+			// pass it the DAC entries set so far
 			vgaDisplay = graphics.NewVGADisplay(cpu.Memory)
+			machine.SetDisplay(vgaDisplay)
+
+			// A deterministic recording captures every other emulated frame
+			// (35 fps) on the CPU's goroutine and saves after Run returns
+			if *deterministic && *gifOutput != "" {
+				fmt.Printf("Recording %d emulated frames to %s...\n", *gifFrames, *gifOutput)
+				recorder = graphics.NewGIFRecorder(vgaDisplay, *gifFrames)
+				cpu.FrameCallback = func(frame uint64) {
+					if frame%2 != 0 || recorder.Done() {
+						return
+					}
+					if err := recorder.Capture(3); err != nil {
+						fmt.Fprintf(os.Stderr, "GIF recording error: %v\n", err)
+					}
+					if recorder.Done() {
+						machine.Stop()
+					}
+				}
+				close(graphicsDone)
+				return
+			}
 
-			// Create keyboard callback
+			// Create keyboard callback. Keys are delivered between
+			// instructions, so a rewind replays them at the same point.
+			// Deterministic runs take input only from the script.
 			keyCallback := func(scancode, ascii uint8) {
-				cpu.SetKeyPress(scancode, ascii)
+				if *deterministic {
+					return
+				}
+				cpu.Schedule(func() { cpu.SetKeyPress(scancode, ascii) })
+			}
+
+			// Save states and rewinds run between instructions on the CPU's
+			// goroutine
+			hotkeys := graphics.Hotkeys{
+				SaveState: func() {
+					cpu.Schedule(func() {
+						if err := saveStateFile(cpu, statePath); err != nil {
+							fmt.Fprintf(os.Stderr, "Save state error: %v\n", err)
+							return
+						}
+						fmt.Printf("Saved state to %s.\n", statePath)
+					})
+				},
+				Rewind: func() {
+					cpu.Schedule(func() {
+						if rewinder == nil || rewinder.Frames() == 0 {
+							return
+						}
+						if err := rewinder.RewindFrames(min(rewindHotkeyFrames, rewinder.Frames()-1)); err != nil {
+							fmt.Fprintf(os.Stderr, "Rewind error: %v\n", err)
+							return
+						}
+						fmt.Printf("Rewound to step %d.\n", cpu.Steps)
+					})
+				},
+				LoadState: func() {
+					cpu.Schedule(func() {
+						if err := loadStateFile(cpu, statePath); err != nil {
+							fmt.Fprintf(os.Stderr, "Load state error: %v\n", err)
+							return
+						}
+						fmt.Printf("Loaded state from %s.\n", statePath)
+					})
+				},
 			}
 
 			// Run graphics in goroutine
@@ -120,26 +298,24 @@ func main() {
 						fmt.Fprintf(os.Stderr, "GIF recording error: %v\n", err)
 					}
 					close(graphicsDone)
-					cpu.Stop()
+					machine.Stop()
 				} else {
-					if err := graphics.RunGraphicsWithDisplay(vgaDisplay, cpu, keyCallback); err != nil {
+					if err := graphics.RunGraphicsWithDisplay(vgaDisplay, cpu, keyCallback, hotkeys); err != nil {
 						fmt.Fprintf(os.Stderr, "Graphics error: %v\n", err)
 					}
 					close(graphicsDone)
 					// Signal CPU to stop when graphics window closes
-					cpu.Stop()
+					machine.Stop()
 				}
 			}()
 		}
 	}
 
-	// Setup palette manipulation callback
-	cpu.SetPaletteCallback = func(index byte, r, g, b byte) {
-		graphicsMutex.Lock()
-		defer graphicsMutex.Unlock()
-		if vgaDisplay != nil {
-			vgaDisplay.SetPaletteColor(index, r, g, b)
-		}
+	if *loadState != "" {
+		restoreState(cpu, *loadState)
+	}
+	if *rewindSeconds > 0 {
+		rewinder = emulator.NewRewinder(cpu, *rewindSeconds*2, rewindSnapshotFrames)
 	}
 
 	fmt.Println("Running program...")
@@ -147,35 +323,52 @@ func main() {
 	// Set start time for performance metrics
 	cpu.StartTime = time.Now().UnixNano()
 
-	// Run the program
-	err = cpu.Run()
+	// Run the program until it halts, the window closes or Ctrl+C
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	err = machine.Run(ctx)
+	cancel()
 
 	// Calculate performance statistics
-	ips, totalInst, elapsed := cpu.GetPerformanceStats(time.Now().UnixNano())
+	stats := cpu.GetPerformanceStats(time.Now().UnixNano())
 
-	if err != nil {
-		// Check if it's a stop signal (not a real error)
-		if err.Error() != "CPU stopped by external signal" {
-			fmt.Fprintf(os.Stderr, "Runtime error: %v\n", err)
-			os.Exit(1)
-		}
-		// If stopped by external signal, this is normal (window closed)
-		fmt.Println("Program stopped (window closed).")
-	} else {
+	halted := errors.Is(err, emulator.ErrHalted)
+	switch {
+	case halted:
 		fmt.Println("Program halted.")
 		fmt.Printf("Final CPU state: %s\n", cpu.String())
+	case errors.Is(err, context.Canceled):
+		fmt.Println("Program stopped (interrupted).")
+	case errors.Is(err, emulator.ErrStopped) && recorder != nil:
+		fmt.Println("Program stopped (recording finished).")
+	case errors.Is(err, emulator.ErrStopped):
+		fmt.Println("Program stopped (window closed).")
+	default:
+		fmt.Fprintf(os.Stderr, "Runtime error: %v\n", err)
+		var exception *emulator.Exception
+		if errors.As(err, &exception) {
+			fmt.Fprintf(os.Stderr, "CPU state: %s\n", cpu.String())
+		}
+		os.Exit(1)
 	}
 
 	// Print performance statistics
-	if elapsed > 0 {
+	if stats.ElapsedSec > 0 {
 		fmt.Printf("\nPerformance Statistics:\n")
-		fmt.Printf("  Total instructions: %d\n", totalInst)
-		fmt.Printf("  Elapsed time: %.2f seconds\n", elapsed)
-		fmt.Printf("  Instructions/second: %.0f (%.2f MHz equivalent)\n", ips, ips/1_000_000)
-		if cpu.FrameCounter > 0 {
-			fmt.Printf("  Frames rendered: %d\n", cpu.FrameCounter)
-			fmt.Printf("  Average FPS: %.1f\n", float64(cpu.FrameCounter)/elapsed)
-			fmt.Printf("  Instructions/frame: %.0f\n", float64(totalInst)/float64(cpu.FrameCounter))
+		fmt.Printf("  Total instructions: %d\n", stats.Instructions)
+		fmt.Printf("  Elapsed time: %.2f seconds\n", stats.ElapsedSec)
+		fmt.Printf("  Instructions/second: %.0f (%.2f MHz equivalent)\n", stats.InstructionsPerSec, stats.InstructionsPerSec/1_000_000)
+		fmt.Printf("  Emulated cycles: %d (%s at %.2f MHz effective)\n", stats.Cycles, cpu.Model, stats.CyclesPerSec/1_000_000)
+		if frames := cpu.FrameCounter.Load(); frames > 0 {
+			fmt.Printf("  Frames rendered: %d\n", frames)
+			fmt.Printf("  Average FPS: %.1f\n", float64(frames)/stats.ElapsedSec)
+			fmt.Printf("  Instructions/frame: %.0f\n", float64(stats.Instructions)/float64(frames))
+		}
+	}
+
+	if recorder != nil {
+		if err := recorder.Save(*gifOutput); err != nil {
+			fmt.Fprintf(os.Stderr, "GIF recording error: %v\n", err)
+			os.Exit(1)
 		}
 	}
 
@@ -184,7 +377,7 @@ func main() {
 	if graphicsStarted {
 		graphicsMutex.Unlock()
 		// Only wait if we haven't already been stopped
-		if err == nil {
+		if halted {
 			fmt.Println("Graphics window is open. Press ESC or close the window to exit.")
 			// Wait for graphics window to close
 			<-graphicsDone
@@ -193,3 +386,88 @@ func main() {
 		graphicsMutex.Unlock()
 	}
 }
+
+// assemble lexes, preprocesses and parses source with the given backend,
+// exiting on error
+func assemble(source []byte, backend assembler.Backend, model emulator.CPUModel, origin uint16) *assembler.Program {
+	lexer := assembler.NewLexer(string(source))
+	tokens, err := lexer.Tokenize()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Lexer error: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Preprocess constants
+	preprocessor := assembler.NewPreprocessor()
+	tokens, err = preprocessor.Process(tokens)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Preprocessor error: %v\n", err)
+		os.Exit(1)
+	}
+
+	parser := assembler.NewParser(tokens)
+	parser.SetBackend(backend, origin)
+	parser.SetCPU(model)
+	program, err := parser.Parse()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Parser error: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Assembly successful! Generated %d bytes of code, %d bytes of data.\n",
+		len(program.CodeBytes), len(program.DataBytes))
+	return program
+}
+
+// runDifferential runs the program headless on the interpreter and the
+// block engine side by side and exits with an error at the first
+// difference. Port 3DAh does not wait for a display, so both machines see
+// the same retrace timing.
+func runDifferential(interp, block *emulator.CPU, maxSteps uint64) {
+	interp.FrameSync, block.FrameSync = false, false
+	fmt.Printf("Comparing the interpreter and the block engine for up to %d steps...\n", maxSteps)
+	d := emulator.NewDifferential(interp, block)
+	err := d.Run(maxSteps)
+	var divergence *emulator.Divergence
+	if errors.As(err, &divergence) {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	if err != nil {
+		fmt.Printf("Both engines stopped after %d steps: %v\n", d.Steps, err)
+		return
+	}
+	fmt.Printf("The engines agree after %d steps.\n", d.Steps)
+}
+
+// saveStateFile writes the machine state to a file
+func saveStateFile(cpu *emulator.CPU, path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := cpu.SaveState(file); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// loadStateFile restores the machine state from a file
+func loadStateFile(cpu *emulator.CPU, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return cpu.LoadState(file)
+}
+
+// restoreState restores the state given to --load-state, exiting on error
+func restoreState(cpu *emulator.CPU, path string) {
+	if err := loadStateFile(cpu, path); err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading state %s: %v\n", path, err)
+		os.Exit(1)
+	}
+	fmt.Printf("Restored state from %s at %04X:%04X.\n", path, cpu.CS, cpu.IP)
+}